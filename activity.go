@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// userAgentMaxLength caps the stored user agents, which clients control.
+const userAgentMaxLength = 255
+
+type Activity struct {
+	Id         string `db:"id" json:"id"`
+	User       string `db:"user" json:"user"`
+	Method     string `db:"method" json:"method"`
+	Path       string `db:"path" json:"path"`
+	Status     int    `db:"status" json:"status"`
+	IP         string `db:"ip" json:"ip"`
+	UserAgent  string `db:"user_agent" json:"userAgent"`
+	DurationMs int64  `db:"duration_ms" json:"durationMs"`
+	Created    string `db:"created" json:"created"`
+}
+
+// Activities is the repository of the user_activity collection table,
+// written in batches by the ActivityRecorder.
+var Activities = NewRepository[Activity]("user_activity")
+
+// ActivityLog records the requests of the users, nil until the server
+// starts.
+var ActivityLog *ActivityRecorder
+
+// ActivityRecorder buffers the activity of the users and writes it in
+// batches, keeping only the latest historySize entries of every user.
+type ActivityRecorder struct {
+	app         core.App
+	batchSize   int
+	historySize int
+
+	mu      sync.Mutex
+	pending []Activity
+	// flushMu serializes the flushes, so that the pruning sees the rows of
+	// the previous batch.
+	flushMu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewActivityRecorder(app core.App, batchSize int, historySize int) *ActivityRecorder {
+	return &ActivityRecorder{
+		app:         app,
+		batchSize:   batchSize,
+		historySize: historySize,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start flushes the buffered activity every interval, until Shutdown.
+func (r *ActivityRecorder) Start(interval time.Duration) {
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.flushAndLog()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Record buffers an activity, flushing the batch in the background once it
+// is full.
+func (r *ActivityRecorder) Record(activity Activity) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.pending = append(r.pending, activity)
+	full := len(r.pending) >= r.batchSize
+	r.mu.Unlock()
+	if full {
+		Drain.Go(r.flushAndLog)
+	}
+}
+
+func (r *ActivityRecorder) flushAndLog() {
+	if err := r.Flush(); err != nil {
+		r.app.Logger().Warn("Failed to write user activity", "error", err)
+	}
+}
+
+// Flush writes the buffered activity in a single transaction and prunes
+// the history of the users it belongs to.
+func (r *ActivityRecorder) Flush() error {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	r.mu.Lock()
+	batch := r.pending
+	r.pending = nil
+	r.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	span := StartStorageSpan(r.app, "FlushActivity", "INSERT")
+	span.SetAttr("db.operation.batch.size", len(batch))
+	err := RetryWrite(r.app, func() error {
+		return WithTx(r.app, func(txApp core.App) error {
+			users := map[string]bool{}
+			for _, activity := range batch {
+				users[activity.User] = true
+				_, err := txApp.DB().Insert(Activities.Table, dbx.Params{
+					"id":          NewId(Activities.Table),
+					"user":        activity.User,
+					"method":      activity.Method,
+					"path":        activity.Path,
+					"status":      activity.Status,
+					"ip":          activity.IP,
+					"user_agent":  activity.UserAgent,
+					"duration_ms": activity.DurationMs,
+					"created":     activity.Created,
+				}).Execute()
+				if err != nil {
+					return err
+				}
+			}
+			for userId := range users {
+				_, err := txApp.DB().NewQuery(
+					"DELETE FROM {{user_activity}} WHERE [[user]] = {:user} AND [[id]] NOT IN (" +
+						"SELECT [[id]] FROM {{user_activity}} WHERE [[user]] = {:user} ORDER BY [[created]] DESC LIMIT {:keep})",
+				).Bind(dbx.Params{"user": userId, "keep": r.historySize}).Execute()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	span.End(err)
+	return err
+}
+
+// Shutdown stops the periodic flushes and writes what is left.
+func (r *ActivityRecorder) Shutdown() error {
+	if r == nil {
+		return nil
+	}
+	close(r.stop)
+	<-r.done
+	return r.Flush()
+}
+
+// TrackActivity records the requests of authenticated users to the custom
+// routes, except the probes, with ActivityLog.
+func TrackActivity() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil || e.Auth.Collection().Name != Users.Table || !shouldLogRequest(e.Request.URL.Path) {
+			return e.Next()
+		}
+
+		start := time.Now()
+		err := e.Next()
+
+		status := e.Status()
+		if err != nil && status == 0 {
+			status = http.StatusInternalServerError
+		}
+		created, _ := types.ParseDateTime(start)
+		userAgent := e.Request.UserAgent()
+		if len(userAgent) > userAgentMaxLength {
+			userAgent = userAgent[:userAgentMaxLength]
+		}
+		ActivityLog.Record(Activity{
+			User:       e.Auth.Id,
+			Method:     e.Request.Method,
+			Path:       e.Request.URL.Path,
+			Status:     status,
+			IP:         e.RealIP(),
+			UserAgent:  userAgent,
+			DurationMs: time.Since(start).Milliseconds(),
+			Created:    created.String(),
+		})
+		return err
+	}
+}
+
+func HandleGetUserActivity(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		opts, err := ParseListOptions(e.Request.URL.Query(), []string{"created"}, cfg)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if len(opts.Sort) == 0 {
+			opts.Sort = []SortField{{Field: "created", Desc: true}}
+		}
+		opts.Filter = dbx.HashExp{"user": userId}
+
+		if _, err := GetUserById(app, userId); errors.Is(err, sql.ErrNoRows) {
+			return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+		} else if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+
+		span := StartStorageSpan(app, "GetUserActivity", "SELECT")
+		total, err := Activities.Count(app, opts.Filter)
+		if err != nil {
+			span.End(err)
+			return WriteInternalServerError(e, "error counting activity: "+err.Error(), nil)
+		}
+		activity, err := Activities.FindAll(app, opts)
+		span.SetAttr("db.response.returned_rows", len(activity))
+		span.End(err)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting activity: "+err.Error(), nil)
+		}
+		return WriteOK(e, "", NewListPage(activity, opts, total))
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+//go:embed adminui
+var embeddedAdminUI embed.FS
+
+// adminUIPolicy keeps the dashboard to its own files and to the routes of
+// the app, the only place the superuser token it holds is sent.
+const adminUIPolicy = "default-src 'self'; frame-ancestors 'none'; base-uri 'none'; form-action 'self'"
+
+// AdminUIConfig is the config.json of the admin dashboard, for what it
+// can't hardcode.
+type AdminUIConfig struct {
+	Roles []string `json:"roles"`
+}
+
+// HandleAdminUI serves the admin dashboard embedded in the binary under
+// /admin-ui/, for the staff managing the users without the PocketBase
+// dashboard. It is public: the dashboard signs in as a superuser and the
+// routes it calls check the token.
+func HandleAdminUI() func(e *core.RequestEvent) error {
+	fsys, err := fs.Sub(embeddedAdminUI, "adminui")
+	if err != nil {
+		panic(err)
+	}
+	serve := apis.Static(fsys, true)
+
+	return func(e *core.RequestEvent) error {
+		header := e.Response.Header()
+		header.Set("Cache-Control", CacheControlNoCache)
+		header.Set("Content-Security-Policy", adminUIPolicy)
+		header.Set("X-Content-Type-Options", "nosniff")
+		if e.Request.PathValue(apis.StaticWildcardParam) == "config.json" {
+			return e.JSON(http.StatusOK, AdminUIConfig{Roles: Roles})
+		}
+		return serve(e)
+	}
+}
@@ -0,0 +1,290 @@
+"use strict";
+
+// The admin dashboard, a single page talking to the custom routes with the
+// token of a superuser. The views are picked by the location hash:
+//
+//	#/users?page=2&q=ann   the users, searched by name or email
+//	#/users/<id>           the edit form and the roles of a user
+//	#/audit?filter=...     the audit log
+
+const tokenKey = "adminUIToken";
+const perPage = 20;
+
+let config = { roles: [] };
+
+const $ = (id) => document.getElementById(id);
+
+function token() {
+	return sessionStorage.getItem(tokenKey);
+}
+
+function showError(message) {
+	$("error").textContent = message;
+	$("error").hidden = !message;
+}
+
+// api calls a route, returning the data of its APIResp envelope. The
+// expired tokens send back to the sign in form.
+async function api(method, path, body) {
+	const headers = { Accept: "application/json" };
+	if (token()) {
+		headers.Authorization = token();
+	}
+	if (body !== undefined) {
+		headers["Content-Type"] = "application/json";
+	}
+	const resp = await fetch(path, { method, headers, body: body === undefined ? undefined : JSON.stringify(body) });
+	const payload = await resp.json().catch(() => ({}));
+	if (resp.status === 401) {
+		sessionStorage.removeItem(tokenKey);
+		route();
+	}
+	if (!resp.ok) {
+		const details = payload.data && typeof payload.data === "object" ? Object.entries(payload.data).map(([k, v]) => `${k}: ${v.message || v}`) : [];
+		throw new Error([payload.message || resp.statusText, ...details].join(" - "));
+	}
+	return payload.data !== undefined ? payload.data : payload;
+}
+
+function el(tag, text, attrs) {
+	const node = document.createElement(tag);
+	if (text !== undefined && text !== null) {
+		node.textContent = String(text);
+	}
+	for (const [name, value] of Object.entries(attrs || {})) {
+		node.setAttribute(name, value);
+	}
+	return node;
+}
+
+function formatDate(value) {
+	if (!value) {
+		return "";
+	}
+	const date = new Date(value.replace(" ", "T"));
+	return isNaN(date) ? value : date.toLocaleString();
+}
+
+// quote escapes a value of a ?filter= expression.
+function quote(value) {
+	return '"' + value.replace(/\\/g, "\\\\").replace(/"/g, '\\"') + '"';
+}
+
+function renderPager(container, page, onPage) {
+	container.replaceChildren();
+	const prev = el("button", "Previous", { type: "button" });
+	prev.disabled = page.page <= 1;
+	prev.onclick = () => onPage(page.page - 1);
+	const next = el("button", "Next", { type: "button" });
+	next.disabled = page.page >= page.totalPages;
+	next.onclick = () => onPage(page.page + 1);
+	container.append(prev, el("span", `Page ${page.page} of ${Math.max(page.totalPages, 1)}, ${page.totalItems} in total`), next);
+}
+
+function hashParams() {
+	const [, query] = location.hash.split("?");
+	return new URLSearchParams(query || "");
+}
+
+function navigate(path, params) {
+	const query = new URLSearchParams(Object.entries(params || {}).filter(([, v]) => v !== "" && v !== undefined)).toString();
+	location.hash = path + (query ? "?" + query : "");
+}
+
+async function showUsers() {
+	const params = hashParams();
+	const q = params.get("q") || "";
+	const page = Number(params.get("page")) || 1;
+	$("search-form").q.value = q;
+
+	const query = new URLSearchParams({ page, perPage, sort: "-created" });
+	if (q) {
+		query.set("filter", `name~${quote(q)} OR email~${quote(q)}`);
+	}
+	const result = await api("GET", "/users?" + query);
+	const rows = result.items.map((user) => {
+		const row = el("tr", undefined, { class: "link" });
+		row.append(
+			el("td", user.name),
+			el("td", user.email),
+			el("td", user.verified ? "yes" : "no"),
+			el("td", (user.roles || []).join(", ")),
+			el("td", formatDate(user.lastSeen)),
+			el("td", formatDate(user.created)),
+		);
+		row.onclick = () => navigate("/users/" + encodeURIComponent(user.id));
+		return row;
+	});
+	$("users-rows").replaceChildren(...rows);
+	renderPager($("users-pager"), result, (p) => navigate("/users", { q, page: p }));
+}
+
+let editedUser = null;
+
+async function showUser(id) {
+	editedUser = await api("GET", "/users/" + encodeURIComponent(id));
+	const form = $("user-form");
+	$("user-title").textContent = editedUser.name || editedUser.email;
+	$("user-saved").hidden = true;
+	form.name.value = editedUser.name || "";
+	form.email.value = editedUser.email || "";
+	form.emailVisibility.checked = !!editedUser.emailVisibility;
+	form.phone.value = editedUser.phone || "";
+	form.nationalId.value = editedUser.nationalId || "";
+	$("user-audit").href = "#/audit?" + new URLSearchParams({ filter: "target_id=" + quote(editedUser.id) });
+	renderRoles();
+}
+
+function renderRoles() {
+	const boxes = config.roles.map((role) => {
+		const label = el("label", undefined, { class: "check" });
+		const box = el("input", undefined, { type: "checkbox" });
+		box.checked = (editedUser.roles || []).includes(role);
+		box.onchange = () => toggleRole(role, box);
+		label.append(box, " " + role);
+		return label;
+	});
+	$("user-roles").replaceChildren(...boxes);
+}
+
+async function toggleRole(role, box) {
+	const path = "/users/" + encodeURIComponent(editedUser.id) + "/roles";
+	try {
+		// the routes answer with the updated user
+		editedUser = box.checked
+			? await api("POST", path, { role })
+			: await api("DELETE", path + "/" + encodeURIComponent(role));
+		showError("");
+	} catch (err) {
+		box.checked = !box.checked;
+		showError(err.message);
+	}
+}
+
+async function saveUser(event) {
+	event.preventDefault();
+	const form = event.target;
+	try {
+		// the update fails if the user changed since it was loaded
+		const result = await api("PATCH", "/users/" + encodeURIComponent(editedUser.id), {
+			name: form.name.value,
+			email: form.email.value,
+			emailVisibility: form.emailVisibility.checked,
+			phone: form.phone.value,
+			nationalId: form.nationalId.value,
+			expectedUpdated: editedUser.updated,
+		});
+		editedUser = result.user;
+		$("user-title").textContent = editedUser.name || editedUser.email;
+		$("user-saved").hidden = false;
+		showError("");
+	} catch (err) {
+		showError(err.message);
+	}
+}
+
+async function showAudit() {
+	const params = hashParams();
+	const filter = params.get("filter") || "";
+	const page = Number(params.get("page")) || 1;
+	$("audit-form").filter.value = filter;
+
+	const query = new URLSearchParams({ page, perPage });
+	if (filter) {
+		query.set("filter", filter);
+	}
+	const result = await api("GET", "/admin/audit?" + query);
+	const rows = result.items.map((log) => {
+		const row = el("tr");
+		const changes = el("td");
+		if (log.changes) {
+			const details = el("details");
+			details.append(el("summary", "Show"), el("pre", JSON.stringify(log.changes, null, 2)));
+			changes.append(details);
+		}
+		const target = el("td");
+		if (log.targetId) {
+			target.append(el("a", log.targetId, { href: "#/users/" + encodeURIComponent(log.targetId) }));
+		}
+		row.append(
+			el("td", formatDate(log.created)),
+			el("td", `${log.actorType} ${log.actorId}` + (log.impersonatorId ? ` (as ${log.impersonatorId})` : "")),
+			el("td", log.action),
+			el("td", `${log.method} ${log.path}`),
+			target,
+			el("td", log.status),
+			changes,
+		);
+		return row;
+	});
+	$("audit-rows").replaceChildren(...rows);
+	renderPager($("audit-pager"), result, (p) => navigate("/audit", { filter, page: p }));
+}
+
+function show(section) {
+	for (const id of ["login", "users", "user", "audit"]) {
+		$(id).hidden = id !== section;
+	}
+	$("nav").hidden = section === "login";
+}
+
+async function route() {
+	showError("");
+	if (!token()) {
+		show("login");
+		return;
+	}
+	const [path] = location.hash.slice(1).split("?");
+	const userMatch = path.match(/^\/users\/([^/]+)$/);
+	try {
+		if (userMatch) {
+			show("user");
+			await showUser(decodeURIComponent(userMatch[1]));
+		} else if (path === "/audit") {
+			show("audit");
+			await showAudit();
+		} else {
+			show("users");
+			await showUsers();
+		}
+	} catch (err) {
+		showError(err.message);
+	}
+}
+
+async function login(event) {
+	event.preventDefault();
+	const form = event.target;
+	try {
+		const auth = await api("POST", "/api/collections/_superusers/auth-with-password", {
+			identity: form.identity.value,
+			password: form.password.value,
+		});
+		sessionStorage.setItem(tokenKey, auth.token);
+		form.password.value = "";
+		route();
+	} catch (err) {
+		showError(err.message);
+	}
+}
+
+document.addEventListener("DOMContentLoaded", async () => {
+	$("login-form").onsubmit = login;
+	$("user-form").onsubmit = saveUser;
+	$("search-form").onsubmit = (event) => {
+		event.preventDefault();
+		navigate("/users", { q: event.target.q.value.trim() });
+	};
+	$("audit-form").onsubmit = (event) => {
+		event.preventDefault();
+		navigate("/audit", { filter: event.target.filter.value.trim() });
+	};
+	$("logout").onclick = () => {
+		sessionStorage.removeItem(tokenKey);
+		route();
+	};
+	window.addEventListener("hashchange", route);
+
+	config = await fetch("config.json").then((resp) => resp.json()).catch(() => config);
+	route();
+});
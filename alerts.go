@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+)
+
+// The types of the operator alerts, routed to the channels by
+// ALERT_ROUTES.
+const (
+	AlertAppStarted       = "app.started"
+	AlertAppStopped       = "app.stopped"
+	AlertMigrationApplied = "migration.applied"
+	AlertErrorRateSpike   = "error_rate.spike"
+	AlertBackupCompleted  = "backup.completed"
+	AlertBackupFailed     = "backup.failed"
+	AlertWebhookFailed    = "webhook.delivery_failed"
+	// AlertTest is sent by POST /admin/alerts/test to every channel,
+	// whatever the routes and the throttling.
+	AlertTest = "test"
+)
+
+var AlertTypes = []string{AlertAppStarted, AlertAppStopped, AlertMigrationApplied, AlertErrorRateSpike,
+	AlertBackupCompleted, AlertBackupFailed, AlertWebhookFailed}
+
+// The kinds of the channels of ALERT_CHANNELS, i.e. the incoming webhooks
+// of Slack and Discord.
+const (
+	AlertChannelSlack   = "slack"
+	AlertChannelDiscord = "discord"
+)
+
+const (
+	AlertLevelInfo    = "info"
+	AlertLevelWarning = "warning"
+	AlertLevelError   = "error"
+)
+
+const alertTimeout = 10 * time.Second
+
+// the colors of the levels, as the Slack attachments and the Discord
+// embeds show them
+var alertColors = map[string]int{
+	AlertLevelInfo:    0x2eb67d,
+	AlertLevelWarning: 0xecb22e,
+	AlertLevelError:   0xe01e5a,
+}
+
+var ErrUnknownAlertChannel = errors.New("unknown alert channel")
+
+// Alerts posts the operator alerts, nil when ALERT_CHANNELS is empty.
+var Alerts *Alerter
+
+type Alert struct {
+	Type    string
+	Level   string
+	Title   string
+	Message string
+	// Key tells apart the alerts of a type throttled separately, e.g. the
+	// failures of each webhook.
+	Key    string
+	Fields []AlertField
+}
+
+type AlertField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// AlertChannel is an incoming webhook of ALERT_CHANNELS.
+type AlertChannel struct {
+	Name string
+	Kind string
+	URL  string
+}
+
+// AlertResult is the outcome of POST /admin/alerts/test for a channel.
+type AlertResult struct {
+	Channel string `json:"channel"`
+	Kind    string `json:"kind"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ParseAlertChannels reads the name:kind:url entries of ALERT_CHANNELS,
+// e.g. ops:slack:https://hooks.slack.com/services/...
+func ParseAlertChannels(entries []string) ([]AlertChannel, error) {
+	channels := []AlertChannel{}
+	for _, entry := range entries {
+		name, rest, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		kind, rawURL, ok := strings.Cut(rest, ":")
+		// the url is left out of the errors, it carries the token of the
+		// webhook
+		if !ok || name == "" || name == "*" {
+			return nil, errors.New("invalid entry, expected name:kind:url")
+		}
+		if kind != AlertChannelSlack && kind != AlertChannelDiscord {
+			return nil, fmt.Errorf("channel %s: unknown kind %q, expected slack or discord", name, kind)
+		}
+		if u, err := url.Parse(rawURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return nil, fmt.Errorf("channel %s: invalid url", name)
+		}
+		if slices.ContainsFunc(channels, func(c AlertChannel) bool { return c.Name == name }) {
+			return nil, fmt.Errorf("duplicate channel %s", name)
+		}
+		channels = append(channels, AlertChannel{Name: name, Kind: kind, URL: rawURL})
+	}
+	return channels, nil
+}
+
+// ParseAlertRoutes reads the type:channel entries of ALERT_ROUTES into the
+// channels of each alert type, * routing every type. Without any entry
+// every type goes to every channel.
+func ParseAlertRoutes(entries []string, channels []AlertChannel) (map[string][]string, error) {
+	routes := map[string][]string{}
+	if len(entries) == 0 {
+		for _, alertType := range AlertTypes {
+			for _, channel := range channels {
+				routes[alertType] = append(routes[alertType], channel.Name)
+			}
+		}
+		return routes, nil
+	}
+	for _, entry := range entries {
+		alertType, channel, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q, expected type:channel", entry)
+		}
+		if alertType != "*" && !slices.Contains(AlertTypes, alertType) {
+			return nil, fmt.Errorf("unknown alert type %q, expected * or one of %s", alertType, strings.Join(AlertTypes, ", "))
+		}
+		if !slices.ContainsFunc(channels, func(c AlertChannel) bool { return c.Name == channel }) {
+			return nil, fmt.Errorf("%w %q", ErrUnknownAlertChannel, channel)
+		}
+		types := []string{alertType}
+		if alertType == "*" {
+			types = AlertTypes
+		}
+		for _, t := range types {
+			if !slices.Contains(routes[t], channel) {
+				routes[t] = append(routes[t], channel)
+			}
+		}
+	}
+	return routes, nil
+}
+
+type alertThrottle struct {
+	sent       time.Time
+	suppressed int
+}
+
+// Alerter posts the alerts to the channels their type is routed to. An
+// alert of the same type and key as one sent within throttle is only
+// counted, and reported along with the next one sent.
+type Alerter struct {
+	app      core.App
+	channels map[string]AlertChannel
+	routes   map[string][]string
+	throttle time.Duration
+	client   *http.Client
+
+	mu        sync.Mutex
+	throttled map[string]*alertThrottle
+}
+
+func NewAlerter(app core.App, channels []AlertChannel, routes map[string][]string, throttle time.Duration) *Alerter {
+	a := &Alerter{
+		app:       app,
+		channels:  map[string]AlertChannel{},
+		routes:    routes,
+		throttle:  throttle,
+		client:    Downstream.Client(DependencyAlerts, alertTimeout),
+		throttled: map[string]*alertThrottle{},
+	}
+	for _, channel := range channels {
+		a.channels[channel.Name] = channel
+	}
+	return a
+}
+
+// Notify posts alert in the background, unless throttled. A nil Alerter
+// drops the alerts.
+func (a *Alerter) Notify(alert Alert) {
+	if a == nil {
+		return
+	}
+	alert, ok := a.admit(alert, time.Now())
+	if !ok {
+		return
+	}
+	Drain.Go(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+		defer cancel()
+		a.post(ctx, alert)
+	})
+}
+
+// NotifyNow posts alert and waits for it, e.g. on shutdown.
+func (a *Alerter) NotifyNow(ctx context.Context, alert Alert) {
+	if a == nil {
+		return
+	}
+	if alert, ok := a.admit(alert, time.Now()); ok {
+		a.post(ctx, alert)
+	}
+}
+
+// admit reports whether alert may be sent at now, adding the count of the
+// alerts throttled since the last one.
+func (a *Alerter) admit(alert Alert, now time.Time) (Alert, bool) {
+	if len(a.routes[alert.Type]) == 0 {
+		return alert, false
+	}
+	if a.throttle <= 0 {
+		return alert, true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := alert.Type + "\x00" + alert.Key
+	state, ok := a.throttled[key]
+	if ok && now.Sub(state.sent) < a.throttle {
+		state.suppressed++
+		return alert, false
+	}
+	if ok && state.suppressed > 0 {
+		alert.Fields = append(alert.Fields, AlertField{Name: "Throttled", Value: strconv.Itoa(state.suppressed) + " similar alerts since " + state.sent.UTC().Format(time.RFC3339)})
+	}
+	a.throttled[key] = &alertThrottle{sent: now}
+	// the states past the throttle are the same as missing ones, but for
+	// the count of the throttled alerts
+	for k, s := range a.throttled {
+		if now.Sub(s.sent) >= a.throttle && s.suppressed == 0 {
+			delete(a.throttled, k)
+		}
+	}
+	return alert, true
+}
+
+func (a *Alerter) post(ctx context.Context, alert Alert) {
+	for _, name := range a.routes[alert.Type] {
+		channel := a.channels[name]
+		if err := a.postTo(ctx, channel, alert); err != nil {
+			a.app.Logger().Warn("Failed to post alert", "type", alert.Type, "channel", channel.Name, "error", err)
+		}
+	}
+}
+
+// Test posts a test alert to every channel, returning how each went.
+func (a *Alerter) Test(ctx context.Context) []AlertResult {
+	alert := Alert{
+		Type:    AlertTest,
+		Level:   AlertLevelInfo,
+		Title:   "Test alert",
+		Message: "The alerts of " + a.app.Settings().Meta.AppName + " reach this channel.",
+	}
+	results := []AlertResult{}
+	for _, channel := range a.channels {
+		result := AlertResult{Channel: channel.Name, Kind: channel.Kind}
+		if err := a.postTo(ctx, channel, alert); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	slices.SortFunc(results, func(x, y AlertResult) int { return strings.Compare(x.Channel, y.Channel) })
+	return results
+}
+
+func (a *Alerter) postTo(ctx context.Context, channel AlertChannel, alert Alert) error {
+	payload, err := json.Marshal(a.payload(channel.Kind, alert))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, channel.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		// the url error would log the token of the webhook
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// payload returns the message of alert for a Slack or a Discord incoming
+// webhook, an attachment or an embed of the color of its level.
+func (a *Alerter) payload(kind string, alert Alert) any {
+	source := a.app.Settings().Meta.AppName
+	if host, err := os.Hostname(); err == nil {
+		source += " on " + host
+	}
+	color := alertColors[alert.Level]
+	if kind == AlertChannelDiscord {
+		fields := make([]map[string]any, len(alert.Fields))
+		for i, field := range alert.Fields {
+			fields[i] = map[string]any{"name": field.Name, "value": field.Value, "inline": true}
+		}
+		return map[string]any{
+			"username": a.app.Settings().Meta.AppName,
+			"embeds": []map[string]any{{
+				"title":       alert.Title,
+				"description": alert.Message,
+				"color":       color,
+				"fields":      fields,
+				"footer":      map[string]string{"text": source + " · " + alert.Type},
+				"timestamp":   time.Now().UTC().Format(time.RFC3339),
+			}},
+		}
+	}
+
+	fields := make([]map[string]any, len(alert.Fields))
+	for i, field := range alert.Fields {
+		fields[i] = map[string]any{"title": field.Name, "value": field.Value, "short": true}
+	}
+	return map[string]any{
+		"text": alert.Title,
+		"attachments": []map[string]any{{
+			"color":  fmt.Sprintf("#%06x", color),
+			"title":  alert.Title,
+			"text":   alert.Message,
+			"fields": fields,
+			"footer": source + " · " + alert.Type,
+			"ts":     time.Now().Unix(),
+		}},
+	}
+}
+
+// AppliedMigrationsSince returns the files of the migrations applied from
+// since, e.g. by the serve of this process.
+func AppliedMigrationsSince(app core.App, since time.Time) ([]string, error) {
+	files := []string{}
+	err := app.DB().Select("file").
+		From(core.DefaultMigrationsTable).
+		Where(dbx.NewExp("[[applied]] >= {:since}", dbx.Params{"since": since.UnixMicro()})).
+		OrderBy("applied", "file").
+		Column(&files)
+	return files, err
+}
+
+// BindAlertHooks sends the alerts of the lifecycle of the app, of the
+// migrations it applied on serve and of its backups.
+func BindAlertHooks(app core.App, started time.Time) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		if err := se.Next(); err != nil {
+			return err
+		}
+		files, err := AppliedMigrationsSince(se.App, started)
+		if err != nil {
+			se.App.Logger().Warn("Failed to list the applied migrations", "error", err)
+		}
+		if len(files) > 0 {
+			Alerts.Notify(Alert{
+				Type:    AlertMigrationApplied,
+				Level:   AlertLevelWarning,
+				Title:   strconv.Itoa(len(files)) + " migrations applied",
+				Message: strings.Join(files, "\n"),
+			})
+		}
+		Alerts.Notify(Alert{
+			Type:    AlertAppStarted,
+			Level:   AlertLevelInfo,
+			Title:   "App started",
+			Message: "Serving " + se.App.Settings().Meta.AppURL,
+			Fields:  []AlertField{{Name: "Startup", Value: time.Since(started).Round(time.Millisecond).String()}},
+		})
+		return nil
+	})
+
+	app.OnTerminate().Bind(&hook.Handler[*core.TerminateEvent]{
+		Id: "alertStopped",
+		// before the graceful shutdown, for the operators to know it began
+		Priority: -10001,
+		Func: func(e *core.TerminateEvent) error {
+			ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+			defer cancel()
+			title := "App stopping"
+			if e.IsRestart {
+				title = "App restarting"
+			}
+			Alerts.NotifyNow(ctx, Alert{
+				Type:   AlertAppStopped,
+				Level:  AlertLevelWarning,
+				Title:  title,
+				Fields: []AlertField{{Name: "Uptime", Value: time.Since(started).Round(time.Second).String()}},
+			})
+			return e.Next()
+		},
+	})
+
+	app.OnBackupCreate().BindFunc(func(e *core.BackupEvent) error {
+		start := time.Now()
+		err := e.Next()
+		fields := []AlertField{{Name: "Name", Value: e.Name}, {Name: "Duration", Value: time.Since(start).Round(time.Millisecond).String()}}
+		if err != nil {
+			Alerts.Notify(Alert{Type: AlertBackupFailed, Level: AlertLevelError, Title: "Backup failed", Message: err.Error(), Fields: fields})
+			return err
+		}
+		Alerts.Notify(Alert{Type: AlertBackupCompleted, Level: AlertLevelInfo, Title: "Backup completed", Fields: fields})
+		return nil
+	})
+}
+
+// ErrorRateMonitor alerts when the share of the requests of the custom
+// routes answered with a 5xx reaches percent within a window, from
+// minRequests requests. The window is checked by the first request past
+// its end, a quiet app having no rate to spike.
+type ErrorRateMonitor struct {
+	percent     int
+	window      time.Duration
+	minRequests int
+
+	mu       sync.Mutex
+	start    time.Time
+	requests int
+	errors   int
+}
+
+func NewErrorRateMonitor(percent int, window time.Duration, minRequests int) *ErrorRateMonitor {
+	return &ErrorRateMonitor{percent: percent, window: window, minRequests: minRequests, start: time.Now()}
+}
+
+// Observe counts a response with status at now, returning the alert of the
+// window it ended if it spiked.
+func (m *ErrorRateMonitor) Observe(status int, now time.Time) (Alert, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var alert Alert
+	spiked := false
+	if now.Sub(m.start) >= m.window {
+		if m.requests >= m.minRequests && m.errors*100 >= m.percent*m.requests {
+			spiked = true
+			alert = Alert{
+				Type:    AlertErrorRateSpike,
+				Level:   AlertLevelError,
+				Title:   "Error rate spike",
+				Message: fmt.Sprintf("%d%% of the requests failed with a 5xx in the last %s.", m.errors*100/m.requests, now.Sub(m.start).Round(time.Second)),
+				Fields: []AlertField{
+					{Name: "Errors", Value: strconv.Itoa(m.errors)},
+					{Name: "Requests", Value: strconv.Itoa(m.requests)},
+					{Name: "Threshold", Value: strconv.Itoa(m.percent) + "%"},
+				},
+			}
+		}
+		m.start, m.requests, m.errors = now, 0, 0
+	}
+	m.requests++
+	if status >= http.StatusInternalServerError {
+		m.errors++
+	}
+	return alert, spiked
+}
+
+// AlertOnErrorRate feeds the responses of the custom routes to m, posting
+// its alerts.
+func AlertOnErrorRate(m *ErrorRateMonitor) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if IsPocketBasePath(e.Request.URL.Path) {
+			return e.Next()
+		}
+		err := e.Next()
+		status := e.Status()
+		if err != nil && status == 0 {
+			status = http.StatusInternalServerError
+		}
+		if alert, ok := m.Observe(status, time.Now()); ok {
+			Alerts.Notify(alert)
+		}
+		return err
+	}
+}
+
+// HandleTestAlert posts a test alert to every channel of ALERT_CHANNELS.
+func HandleTestAlert() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if Alerts == nil {
+			return WriteNotFound(e, "no alert channel, see ALERT_CHANNELS", nil)
+		}
+		return WriteOK(e, "", Alerts.Test(e.Request.Context()))
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+const (
+	APIKeyScopeRead  = "read"
+	APIKeyScopeWrite = "write"
+)
+
+// apiKeyTokenPrefix makes the keys easy to spot, e.g. by secret scanners.
+const apiKeyTokenPrefix = "pbd_"
+
+const apiKeyRequestKey = "apiKey"
+
+var (
+	ErrInvalidAPIKey      = errors.New("invalid api key")
+	ErrInvalidAPIKeyScope = errors.New("invalid api key scope, expected read or write")
+	ErrAPIKeyRevoked      = errors.New("api key is already revoked")
+)
+
+// APIKey is an api_keys row. The key itself is only stored hashed, Prefix
+// is its first characters, enough to tell the keys apart.
+type APIKey struct {
+	Id       string `db:"id" json:"id"`
+	Name     string `db:"name" json:"name"`
+	Prefix   string `db:"prefix" json:"prefix"`
+	Scope    string `db:"scope" json:"scope"`
+	LastUsed string `db:"last_used" json:"lastUsed"`
+	Revoked  string `db:"revoked" json:"revoked"`
+	Created  string `db:"created" json:"created"`
+	// RequireSignature refuses the requests of the key that aren't signed
+	// with SigningSecret, see RequestSigning.
+	RequireSignature bool   `db:"require_signature" json:"requireSignature"`
+	SigningSecret    string `db:"signing_secret" json:"-"`
+}
+
+// CreatedAPIKey is returned once, when the key is minted. The key can't be
+// recovered afterwards, and neither can the secret signing its requests
+// from the API.
+type CreatedAPIKey struct {
+	APIKey
+	Key           string `json:"key"`
+	SigningSecret string `json:"signingSecret"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name             string `json:"name" binding:"required,max=100"`
+	Scope            string `json:"scope" default:"read"`
+	RequireSignature bool   `json:"requireSignature"`
+}
+
+var APIKeys = NewRepository[APIKey]("api_keys")
+
+// apiKeyLastUsed throttles the last_used writes to one per key and minute.
+var apiKeyLastUsed = NewLastSeenTracker(time.Minute, 10000)
+
+// Allows reports whether the key may be used for a request with method.
+// Read keys are limited to the safe methods.
+func (k *APIKey) Allows(method string) bool {
+	if k.Scope == APIKeyScopeWrite {
+		return true
+	}
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateAPIKey returns a new random key and its displayable prefix.
+func GenerateAPIKey() (key string, prefix string) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	key = apiKeyTokenPrefix + hex.EncodeToString(secret)
+	return key, key[:len(apiKeyTokenPrefix)+8]
+}
+
+// CreateAPIKey mints a key along with the secret signing its requests,
+// which are refused unsigned when requireSignature is set.
+func CreateAPIKey(app core.App, name string, scope string, requireSignature bool) (*CreatedAPIKey, error) {
+	if !slices.Contains([]string{APIKeyScopeRead, APIKeyScopeWrite}, scope) {
+		return nil, ErrInvalidAPIKeyScope
+	}
+	collection, err := app.FindCachedCollectionByNameOrId("api_keys")
+	if err != nil {
+		return nil, err
+	}
+
+	key, prefix := GenerateAPIKey()
+	record := core.NewRecord(collection)
+	record.Set("name", name)
+	record.Set("prefix", prefix)
+	record.Set("key_hash", HashAPIKey(key))
+	record.Set("scope", scope)
+	record.Set("signing_secret", NewWebhookSecret())
+	record.Set("require_signature", requireSignature)
+	if err := RetryWrite(app, func() error { return app.Save(record) }); err != nil {
+		return nil, err
+	}
+
+	created, err := APIKeys.Find(app, record.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &CreatedAPIKey{APIKey: *created, Key: key, SigningSecret: created.SigningSecret}, nil
+}
+
+func ListAPIKeys(app core.App) ([]APIKey, error) {
+	return APIKeys.FindAll(app, ListOptions{Sort: []SortField{{Field: "created", Desc: true}}})
+}
+
+// FindAPIKey returns the unrevoked key matching key, or ErrInvalidAPIKey.
+func FindAPIKey(app core.App, key string) (*APIKey, error) {
+	apiKey, err := APIKeys.FindOne(app, dbx.HashExp{"key_hash": HashAPIKey(key), "revoked": ""})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidAPIKey
+	}
+	return apiKey, err
+}
+
+// RevokeAPIKey marks the key as revoked at now, after which it is rejected.
+func RevokeAPIKey(app core.App, id string, now time.Time) (*APIKey, error) {
+	revoked, err := types.ParseDateTime(now)
+	if err != nil {
+		return nil, err
+	}
+	affected, err := APIKeys.exec(app, func(db dbx.Builder) *dbx.Query {
+		return db.Update(APIKeys.Table, dbx.Params{"revoked": revoked.String()}, dbx.HashExp{"id": id, "revoked": ""})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey, err := APIKeys.Find(app, id)
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, ErrAPIKeyRevoked
+	}
+	return apiKey, nil
+}
+
+func UpdateAPIKeyLastUsed(app core.App, id string, used time.Time) error {
+	lastUsed, err := types.ParseDateTime(used)
+	if err != nil {
+		return err
+	}
+	_, err = APIKeys.Update(app, id, Changeset{"last_used": lastUsed.String()})
+	return err
+}
+
+// RequestAPIKey returns the key sent in the X-API-Key header, nil if there
+// is none, or ErrInvalidAPIKey if it is unknown or revoked. The signature
+// of the request is checked by SignedRequests, its errors being told apart
+// with IsSignatureError.
+func RequestAPIKey(e *core.RequestEvent) (*APIKey, error) {
+	if apiKey, ok := e.Get(apiKeyRequestKey).(*APIKey); ok {
+		return apiKey, nil
+	}
+	header := e.Request.Header.Get(APIKeyHeader)
+	if header == "" {
+		return nil, nil
+	}
+
+	apiKey, err := FindAPIKey(e.App, header)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := SignedRequests.VerifyRequest(e, apiKey, now); err != nil {
+		return nil, err
+	}
+	e.Set(apiKeyRequestKey, apiKey)
+	touchAPIKey(e.App, apiKey, now)
+	return apiKey, nil
+}
+
+// touchAPIKey updates the last_used of apiKey in the background, at most
+// once a minute.
+func touchAPIKey(app core.App, apiKey *APIKey, now time.Time) {
+	if !apiKeyLastUsed.ShouldWrite(apiKey.Id, now) {
+		return
+	}
+	Drain.Go(func() {
+		if err := UpdateAPIKeyLastUsed(app, apiKey.Id, now); err != nil {
+			app.Logger().Warn("Failed to update api key last_used", "apiKey", apiKey.Id, "error", err)
+		}
+	})
+}
+
+func HandleListAPIKeys(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		keys, err := ListAPIKeys(app)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting api keys: "+err.Error(), nil)
+		}
+		return WriteOK(e, "", keys)
+	}
+}
+
+func HandleCreateAPIKey(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		cr := CreateAPIKeyRequest{}
+		if err := BindStrict(e, &cr); err != nil {
+			return WriteBindError(e, err)
+		}
+
+		key, err := CreateAPIKey(app, cr.Name, cr.Scope, cr.RequireSignature)
+		if errors.Is(err, ErrInvalidAPIKeyScope) {
+			return WriteBadRequest(e, "invalid api key", map[string]string{"scope": err.Error()})
+		}
+		if err != nil {
+			return WriteError(e, err, "error creating api key")
+		}
+		return WriteOK(e, "store the key now, it can't be shown again", key)
+	}
+}
+
+func HandleRevokeAPIKey(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		key, err := RevokeAPIKey(app, e.Request.PathValue("keyId"), time.Now())
+		if errors.Is(err, sql.ErrNoRows) {
+			return WriteNotFound(e, "api key not found", nil)
+		}
+		if errors.Is(err, ErrAPIKeyRevoked) {
+			return WriteConflict(e, err.Error(), nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error revoking api key")
+		}
+		return WriteOK(e, "", key)
+	}
+}
+
+// NewAPIKeyCommand adds the "apikey" command to mint, list and revoke keys
+// from the CLI.
+func NewAPIKeyCommand(app core.App) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "apikey",
+		Short: "Manages the API keys of machine clients",
+	}
+
+	scope := APIKeyScopeRead
+	requireSignature := false
+	create := &cobra.Command{
+		Use:          "create <name>",
+		Short:        "Mints a new API key and prints it",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			key, err := CreateAPIKey(app, args[0], scope, requireSignature)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("created %s key %s (%s)\n%s\nsigning secret %s\n", key.Scope, key.Id, key.Name, key.Key, key.SigningSecret)
+			return nil
+		},
+	}
+	create.Flags().StringVar(&scope, "scope", APIKeyScopeRead, "read for GET requests only, write for every request")
+	create.Flags().BoolVar(&requireSignature, "require-signature", false, "refuse the requests of the key that aren't signed with its signing secret")
+
+	list := &cobra.Command{
+		Use:          "list",
+		Short:        "Lists the API keys",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			keys, err := ListAPIKeys(app)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				status := "active"
+				if key.Revoked != "" {
+					status = "revoked " + key.Revoked
+				}
+				fmt.Printf("%s\t%s…\t%s\t%s\t%s\n", key.Id, key.Prefix, key.Scope, key.Name, status)
+			}
+			return nil
+		},
+	}
+
+	revoke := &cobra.Command{
+		Use:          "revoke <id>",
+		Short:        "Revokes an API key",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if _, err := RevokeAPIKey(app, args[0], time.Now()); err != nil {
+				return err
+			}
+			fmt.Println("revoked", args[0])
+			return nil
+		},
+	}
+
+	command.AddCommand(create, list, revoke)
+	return command
+}
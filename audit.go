@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	ActorSuperuser = "superuser"
+	ActorUser      = "user"
+	ActorAPIKey    = "apikey"
+	ActorAnonymous = "anonymous"
+)
+
+const (
+	auditedUserKey   = "auditedUser"
+	auditRedactedKey = "auditRedacted"
+	auditChangesKey  = "auditChanges"
+)
+
+// auditedMethods are the methods of the requests that mutate data.
+var auditedMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+var AuditSortFields = []string{"created", "action", "status"}
+
+var AuditFilterFields = map[string]FilterType{
+	"actor_type":      FilterString,
+	"actor_id":        FilterString,
+	"action":          FilterString,
+	"method":          FilterString,
+	"target_id":       FilterString,
+	"impersonator_id": FilterString,
+}
+
+type AuditLog struct {
+	Id        string        `db:"id" json:"id"`
+	ActorType string        `db:"actor_type" json:"actorType"`
+	ActorId   string        `db:"actor_id" json:"actorId"`
+	Action    string        `db:"action" json:"action"`
+	Method    string        `db:"method" json:"method"`
+	Path      string        `db:"path" json:"path"`
+	TargetId  string        `db:"target_id" json:"targetId"`
+	Status    int           `db:"status" json:"status"`
+	Changes   types.JSONRaw `db:"changes" json:"changes"`
+	IP        string        `db:"ip" json:"ip"`
+	RequestId string        `db:"request_id" json:"requestId"`
+	// ImpersonatorId is the superuser behind a request made with an
+	// impersonation token.
+	ImpersonatorId string `db:"impersonator_id" json:"impersonatorId,omitempty"`
+	Created        string `db:"created" json:"created"`
+}
+
+// AuditLogs is the repository of the audit_logs collection table. The logs
+// are written as records by AuditMutations and only read through it.
+var AuditLogs = NewRepository[AuditLog]("audit_logs")
+
+// SetAuditedUser names the user a request acted on, for the routes that
+// don't carry its id in the path, e.g. a created user.
+func SetAuditedUser(e *core.RequestEvent, userId string) {
+	e.Set(auditedUserKey, userId)
+}
+
+// SetAuditChanges records the changes made by the request as computed by
+// its handler, sparing AuditMutations a diff of the user read afterwards.
+func SetAuditChanges(e *core.RequestEvent, changes map[string]FieldChange) {
+	e.Set(auditChangesKey, changes)
+}
+
+// RedactAuditChanges leaves the changes of the request out of its audit
+// log, for the requests that erase personal data.
+func RedactAuditChanges(e *core.RequestEvent) {
+	e.Set(auditRedactedKey, true)
+}
+
+// RequestActor returns the type and id of the requester.
+func RequestActor(e *core.RequestEvent) (string, string) {
+	if e.Auth != nil {
+		if e.HasSuperuserAuth() {
+			return ActorSuperuser, e.Auth.Id
+		}
+		return ActorUser, e.Auth.Id
+	}
+	if apiKey, ok := e.Get(apiKeyRequestKey).(*APIKey); ok {
+		return ActorAPIKey, apiKey.Id
+	}
+	return ActorAnonymous, ""
+}
+
+// DiffFields compares two db tagged structs (or pointers to them, nil for a
+// row that doesn't exist) and returns the fields whose value differs.
+func DiffFields(before any, after any) map[string]FieldChange {
+	values := func(row any) map[string]any {
+		fields := map[string]any{}
+		v := reflect.ValueOf(row)
+		if !v.IsValid() || v.Kind() == reflect.Pointer && v.IsNil() {
+			return fields
+		}
+		v = reflect.Indirect(v)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if col := t.Field(i).Tag.Get("db"); col != "" && col != "-" {
+				fields[col] = v.Field(i).Interface()
+			}
+		}
+		return fields
+	}
+	oldFields, newFields := values(before), values(after)
+
+	changes := map[string]FieldChange{}
+	for field, value := range newFields {
+		if !reflect.DeepEqual(oldFields[field], value) {
+			changes[field] = FieldChange{Old: oldFields[field], New: value}
+		}
+	}
+	for field, value := range oldFields {
+		if _, ok := newFields[field]; !ok {
+			changes[field] = FieldChange{Old: value}
+		}
+	}
+	return changes
+}
+
+// findAuditedUser reads the user the request targets, soft deleted or not,
+// returning nil if there is none.
+func findAuditedUser(app core.App, userId string) *models.User {
+	if userId == "" {
+		return nil
+	}
+	user, err := Users.WithDeleted().Find(app, userId)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// AuditMutations records the successful POST, PUT, PATCH and DELETE requests
+// to the custom routes in audit_logs, along with the changes made to the
+// targeted user. Failing to record them is only logged.
+func AuditMutations(app core.App) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if !slices.Contains(auditedMethods, e.Request.Method) || IsPocketBasePath(e.Request.URL.Path) {
+			return e.Next()
+		}
+		// the dry runs write nothing
+		if IsDryRun(e) {
+			return e.Next()
+		}
+
+		userId := e.Request.PathValue("userId")
+		before := findAuditedUser(app, userId)
+
+		err := e.Next()
+		status := e.Status()
+		if err != nil || status >= http.StatusBadRequest {
+			return err
+		}
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		if id, ok := e.Get(auditedUserKey).(string); ok && userId == "" {
+			userId = id
+		}
+		targetId := userId
+		var changes map[string]FieldChange
+		if redacted, _ := e.Get(auditRedactedKey).(bool); redacted {
+			changes = nil
+		} else if set, ok := e.Get(auditChangesKey).(map[string]FieldChange); ok {
+			changes = set
+		} else if userId != "" {
+			changes = DiffFields(before, findAuditedUser(app, userId))
+		} else {
+			targetId = e.Request.PathValue("keyId")
+		}
+
+		if err := writeAuditLog(app, e, targetId, status, changes); err != nil {
+			app.Logger().Error("Failed to write audit log", "requestId", RequestId(e), "error", err)
+		}
+		return nil
+	}
+}
+
+func writeAuditLog(app core.App, e *core.RequestEvent, targetId string, status int, changes map[string]FieldChange) error {
+	collection, err := app.FindCachedCollectionByNameOrId("audit_logs")
+	if err != nil {
+		return err
+	}
+	rawChanges, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	actorType, actorId := RequestActor(e)
+	record := core.NewRecord(collection)
+	record.Set("actor_type", actorType)
+	record.Set("actor_id", actorId)
+	record.Set("action", e.Request.Pattern)
+	record.Set("method", e.Request.Method)
+	record.Set("path", e.Request.URL.Path)
+	record.Set("target_id", targetId)
+	record.Set("status", status)
+	record.Set("changes", types.JSONRaw(rawChanges))
+	record.Set("ip", e.RealIP())
+	record.Set("request_id", RequestId(e))
+	record.Set("impersonator_id", Impersonator(e))
+	return RetryWrite(app, func() error {
+		return app.Save(record)
+	})
+}
+
+// ParseAuditFilter reads ?filter= along with ?since= and ?until=, which
+// take RFC 3339 times.
+func ParseAuditFilter(e *core.RequestEvent) (dbx.Expression, error) {
+	query := e.Request.URL.Query()
+	filter, err := ParseFilter(query.Get("filter"), AuditFilterFields)
+	if err != nil {
+		return nil, err
+	}
+	// see andWhere, dbx.And builds "()" when it has only nils
+	exps := []dbx.Expression{}
+	if filter != nil {
+		exps = append(exps, filter)
+	}
+	for _, bound := range []struct{ param, op string }{{"since", ">="}, {"until", "<"}} {
+		v := query.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", bound.param, v)
+		}
+		dt, err := types.ParseDateTime(t)
+		if err != nil {
+			return nil, err
+		}
+		exps = append(exps, dbx.NewExp("[[created]] "+bound.op+" {:"+bound.param+"}", dbx.Params{bound.param: dt.String()}))
+	}
+	if len(exps) == 0 {
+		return nil, nil
+	}
+	return dbx.And(exps...), nil
+}
+
+func HandleListAuditLogs(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		filter, err := ParseAuditFilter(e)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		opts, err := ParseListOptions(e.Request.URL.Query(), AuditSortFields, cfg)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if len(opts.Sort) == 0 {
+			opts.Sort = []SortField{{Field: "created", Desc: true}}
+		}
+		opts.Filter = filter
+
+		span := StartStorageSpan(app, "ListAuditLogs", "SELECT")
+		total, err := AuditLogs.Count(app, opts.Filter)
+		if err != nil {
+			span.End(err)
+			return WriteInternalServerError(e, "error counting audit logs: "+err.Error(), nil)
+		}
+		logs, err := AuditLogs.FindAll(app, opts)
+		span.SetAttr("db.response.returned_rows", len(logs))
+		span.End(err)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting audit logs: "+err.Error(), nil)
+		}
+		return WriteOK(e, "", NewListPage(logs, opts, total))
+	}
+}
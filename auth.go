@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// requireAPIKey lets the unauthenticated requests through if they carry an
+// API key whose scope allows the request method.
+func requireAPIKey(e *core.RequestEvent) error {
+	apiKey, err := RequestAPIKey(e)
+	if errors.Is(err, ErrInvalidAPIKey) {
+		return WriteUnauthorized(e, err.Error(), nil)
+	}
+	if IsSignatureError(err) {
+		return WriteErrorCode(e, CodeInvalidSignature, err.Error(), nil)
+	}
+	if limit, ok := IsBodyTooLarge(err); ok {
+		return writeBodyTooLarge(e, limit)
+	}
+	if err != nil {
+		return WriteInternalServerError(e, "error checking api key: "+err.Error(), nil)
+	}
+	if apiKey == nil {
+		return WriteUnauthorized(e, "authentication required", nil)
+	}
+	if !apiKey.Allows(e.Request.Method) {
+		return WriteForbidden(e, "api key is read only", nil)
+	}
+	return e.Next()
+}
+
+// RequireSuperuser rejects requests that aren't authenticated as a superuser
+// or with an API key, responding in the APIResp format rather than
+// PocketBase's error format.
+func RequireSuperuser() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil {
+			return requireAPIKey(e)
+		}
+		if !e.HasSuperuserAuth() {
+			return WriteForbidden(e, "superuser access required", nil)
+		}
+		return e.Next()
+	}
+}
+
+// RequireSuperuserToken is RequireSuperuser without the API keys, for the
+// routes managing the keys themselves.
+func RequireSuperuserToken() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil {
+			return WriteUnauthorized(e, "authentication required", nil)
+		}
+		if !e.HasSuperuserAuth() {
+			return WriteForbidden(e, "superuser access required", nil)
+		}
+		return e.Next()
+	}
+}
+
+// RequireAuth rejects requests without a valid auth record or API key.
+func RequireAuth() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil {
+			return requireAPIKey(e)
+		}
+		return e.Next()
+	}
+}
+
+// RequireSuperuserOrOwner rejects requests that aren't authenticated either
+// as a superuser, as the user identified by the ownerIdParam path value or
+// with an API key.
+func RequireSuperuserOrOwner(ownerIdParam string) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil {
+			return requireAPIKey(e)
+		}
+		if !e.HasSuperuserAuth() && e.Auth.Id != e.Request.PathValue(ownerIdParam) {
+			return WriteForbidden(e, "not allowed to access this user", nil)
+		}
+		return e.Next()
+	}
+}
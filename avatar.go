@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+)
+
+const (
+	identiconGrid   = 5
+	identiconCell   = 40
+	identiconMargin = 20
+)
+
+// AvatarThumbSizes are the thumbnails rendered for every uploaded avatar.
+// The avatar field lists them too, so the files API serves them.
+var AvatarThumbSizes = []string{"64x64", "256x256"}
+
+// AvatarMimeTypes are the image types accepted by the avatar upload. They
+// are checked against the file content, not the declared content type.
+var AvatarMimeTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// GeneratedAvatarsDir is where rendered default avatars are cached.
+func GeneratedAvatarsDir(app core.App) string {
+	return filepath.Join(app.DataDir(), "generated_avatars")
+}
+
+func generatedAvatarPath(app core.App, userId string) string {
+	return filepath.Join(GeneratedAvatarsDir(app), filepath.Base(userId)+".png")
+}
+
+// RenderIdenticon draws a symmetric 5x5 identicon derived from seed.
+func RenderIdenticon(seed string) ([]byte, error) {
+	sum := sha256.Sum256([]byte(seed))
+	fg := color.RGBA{R: sum[0], G: sum[1], B: sum[2], A: 255}
+	bg := color.RGBA{R: 240, G: 240, B: 240, A: 255}
+
+	size := identiconGrid*identiconCell + 2*identiconMargin
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: bg}, image.Point{}, draw.Src)
+
+	half := (identiconGrid + 1) / 2
+	for row := 0; row < identiconGrid; row++ {
+		for col := 0; col < half; col++ {
+			if sum[3+row*half+col]%2 == 0 {
+				continue
+			}
+			for _, c := range []int{col, identiconGrid - 1 - col} {
+				x := identiconMargin + c*identiconCell
+				y := identiconMargin + row*identiconCell
+				rect := image.Rect(x, y, x+identiconCell, y+identiconCell)
+				draw.Draw(img, rect, &image.Uniform{C: fg}, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GetGeneratedAvatar returns the default avatar of the user, rendering and
+// caching it on disk on first use.
+func GetGeneratedAvatar(app core.App, userId string) ([]byte, error) {
+	path := generatedAvatarPath(app, userId)
+	if data, err := os.ReadFile(path); err == nil {
+		return data, nil
+	}
+
+	data, err := RenderIdenticon(userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(GeneratedAvatarsDir(app), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func RemoveGeneratedAvatar(app core.App, userId string) error {
+	err := os.Remove(generatedAvatarPath(app, userId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func HandleGetUserAvatar(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		size := 0
+		if raw := e.Request.URL.Query().Get("size"); raw != "" {
+			var err error
+			size, err = strconv.Atoi(raw)
+			if err != nil || size < AvatarSizeMin || size > AvatarSizeMax {
+				return WriteBadRequest(e, fmt.Sprintf("size must be an integer from %d to %d", AvatarSizeMin, AvatarSizeMax), nil)
+			}
+		}
+
+		userId := e.Request.PathValue("userId")
+		user, err := GetUserById(app, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+
+		if user.Avatar != "" {
+			collection, err := app.FindCachedCollectionByNameOrId("users")
+			if err != nil {
+				return WriteInternalServerError(e, "error getting users collection: "+err.Error(), nil)
+			}
+			fsys, err := app.NewFilesystem()
+			if err != nil {
+				return WriteInternalServerError(e, "error opening filesystem: "+err.Error(), nil)
+			}
+			defer fsys.Close()
+
+			key := collection.Id + "/" + user.Id + "/" + user.Avatar
+			if exists, _ := fsys.Exists(key); exists {
+				if size == 0 {
+					return fsys.Serve(e.Response, e.Request, key, user.Avatar)
+				}
+				data, err := GetAvatarDerivative(app, user.Id, user.Avatar, size, func() ([]byte, error) {
+					return readFile(fsys, key)
+				})
+				// the formats not decodable here, such as WebP, are served
+				// as uploaded for the browser to scale them
+				if errors.Is(err, image.ErrFormat) {
+					return fsys.Serve(e.Response, e.Request, key, user.Avatar)
+				}
+				if err != nil {
+					return WriteInternalServerError(e, "error resizing avatar: "+err.Error(), nil)
+				}
+				return writeAvatar(e, cfg, data)
+			}
+		}
+
+		data, err := GetGeneratedAvatar(app, user.Id)
+		if err == nil && size != 0 {
+			data, err = GetAvatarDerivative(app, user.Id, "identicon.png", size, func() ([]byte, error) {
+				return data, nil
+			})
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error generating avatar: "+err.Error(), nil)
+		}
+		return writeAvatar(e, cfg, data)
+	}
+}
+
+func readFile(fsys *filesystem.System, key string) ([]byte, error) {
+	r, err := fsys.GetFile(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// writeAvatar sends the rendered avatar with its content hash as ETag, so
+// that the clients revalidate it cheaply once the max age passed.
+func writeAvatar(e *core.RequestEvent, cfg *Config, data []byte) error {
+	etag := NewETag(data)
+	e.Response.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cfg.AvatarCacheMaxAge.Seconds())))
+	e.Response.Header().Set("ETag", etag)
+	if ETagMatches(e.Request.Header.Get("If-None-Match"), etag) {
+		return e.NoContent(http.StatusNotModified)
+	}
+	return e.Blob(http.StatusOK, http.DetectContentType(data), data)
+}
+
+type AvatarUpload struct {
+	Avatar string            `json:"avatar"`
+	URL    string            `json:"url"`
+	Thumbs map[string]string `json:"thumbs"`
+}
+
+// NewAvatarUpload describes the avatar of record with its public URLs.
+func NewAvatarUpload(app core.App, record *core.Record) AvatarUpload {
+	name := record.GetString("avatar")
+	base := strings.TrimRight(app.Settings().Meta.AppURL, "/") +
+		"/api/files/" + record.BaseFilesPath() + "/" + url.PathEscape(name)
+
+	upload := AvatarUpload{Avatar: name, URL: base, Thumbs: map[string]string{}}
+	for _, size := range AvatarThumbSizes {
+		upload.Thumbs[size] = base + "?thumb=" + size
+	}
+	return upload
+}
+
+// SetUserAvatar stores file as the avatar of the user, replacing the
+// previous one, and queues the rendering of its thumbnails.
+func SetUserAvatar(app core.App, userId string, file *filesystem.File) (*core.Record, error) {
+	span := StartStorageSpan(app, "SetUserAvatar", "UPDATE")
+	record, err := setUserAvatar(app, userId, file)
+	span.End(err)
+	return record, err
+}
+
+func setUserAvatar(app core.App, userId string, file *filesystem.File) (*core.Record, error) {
+	record, err := app.FindRecordById("users", userId)
+	if err != nil {
+		return nil, err
+	}
+	if record.GetString("deleted_at") != "" {
+		return nil, sql.ErrNoRows
+	}
+
+	record.Set("avatar", file)
+	if err := RetryWrite(app, func() error { return app.Save(record) }); err != nil {
+		return nil, err
+	}
+
+	if err := RemoveAvatarDerivatives(app, userId); err != nil {
+		app.Logger().Warn("Failed to remove avatar derivatives", "userId", userId, "error", err)
+	}
+
+	// the files API renders the missing thumbs on demand meanwhile
+	payload := AvatarThumbsJob{UserId: userId, Avatar: record.GetString("avatar")}
+	if _, err := EnqueueJob(app, JobAvatarThumbs, payload, time.Now()); err != nil {
+		app.Logger().Warn("Failed to queue avatar thumbs", "userId", userId, "error", err)
+	}
+	return record, nil
+}
+
+// AvatarThumbsJob is the payload of the JobAvatarThumbs jobs.
+type AvatarThumbsJob struct {
+	UserId string `json:"userId"`
+	Avatar string `json:"avatar"`
+}
+
+// RunAvatarThumbsJob renders the AvatarThumbSizes thumbnails of an
+// uploaded avatar, unless it was replaced since.
+func RunAvatarThumbsJob(ctx context.Context, app core.App, job *Job) error {
+	p := AvatarThumbsJob{}
+	if err := DecodeJobPayload(job, &p); err != nil {
+		return err
+	}
+	record, err := app.FindRecordById("users", p.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if record.GetString("avatar") != p.Avatar {
+		return nil
+	}
+
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+
+	errs := []error{}
+	key := record.BaseFilesPath() + "/" + p.Avatar
+	for _, size := range AvatarThumbSizes {
+		thumbKey := record.BaseFilesPath() + "/thumbs_" + p.Avatar + "/" + size + "_" + p.Avatar
+		if err := fsys.CreateThumb(key, thumbKey, size); err != nil {
+			errs = append(errs, fmt.Errorf("thumb %s: %w", size, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sniffMimeType detects the type of the uploaded file from its first bytes.
+func sniffMimeType(fh *multipart.FileHeader) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+func HandleUploadUserAvatar(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+
+		// leaves room for the multipart boundaries and headers
+		e.Request.Body = http.MaxBytesReader(e.Response, e.Request.Body, int64(cfg.AvatarMaxSize)+64<<10)
+		_, fh, err := e.Request.FormFile("avatar")
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return WriteRequestEntityTooLarge(e, fmt.Sprintf("avatar must be at most %d bytes", cfg.AvatarMaxSize), nil)
+		}
+		if errors.Is(err, http.ErrNotMultipart) {
+			return WriteUnsupportedMediaType(e, "avatar must be uploaded as multipart/form-data", nil)
+		}
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if fh.Size > int64(cfg.AvatarMaxSize) {
+			return WriteRequestEntityTooLarge(e, fmt.Sprintf("avatar must be at most %d bytes", cfg.AvatarMaxSize), nil)
+		}
+
+		mimeType, err := sniffMimeType(fh)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if !slices.Contains(AvatarMimeTypes, mimeType) {
+			return WriteUnsupportedMediaType(e, "avatar must be one of "+strings.Join(AvatarMimeTypes, ", "), nil)
+		}
+
+		file, err := filesystem.NewFileFromMultipart(fh)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+
+		var record *core.Record
+		err = WithTx(app, func(txApp core.App) error {
+			var err error
+			if record, err = SetUserAvatar(txApp, userId, file); err != nil {
+				return err
+			}
+			return QueueUserEvent(txApp, EventUserUpdated, UserFromRecord(record))
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+		}
+		var validationErrs validation.Errors
+		if errors.As(err, &validationErrs) {
+			return WriteBadRequest(e, "invalid avatar", validationErrs)
+		}
+		if err != nil {
+			return WriteError(e, err, "error saving avatar")
+		}
+		return WriteOK(e, "", NewAvatarUpload(app, record))
+	}
+}
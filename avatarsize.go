@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// The sizes in pixels accepted by GET /users/{userId}/avatar?size=.
+const (
+	AvatarSizeMin = 16
+	AvatarSizeMax = 1024
+)
+
+// AvatarDerivativesDir is where the resized avatars are cached, one
+// directory per user.
+func AvatarDerivativesDir(app core.App) string {
+	return filepath.Join(app.DataDir(), "avatar_derivatives")
+}
+
+func avatarDerivativePath(app core.App, userId string, size int, name string) string {
+	return filepath.Join(AvatarDerivativesDir(app), filepath.Base(userId), strconv.Itoa(size)+"_"+filepath.Base(name))
+}
+
+// RemoveAvatarDerivatives drops the cached resized avatars of the user.
+func RemoveAvatarDerivatives(app core.App, userId string) error {
+	return os.RemoveAll(filepath.Join(AvatarDerivativesDir(app), filepath.Base(userId)))
+}
+
+// GetAvatarDerivative returns the avatar name of the user scaled to a
+// size x size square, rendering it from load and caching it on disk on
+// first use. The name must change with the content, as the uploaded file
+// names do, for the cache to stay fresh.
+func GetAvatarDerivative(app core.App, userId string, name string, size int, load func() ([]byte, error)) ([]byte, error) {
+	path := avatarDerivativePath(app, userId, size, name)
+	if data, err := os.ReadFile(path); err == nil {
+		return data, nil
+	}
+
+	src, err := load()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ResizeAvatar(src, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// written aside then renamed, so that concurrent requests never read
+	// a partial file
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp_*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return data, nil
+}
+
+// ResizeAvatar crops the image to its centered square and scales it to
+// size x size, keeping JPEG images as JPEG and encoding the others as PNG.
+// It fails with image.ErrFormat for the formats the standard library cannot
+// decode, such as WebP.
+func ResizeAvatar(data []byte, size int) ([]byte, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if size < 1 {
+		return nil, errors.New("invalid size")
+	}
+
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2))
+	dst := scaleBox(src, crop, size)
+
+	buf := bytes.Buffer{}
+	if strings.EqualFold(format, "jpeg") {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleBox scales the square r of src to size x size, averaging the source
+// pixels covered by every destination pixel.
+func scaleBox(src image.Image, r image.Rectangle, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	side := r.Dx()
+	for y := 0; y < size; y++ {
+		y0 := r.Min.Y + y*side/size
+		y1 := max(r.Min.Y+(y+1)*side/size, y0+1)
+		for x := 0; x < size; x++ {
+			x0 := r.Min.X + x*side/size
+			x1 := max(r.Min.X+(x+1)*side/size, x0+1)
+
+			var sr, sg, sb, sa, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					sr, sg, sb, sa = sr+uint64(cr), sg+uint64(cg), sb+uint64(cb), sa+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(sr / n >> 8),
+				G: uint8(sg / n >> 8),
+				B: uint8(sb / n >> 8),
+				A: uint8(sa / n >> 8),
+			})
+		}
+	}
+	return dst
+}
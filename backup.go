@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// UsersBackupSchemaVersion must be bumped whenever the users backup document
+// changes in a way older versions of the restore can't read.
+const UsersBackupSchemaVersion = 1
+
+const (
+	RestoreModeMerge   = "merge"
+	RestoreModeReplace = "replace"
+)
+
+var (
+	ErrBackupSchemaTooNew       = errors.New("backup schema version is newer than the supported one")
+	ErrBackupSchemaInvalid      = errors.New("invalid backup schema version")
+	ErrBackupInvalidRow         = errors.New("invalid backup row")
+	ErrBackupInvalidRestoreMode = errors.New("invalid restore mode")
+)
+
+// UsersBackup is the document produced by GET /admin/users-backup. Users
+// holds every column of the users table, including the hidden ones.
+type UsersBackup struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	ExportedAt    string           `json:"exportedAt"`
+	Users         []map[string]any `json:"users"`
+}
+
+type RestoreResult struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+}
+
+// WriteUsersBackup streams the backup document to w one user at a time, so
+// that the whole table never has to be held in memory.
+func WriteUsersBackup(app core.App, w io.Writer, now time.Time) error {
+	rows, err := app.DB().NewQuery("SELECT * FROM users ORDER BY id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	exportedAt, _ := json.Marshal(now.UTC().Format(time.RFC3339))
+	if _, err := fmt.Fprintf(w, `{"schemaVersion":%d,"exportedAt":%s,"users":[`, UsersBackupSchemaVersion, exportedAt); err != nil {
+		return err
+	}
+
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for n := 0; rows.Next(); n++ {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		row := make(map[string]any, len(cols))
+		for i, col := range cols {
+			if b, ok := values[i].([]byte); ok {
+				row[col] = string(b)
+			} else {
+				row[col] = values[i]
+			}
+		}
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			data = append([]byte(","), data...)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+// DecodeUsersBackup reads a backup document, keeping integer values as
+// int64 rather than float64.
+func DecodeUsersBackup(r io.Reader) (*UsersBackup, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+
+	backup := UsersBackup{}
+	if err := dec.Decode(&backup); err != nil {
+		return nil, err
+	}
+	for _, row := range backup.Users {
+		for col, value := range row {
+			n, ok := value.(json.Number)
+			if !ok {
+				continue
+			}
+			if i, err := n.Int64(); err == nil {
+				row[col] = i
+			} else if f, err := n.Float64(); err == nil {
+				row[col] = f
+			}
+		}
+	}
+	return &backup, nil
+}
+
+func (b *UsersBackup) Validate(columns []string) error {
+	if b.SchemaVersion > UsersBackupSchemaVersion {
+		return fmt.Errorf("%w: got %d, supported %d", ErrBackupSchemaTooNew, b.SchemaVersion, UsersBackupSchemaVersion)
+	}
+	if b.SchemaVersion < 1 {
+		return fmt.Errorf("%w: %d", ErrBackupSchemaInvalid, b.SchemaVersion)
+	}
+	for i, row := range b.Users {
+		if id, _ := row["id"].(string); id == "" {
+			return fmt.Errorf("%w: user %d has no id", ErrBackupInvalidRow, i)
+		}
+		for col := range row {
+			if !slices.Contains(columns, col) {
+				return fmt.Errorf("%w: user %d has unknown column %q", ErrBackupInvalidRow, i, col)
+			}
+		}
+	}
+	return nil
+}
+
+// RestoreUsers writes the backup users in a single transaction. In merge mode
+// rows are upserted by id, rows identical to the stored ones are skipped. In
+// replace mode every user is deleted first.
+func RestoreUsers(app core.App, backup *UsersBackup, mode string) (*RestoreResult, error) {
+	if mode != RestoreModeMerge && mode != RestoreModeReplace {
+		return nil, fmt.Errorf("%w: %q", ErrBackupInvalidRestoreMode, mode)
+	}
+
+	users, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		return nil, err
+	}
+	if err := backup.Validate(users.Fields.FieldNames()); err != nil {
+		return nil, err
+	}
+
+	var result *RestoreResult
+	err = WithTx(app, func(txApp core.App) error {
+		result = &RestoreResult{}
+		if mode == RestoreModeReplace {
+			// a plain delete rather than TruncateCollection, which would
+			// cascade to the posts of the users that are about to come back
+			if _, err := txApp.DB().NewQuery("DELETE FROM users").Execute(); err != nil {
+				return err
+			}
+		}
+
+		for _, row := range backup.Users {
+			id := row["id"].(string)
+
+			existing := dbx.NullStringMap{}
+			err := txApp.DB().Select("*").From("users").Where(dbx.HashExp{"id": id}).One(existing)
+			if errors.Is(err, sql.ErrNoRows) {
+				if _, err := txApp.DB().Insert("users", dbx.Params(row)).Execute(); err != nil {
+					return fmt.Errorf("error inserting user %s: %w", id, err)
+				}
+				result.Created++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if backupRowEqual(existing, row) {
+				result.Skipped++
+				continue
+			}
+			if _, err := txApp.DB().Update("users", dbx.Params(row), dbx.HashExp{"id": id}).Execute(); err != nil {
+				return fmt.Errorf("error updating user %s: %w", id, err)
+			}
+			result.Updated++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	UserResponseCache.Invalidate()
+	return result, nil
+}
+
+func backupRowEqual(existing dbx.NullStringMap, row map[string]any) bool {
+	for col, value := range row {
+		stored, ok := existing[col]
+		if !ok {
+			return false
+		}
+		if value == nil {
+			if stored.Valid {
+				return false
+			}
+			continue
+		}
+		if !stored.Valid || stored.String != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func HandleUsersBackup(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		now := time.Now()
+		e.Response.Header().Set("Content-Type", "application/json")
+		e.Response.Header().Set("Content-Disposition", `attachment; filename="users-backup-`+now.UTC().Format("20060102T150405Z")+`.json"`)
+		e.Response.WriteHeader(http.StatusOK)
+
+		// the status is already sent, all that can be done is to log and
+		// leave the document truncated so it fails to decode on restore
+		if err := WriteUsersBackup(app, e.Response, now); err != nil {
+			app.Logger().Error("Failed to write users backup", "error", err)
+		}
+		return nil
+	}
+}
+
+func HandleUsersRestore(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		mode := e.Request.URL.Query().Get("mode")
+		if mode == "" {
+			mode = RestoreModeMerge
+		}
+
+		backup, err := DecodeUsersBackup(e.Request.Body)
+		if limit, ok := IsBodyTooLarge(err); ok {
+			return writeBodyTooLarge(e, limit)
+		}
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+
+		result, err := RestoreUsers(app, backup, mode)
+		if errors.Is(err, ErrBackupSchemaTooNew) ||
+			errors.Is(err, ErrBackupSchemaInvalid) ||
+			errors.Is(err, ErrBackupInvalidRow) ||
+			errors.Is(err, ErrBackupInvalidRestoreMode) {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error restoring users")
+		}
+		return WriteOK(e, "", result)
+	}
+}
+
+// BackupNamePattern is the pattern PocketBase requires of the backup names.
+var BackupNamePattern = regexp.MustCompile(`^[a-z0-9_-]+\.zip$`)
+
+var (
+	ErrBackupInProgress = errors.New("another backup or restore is running, try again later")
+	ErrBackupNotFound   = errors.New("backup not found")
+)
+
+// BackupInfo describes a PocketBase backup, a zip of pb_data holding the
+// database and, with the local storage, the uploaded files.
+type BackupInfo struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Modified string `json:"modified"`
+}
+
+// ListBackups returns the PocketBase backups, newest first.
+func ListBackups(ctx context.Context, app core.App) ([]BackupInfo, error) {
+	fsys, err := app.NewBackupsFilesystem()
+	if err != nil {
+		return nil, err
+	}
+	defer fsys.Close()
+	fsys.SetContext(ctx)
+
+	objects, err := fsys.List("")
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]BackupInfo, 0, len(objects))
+	for _, object := range objects {
+		backups = append(backups, BackupInfo{
+			Name:     object.Key,
+			Size:     object.Size,
+			Modified: object.ModTime.UTC().Format(time.RFC3339),
+		})
+	}
+	slices.SortFunc(backups, func(a, b BackupInfo) int { return strings.Compare(b.Modified, a.Modified) })
+	return backups, nil
+}
+
+// CreateBackup makes a PocketBase backup named name, generated from the time
+// when empty, and returns it. The writes wait for it to complete.
+func CreateBackup(ctx context.Context, app core.App, name string) (*BackupInfo, error) {
+	if app.Store().Has(core.StoreKeyActiveBackup) {
+		return nil, ErrBackupInProgress
+	}
+	if name == "" {
+		name = "backup_" + time.Now().UTC().Format("20060102150405") + ".zip"
+	}
+	if err := app.CreateBackup(ctx, name); err != nil {
+		return nil, err
+	}
+	backups, err := ListBackups(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	for _, backup := range backups {
+		if backup.Name == name {
+			return &backup, nil
+		}
+	}
+	return nil, ErrBackupNotFound
+}
+
+// HandleCreateBackup backs up the database and the local storage. Uploaded
+// files kept on S3 aren't part of the backup.
+func HandleCreateBackup(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		name := e.Request.URL.Query().Get("name")
+		if name != "" && !BackupNamePattern.MatchString(name) {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid backup name", map[string]string{
+				"name": "must be lowercase letters, digits, _ or -, ending in .zip",
+			})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		backup, err := CreateBackup(ctx, app, name)
+		if errors.Is(err, ErrBackupInProgress) {
+			return WriteConflict(e, err.Error(), nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error creating backup: "+err.Error(), nil)
+		}
+		app.Logger().Info("Backup created", "name", backup.Name, "requestId", RequestId(e))
+		return WriteResp(e, http.StatusCreated, "", backup)
+	}
+}
+
+func HandleListBackups(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		backups, err := ListBackups(e.Request.Context(), app)
+		if err != nil {
+			return WriteInternalServerError(e, "error listing backups: "+err.Error(), nil)
+		}
+		return WriteOK(e, "", backups)
+	}
+}
+
+// HandleRestoreBackup replaces pb_data with the backup and restarts the app,
+// once the response is sent.
+func HandleRestoreBackup(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		name := e.Request.PathValue("name")
+		if app.Store().Has(core.StoreKeyActiveBackup) {
+			return WriteConflict(e, ErrBackupInProgress.Error(), nil)
+		}
+		fsys, err := app.NewBackupsFilesystem()
+		if err != nil {
+			return WriteInternalServerError(e, "error opening backups filesystem: "+err.Error(), nil)
+		}
+		defer fsys.Close()
+		fsys.SetContext(e.Request.Context())
+		if exists, err := fsys.Exists(name); err != nil {
+			return WriteInternalServerError(e, "error getting backup: "+err.Error(), nil)
+		} else if !exists {
+			return WriteNotFound(e, ErrBackupNotFound.Error(), nil)
+		}
+
+		app.Logger().Warn("Restoring backup", "name", name, "requestId", RequestId(e))
+		go func() {
+			// leave the response the time to be sent before the restart
+			time.Sleep(time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			defer cancel()
+			if err := app.RestoreBackup(ctx, name); err != nil {
+				app.Logger().Error("Failed to restore backup", "name", name, "error", err)
+			}
+		}()
+		return WriteResp(e, http.StatusAccepted, "restoring backup, the app restarts once done", nil)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// usersTable returns every column of every row of the users table, by id.
+func usersTable(t testing.TB, app core.App) []dbx.NullStringMap {
+	t.Helper()
+	rows := []dbx.NullStringMap{}
+	if err := app.DB().NewQuery("SELECT * FROM users ORDER BY id").All(&rows); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// restoreUsersBackup posts backup to POST /admin/users-restore in mode.
+func (s *testServer) restoreUsersBackup(t testing.TB, backup []byte, mode string) RestoreResult {
+	t.Helper()
+	res, body := s.doRaw(t, http.MethodPost, "/admin/users-restore?mode="+mode, s.SuperuserToken, "application/json", backup)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.StatusCode, body)
+	}
+	result := RestoreResult{}
+	decodeData(t, checkAPIResp(t, res.StatusCode, body), &result)
+	return result
+}
+
+// TestUsersBackupRoundTrip backs the users up, wipes them and restores
+// them, for every column of every row to come back as it was.
+func TestUsersBackupRoundTrip(t *testing.T) {
+	s := newTestServer(t, nil)
+	// the hidden and the unset columns are backed up too
+	if err := DeleteUserById(s.App, s.Users[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.App.DB().Update("users", dbx.Params{"verified": true}, dbx.HashExp{"id": s.Users[2].Id}).Execute(); err != nil {
+		t.Fatal(err)
+	}
+	expected := usersTable(t, s.App)
+
+	res, backup := s.do(t, http.MethodGet, "/admin/users-backup", s.SuperuserToken, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.StatusCode, backup)
+	}
+	doc := UsersBackup{}
+	if err := json.Unmarshal(backup, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.SchemaVersion != UsersBackupSchemaVersion || len(doc.Users) != len(expected) {
+		t.Fatalf("expected the %d users of schema %d, got %d of %d", len(expected), UsersBackupSchemaVersion, len(doc.Users), doc.SchemaVersion)
+	}
+
+	if _, err := s.App.DB().NewQuery("DELETE FROM users").Execute(); err != nil {
+		t.Fatal(err)
+	}
+	result := s.restoreUsersBackup(t, backup, RestoreModeMerge)
+	if expectedResult := (RestoreResult{Created: len(expected)}); result != expectedResult {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
+	if got := usersTable(t, s.App); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the restored users\n%v\ngot\n%v", expected, got)
+	}
+
+	result = s.restoreUsersBackup(t, backup, RestoreModeMerge)
+	if expectedResult := (RestoreResult{Skipped: len(expected)}); result != expectedResult {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
+
+	if _, err := CreateUser(s.App, models.UserCreationRequest{Email: "extra@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	result = s.restoreUsersBackup(t, backup, RestoreModeReplace)
+	if expectedResult := (RestoreResult{Created: len(expected)}); result != expectedResult {
+		t.Errorf("expected %+v, got %+v", expectedResult, result)
+	}
+	if got := usersTable(t, s.App); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the replaced users\n%v\ngot\n%v", expected, got)
+	}
+}
+
+func TestUsersRestoreInvalid(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	scenarios := []struct {
+		name string
+		mode string
+		body string
+	}{
+		{"newer schema", RestoreModeMerge, `{"schemaVersion":2,"exportedAt":"","users":[]}`},
+		{"missing schema", RestoreModeMerge, `{"exportedAt":"","users":[]}`},
+		{"unknown column", RestoreModeMerge, `{"schemaVersion":1,"exportedAt":"","users":[{"id":"a","unknown":1}]}`},
+		{"missing id", RestoreModeMerge, `{"schemaVersion":1,"exportedAt":"","users":[{"name":"A"}]}`},
+		{"unknown mode", "append", `{"schemaVersion":1,"exportedAt":"","users":[]}`},
+		{"not a backup", RestoreModeMerge, `{"users":[],"extra":true}`},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			res, body := s.doRaw(t, http.MethodPost, "/admin/users-restore?mode="+scenario.mode, s.SuperuserToken, "application/json", []byte(scenario.body))
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", res.StatusCode, body)
+			}
+			checkAPIResp(t, res.StatusCode, body)
+		})
+	}
+
+	total, err := CountUsers(s.App, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != len(s.Users) {
+		t.Errorf("expected the users to be left alone, got %d", total)
+	}
+}
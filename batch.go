@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const (
+	BatchOpCreate = "create"
+	BatchOpUpdate = "update"
+	BatchOpDelete = "delete"
+)
+
+var (
+	ErrBatchEmpty     = errors.New("batch has no operations")
+	ErrBatchMissingId = errors.New("id is required")
+	ErrBatchInvalidOp = errors.New("invalid op, expected create, update or delete")
+	// errBatchFailed rolls back an atomic batch after a failed operation.
+	errBatchFailed = errors.New("batch operation failed")
+)
+
+type BatchOperation struct {
+	Op   string          `json:"op"`
+	Id   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// BatchRequest is the body of POST /users/batch. The operations are applied
+// in order in a single transaction, unless BestEffort is set, in which case
+// every operation is applied on its own and a failure doesn't stop the rest.
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+	BestEffort bool             `json:"bestEffort"`
+}
+
+type BatchResult struct {
+	Index  int          `json:"index"`
+	Op     string       `json:"op"`
+	Status int          `json:"status"`
+	User   *models.User `json:"user,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Data   any          `json:"data,omitempty"`
+}
+
+type BatchResponse struct {
+	// Applied is false when an atomic batch was rolled back.
+	Applied bool          `json:"applied"`
+	Results []BatchResult `json:"results"`
+}
+
+// newBatchError describes err as the result of a failed operation, using
+// the status the matching single user route would answer with.
+func newBatchError(result BatchResult, err error) BatchResult {
+	result.Error = err.Error()
+	var bindErr *BindError
+	var validationErrs validation.Errors
+	switch {
+	case errors.As(err, &bindErr):
+		result.Status = http.StatusBadRequest
+		if len(bindErr.Fields) > 0 {
+			result.Data = bindErr.Fields
+		}
+	case errors.As(err, &validationErrs):
+		result.Status = http.StatusBadRequest
+		result.Error = "invalid user"
+		result.Data = validationErrs
+	case errors.Is(err, ErrBatchMissingId), errors.Is(err, ErrBatchInvalidOp), errors.Is(err, ErrPasswordMismatch):
+		result.Status = http.StatusBadRequest
+	case errors.Is(err, sql.ErrNoRows):
+		result.Status = http.StatusNotFound
+		result.Error = "user not found"
+	case errors.Is(err, ErrEmailTaken):
+		result.Status = http.StatusConflict
+		result.Data = map[string]string{"email": err.Error()}
+	default:
+		result.Status = http.StatusInternalServerError
+	}
+	return result
+}
+
+// applyBatchOperation applies op with app, which is a transaction in atomic
+// mode, queueing its event along with it. Email changes are applied right away, as with ?skipConfirmation on
+// PATCH /users/{userId}, since only superusers can run batches.
+func applyBatchOperation(app core.App, op BatchOperation) (*models.User, error) {
+	switch op.Op {
+	case BatchOpCreate:
+		cr := models.UserCreationRequest{}
+		if err := DecodeStrict(op.Data, &cr); err != nil {
+			return nil, err
+		}
+		var user *models.User
+		err := WithTx(app, func(txApp core.App) error {
+			var err error
+			if user, err = CreateUser(txApp, cr); err != nil {
+				return err
+			}
+			return QueueUserEvent(txApp, EventUserCreated, user)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+
+	case BatchOpUpdate:
+		if op.Id == "" {
+			return nil, ErrBatchMissingId
+		}
+		ur := models.UserUpdateRequest{}
+		if err := DecodeStrict(op.Data, &ur); err != nil {
+			return nil, err
+		}
+		// the route is for superusers only
+		if err := CheckWritableFields("POST /users/batch", true, ur); err != nil {
+			return nil, err
+		}
+		if err := ValidateUserUpdateRequest(ur); err != nil {
+			return nil, err
+		}
+		var user *models.User
+		err := WithTx(app, func(txApp core.App) error {
+			if err := CheckUserUpdate(txApp, op.Id, ur); err != nil {
+				return err
+			}
+			var err error
+			if user, _, err = UpdateUserById(txApp, op.Id, ur); err != nil {
+				return err
+			}
+			return QueueUserEvent(txApp, EventUserUpdated, user)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+
+	case BatchOpDelete:
+		if op.Id == "" {
+			return nil, ErrBatchMissingId
+		}
+		return nil, WithTx(app, func(txApp core.App) error {
+			// read beforehand for the event payload
+			user, err := GetUserById(txApp, op.Id)
+			if err != nil {
+				return err
+			}
+			if err := DeleteUserById(txApp, op.Id); err != nil {
+				return err
+			}
+			return QueueUserEvent(txApp, EventUserDeleted, user)
+		})
+	}
+	return nil, ErrBatchInvalidOp
+}
+
+// RunBatch applies the operations of br and returns a result per operation.
+// A busy database fails the whole batch with ErrDatabaseBusy in atomic mode.
+func RunBatch(app core.App, br BatchRequest) (*BatchResponse, error) {
+	if len(br.Operations) == 0 {
+		return nil, ErrBatchEmpty
+	}
+
+	resp := &BatchResponse{Applied: true}
+	apply := func(txApp core.App, i int, op BatchOperation) error {
+		result := BatchResult{Index: i, Op: op.Op, Status: http.StatusOK}
+		user, err := applyBatchOperation(txApp, op)
+		if err != nil {
+			resp.Results = append(resp.Results, newBatchError(result, err))
+			return err
+		}
+		result.User = user
+		resp.Results = append(resp.Results, result)
+		return nil
+	}
+
+	if br.BestEffort {
+		for i, op := range br.Operations {
+			apply(app, i, op)
+		}
+	} else {
+		err := WithTx(app, func(txApp core.App) error {
+			// reset, since a busy database retries the whole transaction
+			resp.Results = nil
+			for i, op := range br.Operations {
+				if err := apply(txApp, i, op); err != nil {
+					if IsBusyError(err) || errors.Is(err, ErrDatabaseBusy) {
+						return err
+					}
+					return errBatchFailed
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, errBatchFailed) {
+			resp.Applied = false
+			for i := range resp.Results[:len(resp.Results)-1] {
+				resp.Results[i].Status = http.StatusFailedDependency
+				resp.Results[i].User = nil
+				resp.Results[i].Error = "rolled back"
+			}
+			for i := len(resp.Results); i < len(br.Operations); i++ {
+				resp.Results = append(resp.Results, BatchResult{
+					Index:  i,
+					Op:     br.Operations[i].Op,
+					Status: http.StatusFailedDependency,
+					Error:  "not applied",
+				})
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func HandleBatchUsers(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		br := BatchRequest{}
+		if err := BindStrict(e, &br); err != nil {
+			return WriteBindError(e, err)
+		}
+		if len(br.Operations) > cfg.BatchMaxOperations {
+			return WriteBadRequest(e, fmt.Sprintf("bad request: at most %d operations can be batched", cfg.BatchMaxOperations), nil)
+		}
+
+		resp, err := RunBatch(app, br)
+		if errors.Is(err, ErrBatchEmpty) {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error running batch")
+		}
+		if !resp.Applied {
+			failed := resp.Results[0]
+			for _, result := range resp.Results {
+				if result.Status != http.StatusFailedDependency {
+					failed = result
+					break
+				}
+			}
+			return WriteUnprocessableEntity(e, fmt.Sprintf("batch rolled back, operation %d failed: %s", failed.Index, failed.Error), resp)
+		}
+		return WriteOK(e, "", resp)
+	}
+}
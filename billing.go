@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// SubscriptionsCollection stores the Stripe subscriptions of the users, one
+// per user, kept up to date by the stripe events of POST /hooks/{provider}.
+const SubscriptionsCollection = "subscriptions"
+
+// StripeAPIURL is the base URL of the Stripe API.
+var StripeAPIURL = "https://api.stripe.com/v1"
+
+// ActiveSubscriptionStatuses are the Stripe statuses of the subscriptions
+// unlocking the premium routes, see RequireActiveSubscription.
+var ActiveSubscriptionStatuses = []string{"active", "trialing"}
+
+var (
+	ErrBillingDisabled         = errors.New("billing is not configured")
+	ErrUnknownPrice            = errors.New("unknown price")
+	ErrSubscriptionUserUnknown = errors.New("no user is linked to the subscription")
+)
+
+// Subscription is the Stripe subscription of a user.
+type Subscription struct {
+	Id                 string `db:"id" json:"id"`
+	User               string `db:"user" json:"user"`
+	StripeCustomer     string `db:"stripe_customer" json:"stripeCustomer"`
+	StripeSubscription string `db:"stripe_subscription" json:"stripeSubscription"`
+	Status             string `db:"status" json:"status"`
+	Price              string `db:"price" json:"price"`
+	CurrentPeriodEnd   string `db:"current_period_end" json:"currentPeriodEnd"`
+	CancelAtPeriodEnd  bool   `db:"cancel_at_period_end" json:"cancelAtPeriodEnd"`
+	Created            string `db:"created" json:"created"`
+	Updated            string `db:"updated" json:"updated"`
+}
+
+var Subscriptions = NewRepository[Subscription](SubscriptionsCollection)
+
+// Active reports whether the subscription unlocks the premium routes at
+// now: its status is one of ActiveSubscriptionStatuses and its current
+// period, when known, isn't over.
+func (s *Subscription) Active(now time.Time) bool {
+	if !slices.Contains(ActiveSubscriptionStatuses, s.Status) {
+		return false
+	}
+	if s.CurrentPeriodEnd == "" {
+		return true
+	}
+	end, err := types.ParseDateTime(s.CurrentPeriodEnd)
+	return err != nil || end.Time().After(now)
+}
+
+// FindUserSubscription returns the subscription of the user, ErrNotFound
+// when it never subscribed.
+func FindUserSubscription(app core.App, userId string) (*Subscription, error) {
+	return Subscriptions.FindOne(app, dbx.HashExp{"user": userId})
+}
+
+type CheckoutRequest struct {
+	// PriceId is one of STRIPE_PRICE_IDS, the first one when empty.
+	PriceId string `json:"priceId"`
+}
+
+// CheckoutSession is the Stripe checkout session the user is redirected to
+// in order to subscribe.
+type CheckoutSession struct {
+	Id  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// StripeError is the error of a failed Stripe API call.
+type StripeError struct {
+	Status  int
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *StripeError) Error() string {
+	return fmt.Sprintf("stripe: %s (status %d)", e.Message, e.Status)
+}
+
+// StripeClient calls the Stripe API with a secret key.
+type StripeClient struct {
+	secretKey string
+	client    *http.Client
+}
+
+func NewStripeClient(secretKey string) *StripeClient {
+	return &StripeClient{secretKey: secretKey, client: Downstream.Client(DependencyStripe, 30*time.Second)}
+}
+
+// post sends the form encoded params to the API path, e.g.
+// /checkout/sessions, and decodes the response into dst.
+func (c *StripeClient) post(ctx context.Context, path string, params url.Values, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, StripeAPIURL+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.secretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		failure := struct {
+			Error *StripeError `json:"error"`
+		}{}
+		if json.Unmarshal(body, &failure) != nil || failure.Error == nil {
+			failure.Error = &StripeError{Message: http.StatusText(resp.StatusCode)}
+		}
+		failure.Error.Status = resp.StatusCode
+		return failure.Error
+	}
+	return json.Unmarshal(body, dst)
+}
+
+// CreateCheckoutSession starts the checkout of a subscription to price by
+// the user. The session and the subscription carry the id of the user, for
+// the stripe events to be linked to it. The known customers of the users
+// are reused, so that they keep their payment methods.
+func CreateCheckoutSession(ctx context.Context, app core.App, cfg *Config, userId string, price string) (*CheckoutSession, error) {
+	if cfg.StripeSecretKey == "" {
+		return nil, ErrBillingDisabled
+	}
+	if price == "" {
+		price = cfg.StripePriceIds[0]
+	}
+	if !slices.Contains(cfg.StripePriceIds, price) {
+		return nil, ErrUnknownPrice
+	}
+	user, err := GetUserById(app, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	appURL := strings.TrimRight(app.Settings().Meta.AppURL, "/")
+	successURL, cancelURL := cfg.BillingSuccessURL, cfg.BillingCancelURL
+	if successURL == "" {
+		successURL = appURL + "/?checkout=success"
+	}
+	if cancelURL == "" {
+		cancelURL = appURL + "/?checkout=canceled"
+	}
+	params := url.Values{
+		"mode":                                {"subscription"},
+		"line_items[0][price]":                {price},
+		"line_items[0][quantity]":             {"1"},
+		"success_url":                         {successURL},
+		"cancel_url":                          {cancelURL},
+		"client_reference_id":                 {user.Id},
+		"metadata[userId]":                    {user.Id},
+		"subscription_data[metadata][userId]": {user.Id},
+	}
+	subscription, err := FindUserSubscription(app, user.Id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if subscription != nil && subscription.StripeCustomer != "" {
+		params.Set("customer", subscription.StripeCustomer)
+	} else {
+		params.Set("customer_email", user.Email)
+	}
+
+	session := &CheckoutSession{}
+	if err := NewStripeClient(cfg.StripeSecretKey).post(ctx, "/checkout/sessions", params, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// findSubscriptionRecord returns the record of the subscription of the
+// user, or the one with the Stripe subscription id, or nil.
+func findSubscriptionRecord(app core.App, userId string, stripeId string) (*core.Record, error) {
+	filter, params := "stripe_subscription = {:stripeId}", dbx.Params{"stripeId": stripeId}
+	if userId != "" {
+		filter, params = "user = {:user}", dbx.Params{"user": userId}
+	}
+	record, err := app.FindFirstRecordByFilter(SubscriptionsCollection, filter, params)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return record, err
+}
+
+// linkCheckoutSession links the customer and the subscription of a
+// completed checkout to its user, the status coming with the subscription
+// events.
+func linkCheckoutSession(app core.App, event *InboundEvent) error {
+	userId, _ := event.Field("data.object.client_reference_id")
+	customer, _ := event.Field("data.object.customer")
+	stripeId, _ := event.Field("data.object.subscription")
+
+	record, err := findSubscriptionRecord(app, userId.(string), "")
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		collection, err := app.FindCachedCollectionByNameOrId(SubscriptionsCollection)
+		if err != nil {
+			return err
+		}
+		record = core.NewRecord(collection)
+		record.Set("user", userId)
+		record.Set("status", "incomplete")
+	}
+	record.Set("stripe_customer", customer)
+	record.Set("stripe_subscription", stripeId)
+	return app.Save(record)
+}
+
+// syncSubscription writes the state of the subscription of the event to the
+// one of its user, found through the userId of its metadata or its id. The
+// subscriptions of no known user fail, for Stripe to redeliver them once
+// their checkout completed.
+func syncSubscription(app core.App, event *InboundEvent) error {
+	stripeId, _ := event.Field("data.object.id")
+	userId, _ := event.Field("data.object.metadata.userId")
+	userIdValue, _ := userId.(string)
+
+	record, err := findSubscriptionRecord(app, userIdValue, stripeId.(string))
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		if userIdValue == "" {
+			return ErrSubscriptionUserUnknown
+		}
+		collection, err := app.FindCachedCollectionByNameOrId(SubscriptionsCollection)
+		if err != nil {
+			return err
+		}
+		record = core.NewRecord(collection)
+		record.Set("user", userIdValue)
+	}
+
+	customer, _ := event.Field("data.object.customer")
+	status, _ := event.Field("data.object.status")
+	cancelAtPeriodEnd, _ := event.Field("data.object.cancel_at_period_end")
+	record.Set("stripe_customer", customer)
+	record.Set("stripe_subscription", stripeId)
+	record.Set("status", status)
+	record.Set("cancel_at_period_end", cancelAtPeriodEnd == true)
+	if item, ok := event.Field("data.object.items.data"); ok {
+		if items, ok := item.([]any); ok && len(items) > 0 {
+			first, _ := items[0].(map[string]any)
+			if price, ok := payloadField(first, "price.id"); ok {
+				record.Set("price", price)
+			}
+			// the newer API versions moved the period to the items
+			if end, ok := payloadField(first, "current_period_end"); ok {
+				record.Set("current_period_end", unixDateTime(end))
+			}
+		}
+	}
+	if end, ok := event.Field("data.object.current_period_end"); ok {
+		record.Set("current_period_end", unixDateTime(end))
+	}
+	return app.Save(record)
+}
+
+// unixDateTime converts the unix times of the Stripe payloads, empty when
+// invalid.
+func unixDateTime(v any) string {
+	n, ok := v.(json.Number)
+	if !ok {
+		return ""
+	}
+	unix, err := strconv.ParseInt(n.String(), 10, 64)
+	if err != nil {
+		return ""
+	}
+	dt, _ := types.ParseDateTime(time.Unix(unix, 0))
+	return dt.String()
+}
+
+func init() {
+	RegisterInboundHandler("stripe", "checkout.session.completed", InboundHandler{
+		Required: map[string]string{
+			"data.object.client_reference_id": "string",
+			"data.object.customer":            "string",
+			"data.object.subscription":        "string",
+		},
+		Handle: linkCheckoutSession,
+	})
+	for _, eventType := range []string{"customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted"} {
+		RegisterInboundHandler("stripe", eventType, InboundHandler{
+			Required: map[string]string{
+				"data.object.id":       "string",
+				"data.object.customer": "string",
+				"data.object.status":   "string",
+			},
+			Handle: syncSubscription,
+		})
+	}
+}
+
+// RequireActiveSubscription rejects the requests of the users without an
+// active subscription with 402, for the premium routes. Superusers are let
+// through.
+func RequireActiveSubscription(app core.App) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil {
+			return WriteUnauthorized(e, "authentication required", nil)
+		}
+		if e.HasSuperuserAuth() {
+			return e.Next()
+		}
+		subscription, err := FindUserSubscription(WithTrace(app, e), e.Auth.Id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return WriteError(e, err, "error getting subscription")
+		}
+		if subscription == nil || !subscription.Active(time.Now()) {
+			return WriteErrorCode(e, CodeSubscriptionRequired, "an active subscription is required", nil)
+		}
+		return e.Next()
+	}
+}
+
+// GatePremiumRoutes applies RequireActiveSubscription to the routes of
+// PREMIUM_ROUTES, given as METHOD /pattern.
+func GatePremiumRoutes(app core.App, cfg *Config) func(e *core.RequestEvent) error {
+	requireSubscription := RequireActiveSubscription(app)
+	return func(e *core.RequestEvent) error {
+		if !slices.Contains(cfg.PremiumRoutes, e.Request.Pattern) {
+			return e.Next()
+		}
+		return requireSubscription(e)
+	}
+}
+
+// HandleCreateCheckoutSession answers POST /billing/checkout with the
+// Stripe checkout session the user subscribes through.
+func HandleCreateCheckoutSession(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		cr := CheckoutRequest{}
+		if err := BindStrict(e, &cr); err != nil {
+			return WriteBindError(e, err)
+		}
+		if e.Auth == nil || e.Auth.Collection().Name != Users.Table {
+			return WriteForbidden(e, "only users can subscribe", nil)
+		}
+
+		session, err := CreateCheckoutSession(e.Request.Context(), app, cfg, e.Auth.Id, cr.PriceId)
+		if errors.Is(err, ErrBillingDisabled) {
+			return WriteNotFound(e, err.Error(), nil)
+		}
+		if errors.Is(err, ErrUnknownPrice) {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid checkout", map[string]string{"priceId": err.Error()})
+		}
+		var stripeErr *StripeError
+		if errors.As(err, &stripeErr) {
+			app.Logger().Error("Failed to create the checkout session", "userId", e.Auth.Id, "error", err)
+			return WriteResp(e, http.StatusBadGateway, "the payment provider failed, try again later", nil)
+		}
+		if err != nil {
+			return writeUserError(e, err, "error creating checkout session")
+		}
+		return WriteResp(e, http.StatusCreated, "", session)
+	}
+}
+
+// HandleGetSubscription answers GET /billing/subscription with the
+// subscription of the user.
+func HandleGetSubscription(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil || e.Auth.Collection().Name != Users.Table {
+			return WriteForbidden(e, "only users have subscriptions", nil)
+		}
+		subscription, err := FindUserSubscription(WithTrace(app, e), e.Auth.Id)
+		if errors.Is(err, ErrNotFound) {
+			return WriteNotFound(e, "no subscription", nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error getting subscription")
+		}
+		return WriteOK(e, "", subscription)
+	}
+}
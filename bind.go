@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Codes of the FieldErrors, stable so that clients can map them to messages
+// of their own.
+const (
+	BindCodeUnknownField = "unknown_field"
+	BindCodeInvalidType  = "invalid_type"
+	BindCodeRequired     = "required"
+	BindCodeTooSmall     = "too_small"
+	BindCodeTooLarge     = "too_large"
+	BindCodeNotWritable  = "not_writable"
+)
+
+// FieldError is the machine readable error of a single body field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// BindError describes why a request body couldn't be bound, with the errors
+// of the offending fields (if any), sorted by field.
+type BindError struct {
+	Message string
+	Fields  []FieldError
+}
+
+func (e *BindError) Error() string {
+	return e.Message
+}
+
+func newFieldsBindError(message string, fields []FieldError) *BindError {
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+	names := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if !slices.Contains(names, field.Field) {
+			names = append(names, field.Field)
+		}
+	}
+	return &BindError{Message: message + ": " + strings.Join(names, ", "), Fields: fields}
+}
+
+// BindStrict binds a JSON request body into dst (a pointer to a struct),
+// rejecting empty bodies, keys that dst doesn't declare and values of the
+// wrong type. Non JSON bodies are bound with the default e.BindBody. Either
+// way, the default and binding tags of dst are then applied:
+//
+//	Limit int    `json:"limit" default:"10" binding:"min=1,max=100"`
+//	Name  string `json:"name" binding:"required,max=255"`
+//
+// required rejects missing and zero values, min and max bound the numbers
+// and the length of strings and slices.
+func BindStrict(e *core.RequestEvent, dst any) error {
+	mediaType, _, _ := mime.ParseMediaType(e.Request.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		if err := e.BindBody(dst); err != nil {
+			return err
+		}
+		return applyBindTags(dst, nil)
+	}
+
+	body, err := io.ReadAll(e.Request.Body)
+	if err != nil {
+		return err
+	}
+	return DecodeStrict(body, dst)
+}
+
+// DecodeStrict decodes the JSON object in body into dst with the same checks
+// as BindStrict. Numbers and booleans sent as strings, e.g. by forms, are
+// coerced to the type of their field.
+func DecodeStrict(body []byte, dst any) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return &BindError{Message: "request body is empty"}
+	}
+
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return &BindError{Message: "request body must be a JSON object"}
+	}
+
+	fields := bindFields(dst)
+	var unknown []FieldError
+	for key := range raw {
+		if _, ok := fields[key]; !ok {
+			unknown = append(unknown, FieldError{Field: key, Code: BindCodeUnknownField, Message: "unknown field"})
+		}
+	}
+	if len(unknown) > 0 {
+		return newFieldsBindError("unknown fields", unknown)
+	}
+
+	var invalid []FieldError
+	for key, value := range raw {
+		coerced, err := coerceJSON(value, fields[key].Type)
+		if err != nil {
+			invalid = append(invalid, FieldError{Field: key, Code: BindCodeInvalidType, Message: err.Error()})
+			continue
+		}
+		raw[key] = coerced
+	}
+	if len(invalid) > 0 {
+		return newFieldsBindError("invalid fields", invalid)
+	}
+	body, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return newFieldsBindError("invalid fields", []FieldError{{
+				Field:   typeErr.Field,
+				Code:    BindCodeInvalidType,
+				Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value),
+			}})
+		}
+		return &BindError{Message: err.Error()}
+	}
+
+	present := make(map[string]bool, len(raw))
+	for key := range raw {
+		present[key] = true
+	}
+	return applyBindTags(dst, present)
+}
+
+// coerceJSON converts a JSON string holding a number or a boolean into that
+// literal when t expects one, leaving any other value as is.
+func coerceJSON(value json.RawMessage, t reflect.Type) (json.RawMessage, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var str string
+	if json.Unmarshal(value, &str) != nil {
+		return value, nil
+	}
+	str = strings.TrimSpace(str)
+	switch t.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return nil, fmt.Errorf("expected bool, got %q", str)
+		}
+		return json.RawMessage(strconv.FormatBool(b)), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseInt(str, 10, 64); err != nil {
+			return nil, fmt.Errorf("expected integer, got %q", str)
+		}
+		return json.RawMessage(str), nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("expected number, got %q", str)
+		}
+		return json.RawMessage(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	}
+	return value, nil
+}
+
+// applyBindTags sets the defaults of the fields missing from the body and
+// checks the binding rules. present lists the keys of the body, when nil the
+// zero fields are treated as missing.
+func applyBindTags(dst any, present map[string]bool) error {
+	v := reflect.ValueOf(dst)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var errs []FieldError
+	for name, field := range bindFields(dst) {
+		value := v.FieldByIndex(field.Index)
+		missing := !present[name] && value.IsZero()
+		if present == nil {
+			missing = value.IsZero()
+		}
+
+		if def, ok := field.Tag.Lookup("default"); ok && missing {
+			if err := setDefault(value, def); err != nil {
+				return fmt.Errorf("invalid default of %s: %w", name, err)
+			}
+			missing = false
+		}
+
+		rules := field.Tag.Get("binding")
+		if rules == "" {
+			continue
+		}
+		if fieldErr := checkBindRules(name, value, rules, missing); fieldErr != nil {
+			errs = append(errs, *fieldErr)
+		}
+	}
+	if len(errs) > 0 {
+		return newFieldsBindError("invalid fields", errs)
+	}
+	return nil
+}
+
+// setDefault parses def into value, allocating it first for pointers.
+func setDefault(value reflect.Value, def string) error {
+	if value.Kind() == reflect.Pointer {
+		value.Set(reflect.New(value.Type().Elem()))
+		value = value.Elem()
+	}
+	if value.Kind() == reflect.String {
+		value.SetString(def)
+		return nil
+	}
+	return json.Unmarshal([]byte(def), value.Addr().Interface())
+}
+
+// checkBindRules checks the comma separated rules of a binding tag.
+func checkBindRules(name string, value reflect.Value, rules string, missing bool) *FieldError {
+	for _, rule := range strings.Split(rules, ",") {
+		key, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		if key == "required" {
+			if missing || value.IsZero() {
+				return &FieldError{Field: name, Code: BindCodeRequired, Message: "cannot be blank"}
+			}
+			continue
+		}
+		if key != "min" && key != "max" {
+			continue
+		}
+		if value.Kind() == reflect.Pointer {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			continue
+		}
+
+		var size float64
+		unit := ""
+		switch value.Kind() {
+		case reflect.String:
+			size, unit = float64(utf8.RuneCountInString(value.String())), " characters"
+		case reflect.Slice, reflect.Map, reflect.Array:
+			size, unit = float64(value.Len()), " items"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			size = float64(value.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			size = float64(value.Uint())
+		case reflect.Float32, reflect.Float64:
+			size = value.Float()
+		default:
+			continue
+		}
+		// optional strings and slices are only checked when given
+		if unit != "" && size == 0 && missing {
+			continue
+		}
+
+		if key == "min" && size < limit {
+			return &FieldError{Field: name, Code: BindCodeTooSmall, Message: "must be at least " + arg + unit}
+		}
+		if key == "max" && size > limit {
+			return &FieldError{Field: name, Code: BindCodeTooLarge, Message: "must be at most " + arg + unit}
+		}
+	}
+	return nil
+}
+
+// bindFields returns the fields of the struct pointed by dst by json key.
+func bindFields(dst any) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	t := reflect.TypeOf(dst)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return fields
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// WriteBindError responds with 400, including the FieldErrors of a BindError.
+func WriteBindError(e *core.RequestEvent, err error) error {
+	if limit, ok := IsBodyTooLarge(err); ok {
+		return writeBodyTooLarge(e, limit)
+	}
+	var bindErr *BindError
+	if errors.As(err, &bindErr) && len(bindErr.Fields) > 0 {
+		return WriteErrorCode(e, CodeInvalidBody, "bad request: "+bindErr.Message, bindErr.Fields)
+	}
+	return WriteErrorCode(e, CodeInvalidBody, "bad request: "+err.Error(), nil)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+)
+
+func TestDecodeStrict(t *testing.T) {
+	scenarios := []struct {
+		name           string
+		body           string
+		expectedFields []FieldError
+	}{
+		{"empty", "", nil},
+		{"blank", " \n", nil},
+		{"not an object", `["email"]`, nil},
+		{"unknown field", `{"emial":"a@example.com","email":"a@example.com"}`, []FieldError{
+			{Field: "emial", Code: BindCodeUnknownField, Message: "unknown field"},
+		}},
+		{"unknown fields", `{"b":1,"a":2}`, []FieldError{
+			{Field: "a", Code: BindCodeUnknownField, Message: "unknown field"},
+			{Field: "b", Code: BindCodeUnknownField, Message: "unknown field"},
+		}},
+		{"invalid bool string", `{"emailVisibility":"maybe"}`, []FieldError{
+			{Field: "emailVisibility", Code: BindCodeInvalidType, Message: `expected bool, got "maybe"`},
+		}},
+		{"wrong type", `{"emailVisibility":1}`, []FieldError{
+			{Field: "emailVisibility", Code: BindCodeInvalidType, Message: "expected bool, got number"},
+		}},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			cr := models.UserCreationRequest{}
+			err := DecodeStrict([]byte(scenario.body), &cr)
+			bindErr := &BindError{}
+			if !errors.As(err, &bindErr) {
+				t.Fatalf("expected a BindError, got %v", err)
+			}
+			if !reflect.DeepEqual(bindErr.Fields, scenario.expectedFields) {
+				t.Errorf("expected the fields %+v, got %+v", scenario.expectedFields, bindErr.Fields)
+			}
+		})
+	}
+
+	ur := models.UserUpdateRequest{}
+	if err := DecodeStrict([]byte(`{"name":"A","emailVisibility":"true"}`), &ur); err != nil {
+		t.Fatal(err)
+	}
+	if ur.Name == nil || *ur.Name != "A" || ur.EmailVisibility == nil || !*ur.EmailVisibility {
+		t.Errorf("expected the name and the coerced emailVisibility, got %+v", ur)
+	}
+}
+
+// TestUserRoutesBindStrict sends the bodies BindStrict rejects to POST and
+// PATCH /users, which must answer with the offending fields and write
+// nothing.
+func TestUserRoutesBindStrict(t *testing.T) {
+	s := newTestServer(t, nil)
+	user := s.Users[0]
+
+	scenarios := []struct {
+		name           string
+		body           string
+		expectedFields []FieldError
+	}{
+		{"empty body", "", nil},
+		{"unknown field", `{"emial":"x@example.com"}`, []FieldError{
+			{Field: "emial", Code: BindCodeUnknownField, Message: "unknown field"},
+		}},
+		{"wrong type", `{"emailVisibility":"maybe"}`, []FieldError{
+			{Field: "emailVisibility", Code: BindCodeInvalidType, Message: `expected bool, got "maybe"`},
+		}},
+	}
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/users"},
+		{http.MethodPatch, "/users/" + user.Id},
+	} {
+		for _, scenario := range scenarios {
+			t.Run(route.method+" "+scenario.name, func(t *testing.T) {
+				res, body := s.doRaw(t, route.method, route.path, s.SuperuserToken, "application/json", []byte(scenario.body))
+				if res.StatusCode != http.StatusBadRequest {
+					t.Fatalf("expected status 400, got %d: %s", res.StatusCode, body)
+				}
+				resp := checkAPIResp(t, res.StatusCode, body)
+				if resp.Code != CodeInvalidBody {
+					t.Errorf("expected code %q, got %q", CodeInvalidBody, resp.Code)
+				}
+				var fields []FieldError
+				if resp.Data != nil {
+					decodeData(t, resp, &fields)
+				}
+				if !reflect.DeepEqual(fields, scenario.expectedFields) {
+					t.Errorf("expected the fields %+v, got %+v", scenario.expectedFields, fields)
+				}
+			})
+		}
+	}
+
+	total, err := CountUsers(s.App, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != len(s.Users) {
+		t.Errorf("expected no user to be created, got %d users", total)
+	}
+	current, err := GetUserById(s.App, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Updated != user.Updated {
+		t.Errorf("expected the user to be left alone, got %+v", current)
+	}
+}
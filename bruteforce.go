@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// CaptchaResponseHeader carries the CAPTCHA response of the clients the
+// throttle challenges, e.g. the h-captcha-response of an hCaptcha widget.
+const CaptchaResponseHeader = "X-Captcha-Response"
+
+const (
+	authFailuresTable          = "auth_failures"
+	authFailuresCleanupJobName = "authFailuresCleanup"
+	// authThrottleMaxEntries bounds the keys held in memory, the ones past
+	// their window being dropped first.
+	authThrottleMaxEntries = 100000
+)
+
+// upsertAuthFailureSQL writes the counter of a key.
+const upsertAuthFailureSQL = "INSERT INTO {{auth_failures}} ([[id]], [[key]], [[failures]], [[last_failure]], [[locked_until]], [[created]], [[updated]]) " +
+	"VALUES ({:id}, {:key}, {:failures}, {:lastFailure}, {:lockedUntil}, {:now}, {:now}) " +
+	"ON CONFLICT ([[key]]) DO UPDATE SET " +
+	"[[failures]] = excluded.[[failures]], [[last_failure]] = excluded.[[last_failure]], " +
+	"[[locked_until]] = excluded.[[locked_until]], [[updated]] = excluded.[[updated]]"
+
+var (
+	ErrAuthLockedOut   = errors.New("too many failed attempts, try again later")
+	ErrCaptchaRequired = errors.New("captcha required, send its response in the " + CaptchaResponseHeader + " header")
+)
+
+// AuthLockout is a client IP or an account with failed logins, in
+// GET /admin/auth-lockouts.
+type AuthLockout struct {
+	Key         string `db:"key" json:"key"`
+	Failures    int    `db:"failures" json:"failures"`
+	LastFailure string `db:"last_failure" json:"lastFailure"`
+	LockedUntil string `db:"locked_until" json:"lockedUntil"`
+}
+
+type authFailures struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// AuthThrottleOptions are the AUTH_* settings of the throttle.
+type AuthThrottleOptions struct {
+	// LockoutThreshold is the failures after which the key is locked out,
+	// for BaseLockout doubled by each further failure up to MaxLockout.
+	LockoutThreshold int
+	// CaptchaThreshold is the failures after which Captcha challenges the
+	// key, 0 for never.
+	CaptchaThreshold int
+	BaseLockout      time.Duration
+	MaxLockout       time.Duration
+	// Window is how long the failures are remembered after the last one.
+	Window time.Duration
+}
+
+// AuthThrottle counts the failed logins and 2FA verifications per client
+// IP and per account, locking them out for exponentially longer after
+// too many. The counters are kept in memory and written through to
+// auth_failures, from which they are loaded on start, so that restarting
+// doesn't lift the lockouts. Like the usage, the instances sharing the
+// database don't see each other's failures until they restart.
+type AuthThrottle struct {
+	app  core.App
+	opts AuthThrottleOptions
+
+	mu      sync.Mutex
+	entries map[string]*authFailures
+}
+
+// Throttle is the brute-force protection of the auth endpoints, nil when
+// AUTH_LOCKOUT_THRESHOLD is 0.
+var Throttle *AuthThrottle
+
+func NewAuthThrottle(app core.App, opts AuthThrottleOptions) *AuthThrottle {
+	return &AuthThrottle{app: app, opts: opts, entries: map[string]*authFailures{}}
+}
+
+// AuthAccountKey and AuthIPKey are the keys the failures are counted by.
+func AuthAccountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func AuthIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Load reads the counters still within their window from auth_failures.
+func (t *AuthThrottle) Load() error {
+	rows := []AuthLockout{}
+	cutoff, err := types.ParseDateTime(time.Now().Add(-t.opts.Window))
+	if err != nil {
+		return err
+	}
+	now := types.NowDateTime().String()
+	err = t.app.DB().
+		Select("key", "failures", "last_failure", "locked_until").
+		From(authFailuresTable).
+		Where(dbx.NewExp("[[last_failure]] >= {:cutoff} OR [[locked_until]] > {:now}", dbx.Params{"cutoff": cutoff.String(), "now": now})).
+		All(&rows)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, row := range rows {
+		entry := &authFailures{failures: row.Failures}
+		if last, err := types.ParseDateTime(row.LastFailure); err == nil {
+			entry.last = last.Time()
+		}
+		if lockedUntil, err := types.ParseDateTime(row.LockedUntil); err == nil {
+			entry.lockedUntil = lockedUntil.Time()
+		}
+		t.entries[row.Key] = entry
+	}
+	return nil
+}
+
+// entry returns the counter of key, forgetting the failures past their
+// window. The caller holds mu.
+func (t *AuthThrottle) entry(key string, now time.Time) *authFailures {
+	entry := t.entries[key]
+	if entry != nil && now.Sub(entry.last) > t.opts.Window && !now.Before(entry.lockedUntil) {
+		delete(t.entries, key)
+		entry = nil
+	}
+	return entry
+}
+
+// Check returns ErrAuthLockedOut, with how long until the lockout ends,
+// while a key is locked out, and ErrCaptchaRequired once a key failed
+// often enough to be challenged and the request doesn't carry a valid
+// CAPTCHA response. The CAPTCHA isn't checked when Captcha is nil.
+func (t *AuthThrottle) Check(e *core.RequestEvent, keys ...string) (time.Duration, error) {
+	if t == nil {
+		return 0, nil
+	}
+	now := time.Now()
+	retryAfter, challenge := time.Duration(0), false
+	t.mu.Lock()
+	for _, key := range keys {
+		entry := t.entry(key, now)
+		if entry == nil {
+			continue
+		}
+		retryAfter = max(retryAfter, entry.lockedUntil.Sub(now))
+		challenge = challenge || (t.opts.CaptchaThreshold > 0 && entry.failures >= t.opts.CaptchaThreshold)
+	}
+	t.mu.Unlock()
+	if retryAfter > 0 {
+		return retryAfter, ErrAuthLockedOut
+	}
+	if challenge && Captcha != nil {
+		response := e.Request.Header.Get(CaptchaResponseHeader)
+		if response == "" {
+			return 0, ErrCaptchaRequired
+		}
+		ok, err := Captcha.Verify(e.Request.Context(), response, e.RealIP())
+		if err != nil {
+			// the lockouts still hold while the CAPTCHA service is down
+			t.app.Logger().Warn("Failed to verify captcha", "error", err)
+			return 0, nil
+		}
+		if !ok {
+			return 0, ErrCaptchaRequired
+		}
+	}
+	return 0, nil
+}
+
+// Fail counts a failure of the keys, locking out those past the threshold.
+func (t *AuthThrottle) Fail(keys ...string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	updated := make([]AuthLockout, 0, len(keys))
+	t.mu.Lock()
+	if len(t.entries) >= authThrottleMaxEntries {
+		t.sweep(now)
+	}
+	for _, key := range keys {
+		entry := t.entry(key, now)
+		if entry == nil {
+			entry = &authFailures{}
+			t.entries[key] = entry
+		}
+		entry.failures++
+		entry.last = now
+		if excess := entry.failures - t.opts.LockoutThreshold; excess >= 0 {
+			lockout := t.opts.BaseLockout
+			for i := 0; i < excess && lockout < t.opts.MaxLockout; i++ {
+				lockout *= 2
+			}
+			entry.lockedUntil = now.Add(min(lockout, t.opts.MaxLockout))
+		}
+		updated = append(updated, newAuthLockout(key, entry))
+	}
+	t.mu.Unlock()
+
+	if err := t.save(updated); err != nil {
+		t.app.Logger().Warn("Failed to write auth failures", "error", err)
+	}
+}
+
+// Succeed forgets the failures of the key, e.g. of the account once its
+// owner logged in. The failures of the client IPs are only forgotten
+// after their window, so that an attacker can't reset them with an
+// account of their own.
+func (t *AuthThrottle) Succeed(key string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	_, ok := t.entries[key]
+	delete(t.entries, key)
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := t.delete(key); err != nil {
+		t.app.Logger().Warn("Failed to delete auth failures", "key", key, "error", err)
+	}
+}
+
+// Unlock lifts the lockout of the key and forgets its failures, returning
+// ErrNotFound when it has none.
+func (t *AuthThrottle) Unlock(key string) error {
+	t.mu.Lock()
+	_, ok := t.entries[key]
+	delete(t.entries, key)
+	t.mu.Unlock()
+	var affected int64
+	err := RetryWrite(t.app, func() error {
+		res, err := t.app.NonconcurrentDB().Delete(authFailuresTable, dbx.HashExp{"key": key}).Execute()
+		if err != nil {
+			return err
+		}
+		affected, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !ok && affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Lockouts returns the keys with failures within their window, the locked
+// out ones first, then the most recent failures first.
+func (t *AuthThrottle) Lockouts() []AuthLockout {
+	now := time.Now()
+	t.mu.Lock()
+	lockouts := make([]AuthLockout, 0, len(t.entries))
+	for key := range t.entries {
+		if entry := t.entry(key, now); entry != nil {
+			lockouts = append(lockouts, newAuthLockout(key, entry))
+		}
+	}
+	t.mu.Unlock()
+	nowValue := types.NowDateTime().String()
+	sort.Slice(lockouts, func(i, j int) bool {
+		iLocked, jLocked := lockouts[i].LockedUntil > nowValue, lockouts[j].LockedUntil > nowValue
+		if iLocked != jLocked {
+			return iLocked
+		}
+		return lockouts[i].LastFailure > lockouts[j].LastFailure
+	})
+	return lockouts
+}
+
+// sweep drops the keys past their window, or every key when they all are
+// within it rather than growing unbounded. The caller holds mu.
+func (t *AuthThrottle) sweep(now time.Time) {
+	for key := range t.entries {
+		t.entry(key, now)
+	}
+	if len(t.entries) >= authThrottleMaxEntries {
+		clear(t.entries)
+	}
+}
+
+func newAuthLockout(key string, entry *authFailures) AuthLockout {
+	lockout := AuthLockout{Key: key, Failures: entry.failures}
+	if !entry.last.IsZero() {
+		last, _ := types.ParseDateTime(entry.last)
+		lockout.LastFailure = last.String()
+	}
+	if !entry.lockedUntil.IsZero() {
+		lockedUntil, _ := types.ParseDateTime(entry.lockedUntil)
+		lockout.LockedUntil = lockedUntil.String()
+	}
+	return lockout
+}
+
+func (t *AuthThrottle) save(lockouts []AuthLockout) error {
+	now := types.NowDateTime().String()
+	return RetryWrite(t.app, func() error {
+		return WithTx(t.app, func(txApp core.App) error {
+			for _, lockout := range lockouts {
+				_, err := txApp.DB().NewQuery(upsertAuthFailureSQL).Bind(dbx.Params{
+					"id":          NewId("auth_failures"),
+					"key":         lockout.Key,
+					"failures":    lockout.Failures,
+					"lastFailure": lockout.LastFailure,
+					"lockedUntil": lockout.LockedUntil,
+					"now":         now,
+				}).Execute()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func (t *AuthThrottle) delete(key string) error {
+	return RetryWrite(t.app, func() error {
+		_, err := t.app.NonconcurrentDB().Delete(authFailuresTable, dbx.HashExp{"key": key}).Execute()
+		return err
+	})
+}
+
+// DeleteExpiredAuthFailures removes the counters past their window and
+// their lockout.
+func DeleteExpiredAuthFailures(app core.App, window time.Duration) error {
+	cutoff, err := types.ParseDateTime(time.Now().Add(-window))
+	if err != nil {
+		return err
+	}
+	return RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().Delete(authFailuresTable, dbx.NewExp(
+			"[[last_failure]] < {:cutoff} AND [[locked_until]] < {:now}",
+			dbx.Params{"cutoff": cutoff.String(), "now": types.NowDateTime().String()},
+		)).Execute()
+		return err
+	})
+}
+
+// ScheduleAuthFailuresCleanup deletes the expired counters every hour.
+func ScheduleAuthFailuresCleanup(app core.App, window time.Duration) {
+	app.Cron().MustAdd(authFailuresCleanupJobName, "15 * * * *", func() {
+		if err := DeleteExpiredAuthFailures(app, window); err != nil {
+			app.Logger().Warn("Failed to delete expired auth failures", "error", err)
+		}
+	})
+}
+
+// writeAuthThrottleError responds to the requests Check refused.
+func writeAuthThrottleError(e *core.RequestEvent, retryAfter time.Duration, err error) error {
+	if errors.Is(err, ErrAuthLockedOut) {
+		e.Response.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		return WriteErrorCode(e, CodeAuthLockedOut, err.Error(), nil)
+	}
+	return WriteErrorCode(e, CodeCaptchaRequired, err.Error(), nil)
+}
+
+// BindAuthThrottleHooks throttles the built-in auth-with-password endpoint
+// of the users collection like POST /auth/login.
+func BindAuthThrottleHooks(app core.App) {
+	app.OnRecordAuthWithPasswordRequest(Users.Table).BindFunc(func(e *core.RecordAuthWithPasswordRequestEvent) error {
+		keys := []string{AuthIPKey(e.RealIP()), AuthAccountKey(e.Identity)}
+		if retryAfter, err := Throttle.Check(e.RequestEvent, keys...); err != nil {
+			if errors.Is(err, ErrAuthLockedOut) {
+				e.Response.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				return e.TooManyRequestsError(err.Error(), nil)
+			}
+			return e.UnauthorizedError(err.Error(), nil)
+		}
+		if e.Record == nil || !e.Record.ValidatePassword(e.Password) {
+			Throttle.Fail(keys...)
+		} else {
+			Throttle.Succeed(AuthAccountKey(e.Identity))
+		}
+		return e.Next()
+	})
+}
+
+// CaptchaVerifier checks the CAPTCHA responses of the clients the throttle
+// challenges.
+type CaptchaVerifier interface {
+	Verify(ctx context.Context, response string, remoteIP string) (bool, error)
+}
+
+// Captcha verifies the CAPTCHA responses, nil unless CAPTCHA_VERIFY_URL is
+// set, in which case the failures only lead to lockouts.
+var Captcha CaptchaVerifier
+
+// SiteVerifyCaptcha verifies the responses with the siteverify endpoint
+// shared by hCaptcha, reCAPTCHA and Cloudflare Turnstile.
+type SiteVerifyCaptcha struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func NewSiteVerifyCaptcha(verifyURL string, secret string) *SiteVerifyCaptcha {
+	return &SiteVerifyCaptcha{url: verifyURL, secret: secret, client: Downstream.Client(DependencyCaptcha, 5*time.Second)}
+}
+
+func (c *SiteVerifyCaptcha) Verify(ctx context.Context, response string, remoteIP string) (bool, error) {
+	params := url.Values{"secret": {c.secret}, "response": {response}, "remoteip": {remoteIP}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, strings.NewReader(params.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New("captcha verification failed with status " + strconv.Itoa(resp.StatusCode))
+	}
+	result := struct {
+		Success bool `json:"success"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// HandleListAuthLockouts lists the client IPs and the accounts with failed
+// logins, for the support staff.
+func HandleListAuthLockouts() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if Throttle == nil {
+			return WriteOK(e, "", []AuthLockout{})
+		}
+		return WriteOK(e, "", Throttle.Lockouts())
+	}
+}
+
+// HandleUnlockAuthLockout lifts the lockout of a client IP or an account.
+func HandleUnlockAuthLockout(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		key := e.Request.PathValue("key")
+		if Throttle == nil {
+			return WriteNotFound(e, "lockout not found", nil)
+		}
+		err := Throttle.Unlock(key)
+		if errors.Is(err, ErrNotFound) {
+			return WriteNotFound(e, "lockout not found", nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error lifting lockout")
+		}
+		_, actorId := RequestActor(e)
+		app.Logger().Info("Auth lockout lifted", "key", key, "actorId", actorId)
+		return WriteOK(e, "", nil)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var (
+	ErrBulkDeleteNoFilter = errors.New("a filter is required to delete users in bulk")
+	ErrBulkDeleteTooMany  = errors.New("too many users match the filter")
+	ErrBulkDeleteInvalid  = errors.New("invalid confirmation token")
+	ErrBulkDeleteExpired  = errors.New("confirmation token expired")
+	ErrBulkDeleteChanged  = errors.New("the users matching the filter changed since the dry run")
+)
+
+// BulkDeletePreview is the response to DELETE /users?dryRun=true, with the
+// token confirming the deletion of exactly these users.
+type BulkDeletePreview struct {
+	Count   int      `json:"count"`
+	Ids     []string `json:"ids"`
+	Token   string   `json:"token"`
+	Expires string   `json:"expires"`
+}
+
+type BulkDeleteResult struct {
+	Deleted int      `json:"deleted"`
+	Ids     []string `json:"ids"`
+}
+
+// bulkDeleteDigest identifies the filter along with the users it matched,
+// so that a token can't confirm another deletion than the one previewed.
+func bulkDeleteDigest(filter string, ids []string) string {
+	sum := sha256.Sum256([]byte(filter + "\n" + strings.Join(ids, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// SignBulkDeleteToken returns a token for the actor to delete the users
+// matching filter, which must be ids when it is used.
+func SignBulkDeleteToken(secret []byte, actorId string, filter string, ids []string, expires time.Time) string {
+	return signUserToken(secret, "bulk-delete", actorId, bulkDeleteDigest(filter, ids), expires)
+}
+
+// VerifyBulkDeleteToken checks that the token was issued to the actor for
+// filter matching ids.
+func VerifyBulkDeleteToken(secret []byte, token string, actorId string, filter string, ids []string, now time.Time) error {
+	subject, digest, err := verifyUserToken(secret, "bulk-delete", token, now)
+	if errors.Is(err, errTokenExpired) {
+		return ErrBulkDeleteExpired
+	}
+	if err != nil || subject != actorId {
+		return ErrBulkDeleteInvalid
+	}
+	if digest != bulkDeleteDigest(filter, ids) {
+		return ErrBulkDeleteChanged
+	}
+	return nil
+}
+
+// FindBulkDeleteIds returns the sorted ids of the users matching filter,
+// failing with ErrBulkDeleteTooMany past max.
+func FindBulkDeleteIds(app core.App, filter dbx.Expression, max int) ([]string, error) {
+	ids := []string{}
+	err := Users.Query(app).
+		Select(Users.Table + ".id").
+		AndWhere(filter).
+		OrderBy(Users.Table + ".id").
+		Limit(int64(max) + 1).
+		Column(&ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > max {
+		return nil, ErrBulkDeleteTooMany
+	}
+	return ids, nil
+}
+
+// BulkDeleteUsers deletes the at most max users matching filter in a single
+// transaction, soft deleting them unless hard is set. check vets their ids
+// before anything is deleted. The events of the deleted users are queued
+// along with them, and the users are returned as read beforehand.
+func BulkDeleteUsers(app core.App, filter dbx.Expression, max int, check func(ids []string) error, hard bool) ([]models.User, error) {
+	span := StartStorageSpan(app, "BulkDeleteUsers", "UPDATE")
+	var users []models.User
+	err := WithTx(app, func(txApp core.App) error {
+		ids, err := FindBulkDeleteIds(txApp, filter, max)
+		if err != nil {
+			return err
+		}
+		if err := check(ids); err != nil {
+			return err
+		}
+		users = make([]models.User, 0, len(ids))
+		for _, id := range ids {
+			user, err := GetUserById(txApp, id)
+			if err != nil {
+				return err
+			}
+			if hard {
+				err = HardDeleteUserById(txApp, id)
+			} else {
+				err = DeleteUserById(txApp, id)
+			}
+			if err != nil {
+				return fmt.Errorf("deleting %s: %w", id, err)
+			}
+			if err := QueueUserEvent(txApp, EventUserDeleted, user); err != nil {
+				return err
+			}
+			users = append(users, *user)
+		}
+		span.SetAttr("db.response.affected_rows", len(users))
+		return nil
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	UserResponseCache.Invalidate()
+	return users, nil
+}
+
+// HandleBulkDeleteUsers deletes the users matching ?filter=, with the syntax
+// of GET /users, in two steps: ?dryRun=true lists them along with a token,
+// which the deletion itself requires as ?token= before it expires.
+func HandleBulkDeleteUsers(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	secret := []byte(cfg.BulkDeleteSecret)
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		query := e.Request.URL.Query()
+		rawFilter := strings.TrimSpace(query.Get("filter"))
+		if rawFilter == "" {
+			return WriteBadRequest(e, ErrBulkDeleteNoFilter.Error(), nil)
+		}
+		filter, err := ParseFilter(rawFilter, UserFilterFields)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		hard, _ := strconv.ParseBool(query.Get("hard"))
+		_, actorId := RequestActor(e)
+		// a token previewing a soft delete doesn't confirm a hard one
+		scope := rawFilter
+		if hard {
+			scope += "\nhard"
+		}
+
+		if dryRun, _ := strconv.ParseBool(query.Get("dryRun")); dryRun {
+			ids, err := FindBulkDeleteIds(app, filter, cfg.BulkDeleteMax)
+			if errors.Is(err, ErrBulkDeleteTooMany) {
+				return WriteBadRequest(e, fmt.Sprintf("more than %d users match the filter, narrow it down", cfg.BulkDeleteMax), nil)
+			}
+			if err != nil {
+				return WriteError(e, err, "error getting users")
+			}
+			expires := time.Now().Add(cfg.BulkDeleteTokenTTL)
+			return WriteOK(e, "", BulkDeletePreview{
+				Count:   len(ids),
+				Ids:     ids,
+				Token:   SignBulkDeleteToken(secret, actorId, scope, ids, expires),
+				Expires: expires.UTC().Format(time.RFC3339),
+			})
+		}
+
+		token := query.Get("token")
+		if token == "" {
+			return WriteBadRequest(e, "a token from a ?dryRun=true request is required", nil)
+		}
+		users, err := BulkDeleteUsers(app, filter, cfg.BulkDeleteMax, func(ids []string) error {
+			return VerifyBulkDeleteToken(secret, token, actorId, scope, ids, time.Now())
+		}, hard)
+		switch {
+		case errors.Is(err, ErrBulkDeleteInvalid), errors.Is(err, ErrBulkDeleteExpired):
+			return WriteBadRequest(e, err.Error(), nil)
+		case errors.Is(err, ErrBulkDeleteChanged):
+			return WriteConflict(e, err.Error()+", run it again", nil)
+		case errors.Is(err, ErrBulkDeleteTooMany):
+			return WriteBadRequest(e, fmt.Sprintf("more than %d users match the filter, narrow it down", cfg.BulkDeleteMax), nil)
+		case err != nil:
+			return WriteError(e, err, "error deleting users")
+		}
+
+		result := BulkDeleteResult{Deleted: len(users), Ids: make([]string, len(users))}
+		for i, user := range users {
+			result.Ids[i] = user.Id
+		}
+		app.Logger().Info("Deleted users in bulk", "filter", rawFilter, "count", len(users), "hard", hard, "actorId", actorId)
+		return WriteOK(e, "", result)
+	}
+}
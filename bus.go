@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+
+	"github.com/EricFrancis12/pocketbase-demo/events"
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// EventBus publishes the user events to the message bus of EVENT_BUS_URL.
+// It is nil unless EVENT_BUS_URL is set.
+var EventBus events.Publisher
+
+// BindEventBus publishes the user events taken out of the outbox to
+// publisher, on the subject prefix.event, e.g. users.user.created, and
+// closes it on terminate.
+func BindEventBus(app core.App, publisher events.Publisher, prefix string) {
+	RegisterOutboxSink(OutboxSinkBus, func(ctx context.Context, id string, event string, user models.User) error {
+		msg, err := events.NewMessage(id, event, user)
+		if err != nil {
+			return err
+		}
+		return Downstream.Guard(DependencyEventBus).Do(ctx, func(ctx context.Context) error {
+			return publisher.Publish(ctx, prefix+"."+event, msg)
+		})
+	})
+	app.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+		if err := publisher.Close(); err != nil {
+			e.App.Logger().Warn("Failed to close the event bus connection", "error", err)
+		}
+		return e.Next()
+	})
+}
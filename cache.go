@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/cache"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// UserResponseCache caches the responses of the user read routes. It is
+// nil when RESPONSE_CACHE_TTL is 0, in which case only the ETags are sent.
+var UserResponseCache *ResponseCache
+
+// responseGenerationKey holds the generation of the cached responses,
+// bumped by Invalidate.
+const responseGenerationKey = "generation"
+
+type cachedResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType,omitempty"`
+	ETag        string `json:"etag"`
+	Body        []byte `json:"body"`
+}
+
+// ResponseCache holds successful GET responses for ttl, in a cache.Cache
+// shared by the instances when CACHE_URL is set. Every write to the
+// underlying data must call Invalidate, which drops all of them at once by
+// moving to a new generation, the responses being cached per generation.
+type ResponseCache struct {
+	cache  cache.Cache
+	ttl    time.Duration
+	logger *slog.Logger
+}
+
+// NewResponseCache returns a cache of the responses in c. The failures to
+// invalidate it are logged to logger, when set.
+func NewResponseCache(c cache.Cache, ttl time.Duration, logger *slog.Logger) *ResponseCache {
+	return &ResponseCache{cache: c, ttl: ttl, logger: logger}
+}
+
+// Invalidate drops every cached response. It is safe to call on a nil cache.
+// When it fails, which only Redis can, the responses stay cached until
+// they expire.
+func (c *ResponseCache) Invalidate() {
+	if c == nil {
+		return
+	}
+	_, err := c.cache.Incr(context.Background(), responseGenerationKey, 1, 0)
+	if err != nil && c.logger != nil {
+		c.logger.Error("Failed to invalidate the response cache", "error", err)
+	}
+}
+
+// Generation returns the current generation, to be passed to Get and Set.
+func (c *ResponseCache) Generation(ctx context.Context) (int64, error) {
+	return c.cache.Incr(ctx, responseGenerationKey, 0, 0)
+}
+
+func (c *ResponseCache) Get(ctx context.Context, key string, generation int64) (cachedResponse, bool, error) {
+	raw, ok, err := c.cache.Get(ctx, generationKey(key, generation))
+	if err != nil || !ok {
+		return cachedResponse{}, false, err
+	}
+	var entry cachedResponse
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return cachedResponse{}, false, err
+	}
+	return entry, true, nil
+}
+
+// Set stores entry in generation. An entry of a response computed while
+// the cache was invalidated is stored in a past generation, and never
+// read.
+func (c *ResponseCache) Set(ctx context.Context, key string, entry cachedResponse, generation int64) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return c.cache.Set(ctx, generationKey(key, generation), raw, c.ttl)
+}
+
+func generationKey(key string, generation int64) string {
+	return strconv.FormatInt(generation, 10) + ":" + key
+}
+
+// OpenCache opens the cache of CACHE_URL for the keys under prefix, or an
+// in-process LRU of maxEntries keys when it's empty, closed on terminate.
+func OpenCache(app core.App, cfg *Config, prefix string, maxEntries int) (cache.Cache, error) {
+	c, err := cache.Open(cfg.CacheURL,
+		cache.WithPrefix(cfg.CachePrefix+prefix),
+		cache.WithMaxEntries(maxEntries),
+		cache.WithTimeout(cfg.CacheTimeout))
+	if err != nil {
+		return nil, err
+	}
+	app.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+		if err := c.Close(); err != nil {
+			e.App.Logger().Warn("Failed to close the cache", "prefix", prefix, "error", err)
+		}
+		return e.Next()
+	})
+	return c, nil
+}
+
+// bufferedResponse holds back the response body, so that the ETag can be
+// computed from it before anything is sent.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func NewETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// ETagMatches reports whether the If-None-Match header lists etag.
+func ETagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// responseCacheKey identifies the response of a request. The requester is
+// part of the key since the responses depend on it, e.g. the redacted
+// emails.
+func responseCacheKey(e *core.RequestEvent) string {
+	requester := ""
+	switch {
+	case e.HasSuperuserAuth():
+		requester = "superuser"
+	case e.Auth != nil:
+		requester = "auth:" + e.Auth.Collection().Id + ":" + e.Auth.Id
+	case e.Get(apiKeyRequestKey) != nil:
+		requester = "apikey"
+	}
+	if WantsRawResponse(e) {
+		requester += ":raw"
+	}
+	if contentType := NegotiateContentType(e.Request); contentType != ContentTypeJSON {
+		requester += ":" + contentType
+	}
+	if tenantId, ok := RequestTenant(e); ok && tenantId != "" {
+		requester += ":tenant:" + tenantId
+	}
+	return requester + " " + e.Request.URL.Path + "?" + e.Request.URL.Query().Encode()
+}
+
+func writeCachedResponse(e *core.RequestEvent, entry cachedResponse) error {
+	e.Response.Header().Set("ETag", entry.ETag)
+	if ETagMatches(e.Request.Header.Get("If-None-Match"), entry.ETag) {
+		e.Response.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if entry.ContentType != "" {
+		e.Response.Header().Set("Content-Type", entry.ContentType)
+	}
+	e.Response.WriteHeader(entry.Status)
+	_, err := e.Response.Write(entry.Body)
+	return err
+}
+
+// CacheResponses answers GET requests from cache when possible and sends an
+// ETag with every successful response, answering 304 when it matches the
+// If-None-Match header. The cache can be nil to only send the ETags.
+func CacheResponses(responses *ResponseCache) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		// the streamed responses would be held back whole, and the writes
+		// to the expanded relations don't invalidate the cache
+		if _, stream := RequestedStream(e.Request); e.Request.Method != http.MethodGet || stream || e.Request.URL.Query().Has("expand") {
+			return e.Next()
+		}
+		// the responses can change at any time, but can be revalidated
+		e.Response.Header().Set("Cache-Control", "private, no-cache")
+
+		key := responseCacheKey(e)
+		ctx := e.Request.Context()
+		c := responses
+		var generation int64
+		if c != nil {
+			var err error
+			generation, err = c.Generation(ctx)
+			if err != nil {
+				// answered uncached rather than failed
+				e.App.Logger().Warn("Failed to read the response cache", "error", err)
+				c = nil
+			}
+		}
+		if c != nil {
+			entry, ok, err := c.Get(ctx, key, generation)
+			if err != nil {
+				e.App.Logger().Warn("Failed to read the response cache", "error", err)
+			}
+			if ok {
+				e.Response.Header().Set("X-Cache", "HIT")
+				return writeCachedResponse(e, entry)
+			}
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: e.Response}
+		e.Response = buffered
+		err := e.Next()
+		e.Response = buffered.ResponseWriter
+		if err != nil {
+			return err
+		}
+
+		entry := cachedResponse{
+			Status:      buffered.status,
+			ContentType: e.Response.Header().Get("Content-Type"),
+			Body:        buffered.body.Bytes(),
+		}
+		if entry.Status != http.StatusOK {
+			if entry.Status != 0 {
+				e.Response.WriteHeader(entry.Status)
+			}
+			_, err := e.Response.Write(entry.Body)
+			return err
+		}
+
+		entry.ETag = NewETag(entry.Body)
+		if c != nil {
+			e.Response.Header().Set("X-Cache", "MISS")
+			if err := c.Set(ctx, key, entry, generation); err != nil {
+				e.App.Logger().Warn("Failed to write the response cache", "error", err)
+			}
+		}
+		return writeCachedResponse(e, entry)
+	}
+}
+
+// BindResponseCacheHooks invalidates the cache on the writes made through
+// the PocketBase records API and the admin UI. The custom storage functions
+// invalidate it themselves.
+func BindResponseCacheHooks(app core.App) {
+	invalidate := func(e *core.RecordEvent) error {
+		UserResponseCache.Invalidate()
+		return e.Next()
+	}
+	app.OnRecordAfterCreateSuccess("users").BindFunc(invalidate)
+	app.OnRecordAfterUpdateSuccess("users").BindFunc(invalidate)
+	app.OnRecordAfterDeleteSuccess("users").BindFunc(invalidate)
+}
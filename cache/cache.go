@@ -0,0 +1,115 @@
+// Package cache holds the state the instances of the app share: the cached
+// responses, the rate limit buckets and the versions of the cached
+// settings. The in-process LRU keeps that state to a single instance, the
+// Redis backend shares it between all of them.
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultTimeout    = time.Second
+	DefaultMaxEntries = 10000
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("unsupported cache url, expected redis://")
+	ErrNotInteger        = errors.New("cached value is not an integer")
+)
+
+// Cache is a key value store with expiring keys. It is safe for concurrent
+// use.
+type Cache interface {
+	// Get returns the value of key, false when it's missing or expired.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value under key for ttl, without expiry when ttl is 0.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	// Incr adds delta to the counter of key and returns its new value. A
+	// missing counter starts from 0, and expires after ttl when set.
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// Take takes a token from the bucket of key at now, the bucket holding
+	// up to burst tokens and being refilled with rate tokens a second. When
+	// the bucket is empty it returns false and how long until the next
+	// token.
+	Take(ctx context.Context, key string, rate float64, burst int, now time.Time) (bool, time.Duration, error)
+	// Ping checks that the backend is reachable.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+type Options struct {
+	// Prefix is prepended to the keys of the Redis backend, for the
+	// caches sharing a server not to collide.
+	Prefix string
+	// MaxEntries bounds the in-process LRU, the least recently used keys
+	// being evicted past it.
+	MaxEntries int
+	// Timeout bounds the dial and every command of the Redis backend.
+	Timeout time.Duration
+}
+
+type Option func(o *Options)
+
+func WithPrefix(prefix string) Option {
+	return func(o *Options) {
+		o.Prefix = prefix
+	}
+}
+
+func WithMaxEntries(maxEntries int) Option {
+	return func(o *Options) {
+		o.MaxEntries = maxEntries
+	}
+}
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = timeout
+	}
+}
+
+// Open returns the in-process LRU when rawURL is empty, and otherwise the
+// Redis backend of a redis://[[user]:password@]host[:port][/db] url. The
+// Redis backend connects on the first command, and reconnects after a
+// failure.
+func Open(rawURL string, opts ...Option) (Cache, error) {
+	o := Options{MaxEntries: DefaultMaxEntries, Timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if rawURL == "" {
+		return NewLRU(o), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache url: %w", err)
+	}
+	if u.Scheme == "redis" {
+		return NewRedis(u, o)
+	}
+	return nil, ErrUnsupportedScheme
+}
+
+// refill returns the tokens of a bucket last updated at last, refilled up
+// to now.
+func refill(tokens float64, last time.Time, rate float64, burst int, now time.Time) float64 {
+	return min(float64(burst), tokens+max(now.Sub(last).Seconds(), 0)*rate)
+}
+
+// retryAfter returns how long a bucket holding tokens takes to get a full
+// token.
+func retryAfter(tokens float64, rate float64) time.Duration {
+	return time.Duration((1 - tokens) / rate * float64(time.Second))
+}
+
+// bucketTTL is how long a bucket takes to be full again, after which it is
+// the same as a missing one and can expire.
+func bucketTTL(rate float64, burst int) time.Duration {
+	return time.Duration(float64(burst)/rate*float64(time.Second)) + time.Second
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+	// tokens and last are the state of the buckets of Take
+	tokens float64
+	last   time.Time
+}
+
+// LRU is the in-process Cache, holding up to MaxEntries keys.
+type LRU struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func NewLRU(opts Options) *LRU {
+	return &LRU{
+		maxEntries: max(opts.MaxEntries, 1),
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// lookup returns the entry of key, moved to the front, nil when it's
+// missing or expired.
+func (c *LRU) lookup(key string, now time.Time) *lruEntry {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*lruEntry)
+	if !entry.expires.IsZero() && now.After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return entry
+}
+
+// store adds entry, evicting the least recently used ones past
+// maxEntries.
+func (c *LRU) store(entry *lruEntry) {
+	if el, ok := c.entries[entry.key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+func (c *LRU) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.lookup(key, time.Now())
+	if entry == nil {
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (c *LRU) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(&lruEntry{key: key, value: value, expires: expiry(time.Now(), ttl)})
+	return nil
+}
+
+func (c *LRU) Delete(ctx context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+	return nil
+}
+
+func (c *LRU) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var n int64
+	expires := expiry(now, ttl)
+	if entry := c.lookup(key, now); entry != nil {
+		var err error
+		if n, err = strconv.ParseInt(string(entry.value), 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+		// like the Redis backend, the ttl only applies to a new counter
+		expires = entry.expires
+	}
+	n += delta
+	c.store(&lruEntry{key: key, value: strconv.AppendInt(nil, n, 10), expires: expires})
+	return n, nil
+}
+
+func (c *LRU) Take(ctx context.Context, key string, rate float64, burst int, now time.Time) (bool, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tokens := float64(burst)
+	if entry := c.lookup(key, now); entry != nil {
+		tokens = refill(entry.tokens, entry.last, rate, burst, now)
+	}
+	ok := tokens >= 1
+	if ok {
+		tokens--
+	}
+	c.store(&lruEntry{key: key, tokens: tokens, last: now, expires: expiry(now, bucketTTL(rate, burst))})
+	if !ok {
+		return false, retryAfter(tokens, rate), nil
+	}
+	return true, 0, nil
+}
+
+func (c *LRU) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (c *LRU) Close() error {
+	return nil
+}
@@ -0,0 +1,320 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRedisPort = "6379"
+
+// incrScript is INCRBY setting the ttl of the counters without one, i.e.
+// the new ones.
+const incrScript = `
+local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return n`
+
+// takeScript is the token bucket of Take, in a hash of the tokens and the
+// time in seconds of its last update. The tokens are returned as a string,
+// the numbers being truncated to integers in the replies.
+const takeScript = `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(now - last, 0) * rate)
+local ok = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	ok = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {ok, tostring(tokens)}`
+
+// redisError is an error reply, after which the connection is still
+// usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// Redis is the Cache of a Redis server, on a single connection speaking
+// RESP, the Redis protocol.
+type Redis struct {
+	addr     string
+	username string
+	password string
+	db       int
+	opts     Options
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func NewRedis(u *url.URL, opts Options) (*Redis, error) {
+	c := &Redis{addr: u.Host, opts: opts}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), defaultRedisPort)
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+		c.db = n
+	}
+	return c, nil
+}
+
+func (c *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := c.command(ctx, "GET", c.opts.Prefix+key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected reply %v to GET", reply)
+	}
+	return value, true, nil
+}
+
+func (c *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", c.opts.Prefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	_, err := c.command(ctx, args...)
+	return err
+}
+
+func (c *Redis) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := []string{"DEL"}
+	for _, key := range keys {
+		args = append(args, c.opts.Prefix+key)
+	}
+	_, err := c.command(ctx, args...)
+	return err
+}
+
+func (c *Redis) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	reply, err := c.eval(ctx, incrScript, c.opts.Prefix+key,
+		strconv.FormatInt(delta, 10), strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		if strings.Contains(err.Error(), "not an integer") {
+			return 0, ErrNotInteger
+		}
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply %v to INCRBY", reply)
+	}
+	return n, nil
+}
+
+func (c *Redis) Take(ctx context.Context, key string, rate float64, burst int, now time.Time) (bool, time.Duration, error) {
+	reply, err := c.eval(ctx, takeScript, c.opts.Prefix+key,
+		strconv.FormatFloat(rate, 'f', -1, 64),
+		strconv.Itoa(burst),
+		strconv.FormatFloat(float64(now.UnixMicro())/1e6, 'f', 6, 64),
+		strconv.FormatInt(bucketTTL(rate, burst).Milliseconds(), 10))
+	if err != nil {
+		return false, 0, err
+	}
+	items, _ := reply.([]any)
+	if len(items) != 2 {
+		return false, 0, fmt.Errorf("unexpected reply %v to the token bucket script", reply)
+	}
+	ok, _ := items[0].(int64)
+	raw, _ := items[1].([]byte)
+	tokens, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil {
+		return false, 0, fmt.Errorf("unexpected tokens %q of the token bucket script", raw)
+	}
+	if ok != 1 {
+		return false, retryAfter(tokens, rate), nil
+	}
+	return true, 0, nil
+}
+
+func (c *Redis) Ping(ctx context.Context) error {
+	_, err := c.command(ctx, "PING")
+	return err
+}
+
+func (c *Redis) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn, c.r, c.w = nil, nil, nil
+	return err
+}
+
+// eval runs script by its SHA1, sending it whole only when the server
+// doesn't have it yet.
+func (c *Redis) eval(ctx context.Context, script string, key string, args ...string) (any, error) {
+	sum := sha1.Sum([]byte(script))
+	reply, err := c.command(ctx, append([]string{"EVALSHA", hex.EncodeToString(sum[:]), "1", key}, args...)...)
+	var replyErr redisError
+	if errors.As(err, &replyErr) && strings.HasPrefix(string(replyErr), "NOSCRIPT") {
+		return c.command(ctx, append([]string{"EVAL", script, "1", key}, args...)...)
+	}
+	return reply, err
+}
+
+// command runs a command, connecting first if needed. The connection is
+// dropped after any failure but the error replies.
+func (c *Redis) command(ctx context.Context, args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	c.conn.SetDeadline(deadline(ctx, c.opts.Timeout))
+	reply, err := c.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.reset()
+		return nil, fmt.Errorf("redis %s: %w", args[0], err)
+	}
+	return reply, err
+}
+
+// connect dials the server, unless connected, authenticating and selecting
+// the database of the url.
+func (c *Redis) connect(ctx context.Context) error {
+	if c.conn != nil {
+		return nil
+	}
+	dialer := net.Dialer{Deadline: deadline(ctx, c.opts.Timeout)}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to redis: %w", err)
+	}
+	c.conn, c.r, c.w = conn, bufio.NewReader(conn), bufio.NewWriter(conn)
+	conn.SetDeadline(deadline(ctx, c.opts.Timeout))
+
+	commands := [][]string{}
+	if c.password != "" && c.username != "" {
+		commands = append(commands, []string{"AUTH", c.username, c.password})
+	} else if c.password != "" {
+		commands = append(commands, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, command := range commands {
+		if _, err := c.do(command...); err != nil {
+			c.reset()
+			return fmt.Errorf("error connecting to redis: %s: %w", command[0], err)
+		}
+	}
+	return nil
+}
+
+func (c *Redis) reset() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn, c.r, c.w = nil, nil, nil
+}
+
+// do sends the command as an array of bulk strings and reads its reply.
+func (c *Redis) do(args ...string) (any, error) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads a reply: a string for the simple strings, an int64 for
+// the integers, a []byte for the bulk strings, a []any for the arrays and
+// nil for the null ones. The error replies are returned as a redisError,
+// or within an array as its element.
+func (c *Redis) readReply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			item, err := c.readReply()
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				item = replyErr
+			} else if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// deadline returns the earlier of the deadline of ctx and timeout from
+// now.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+	return d
+}
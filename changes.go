@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+var (
+	ErrEmailTaken         = errors.New("email is already in use")
+	ErrUserUpdateConflict = errors.New("user was modified since it was read")
+	ErrUserModifiedSince  = errors.New("user was modified since If-Unmodified-Since")
+)
+
+// UserWritableFields whitelists the users columns that a changeset built
+// from a UserUpdateRequest is allowed to write. The routes narrow it down
+// per client, see RegisterFieldPolicy.
+var UserWritableFields = []string{"email", "emailVisibility", "name", "phone", "nationalId"}
+
+type FieldChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// Changeset maps column names to the values an update should write.
+type Changeset map[string]any
+
+// NewChangeset collects the non-nil pointer fields of req (a struct or a
+// pointer to one) keyed by their db tag, so adding a nullable field to an
+// update request only requires declaring it.
+func NewChangeset(req any) Changeset {
+	cs := Changeset{}
+	v := reflect.Indirect(reflect.ValueOf(req))
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		col := t.Field(i).Tag.Get("db")
+		f := v.Field(i)
+		if col == "" || col == "-" || f.Kind() != reflect.Pointer || f.IsNil() {
+			continue
+		}
+		cs[col] = f.Elem().Interface()
+	}
+	return cs
+}
+
+// Fields returns the changeset columns in sorted order.
+func (cs Changeset) Fields() []string {
+	fields := make([]string, 0, len(cs))
+	for field := range cs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (cs Changeset) Validate(allowed []string) error {
+	for _, field := range cs.Fields() {
+		if !slices.Contains(allowed, field) {
+			return fmt.Errorf("field %q is not writable", field)
+		}
+	}
+	return nil
+}
+
+func (cs Changeset) Params() dbx.Params {
+	return dbx.Params(cs)
+}
+
+// Diff compares the changeset against current, a db tagged struct (or a
+// pointer to one), and returns the fields whose value would change.
+func (cs Changeset) Diff(current any) map[string]FieldChange {
+	values := map[string]any{}
+	v := reflect.Indirect(reflect.ValueOf(current))
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if col := t.Field(i).Tag.Get("db"); col != "" && col != "-" {
+			values[col] = v.Field(i).Interface()
+		}
+	}
+
+	changes := map[string]FieldChange{}
+	for field, value := range cs {
+		if old, ok := values[field]; !ok || old != value {
+			changes[field] = FieldChange{Old: values[field], New: value}
+		}
+	}
+	return changes
+}
+
+// Apply sets the db tagged fields of row, a pointer to a struct, to the
+// values of the changeset, e.g. to preview an update. The values of another
+// type than their field are left out.
+func (cs Changeset) Apply(row any) {
+	v := reflect.ValueOf(row).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		value, ok := cs[t.Field(i).Tag.Get("db")]
+		if !ok || value == nil {
+			continue
+		}
+		if rv := reflect.ValueOf(value); rv.Type().AssignableTo(t.Field(i).Type) {
+			v.Field(i).Set(rv)
+		}
+	}
+}
+
+// DiffUserUpdate returns the fields whose value would change if ur was
+// applied to user, keyed by their json name.
+func DiffUserUpdate(user models.User, ur models.UserUpdateRequest) map[string]FieldChange {
+	return NewChangeset(ur).Diff(user)
+}
+
+// CheckUserUpdate runs the checks that have to pass before ur can be
+// applied to the user with the given id.
+func CheckUserUpdate(app core.App, userId string, ur models.UserUpdateRequest) error {
+	if ur.Email == nil {
+		return nil
+	}
+	return CheckEmailAvailable(app, userId, *ur.Email)
+}
+
+// CheckUserVersion returns ErrUserUpdateConflict if ur expects the user to
+// have been updated at another time than user was, and ErrUserModifiedSince
+// if the user was updated after ur.UnmodifiedSince.
+func CheckUserVersion(user *models.User, ur models.UserUpdateRequest) error {
+	if ur.ExpectedUpdated != nil && *ur.ExpectedUpdated != user.Updated {
+		return ErrUserUpdateConflict
+	}
+	return CheckUserUnmodifiedSince(user, ur.UnmodifiedSince)
+}
+
+// CheckUserUnmodifiedSince returns ErrUserModifiedSince if the user was
+// updated after since, to the second as the HTTP dates are, and nil when
+// since is nil.
+func CheckUserUnmodifiedSince(user *models.User, since *time.Time) error {
+	if since == nil {
+		return nil
+	}
+	updated, err := types.ParseDateTime(user.Updated)
+	if err != nil {
+		return err
+	}
+	if updated.Time().Truncate(time.Second).After(*since) {
+		return ErrUserModifiedSince
+	}
+	return nil
+}
+
+// IsUserVersionError reports whether err is one of the errors of
+// CheckUserVersion, returned along with the current user.
+func IsUserVersionError(err error) bool {
+	return errors.Is(err, ErrUserUpdateConflict) || errors.Is(err, ErrUserModifiedSince)
+}
+
+// ParseIfMatch returns the updated time sent in an If-Match header, which
+// may be quoted like an ETag. It returns nil for a missing header or "*".
+func ParseIfMatch(header string) *string {
+	v := strings.TrimSpace(header)
+	if v == "" || v == "*" {
+		return nil
+	}
+	v = strings.Trim(strings.TrimPrefix(v, "W/"), `"`)
+	return &v
+}
+
+// ParseIfUnmodifiedSince returns the time of an If-Unmodified-Since
+// header. It returns nil for a missing header, for an invalid date, which
+// RFC 9110 says to ignore, and when ifMatch is set, If-Match taking
+// precedence.
+func ParseIfUnmodifiedSince(header string, ifMatch string) *time.Time {
+	if strings.TrimSpace(ifMatch) != "" {
+		return nil
+	}
+	since, err := http.ParseTime(strings.TrimSpace(header))
+	if err != nil {
+		return nil
+	}
+	return &since
+}
+
+// SetUserLastModified sends the updated time of the user as Last-Modified,
+// for the clients to send back as If-Unmodified-Since.
+func SetUserLastModified(e *core.RequestEvent, user *models.User) {
+	if updated, err := types.ParseDateTime(user.Updated); err == nil && !updated.IsZero() {
+		e.Response.Header().Set("Last-Modified", updated.Time().UTC().Format(http.TimeFormat))
+	}
+}
+
+// RecordEmailError returns ErrEmailTaken for the failed saves of a users
+// record whose email is taken, which PocketBase reports as a validation
+// error, and err itself otherwise.
+func RecordEmailError(err error) error {
+	var validationErrs validation.Errors
+	if !errors.As(err, &validationErrs) {
+		return err
+	}
+	if emailErr, ok := validationErrs["email"].(validation.Error); ok && emailErr.Code() == "validation_not_unique" {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// CheckEmailAvailable returns ErrEmailTaken if email belongs to a user other
+// than userId (which is empty for users that don't exist yet).
+func CheckEmailAvailable(app core.App, userId string, email string) error {
+	// soft deleted users keep their email until they are deleted for good
+	existing, err := Users.WithDeleted().AcrossTenants().FindOne(app, dbx.HashExp{"email": email})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Id != userId {
+		return ErrEmailTaken
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+)
+
+// userUpdateCombination returns the update request setting the fields of
+// UserWritableFields whose bit is set in mask, to values none of them has
+// in user, along with the columns it sets.
+func userUpdateCombination(user models.User, mask int) (models.UserUpdateRequest, []string) {
+	email := fmt.Sprintf("changed%d@example.com", mask)
+	emailVisibility := !user.EmailVisibility
+	name := fmt.Sprintf("Changed %d", mask)
+	phone := fmt.Sprintf("+1555%07d", mask)
+	nationalId := fmt.Sprintf("ID%d", mask)
+
+	ur := models.UserUpdateRequest{}
+	fields := []string{}
+	for i, field := range UserWritableFields {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		fields = append(fields, field)
+		switch field {
+		case "email":
+			ur.Email = &email
+		case "emailVisibility":
+			ur.EmailVisibility = &emailVisibility
+		case "name":
+			ur.Name = &name
+		case "phone":
+			ur.Phone = &phone
+		case "nationalId":
+			ur.NationalId = &nationalId
+		}
+	}
+	slices.Sort(fields)
+	return ur, fields
+}
+
+func TestChangeset(t *testing.T) {
+	user := models.User{Id: "a", Email: "a@example.com", Name: "A", Phone: "+15550000000", Updated: "2024-01-02 03:04:05.000Z"}
+
+	for mask := 0; mask < 1<<len(UserWritableFields); mask++ {
+		ur, fields := userUpdateCombination(user, mask)
+		t.Run(fmt.Sprint(fields), func(t *testing.T) {
+			cs := NewChangeset(ur)
+			if !slices.Equal(cs.Fields(), fields) {
+				t.Fatalf("expected the fields %v, got %v", fields, cs.Fields())
+			}
+			if err := cs.Validate(UserWritableFields); err != nil {
+				t.Fatal(err)
+			}
+
+			changes := cs.Diff(user)
+			if len(changes) != len(fields) {
+				t.Errorf("expected changes of %v, got %+v", fields, changes)
+			}
+			for _, field := range fields {
+				if change := changes[field]; change.New != cs[field] {
+					t.Errorf("expected %s to change to %v, got %+v", field, cs[field], change)
+				}
+			}
+			if !reflect.DeepEqual(DiffUserUpdate(user, ur), changes) {
+				t.Errorf("expected DiffUserUpdate to match Diff, got %+v", DiffUserUpdate(user, ur))
+			}
+
+			preview := user
+			cs.Apply(&preview)
+			if again := cs.Diff(preview); len(again) != 0 {
+				t.Errorf("expected no changes once applied, got %+v", again)
+			}
+			if after := DiffFields(user, preview); !reflect.DeepEqual(after, changes) {
+				t.Errorf("expected the applied changes %+v, got %+v", changes, after)
+			}
+		})
+	}
+
+	if err := (Changeset{"password": "x"}).Validate(UserWritableFields); err == nil {
+		t.Error("expected an error for a field that isn't writable")
+	}
+}
+
+// TestUpdateUserByIdChangeset writes every combination of the fields of
+// UserWritableFields, for the stored user to be the one the changeset
+// previews and the changes to be the ones it computes.
+func TestUpdateUserByIdChangeset(t *testing.T) {
+	app := newTestApp(t)
+	key := make([]byte, 32)
+	rand.Read(key)
+	cipher, err := NewFieldCipher([]string{"test:" + base64.StdEncoding.EncodeToString(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := FieldEncryption
+	FieldEncryption = cipher
+	t.Cleanup(func() { FieldEncryption = previous })
+	userId := seedTestUsers(t, app, 1)[0].Id
+
+	for mask := 0; mask < 1<<len(UserWritableFields); mask++ {
+		before, err := GetUserById(app, userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ur, fields := userUpdateCombination(*before, mask)
+		t.Run(fmt.Sprint(fields), func(t *testing.T) {
+			cs := NewChangeset(ur)
+			preview := *before
+			cs.Apply(&preview)
+
+			user, changed, err := UpdateUserById(app, userId, ur)
+			if len(fields) == 0 {
+				if err == nil {
+					t.Error("expected an error for an empty update")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := changed["updated"]; !ok {
+				t.Error("expected the updated time to change")
+			}
+			delete(changed, "updated")
+			if expected := cs.Diff(*before); !reflect.DeepEqual(changed, expected) {
+				t.Errorf("expected the changes %+v, got %+v", expected, changed)
+			}
+			preview.Updated = user.Updated
+			if !reflect.DeepEqual(*user, preview) {
+				t.Errorf("expected the user %+v, got %+v", preview, *user)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// Package client is a Go client for the custom users API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+)
+
+const DefaultTimeout = 30 * time.Second
+
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+type Option func(c *Client)
+
+// WithToken sets the auth token sent in the Authorization header.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.httpClient.Timeout = timeout
+	}
+}
+
+// WithHTTPClient replaces the underlying http client, including its timeout.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: DefaultTimeout},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type ListUsersOptions struct {
+	Page    int
+	PerPage int
+	Sort    string
+	Filter  string
+}
+
+func (o *ListUsersOptions) query() url.Values {
+	query := url.Values{}
+	if o == nil {
+		return query
+	}
+	if o.Page > 0 {
+		query.Set("page", strconv.Itoa(o.Page))
+	}
+	if o.PerPage > 0 {
+		query.Set("perPage", strconv.Itoa(o.PerPage))
+	}
+	if o.Sort != "" {
+		query.Set("sort", o.Sort)
+	}
+	if o.Filter != "" {
+		query.Set("filter", o.Filter)
+	}
+	return query
+}
+
+func (c *Client) ListUsers(ctx context.Context, opts *ListUsersOptions) (*models.ListPage[models.User], error) {
+	page := &models.ListPage[models.User]{}
+	if err := c.do(ctx, http.MethodGet, "/users", opts.query(), nil, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// ListUsersAfter returns the page of users following cursor, the first one
+// when cursor is empty. Pass the NextCursor of the returned page to get the
+// next one, until it is empty.
+func (c *Client) ListUsersAfter(ctx context.Context, cursor string, limit int, filter string) (*models.CursorPage[models.User], error) {
+	query := url.Values{}
+	query.Set("cursor", cursor)
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if filter != "" {
+		query.Set("filter", filter)
+	}
+	page := &models.CursorPage[models.User]{}
+	if err := c.do(ctx, http.MethodGet, "/users", query, nil, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (c *Client) GetUser(ctx context.Context, userId string) (*models.User, error) {
+	user := &models.User{}
+	if err := c.do(ctx, http.MethodGet, "/users/"+url.PathEscape(userId), nil, nil, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (c *Client) CreateUser(ctx context.Context, cr models.UserCreationRequest) (*models.User, error) {
+	user := &models.User{}
+	if err := c.do(ctx, http.MethodPost, "/users", nil, cr, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (c *Client) UpdateUser(ctx context.Context, userId string, ur models.UserUpdateRequest) error {
+	return c.do(ctx, http.MethodPatch, "/users/"+url.PathEscape(userId), nil, ur, nil)
+}
+
+func (c *Client) DeleteUser(ctx context.Context, userId string) error {
+	return c.do(ctx, http.MethodDelete, "/users/"+url.PathEscape(userId), nil, nil, nil)
+}
+
+// Register signs up a user with a password. Pass the returned token to
+// WithToken to act as the user.
+func (c *Client) Register(ctx context.Context, cr models.UserCreationRequest) (*models.AuthResponse, error) {
+	resp := &models.AuthResponse{}
+	if err := c.do(ctx, http.MethodPost, "/auth/register", nil, cr, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Login returns the auth token, or only a TwoFactorToken to pass to
+// VerifyTwoFactor for the users with 2FA enabled.
+func (c *Client) Login(ctx context.Context, email string, password string) (*models.AuthResponse, error) {
+	resp := &models.AuthResponse{}
+	if err := c.do(ctx, http.MethodPost, "/auth/login", nil, models.LoginRequest{Email: email, Password: password}, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// VerifyTwoFactor completes a login that returned a TwoFactorToken.
+func (c *Client) VerifyTwoFactor(ctx context.Context, twoFactorToken string, code string) (*models.AuthResponse, error) {
+	resp := &models.AuthResponse{}
+	body := map[string]string{"token": twoFactorToken, "code": code}
+	if err := c.do(ctx, http.MethodPost, "/auth/2fa", nil, body, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// RefreshToken exchanges the client token for a fresh one.
+func (c *Client) RefreshToken(ctx context.Context) (*models.AuthResponse, error) {
+	resp := &models.AuthResponse{}
+	if err := c.do(ctx, http.MethodPost, "/auth/refresh", nil, nil, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// envelope mirrors models.APIResp with the data left undecoded.
+type envelope struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+	// Code and RequestId are only sent on failures.
+	Code      string `json:"code"`
+	RequestId string `json:"requestId"`
+}
+
+// do sends the request and decodes the APIResp data into out (if not nil).
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body any, out any) error {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	env := envelope{}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil && err != io.EOF {
+		if resp.StatusCode >= http.StatusBadRequest {
+			return newError(resp.StatusCode, "", "", nil, resp.Header.Get("X-Request-Id"))
+		}
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest || !env.Success {
+		requestId := env.RequestId
+		if requestId == "" {
+			requestId = resp.Header.Get("X-Request-Id")
+		}
+		return newError(resp.StatusCode, env.Code, env.Message, env.Data, requestId)
+	}
+
+	if out == nil || len(env.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(env.Data, out)
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrForbidden          = errors.New("forbidden")
+	ErrConflict           = errors.New("conflict")
+	ErrValidation         = errors.New("validation failed")
+	ErrServiceUnavailable = errors.New("service unavailable")
+)
+
+// Error is returned for every non 2xx response. It matches the sentinel
+// errors above with errors.Is based on its status code.
+type Error struct {
+	StatusCode int
+	// Code is the stable code of the failure, e.g. USER_NOT_FOUND.
+	Code    string
+	Message string
+	Data    json.RawMessage
+	// RequestId identifies the failed request in the server logs.
+	RequestId string
+}
+
+func (e *Error) Error() string {
+	message := e.Message
+	if message == "" {
+		message = http.StatusText(e.StatusCode)
+	}
+	if e.RequestId != "" {
+		return fmt.Sprintf("api error: %d %s (request %s)", e.StatusCode, message, e.RequestId)
+	}
+	return fmt.Sprintf("api error: %d %s", e.StatusCode, message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrServiceUnavailable:
+		return e.StatusCode == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// FieldError is the error of a single request body field, as returned for
+// bodies that couldn't be bound.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned for 400 and 422 responses that carry
+// field-level errors in their data. Fields maps the fields to their error
+// messages, FieldErrors is only set for the binding errors, which also carry
+// a code.
+type ValidationError struct {
+	Err         *Error
+	Fields      map[string]any
+	FieldErrors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func newError(statusCode int, code string, message string, data json.RawMessage, requestId string) error {
+	apiErr := &Error{StatusCode: statusCode, Code: code, Message: message, Data: data, RequestId: requestId}
+	if statusCode != http.StatusBadRequest && statusCode != http.StatusUnprocessableEntity {
+		return apiErr
+	}
+	if len(data) == 0 {
+		return apiErr
+	}
+	var fieldErrs []FieldError
+	if json.Unmarshal(data, &fieldErrs) == nil && len(fieldErrs) > 0 {
+		fields := make(map[string]any, len(fieldErrs))
+		for _, fieldErr := range fieldErrs {
+			fields[fieldErr.Field] = fieldErr.Message
+		}
+		return &ValidationError{Err: apiErr, Fields: fields, FieldErrors: fieldErrs}
+	}
+	fields := map[string]any{}
+	if json.Unmarshal(data, &fields) != nil || len(fields) == 0 {
+		return apiErr
+	}
+	return &ValidationError{Err: apiErr, Fields: fields}
+}
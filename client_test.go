@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/client"
+	"github.com/EricFrancis12/pocketbase-demo/models"
+)
+
+// TestClient runs the client package against the test server.
+func TestClient(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx := context.Background()
+	c := client.New(s.URL+"/", client.WithToken(s.SuperuserToken), client.WithTimeout(15*time.Second))
+
+	page, err := c.ListUsers(ctx, &client.ListUsersOptions{Page: 1, PerPage: 2, Sort: "-email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emails := []string{}
+	for _, user := range page.Items {
+		emails = append(emails, user.Email)
+	}
+	if expected := []string{"user2@example.com", "user1@example.com"}; !slices.Equal(emails, expected) {
+		t.Errorf("expected the users %v, got %v", expected, emails)
+	}
+	if page.TotalItems != len(s.Users) {
+		t.Errorf("expected totalItems %d, got %d", len(s.Users), page.TotalItems)
+	}
+
+	page, err = c.ListUsers(ctx, &client.ListUsersOptions{Filter: `email = "user1@example.com"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].Id != s.Users[1].Id {
+		t.Errorf("expected only %s, got %+v", s.Users[1].Id, page.Items)
+	}
+
+	ids := []string{}
+	cursor := ""
+	for {
+		cursorPage, err := c.ListUsersAfter(ctx, cursor, 2, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range cursorPage.Items {
+			ids = append(ids, user.Id)
+		}
+		if cursor = cursorPage.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if len(ids) != len(s.Users) {
+		t.Errorf("expected the %d users over the cursor pages, got %v", len(s.Users), ids)
+	}
+
+	user, err := c.GetUser(ctx, s.Users[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != s.Users[0].Email {
+		t.Errorf("expected %s, got %s", s.Users[0].Email, user.Email)
+	}
+
+	_, err = c.GetUser(ctx, "unknown")
+	apiErr := &client.Error{}
+	if !errors.Is(err, client.ErrNotFound) || !errors.As(err, &apiErr) || apiErr.Code != CodeUserNotFound || apiErr.RequestId == "" {
+		t.Errorf("expected a %s error with a request id, got %v", CodeUserNotFound, err)
+	}
+
+	created, err := c.CreateUser(ctx, models.UserCreationRequest{Email: "new@example.com", Name: "New"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == "" || created.Email != "new@example.com" {
+		t.Errorf("expected the created user, got %+v", created)
+	}
+	if _, err := c.CreateUser(ctx, models.UserCreationRequest{Email: "new@example.com"}); !errors.Is(err, client.ErrConflict) {
+		t.Errorf("expected ErrConflict for a taken email, got %v", err)
+	}
+	_, err = c.CreateUser(ctx, models.UserCreationRequest{Email: "invalid"})
+	validationErr := &client.ValidationError{}
+	if !errors.Is(err, client.ErrValidation) || !errors.As(err, &validationErr) || validationErr.Fields["email"] == nil {
+		t.Errorf("expected a validation error of the email, got %v", err)
+	}
+
+	name := "Renamed"
+	if err := c.UpdateUser(ctx, created.Id, models.UserUpdateRequest{Name: &name}); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := c.GetUser(ctx, created.Id); err != nil || user.Name != name {
+		t.Errorf("expected the renamed user, got %+v, %v", user, err)
+	}
+	stale := s.Users[0].Updated + "0"
+	if err := c.UpdateUser(ctx, s.Users[0].Id, models.UserUpdateRequest{Name: &name, ExpectedUpdated: &stale}); !errors.Is(err, client.ErrConflict) {
+		t.Errorf("expected ErrConflict for a stale update, got %v", err)
+	}
+
+	if err := c.DeleteUser(ctx, created.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetUser(ctx, created.Id); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for the deleted user, got %v", err)
+	}
+	if err := c.DeleteUser(ctx, created.Id); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a deleted user, got %v", err)
+	}
+
+	anonymous := client.New(s.URL)
+	if _, err := anonymous.ListUsers(ctx, nil); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("expected ErrUnauthorized without a token, got %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.GetUser(canceled, s.Users[0].Id); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+// TestClientAuth signs up, logs in and refreshes the token with the client.
+func TestClientAuth(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx := context.Background()
+	c := client.New(s.URL)
+
+	registered, err := c.Register(ctx, models.UserCreationRequest{
+		Email:           "new@example.com",
+		Password:        testUserPassword,
+		PasswordConfirm: testUserPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registered.Token == "" || registered.User == nil || registered.User.Email != "new@example.com" {
+		t.Errorf("expected the token of the new user, got %+v", registered)
+	}
+
+	auth, err := c.Login(ctx, s.Users[0].Email, testUserPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Token == "" || auth.User == nil || auth.User.Id != s.Users[0].Id {
+		t.Errorf("expected the token of %s, got %+v", s.Users[0].Id, auth)
+	}
+	if _, err := c.Login(ctx, s.Users[0].Email, "wrong-password-1"); err == nil {
+		t.Error("expected an error for a wrong password")
+	}
+
+	refreshed, err := client.New(s.URL, client.WithToken(auth.Token)).RefreshToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.Token == "" {
+		t.Errorf("expected a fresh token, got %+v", refreshed)
+	}
+}
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"go/token"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+)
+
+// ClientOperations are the operations of the generated clients: the
+// APIOperations declared upfront along with those RegisterCRUD adds once
+// the app serves.
+func ClientOperations() []APIOperation {
+	return slices.Concat(APIOperations, CRUDOperations("posts", PostsCRUDOptions(nil, nil)))
+}
+
+// NewGenClientCommand generates the TypeScript or the Go client of the
+// custom API from ClientOperations, the same operations the OpenAPI spec
+// describes, so that regenerating the clients in the build of the frontend
+// keeps them in sync with the handlers.
+func NewGenClientCommand() *cobra.Command {
+	lang, out, pkg := "ts", "", "client"
+	command := &cobra.Command{
+		Use:          "gen-client",
+		Short:        "Generates a TypeScript or Go client for the custom API",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			var src []byte
+			var err error
+			switch lang {
+			case "ts":
+				src = GenerateTSClient(ClientOperations())
+			case "go":
+				src, err = GenerateGoClient(ClientOperations(), pkg)
+			default:
+				return fmt.Errorf("unknown language %q, expected ts or go", lang)
+			}
+			if err != nil {
+				return err
+			}
+			if out == "" {
+				_, err = command.OutOrStdout().Write(src)
+				return err
+			}
+			return os.WriteFile(out, src, 0o644)
+		},
+	}
+	command.Flags().StringVar(&lang, "lang", "ts", "language of the client, ts or go")
+	command.Flags().StringVar(&out, "out", "", "file to write the client to, stdout when empty")
+	command.Flags().StringVar(&pkg, "package", "client", "package name of the Go client")
+	return command
+}
+
+const generatedHeader = "Code generated by pocketbase-demo gen-client. DO NOT EDIT."
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	dateTimeType      = reflect.TypeOf(types.DateTime{})
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	jsonRawType       = reflect.TypeOf(types.JSONRaw{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// encodesItself reports whether the struct t has its own JSON encoding,
+// which its fields don't describe.
+func encodesItself(t reflect.Type) bool {
+	return t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType)
+}
+
+// clientField is a JSON field of a struct, as documented by the
+// schemaBuilder.
+type clientField struct {
+	Name     string
+	GoName   string
+	Tag      string
+	Type     reflect.Type
+	Optional bool
+}
+
+func clientFields(t reflect.Type) []clientField {
+	fields := []clientField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || !field.IsExported() && !field.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, clientFields(field.Type)...)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+			tag = name + tag
+		}
+		fields = append(fields, clientField{
+			Name:     name,
+			GoName:   field.Name,
+			Tag:      tag,
+			Type:     field.Type,
+			Optional: strings.Contains(opts, "omitempty") || field.Type.Kind() == reflect.Pointer,
+		})
+	}
+	return fields
+}
+
+// clientOperation is an operation as the generated clients call it.
+type clientOperation struct {
+	APIOperation
+	Name       string
+	PathParams []string
+	// JSONBody is set for the operations taking a JSON body, RawBody for
+	// those taking another content type.
+	JSONBody bool
+	RawBody  bool
+	// Accept is the Accept header of the operations that don't answer
+	// with the APIResp envelope.
+	Accept string
+}
+
+func newClientOperation(op APIOperation) clientOperation {
+	c := clientOperation{APIOperation: op, Name: operationId(op)}
+	for _, m := range pathParamPattern.FindAllStringSubmatch(op.Path, -1) {
+		c.PathParams = append(c.PathParams, m[1])
+	}
+	switch {
+	case op.Body != nil && (len(op.BodyTypes) == 0 || slices.ContainsFunc(op.BodyTypes, isJSONContentType)):
+		c.JSONBody = true
+	case len(op.BodyTypes) > 0:
+		c.RawBody = true
+	}
+	if len(op.ResponseTypes) > 0 {
+		c.Accept = strings.Join(op.ResponseTypes, ", ")
+	}
+	return c
+}
+
+func isJSONContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json")
+}
+
+// isHeader reports whether name is one of the Headers of the operation,
+// the other params going in the query string.
+func (c clientOperation) isHeader(name string) bool {
+	return slices.ContainsFunc(c.Headers, func(p APIParam) bool { return p.Name == name })
+}
+
+func (c clientOperation) params() []APIParam {
+	return slices.Concat(c.Query, c.Headers)
+}
+
+// pathSegments splits the path around its params, e.g. /users/{userId}/x
+// into "/users/", "userId", "/x", the params at the odd indexes.
+func pathSegments(path string) []string {
+	segments := []string{}
+	last := 0
+	for _, m := range pathParamPattern.FindAllStringSubmatchIndex(path, -1) {
+		segments = append(segments, path[last:m[0]], path[m[2]:m[3]])
+		last = m[1]
+	}
+	return append(segments, path[last:])
+}
+
+// exportedName turns e.g. If-Match or perPage into IfMatch and PerPage.
+func exportedName(name string) string {
+	exported := ""
+	for _, word := range pathWordPattern.FindAllString(name, -1) {
+		exported += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return exported
+}
+
+// clientParamName renames the path params clashing with the keywords or
+// with the variables of the generated methods.
+func clientParamName(name string) string {
+	switch name {
+	case "ctx", "body", "params", "contentType", "query", "header", "resp", "out", "err", "signal", "delete", "new", "default":
+		return name + "Param"
+	}
+	if token.IsKeyword(name) {
+		return name + "Param"
+	}
+	return name
+}
+
+// GenerateTSClient generates a TypeScript client of ops, with an interface
+// per Go type of their bodies and responses and a method per operation,
+// named after its OpenAPI operationId.
+func GenerateTSClient(ops []APIOperation) []byte {
+	g := &tsClientGen{defs: map[string]string{}}
+	methods := &strings.Builder{}
+	params := &strings.Builder{}
+	for _, op := range ops {
+		g.operation(methods, params, newClientOperation(op))
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "// %s\n\n", generatedHeader)
+	fmt.Fprintf(b, tsClientRuntime, APIKeyHeader)
+	names := make([]string, 0, len(g.defs))
+	for name := range g.defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(b, "\nexport interface %s %s\n", name, g.defs[name])
+	}
+	b.WriteString(params.String())
+	b.WriteString("\nexport class Client extends BaseClient {")
+	b.WriteString(methods.String())
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+type tsClientGen struct {
+	// defs are the interfaces of the named struct types, by schemaName.
+	defs map[string]string
+}
+
+func (g *tsClientGen) ref(t reflect.Type) string {
+	switch t {
+	case timeType, dateTimeType:
+		return "string"
+	case rawMessageType, jsonRawType:
+		return "unknown"
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.ref(t.Elem()) + " | null"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			// base64 encoded
+			return "string"
+		}
+		return "Array<" + g.ref(t.Elem()) + ">"
+	case reflect.Map:
+		return "Record<string, " + g.ref(t.Elem()) + ">"
+	case reflect.Struct:
+		if encodesItself(t) {
+			return "unknown"
+		}
+		if t.Name() == "" {
+			return g.object(t, false)
+		}
+		name := schemaName(t)
+		if _, ok := g.defs[name]; !ok {
+			// registered first so that recursive types terminate
+			g.defs[name] = ""
+			g.defs[name] = g.object(t, true)
+		}
+		return name
+	}
+	return "unknown"
+}
+
+// object renders the fields of t, one per line for the interfaces and on a
+// single line for the anonymous structs.
+func (g *tsClientGen) object(t reflect.Type, multiline bool) string {
+	fields := []string{}
+	for _, f := range clientFields(t) {
+		optional := ""
+		if f.Optional {
+			optional = "?"
+		}
+		fields = append(fields, tsKey(f.Name)+optional+": "+g.ref(f.Type)+";")
+	}
+	if len(fields) == 0 {
+		return "{}"
+	}
+	if !multiline {
+		return "{ " + strings.Join(fields, " ") + " }"
+	}
+	return "{\n  " + strings.Join(fields, "\n  ") + "\n}"
+}
+
+var tsIdentifierPattern = regexp.MustCompile(`^[A-Za-z_$][\w$]*$`)
+
+// tsKey quotes the keys that aren't identifiers, e.g. If-Match.
+func tsKey(name string) string {
+	if tsIdentifierPattern.MatchString(name) {
+		return name
+	}
+	return fmt.Sprintf("%q", name)
+}
+
+func tsParamType(param APIParam) string {
+	switch param.Type {
+	case "integer", "number":
+		return "number"
+	case "boolean":
+		return "boolean"
+	}
+	return "string"
+}
+
+func (g *tsClientGen) operation(methods *strings.Builder, params *strings.Builder, op clientOperation) {
+	args := []string{}
+	for _, name := range op.PathParams {
+		args = append(args, clientParamName(name)+": string")
+	}
+	body, contentType := "undefined", "undefined"
+	switch {
+	case op.JSONBody:
+		args = append(args, "body: "+g.ref(reflect.TypeOf(op.Body)))
+		body, contentType = "JSON.stringify(body)", `"application/json"`
+	case op.RawBody:
+		// optional, fetch setting the one of a FormData with its boundary
+		args = append(args, "body: BodyInit", "contentType?: string")
+		body, contentType = "body", "contentType"
+	}
+
+	query, headers := []string{}, []string{}
+	if all := op.params(); len(all) > 0 {
+		paramsType := exportedName(op.Name) + "Params"
+		fmt.Fprintf(params, "\nexport interface %s {\n", paramsType)
+		for _, p := range all {
+			if p.Description != "" {
+				fmt.Fprintf(params, "  /** %s */\n", p.Description)
+			}
+			fmt.Fprintf(params, "  %s?: %s;\n", tsKey(p.Name), tsParamType(p))
+			value := tsKey(p.Name) + ": params." + p.Name
+			if tsKey(p.Name) != p.Name {
+				value = tsKey(p.Name) + ": params[" + tsKey(p.Name) + "]"
+			}
+			if op.isHeader(p.Name) {
+				headers = append(headers, value)
+			} else {
+				query = append(query, value)
+			}
+		}
+		params.WriteString("}\n")
+		args = append(args, "params: "+paramsType+" = {}")
+	}
+	args = append(args, "signal?: AbortSignal")
+
+	path := "`"
+	for i, segment := range pathSegments(op.Path) {
+		if i%2 == 1 {
+			segment = "${encodeURIComponent(" + clientParamName(segment) + ")}"
+		}
+		path += segment
+	}
+	path += "`"
+	call := fmt.Sprintf("%q, %s, { %s }, { %s }, %s, %s", op.Method, path,
+		strings.Join(query, ", "), strings.Join(headers, ", "), body, contentType)
+	call = strings.ReplaceAll(call, "{  }", "{}")
+
+	summary := op.Summary
+	if op.Access != AccessPublic {
+		summary += " (" + op.Access + ")"
+	}
+	fmt.Fprintf(methods, "\n  /** %s %s: %s */\n", op.Method, op.Path, summary)
+	switch {
+	case op.Accept != "":
+		fmt.Fprintf(methods, "  %s(%s): Promise<Response> {\n", op.Name, strings.Join(args, ", "))
+		fmt.Fprintf(methods, "    return this.send(%s, %q, signal);\n  }\n", call, op.Accept)
+	case op.Response == nil:
+		fmt.Fprintf(methods, "  async %s(%s): Promise<void> {\n", op.Name, strings.Join(args, ", "))
+		fmt.Fprintf(methods, "    await this.call(%s, signal);\n  }\n", call)
+	default:
+		response := g.ref(reflect.TypeOf(op.Response))
+		fmt.Fprintf(methods, "  %s(%s): Promise<%s> {\n", op.Name, strings.Join(args, ", "), response)
+		fmt.Fprintf(methods, "    return this.call<%s>(%s, signal);\n  }\n", response, call)
+	}
+}
+
+// tsClientRuntime is the part of the TypeScript client that doesn't depend
+// on the operations, formatted with the API key header.
+const tsClientRuntime = `export interface ClientOptions {
+  /** Auth token of a users or _superusers record. */
+  token?: string;
+  /** API key, sent in the %[1]s header. */
+  apiKey?: string;
+  fetch?: typeof fetch;
+}
+
+/** APIError is a failed request, with the code and the message of the APIResp envelope. */
+export class APIError extends Error {
+  constructor(
+    readonly status: number,
+    readonly code: string,
+    message: string,
+    readonly requestId?: string,
+    readonly data?: unknown,
+  ) {
+    super(message);
+    this.name = "APIError";
+  }
+}
+
+interface Envelope<T> {
+  success: boolean;
+  message?: string;
+  code?: string;
+  requestId?: string;
+  data?: T;
+}
+
+type Values = Record<string, string | number | boolean | undefined>;
+
+export class BaseClient {
+  readonly baseURL: string;
+  token?: string;
+  apiKey?: string;
+  private readonly fetchImpl: typeof fetch;
+
+  constructor(baseURL: string, options: ClientOptions = {}) {
+    this.baseURL = baseURL.replace(/\/+$/, "");
+    this.token = options.token;
+    this.apiKey = options.apiKey;
+    this.fetchImpl = options.fetch ?? globalThis.fetch.bind(globalThis);
+  }
+
+  /** send sends the request, throwing an APIError unless the response is a success. */
+  protected async send(
+    method: string,
+    path: string,
+    query: Values,
+    headers: Values,
+    body: BodyInit | undefined,
+    contentType: string | undefined,
+    accept: string,
+    signal?: AbortSignal,
+  ): Promise<Response> {
+    const search = new URLSearchParams();
+    for (const [key, value] of Object.entries(query)) {
+      if (value !== undefined) search.set(key, String(value));
+    }
+    const init: Record<string, string> = { Accept: accept };
+    for (const [key, value] of Object.entries(headers)) {
+      if (value !== undefined) init[key] = String(value);
+    }
+    if (contentType) init["Content-Type"] = contentType;
+    if (this.token) init["Authorization"] = this.token;
+    if (this.apiKey) init["%[1]s"] = this.apiKey;
+
+    const qs = search.toString();
+    const resp = await this.fetchImpl(this.baseURL + path + (qs ? "?" + qs : ""), { method, headers: init, body, signal });
+    if (!resp.ok) {
+      let env: Partial<Envelope<unknown>> = {};
+      try {
+        env = await resp.json();
+      } catch {
+        // not an APIResp envelope
+      }
+      throw new APIError(resp.status, env.code ?? resp.statusText, env.message ?? resp.statusText,
+        env.requestId ?? resp.headers.get("X-Request-Id") ?? undefined, env.data);
+    }
+    return resp;
+  }
+
+  /** call sends the request and returns the data of the APIResp envelope. */
+  protected async call<T = void>(
+    method: string,
+    path: string,
+    query: Values,
+    headers: Values,
+    body: BodyInit | undefined,
+    contentType: string | undefined,
+    signal?: AbortSignal,
+  ): Promise<T> {
+    const resp = await this.send(method, path, query, headers, body, contentType, "application/json", signal);
+    const text = await resp.text();
+    if (!text) return undefined as T;
+    const env = JSON.parse(text) as Envelope<T>;
+    if (!env.success) {
+      throw new APIError(resp.status, env.code ?? "", env.message ?? "", env.requestId, env.data);
+    }
+    return env.data as T;
+  }
+}
+`
+
+// GenerateGoClient generates the Go client of ops in package pkg, the Go
+// counterpart of GenerateTSClient. Unlike the client package, it depends
+// on nothing but the standard library.
+func GenerateGoClient(ops []APIOperation, pkg string) ([]byte, error) {
+	if !token.IsIdentifier(pkg) {
+		return nil, fmt.Errorf("invalid package name %q", pkg)
+	}
+	g := &goClientGen{defs: map[string]string{}}
+	methods := &strings.Builder{}
+	params := &strings.Builder{}
+	for _, op := range ops {
+		g.operation(methods, params, newClientOperation(op))
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "// %s\n\n", generatedHeader)
+	fmt.Fprintf(b, "// Package %s is a client for the pocketbase-demo custom API.\npackage %s\n\n", pkg, pkg)
+	imports := []string{"bytes", "context", "encoding/json", "io", "net/http", "net/url", "strings"}
+	if g.usesStrconv {
+		imports = append(imports, "strconv")
+	}
+	if g.usesTime {
+		imports = append(imports, "time")
+	}
+	sort.Strings(imports)
+	b.WriteString("import (\n")
+	for _, path := range imports {
+		fmt.Fprintf(b, "\t%q\n", path)
+	}
+	b.WriteString(")\n")
+	fmt.Fprintf(b, goClientRuntime, APIKeyHeader)
+	names := make([]string, 0, len(g.defs))
+	for name := range g.defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(b, "\ntype %s %s\n", name, g.defs[name])
+	}
+	b.WriteString(params.String())
+	b.WriteString(methods.String())
+	return format.Source([]byte(b.String()))
+}
+
+type goClientGen struct {
+	// defs are the structs of the named struct types, by schemaName.
+	defs        map[string]string
+	usesStrconv bool
+	usesTime    bool
+}
+
+func (g *goClientGen) ref(t reflect.Type) string {
+	switch t {
+	case timeType:
+		g.usesTime = true
+		return "time.Time"
+	case dateTimeType:
+		return "string"
+	case rawMessageType, jsonRawType:
+		return "json.RawMessage"
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return "*" + g.ref(t.Elem())
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return t.Kind().String()
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "[]byte"
+		}
+		return "[]" + g.ref(t.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), g.ref(t.Elem()))
+	case reflect.Map:
+		return "map[" + g.ref(t.Key()) + "]" + g.ref(t.Elem())
+	case reflect.Struct:
+		if encodesItself(t) {
+			return "json.RawMessage"
+		}
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := g.defs[name]; !ok {
+			// registered first so that recursive types terminate
+			g.defs[name] = ""
+			g.defs[name] = g.object(t)
+		}
+		return name
+	}
+	return "any"
+}
+
+func (g *goClientGen) object(t reflect.Type) string {
+	b := &strings.Builder{}
+	b.WriteString("struct {\n")
+	for _, f := range clientFields(t) {
+		fmt.Fprintf(b, "%s %s `json:%q`\n", f.GoName, g.ref(f.Type), f.Tag)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func (g *goClientGen) operation(methods *strings.Builder, params *strings.Builder, op clientOperation) {
+	name := exportedName(op.Name)
+	args := []string{"ctx context.Context"}
+	for _, param := range op.PathParams {
+		args = append(args, clientParamName(param)+" string")
+	}
+	switch {
+	case op.JSONBody:
+		args = append(args, "body "+g.ref(reflect.TypeOf(op.Body)))
+	case op.RawBody:
+		args = append(args, "body io.Reader", "contentType string")
+	}
+
+	encode := "query, header := url.Values{}, http.Header{}"
+	if all := op.params(); len(all) > 0 {
+		paramsType := name + "Params"
+		fmt.Fprintf(params, "\n// %s are the params of %s.\ntype %s struct {\n", paramsType, name, paramsType)
+		for _, p := range all {
+			if p.Description != "" {
+				fmt.Fprintf(params, "// %s\n", p.Description)
+			}
+			fmt.Fprintf(params, "%s %s\n", exportedName(p.Name), goParamType(p))
+		}
+		fmt.Fprintf(params, "}\n\nfunc (p *%s) encode() (url.Values, http.Header) {\n", paramsType)
+		params.WriteString("query, header := url.Values{}, http.Header{}\nif p == nil {\nreturn query, header\n}\n")
+		for _, p := range all {
+			target := "query"
+			if op.isHeader(p.Name) {
+				target = "header"
+			}
+			field := "p." + exportedName(p.Name)
+			switch goParamType(p) {
+			case "int":
+				g.usesStrconv = true
+				fmt.Fprintf(params, "if %s != 0 {\n%s.Set(%q, strconv.Itoa(%s))\n}\n", field, target, p.Name, field)
+			case "float64":
+				g.usesStrconv = true
+				fmt.Fprintf(params, "if %s != 0 {\n%s.Set(%q, strconv.FormatFloat(%s, 'f', -1, 64))\n}\n", field, target, p.Name, field)
+			case "*bool":
+				g.usesStrconv = true
+				fmt.Fprintf(params, "if %s != nil {\n%s.Set(%q, strconv.FormatBool(*%s))\n}\n", field, target, p.Name, field)
+			default:
+				fmt.Fprintf(params, "if %s != \"\" {\n%s.Set(%q, %s)\n}\n", field, target, p.Name, field)
+			}
+		}
+		params.WriteString("return query, header\n}\n")
+		args = append(args, "params *"+paramsType)
+		encode = "query, header := params.encode()"
+	}
+
+	// the results are pointers, maps or slices, nil on failure
+	result := ""
+	switch {
+	case op.Accept != "":
+		result = "*http.Response"
+	case op.Response != nil:
+		t := reflect.TypeOf(op.Response)
+		result = g.ref(t)
+		if t.Kind() == reflect.Struct {
+			result = "*" + result
+		}
+	}
+
+	path := ""
+	for i, segment := range pathSegments(op.Path) {
+		if segment == "" {
+			continue
+		}
+		if path != "" {
+			path += " + "
+		}
+		if i%2 == 1 {
+			path += "url.PathEscape(" + clientParamName(segment) + ")"
+		} else {
+			path += fmt.Sprintf("%q", segment)
+		}
+	}
+
+	summary := op.Summary
+	if op.Access != AccessPublic {
+		summary += " (" + op.Access + ")"
+	}
+	fmt.Fprintf(methods, "\n// %s calls %s %s: %s.", name, op.Method, op.Path, summary)
+	if op.Accept != "" {
+		methods.WriteString(" The caller closes the body of the response.")
+	}
+	methods.WriteString("\n")
+	if result == "" {
+		fmt.Fprintf(methods, "func (c *Client) %s(%s) error {\n", name, strings.Join(args, ", "))
+	} else {
+		fmt.Fprintf(methods, "func (c *Client) %s(%s) (%s, error) {\n", name, strings.Join(args, ", "), result)
+	}
+	returnErr := "return err"
+	if result != "" {
+		returnErr = "return nil, err"
+	}
+
+	methods.WriteString(encode + "\n")
+	accept := op.Accept
+	if accept == "" {
+		accept = "application/json"
+	}
+	fmt.Fprintf(methods, "header.Set(\"Accept\", %q)\n", accept)
+	reader := "nil"
+	switch {
+	case op.JSONBody:
+		fmt.Fprintf(methods, "reader, err := jsonBody(body, header)\nif err != nil {\n%s\n}\n", returnErr)
+		reader = "reader"
+	case op.RawBody:
+		methods.WriteString("header.Set(\"Content-Type\", contentType)\n")
+		reader = "body"
+	}
+	send := fmt.Sprintf("c.send(ctx, http.Method%s, %s, query, header, %s)",
+		strings.ToUpper(op.Method[:1])+strings.ToLower(op.Method[1:]), path, reader)
+
+	if op.Accept != "" {
+		fmt.Fprintf(methods, "return %s\n}\n", send)
+		return
+	}
+	fmt.Fprintf(methods, "resp, err := %s\nif err != nil {\n%s\n}\n", send, returnErr)
+	switch {
+	case result == "":
+		methods.WriteString("return decode(resp, nil)\n}\n")
+	case strings.HasPrefix(result, "*"):
+		fmt.Fprintf(methods, "out := new(%s)\nif err := decode(resp, out); err != nil {\nreturn nil, err\n}\nreturn out, nil\n}\n", result[1:])
+	default:
+		fmt.Fprintf(methods, "var out %s\nif err := decode(resp, &out); err != nil {\nreturn nil, err\n}\nreturn out, nil\n}\n", result)
+	}
+}
+
+func goParamType(param APIParam) string {
+	switch param.Type {
+	case "integer":
+		return "int"
+	case "number":
+		return "float64"
+	case "boolean":
+		// a pointer, to send false
+		return "*bool"
+	}
+	return "string"
+}
+
+// goClientRuntime is the part of the Go client that doesn't depend on the
+// operations, formatted with the API key header.
+const goClientRuntime = `
+type Client struct {
+	baseURL    string
+	token      string
+	apiKey     string
+	httpClient *http.Client
+}
+
+type Option func(c *Client)
+
+// WithToken sets the auth token of a users or _superusers record sent in
+// the Authorization header.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithAPIKey sets the API key sent in the %[1]s header.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithHTTPClient replaces http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{baseURL: strings.TrimRight(baseURL, "/"), httpClient: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// APIError is a failed request, with the code and the message of the
+// APIResp envelope.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestId  string
+	Data       json.RawMessage
+}
+
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+type envelope struct {
+	Success   bool            ` + "`json:\"success\"`" + `
+	Message   string          ` + "`json:\"message\"`" + `
+	Code      string          ` + "`json:\"code\"`" + `
+	RequestId string          ` + "`json:\"requestId\"`" + `
+	Data      json.RawMessage ` + "`json:\"data\"`" + `
+}
+
+func jsonBody(body any, header http.Header) (io.Reader, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	header.Set("Content-Type", "application/json")
+	return bytes.NewReader(raw), nil
+}
+
+// send sends the request, returning an *APIError unless the response is a
+// success.
+func (c *Client) send(ctx context.Context, method string, path string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", c.token)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("%[1]s", c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	env := envelope{}
+	json.Unmarshal(raw, &env)
+	apiErr := &APIError{StatusCode: resp.StatusCode, Code: env.Code, Message: env.Message, RequestId: env.RequestId, Data: env.Data}
+	if apiErr.Code == "" {
+		apiErr.Code = http.StatusText(resp.StatusCode)
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(raw))
+	}
+	if apiErr.RequestId == "" {
+		apiErr.RequestId = resp.Header.Get("X-Request-Id")
+	}
+	return nil, apiErr
+}
+
+// decode closes the response, decoding the data of its APIResp envelope
+// into out (if not nil).
+func decode(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+	env := envelope{}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if !env.Success {
+		return &APIError{StatusCode: resp.StatusCode, Code: env.Code, Message: env.Message, RequestId: env.RequestId, Data: env.Data}
+	}
+	if out == nil || len(env.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(env.Data, out)
+}
+`
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// CompletenessCriterion is a part of the completeness of a profile, worth
+// Weight of its 100 points when SQL, a condition on the users row, holds.
+type CompletenessCriterion struct {
+	Name   string
+	Weight int
+	SQL    string
+}
+
+// CompletenessCriteria are what the completeness of the users is scored
+// on. The score itself is stored in the completeness column by the
+// triggers of the users and preferences tables, whatever writes them,
+// which must be migrated along with the weights.
+var CompletenessCriteria = []CompletenessCriterion{
+	{Name: "verified", Weight: 30, SQL: "[[verified]] = TRUE"},
+	{Name: "name", Weight: 25, SQL: "[[name]] != ''"},
+	{Name: "avatar", Weight: 25, SQL: "[[avatar]] != ''"},
+	{Name: "preferences", Weight: 20, SQL: "EXISTS (SELECT 1 FROM {{preferences}} p WHERE p.[[user]] = {{users}}.[[id]] " +
+		"AND p.[[values]] NOT IN ('', '{}', 'null'))"},
+}
+
+// CompletenessBuckets are the score ranges of the distribution of GET
+// /admin/completeness, the complete profiles having their own.
+var CompletenessBuckets = []CompletenessBucket{{Min: 0, Max: 24}, {Min: 25, Max: 49}, {Min: 50, Max: 74}, {Min: 75, Max: 99}, {Min: 100, Max: 100}}
+
+type CompletenessBucket struct {
+	Min   int `json:"min"`
+	Max   int `json:"max"`
+	Users int `json:"users"`
+}
+
+type CompletenessCriterionStats struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+	// Users counts the users meeting the criterion.
+	Users   int     `json:"users"`
+	Percent float64 `json:"percent"`
+}
+
+type CompletenessStats struct {
+	Users     int                          `json:"users"`
+	Average   float64                      `json:"average"`
+	Buckets   []CompletenessBucket         `json:"buckets"`
+	Criteria  []CompletenessCriterionStats `json:"criteria"`
+	Generated string                       `json:"generated"`
+}
+
+// GetCompletenessStats computes the distribution of the completeness of the
+// users that aren't deleted, and how many meet each criterion, in a single
+// scan of the table.
+func GetCompletenessStats(app core.App) (*CompletenessStats, error) {
+	stats := &CompletenessStats{
+		Buckets:   make([]CompletenessBucket, len(CompletenessBuckets)),
+		Criteria:  make([]CompletenessCriterionStats, len(CompletenessCriteria)),
+		Generated: types.NowDateTime().String(),
+	}
+	columns := []string{"COUNT(*)", "COALESCE(AVG([[completeness]]), 0)"}
+	dest := []any{&stats.Users, &stats.Average}
+	for i, bucket := range CompletenessBuckets {
+		stats.Buckets[i] = bucket
+		columns = append(columns, "COALESCE(SUM([[completeness]] BETWEEN "+strconv.Itoa(bucket.Min)+" AND "+strconv.Itoa(bucket.Max)+"), 0)")
+		dest = append(dest, &stats.Buckets[i].Users)
+	}
+	for i, criterion := range CompletenessCriteria {
+		stats.Criteria[i] = CompletenessCriterionStats{Name: criterion.Name, Weight: criterion.Weight}
+		columns = append(columns, "COALESCE(SUM("+criterion.SQL+"), 0)")
+		dest = append(dest, &stats.Criteria[i].Users)
+	}
+
+	span := StartStorageSpan(app, "GetCompletenessStats", "SELECT")
+	err := app.DB().
+		Select(columns...).
+		From(Users.Table).
+		Where(Users.scope(app)).
+		Row(dest...)
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	for i := range stats.Criteria {
+		if stats.Users > 0 {
+			stats.Criteria[i].Percent = float64(stats.Criteria[i].Users) * 100 / float64(stats.Users)
+		}
+	}
+	return stats, nil
+}
+
+func HandleGetCompletenessStats(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		stats, err := GetCompletenessStats(WithTrace(app, e))
+		if err != nil {
+			return WriteError(e, err, "error getting completeness stats")
+		}
+		return WriteOK(e, "", stats)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// CompressibleContentTypes are the media types worth compressing, the
+// others (images, archives, ...) are usually compressed already.
+// text/event-stream is left out since the events must reach the client as
+// soon as they are flushed.
+var CompressibleContentTypes = []string{
+	"application/json",
+	"application/x-ndjson",
+	"application/xml",
+	"application/msgpack",
+	"application/javascript",
+	"image/svg+xml",
+	"text/html",
+	"text/css",
+	"text/csv",
+	"text/plain",
+	"text/javascript",
+	"text/xml",
+}
+
+// compressionSkippedPrefixes are served by PocketBase itself.
+var compressionSkippedPrefixes = []string{"/api/", "/_/"}
+
+// compressionEncodings are the supported Content-Encodings, by preference.
+var compressionEncodings = []string{"gzip", "deflate"}
+
+// NegotiateEncoding returns the supported encoding the Accept-Encoding
+// header prefers, or "" for none.
+func NegotiateEncoding(acceptEncoding string) string {
+	return negotiateEncoding(acceptEncoding, compressionEncodings)
+}
+
+// negotiateEncoding returns the one of encodings, by preference, the
+// Accept-Encoding header prefers, or "" for none.
+func negotiateEncoding(acceptEncoding string, encodings []string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if coding == "*" && len(encodings) > 0 {
+			coding = encodings[0]
+		}
+		rank := slices.Index(encodings, coding)
+		if rank < 0 || q <= 0 {
+			continue
+		}
+		if q > bestQ || q == bestQ && rank < slices.Index(encodings, best) {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// Compress compresses the responses of the custom routes and the static
+// files with gzip or deflate, as negotiated with Accept-Encoding, when they
+// have a CompressibleContentTypes type and at least minSize bytes.
+func Compress(minSize int) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		for _, prefix := range compressionSkippedPrefixes {
+			if strings.HasPrefix(e.Request.URL.Path, prefix) {
+				return e.Next()
+			}
+		}
+		e.Response.Header().Add("Vary", "Accept-Encoding")
+		encoding := NegotiateEncoding(e.Request.Header.Get("Accept-Encoding"))
+		// the ranges would apply to the compressed body
+		if encoding == "" || e.Request.Method == http.MethodHead || e.Request.Header.Get("Range") != "" {
+			return e.Next()
+		}
+
+		cw := &compressResponse{ResponseWriter: e.Response, encoding: encoding, minSize: minSize}
+		e.Response = cw
+		err := e.Next()
+		e.Response = cw.ResponseWriter
+		if closeErr := cw.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+}
+
+// compressResponse holds back the start of the body until it knows whether
+// to compress it: right away for the other content types, once minSize
+// bytes are written or the handler flushes for the compressible ones.
+type compressResponse struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	decided bool
+	buf     bytes.Buffer
+	writer  io.WriteCloser
+}
+
+func (w *compressResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		if !w.compressible() {
+			if err := w.start(false); err != nil {
+				return 0, err
+			}
+		} else if w.buf.Len()+len(b) < w.minSize {
+			return w.buf.Write(b)
+		} else if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	if w.writer != nil {
+		return w.writer.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// FlushError starts the body, compressed if compressible, for the streaming
+// responses.
+func (w *compressResponse) FlushError() error {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		if err := w.start(w.compressible()); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := w.writer.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close writes out the rest of the body, uncompressed when it stayed under
+// minSize.
+func (w *compressResponse) Close() error {
+	if !w.decided {
+		if w.status == 0 && w.buf.Len() == 0 {
+			// nothing was written, e.g. the handler failed
+			return nil
+		}
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		if err := w.start(false); err != nil {
+			return err
+		}
+	}
+	if w.writer != nil {
+		return w.writer.Close()
+	}
+	return nil
+}
+
+func (w *compressResponse) compressible() bool {
+	header := w.Header()
+	switch {
+	case w.status != http.StatusOK && w.status != http.StatusCreated,
+		header.Get("Content-Encoding") != "",
+		strings.Contains(header.Get("Cache-Control"), "no-transform"):
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return slices.Contains(CompressibleContentTypes, mediaType)
+}
+
+// start sends the headers and the held back bytes.
+func (w *compressResponse) start(compress bool) error {
+	w.decided = true
+	if compress {
+		header := w.Header()
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		// the compressed body differs from the uncompressed one
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		if w.encoding == "gzip" {
+			w.writer = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.writer, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.writer != nil {
+		_, err = w.writer.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
@@ -0,0 +1,855 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/cache"
+	"github.com/EricFrancis12/pocketbase-demo/events"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/spf13/cobra"
+)
+
+// Config holds the settings of the custom API. Every field is loaded from,
+// by precedence, the command line flag named after its json tag (e.g.
+// --maxPerPage), the environment variable named by its env tag, the config
+// file and the default tag. The fields tagged secret are redacted by
+// GET /admin/config.
+type Config struct {
+	LocalesDir              string        `json:"localesDir" env:"LOCALES_DIR" desc:"Directory of the <language>.json message catalogs, replacing the built-in en, es and de ones when set."`
+	TemplatesDir            string        `json:"templatesDir" env:"TEMPLATES_DIR" desc:"Directory of the layouts, partials, pages and emails HTML templates, replacing the built-in ones when set."`
+	DefaultLanguage         string        `json:"defaultLanguage" env:"DEFAULT_LANGUAGE" default:"en" desc:"Language of the responses to the requests whose Accept-Language matches no catalog."`
+	PublicDir               string        `json:"publicDir" env:"PUBLIC_DIR" default:"./pb_public" desc:"Directory served by the static files handler."`
+	SPAFallback             bool          `json:"spaFallback" env:"SPA_FALLBACK" default:"false" desc:"Serve index.html for unknown non API paths under SPA_BASE without a file extension."`
+	SPABase                 string        `json:"spaBase" env:"SPA_BASE" default:"/" desc:"Path under which SPA_FALLBACK serves the index.html of the same directory of PUBLIC_DIR, e.g. /app for pb_public/app/index.html."`
+	StaticPrecompressed     bool          `json:"staticPrecompressed" env:"STATIC_PRECOMPRESSED" desc:"Serve the .br and .gz files next to the static files, e.g. app.js.br for app.js, to the clients accepting them."`
+	StaticVersionsDir       string        `json:"staticVersionsDir" env:"STATIC_VERSIONS_DIR" default:"./pb_public_versions" desc:"Directory of the bundles deployed by POST /admin/deploy-static, PUBLIC_DIR becoming a symlink to the served one."`
+	StaticDeployToken       string        `json:"staticDeployToken" env:"STATIC_DEPLOY_TOKEN" secret:"true" desc:"Token POST /admin/deploy-static requires in the X-Deploy-Token header along with the superuser auth. The static deploys are disabled when empty."`
+	StaticDeployKeep        int           `json:"staticDeployKeep" env:"STATIC_DEPLOY_KEEP" default:"5" desc:"Number of deployed static bundles kept for rollbacks, the served one included."`
+	StaticDeployMaxSize     int           `json:"staticDeployMaxSize" env:"STATIC_DEPLOY_MAX_SIZE" default:"268435456" desc:"Maximum size in bytes of the unpacked static bundles. The zips themselves are limited by MAX_UPLOAD_SIZE."`
+	DefaultPerPage          int           `json:"defaultPerPage" env:"DEFAULT_PER_PAGE" default:"30" desc:"Page size used by list endpoints when ?perPage is missing."`
+	MaxPerPage              int           `json:"maxPerPage" env:"MAX_PER_PAGE" default:"500" desc:"Upper bound for ?perPage on list endpoints."`
+	MaxLookupIds            int           `json:"maxLookupIds" env:"MAX_LOOKUP_IDS" default:"100" desc:"Maximum number of ids accepted by a single user lookup."`
+	BatchMaxOperations      int           `json:"batchMaxOperations" env:"BATCH_MAX_OPERATIONS" default:"100" desc:"Maximum number of operations accepted by a single user batch."`
+	WriteRetryAttempts      int           `json:"writeRetryAttempts" env:"WRITE_RETRY_ATTEMPTS" default:"5" desc:"Attempts made by writes that hit a busy database before answering 503."`
+	LastSeenInterval        time.Duration `json:"lastSeenInterval" env:"LAST_SEEN_INTERVAL" default:"1m" desc:"Minimum time between two writes of a user's lastSeen."`
+	LastSeenCacheSize       int           `json:"lastSeenCacheSize" env:"LAST_SEEN_CACHE_SIZE" default:"10000" desc:"Maximum number of users tracked by the lastSeen throttle."`
+	ActivityFlushInterval   time.Duration `json:"activityFlushInterval" env:"ACTIVITY_FLUSH_INTERVAL" default:"5s" desc:"How often the buffered user activity is written."`
+	ActivityBatchSize       int           `json:"activityBatchSize" env:"ACTIVITY_BATCH_SIZE" default:"100" desc:"Buffered user activity that triggers a write before the next flush."`
+	ActivityHistorySize     int           `json:"activityHistorySize" env:"ACTIVITY_HISTORY_SIZE" default:"200" desc:"Number of recent requests kept in the activity history of every user."`
+	UsageFlushInterval      time.Duration `json:"usageFlushInterval" env:"USAGE_FLUSH_INTERVAL" default:"10s" desc:"How often the buffered request counts of the users and API keys are written."`
+	UsageMonthlyQuota       int           `json:"usageMonthlyQuota" env:"USAGE_MONTHLY_QUOTA" desc:"Requests a user or API key can make to the custom routes per calendar month (UTC), answered with 429 past it. 0 disables the quota."`
+	StorageBackend          string        `json:"storageBackend" env:"STORAGE_BACKEND" desc:"Storage of the uploaded avatars and the stored exports: local or s3. When empty, the S3 settings of the dashboard apply."`
+	StorageS3Bucket         string        `json:"storageS3Bucket" env:"STORAGE_S3_BUCKET" desc:"Bucket used by the s3 storage backend."`
+	StorageS3Region         string        `json:"storageS3Region" env:"STORAGE_S3_REGION" desc:"Region of the s3 storage backend."`
+	StorageS3Endpoint       string        `json:"storageS3Endpoint" env:"STORAGE_S3_ENDPOINT" desc:"Endpoint of the S3-compatible service, e.g. https://s3.amazonaws.com."`
+	StorageS3AccessKey      string        `json:"storageS3AccessKey" env:"STORAGE_S3_ACCESS_KEY" desc:"Access key of the s3 storage backend."`
+	StorageS3Secret         string        `json:"storageS3Secret" env:"STORAGE_S3_SECRET" secret:"true" desc:"Secret key of the s3 storage backend."`
+	StorageS3ForcePathStyle bool          `json:"storageS3ForcePathStyle" env:"STORAGE_S3_FORCE_PATH_STYLE" default:"false" desc:"Address the bucket in the path instead of the host name, as MinIO and some other services require."`
+	DownloadURLSecret       string        `json:"downloadURLSecret" env:"DOWNLOAD_URL_SECRET" secret:"true" desc:"HMAC key used to sign download links. A random key is used when empty."`
+	ImpersonationTTL        time.Duration `json:"impersonationTTL" env:"IMPERSONATION_TTL" default:"15m" desc:"Lifetime of the tokens issued by POST /admin/impersonate/{userId}."`
+	DownloadURLTTL          time.Duration `json:"downloadURLTTL" env:"DOWNLOAD_URL_TTL" default:"15m" desc:"Lifetime of download links."`
+	ShareLinkSecret         string        `json:"shareLinkSecret" env:"SHARE_LINK_SECRET" secret:"true" desc:"HMAC key used to sign profile share links. A random key is used when empty."`
+	ShareLinkDefaultTTL     time.Duration `json:"shareLinkDefaultTTL" env:"SHARE_LINK_DEFAULT_TTL" default:"24h" desc:"Lifetime of share links created without ?ttl."`
+	ShareLinkMaxTTL         time.Duration `json:"shareLinkMaxTTL" env:"SHARE_LINK_MAX_TTL" default:"168h" desc:"Upper bound for the ?ttl of share links."`
+	SitemapChunkSize        int           `json:"sitemapChunkSize" env:"SITEMAP_CHUNK_SIZE" default:"50000" desc:"Profiles listed per file of GET /sitemap.xml, the sitemap becoming an index of several files past it. At most 50000."`
+	SitemapSchedule         string        `json:"sitemapSchedule" env:"SITEMAP_SCHEDULE" default:"0 * * * *" desc:"Cron expression of the rebuilds of the cached GET /sitemap.xml."`
+	RobotsDisallow          []string      `json:"robotsDisallow" env:"ROBOTS_DISALLOW" default:"/api/,/admin-ui/,/shared/,/downloads/" desc:"Comma separated paths GET /robots.txt disallows to every crawler."`
+	RobotsTxt               string        `json:"robotsTxt" env:"ROBOTS_TXT" desc:"Content of GET /robots.txt, replacing the generated one when set."`
+	EmailChangeSecret       string        `json:"emailChangeSecret" env:"EMAIL_CHANGE_SECRET" secret:"true" desc:"HMAC key used to sign email change confirmation tokens. A random key is used when empty."`
+	EmailChangeTTL          time.Duration `json:"emailChangeTTL" env:"EMAIL_CHANGE_TTL" default:"1h" desc:"Lifetime of email change confirmation tokens."`
+	VerificationSecret      string        `json:"verificationSecret" env:"VERIFICATION_SECRET" secret:"true" desc:"HMAC key used to sign email verification tokens. A random key is used when empty."`
+	OAuth2StateSecret       string        `json:"oauth2StateSecret" env:"OAUTH2_STATE_SECRET" secret:"true" desc:"HMAC key used to sign the state of the OAuth2 logins. A random key is used when empty."`
+	TwoFactorSecret         string        `json:"twoFactorSecret" env:"TWO_FACTOR_SECRET" secret:"true" desc:"HMAC key used to sign the 2FA login challenges and sessions. A random key is used when empty."`
+	FieldEncryptionKeys     []string      `json:"fieldEncryptionKeys" env:"FIELD_ENCRYPTION_KEYS" secret:"true" desc:"Comma separated keyId:key AES-256 keys, base64 encoded, encrypting the phone and nationalId of the users at rest. The first one encrypts, the others only decrypt until \"users reencrypt\" rewrites the rows with the first. Those fields can't be written when empty."`
+	TwoFactorSessionTTL     time.Duration `json:"twoFactorSessionTTL" env:"TWO_FACTOR_SESSION_TTL" default:"12h" desc:"How long a verified second factor unlocks the routes requiring it."`
+	VerificationTTL         time.Duration `json:"verificationTTL" env:"VERIFICATION_TTL" default:"72h" desc:"Lifetime of email verification tokens."`
+	TeamInviteSecret        string        `json:"teamInviteSecret" env:"TEAM_INVITE_SECRET" secret:"true" desc:"HMAC key used to sign team invitation tokens. A random key is used when empty."`
+	TeamInviteTTL           time.Duration `json:"teamInviteTTL" env:"TEAM_INVITE_TTL" default:"168h" desc:"Lifetime of team invitation tokens."`
+	BulkDeleteSecret        string        `json:"bulkDeleteSecret" env:"BULK_DELETE_SECRET" secret:"true" desc:"HMAC key used to sign the confirmation tokens of DELETE /users. A random key is used when empty."`
+	BulkDeleteTokenTTL      time.Duration `json:"bulkDeleteTokenTTL" env:"BULK_DELETE_TOKEN_TTL" default:"10m" desc:"Lifetime of the confirmation tokens returned by DELETE /users?dryRun=true."`
+	ReadReplicaConns        int           `json:"readReplicaConns" env:"READ_REPLICA_CONNS" default:"0" desc:"Connections of the read-only pool the routes with the replica read mode read through. 0 disables it, those routes then read through the concurrent pool."`
+	DuplicateScanMax        int           `json:"duplicateScanMax" env:"DUPLICATE_SCAN_MAX" default:"10000" desc:"Maximum number of users GET /admin/users/duplicates compares, it fails past it."`
+	BulkDeleteMax           int           `json:"bulkDeleteMax" env:"BULK_DELETE_MAX" default:"1000" desc:"Maximum number of users DELETE /users deletes at once."`
+	InvitationSecret        string        `json:"invitationSecret" env:"INVITATION_SECRET" secret:"true" desc:"HMAC key used to sign the invitation links of POST /admin/invitations. A random key is used when empty."`
+	InvitationTTL           time.Duration `json:"invitationTTL" env:"INVITATION_TTL" default:"168h" desc:"Lifetime of invitations."`
+	AuthLockoutThreshold    int           `json:"authLockoutThreshold" env:"AUTH_LOCKOUT_THRESHOLD" default:"5" desc:"Failed logins and 2FA verifications of a client IP or an account after which it is locked out. 0 disables the brute-force protection."`
+	AuthLockoutBase         time.Duration `json:"authLockoutBase" env:"AUTH_LOCKOUT_BASE" default:"30s" desc:"First lockout past AUTH_LOCKOUT_THRESHOLD, doubled by each further failure."`
+	AuthLockoutMax          time.Duration `json:"authLockoutMax" env:"AUTH_LOCKOUT_MAX" default:"1h" desc:"Longest lockout."`
+	AuthFailureWindow       time.Duration `json:"authFailureWindow" env:"AUTH_FAILURE_WINDOW" default:"1h" desc:"How long the failures of a client IP or an account are remembered after the last one."`
+	AuthCaptchaThreshold    int           `json:"authCaptchaThreshold" env:"AUTH_CAPTCHA_THRESHOLD" default:"3" desc:"Failures after which the client IP or the account must send a CAPTCHA response, when CAPTCHA_VERIFY_URL is set. 0 never challenges them."`
+	CaptchaVerifyURL        string        `json:"captchaVerifyURL" env:"CAPTCHA_VERIFY_URL" desc:"siteverify endpoint of the CAPTCHA provider, e.g. https://hcaptcha.com/siteverify or https://challenges.cloudflare.com/turnstile/v0/siteverify. Empty disables the CAPTCHA challenges."`
+	CaptchaSecret           string        `json:"captchaSecret" env:"CAPTCHA_SECRET" secret:"true" desc:"Secret key of CAPTCHA_VERIFY_URL."`
+	SignupHoneypotFields    []string      `json:"signupHoneypotFields" env:"SIGNUP_HONEYPOT_FIELDS" default:"website" desc:"Comma separated body fields of POST /auth/register the signup form hides from the humans, the signups filling one being rejected. They are stripped from the body, so they can't be fields of the users."`
+	SignupMinSubmitTime     time.Duration `json:"signupMinSubmitTime" env:"SIGNUP_MIN_SUBMIT_TIME" default:"0" desc:"Minimum time between GET /auth/register/form and the POST /auth/register sending its token, faster signups being rejected. 0 doesn't require the token."`
+	SignupFormTokenTTL      time.Duration `json:"signupFormTokenTTL" env:"SIGNUP_FORM_TOKEN_TTL" default:"1h" desc:"Lifetime of the tokens of GET /auth/register/form."`
+	SignupFormSecret        string        `json:"signupFormSecret" env:"SIGNUP_FORM_SECRET" secret:"true" desc:"HMAC key used to sign the tokens of GET /auth/register/form. A random key is used when empty."`
+	SignupCaptcha           bool          `json:"signupCaptcha" env:"SIGNUP_CAPTCHA" desc:"Require a CAPTCHA response, verified with CAPTCHA_VERIFY_URL, from every POST /auth/register."`
+	SignupBlockDisposable   bool          `json:"signupBlockDisposableEmails" env:"SIGNUP_BLOCK_DISPOSABLE_EMAILS" default:"true" desc:"Refuse the signups of the emails of the domains of blocked_email_domains, and of their subdomains."`
+	InviteOnly              bool          `json:"inviteOnly" env:"INVITE_ONLY" desc:"Only let the invited users sign up, closing POST /auth/register and the OAuth2 sign ups."`
+	UserUpdatesPerHour      int           `json:"userUpdatesPerHour" env:"USER_UPDATES_PER_HOUR" default:"20" desc:"Maximum number of PATCH /users/{userId} accepted per user and hour."`
+	RateLimitIPPerMinute    int           `json:"rateLimitIPPerMinute" env:"RATE_LIMIT_IP_PER_MINUTE" default:"120" desc:"Requests a minute allowed per client IP on the custom routes. 0 disables the limit."`
+	RateLimitIPBurst        int           `json:"rateLimitIPBurst" env:"RATE_LIMIT_IP_BURST" default:"30" desc:"Requests a client IP can make at once before RATE_LIMIT_IP_PER_MINUTE applies."`
+	RateLimitAuthPerMinute  int           `json:"rateLimitAuthPerMinute" env:"RATE_LIMIT_AUTH_PER_MINUTE" default:"300" desc:"Requests a minute allowed per auth record on the custom routes. 0 disables the limit."`
+	RateLimitAuthBurst      int           `json:"rateLimitAuthBurst" env:"RATE_LIMIT_AUTH_BURST" default:"60" desc:"Requests an auth record can make at once before RATE_LIMIT_AUTH_PER_MINUTE applies."`
+	SyncTombstoneTTL        time.Duration `json:"syncTombstoneTTL" env:"SYNC_TOMBSTONE_TTL" default:"720h" desc:"How long the deletions of users are kept for GET /users/changes. The syncs from further back answer 410 and must start over."`
+	IdempotencyKeyTTL       time.Duration `json:"idempotencyKeyTTL" env:"IDEMPOTENCY_KEY_TTL" default:"24h" desc:"How long the responses to requests with an Idempotency-Key are replayed."`
+	CacheURL                string        `json:"cacheURL" env:"CACHE_URL" secret:"true" desc:"redis://[[user]:password@]host[:port][/db] url of the cache the instances share the cached responses, the rate limits and the route settings versions in. Empty keeps them in process, per instance."`
+	CachePrefix             string        `json:"cachePrefix" env:"CACHE_PREFIX" default:"pocketbase-demo:" desc:"Prefix of the keys of CACHE_URL, for the apps sharing a Redis server."`
+	CacheTimeout            time.Duration `json:"cacheTimeout" env:"CACHE_TIMEOUT" default:"1s" desc:"Timeout of the connection to CACHE_URL and of every command. The requests are served uncached and unlimited when it fails."`
+	ResponseCacheTTL        time.Duration `json:"responseCacheTTL" env:"RESPONSE_CACHE_TTL" default:"30s" desc:"How long GET /users and GET /users/{userId} responses are cached. 0 disables the cache."`
+	ResponseCacheSize       int           `json:"responseCacheSize" env:"RESPONSE_CACHE_SIZE" default:"1000" desc:"Maximum number of responses cached in process, when CACHE_URL is empty."`
+	TenantBaseDomain        string        `json:"tenantBaseDomain" env:"TENANT_BASE_DOMAIN" desc:"Domain whose subdomains name the tenant of the requests, e.g. example.com for acme.example.com. The X-Tenant header takes precedence."`
+	CompressionMinSize      int           `json:"compressionMinSize" env:"COMPRESSION_MIN_SIZE" default:"1024" desc:"Responses smaller than this many bytes are sent uncompressed. -1 disables the compression."`
+	MaxBodySize             int           `json:"maxBodySize" env:"MAX_BODY_SIZE" default:"1048576" desc:"Maximum size in bytes of the request bodies of the custom routes, except the uploads."`
+	MaxUploadSize           int           `json:"maxUploadSize" env:"MAX_UPLOAD_SIZE" default:"52428800" desc:"Maximum size in bytes of the request bodies of the imports, restores and avatar uploads."`
+	MaxJSONDepth            int           `json:"maxJSONDepth" env:"MAX_JSON_DEPTH" default:"32" desc:"Maximum nesting depth of the JSON request bodies."`
+	MaxJSONArrayLength      int           `json:"maxJSONArrayLength" env:"MAX_JSON_ARRAY_LENGTH" default:"1000" desc:"Maximum number of items of the arrays of the JSON request bodies."`
+	ErasureAuditRetention   time.Duration `json:"erasureAuditRetention" env:"ERASURE_AUDIT_RETENTION" default:"2160h" desc:"The audit logs about a user younger than this survive the erasure of its personal data."`
+	MergeOwnedTables        []string      `json:"mergeOwnedTables" env:"MERGE_OWNED_TABLES" default:"posts.author" desc:"Comma separated table.column relations to the users whose rows follow the merged users."`
+	TakeoutCollections      []string      `json:"takeoutCollections" env:"TAKEOUT_COLLECTIONS" default:"posts.author,user_activity.user" desc:"Comma separated table.column relations to the users whose rows are part of their takeouts."`
+	TakeoutURLTTL           time.Duration `json:"takeoutURLTTL" env:"TAKEOUT_URL_TTL" default:"72h" desc:"Lifetime of the emailed takeout download links."`
+	ReadOnlyFields          []string      `json:"readOnlyFields" env:"READ_ONLY_FIELDS" default:"verified,tenant_id" desc:"Comma separated users columns the regular clients can't write on any route, whatever its writable fields."`
+	UserEventSourcing       bool          `json:"userEventSourcing" env:"USER_EVENT_SOURCING" desc:"Append the writes of the /users routes as events to the stream of the user, projected to the users table, and listed by GET /users/{userId}/history."`
+	IdStrategies            []string      `json:"idStrategies" env:"ID_STRATEGIES" desc:"Comma separated table=strategy entries choosing how the ids of the new rows of the tables are generated: random, the default, uuidv7, ulid or snowflake, the last three sorting by creation time. Their ids are longer than the random ones, the id field of the table must allow up to 32 characters."`
+	SnowflakeNode           int           `json:"snowflakeNode" env:"SNOWFLAKE_NODE" default:"0" desc:"Node number, from 0 to 1023, of the snowflake ids of ID_STRATEGIES, unique to each instance sharing the database."`
+	MaintenanceMode         bool          `json:"maintenanceMode" env:"MAINTENANCE_MODE" desc:"Reject the writes of everyone but the superusers with 503, whatever the maintenance toggle of the admin API."`
+	ReadOnlyMode            bool          `json:"readOnlyMode" env:"READ_ONLY_MODE" desc:"Reject the writes of everyone but the superusers with 403, for a public demo, whatever the read-only toggle of the admin API. Only then does the reset_demo_data cron task run."`
+	DemoSeedUsers           int           `json:"demoSeedUsers" env:"DEMO_SEED_USERS" default:"50" desc:"Number of fake users the reset_demo_data cron task replaces the users with, as \"seed\" with its default flags does."`
+	SchemaDriftAction       string        `json:"schemaDriftAction" env:"SCHEMA_DRIFT_ACTION" default:"refuse" desc:"What a drift of the collections from what this build expects does at startup: refuse fails the serve, readonly forces the maintenance mode, warn only logs it. The drifts are listed by GET /admin/schema and \"schema check\"."`
+	RequestTimeout          time.Duration `json:"requestTimeout" env:"REQUEST_TIMEOUT" default:"30s" desc:"Time the custom routes have to respond before a 504, unless ROUTE_TIMEOUTS sets theirs. 0 disables it."`
+	RouteTimeouts           []string      `json:"routeTimeouts" env:"ROUTE_TIMEOUTS" default:"GET /users/events=0,GET /ws=0,GET /users/export=10m,POST /users/import=10m,GET /admin/users-backup=10m,POST /admin/users-restore=10m,POST /admin/backup=0,GET /downloads/{token}=0,GET /debug/pprof/{profile...}=0" desc:"Comma separated METHOD /pattern=duration timeouts of the routes that don't use REQUEST_TIMEOUT, 0 for none."`
+	ImportBatchSize         int           `json:"importBatchSize" env:"IMPORT_BATCH_SIZE" default:"500" desc:"Number of rows inserted per transaction by POST /users/import."`
+	LegacySyncDriver        string        `json:"legacySyncDriver" env:"LEGACY_SYNC_DRIVER" default:"pgx" desc:"database/sql driver of LEGACY_SYNC_DSN, pgx for Postgres or mysql, compiled in with the legacysync_postgres or legacysync_mysql build tag."`
+	LegacySyncDSN           string        `json:"legacySyncDSN" env:"LEGACY_SYNC_DSN" secret:"true" desc:"Data source name of the legacy database the users are imported from on LEGACY_SYNC_SCHEDULE. The sync is disabled when empty."`
+	LegacySyncTable         string        `json:"legacySyncTable" env:"LEGACY_SYNC_TABLE" default:"users" desc:"Table, or view, of the legacy database the users are read from."`
+	LegacySyncFields        []string      `json:"legacySyncFields" env:"LEGACY_SYNC_FIELDS" default:"externalId=id,email=email,name=name" desc:"Comma separated field=column mapping of the legacy columns to externalId, email, name, verified, active and updated. externalId and email are required, updated lets the runs only read the rows changed since the previous one."`
+	LegacySyncSchedule      string        `json:"legacySyncSchedule" env:"LEGACY_SYNC_SCHEDULE" default:"*/15 * * * *" desc:"Cron expression of the runs of the legacy user sync."`
+	LegacySyncConflict      string        `json:"legacySyncConflict" env:"LEGACY_SYNC_CONFLICT" default:"newest" desc:"What the legacy rows do to the users existing on both sides: legacy overwrites them, local only links them, newest overwrites the ones updated before their legacy row and requires the updated field."`
+	LegacySyncBatchSize     int           `json:"legacySyncBatchSize" env:"LEGACY_SYNC_BATCH_SIZE" default:"500" desc:"Number of legacy rows read per query by the legacy user sync."`
+	ContractMode            string        `json:"contractMode" env:"CONTRACT_MODE" desc:"Development only: record writes the request and response shapes of the custom routes to golden files of CONTRACT_DIR, verify reports the responses drifting from them. Empty disables both."`
+	ContractDir             string        `json:"contractDir" env:"CONTRACT_DIR" default:"./contracts" desc:"Directory of the API contract golden files, and of the drift.ndjson report of the verify mode."`
+	AvatarCacheMaxAge       time.Duration `json:"avatarCacheMaxAge" env:"AVATAR_CACHE_MAX_AGE" default:"168h" desc:"Max age sent in the Cache-Control header of GET /users/{userId}/avatar, revalidated through its ETag."`
+	AvatarMaxSize           int           `json:"avatarMaxSize" env:"AVATAR_MAX_SIZE" default:"5242880" desc:"Maximum size in bytes of the images accepted by POST /users/{userId}/avatar."`
+	WebhookMaxAttempts      int           `json:"webhookMaxAttempts" env:"WEBHOOK_MAX_ATTEMPTS" default:"5" desc:"Attempts made to deliver a webhook before marking it failed."`
+	WebhookBaseDelay        time.Duration `json:"webhookBaseDelay" env:"WEBHOOK_BASE_DELAY" default:"2s" desc:"Delay before the first webhook retry, doubled on every following one."`
+	WebhookTimeout          time.Duration `json:"webhookTimeout" env:"WEBHOOK_TIMEOUT" default:"10s" desc:"Timeout of a single webhook delivery attempt."`
+	BreakerFailureThreshold int           `json:"breakerFailureThreshold" env:"BREAKER_FAILURE_THRESHOLD" default:"5" desc:"Consecutive failures of a downstream dependency, e.g. a webhook host, the mail server or an external API, opening its circuit breaker, which refuses the calls until BREAKER_OPEN_TIMEOUT passed."`
+	BreakerOpenTimeout      time.Duration `json:"breakerOpenTimeout" env:"BREAKER_OPEN_TIMEOUT" default:"30s" desc:"How long an open circuit breaker refuses the calls before letting a probe through."`
+	BulkheadMaxConcurrent   int           `json:"bulkheadMaxConcurrent" env:"BULKHEAD_MAX_CONCURRENT" default:"16" desc:"Calls in flight to a downstream dependency beyond which the others fail right away."`
+	RetentionMaxPerRun      int           `json:"retentionMaxPerRun" env:"RETENTION_MAX_PER_RUN" default:"1000" desc:"Rows a run of a retention rule deletes at most, the oldest first, leaving the others to the next runs."`
+	RetentionReportTTL      time.Duration `json:"retentionReportTTL" env:"RETENTION_REPORT_TTL" default:"2160h" desc:"How long the reports of the retention runs are kept."`
+	OutboxPollInterval      time.Duration `json:"outboxPollInterval" env:"OUTBOX_POLL_INTERVAL" default:"1s" desc:"How often the outbox dispatcher looks for the user events written in the transactions of the user changes."`
+	OutboxBatchSize         int           `json:"outboxBatchSize" env:"OUTBOX_BATCH_SIZE" default:"100" desc:"Number of outbox events read at once by the outbox dispatcher."`
+	OutboxBaseDelay         time.Duration `json:"outboxBaseDelay" env:"OUTBOX_BASE_DELAY" default:"1s" desc:"Delay before the first retry of an outbox event a sink failed, doubled on every following one."`
+	OutboxMaxDelay          time.Duration `json:"outboxMaxDelay" env:"OUTBOX_MAX_DELAY" default:"10m" desc:"Longest delay between the retries of an outbox event, retried until every sink took it."`
+	OutboxRetention         time.Duration `json:"outboxRetention" env:"OUTBOX_RETENTION" default:"168h" desc:"How long the delivered outbox events are kept."`
+	EventBusURL             string        `json:"eventBusURL" env:"EVENT_BUS_URL" secret:"true" desc:"nats://[user:password@]host[:port] or redis://[[user]:password@]host[:port][/db] url of the message bus the user events are published to, as JSON messages with a schemaVersion. Empty disables it."`
+	EventBusPrefix          string        `json:"eventBusPrefix" env:"EVENT_BUS_PREFIX" default:"users" desc:"Prefix of the subjects, or channels, of the user events, e.g. users.user.created."`
+	EventBusTimeout         time.Duration `json:"eventBusTimeout" env:"EVENT_BUS_TIMEOUT" default:"5s" desc:"Timeout of the connection to the message bus and of every publish."`
+	JobWorkers              int           `json:"jobWorkers" env:"JOB_WORKERS" default:"4" desc:"Number of background jobs run concurrently, e.g. webhook deliveries and emails."`
+	JobPollInterval         time.Duration `json:"jobPollInterval" env:"JOB_POLL_INTERVAL" default:"1s" desc:"How often the job workers look for due jobs when idle."`
+	JobMaxAttempts          int           `json:"jobMaxAttempts" env:"JOB_MAX_ATTEMPTS" default:"5" desc:"Attempts made by the email and avatar jobs before marking them failed."`
+	JobBaseDelay            time.Duration `json:"jobBaseDelay" env:"JOB_BASE_DELAY" default:"5s" desc:"Delay before the first retry of a failed email or avatar job, doubled on every following one."`
+	ShutdownTimeout         time.Duration `json:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" default:"30s" desc:"How long the shutdown waits for the in flight requests and the due jobs before closing the database."`
+	MetricsToken            string        `json:"metricsToken" env:"METRICS_TOKEN" secret:"true" desc:"Bearer token Prometheus scrapes GET /metrics with. Only superusers and API keys can read the metrics when empty."`
+	DebugToken              string        `json:"debugToken" env:"DEBUG_TOKEN" secret:"true" desc:"Bearer token the profilers can read /debug/pprof with. Only superusers can read it when empty."`
+	DebugTrace              bool          `json:"debugTrace" env:"DEBUG_TRACE" desc:"Serve the execution traces of /debug/pprof/trace, which slow a busy process down while they run."`
+	SlowQueryThreshold      time.Duration `json:"slowQueryThreshold" env:"SLOW_QUERY_THRESHOLD" default:"200ms" desc:"Duration from which the SQL statements are logged, with their values masked, and counted as slow by GET /admin/slow-queries. 0 disables it."`
+	QueryStatsMaxStatements int           `json:"queryStatsMaxStatements" env:"QUERY_STATS_MAX_STATEMENTS" default:"1000" desc:"Maximum number of normalized statements GET /admin/slow-queries keeps the stats of."`
+	HookSecrets             []string      `json:"hookSecrets" env:"HOOK_SECRETS" secret:"true" desc:"Comma separated provider:secret entries signing the deliveries of POST /hooks/{provider}, e.g. stripe:whsec_... A provider can have several while rotating them, and is disabled without any."`
+	HookTolerance           time.Duration `json:"hookTolerance" env:"HOOK_TOLERANCE" default:"5m" desc:"Maximum age of the timestamped signatures of POST /hooks/{provider}, which keeps the old deliveries from being replayed."`
+	RequireSignedRequests   bool          `json:"requireSignedRequests" env:"REQUIRE_SIGNED_REQUESTS" desc:"Refuse the unsigned requests of every API key, not only of the keys created with requireSignature. The keys created before the signing secrets can't sign and are refused."`
+	AlertChannels           []string      `json:"alertChannels" env:"ALERT_CHANNELS" secret:"true" desc:"Comma separated name:kind:url incoming webhooks the operator alerts are posted to, kind being slack or discord, e.g. ops:slack:https://hooks.slack.com/services/... The alerts are disabled without any."`
+	AlertRoutes             []string      `json:"alertRoutes" env:"ALERT_ROUTES" desc:"Comma separated type:channel entries routing the alerts of a type, or of every type with *, to a channel of ALERT_CHANNELS, e.g. *:ops,error_rate.spike:oncall. Every type goes to every channel when empty. The types are app.started, app.stopped, migration.applied, error_rate.spike, backup.completed, backup.failed and webhook.delivery_failed."`
+	AlertThrottle           time.Duration `json:"alertThrottle" env:"ALERT_THROTTLE" default:"10m" desc:"Minimum time between two alerts of the same type, and of the same webhook for the delivery failures. The alerts in between are only counted in the next one. 0 disables the throttling."`
+	AlertErrorRatePercent   int           `json:"alertErrorRatePercent" env:"ALERT_ERROR_RATE_PERCENT" default:"10" desc:"Percentage of the requests of the custom routes answered with a 5xx within ALERT_ERROR_RATE_WINDOW from which an error_rate.spike alert is sent. 0 disables it."`
+	AlertErrorRateWindow    time.Duration `json:"alertErrorRateWindow" env:"ALERT_ERROR_RATE_WINDOW" default:"5m" desc:"Window the error rate of ALERT_ERROR_RATE_PERCENT is measured over."`
+	AlertErrorRateRequests  int           `json:"alertErrorRateRequests" env:"ALERT_ERROR_RATE_REQUESTS" default:"50" desc:"Minimum requests within ALERT_ERROR_RATE_WINDOW for its error rate to be alerted on, a handful of failures of a quiet app being no spike."`
+	SignedRequestMaxSkew    time.Duration `json:"signedRequestMaxSkew" env:"SIGNED_REQUEST_MAX_SKEW" default:"5m" desc:"Maximum difference between the X-Signature-Timestamp of a signed API key request and the server clock. The nonces are remembered for twice as long, through CACHE_URL when set, to refuse the replayed requests."`
+	StripeSecretKey         string        `json:"stripeSecretKey" env:"STRIPE_SECRET_KEY" secret:"true" desc:"Secret key POST /billing/checkout creates the Stripe checkout sessions with. Billing is disabled when empty. The subscriptions follow the stripe events of POST /hooks/{provider}, which needs a stripe entry in HOOK_SECRETS."`
+	StripePriceIds          []string      `json:"stripePriceIds" env:"STRIPE_PRICE_IDS" desc:"Comma separated ids of the Stripe prices the users can subscribe to, the first one by default."`
+	BillingSuccessURL       string        `json:"billingSuccessURL" env:"BILLING_SUCCESS_URL" desc:"URL Stripe redirects to after a checkout, the app URL with ?checkout=success when empty."`
+	BillingCancelURL        string        `json:"billingCancelURL" env:"BILLING_CANCEL_URL" desc:"URL Stripe redirects to when a checkout is canceled, the app URL with ?checkout=canceled when empty."`
+	PremiumRoutes           []string      `json:"premiumRoutes" env:"PREMIUM_ROUTES" desc:"Comma separated METHOD /pattern of the custom routes requiring an active subscription, answered with 402 otherwise."`
+	ModerationRejectList    string        `json:"moderationRejectList" env:"MODERATION_REJECT_LIST" desc:"Path of a file of words or phrases, one per line, rejecting the names of the users and the titles and bodies of the posts containing them with 422 CONTENT_REJECTED."`
+	ModerationFlagList      string        `json:"moderationFlagList" env:"MODERATION_FLAG_LIST" desc:"Path of a file of words or phrases, one per line, letting the values containing them through but queuing them for review in GET /admin/moderation."`
+	ModerationAPIURL        string        `json:"moderationAPIURL" env:"MODERATION_API_URL" desc:"URL of an OpenAI-compatible moderation endpoint, e.g. https://api.openai.com/v1/moderations, screening the values the word lists let through. Empty disables it."`
+	ModerationAPIKey        string        `json:"moderationAPIKey" env:"MODERATION_API_KEY" secret:"true" desc:"Bearer token of MODERATION_API_URL."`
+	ModerationAPIAction     string        `json:"moderationAPIAction" env:"MODERATION_API_ACTION" default:"flag" desc:"What the values flagged by MODERATION_API_URL do: reject refuses them, flag queues them for review."`
+	ModerationTimeout       time.Duration `json:"moderationTimeout" env:"MODERATION_TIMEOUT" default:"5s" desc:"Timeout of the calls to MODERATION_API_URL, after which the values are only screened by the word lists."`
+	GeoIPDatabase           string        `json:"geoipDatabase" env:"GEOIP_DATABASE" desc:"Path of a CSV file, gzipped when ending with .gz, of start,end,country[,region] IP ranges, e.g. an IP2Location LITE database, resolving the country and the region the users sign up from. Empty disables it."`
+	PasswordMinLength       int           `json:"passwordMinLength" env:"PASSWORD_MIN_LENGTH" default:"8" desc:"Minimum length of the passwords set through POST /auth/register and POST /users/{userId}/set-password, at least 8."`
+	PasswordRequiredClasses []string      `json:"passwordRequiredClasses" env:"PASSWORD_REQUIRED_CLASSES" desc:"Comma separated character classes the passwords must contain, among lower, upper, digit and symbol."`
+	PasswordBreachCache     string        `json:"passwordBreachCache" env:"PASSWORD_BREACH_CACHE" desc:"Directory of Have I Been Pwned <PREFIX>.txt range files of SUFFIX:COUNT lines, refusing the passwords found in them. Empty disables the breached password check."`
+	PasswordBreachAPIURL    string        `json:"passwordBreachAPIURL" env:"PASSWORD_BREACH_API_URL" desc:"Range API the missing and the stale ranges of PASSWORD_BREACH_CACHE are fetched from, e.g. https://api.pwnedpasswords.com/range/. Only the first 5 characters of the SHA-1 of the passwords are sent. Empty only reads the cache."`
+	PasswordBreachCacheTTL  time.Duration `json:"passwordBreachCacheTTL" env:"PASSWORD_BREACH_CACHE_TTL" default:"720h" desc:"Age after which the ranges of PASSWORD_BREACH_CACHE are fetched again from PASSWORD_BREACH_API_URL, 0 for never."`
+	SCIMToken               string        `json:"scimToken" env:"SCIM_TOKEN" secret:"true" desc:"Bearer token the identity providers provision the users through /scim/v2/Users with. SCIM is disabled when empty."`
+	PIIPatterns             []string      `json:"piiPatterns" env:"PII_PATTERNS" desc:"Comma separated regular expressions, without commas, of the personal data masked, besides the emails and the tokens, in the logs and the failure messages."`
+	OTLPEndpoint            string        `json:"otlpEndpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" desc:"Base URL of the OTLP/HTTP collector traces are exported to. Tracing is disabled when empty."`
+	OTelServiceName         string        `json:"otelServiceName" env:"OTEL_SERVICE_NAME" default:"pocketbase-demo" desc:"service.name reported with the exported traces."`
+	GRPCAddr                string        `json:"grpcAddr" env:"GRPC_ADDR" desc:"Address the gRPC UserService of proto/users/v1 listens on, e.g. :9090, next to the HTTP server. Empty disables it."`
+	GRPCTLSCert             string        `json:"grpcTLSCert" env:"GRPC_TLS_CERT" desc:"Path of the PEM certificate the gRPC server is served over TLS with, along with GRPC_TLS_KEY. Plaintext when empty."`
+	GRPCTLSKey              string        `json:"grpcTLSKey" env:"GRPC_TLS_KEY" desc:"Path of the PEM private key of GRPC_TLS_CERT."`
+}
+
+type ConfigEntry struct {
+	Name        string `json:"name"`
+	Env         string `json:"env"`
+	Value       any    `json:"value"`
+	Description string `json:"description"`
+}
+
+// DefaultConfigFile is read when present, unless --config names another
+// file, which must then exist.
+const DefaultConfigFile = "config.yaml"
+
+func configFieldName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// LoadConfig registers the config flags on cmd, parses them eagerly as
+// PocketBase does with its own flags and loads the config.
+func LoadConfig(cmd *cobra.Command) (*Config, error) {
+	flags := cmd.PersistentFlags()
+	configFile := flags.String("config", DefaultConfigFile, "the config file of the custom API")
+	flagNames := map[string]string{}
+	flagValues := map[string]*string{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		env, name := field.Tag.Get("env"), configFieldName(field)
+		flagNames[env] = name
+		flagValues[env] = flags.String(name, field.Tag.Get("default"), field.Tag.Get("desc")+" ("+env+")")
+	}
+	// errors are ignored, since the full flags parsing happens on Execute()
+	cmd.ParseFlags(os.Args[1:])
+
+	fileValues := map[string]string{}
+	data, err := os.ReadFile(*configFile)
+	if err == nil {
+		if fileValues, err = ParseConfigFile(data); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", *configFile, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) || flags.Changed("config") {
+		return nil, err
+	}
+
+	return LoadConfigFrom(func(key string) (string, bool) {
+		if flags.Changed(flagNames[key]) {
+			return *flagValues[key], true
+		}
+		if raw, ok := os.LookupEnv(key); ok {
+			return raw, true
+		}
+		raw, ok := fileValues[key]
+		return raw, ok
+	})
+}
+
+// ParseConfigFile reads the flat YAML config file, e.g.
+//
+//	maxPerPage: 200
+//	publicDir: "./public"
+//	allowedOrigins: [https://a.example, https://b.example]
+//
+// and returns the values keyed by env variable, the lists joined with
+// commas. Nested mappings aren't supported.
+func ParseConfigFile(data []byte) (map[string]string, error) {
+	envs := map[string]string{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		envs[configFieldName(t.Field(i))] = t.Field(i).Tag.Get("env")
+	}
+
+	values := map[string]string{}
+	list := ""
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(stripYAMLComment(line), " \t\r")
+		if strings.TrimSpace(line) == "" || line == "---" {
+			continue
+		}
+		if item, ok := strings.CutPrefix(strings.TrimSpace(line), "- "); ok && list != "" {
+			if values[list] != "" {
+				values[list] += ","
+			}
+			values[list] += unquoteYAML(strings.TrimSpace(item))
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: nested values are not supported", n+1)
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", n+1)
+		}
+		env, ok := envs[strings.TrimSpace(key)]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown key %q", n+1, strings.TrimSpace(key))
+		}
+		value = strings.TrimSpace(value)
+		list = ""
+		if value == "" {
+			// a block list may follow
+			list = env
+		} else if inner, ok := strings.CutPrefix(value, "["); ok && strings.HasSuffix(inner, "]") {
+			items := []string{}
+			for _, item := range strings.Split(strings.TrimSuffix(inner, "]"), ",") {
+				if item = unquoteYAML(strings.TrimSpace(item)); item != "" {
+					items = append(items, item)
+				}
+			}
+			value = strings.Join(items, ",")
+		} else {
+			value = unquoteYAML(value)
+		}
+		values[env] = value
+	}
+	return values, nil
+}
+
+// stripYAMLComment drops a # comment outside of quotes.
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteYAML(value string) string {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			return unquoted
+		}
+	}
+	return value
+}
+
+// LoadConfigFrom loads the config using lookup to read the variables.
+func LoadConfigFrom(lookup func(key string) (string, bool)) (*Config, error) {
+	cfg := &Config{}
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		raw, ok := lookup(field.Tag.Get("env"))
+		if !ok {
+			raw = field.Tag.Get("default")
+		}
+		if err := setConfigField(v.Field(i), raw); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", field.Tag.Get("env"), err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func setConfigField(f reflect.Value, raw string) error {
+	switch f.Interface().(type) {
+	case string:
+		f.SetString(raw)
+	case bool:
+		if raw == "" {
+			return nil
+		}
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case int:
+		if raw == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case time.Duration:
+		if raw == "" {
+			return nil
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	case []string:
+		values := []string{}
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+		f.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported config field type %s", f.Type())
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	errs := []error{}
+	if c.DefaultPerPage < 1 {
+		errs = append(errs, errors.New("DEFAULT_PER_PAGE must be at least 1"))
+	}
+	if c.MaxPerPage < c.DefaultPerPage {
+		errs = append(errs, errors.New("MAX_PER_PAGE must not be lower than DEFAULT_PER_PAGE"))
+	}
+	if c.MaxLookupIds < 1 {
+		errs = append(errs, errors.New("MAX_LOOKUP_IDS must be at least 1"))
+	}
+	if c.BatchMaxOperations < 1 {
+		errs = append(errs, errors.New("BATCH_MAX_OPERATIONS must be at least 1"))
+	}
+	if c.WriteRetryAttempts < 1 {
+		errs = append(errs, errors.New("WRITE_RETRY_ATTEMPTS must be at least 1"))
+	}
+	if c.LastSeenInterval < 0 {
+		errs = append(errs, errors.New("LAST_SEEN_INTERVAL must not be negative"))
+	}
+	if c.LastSeenCacheSize < 1 {
+		errs = append(errs, errors.New("LAST_SEEN_CACHE_SIZE must be at least 1"))
+	}
+	if c.ActivityFlushInterval <= 0 {
+		errs = append(errs, errors.New("ACTIVITY_FLUSH_INTERVAL must be positive"))
+	}
+	if c.UsageFlushInterval <= 0 {
+		errs = append(errs, errors.New("USAGE_FLUSH_INTERVAL must be positive"))
+	}
+	if c.UsageMonthlyQuota < 0 {
+		errs = append(errs, errors.New("USAGE_MONTHLY_QUOTA must not be negative"))
+	}
+	if c.ActivityBatchSize < 1 {
+		errs = append(errs, errors.New("ACTIVITY_BATCH_SIZE must be at least 1"))
+	}
+	if c.ActivityHistorySize < 1 {
+		errs = append(errs, errors.New("ACTIVITY_HISTORY_SIZE must be at least 1"))
+	}
+	switch c.StorageBackend {
+	case "", StorageBackendLocal:
+	case StorageBackendS3:
+		if c.StorageS3Bucket == "" || c.StorageS3Region == "" || c.StorageS3Endpoint == "" || c.StorageS3AccessKey == "" || c.StorageS3Secret == "" {
+			errs = append(errs, errors.New("STORAGE_S3_BUCKET, STORAGE_S3_REGION, STORAGE_S3_ENDPOINT, STORAGE_S3_ACCESS_KEY and STORAGE_S3_SECRET are required by the s3 storage backend"))
+		}
+	default:
+		errs = append(errs, errors.New("STORAGE_BACKEND must be local or s3"))
+	}
+	if c.ImpersonationTTL <= 0 {
+		errs = append(errs, errors.New("IMPERSONATION_TTL must be positive"))
+	}
+	if c.DownloadURLTTL <= 0 {
+		errs = append(errs, errors.New("DOWNLOAD_URL_TTL must be positive"))
+	}
+	if c.ShareLinkDefaultTTL <= 0 {
+		errs = append(errs, errors.New("SHARE_LINK_DEFAULT_TTL must be positive"))
+	}
+	if c.ShareLinkMaxTTL <= 0 {
+		errs = append(errs, errors.New("SHARE_LINK_MAX_TTL must be positive"))
+	}
+	if c.SitemapChunkSize < 1 || c.SitemapChunkSize > SitemapMaxURLs {
+		errs = append(errs, fmt.Errorf("SITEMAP_CHUNK_SIZE must be between 1 and %d", SitemapMaxURLs))
+	}
+	if _, err := cron.NewSchedule(c.SitemapSchedule); err != nil {
+		errs = append(errs, fmt.Errorf("SITEMAP_SCHEDULE: %w", err))
+	}
+	for _, path := range c.RobotsDisallow {
+		if !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("ROBOTS_DISALLOW: path %q must start with /", path))
+		}
+	}
+	if c.EmailChangeTTL <= 0 {
+		errs = append(errs, errors.New("EMAIL_CHANGE_TTL must be positive"))
+	}
+	if c.VerificationTTL <= 0 {
+		errs = append(errs, errors.New("VERIFICATION_TTL must be positive"))
+	}
+	if c.TeamInviteTTL <= 0 {
+		errs = append(errs, errors.New("TEAM_INVITE_TTL must be positive"))
+	}
+	if c.InvitationTTL <= 0 {
+		errs = append(errs, errors.New("INVITATION_TTL must be positive"))
+	}
+	if c.TwoFactorSessionTTL <= 0 {
+		errs = append(errs, errors.New("TWO_FACTOR_SESSION_TTL must be positive"))
+	}
+	if c.UserUpdatesPerHour < 1 {
+		errs = append(errs, errors.New("USER_UPDATES_PER_HOUR must be at least 1"))
+	}
+	if c.RateLimitIPPerMinute < 0 {
+		errs = append(errs, errors.New("RATE_LIMIT_IP_PER_MINUTE can't be negative"))
+	}
+	if c.RateLimitIPPerMinute > 0 && c.RateLimitIPBurst < 1 {
+		errs = append(errs, errors.New("RATE_LIMIT_IP_BURST must be at least 1"))
+	}
+	if c.RateLimitAuthPerMinute < 0 {
+		errs = append(errs, errors.New("RATE_LIMIT_AUTH_PER_MINUTE can't be negative"))
+	}
+	if c.RateLimitAuthPerMinute > 0 && c.RateLimitAuthBurst < 1 {
+		errs = append(errs, errors.New("RATE_LIMIT_AUTH_BURST must be at least 1"))
+	}
+	if c.SyncTombstoneTTL <= 0 {
+		errs = append(errs, errors.New("SYNC_TOMBSTONE_TTL must be positive"))
+	}
+	if c.IdempotencyKeyTTL <= 0 {
+		errs = append(errs, errors.New("IDEMPOTENCY_KEY_TTL must be positive"))
+	}
+	if c.ResponseCacheTTL < 0 {
+		errs = append(errs, errors.New("RESPONSE_CACHE_TTL can't be negative"))
+	}
+	if c.ResponseCacheTTL > 0 && c.ResponseCacheSize < 1 {
+		errs = append(errs, errors.New("RESPONSE_CACHE_SIZE must be at least 1"))
+	}
+	if c.CompressionMinSize < -1 {
+		errs = append(errs, errors.New("COMPRESSION_MIN_SIZE must be at least -1"))
+	}
+	if c.MaxBodySize < 1 {
+		errs = append(errs, errors.New("MAX_BODY_SIZE must be at least 1"))
+	}
+	if c.MaxUploadSize < 1 {
+		errs = append(errs, errors.New("MAX_UPLOAD_SIZE must be at least 1"))
+	}
+	if c.SlowQueryThreshold < 0 {
+		errs = append(errs, errors.New("SLOW_QUERY_THRESHOLD can't be negative"))
+	}
+	if c.QueryStatsMaxStatements < 1 {
+		errs = append(errs, errors.New("QUERY_STATS_MAX_STATEMENTS must be at least 1"))
+	}
+	if c.StaticDeployKeep < 1 {
+		errs = append(errs, errors.New("STATIC_DEPLOY_KEEP must be at least 1"))
+	}
+	if c.StaticDeployMaxSize < 1 {
+		errs = append(errs, errors.New("STATIC_DEPLOY_MAX_SIZE must be at least 1"))
+	}
+	if c.MaxJSONDepth < 1 {
+		errs = append(errs, errors.New("MAX_JSON_DEPTH must be at least 1"))
+	}
+	if c.MaxJSONArrayLength < 1 {
+		errs = append(errs, errors.New("MAX_JSON_ARRAY_LENGTH must be at least 1"))
+	}
+	if c.ErasureAuditRetention < 0 {
+		errs = append(errs, errors.New("ERASURE_AUDIT_RETENTION must not be negative"))
+	}
+	for _, s := range c.IdStrategies {
+		if _, _, err := ParseIdStrategy(s); err != nil {
+			errs = append(errs, fmt.Errorf("ID_STRATEGIES: %w", err))
+		}
+	}
+	if c.SnowflakeNode < 0 || c.SnowflakeNode > 1023 {
+		errs = append(errs, errors.New("SNOWFLAKE_NODE must be from 0 to 1023"))
+	}
+	for _, owned := range c.MergeOwnedTables {
+		if _, err := ParseOwnedTable(owned); err != nil {
+			errs = append(errs, fmt.Errorf("MERGE_OWNED_TABLES: %w", err))
+		}
+	}
+	if c.RequestTimeout < 0 {
+		errs = append(errs, errors.New("REQUEST_TIMEOUT must not be negative"))
+	}
+	for _, s := range c.RouteTimeouts {
+		if _, _, err := ParseRouteTimeout(s); err != nil {
+			errs = append(errs, fmt.Errorf("ROUTE_TIMEOUTS: %w", err))
+		}
+	}
+	for _, owned := range c.TakeoutCollections {
+		if _, err := ParseOwnedTable(owned); err != nil {
+			errs = append(errs, fmt.Errorf("TAKEOUT_COLLECTIONS: %w", err))
+		}
+	}
+	if c.TakeoutURLTTL <= 0 {
+		errs = append(errs, errors.New("TAKEOUT_URL_TTL must be positive"))
+	}
+	if len(c.FieldEncryptionKeys) > 0 {
+		if _, err := NewFieldCipher(c.FieldEncryptionKeys); err != nil {
+			errs = append(errs, fmt.Errorf("FIELD_ENCRYPTION_KEYS: %w", err))
+		}
+	}
+	if _, err := ParseHookSecrets(c.HookSecrets); err != nil {
+		errs = append(errs, fmt.Errorf("HOOK_SECRETS: %w", err))
+	}
+	if c.HookTolerance <= 0 {
+		errs = append(errs, errors.New("HOOK_TOLERANCE must be positive"))
+	}
+	if channels, err := ParseAlertChannels(c.AlertChannels); err != nil {
+		errs = append(errs, fmt.Errorf("ALERT_CHANNELS: %w", err))
+	} else if _, err := ParseAlertRoutes(c.AlertRoutes, channels); err != nil {
+		errs = append(errs, fmt.Errorf("ALERT_ROUTES: %w", err))
+	}
+	if c.AlertThrottle < 0 {
+		errs = append(errs, errors.New("ALERT_THROTTLE can't be negative"))
+	}
+	if c.AlertErrorRatePercent < 0 || c.AlertErrorRatePercent > 100 {
+		errs = append(errs, errors.New("ALERT_ERROR_RATE_PERCENT must be between 0 and 100"))
+	}
+	if c.AlertErrorRateWindow <= 0 {
+		errs = append(errs, errors.New("ALERT_ERROR_RATE_WINDOW must be positive"))
+	}
+	if c.AlertErrorRateRequests < 1 {
+		errs = append(errs, errors.New("ALERT_ERROR_RATE_REQUESTS must be at least 1"))
+	}
+	if c.SignedRequestMaxSkew <= 0 {
+		errs = append(errs, errors.New("SIGNED_REQUEST_MAX_SKEW must be positive"))
+	}
+	if c.StripeSecretKey != "" && len(c.StripePriceIds) == 0 {
+		errs = append(errs, errors.New("STRIPE_PRICE_IDS is required by STRIPE_SECRET_KEY"))
+	}
+	for _, route := range c.PremiumRoutes {
+		if !strings.Contains(route, " /") {
+			errs = append(errs, fmt.Errorf("PREMIUM_ROUTES: invalid route %q, expected METHOD /pattern", route))
+		}
+	}
+	if _, err := CompilePIIPatterns(c.PIIPatterns); err != nil {
+		errs = append(errs, fmt.Errorf("PII_PATTERNS: %w", err))
+	}
+	if !strings.HasPrefix(c.SPABase, "/") {
+		errs = append(errs, errors.New("SPA_BASE must start with /"))
+	}
+	if c.ImportBatchSize < 1 {
+		errs = append(errs, errors.New("IMPORT_BATCH_SIZE must be at least 1"))
+	}
+	if c.LegacySyncDSN != "" {
+		mapping, err := ParseLegacyFieldMapping(c.LegacySyncFields)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("LEGACY_SYNC_FIELDS: %w", err))
+		}
+		if !legacyIdentifierRegex.MatchString(c.LegacySyncTable) {
+			errs = append(errs, fmt.Errorf("LEGACY_SYNC_TABLE: invalid table %q", c.LegacySyncTable))
+		}
+		if _, err := cron.NewSchedule(c.LegacySyncSchedule); err != nil {
+			errs = append(errs, fmt.Errorf("LEGACY_SYNC_SCHEDULE: %w", err))
+		}
+		switch c.LegacySyncConflict {
+		case LegacyConflictLegacy, LegacyConflictLocal:
+		case LegacyConflictNewest:
+			if _, ok := mapping[LegacyFieldUpdated]; err == nil && !ok {
+				errs = append(errs, errors.New("LEGACY_SYNC_CONFLICT newest requires an updated field in LEGACY_SYNC_FIELDS"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("LEGACY_SYNC_CONFLICT must be %s, %s or %s", LegacyConflictLegacy, LegacyConflictLocal, LegacyConflictNewest))
+		}
+		if c.LegacySyncBatchSize < 1 {
+			errs = append(errs, errors.New("LEGACY_SYNC_BATCH_SIZE must be at least 1"))
+		}
+	}
+	if c.AvatarMaxSize < 1 {
+		errs = append(errs, errors.New("AVATAR_MAX_SIZE must be at least 1"))
+	}
+	if c.BulkDeleteTokenTTL <= 0 {
+		errs = append(errs, errors.New("BULK_DELETE_TOKEN_TTL must be positive"))
+	}
+	if c.ReadReplicaConns < 0 {
+		errs = append(errs, errors.New("READ_REPLICA_CONNS can't be negative"))
+	}
+	if c.DuplicateScanMax < 1 {
+		errs = append(errs, errors.New("DUPLICATE_SCAN_MAX must be at least 1"))
+	}
+	if c.BulkDeleteMax < 1 {
+		errs = append(errs, errors.New("BULK_DELETE_MAX must be at least 1"))
+	}
+	if c.ContractMode != "" && c.ContractMode != ContractModeRecord && c.ContractMode != ContractModeVerify {
+		errs = append(errs, fmt.Errorf("CONTRACT_MODE must be %s or %s", ContractModeRecord, ContractModeVerify))
+	}
+	if c.AvatarCacheMaxAge < 0 {
+		errs = append(errs, errors.New("AVATAR_CACHE_MAX_AGE can't be negative"))
+	}
+	if c.WebhookMaxAttempts < 1 {
+		errs = append(errs, errors.New("WEBHOOK_MAX_ATTEMPTS must be at least 1"))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("SHUTDOWN_TIMEOUT can't be negative"))
+	}
+	if c.WebhookBaseDelay <= 0 {
+		errs = append(errs, errors.New("WEBHOOK_BASE_DELAY must be positive"))
+	}
+	if c.WebhookTimeout <= 0 {
+		errs = append(errs, errors.New("WEBHOOK_TIMEOUT must be positive"))
+	}
+	if c.BreakerFailureThreshold < 1 {
+		errs = append(errs, errors.New("BREAKER_FAILURE_THRESHOLD must be at least 1"))
+	}
+	if c.BreakerOpenTimeout <= 0 {
+		errs = append(errs, errors.New("BREAKER_OPEN_TIMEOUT must be positive"))
+	}
+	if c.BulkheadMaxConcurrent < 1 {
+		errs = append(errs, errors.New("BULKHEAD_MAX_CONCURRENT must be at least 1"))
+	}
+	if (c.GRPCTLSCert == "") != (c.GRPCTLSKey == "") {
+		errs = append(errs, errors.New("GRPC_TLS_CERT and GRPC_TLS_KEY must be set together"))
+	}
+	if c.RetentionMaxPerRun < 1 {
+		errs = append(errs, errors.New("RETENTION_MAX_PER_RUN must be at least 1"))
+	}
+	if c.RetentionReportTTL <= 0 {
+		errs = append(errs, errors.New("RETENTION_REPORT_TTL must be positive"))
+	}
+	if c.OutboxPollInterval <= 0 {
+		errs = append(errs, errors.New("OUTBOX_POLL_INTERVAL must be positive"))
+	}
+	if c.OutboxBatchSize < 1 {
+		errs = append(errs, errors.New("OUTBOX_BATCH_SIZE must be at least 1"))
+	}
+	if c.OutboxBaseDelay <= 0 {
+		errs = append(errs, errors.New("OUTBOX_BASE_DELAY must be positive"))
+	}
+	if c.OutboxMaxDelay < c.OutboxBaseDelay {
+		errs = append(errs, errors.New("OUTBOX_MAX_DELAY can't be shorter than OUTBOX_BASE_DELAY"))
+	}
+	if c.OutboxRetention <= 0 {
+		errs = append(errs, errors.New("OUTBOX_RETENTION must be positive"))
+	}
+	if c.DemoSeedUsers < 0 {
+		errs = append(errs, errors.New("DEMO_SEED_USERS must not be negative"))
+	}
+	if !slices.Contains(SchemaDriftActions, c.SchemaDriftAction) {
+		errs = append(errs, fmt.Errorf("SCHEMA_DRIFT_ACTION: expected one of %s", strings.Join(SchemaDriftActions, ", ")))
+	}
+	if c.CacheURL != "" {
+		if _, err := cache.Open(c.CacheURL); err != nil {
+			errs = append(errs, fmt.Errorf("CACHE_URL: %w", err))
+		}
+	}
+	if c.CacheTimeout <= 0 {
+		errs = append(errs, errors.New("CACHE_TIMEOUT must be positive"))
+	}
+	if c.EventBusURL != "" {
+		if _, err := events.NewPublisher(c.EventBusURL); err != nil {
+			errs = append(errs, fmt.Errorf("EVENT_BUS_URL: %w", err))
+		}
+		if c.EventBusPrefix == "" || strings.ContainsAny(c.EventBusPrefix, " \t\r\n*>") {
+			errs = append(errs, errors.New("EVENT_BUS_PREFIX must be a non empty subject without spaces or wildcards"))
+		}
+	}
+	if c.EventBusTimeout <= 0 {
+		errs = append(errs, errors.New("EVENT_BUS_TIMEOUT must be positive"))
+	}
+	if c.ModerationAPIURL != "" {
+		if u, err := url.Parse(c.ModerationAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("MODERATION_API_URL must be an http or https URL"))
+		}
+	}
+	if c.ModerationAPIAction != ModerationReject && c.ModerationAPIAction != ModerationFlag {
+		errs = append(errs, fmt.Errorf("MODERATION_API_ACTION must be %s or %s", ModerationReject, ModerationFlag))
+	}
+	if c.ModerationTimeout <= 0 {
+		errs = append(errs, errors.New("MODERATION_TIMEOUT must be positive"))
+	}
+	if c.AuthLockoutThreshold < 0 {
+		errs = append(errs, errors.New("AUTH_LOCKOUT_THRESHOLD must not be negative"))
+	}
+	if c.AuthLockoutBase <= 0 {
+		errs = append(errs, errors.New("AUTH_LOCKOUT_BASE must be positive"))
+	}
+	if c.AuthLockoutMax < c.AuthLockoutBase {
+		errs = append(errs, errors.New("AUTH_LOCKOUT_MAX must not be lower than AUTH_LOCKOUT_BASE"))
+	}
+	if c.AuthFailureWindow <= 0 {
+		errs = append(errs, errors.New("AUTH_FAILURE_WINDOW must be positive"))
+	}
+	if c.AuthCaptchaThreshold < 0 {
+		errs = append(errs, errors.New("AUTH_CAPTCHA_THRESHOLD must not be negative"))
+	}
+	if c.SignupMinSubmitTime < 0 {
+		errs = append(errs, errors.New("SIGNUP_MIN_SUBMIT_TIME must not be negative"))
+	}
+	if c.SignupMinSubmitTime >= c.SignupFormTokenTTL {
+		errs = append(errs, errors.New("SIGNUP_FORM_TOKEN_TTL must be longer than SIGNUP_MIN_SUBMIT_TIME"))
+	}
+	if c.SignupCaptcha && c.CaptchaVerifyURL == "" {
+		errs = append(errs, errors.New("SIGNUP_CAPTCHA requires CAPTCHA_VERIFY_URL"))
+	}
+	if c.CaptchaVerifyURL != "" {
+		if u, err := url.Parse(c.CaptchaVerifyURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("CAPTCHA_VERIFY_URL must be an http or https URL"))
+		}
+		if c.CaptchaSecret == "" {
+			errs = append(errs, errors.New("CAPTCHA_VERIFY_URL requires CAPTCHA_SECRET"))
+		}
+	}
+	if c.PasswordMinLength < UserPasswordMinLength || c.PasswordMinLength > UserPasswordMaxLength {
+		errs = append(errs, fmt.Errorf("PASSWORD_MIN_LENGTH must be between %d and %d", UserPasswordMinLength, UserPasswordMaxLength))
+	}
+	for _, class := range c.PasswordRequiredClasses {
+		if _, ok := passwordClasses[class]; !ok {
+			errs = append(errs, fmt.Errorf("PASSWORD_REQUIRED_CLASSES: unknown class %q, expected lower, upper, digit or symbol", class))
+		}
+	}
+	if c.PasswordBreachAPIURL != "" {
+		if c.PasswordBreachCache == "" {
+			errs = append(errs, errors.New("PASSWORD_BREACH_API_URL requires PASSWORD_BREACH_CACHE"))
+		}
+		if u, err := url.Parse(c.PasswordBreachAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("PASSWORD_BREACH_API_URL must be an http or https URL"))
+		}
+	}
+	if c.PasswordBreachCacheTTL < 0 {
+		errs = append(errs, errors.New("PASSWORD_BREACH_CACHE_TTL must not be negative"))
+	}
+	if c.JobWorkers < 1 {
+		errs = append(errs, errors.New("JOB_WORKERS must be at least 1"))
+	}
+	if c.JobPollInterval <= 0 {
+		errs = append(errs, errors.New("JOB_POLL_INTERVAL must be positive"))
+	}
+	if c.JobMaxAttempts < 1 {
+		errs = append(errs, errors.New("JOB_MAX_ATTEMPTS must be at least 1"))
+	}
+	if c.JobBaseDelay <= 0 {
+		errs = append(errs, errors.New("JOB_BASE_DELAY must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// Entries describes every config field, with the secret values redacted.
+func (c *Config) Entries() []ConfigEntry {
+	entries := []ConfigEntry{}
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		var value any = v.Field(i).Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if field.Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+			value = "[redacted]"
+		}
+		entries = append(entries, ConfigEntry{
+			Name:        configFieldName(field),
+			Env:         field.Tag.Get("env"),
+			Value:       value,
+			Description: field.Tag.Get("desc"),
+		})
+	}
+	return entries
+}
+
+func HandleGetConfig(cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		return WriteOK(e, "", cfg.Entries())
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const (
+	ContractModeRecord = "record"
+	ContractModeVerify = "verify"
+)
+
+// ContractMaxBody caps the bytes of the bodies a contract is taken from,
+// the larger ones are left out of it.
+const ContractMaxBody = 1 << 20
+
+var contractFileUnsafe = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// Contract is the golden file of a route answering with a status: the shape
+// of its request and response bodies, i.e. their JSON keys and value types,
+// which the values are free to change within.
+type Contract struct {
+	Route    string        `json:"route"`
+	Status   int           `json:"status"`
+	Request  ContractShape `json:"request"`
+	Response ContractShape `json:"response"`
+}
+
+type ContractShape struct {
+	ContentType string   `json:"contentType,omitempty"`
+	Query       []string `json:"query,omitempty"`
+	Body        any      `json:"body,omitempty"`
+}
+
+// ContractDrift is a line of the drift.ndjson report of verify mode.
+type ContractDrift struct {
+	Route       string   `json:"route"`
+	Status      int      `json:"status"`
+	Path        string   `json:"path"`
+	Differences []string `json:"differences"`
+	RequestId   string   `json:"requestId"`
+	Time        string   `json:"time"`
+}
+
+// JSONShape replaces the values of v, decoded JSON, with their type names,
+// keeping the keys of the objects and the shape of the first element of the
+// arrays.
+func JSONShape(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		shape := make(map[string]any, len(v))
+		for key, value := range v {
+			shape[key] = JSONShape(value)
+		}
+		return shape
+	case []any:
+		if len(v) == 0 {
+			return []any{}
+		}
+		return []any{JSONShape(v[0])}
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+// CompareShapes lists where got differs from want, a null or an empty array
+// matching any value since they tell nothing of its type.
+func CompareShapes(path string, want any, got any) []string {
+	if want == "null" || got == "null" {
+		return nil
+	}
+	switch want := want.(type) {
+	case map[string]any:
+		gotMap, ok := got.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: object became %s", path, shapeName(got))}
+		}
+		var diffs []string
+		for key, value := range want {
+			if _, ok := gotMap[key]; !ok {
+				diffs = append(diffs, fmt.Sprintf("%s.%s: removed", path, key))
+				continue
+			}
+			diffs = append(diffs, CompareShapes(path+"."+key, value, gotMap[key])...)
+		}
+		for key := range gotMap {
+			if _, ok := want[key]; !ok {
+				diffs = append(diffs, fmt.Sprintf("%s.%s: added", path, key))
+			}
+		}
+		sort.Strings(diffs)
+		return diffs
+	case []any:
+		gotSlice, ok := got.([]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: array became %s", path, shapeName(got))}
+		}
+		if len(want) == 0 || len(gotSlice) == 0 {
+			return nil
+		}
+		return CompareShapes(path+"[]", want[0], gotSlice[0])
+	}
+	if want != got {
+		return []string{fmt.Sprintf("%s: %s became %s", path, shapeName(want), shapeName(got))}
+	}
+	return nil
+}
+
+func shapeName(shape any) string {
+	switch shape.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	}
+	return fmt.Sprint(shape)
+}
+
+// bodyShape returns the shape of a JSON body, nil for the other ones.
+func bodyShape(contentType string, body []byte) any {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != ContentTypeJSON || len(body) == 0 || len(body) > ContractMaxBody {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	return JSONShape(v)
+}
+
+// contractResponse passes the response through while keeping a copy of the
+// start of its body.
+type contractResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *contractResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *contractResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len() <= ContractMaxBody {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *contractResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ContractRecorder records the contracts of the custom routes as golden
+// files of dir, or verifies the responses against them.
+type ContractRecorder struct {
+	mode string
+	dir  string
+	mu   sync.Mutex
+}
+
+func NewContractRecorder(mode string, dir string) *ContractRecorder {
+	return &ContractRecorder{mode: mode, dir: dir}
+}
+
+func (c *ContractRecorder) path(route string, status int) string {
+	name := strings.Trim(contractFileUnsafe.ReplaceAllString(route, "_"), "_")
+	return filepath.Join(c.dir, fmt.Sprintf("%s_%d.json", name, status))
+}
+
+// Middleware records or verifies the contract of every request to the
+// custom routes, by route pattern and status. In verify mode, the drifted
+// responses are logged and reported in drift.ndjson, which the API tests
+// check for once they ran.
+func (c *ContractRecorder) Middleware() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if IsPocketBasePath(e.Request.URL.Path) {
+			return e.Next()
+		}
+
+		var reqBody []byte
+		if e.Request.Body != nil {
+			var err error
+			reqBody, err = io.ReadAll(io.LimitReader(e.Request.Body, ContractMaxBody+1))
+			if err != nil {
+				return err
+			}
+			e.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(reqBody), e.Request.Body))
+		}
+		query := make([]string, 0, len(e.Request.URL.Query()))
+		for key := range e.Request.URL.Query() {
+			query = append(query, key)
+		}
+		sort.Strings(query)
+
+		rw := &contractResponse{ResponseWriter: e.Response}
+		e.Response = rw
+		err := e.Next()
+		e.Response = rw.ResponseWriter
+		if rw.status == 0 || e.Request.Pattern == "" {
+			return err
+		}
+
+		contract := Contract{
+			Route:  e.Request.Pattern,
+			Status: rw.status,
+			Request: ContractShape{
+				ContentType: e.Request.Header.Get("Content-Type"),
+				Query:       query,
+				Body:        bodyShape(e.Request.Header.Get("Content-Type"), reqBody),
+			},
+			Response: ContractShape{
+				ContentType: e.Response.Header().Get("Content-Type"),
+				Body:        bodyShape(e.Response.Header().Get("Content-Type"), rw.body.Bytes()),
+			},
+		}
+		if c.mode == ContractModeRecord {
+			if writeErr := c.record(contract); writeErr != nil {
+				e.App.Logger().Warn("Failed to record contract", "route", contract.Route, "error", writeErr)
+			}
+		} else if diffs := c.verify(contract); len(diffs) > 0 {
+			c.reportDrift(e, contract, diffs)
+		}
+		return err
+	}
+}
+
+func (c *ContractRecorder) record(contract Contract) error {
+	data, err := json.MarshalIndent(contract, "", "\t")
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(c.dir, os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(contract.Route, contract.Status), append(data, '\n'), 0644)
+}
+
+// verify lists the differences between contract and its golden file.
+func (c *ContractRecorder) verify(contract Contract) []string {
+	data, err := os.ReadFile(c.path(contract.Route, contract.Status))
+	if err != nil {
+		return []string{"no contract recorded"}
+	}
+	golden := Contract{}
+	if err := json.Unmarshal(data, &golden); err != nil {
+		return []string{"invalid contract: " + err.Error()}
+	}
+
+	var diffs []string
+	if golden.Response.ContentType != contract.Response.ContentType {
+		diffs = append(diffs, fmt.Sprintf("response content type %q became %q", golden.Response.ContentType, contract.Response.ContentType))
+	}
+	diffs = append(diffs, CompareShapes("request", golden.Request.Body, contract.Request.Body)...)
+	diffs = append(diffs, CompareShapes("response", golden.Response.Body, contract.Response.Body)...)
+	return diffs
+}
+
+func (c *ContractRecorder) reportDrift(e *core.RequestEvent, contract Contract, diffs []string) {
+	e.App.Logger().Warn("Response drifted from its contract", "route", contract.Route, "status", contract.Status, "differences", diffs)
+
+	line, err := json.Marshal(ContractDrift{
+		Route:       contract.Route,
+		Status:      contract.Status,
+		Path:        e.Request.URL.Path,
+		Differences: diffs,
+		RequestId:   RequestId(e),
+		Time:        time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(c.dir, os.ModePerm); err != nil {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(c.dir, "drift.ndjson"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		e.App.Logger().Warn("Failed to report contract drift", "error", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+)
+
+// contractRequests are the requests whose contracts TestContractRecorder
+// records, with the status they get.
+var contractRequests = []struct {
+	method string
+	path   string
+	body   string
+	status int
+}{
+	{http.MethodGet, "/users", "", http.StatusOK},
+	{http.MethodGet, "/users/a?fields=id,name", "", http.StatusOK},
+	{http.MethodGet, "/users/unknown", "", http.StatusNotFound},
+	{http.MethodPost, "/users", `{"email":"a@example.com"}`, http.StatusConflict},
+}
+
+// serveContractRequest sends a request to handler and returns its status.
+func serveContractRequest(t testing.TB, handler http.Handler, method string, path string, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Accept", "application/json")
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// readContractDrift returns the lines of the drift.ndjson report of dir.
+func readContractDrift(t testing.TB, dir string) []ContractDrift {
+	t.Helper()
+	f, err := os.Open(filepath.Join(dir, "drift.ndjson"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	drifts := []ContractDrift{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		drift := ContractDrift{}
+		if err := json.Unmarshal(scanner.Bytes(), &drift); err != nil {
+			t.Fatal(err)
+		}
+		drifts = append(drifts, drift)
+	}
+	return drifts
+}
+
+// TestContractRecorder records the contracts of the /users routes, then
+// verifies the same requests against them, and the drifted ones.
+func TestContractRecorder(t *testing.T) {
+	dir := t.TempDir()
+	service := newFakeUserService(
+		models.User{Id: "a", Email: "a@example.com", Name: "A", Updated: "2024-01-02 03:04:05.000Z"},
+		models.User{Id: "b", Email: "b@example.com", Name: "B", Updated: "2024-01-02 03:04:05.000Z"},
+	)
+
+	recorder := NewContractRecorder(ContractModeRecord, dir)
+	handler := serveUserHandlers(t, service, recorder.Middleware())
+	for _, request := range contractRequests {
+		if status := serveContractRequest(t, handler, request.method, request.path, request.body); status != request.status {
+			t.Fatalf("%s %s: expected status %d, got %d", request.method, request.path, request.status, status)
+		}
+	}
+
+	data, err := os.ReadFile(recorder.path("GET /users/{userId}", http.StatusOK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := Contract{}
+	if err := json.Unmarshal(data, &golden); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(golden.Request.Query, []string{"fields"}) {
+		t.Errorf("expected the fields query, got %v", golden.Request.Query)
+	}
+	expectedBody := map[string]any{
+		"success": "boolean",
+		"data":    map[string]any{"id": "string", "name": "string"},
+	}
+	if !reflect.DeepEqual(golden.Response.Body, expectedBody) {
+		t.Errorf("expected the response shape %v, got %v", expectedBody, golden.Response.Body)
+	}
+	for _, request := range contractRequests {
+		pattern := request.method + " /users"
+		if strings.Count(request.path, "/") > 1 {
+			pattern += "/{userId}"
+		}
+		if _, err := os.Stat(recorder.path(pattern, request.status)); err != nil {
+			t.Errorf("expected the contract of %s %d, got %v", pattern, request.status, err)
+		}
+	}
+
+	// the same requests match their contracts, whatever their values
+	service.users["a"].Name = "Renamed"
+	handler = serveUserHandlers(t, service, NewContractRecorder(ContractModeVerify, dir).Middleware())
+	for _, request := range contractRequests {
+		serveContractRequest(t, handler, request.method, request.path, request.body)
+	}
+	if drifts := readContractDrift(t, dir); len(drifts) != 0 {
+		t.Fatalf("expected no drift, got %+v", drifts)
+	}
+
+	serveContractRequest(t, handler, http.MethodGet, "/users/a?fields=id,name,email", "")
+	serveContractRequest(t, handler, http.MethodDelete, "/users/b", "")
+	drifts := readContractDrift(t, dir)
+	if len(drifts) != 2 {
+		t.Fatalf("expected 2 drifts, got %+v", drifts)
+	}
+	expectedDrifts := []struct {
+		route       string
+		differences []string
+	}{
+		{"GET /users/{userId}", []string{"response.data.email: added"}},
+		{"DELETE /users/{userId}", []string{"no contract recorded"}},
+	}
+	for i, expected := range expectedDrifts {
+		drift := drifts[i]
+		if drift.Route != expected.route || drift.Status != http.StatusOK || !reflect.DeepEqual(drift.Differences, expected.differences) {
+			t.Errorf("expected the drift of %s: %v, got %+v", expected.route, expected.differences, drift)
+		}
+		if drift.RequestId == "" {
+			t.Errorf("missing requestId in %+v", drift)
+		}
+	}
+}
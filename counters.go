@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var ErrCounterOutOfRange = errors.New("the counter would go out of its bounds")
+
+// CounterField is an integer users column changed by increments only, see
+// IncrementUserCounter.
+type CounterField struct {
+	Min int64
+	Max int64
+	// Untouched leaves the updated time of the user as is, for the counters
+	// that aren't changes of the user.
+	Untouched bool
+}
+
+// UserCounters are the counter fields of the users, by column.
+var UserCounters = map[string]CounterField{
+	"loginCount": {Min: 0, Max: math.MaxInt64, Untouched: true},
+	"credits":    {Min: 0, Max: math.MaxInt64},
+}
+
+type IncrementRequest struct {
+	Field string `json:"field" binding:"required"`
+	Delta int64  `json:"delta" binding:"required"`
+}
+
+type IncrementResult struct {
+	Field string `json:"field"`
+	Value int64  `json:"value"`
+}
+
+// IncrementUserCounter adds delta, which may be negative, to the counter
+// field of the user in a single statement, so that concurrent increments
+// can't overwrite each other. It returns the new value, ErrNotFound if there
+// is no such user and ErrCounterOutOfRange if the value would leave the
+// bounds of the field.
+func IncrementUserCounter(app core.App, userId string, field string, delta int64) (int64, error) {
+	counter, ok := UserCounters[field]
+	if !ok {
+		return 0, fmt.Errorf("field %q is not a counter", field)
+	}
+	repo := Users
+	if counter.Untouched {
+		repo = Users.Untouched()
+	}
+	span := StartStorageSpan(app, "IncrementUserCounter", "UPDATE")
+	value, err := repo.Increment(app, userId, field, delta, counter.Min, counter.Max)
+	span.End(err)
+	if errors.Is(err, sql.ErrNoRows) {
+		// tell the missing users from the bounds
+		if _, err := GetUserById(app, userId); err != nil {
+			return 0, err
+		}
+		return 0, ErrCounterOutOfRange
+	}
+	return value, err
+}
+
+// CountLogin increments the loginCount of the user, logging the failures
+// instead of failing the login.
+func CountLogin(app core.App, userId string) {
+	if _, err := IncrementUserCounter(app, userId, "loginCount", 1); err != nil {
+		app.Logger().Warn("Failed to count login", "userId", userId, "error", err)
+	}
+}
+
+// HandleIncrementUserCounter adds the delta of the body to a counter field
+// of the user, answering 409 when it would go out of bounds.
+func HandleIncrementUserCounter(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	fields := make([]string, 0, len(UserCounters))
+	for field := range UserCounters {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		req := IncrementRequest{}
+		if err := BindStrict(e, &req); err != nil {
+			return WriteBindError(e, err)
+		}
+		if _, ok := UserCounters[req.Field]; !ok {
+			return WriteBadRequest(e, fmt.Sprintf("bad request: field must be one of %s", strings.Join(fields, ", ")), nil)
+		}
+
+		value, err := IncrementUserCounter(app, userId, req.Field, req.Delta)
+		if err != nil {
+			return writeUserError(e, err, "error incrementing counter")
+		}
+		SetAuditedUser(e, userId)
+		SetAuditChanges(e, map[string]FieldChange{req.Field: {Old: value - req.Delta, New: value}})
+		return WriteOK(e, "", IncrementResult{Field: req.Field, Value: value})
+	}
+}
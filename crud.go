@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// CRUDOptions configures the routes generated by RegisterCRUD.
+type CRUDOptions struct {
+	App    *pocketbase.PocketBase
+	Config *Config
+	// Path defaults to "/" + the collection name.
+	Path string
+	// Tag groups the routes in the OpenAPI spec, the collection name by
+	// default.
+	Tag string
+	// Fields are the fields returned besides id, every non hidden field
+	// when empty.
+	Fields []string
+	// WritableFields are the only fields POST and PATCH may set.
+	WritableFields []string
+	SortFields     []string
+	FilterFields   map[string]FilterType
+	// OwnerField, when set, names a relation to the users that is set to
+	// the requester on create. Only the owner, a superuser or an API key may
+	// then update or delete the record.
+	OwnerField string
+	// TenantScope, when set, limits the records the requests scoped to a
+	// tenant (see ResolveTenant) see to those of the tenant.
+	TenantScope func(tenantId string) dbx.Expression
+	// Validate is called with the record about to be created or updated,
+	// after the changes of the request body are applied. validation.Errors
+	// are reported with 400.
+	Validate func(e *core.RequestEvent, record *core.Record) error
+	// ModeratedFields are the free-text fields screened by Moderation when
+	// created or changed, see ScreenRequest.
+	ModeratedFields []string
+	// Item, Input and List are zero values of the record, of the create and
+	// update body and of a page of records, documenting the routes in the
+	// OpenAPI spec and the generated clients. Plain objects when nil.
+	Item  any
+	Input any
+	List  any
+	// Read and Write are bound to the read and the write routes. Write
+	// defaults to RequireAuth.
+	Read  []func(e *core.RequestEvent) error
+	Write []func(e *core.RequestEvent) error
+}
+
+// RegisterCRUD registers the list, get, create, update and delete routes of
+// collectionName and documents them in APIOperations, so it must be called
+// before the OpenAPI route is registered.
+func RegisterCRUD(router RouteGroup, collectionName string, opts CRUDOptions) {
+	c := newCRUD(collectionName, opts)
+
+	HandleResource(router, c.opts.Path, func(r *Resource) {
+		r.GET(c.handleList()).BindFunc(c.opts.Read...)
+		r.POST(c.handleCreate()).BindFunc(c.opts.Write...)
+	})
+	HandleResource(router, c.opts.Path+"/{id}", func(r *Resource) {
+		r.GET(c.handleGet()).BindFunc(c.opts.Read...)
+		r.PATCH(c.handleUpdate()).BindFunc(c.opts.Write...)
+		r.DELETE(c.handleDelete()).BindFunc(c.opts.Write...)
+	})
+
+	APIOperations = append(APIOperations, c.operations()...)
+}
+
+// CRUDOperations documents the routes RegisterCRUD registers for
+// collectionName, without registering them.
+func CRUDOperations(collectionName string, opts CRUDOptions) []APIOperation {
+	return newCRUD(collectionName, opts).operations()
+}
+
+type crud struct {
+	collection string
+	opts       CRUDOptions
+}
+
+func newCRUD(collectionName string, opts CRUDOptions) *crud {
+	if opts.Path == "" {
+		opts.Path = "/" + collectionName
+	}
+	if opts.Tag == "" {
+		opts.Tag = collectionName
+	}
+	if opts.Write == nil {
+		opts.Write = []func(e *core.RequestEvent) error{RequireAuth()}
+	}
+	return &crud{collection: collectionName, opts: opts}
+}
+
+func (c *crud) operations() []APIOperation {
+	readAccess, writeAccess := AccessPublic, AccessAuth
+	if len(c.opts.Read) > 0 {
+		readAccess = AccessAuth
+	}
+	if c.opts.OwnerField != "" {
+		writeAccess = AccessOwner
+	}
+	var item, input, list any = map[string]any{}, map[string]any{}, map[string]any{}
+	if c.opts.Item != nil {
+		item = c.opts.Item
+	}
+	if c.opts.Input != nil {
+		input = c.opts.Input
+	}
+	if c.opts.List != nil {
+		list = c.opts.List
+	}
+	query := listParams
+	if len(c.opts.FilterFields) > 0 {
+		query = slices.Concat(listParams, []APIParam{
+			{Name: "filter", Type: "string", Description: FilterDescription(c.opts.FilterFields)},
+		})
+	}
+	return []APIOperation{
+		{Method: http.MethodGet, Path: c.opts.Path, Tag: c.opts.Tag, Summary: "List " + c.collection, Access: readAccess,
+			Query: query, Response: list},
+		{Method: http.MethodPost, Path: c.opts.Path, Tag: c.opts.Tag, Summary: "Create a " + c.collection + " record", Access: writeAccess,
+			Body: input, Response: item},
+		{Method: http.MethodGet, Path: c.opts.Path + "/{id}", Tag: c.opts.Tag, Summary: "Get a " + c.collection + " record", Access: readAccess,
+			Response: item},
+		{Method: http.MethodPatch, Path: c.opts.Path + "/{id}", Tag: c.opts.Tag, Summary: "Update a " + c.collection + " record", Access: writeAccess,
+			Body: input, Response: item},
+		{Method: http.MethodDelete, Path: c.opts.Path + "/{id}", Tag: c.opts.Tag, Summary: "Delete a " + c.collection + " record", Access: writeAccess},
+	}
+}
+
+// export returns the fields of record the routes respond with.
+func (c *crud) export(record *core.Record) map[string]any {
+	if len(c.opts.Fields) == 0 {
+		return record.PublicExport()
+	}
+	data := map[string]any{"id": record.Id}
+	for _, field := range c.opts.Fields {
+		data[field] = record.Get(field)
+	}
+	return data
+}
+
+// bind decodes the JSON object of the request body, rejecting the fields
+// that aren't writable.
+func (c *crud) bind(e *core.RequestEvent) (map[string]any, error) {
+	body, err := io.ReadAll(e.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, &BindError{Message: "request body is empty"}
+	}
+	data := map[string]any{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, &BindError{Message: "request body must be a JSON object"}
+	}
+
+	var rejected []FieldError
+	for field := range data {
+		if !slices.Contains(c.opts.WritableFields, field) {
+			rejected = append(rejected, FieldError{Field: field, Code: BindCodeNotWritable, Message: "not writable"})
+		}
+	}
+	if len(rejected) > 0 {
+		return nil, newFieldsBindError("fields not writable", rejected)
+	}
+	return data, nil
+}
+
+// canWrite reports whether the requester may change record. Requests
+// without an auth record got through the write middlewares with an API key.
+func (c *crud) canWrite(e *core.RequestEvent, record *core.Record) bool {
+	if c.opts.OwnerField == "" || e.Auth == nil || e.HasSuperuserAuth() {
+		return true
+	}
+	return record.GetString(c.opts.OwnerField) == e.Auth.Id
+}
+
+// find returns the record of the id path value, writing the error response
+// when it returns nil.
+// scope returns the TenantScope of the tenant app is scoped to, if any.
+func (c *crud) scope(app core.App) dbx.Expression {
+	tenantId, ok := TenantOf(app)
+	if !ok || c.opts.TenantScope == nil {
+		return nil
+	}
+	return c.opts.TenantScope(tenantId)
+}
+
+func (c *crud) find(app core.App, e *core.RequestEvent) (*core.Record, error) {
+	span := StartStorageSpan(app, "Find "+c.collection, "SELECT")
+	record, err := app.FindRecordById(c.collection, e.Request.PathValue("id"), func(q *dbx.SelectQuery) error {
+		q.AndWhere(c.scope(app))
+		return nil
+	})
+	span.End(err)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, WriteNotFound(e, c.collection+" record not found", nil)
+	}
+	if err != nil {
+		return nil, WriteInternalServerError(e, "error getting "+c.collection+" record: "+err.Error(), nil)
+	}
+	return record, nil
+}
+
+// save validates and saves record, writing the response either way.
+func (c *crud) save(app core.App, e *core.RequestEvent, record *core.Record) error {
+	if c.opts.Validate != nil {
+		if err := c.opts.Validate(e, record); err != nil {
+			var validationErrs validation.Errors
+			if errors.As(err, &validationErrs) {
+				return WriteBadRequest(e, "invalid "+c.collection+" record", validationErrs)
+			}
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+	}
+	moderated := map[string]string{}
+	for _, field := range c.opts.ModeratedFields {
+		if value := record.GetString(field); record.IsNew() || value != record.Original().GetString(field) {
+			moderated[field] = value
+		}
+	}
+	verdict := ScreenRequest(app, e, moderated)
+	if len(verdict.Rejected) > 0 {
+		return WriteErrorCode(e, CodeContentRejected, "invalid "+c.collection+" record", verdict.Rejected)
+	}
+
+	op := "UPDATE"
+	if record.IsNew() {
+		op = "INSERT"
+	}
+	span := StartStorageSpan(app, "Save "+c.collection, op)
+	err := RetryWrite(app, func() error { return app.Save(record) })
+	span.End(err)
+	var validationErrs validation.Errors
+	if errors.As(err, &validationErrs) {
+		return WriteBadRequest(e, "invalid "+c.collection+" record", validationErrs)
+	}
+	if err != nil {
+		return WriteError(e, err, "error saving "+c.collection+" record")
+	}
+	flagForReview(app, c.collection, record.Id, verdict)
+	return WriteOK(e, "", c.export(record))
+}
+
+func (c *crud) handleList() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(c.opts.App, e)
+		filter, err := ParseFilter(e.Request.URL.Query().Get("filter"), c.opts.FilterFields)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		opts, err := ParseListOptions(e.Request.URL.Query(), c.opts.SortFields, c.opts.Config)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		opts.Filter = filter
+
+		span := StartStorageSpan(app, "List "+c.collection, "SELECT")
+		total, err := app.CountRecords(c.collection, opts.Filter, c.scope(app))
+		if err != nil {
+			span.End(err)
+			return WriteInternalServerError(e, "error counting "+c.collection+" records: "+err.Error(), nil)
+		}
+		records := []*core.Record{}
+		err = opts.Apply(app.RecordQuery(c.collection).AndWhere(opts.Filter).AndWhere(c.scope(app)), c.collection).All(&records)
+		span.SetAttr("db.response.returned_rows", len(records))
+		span.End(err)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting "+c.collection+" records: "+err.Error(), nil)
+		}
+
+		items := make([]map[string]any, len(records))
+		for i, record := range records {
+			items[i] = c.export(record)
+		}
+		return WriteOK(e, "", NewListPage(items, opts, int(total)))
+	}
+}
+
+func (c *crud) handleGet() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(c.opts.App, e)
+		record, err := c.find(app, e)
+		if record == nil {
+			return err
+		}
+		return WriteOK(e, "", c.export(record))
+	}
+}
+
+func (c *crud) handleCreate() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(c.opts.App, e)
+		data, err := c.bind(e)
+		if err != nil {
+			return WriteBindError(e, err)
+		}
+		collection, err := app.FindCachedCollectionByNameOrId(c.collection)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting "+c.collection+" collection: "+err.Error(), nil)
+		}
+
+		record := core.NewRecord(collection)
+		record.Load(data)
+		if c.opts.OwnerField != "" && e.Auth != nil && !e.HasSuperuserAuth() {
+			record.Set(c.opts.OwnerField, e.Auth.Id)
+		}
+		return c.save(app, e, record)
+	}
+}
+
+func (c *crud) handleUpdate() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(c.opts.App, e)
+		data, err := c.bind(e)
+		if err != nil {
+			return WriteBindError(e, err)
+		}
+		if len(data) == 0 {
+			return WriteBadRequest(e, "bad request: empty update request", nil)
+		}
+		record, err := c.find(app, e)
+		if record == nil {
+			return err
+		}
+		if !c.canWrite(e, record) {
+			return WriteForbidden(e, "not allowed to update this "+c.collection+" record", nil)
+		}
+
+		record.Load(data)
+		// owners can't hand the record over to another user
+		if !c.canWrite(e, record) {
+			return WriteForbidden(e, "not allowed to change the "+c.opts.OwnerField+" of this "+c.collection+" record", nil)
+		}
+		return c.save(app, e, record)
+	}
+}
+
+func (c *crud) handleDelete() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(c.opts.App, e)
+		record, err := c.find(app, e)
+		if record == nil {
+			return err
+		}
+		if !c.canWrite(e, record) {
+			return WriteForbidden(e, "not allowed to delete this "+c.collection+" record", nil)
+		}
+
+		span := StartStorageSpan(app, "Delete "+c.collection, "DELETE")
+		err = RetryWrite(app, func() error { return app.Delete(record) })
+		span.End(err)
+		if err != nil {
+			return WriteError(e, err, "error deleting "+c.collection+" record")
+		}
+		return WriteOK(e, "", nil)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is the keyset position of a row in the (created, id) order.
+type Cursor struct {
+	Created string `json:"c"`
+	Id      string `json:"i"`
+}
+
+// CursorOptions select the page of rows following After, or the first page
+// when After is nil.
+type CursorOptions struct {
+	After  *Cursor
+	Limit  int
+	Filter dbx.Expression
+}
+
+// EncodeCursor returns the opaque ?cursor= token of c.
+func EncodeCursor(c Cursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func DecodeCursor(token string) (Cursor, error) {
+	c := Cursor{}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(raw, &c); err != nil || c.Created == "" || c.Id == "" {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// IsCursorRequest reports whether the list request asked for the cursor
+// mode with ?cursor= or ?limit= instead of page based pagination.
+func IsCursorRequest(query url.Values) bool {
+	return query.Has("cursor") || query.Has("limit")
+}
+
+// ParseCursorOptions reads ?cursor= and ?limit= from the query string. The
+// cursor mode always sorts by (created, id), so ?sort= is rejected.
+func ParseCursorOptions(query url.Values, cfg *Config) (CursorOptions, error) {
+	opts := CursorOptions{Limit: cfg.DefaultPerPage}
+
+	if query.Has("page") || query.Has("sort") {
+		return opts, errors.New("page and sort can't be combined with cursor or limit")
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return opts, fmt.Errorf("invalid limit %q", v)
+		}
+		opts.Limit = min(limit, cfg.MaxPerPage)
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		c, err := DecodeCursor(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.After = &c
+	}
+
+	return opts, nil
+}
+
+// Apply adds the keyset condition and the ORDER BY and LIMIT clauses to q.
+// One row more than the limit is selected, to tell if there is a next page.
+func (o CursorOptions) Apply(q *dbx.SelectQuery, table string) *dbx.SelectQuery {
+	if o.After != nil {
+		q = q.AndWhere(dbx.NewExp(
+			fmt.Sprintf("([[%[1]s.created]] > {:created} OR ([[%[1]s.created]] = {:created} AND [[%[1]s.id]] > {:id}))", table),
+			dbx.Params{"created": o.After.Created, "id": o.After.Id},
+		))
+	}
+	return q.
+		AndOrderBy(fmt.Sprintf("[[%s.created]] ASC", table)).
+		AndOrderBy(fmt.Sprintf("[[%s.id]] ASC", table)).
+		Limit(int64(o.Limit + 1))
+}
+
+// NewCursorPage trims the extra row selected by CursorOptions.Apply and
+// returns the cursor of the last item when there are more rows.
+func NewCursorPage[T any](items []T, opts CursorOptions, cursorOf func(item T) Cursor) *models.CursorPage[T] {
+	page := &models.CursorPage[T]{Items: items, Limit: opts.Limit}
+	if len(items) > opts.Limit {
+		page.Items = items[:opts.Limit]
+		page.NextCursor = EncodeCursor(cursorOf(page.Items[opts.Limit-1]))
+	}
+	return page
+}
+
+func UserCursor(user models.User) Cursor {
+	return Cursor{Created: user.Created, Id: user.Id}
+}
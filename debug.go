@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// processStarted is when the process started, for the uptime.
+var processStarted = time.Now()
+
+// RuntimeStats are the process stats of GET /admin/runtime.
+type RuntimeStats struct {
+	Started    string        `json:"started"`
+	Uptime     string        `json:"uptime"`
+	GoVersion  string        `json:"goVersion"`
+	NumCPU     int           `json:"numCPU"`
+	GOMAXPROCS int           `json:"gomaxprocs"`
+	Goroutines int           `json:"goroutines"`
+	CgoCalls   int64         `json:"cgoCalls"`
+	Memory     RuntimeMemory `json:"memory"`
+}
+
+// RuntimeMemory is the subset of runtime.MemStats worth watching, in bytes.
+type RuntimeMemory struct {
+	Alloc        uint64 `json:"alloc"`
+	TotalAlloc   uint64 `json:"totalAlloc"`
+	Sys          uint64 `json:"sys"`
+	HeapAlloc    uint64 `json:"heapAlloc"`
+	HeapInuse    uint64 `json:"heapInuse"`
+	HeapIdle     uint64 `json:"heapIdle"`
+	HeapReleased uint64 `json:"heapReleased"`
+	HeapObjects  uint64 `json:"heapObjects"`
+	StackInuse   uint64 `json:"stackInuse"`
+	NumGC        uint32 `json:"numGC"`
+	PauseTotalNs uint64 `json:"pauseTotalNs"`
+	// LastGC is empty before the first collection.
+	LastGC string `json:"lastGC"`
+}
+
+func ReadRuntimeStats() RuntimeStats {
+	mem := runtime.MemStats{}
+	runtime.ReadMemStats(&mem)
+	lastGC := ""
+	if mem.LastGC > 0 {
+		lastGC = time.Unix(0, int64(mem.LastGC)).UTC().Format(time.RFC3339)
+	}
+	return RuntimeStats{
+		Started:    processStarted.UTC().Format(time.RFC3339),
+		Uptime:     time.Since(processStarted).Round(time.Second).String(),
+		GoVersion:  runtime.Version(),
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		CgoCalls:   runtime.NumCgoCall(),
+		Memory: RuntimeMemory{
+			Alloc:        mem.Alloc,
+			TotalAlloc:   mem.TotalAlloc,
+			Sys:          mem.Sys,
+			HeapAlloc:    mem.HeapAlloc,
+			HeapInuse:    mem.HeapInuse,
+			HeapIdle:     mem.HeapIdle,
+			HeapReleased: mem.HeapReleased,
+			HeapObjects:  mem.HeapObjects,
+			StackInuse:   mem.StackInuse,
+			NumGC:        mem.NumGC,
+			PauseTotalNs: mem.PauseTotalNs,
+			LastGC:       lastGC,
+		},
+	}
+}
+
+// HandleRuntime reports the goroutines, the memory and the uptime of the
+// process.
+func HandleRuntime() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		e.Response.Header().Set("Cache-Control", "no-store")
+		return WriteOK(e, "", ReadRuntimeStats())
+	}
+}
+
+// RequireDebugToken lets the profilers in with DEBUG_TOKEN as bearer
+// token, e.g. from curl on the host, and the superusers otherwise. The API
+// keys don't get in: profiles expose the internals of the process.
+func RequireDebugToken(cfg *Config) func(e *core.RequestEvent) error {
+	superuser := RequireSuperuserToken()
+	return func(e *core.RequestEvent) error {
+		if cfg.DebugToken != "" {
+			bearer, ok := strings.CutPrefix(e.Request.Header.Get("Authorization"), "Bearer ")
+			if ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(cfg.DebugToken)) == 1 {
+				return e.Next()
+			}
+		}
+		return superuser(e)
+	}
+}
+
+// HandlePprof serves net/http/pprof under /debug/pprof/: the index, the
+// named profiles such as heap and goroutine, and the CPU profile. The
+// execution trace, heavier on a busy process, is only served with
+// DEBUG_TRACE, and the command line never is, as the config flags can hold
+// secrets.
+func HandlePprof(cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		e.Response.Header().Set("Cache-Control", "no-store")
+		switch e.Request.PathValue("profile") {
+		case "cmdline":
+			return WriteNotFound(e, "the command line isn't served", nil)
+		case "profile":
+			pprof.Profile(e.Response, e.Request)
+		case "symbol":
+			pprof.Symbol(e.Response, e.Request)
+		case "trace":
+			if !cfg.DebugTrace {
+				return WriteNotFound(e, "execution traces are disabled, see DEBUG_TRACE", nil)
+			}
+			pprof.Trace(e.Response, e.Request)
+		default:
+			// the index and the named profiles, found from the URL path
+			pprof.Index(e.Response, e.Request)
+		}
+		return nil
+	}
+}
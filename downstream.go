@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/EricFrancis12/pocketbase-demo/resilience"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+)
+
+// The downstream dependencies guarded by Downstream. The HTTP ones get a
+// guard per host, e.g. webhooks/hooks.example.com.
+const (
+	DependencyWebhooks   = "webhooks"
+	DependencyEmail      = "email"
+	DependencyStripe     = "stripe"
+	DependencyModeration = "moderation"
+	DependencyTracing    = "otlp"
+	DependencyEventBus   = "bus"
+	DependencyPasswords  = "pwned-passwords"
+	DependencyCaptcha    = "captcha"
+	DependencyAlerts     = "alerts"
+)
+
+// Downstream holds the circuit breakers and the bulkheads of the downstream
+// dependencies, with the BREAKER_* and BULKHEAD_* settings once main
+// configured them.
+var Downstream = resilience.NewRegistry(resilience.Options{})
+
+// SendMail sends the message through the mail client of the app, guarded
+// by the email breaker so that a down mail server fails the emails right
+// away, and their jobs retry them later.
+func SendMail(app core.App, msg *mailer.Message) error {
+	return Downstream.Guard(DependencyEmail).Do(context.Background(), func(context.Context) error {
+		return app.NewMailClient().Send(msg)
+	})
+}
+
+// breakerStateValues are the values of the downstream_circuit_state gauge.
+var breakerStateValues = map[string]int{
+	resilience.StateClosed:   0,
+	resilience.StateHalfOpen: 1,
+	resilience.StateOpen:     2,
+}
+
+// writeDownstreamMetrics writes the state of the guards of Downstream in
+// the Prometheus text format.
+func writeDownstreamMetrics(b *strings.Builder) {
+	snapshots := Downstream.Snapshots()
+	writeMetricHeader(b, "downstream_circuit_state", "gauge", "State of the circuit breaker of a downstream dependency: 0 closed, 1 half-open, 2 open.")
+	for _, s := range snapshots {
+		fmt.Fprintf(b, "downstream_circuit_state{dependency=%s} %d\n", quoteLabel(s.Name), breakerStateValues[s.State])
+	}
+	writeMetricHeader(b, "downstream_calls_in_flight", "gauge", "Calls to a downstream dependency in flight.")
+	for _, s := range snapshots {
+		fmt.Fprintf(b, "downstream_calls_in_flight{dependency=%s} %d\n", quoteLabel(s.Name), s.InFlight)
+	}
+	writeMetricHeader(b, "downstream_calls_rejected_total", "counter", "Calls to a downstream dependency refused by its open breaker or its full bulkhead.")
+	for _, s := range snapshots {
+		fmt.Fprintf(b, "downstream_calls_rejected_total{dependency=%s,reason=\"open\"} %d\n", quoteLabel(s.Name), s.RejectedOpen)
+		fmt.Fprintf(b, "downstream_calls_rejected_total{dependency=%s,reason=\"full\"} %d\n", quoteLabel(s.Name), s.RejectedFull)
+	}
+}
+
+// AdminHealth is the response to GET /admin/health, the readiness checks
+// along with the state of the downstream dependencies called so far.
+type AdminHealth struct {
+	Readiness
+	Dependencies []resilience.Snapshot `json:"dependencies"`
+}
+
+// HandleAdminHealth reports the readiness and the downstream dependencies.
+// An open breaker doesn't make the app unready, as the calls it refuses are
+// retried later or fail on their own.
+func HandleAdminHealth(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		e.Response.Header().Set("Cache-Control", "no-store")
+		return WriteOK(e, "", AdminHealth{
+			Readiness:    CheckReadiness(e.Request.Context(), app),
+			Dependencies: Downstream.Snapshots(),
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// DryRunResult is the response of the POST and PATCH /users requests with
+// ?dryRun=true, which run the binding, the validation, the uniqueness and
+// the permission checks of the write but skip it, for the forms to be
+// validated server side as they are filled. The checks failing respond as
+// they would without the flag.
+type DryRunResult struct {
+	DryRun bool `json:"dryRun"`
+	// User is the user as it would be written. The created users have no
+	// id nor dates yet.
+	User *models.User `json:"user"`
+	// Changed are the fields an update would change.
+	Changed map[string]FieldChange `json:"changed,omitempty"`
+	// PendingEmail is the new email that would wait for the confirmation of
+	// the link mailed to it, rather than be written.
+	PendingEmail string `json:"pendingEmail,omitempty"`
+	// Flagged are the fields moderation would flag for review.
+	Flagged []string `json:"flagged,omitempty"`
+}
+
+// IsDryRun reports whether the request asks for a dry run with
+// ?dryRun=true.
+func IsDryRun(e *core.RequestEvent) bool {
+	dryRun, _ := strconv.ParseBool(e.Request.URL.Query().Get("dryRun"))
+	return dryRun
+}
+
+// NewDryRunResult returns the result of the dry run of a write of user,
+// flagged for review per verdict.
+func NewDryRunResult(user *models.User, verdict ModerationVerdict) DryRunResult {
+	result := DryRunResult{DryRun: true, User: user}
+	for _, flag := range verdict.Flags {
+		result.Flagged = append(result.Flagged, flag.Field)
+	}
+	return result
+}
+
+// PreviewUserCreation runs the checks of CreateUser, in the same order, and
+// returns the user it would insert.
+func PreviewUserCreation(app core.App, cr models.UserCreationRequest) (*models.User, error) {
+	if cr.Password != cr.PasswordConfirm {
+		return nil, ErrPasswordMismatch
+	}
+	if err := ValidateUserCreationRequest(cr); err != nil {
+		return nil, err
+	}
+	if err := CheckEmailAvailable(app, "", cr.Email); err != nil {
+		return nil, err
+	}
+	tenantId, _ := Users.tenant(app)
+	return &models.User{
+		Email:           cr.Email,
+		EmailVisibility: cr.EmailVisibility,
+		Name:            cr.Name,
+		Roles:           models.Roles{},
+		TenantId:        tenantId,
+	}, nil
+}
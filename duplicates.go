@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// DuplicateDefaultThreshold is the trigram similarity, from 0 to 1, from
+// which two names or email local parts are reported as likely the same.
+const DuplicateDefaultThreshold = 0.6
+
+const (
+	DuplicateReasonEmail     = "email"
+	DuplicateReasonLocalPart = "email_local_part"
+	DuplicateReasonName      = "name"
+)
+
+// emailDomainAliases are the domains delivering to the same mailboxes.
+var emailDomainAliases = map[string]string{
+	"googlemail.com": "gmail.com",
+}
+
+// DuplicateCluster is a group of users likely to be the same person. The
+// oldest is suggested as the primary user of POST /admin/users/merge.
+type DuplicateCluster struct {
+	PrimaryId string        `json:"primaryId"`
+	Users     []models.User `json:"users"`
+	Reasons   []string      `json:"reasons"`
+	// Score is the highest similarity between two users of the cluster, 1
+	// for the same normalized email.
+	Score float64 `json:"score"`
+}
+
+// DuplicateReport is the response to GET /admin/users/duplicates, with the
+// total number of clusters found before the limit.
+type DuplicateReport struct {
+	Clusters []DuplicateCluster `json:"clusters"`
+	Total    int                `json:"total"`
+}
+
+// NormalizeEmail lowercases the email and drops what doesn't change the
+// mailbox it delivers to: the +tag of the local part and, for gmail, its
+// dots. It returns the local part and the domain.
+func NormalizeEmail(email string) (string, string) {
+	local, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(email)), "@")
+	if !ok {
+		return local, ""
+	}
+	if alias, ok := emailDomainAliases[domain]; ok {
+		domain = alias
+	}
+	local, _, _ = strings.Cut(local, "+")
+	if domain == "gmail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local, domain
+}
+
+// normalizeName lowercases the name and keeps its letters and digits, its
+// words sorted so that "Smith John" matches "John Smith".
+func normalizeName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// trigrams returns the set of the 3 rune windows of s, padded so that its
+// first and last letters weigh as much as the others.
+func trigrams(s string) map[string]struct{} {
+	grams := map[string]struct{}{}
+	if s == "" {
+		return grams
+	}
+	runes := []rune("  " + s + " ")
+	for i := 0; i+3 <= len(runes); i++ {
+		grams[string(runes[i:i+3])] = struct{}{}
+	}
+	return grams
+}
+
+// trigramIndex finds the pairs of strings with a trigram similarity (the
+// Jaccard index of their trigram sets) of at least a threshold, comparing
+// only the strings sharing trigrams.
+type trigramIndex struct {
+	grams    []map[string]struct{}
+	postings map[string][]int
+}
+
+func newTrigramIndex(values []string) *trigramIndex {
+	index := &trigramIndex{grams: make([]map[string]struct{}, len(values)), postings: map[string][]int{}}
+	for i, value := range values {
+		index.grams[i] = trigrams(value)
+		for gram := range index.grams[i] {
+			index.postings[gram] = append(index.postings[gram], i)
+		}
+	}
+	return index
+}
+
+// similar calls fn for every pair i < j whose similarity reaches threshold.
+func (index *trigramIndex) similar(threshold float64, fn func(i, j int, score float64)) {
+	for i, grams := range index.grams {
+		shared := map[int]int{}
+		for gram := range grams {
+			for _, j := range index.postings[gram] {
+				if j > i {
+					shared[j]++
+				}
+			}
+		}
+		for j, n := range shared {
+			score := float64(n) / float64(len(grams)+len(index.grams[j])-n)
+			if score >= threshold {
+				fn(i, j, score)
+			}
+		}
+	}
+}
+
+// FindDuplicateUsers groups the users likely to be the same person: the
+// ones with the same normalized email, or with similar email local parts or
+// names. Similar local parts only count within an email domain, while names
+// are compared across all of them.
+func FindDuplicateUsers(users []models.User, threshold float64) []DuplicateCluster {
+	parent := make([]int, len(users))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	type link struct {
+		reason string
+		score  float64
+	}
+	links := map[[2]int][]link{}
+	union := func(i, j int, reason string, score float64) {
+		links[[2]int{i, j}] = append(links[[2]int{i, j}], link{reason, score})
+		parent[find(i)] = find(j)
+	}
+
+	locals := make([]string, len(users))
+	domains := map[string][]int{}
+	byEmail := map[string]int{}
+	for i, user := range users {
+		local, domain := NormalizeEmail(user.Email)
+		locals[i] = local
+		if first, ok := byEmail[local+"@"+domain]; ok {
+			union(first, i, DuplicateReasonEmail, 1)
+		} else {
+			byEmail[local+"@"+domain] = i
+		}
+		domains[domain] = append(domains[domain], i)
+	}
+	for _, members := range domains {
+		values := make([]string, len(members))
+		for k, i := range members {
+			values[k] = locals[i]
+		}
+		newTrigramIndex(values).similar(threshold, func(a, b int, score float64) {
+			if i, j := members[a], members[b]; locals[i] != locals[j] {
+				union(i, j, DuplicateReasonLocalPart, score)
+			}
+		})
+	}
+
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = normalizeName(user.Name)
+	}
+	newTrigramIndex(names).similar(threshold, func(i, j int, score float64) {
+		union(i, j, DuplicateReasonName, score)
+	})
+
+	members := map[int][]int{}
+	for i := range users {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+	reasons := map[int]map[string]bool{}
+	scores := map[int]float64{}
+	for pair, pairLinks := range links {
+		root := find(pair[0])
+		if reasons[root] == nil {
+			reasons[root] = map[string]bool{}
+		}
+		for _, l := range pairLinks {
+			reasons[root][l.reason] = true
+			scores[root] = max(scores[root], l.score)
+		}
+	}
+
+	clusters := []DuplicateCluster{}
+	for root, indexes := range members {
+		if len(indexes) < 2 {
+			continue
+		}
+		cluster := DuplicateCluster{Score: scores[root]}
+		for _, i := range indexes {
+			cluster.Users = append(cluster.Users, users[i])
+		}
+		sort.Slice(cluster.Users, func(a, b int) bool { return cluster.Users[a].Created < cluster.Users[b].Created })
+		cluster.PrimaryId = cluster.Users[0].Id
+		for reason := range reasons[root] {
+			cluster.Reasons = append(cluster.Reasons, reason)
+		}
+		sort.Strings(cluster.Reasons)
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(a, b int) bool {
+		if clusters[a].Score != clusters[b].Score {
+			return clusters[a].Score > clusters[b].Score
+		}
+		return clusters[a].PrimaryId < clusters[b].PrimaryId
+	})
+	return clusters
+}
+
+// HandleFindDuplicateUsers lists the clusters of likely duplicate users,
+// the most similar first. ?threshold= sets the similarity from which names
+// and email local parts match, and ?limit= caps the clusters returned.
+func HandleFindDuplicateUsers(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		threshold := DuplicateDefaultThreshold
+		if raw := e.Request.URL.Query().Get("threshold"); raw != "" {
+			var err error
+			threshold, err = strconv.ParseFloat(raw, 64)
+			if err != nil || threshold <= 0 || threshold > 1 {
+				return WriteBadRequest(e, "threshold must be a number above 0 and up to 1", nil)
+			}
+		}
+		limit := cfg.DefaultPerPage
+		if raw := e.Request.URL.Query().Get("limit"); raw != "" {
+			var err error
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit < 1 || limit > cfg.MaxPerPage {
+				return WriteBadRequest(e, fmt.Sprintf("limit must be an integer from 1 to %d", cfg.MaxPerPage), nil)
+			}
+		}
+
+		total, err := Users.Count(app, nil)
+		if err != nil {
+			return WriteError(e, err, "error counting users")
+		}
+		if total > cfg.DuplicateScanMax {
+			return WriteBadRequest(e, fmt.Sprintf("too many users to compare, at most %d are", cfg.DuplicateScanMax), nil)
+		}
+		users, err := Users.FindAll(app, ListOptions{})
+		if err != nil {
+			return WriteError(e, err, "error getting users")
+		}
+
+		clusters := FindDuplicateUsers(users, threshold)
+		report := DuplicateReport{Clusters: clusters, Total: len(clusters)}
+		if len(clusters) > limit {
+			report.Clusters = clusters[:limit]
+		}
+		return WriteOK(e, "", report)
+	}
+}
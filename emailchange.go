@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+var (
+	ErrEmailChangeInvalid = errors.New("invalid email change token")
+	ErrEmailChangeExpired = errors.New("email change token expired")
+)
+
+type EmailChangeRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type ConfirmEmailChangeRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+var emailChangeTemplate = template.Must(template.New("email-change").Parse(
+	`<p>Hi{{if .Name}} {{.Name}}{{end}},</p>
+<p>Confirm your new email address by opening the link below. It expires in {{.TTL}}.</p>
+<p><a href="{{.URL}}">{{.URL}}</a></p>
+<p>If you didn't ask for this change, you can ignore this email.</p>`))
+
+var emailChangeNoticeTemplate = template.Must(template.New("email-change-notice").Parse(
+	`<p>Hi{{if .Name}} {{.Name}}{{end}},</p>
+<p>A change of the email address of your account to {{.Email}} was requested. It only happens once confirmed from that address.</p>
+<p>If you didn't ask for this change, change your password and contact us.</p>`))
+
+// SignEmailChangeToken returns a token of the form
+// base64(userId:expiry:email).base64(hmac).
+func SignEmailChangeToken(secret []byte, userId string, email string, expires time.Time) string {
+	return signUserToken(secret, "email-change", userId, email, expires)
+}
+
+// VerifyEmailChangeToken checks the token signature and expiry and returns
+// the user id and new email it was issued for.
+func VerifyEmailChangeToken(secret []byte, token string, now time.Time) (string, string, error) {
+	userId, email, err := verifyUserToken(secret, "email-change", token, now)
+	if errors.Is(err, errTokenExpired) {
+		return "", "", ErrEmailChangeExpired
+	}
+	if err != nil {
+		return "", "", ErrEmailChangeInvalid
+	}
+	return userId, email, nil
+}
+
+// RequestEmailChange stores email as the pending email of the user and
+// mails it a link to GET /users/email-change/confirm, along with a notice
+// to the current email. The users email is left untouched until the link is
+// opened.
+func RequestEmailChange(app core.App, cfg *Config, userId string, email string) error {
+	user, err := GetUserById(app, userId)
+	if err != nil {
+		return err
+	}
+	err = RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().
+			Update("users", dbx.Params{"pending_email": email}, dbx.HashExp{"id": userId}).
+			Execute()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	token := SignEmailChangeToken([]byte(cfg.EmailChangeSecret), userId, email, time.Now().Add(cfg.EmailChangeTTL))
+	meta := app.Settings().Meta
+	body := bytes.Buffer{}
+	err = emailChangeTemplate.Execute(&body, map[string]any{
+		"Name": user.Name,
+		"TTL":  cfg.EmailChangeTTL.String(),
+		"URL":  strings.TrimRight(meta.AppURL, "/") + "/users/email-change/confirm?token=" + url.QueryEscape(token),
+	})
+	if err != nil {
+		return err
+	}
+	err = SendMail(app, &mailer.Message{
+		From:    mail.Address{Name: meta.SenderName, Address: meta.SenderAddress},
+		To:      []mail.Address{{Address: email}},
+		Subject: "Confirm your new email address",
+		HTML:    body.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// the change stands without the notice, which only warns of a takeover
+	body.Reset()
+	err = emailChangeNoticeTemplate.Execute(&body, map[string]any{"Name": user.Name, "Email": email})
+	if err == nil {
+		err = SendMail(app, &mailer.Message{
+			From:    mail.Address{Name: meta.SenderName, Address: meta.SenderAddress},
+			To:      []mail.Address{{Address: user.Email}},
+			Subject: "Your email address is being changed",
+			HTML:    body.String(),
+		})
+	}
+	if err != nil {
+		app.Logger().Warn("Failed to send email change notice", "userId", userId, "error", err)
+	}
+	return nil
+}
+
+// ConfirmEmailChange replaces the email of the user with the pending email
+// carried by token, as long as it is still the pending one, and queues the
+// event of the change along with it.
+func ConfirmEmailChange(app core.App, cfg *Config, userId string, token string) (*models.User, error) {
+	tokenUserId, email, err := VerifyEmailChangeToken([]byte(cfg.EmailChangeSecret), token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if tokenUserId != userId {
+		return nil, ErrEmailChangeInvalid
+	}
+	if err := CheckUserUpdate(app, userId, models.UserUpdateRequest{Email: &email}); err != nil {
+		return nil, err
+	}
+
+	var user *models.User
+	err = WithTx(app, func(txApp core.App) error {
+		res, err := txApp.NonconcurrentDB().
+			Update("users", dbx.Params{
+				"email":         email,
+				"pending_email": "",
+				"updated":       types.NowDateTime().String(),
+			}, dbx.HashExp{"id": userId, "pending_email": email}).
+			Execute()
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrEmailChangeInvalid
+		}
+		if user, err = GetUserById(txApp, userId); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserUpdated, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	UserResponseCache.Invalidate()
+	return user, nil
+}
+
+// HandleRequestEmailChange sends the confirmation link of a change of the
+// email of the user to the new address, and a notice to the current one.
+func HandleRequestEmailChange(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		req := EmailChangeRequest{}
+		if err := BindStrict(e, &req); err != nil {
+			return WriteBindError(e, err)
+		}
+		if err := ValidateUserUpdateRequest(models.UserUpdateRequest{Email: &req.Email}); err != nil {
+			return WriteError(e, err, "")
+		}
+		user, err := GetUserById(app, userId)
+		if err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+		if req.Email == user.Email {
+			return WriteBadRequest(e, "bad request: email is unchanged", nil)
+		}
+		if err := CheckEmailAvailable(app, userId, req.Email); err != nil {
+			if errors.Is(err, ErrEmailTaken) {
+				return WriteErrorCode(e, CodeEmailTaken, err.Error(), map[string]string{"email": err.Error()})
+			}
+			return WriteError(e, err, "error checking email")
+		}
+		if err := RequestEmailChange(app, cfg, userId, req.Email); err != nil {
+			return writeUserError(e, err, "error requesting email change")
+		}
+		SetAuditedUser(e, userId)
+		return WriteOK(e, "a confirmation link was sent to "+req.Email, nil)
+	}
+}
+
+// HandleConfirmEmailChangeLink applies the email change of the ?token= of
+// the link sent by RequestEmailChange.
+func HandleConfirmEmailChangeLink(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		token := e.Request.URL.Query().Get("token")
+		if token == "" {
+			return WriteBadRequest(e, "bad request: token is required", nil)
+		}
+		userId, _, err := VerifyEmailChangeToken([]byte(cfg.EmailChangeSecret), token, time.Now())
+		if err != nil {
+			return writeEmailChangeError(e, err)
+		}
+		user, err := ConfirmEmailChange(app, cfg, userId, token)
+		if err != nil {
+			return writeEmailChangeError(e, err)
+		}
+		SetAuditedUser(e, userId)
+		return WriteOK(e, "email changed", user)
+	}
+}
+
+func HandleConfirmEmailChange(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		userId := e.Request.PathValue("userId")
+		cr := ConfirmEmailChangeRequest{}
+		if err := BindStrict(e, &cr); err != nil {
+			return WriteBindError(e, err)
+		}
+
+		user, err := ConfirmEmailChange(app, cfg, userId, cr.Token)
+		if err != nil {
+			return writeEmailChangeError(e, err)
+		}
+		return WriteOK(e, "", user)
+	}
+}
+
+func writeEmailChangeError(e *core.RequestEvent, err error) error {
+	switch {
+	case errors.Is(err, ErrEmailChangeExpired):
+		return WriteGone(e, err.Error(), nil)
+	case errors.Is(err, ErrEmailChangeInvalid):
+		return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+	case errors.Is(err, ErrEmailTaken):
+		return WriteConflict(e, err.Error(), nil)
+	case errors.Is(err, sql.ErrNoRows):
+		return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+	}
+	return WriteError(e, err, "error confirming email change")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// ErasedEmailDomain is the domain of the placeholder emails of the erased
+// users, reserved so that they can't receive any mail.
+const ErasedEmailDomain = "erased.invalid"
+
+// ErasureReceipt records an erasure of the personal data of a user.
+type ErasureReceipt struct {
+	Id     string `db:"id" json:"id"`
+	UserId string `db:"user_id" json:"userId"`
+	// EmailHash is the SHA-256 of the erased email.
+	EmailHash        string `db:"email_hash" json:"emailHash"`
+	ActorType        string `db:"actor_type" json:"actorType"`
+	ActorId          string `db:"actor_id" json:"actorId"`
+	AuditLogsPurged  int64  `db:"audit_logs_purged" json:"auditLogsPurged"`
+	ActivitiesPurged int64  `db:"activities_purged" json:"activitiesPurged"`
+	FilesDeleted     int    `db:"files_deleted" json:"filesDeleted"`
+	Created          string `db:"created" json:"created"`
+}
+
+var ErasureReceipts = NewRepository[ErasureReceipt]("erasure_receipts")
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ErasePersonalData replaces the email and the name of the user, soft
+// deleted or not, with placeholders hashed from its id, blanks its phone,
+// national id and signup region, deletes its avatar, OAuth2 links, activity
+// and event stream, and the audit logs about it older than
+// auditRetention. The user's tokens stop working. A receipt of the erasure
+// is stored and returned.
+func ErasePersonalData(app core.App, userId string, actorType string, actorId string, auditRetention time.Duration, now time.Time) (*ErasureReceipt, error) {
+	cutoff, err := types.ParseDateTime(now.Add(-auditRetention))
+	if err != nil {
+		return nil, err
+	}
+
+	var receipt *ErasureReceipt
+	err = WithTx(app, func(txApp core.App) error {
+		user, err := Users.WithDeleted().Find(txApp, userId)
+		if err != nil {
+			return err
+		}
+		record, err := txApp.FindRecordById(Users.Table, userId)
+		if err != nil {
+			return err
+		}
+
+		receipt = &ErasureReceipt{
+			UserId:    userId,
+			EmailHash: sha256Hex(strings.ToLower(user.Email)),
+			ActorType: actorType,
+			ActorId:   actorId,
+		}
+		if user.Avatar != "" {
+			receipt.FilesDeleted++
+		}
+
+		placeholder := sha256Hex(userId)[:16]
+		record.SetEmail("erased-" + placeholder + "@" + ErasedEmailDomain)
+		record.SetEmailVisibility(false)
+		record.SetVerified(false)
+		record.Set("name", "Erased user "+placeholder[:8])
+		// PocketBase deletes the file, and its thumbs, once saved
+		record.Set("avatar", nil)
+		record.Set("pending_email", "")
+		record.Set("phone", "")
+		record.Set("nationalId", "")
+		record.Set("signup_region", "")
+		record.RefreshTokenKey()
+		if err := txApp.Save(record); err != nil {
+			return err
+		}
+		erased, err := Users.WithDeleted().Find(txApp, userId)
+		if err != nil {
+			return err
+		}
+		if err := QueueUserEvent(txApp, EventUserUpdated, erased); err != nil {
+			return err
+		}
+
+		externalAuths, err := txApp.FindAllExternalAuthsByRecord(record)
+		if err != nil {
+			return err
+		}
+		for _, externalAuth := range externalAuths {
+			if err := txApp.Delete(externalAuth); err != nil {
+				return err
+			}
+		}
+
+		res, err := txApp.NonconcurrentDB().
+			Delete(Activities.Table, dbx.HashExp{"user": userId}).
+			Execute()
+		if err != nil {
+			return err
+		}
+		receipt.ActivitiesPurged, _ = res.RowsAffected()
+
+		if err := DeleteUserEvents(txApp, userId); err != nil {
+			return err
+		}
+
+		res, err = txApp.NonconcurrentDB().
+			Delete(AuditLogs.Table, dbx.And(
+				dbx.Or(dbx.HashExp{"target_id": userId}, dbx.HashExp{"actor_id": userId}),
+				dbx.NewExp("[[created]] < {:cutoff}", dbx.Params{"cutoff": cutoff.String()}),
+			)).
+			Execute()
+		if err != nil {
+			return err
+		}
+		receipt.AuditLogsPurged, _ = res.RowsAffected()
+
+		collection, err := txApp.FindCachedCollectionByNameOrId(ErasureReceipts.Table)
+		if err != nil {
+			return err
+		}
+		receiptRecord := core.NewRecord(collection)
+		receiptRecord.Load(NewInsertParams(receipt))
+		if err := txApp.Save(receiptRecord); err != nil {
+			return err
+		}
+		receipt.Id = receiptRecord.Id
+		receipt.Created = receiptRecord.GetString("created")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// derived from the id, but no reason to keep it
+	if err := RemoveGeneratedAvatar(app, userId); err != nil {
+		app.Logger().Warn("Failed to remove generated avatar", "userId", userId, "error", err)
+	}
+	UserResponseCache.Invalidate()
+	return receipt, nil
+}
+
+// HandleErasePersonalData erases the personal data of the user, for the
+// right to be forgotten requests, and responds with the receipt.
+func HandleErasePersonalData(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		// the audit log of the erasure itself mustn't keep the erased values
+		RedactAuditChanges(e)
+
+		actorType, actorId := RequestActor(e)
+		receipt, err := ErasePersonalData(app, userId, actorType, actorId, cfg.ErasureAuditRetention, time.Now())
+		if err != nil {
+			return writeUserError(e, err, "error erasing personal data")
+		}
+		return WriteOK(e, "personal data erased", receipt)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Error codes of the failed responses, stable so that clients can branch on
+// them rather than on the messages. The responses without a specific code
+// carry the one of their status, e.g. NOT_FOUND.
+const (
+	CodeValidationFailed     = "VALIDATION_FAILED"
+	CodeInvalidBody          = "INVALID_BODY"
+	CodeUserNotFound         = "USER_NOT_FOUND"
+	CodeEmailTaken           = "EMAIL_TAKEN"
+	CodeInvalidCredentials   = "INVALID_CREDENTIALS"
+	CodeDatabaseBusy         = "DATABASE_BUSY"
+	CodeBodyTooLarge         = "BODY_TOO_LARGE"
+	CodeMaintenance          = "MAINTENANCE"
+	CodeReadOnly             = "READ_ONLY"
+	CodeDeadlineExceeded     = "DEADLINE_EXCEEDED"
+	CodeQuotaExceeded        = "QUOTA_EXCEEDED"
+	CodeUserLocked           = "USER_LOCKED"
+	CodeCounterOutOfRange    = "COUNTER_OUT_OF_RANGE"
+	CodeInvalidSignature     = "INVALID_SIGNATURE"
+	CodeSubscriptionRequired = "SUBSCRIPTION_REQUIRED"
+	CodeContentRejected      = "CONTENT_REJECTED"
+	CodeWeakPassword         = "WEAK_PASSWORD"
+	CodeSessionRevoked       = "SESSION_REVOKED"
+	CodeAuthLockedOut        = "AUTH_LOCKED_OUT"
+	CodeCaptchaRequired      = "CAPTCHA_REQUIRED"
+	CodeSignupRejected       = "SIGNUP_REJECTED"
+	CodeShareLinkInvalid     = "SHARE_LINK_INVALID"
+	CodeShareLinkExpired     = "SHARE_LINK_EXPIRED"
+	CodeTwoFactorEnabled     = "TWO_FACTOR_ENABLED"
+	CodeTwoFactorNotEnabled  = "TWO_FACTOR_NOT_ENABLED"
+	CodeTwoFactorNotEnrolled = "TWO_FACTOR_NOT_ENROLLED"
+	CodeTwoFactorInvalid     = "TWO_FACTOR_CODE_INVALID"
+	CodeTwoFactorChallenge   = "TWO_FACTOR_CHALLENGE_INVALID"
+	CodeTwoFactorRequired    = "TWO_FACTOR_REQUIRED"
+	CodeInternalError        = "INTERNAL_SERVER_ERROR"
+)
+
+// ErrorCode documents an error code and the status it is sent with.
+type ErrorCode struct {
+	Code        string `json:"code"`
+	Status      int    `json:"status"`
+	Description string `json:"description"`
+}
+
+// ErrorCodes is the registry of the specific error codes, by code.
+var ErrorCodes = map[string]ErrorCode{}
+
+// errorMappings translate the errors returned by the storage functions to
+// the codes they are reported with, checked in order.
+var errorMappings []errorMapping
+
+type errorMapping struct {
+	match   func(err error) bool
+	code    string
+	message string
+}
+
+func init() {
+	RegisterErrorCode(CodeValidationFailed, http.StatusBadRequest, "The values of some fields are invalid, see the data of the response.")
+	RegisterErrorCode(CodeInvalidBody, http.StatusBadRequest, "The request body couldn't be bound, see the data of the response.")
+	RegisterErrorCode(CodeUserNotFound, http.StatusNotFound, "The user doesn't exist or was deleted.")
+	RegisterErrorCode(CodeEmailTaken, http.StatusConflict, "Another user has the email.")
+	RegisterErrorCode(CodeInvalidCredentials, http.StatusUnauthorized, "The email or the password is wrong.")
+	RegisterErrorCode(CodeDatabaseBusy, http.StatusServiceUnavailable, "The database is busy, retry after the Retry-After delay.")
+	RegisterErrorCode(CodeBodyTooLarge, http.StatusRequestEntityTooLarge, "The request body is larger than allowed.")
+	RegisterErrorCode(CodeMaintenance, http.StatusServiceUnavailable, "The app is down for maintenance, the reads keep working. Retry the writes after the Retry-After delay.")
+	RegisterErrorCode(CodeReadOnly, http.StatusForbidden, "The deployment is read-only, e.g. a public demo, the reads keep working but the writes are refused.")
+	RegisterErrorCode(CodeDeadlineExceeded, http.StatusGatewayTimeout, "The request took longer than the timeout of its route.")
+	RegisterErrorCode(CodeQuotaExceeded, http.StatusTooManyRequests, "The user or API key used up its monthly request quota, see the X-Quota-Limit header.")
+	RegisterErrorCode(CodeUserLocked, http.StatusForbidden, "The account was locked by an admin, its tokens are refused until it is unlocked.")
+	RegisterErrorCode(CodeCounterOutOfRange, http.StatusConflict, "The increment would take the counter out of its bounds, it was left as is.")
+	RegisterErrorCode(CodeInvalidSignature, http.StatusUnauthorized, "The signature of the webhook delivery or of the API key request is missing, wrong, too old or replayed.")
+	RegisterErrorCode(CodeSubscriptionRequired, http.StatusPaymentRequired, "The route is part of the premium plan, which requires an active subscription, see POST /billing/checkout.")
+	RegisterErrorCode(CodeContentRejected, http.StatusUnprocessableEntity, "Some fields contain disallowed content, see the data of the response.")
+	RegisterErrorCode(CodeWeakPassword, http.StatusUnprocessableEntity, "The password breaks the password policy, see the violations in the data of the response.")
+	RegisterErrorCode(CodeSessionRevoked, http.StatusUnauthorized, "The session of the token was revoked or has expired, log in again.")
+	RegisterErrorCode(CodeAuthLockedOut, http.StatusTooManyRequests, "The client IP or the account failed to log in too many times, retry after the Retry-After delay.")
+	RegisterErrorCode(CodeCaptchaRequired, http.StatusUnauthorized, "The client IP or the account failed to log in several times, or the signups require a CAPTCHA, retry with a CAPTCHA response in the X-Captcha-Response header.")
+	RegisterErrorCode(CodeSignupRejected, http.StatusBadRequest, "The signup looked automated, or its form token expired, reload the form and retry.")
+	RegisterErrorCode(CodeShareLinkInvalid, http.StatusUnauthorized, "The share link is malformed or its signature is wrong.")
+	RegisterErrorCode(CodeShareLinkExpired, http.StatusGone, "The share link has expired, ask the user for a new one.")
+	RegisterErrorCode(CodeTwoFactorEnabled, http.StatusConflict, "2FA is already enabled, disable it before enrolling a new secret.")
+	RegisterErrorCode(CodeTwoFactorNotEnabled, http.StatusConflict, "2FA isn't enabled for the user.")
+	RegisterErrorCode(CodeTwoFactorNotEnrolled, http.StatusConflict, "No TOTP secret is enrolled, see POST /users/{userId}/2fa.")
+	RegisterErrorCode(CodeTwoFactorInvalid, http.StatusBadRequest, "The TOTP or backup code is wrong.")
+	RegisterErrorCode(CodeTwoFactorChallenge, http.StatusUnauthorized, "The two-factor challenge of the login is invalid or has expired, log in again.")
+	RegisterErrorCode(CodeTwoFactorRequired, http.StatusForbidden, "The user has 2FA enabled, the route requires the X-2FA-Session header of POST /auth/2fa.")
+	RegisterErrorCode(CodeInternalError, http.StatusInternalServerError, "An unexpected error, reported with the request id.")
+
+	MapError(func(err error) bool { return errors.Is(err, ErrNotFound) || errors.Is(err, sql.ErrNoRows) }, DefaultErrorCode(http.StatusNotFound), "not found")
+	MapError(func(err error) bool { return errors.Is(err, ErrDatabaseBusy) }, CodeDatabaseBusy, "database busy, try again later")
+	MapError(func(err error) bool { return errors.Is(err, context.DeadlineExceeded) }, CodeDeadlineExceeded, "request timed out")
+	MapError(func(err error) bool { return errors.Is(err, ErrEmailTaken) }, CodeEmailTaken, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrInvalidCredentials) }, CodeInvalidCredentials, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrUserLocked) }, CodeUserLocked, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrCounterOutOfRange) }, CodeCounterOutOfRange, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrSessionRevoked) }, CodeSessionRevoked, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrShareLinkInvalid) }, CodeShareLinkInvalid, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrShareLinkExpired) }, CodeShareLinkExpired, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrTwoFactorEnabled) }, CodeTwoFactorEnabled, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrTwoFactorNotEnabled) }, CodeTwoFactorNotEnabled, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrTwoFactorNotEnrolled) }, CodeTwoFactorNotEnrolled, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrTwoFactorCodeInvalid) }, CodeTwoFactorInvalid, "")
+	MapError(func(err error) bool { return errors.Is(err, ErrTwoFactorChallengeInvalid) }, CodeTwoFactorChallenge, "")
+	MapError(func(err error) bool {
+		var validationErrs validation.Errors
+		return errors.As(err, &validationErrs)
+	}, CodeValidationFailed, "validation failed")
+	MapError(func(err error) bool {
+		var policyErr *PasswordPolicyError
+		return errors.As(err, &policyErr)
+	}, CodeWeakPassword, "weak password")
+	MapError(func(err error) bool {
+		var bindErr *BindError
+		return errors.As(err, &bindErr)
+	}, CodeInvalidBody, "")
+	MapError(func(err error) bool {
+		_, ok := IsBodyTooLarge(err)
+		return ok
+	}, CodeBodyTooLarge, "")
+}
+
+// RegisterErrorCode adds a specific error code to the registry.
+func RegisterErrorCode(code string, status int, description string) {
+	ErrorCodes[code] = ErrorCode{Code: code, Status: status, Description: description}
+}
+
+// MapError reports the errors matching match with code and message, the
+// message of the error itself when empty.
+func MapError(match func(err error) bool, code string, message string) {
+	errorMappings = append(errorMappings, errorMapping{match: match, code: code, message: message})
+}
+
+// DefaultErrorCode is the code of the failed responses of status without a
+// specific one, e.g. NOT_FOUND for 404.
+func DefaultErrorCode(status int) string {
+	return strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// ErrorStatus returns the status a code is sent with, 500 for the unknown
+// codes.
+func ErrorStatus(code string) int {
+	if errorCode, ok := ErrorCodes[code]; ok {
+		return errorCode.Status
+	}
+	for status := http.StatusBadRequest; status < 600; status++ {
+		if text := http.StatusText(status); text != "" && DefaultErrorCode(status) == code {
+			return status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// ClassifyError returns the code and the message of err, CodeInternalError
+// and no message for the unmapped errors.
+func ClassifyError(err error) (string, string) {
+	for _, mapping := range errorMappings {
+		if mapping.match(err) {
+			if mapping.message == "" {
+				return mapping.code, err.Error()
+			}
+			return mapping.code, mapping.message
+		}
+	}
+	return CodeInternalError, ""
+}
+
+// WriteError responds with the code, status and message err maps to (see
+// MapError). action, e.g. "error getting user", prefixes the message of the
+// internal errors.
+func WriteError(e *core.RequestEvent, err error, action string) error {
+	code, message := ClassifyError(err)
+	if code == CodeInternalError {
+		return WriteErrorCode(e, code, action+": "+err.Error(), nil)
+	}
+	var data any
+	var validationErrs validation.Errors
+	var bindErr *BindError
+	var policyErr *PasswordPolicyError
+	switch {
+	case errors.As(err, &validationErrs):
+		data = validationErrs
+	case errors.As(err, &bindErr) && len(bindErr.Fields) > 0:
+		data = bindErr.Fields
+	case errors.As(err, &policyErr):
+		data = map[string][]PasswordViolation{"password": policyErr.Violations}
+	}
+	return WriteErrorCode(e, code, message, data)
+}
+
+// WriteErrorCode responds with the status of code, see ErrorStatus.
+func WriteErrorCode(e *core.RequestEvent, code string, message string, data any) error {
+	status := ErrorStatus(code)
+	if status == http.StatusServiceUnavailable {
+		e.Response.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds))
+	}
+	return writeResp(e, status, code, message, data)
+}
+
+// ListErrorCodes returns the registry sorted by code, for the docs.
+func ListErrorCodes() []ErrorCode {
+	codes := make([]ErrorCode, 0, len(ErrorCodes))
+	for _, errorCode := range ErrorCodes {
+		codes = append(codes, errorCode)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].Code < codes[j].Code })
+	return codes
+}
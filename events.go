@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const (
+	userEventBufferSize = 64
+	userEventHeartbeat  = 30 * time.Second
+)
+
+// UserEvents streams the user lifecycle events to the GET /users/events
+// subscribers.
+var UserEvents = NewUserEventHub(userEventBufferSize)
+
+type UserEvent struct {
+	Id    uint64
+	Event string
+	User  models.User
+}
+
+// UserEventHub fans the published events out to every subscriber. The
+// events are kept in memory only, so a subscriber that reconnects misses
+// the ones published in between and should refetch what it shows.
+type UserEventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan UserEvent]struct{}
+	lastId      uint64
+	bufferSize  int
+	closed      bool
+}
+
+func NewUserEventHub(bufferSize int) *UserEventHub {
+	return &UserEventHub{
+		subscribers: map[chan UserEvent]struct{}{},
+		bufferSize:  bufferSize,
+	}
+}
+
+// Subscribe returns a channel receiving the events published from now on,
+// and the function to call once done with it. The channel is closed if the
+// subscriber falls too far behind to keep up.
+func (h *UserEventHub) Subscribe() (<-chan UserEvent, func()) {
+	ch := make(chan UserEvent, h.bufferSize)
+	h.mu.Lock()
+	if h.closed {
+		close(ch)
+	} else {
+		h.subscribers[ch] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *UserEventHub) Publish(event string, user models.User) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastId++
+	e := UserEvent{Id: h.lastId, Event: event, User: user}
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// drop the slow subscriber rather than blocking the writers
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends the streams of every subscriber, current and future, so that
+// the shutdown doesn't wait for them.
+func (h *UserEventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// EmitUserEvent notifies the webhooks and the event stream subscribers that
+// user, a models.User or a pointer to one, was created, updated or deleted.
+// It writes the event to the outbox outside of the transaction of the
+// change, QueueUserEvent writes it along with the change. Before the outbox
+// is started, or when it can't be written, the event is published right
+// away.
+func EmitUserEvent(event string, user any) {
+	if Outbox != nil {
+		err := QueueUserEvent(Outbox.app, event, user)
+		if err == nil {
+			return
+		}
+		Outbox.app.Logger().Error("Failed to write user event to the outbox", "event", event, "error", err)
+	}
+	if err := PublishUserEvent(context.Background(), event, user); err != nil && Outbox != nil {
+		Outbox.app.Logger().Error("Failed to publish user event", "event", event, "error", err)
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, id string, event string, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, event, raw)
+	return err
+}
+
+// HandleUserEvents streams the user events as Server-Sent Events, with the
+// emails redacted as in the other user routes.
+func HandleUserEvents() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		rc := http.NewResponseController(e.Response)
+		// lift the server WriteTimeout, which would cut the stream
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return WriteInternalServerError(e, "error opening event stream: "+err.Error(), nil)
+		}
+		events, unsubscribe := UserEvents.Subscribe()
+		defer unsubscribe()
+
+		e.Response.Header().Set("Content-Type", "text/event-stream")
+		e.Response.Header().Set("Cache-Control", "no-cache")
+		e.Response.Header().Set("X-Accel-Buffering", "no")
+		e.Response.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return err
+		}
+
+		heartbeat := time.NewTicker(userEventHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-e.Request.Context().Done():
+				return nil
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(e.Response, ": ping\n\n"); err != nil {
+					return nil
+				}
+			case event, ok := <-events:
+				if !ok {
+					return nil
+				}
+				if tenantId, ok := RequestTenant(e); ok && event.User.TenantId != tenantId {
+					continue
+				}
+				id := strconv.FormatUint(event.Id, 10)
+				if err := writeServerSentEvent(e.Response, id, event.Event, RedactUser(e, event.User)); err != nil {
+					return nil
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Package events publishes the user events to a message bus, NATS or Redis
+// Pub/Sub, for the other services to react to the changes of the users.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// SchemaVersion is the version of the Message format, bumped on every
+// change the consumers can't ignore.
+const SchemaVersion = 1
+
+const DefaultTimeout = 5 * time.Second
+
+var ErrUnsupportedScheme = errors.New("unsupported message bus url, expected nats:// or redis://")
+
+// Message is the JSON body of the published events. Id is the same for
+// the redeliveries of an event, for the consumers to skip them.
+type Message struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Id            string          `json:"id"`
+	Type          string          `json:"type"`
+	Time          string          `json:"time"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// NewMessage returns the message of the event of type, e.g. user.created,
+// with data encoded as JSON.
+func NewMessage(id string, eventType string, data any) (Message, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		SchemaVersion: SchemaVersion,
+		Id:            id,
+		Type:          eventType,
+		Time:          time.Now().UTC().Format(time.RFC3339Nano),
+		Data:          raw,
+	}, nil
+}
+
+// Publisher publishes the messages to the subjects, or channels, of a
+// message bus. It is safe for concurrent use.
+type Publisher interface {
+	Publish(ctx context.Context, subject string, msg Message) error
+	Close() error
+}
+
+type Options struct {
+	// Name identifies the connections of the publisher on the bus.
+	Name string
+	// Timeout bounds the dial and every publish.
+	Timeout time.Duration
+}
+
+type Option func(o *Options)
+
+func WithName(name string) Option {
+	return func(o *Options) {
+		o.Name = name
+	}
+}
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = timeout
+	}
+}
+
+// NewPublisher returns the publisher of the bus of rawURL, a
+// nats://[user:password@]host[:port] or a
+// redis://[[user]:password@]host[:port][/db] url. It connects on the first
+// publish, and reconnects after a failure.
+func NewPublisher(rawURL string, opts ...Option) (Publisher, error) {
+	o := Options{Name: "pocketbase-demo", Timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message bus url: %w", err)
+	}
+	switch u.Scheme {
+	case "nats":
+		return NewNATSPublisher(u, o), nil
+	case "redis":
+		return NewRedisPublisher(u, o)
+	}
+	return nil, ErrUnsupportedScheme
+}
+
+// deadline returns the earlier of the deadline of ctx and timeout from
+// now.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+	return d
+}
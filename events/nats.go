@@ -0,0 +1,163 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const defaultNATSPort = "4222"
+
+// NATSPublisher publishes with PUB on a single connection speaking the
+// NATS client protocol. Each publish is followed by a PING, the PONG
+// confirming that the server processed it, or the -ERR that it didn't.
+type NATSPublisher struct {
+	addr string
+	user *url.Userinfo
+	opts Options
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func NewNATSPublisher(u *url.URL, opts Options) *NATSPublisher {
+	p := &NATSPublisher{addr: u.Host, user: u.User, opts: opts}
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), defaultNATSPort)
+	}
+	return p
+}
+
+func (p *NATSPublisher) Publish(ctx context.Context, subject string, msg Message) error {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("invalid nats subject %q", subject)
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	p.conn.SetDeadline(deadline(ctx, p.opts.Timeout))
+	frame := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", subject, len(payload), payload)
+	if _, err := p.conn.Write([]byte(frame)); err != nil {
+		p.reset()
+		return fmt.Errorf("error publishing to nats: %w", err)
+	}
+	if err := p.awaitPong(); err != nil {
+		p.reset()
+		return fmt.Errorf("error publishing to nats: %w", err)
+	}
+	return nil
+}
+
+func (p *NATSPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn, p.r = nil, nil
+	return err
+}
+
+// natsConnect is the CONNECT of the publisher, see
+// https://docs.nats.io/reference/reference-protocols/nats-protocol#connect.
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	Protocol  int    `json:"protocol"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// connect dials the server, unless connected, reads its INFO and sends the
+// CONNECT, with the user and password of the url or its user as token.
+func (p *NATSPublisher) connect(ctx context.Context) error {
+	if p.conn != nil {
+		return nil
+	}
+	dialer := net.Dialer{Deadline: deadline(ctx, p.opts.Timeout)}
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to nats: %w", err)
+	}
+	p.conn, p.r = conn, bufio.NewReader(conn)
+	conn.SetDeadline(deadline(ctx, p.opts.Timeout))
+
+	line, err := p.readLine()
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		p.reset()
+		return fmt.Errorf("error connecting to nats: unexpected greeting %q: %v", line, err)
+	}
+	c := natsConnect{Name: p.opts.Name, Lang: "go", Version: "1", Protocol: 1}
+	if p.user != nil {
+		if pass, ok := p.user.Password(); ok {
+			c.User, c.Pass = p.user.Username(), pass
+		} else {
+			c.AuthToken = p.user.Username()
+		}
+	}
+	raw, _ := json.Marshal(c)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", raw); err != nil {
+		p.reset()
+		return fmt.Errorf("error connecting to nats: %w", err)
+	}
+	if err := p.awaitPong(); err != nil {
+		p.reset()
+		return fmt.Errorf("error connecting to nats: %w", err)
+	}
+	return nil
+}
+
+// awaitPong reads until the PONG, answering the PINGs of the server and
+// returning its -ERR.
+func (p *NATSPublisher) awaitPong() error {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'"))
+		}
+		// +OK and the INFO updates are skipped
+	}
+}
+
+func (p *NATSPublisher) readLine() (string, error) {
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (p *NATSPublisher) reset() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn, p.r = nil, nil
+}
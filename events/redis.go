@@ -0,0 +1,145 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultRedisPort = "6379"
+
+// RedisPublisher publishes with PUBLISH on a single connection speaking
+// RESP, the Redis protocol.
+type RedisPublisher struct {
+	addr     string
+	username string
+	password string
+	db       int
+	opts     Options
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func NewRedisPublisher(u *url.URL, opts Options) (*RedisPublisher, error) {
+	p := &RedisPublisher{addr: u.Host, opts: opts}
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), defaultRedisPort)
+	}
+	if u.User != nil {
+		p.username = u.User.Username()
+		p.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+		p.db = n
+	}
+	return p, nil
+}
+
+func (p *RedisPublisher) Publish(ctx context.Context, subject string, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	p.conn.SetDeadline(deadline(ctx, p.opts.Timeout))
+	if _, err := p.do("PUBLISH", subject, string(payload)); err != nil {
+		p.reset()
+		return fmt.Errorf("error publishing to redis: %w", err)
+	}
+	return nil
+}
+
+func (p *RedisPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn, p.r = nil, nil
+	return err
+}
+
+// connect dials the server, unless connected, authenticating and selecting
+// the database of the url.
+func (p *RedisPublisher) connect(ctx context.Context) error {
+	if p.conn != nil {
+		return nil
+	}
+	dialer := net.Dialer{Deadline: deadline(ctx, p.opts.Timeout)}
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to redis: %w", err)
+	}
+	p.conn, p.r = conn, bufio.NewReader(conn)
+	conn.SetDeadline(deadline(ctx, p.opts.Timeout))
+
+	commands := [][]string{}
+	if p.password != "" && p.username != "" {
+		commands = append(commands, []string{"AUTH", p.username, p.password})
+	} else if p.password != "" {
+		commands = append(commands, []string{"AUTH", p.password})
+	}
+	if p.db != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(p.db)})
+	}
+	for _, command := range commands {
+		if _, err := p.do(command...); err != nil {
+			p.reset()
+			return fmt.Errorf("error connecting to redis: %s: %w", command[0], err)
+		}
+	}
+	return nil
+}
+
+func (p *RedisPublisher) reset() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn, p.r = nil, nil
+}
+
+// do sends the command as an array of bulk strings and reads its reply,
+// returning the error replies as errors.
+func (p *RedisPublisher) do(args ...string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := p.conn.Write([]byte(b.String())); err != nil {
+		return "", err
+	}
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", errors.New(line[1:])
+	}
+	return "", fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// The types of the events of the users aggregate, see
+// EventSourcedUserService.
+const (
+	UserCreated            = "UserCreated"
+	EmailChanged           = "EmailChanged"
+	EmailVisibilityChanged = "EmailVisibilityChanged"
+	NameChanged            = "NameChanged"
+	PhoneChanged           = "PhoneChanged"
+	NationalIdChanged      = "NationalIdChanged"
+	UserDeleted            = "UserDeleted"
+	UserRestored           = "UserRestored"
+)
+
+// userFieldEvents are the events of the changes of the UserWritableFields.
+var userFieldEvents = map[string]string{
+	"email":           EmailChanged,
+	"emailVisibility": EmailVisibilityChanged,
+	"name":            NameChanged,
+	"phone":           PhoneChanged,
+	"nationalId":      NationalIdChanged,
+}
+
+// StoredUserEvent is an event of the stream of a user, the versions
+// counting the events of the user from 1.
+type StoredUserEvent struct {
+	Id        string        `db:"id" json:"id"`
+	Aggregate string        `db:"aggregate" json:"userId"`
+	Version   int           `db:"version" json:"version"`
+	Type      string        `db:"type" json:"type"`
+	Data      types.JSONRaw `db:"data" json:"data"`
+	ActorType string        `db:"actor_type" json:"actorType"`
+	ActorId   string        `db:"actor_id" json:"actorId"`
+	Created   string        `db:"created" json:"created"`
+}
+
+var UserEventStream = &Repository[StoredUserEvent]{
+	Table:         "user_events",
+	CreatedColumn: "created",
+}
+
+// UserCreatedData is the data of the UserCreated events. The password is
+// never part of the stream: PasswordSet only tells that one was given.
+type UserCreatedData struct {
+	Email           string `json:"email"`
+	EmailVisibility bool   `json:"emailVisibility"`
+	Name            string `json:"name"`
+	TenantId        string `json:"tenantId,omitempty"`
+	PasswordSet     bool   `json:"passwordSet"`
+}
+
+// userCreatedRow is the users row the projection of UserCreated inserts.
+type userCreatedRow struct {
+	Id              string `db:"id"`
+	Email           string `db:"email"`
+	EmailVisibility bool   `db:"emailVisibility"`
+	Name            string `db:"name"`
+}
+
+// AppendUserEvent appends the event to the stream of the user, at the
+// version following the last one, and applies it to the users read model
+// with ProjectUserEvent. Called with the transaction of the change, the
+// event and its projection commit together.
+func AppendUserEvent(app core.App, userId string, eventType string, data any, actorType string, actorId string) (*StoredUserEvent, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	version := 0
+	err = app.DB().
+		Select("COALESCE(MAX([[version]]), 0)").
+		From(UserEventStream.Table).
+		Where(dbx.HashExp{"aggregate": userId}).
+		Row(&version)
+	if err != nil {
+		return nil, err
+	}
+	event := &StoredUserEvent{
+		Id:        NewId(UserEventStream.Table),
+		Aggregate: userId,
+		Version:   version + 1,
+		Type:      eventType,
+		Data:      raw,
+		ActorType: actorType,
+		ActorId:   actorId,
+		Created:   types.NowDateTime().String(),
+	}
+	if err := UserEventStream.Insert(app, event); err != nil {
+		return nil, err
+	}
+	if err := ProjectUserEvent(app, event); err != nil {
+		return nil, fmt.Errorf("projecting %s v%d of %s: %w", event.Type, event.Version, userId, err)
+	}
+	return event, nil
+}
+
+// ProjectUserEvent applies the event to the users read model. It returns
+// ErrNotFound if the user the event is about isn't in it.
+func ProjectUserEvent(app core.App, event *StoredUserEvent) error {
+	var affected int64
+	var err error
+	switch event.Type {
+	case UserCreated:
+		data := UserCreatedData{}
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return err
+		}
+		return Users.Insert(app, userCreatedRow{
+			Id:              event.Aggregate,
+			Email:           data.Email,
+			EmailVisibility: data.EmailVisibility,
+			Name:            data.Name,
+		})
+	case UserDeleted:
+		created, err := types.ParseDateTime(event.Created)
+		if err != nil {
+			return err
+		}
+		affected, err = Users.SoftDelete(app, event.Aggregate, created.Time())
+		if err != nil {
+			return err
+		}
+	case UserRestored:
+		affected, err = Users.Restore(app, event.Aggregate)
+		if err != nil {
+			return err
+		}
+	default:
+		cs := Changeset{}
+		if err := json.Unmarshal(event.Data, &cs); err != nil {
+			return err
+		}
+		// the encrypted fields are kept encrypted in the stream, and
+		// encrypted again by the update
+		for _, column := range Users.encryptedColumns() {
+			if s, ok := cs[column].(string); ok && s != "" {
+				if FieldEncryption == nil {
+					return ErrFieldKeyRequired
+				}
+				if cs[column], err = FieldEncryption.Decrypt(Users.Table+"."+column, s); err != nil {
+					return err
+				}
+			}
+		}
+		affected, err = Users.Update(app, event.Aggregate, cs)
+		if err != nil {
+			return err
+		}
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// FindUserEvents returns the events of the stream of the user from the
+// given version on, oldest first.
+func FindUserEvents(app core.App, userId string, fromVersion int, limit int) ([]StoredUserEvent, error) {
+	events := []StoredUserEvent{}
+	err := app.DB().
+		Select("*").
+		From(UserEventStream.Table).
+		Where(dbx.HashExp{"aggregate": userId}).
+		AndWhere(dbx.NewExp("[[version]] >= {:from}", dbx.Params{"from": fromVersion})).
+		OrderBy("version ASC").
+		Limit(int64(limit)).
+		All(&events)
+	return events, err
+}
+
+// DeleteUserEvents drops the stream of the user, which holds its personal
+// data, along with the user itself.
+func DeleteUserEvents(app core.App, userId string) error {
+	_, err := app.NonconcurrentDB().
+		Delete(UserEventStream.Table, dbx.HashExp{"aggregate": userId}).
+		Execute()
+	return err
+}
+
+// EventSourcedUserService is the UserService of USER_EVENT_SOURCING: its
+// writes append the events of the change to the stream of the user, in
+// user_events, and the users table is the read model the events are
+// projected to, in the same transaction. The reads are the ones of the
+// PocketBaseUserService.
+//
+// Only the writes of the /users routes go through the stream. The others,
+// e.g. the verification, the roles or SCIM, write the read model directly
+// and don't show in the history. The hard deletes and the erasures drop
+// the stream of the user.
+type EventSourcedUserService struct {
+	*PocketBaseUserService
+	actorType string
+	actorId   string
+}
+
+func NewEventSourcedUserService(app core.App) *EventSourcedUserService {
+	return &EventSourcedUserService{PocketBaseUserService: NewUserService(app)}
+}
+
+// WithRequest binds the service to the request, whose requester is
+// recorded as the actor of the events. The events appended outside of a
+// request have no actor.
+func (s *EventSourcedUserService) WithRequest(e *core.RequestEvent) UserService {
+	actorType, actorId := RequestActor(e)
+	return &EventSourcedUserService{
+		PocketBaseUserService: &PocketBaseUserService{App: WithTrace(s.App, e)},
+		actorType:             actorType,
+		actorId:               actorId,
+	}
+}
+
+func (s *EventSourcedUserService) Create(cr models.UserCreationRequest) (*models.User, error) {
+	if cr.Password != cr.PasswordConfirm {
+		return nil, ErrPasswordMismatch
+	}
+	if err := ValidateUserCreationRequest(cr); err != nil {
+		return nil, err
+	}
+	var user *models.User
+	err := WithTx(s.App, func(txApp core.App) error {
+		if err := CheckEmailAvailable(txApp, "", cr.Email); err != nil {
+			return err
+		}
+		userId := NewId(Users.Table)
+		tenantId, _ := Users.tenant(txApp)
+		_, err := AppendUserEvent(txApp, userId, UserCreated, UserCreatedData{
+			Email:           cr.Email,
+			EmailVisibility: cr.EmailVisibility,
+			Name:            cr.Name,
+			TenantId:        tenantId,
+			PasswordSet:     cr.Password != "",
+		}, s.actorType, s.actorId)
+		if err != nil {
+			return err
+		}
+		if cr.Password != "" {
+			if err := SetUserPassword(txApp, userId, cr.Password); err != nil {
+				return err
+			}
+		}
+		if user, err = GetUserById(txApp, userId); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserCreated, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Update appends an event per field ur changes, in the order of the
+// fields. The fields set to their current value append none.
+func (s *EventSourcedUserService) Update(userId string, ur models.UserUpdateRequest) (*models.User, map[string]FieldChange, error) {
+	cs := NewChangeset(ur)
+	if len(cs) == 0 {
+		return nil, nil, fmt.Errorf("empty update request")
+	}
+	if err := cs.Validate(UserWritableFields); err != nil {
+		return nil, nil, err
+	}
+	var user *models.User
+	var changed map[string]FieldChange
+	err := WithTx(s.App, func(txApp core.App) error {
+		before, err := GetUserById(txApp, userId)
+		if err != nil {
+			return err
+		}
+		if err := CheckUserVersion(before, ur); err != nil {
+			user = before
+			return err
+		}
+		current := NewInsertParams(before)
+		encrypted := Users.encryptedColumns()
+		for _, field := range cs.Fields() {
+			value := cs[field]
+			if reflect.DeepEqual(current[field], value) {
+				continue
+			}
+			if slices.Contains(encrypted, field) {
+				if value, err = Users.encryptValue(field, value); err != nil {
+					return err
+				}
+			}
+			eventType, ok := userFieldEvents[field]
+			if !ok {
+				eventType = field + "Changed"
+			}
+			_, err := AppendUserEvent(txApp, userId, eventType, map[string]any{field: value}, s.actorType, s.actorId)
+			if err != nil {
+				return err
+			}
+		}
+		if user, err = GetUserById(txApp, userId); err != nil {
+			return err
+		}
+		changed = DiffFields(before, user)
+		return QueueUserEvent(txApp, EventUserUpdated, user)
+	})
+	if IsUserVersionError(err) {
+		return user, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, changed, nil
+}
+
+func (s *EventSourcedUserService) Delete(userId string, unmodifiedSince *time.Time) error {
+	return WithTx(s.App, func(txApp core.App) error {
+		user, err := GetUserById(txApp, userId)
+		if err != nil {
+			return err
+		}
+		if err := CheckUserUnmodifiedSince(user, unmodifiedSince); err != nil {
+			return err
+		}
+		if _, err := AppendUserEvent(txApp, userId, UserDeleted, struct{}{}, s.actorType, s.actorId); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserDeleted, user)
+	})
+}
+
+func (s *EventSourcedUserService) HardDelete(userId string, unmodifiedSince *time.Time) error {
+	return WithTx(s.App, func(txApp core.App) error {
+		if err := (&PocketBaseUserService{App: txApp}).HardDelete(userId, unmodifiedSince); err != nil {
+			return err
+		}
+		return DeleteUserEvents(txApp, userId)
+	})
+}
+
+func (s *EventSourcedUserService) Restore(userId string) (*models.User, error) {
+	var user *models.User
+	err := WithTx(s.App, func(txApp core.App) error {
+		if _, err := Users.Find(txApp, userId); err == nil {
+			return ErrUserNotDeleted
+		}
+		if _, err := Users.WithDeleted().Find(txApp, userId); err != nil {
+			return err
+		}
+		if _, err := AppendUserEvent(txApp, userId, UserRestored, struct{}{}, s.actorType, s.actorId); err != nil {
+			return err
+		}
+		var err error
+		if user, err = GetUserById(txApp, userId); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserUpdated, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UserHistory is the response of GET /users/{userId}/history.
+type UserHistory struct {
+	UserId string            `json:"userId"`
+	Events []StoredUserEvent `json:"events"`
+	// NextVersion is the ?from of the following page, 0 on the last one.
+	NextVersion int `json:"nextVersion"`
+}
+
+// HandleGetUserHistory lists the event stream of the user, oldest first,
+// with the values of the encrypted fields masked. The stream is only
+// written with USER_EVENT_SOURCING, and is empty for the users created
+// without it until their next change through the /users routes.
+func HandleGetUserHistory(app core.App, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		query := e.Request.URL.Query()
+		from := 1
+		if raw := query.Get("from"); raw != "" {
+			var err error
+			if from, err = strconv.Atoi(raw); err != nil || from < 1 {
+				return WriteBadRequest(e, "from must be a version from 1", nil)
+			}
+		}
+		limit := cfg.DefaultPerPage
+		if raw := query.Get("limit"); raw != "" {
+			var err error
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit < 1 || limit > cfg.MaxPerPage {
+				return WriteBadRequest(e, fmt.Sprintf("limit must be an integer from 1 to %d", cfg.MaxPerPage), nil)
+			}
+		}
+
+		if _, err := Users.WithDeleted().Find(app, userId); err != nil {
+			return writeUserError(e, err, "error reading the user")
+		}
+		// one more to tell whether there is a next page
+		events, err := FindUserEvents(app, userId, from, limit+1)
+		if err != nil {
+			return WriteError(e, err, "error reading the user history")
+		}
+		history := UserHistory{UserId: userId, Events: events}
+		if len(events) > limit {
+			history.Events = events[:limit]
+			history.NextVersion = events[limit].Version
+		}
+		for i := range history.Events {
+			history.Events[i].Data = maskEncryptedEventData(history.Events[i].Data)
+		}
+		return WriteOK(e, "", history)
+	}
+}
+
+// maskEncryptedEventData replaces the ciphertexts of the encrypted fields
+// of the event data.
+func maskEncryptedEventData(data types.JSONRaw) types.JSONRaw {
+	values := map[string]any{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return data
+	}
+	masked := false
+	for _, column := range Users.encryptedColumns() {
+		if s, ok := values[column].(string); ok && s != "" {
+			values[column] = "[encrypted]"
+			masked = true
+		}
+	}
+	if !masked {
+		return data
+	}
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return data
+	}
+	return raw
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// MaxExpandDepth caps the relations of an ?expand= path, e.g. teams.members
+// is 2 deep, and MaxExpandRows the rows expanded per relation of a row.
+const (
+	MaxExpandDepth = 3
+	MaxExpandRows  = 100
+)
+
+// Relation describes the rows of a table related to the rows of another,
+// which ?expand= embeds under their "expand" key. See HasMany and
+// ManyThrough.
+type Relation struct {
+	// Fields, when set, are the only fields of the related rows returned,
+	// e.g. to keep the emails of the users out.
+	Fields []string
+	// Private relations are only expanded for the superusers and for the
+	// user the row is, e.g. the teams of a user, and never nested.
+	Private bool
+	// Relations are the relations of the related rows, for the nested
+	// paths such as teams.members.
+	Relations map[string]*Relation
+	// load returns the related rows of each id.
+	load func(app core.App, ids []string) (map[string][]map[string]any, error)
+}
+
+// HasMany relates the rows of target whose column holds the id of the row,
+// e.g. the posts of a user by their author.
+func HasMany[T any](target *Repository[T], column string) *Relation {
+	r := &Relation{}
+	r.load = func(app core.App, ids []string) (map[string][]map[string]any, error) {
+		rows, err := target.FindAll(app, ListOptions{
+			Filter: dbx.In(target.Table+"."+column, toAny(ids)...),
+			Sort:   []SortField{{Field: "id"}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		related := map[string][]map[string]any{}
+		for _, row := range rows {
+			owner := dbColumnValue(row, column)
+			if len(related[owner]) >= MaxExpandRows {
+				continue
+			}
+			m, err := r.toMap(row)
+			if err != nil {
+				return nil, err
+			}
+			related[owner] = append(related[owner], m)
+		}
+		return related, nil
+	}
+	return r
+}
+
+// ManyThrough relates the rows of target linked to the row by the rows of
+// the through table, whose from column holds the id of the row and to
+// column the id of the target row, e.g. the teams of a user through the
+// team memberships.
+func ManyThrough[T any](target *Repository[T], through string, from string, to string) *Relation {
+	r := &Relation{}
+	r.load = func(app core.App, ids []string) (map[string][]map[string]any, error) {
+		links := []struct {
+			From string `db:"from"`
+			To   string `db:"to"`
+		}{}
+		err := app.DB().
+			Select("[["+from+"]] AS [[from]]", "[["+to+"]] AS [[to]]").
+			From(through).
+			Where(dbx.In(from, toAny(ids)...)).
+			OrderBy(from, to).
+			All(&links)
+		if err != nil {
+			return nil, err
+		}
+		targetIds := []string{}
+		for _, link := range links {
+			targetIds = append(targetIds, link.To)
+		}
+		rows, err := target.FindAll(app, ListOptions{Filter: dbx.In(target.Table+".id", toAny(targetIds)...)})
+		if err != nil {
+			return nil, err
+		}
+		// the scope of target, e.g. its tenant, leaves some rows out
+		byId := make(map[string]map[string]any, len(rows))
+		for _, row := range rows {
+			m, err := r.toMap(row)
+			if err != nil {
+				return nil, err
+			}
+			byId[dbColumnValue(row, "id")] = m
+		}
+		related := map[string][]map[string]any{}
+		for _, link := range links {
+			if m, ok := byId[link.To]; ok && len(related[link.From]) < MaxExpandRows {
+				related[link.From] = append(related[link.From], m)
+			}
+		}
+		return related, nil
+	}
+	return r
+}
+
+// toMap converts a related row to its JSON fields, keeping only Fields
+// when set.
+func (r *Relation) toMap(row any) (map[string]any, error) {
+	raw, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]any{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	if r.Fields != nil {
+		for field := range m {
+			if field != "id" && !slices.Contains(r.Fields, field) {
+				delete(m, field)
+			}
+		}
+	}
+	return m, nil
+}
+
+// dbColumnValue returns the field of the struct row tagged with column, as
+// a string.
+func dbColumnValue(row any, column string) string {
+	v := reflect.Indirect(reflect.ValueOf(row))
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("db") == column {
+			return fmt.Sprint(v.Field(i).Interface())
+		}
+	}
+	return ""
+}
+
+func toAny(ids []string) []any {
+	values := make([]any, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+	return values
+}
+
+// ParseExpand parses ?expand=, comma separated dotted paths of relations,
+// e.g. teams,teams.members. Every relation of a path must exist, and the
+// paths can't be more than MaxExpandDepth deep. The last return value tells
+// if a path goes through a Private relation.
+func ParseExpand(v string, relations map[string]*Relation) ([]string, bool, error) {
+	if v == "" {
+		return nil, false, nil
+	}
+	paths := []string{}
+	private := false
+	for _, path := range strings.Split(v, ",") {
+		path = strings.TrimSpace(path)
+		names := strings.Split(path, ".")
+		if len(names) > MaxExpandDepth {
+			return nil, false, fmt.Errorf("expand %q is more than %d relations deep", path, MaxExpandDepth)
+		}
+		current := relations
+		for i, name := range names {
+			relation, ok := current[name]
+			if !ok {
+				return nil, false, fmt.Errorf("unsupported expand %q", path)
+			}
+			// the private relations of the related rows belong to others
+			if relation.Private && i > 0 {
+				return nil, false, fmt.Errorf("unsupported expand %q, %s is private", path, name)
+			}
+			private = private || relation.Private
+			current = relation.Relations
+		}
+		paths = append(paths, path)
+	}
+	return paths, private, nil
+}
+
+// Expand loads the relations of paths, parsed by ParseExpand, for the rows
+// of ids. It returns the "expand" object of each row, which maps the names
+// of the relations to the lists of related rows, each with its own
+// "expand" for the nested paths. The rows without related rows get empty
+// lists.
+func Expand(app core.App, relations map[string]*Relation, ids []string, paths []string) (map[string]map[string]any, error) {
+	// group the paths by their first relation, the rest nested under it
+	nested := map[string][]string{}
+	names := []string{}
+	for _, path := range paths {
+		name, rest, _ := strings.Cut(path, ".")
+		if _, ok := nested[name]; !ok {
+			names = append(names, name)
+			nested[name] = nil
+		}
+		if rest != "" {
+			nested[name] = append(nested[name], rest)
+		}
+	}
+
+	expanded := make(map[string]map[string]any, len(ids))
+	for _, id := range ids {
+		expanded[id] = map[string]any{}
+	}
+	if len(ids) == 0 {
+		return expanded, nil
+	}
+	for _, name := range names {
+		relation := relations[name]
+		related, err := relation.load(app, ids)
+		if err != nil {
+			return nil, err
+		}
+		if len(nested[name]) > 0 {
+			relatedIds := []string{}
+			for _, rows := range related {
+				for _, row := range rows {
+					if id, ok := row["id"].(string); ok && !slices.Contains(relatedIds, id) {
+						relatedIds = append(relatedIds, id)
+					}
+				}
+			}
+			inner, err := Expand(app, relation.Relations, relatedIds, nested[name])
+			if err != nil {
+				return nil, err
+			}
+			for _, rows := range related {
+				for _, row := range rows {
+					if id, ok := row["id"].(string); ok {
+						row["expand"] = inner[id]
+					}
+				}
+			}
+		}
+		for _, id := range ids {
+			rows := related[id]
+			if rows == nil {
+				rows = []map[string]any{}
+			}
+			expanded[id][name] = rows
+		}
+	}
+	return expanded, nil
+}
+
+// WithExpand adds the "expand" object to v, a struct or a map encoded as
+// a JSON object.
+func WithExpand(v any, expand map[string]any) (map[string]any, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]any{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	m["expand"] = expand
+	return m, nil
+}
+
+// UserRelations are the relations ?expand= embeds in the users, and
+// TeamRelations those in the teams. Their nested relations are set in init,
+// as they refer to each other.
+var (
+	UserRelations = map[string]*Relation{
+		"teams": ManyThrough(Teams, TeamMemberships.Table, "user", "team"),
+		"posts": HasMany(Posts, "author"),
+	}
+	TeamRelations = map[string]*Relation{
+		"members": ManyThrough(Users, TeamMemberships.Table, "team", "user"),
+	}
+)
+
+func init() {
+	UserRelations["teams"].Private = true
+	UserRelations["teams"].Relations = TeamRelations
+	TeamRelations["members"].Fields = []string{"name", "avatar", "verified", "created"}
+	TeamRelations["members"].Relations = UserRelations
+}
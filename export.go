@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const (
+	ExportFormatCSV    = "csv"
+	ExportFormatJSON   = "json"
+	ExportFormatNDJSON = "ndjson"
+)
+
+var exportContentTypes = map[string]string{
+	ExportFormatCSV:    "text/csv; charset=utf-8",
+	ExportFormatJSON:   "application/json",
+	ExportFormatNDJSON: "application/x-ndjson",
+}
+
+var ExportCSVColumns = []string{"id", "email", "emailVisibility", "verified", "name", "avatar", "lastSeen", "roles", "created", "updated"}
+
+// EachUser calls fn for every user matching opts.Filter, in opts.Sort order,
+// reading them one row at a time.
+func EachUser(app core.App, opts ListOptions, fn func(user models.User) error) error {
+	q := Users.Query(app).
+		AndWhere(opts.Filter)
+	rows, err := opts.ApplySort(q, "users").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user := models.User{}
+		if err := rows.ScanStruct(&user); err != nil {
+			return err
+		}
+		if err := Users.Decrypt(&user); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// csvSafe prefixes values that spreadsheets would evaluate as formulas.
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func WriteUsersExport(app core.App, w io.Writer, format string, opts ListOptions) error {
+	switch format {
+	case ExportFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(ExportCSVColumns); err != nil {
+			return err
+		}
+		err := EachUser(app, opts, func(user models.User) error {
+			return cw.Write([]string{
+				user.Id,
+				csvSafe(user.Email),
+				strconv.FormatBool(user.EmailVisibility),
+				strconv.FormatBool(user.Verified),
+				csvSafe(user.Name),
+				csvSafe(user.Avatar),
+				user.LastSeen,
+				strings.Join(user.Roles, " "),
+				user.Created,
+				user.Updated,
+			})
+		})
+		if err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
+	case ExportFormatJSON, ExportFormatNDJSON:
+		stream := NewJSONStream(w, format)
+		err := EachUser(app, opts, func(user models.User) error {
+			return stream.Write(user)
+		})
+		if err != nil {
+			return err
+		}
+		return stream.Close()
+	}
+	return fmt.Errorf("unsupported export format %q", format)
+}
+
+func HandleExportUsers(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		query := e.Request.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = ExportFormatJSON
+		}
+		contentType, ok := exportContentTypes[format]
+		if !ok {
+			return WriteBadRequest(e, "bad request: unsupported format "+format, nil)
+		}
+
+		opts, err := ParseListOptions(query, UserSortFields, cfg)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		opts.Filter, err = ParseFilter(query.Get("filter"), UserFilterFields)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+
+		if store, _ := strconv.ParseBool(query.Get("store")); store {
+			return writeStoredExport(app, cfg, e, format, opts)
+		}
+
+		filename := "users-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+		e.Response.Header().Set("Content-Type", contentType)
+		e.Response.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		e.Response.WriteHeader(http.StatusOK)
+
+		// the status is already sent, a failure can only leave the export
+		// truncated
+		if err := WriteUsersExport(app, e.Response, format, opts); err != nil {
+			app.Logger().Error("Failed to write users export", "format", format, "error", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix starts the encrypted values, followed by the id of their
+// key and the base64 of the nonce and ciphertext: enc:<keyId>:<data>.
+const encryptedPrefix = "enc:"
+
+var (
+	ErrFieldKeyUnknown  = errors.New("the value was encrypted with an unknown key")
+	ErrFieldKeyRequired = errors.New("FIELD_ENCRYPTION_KEYS is not set")
+)
+
+// FieldEncryption encrypts the columns tagged encrypted:"true" of the
+// repositories, see Repository. It is nil when FIELD_ENCRYPTION_KEYS is
+// unset, the writes of those columns then fail.
+var FieldEncryption *FieldCipher
+
+// FieldCipher encrypts the values of the sensitive columns with AES-GCM,
+// authenticating the table and column they belong to so that they can't be
+// moved to another. It decrypts with every key it has, and encrypts with
+// the first one, so that the keys can be rotated: the new key goes first,
+// and the old one stays until the rows are re-encrypted.
+type FieldCipher struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewFieldCipher reads the keyId:key entries of FIELD_ENCRYPTION_KEYS, the
+// keys being base64 encoded 32 bytes.
+func NewFieldCipher(entries []string) (*FieldCipher, error) {
+	c := &FieldCipher{keys: map[string]cipher.AEAD{}}
+	for _, entry := range entries {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid key %q, expected keyId:base64", entry)
+		}
+		if _, ok := c.keys[id]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes encoded in base64", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.keys[id] = aead
+		if c.primary == "" {
+			c.primary = id
+		}
+	}
+	if c.primary == "" {
+		return nil, ErrFieldKeyRequired
+	}
+	return c, nil
+}
+
+// IsEncrypted reports whether the value was encrypted by a FieldCipher.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// Encrypt encrypts the value of the column with the primary key. The empty
+// values stay empty, for the columns left unset.
+func (c *FieldCipher) Encrypt(column string, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	aead := c.keys[c.primary]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(column))
+	return encryptedPrefix + c.primary + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts the value of the column. The values stored before the
+// column was encrypted are returned as is.
+func (c *FieldCipher) Decrypt(column string, value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	id, encoded, _ := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	aead, ok := c.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrFieldKeyUnknown, id)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted value of %s", column)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("decrypting %s: %w", column, err)
+	}
+	return string(plaintext), nil
+}
+
+// NeedsReencryption reports whether the value isn't encrypted with the
+// primary key, plain values included.
+func (c *FieldCipher) NeedsReencryption(value string) bool {
+	if value == "" {
+		return false
+	}
+	return !strings.HasPrefix(value, encryptedPrefix+c.primary+":")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"slices"
+	"sync"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// The routes of the user updates that aren't identified by the pattern of
+// their request.
+const (
+	GraphQLUpdateUserRoute = "graphql updateUser"
+)
+
+var ErrFieldNotWritable = validation.NewError("validation_not_writable", "is not writable")
+
+// FieldPolicy is the writable-field configuration of a route: the columns
+// every client allowed on it may write, and the ones only superusers may.
+type FieldPolicy struct {
+	Allow     []string
+	Superuser []string
+}
+
+var (
+	fieldPoliciesMu sync.RWMutex
+	fieldPolicies   = map[string]FieldPolicy{}
+	// readOnlyFields are never writable by the regular clients, whatever
+	// the policy of the route, see SetReadOnlyFields.
+	readOnlyFields []string
+)
+
+func init() {
+	userFields := FieldPolicy{Allow: []string{"email", "emailVisibility", "name", "phone", "nationalId"}}
+	RegisterFieldPolicy("PATCH /users/{userId}", userFields)
+	RegisterFieldPolicy("POST /users/batch", userFields)
+	RegisterFieldPolicy(GraphQLUpdateUserRoute, userFields)
+}
+
+// RegisterFieldPolicy sets the columns route lets the clients write. The
+// routes without a policy write none.
+func RegisterFieldPolicy(route string, policy FieldPolicy) {
+	fieldPoliciesMu.Lock()
+	defer fieldPoliciesMu.Unlock()
+	fieldPolicies[route] = policy
+}
+
+// SetReadOnlyFields sets the columns the regular clients can't write on any
+// route, from READ_ONLY_FIELDS.
+func SetReadOnlyFields(fields []string) {
+	fieldPoliciesMu.Lock()
+	defer fieldPoliciesMu.Unlock()
+	readOnlyFields = fields
+}
+
+// WritableFields returns the columns route lets a superuser, or a regular
+// client, write.
+func WritableFields(route string, superuser bool) []string {
+	fieldPoliciesMu.RLock()
+	defer fieldPoliciesMu.RUnlock()
+	policy := fieldPolicies[route]
+	if superuser {
+		return append(slices.Clone(policy.Allow), policy.Superuser...)
+	}
+	fields := []string{}
+	for _, field := range policy.Allow {
+		if !slices.Contains(readOnlyFields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// CheckWritableFields rejects the update requests setting a column route
+// doesn't let the client write, before the update is built, so that a field
+// added to the request struct isn't writable until a policy allows it.
+func CheckWritableFields(route string, superuser bool, req any) error {
+	allowed := WritableFields(route, superuser)
+	errs := validation.Errors{}
+	for _, field := range NewChangeset(req).Fields() {
+		if !slices.Contains(allowed, field) {
+			errs[field] = ErrFieldNotWritable
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
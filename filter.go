@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+)
+
+// MaxFilterTerms caps the comparisons of a filter, and MaxFilterDepth its
+// nested parentheses.
+const (
+	MaxFilterTerms = 32
+	MaxFilterDepth = 8
+)
+
+type filterTokenKind int
+
+const (
+	filterEOF filterTokenKind = iota
+	filterWord
+	filterString
+	filterOp
+	filterOpen
+	filterClose
+	filterComma
+)
+
+type filterToken struct {
+	kind  filterTokenKind
+	text  string
+	start int
+}
+
+// filterOps are the comparison operators, the two-character ones first.
+var filterOps = []string{"!=", ">=", "<=", "!~", "=", ">", "<", "~"}
+
+// lexFilter splits a filter into tokens. The values are bare words or
+// quoted with " or ', with \ escaping the quote and itself.
+func lexFilter(v string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	for i := 0; i < len(v); {
+		c := v[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '(':
+			tokens = append(tokens, filterToken{kind: filterOpen, text: "(", start: i})
+			i++
+			continue
+		case c == ')':
+			tokens = append(tokens, filterToken{kind: filterClose, text: ")", start: i})
+			i++
+			continue
+		case c == ',':
+			tokens = append(tokens, filterToken{kind: filterComma, text: ",", start: i})
+			i++
+			continue
+		case c == '"' || c == '\'':
+			b := strings.Builder{}
+			j := i + 1
+			for ; j < len(v) && v[j] != c; j++ {
+				if v[j] == '\\' && j+1 < len(v) {
+					j++
+				}
+				b.WriteByte(v[j])
+			}
+			if j == len(v) {
+				return nil, fmt.Errorf("invalid filter: unterminated string at %d", i)
+			}
+			tokens = append(tokens, filterToken{kind: filterString, text: b.String(), start: i})
+			i = j + 1
+			continue
+		}
+		if op := filterOpAt(v, i); op != "" {
+			tokens = append(tokens, filterToken{kind: filterOp, text: op, start: i})
+			i += len(op)
+			continue
+		}
+		j := i
+		for j < len(v) && !strings.ContainsRune(" \t\n\r(),\"'", rune(v[j])) && filterOpAt(v, j) == "" {
+			j++
+		}
+		tokens = append(tokens, filterToken{kind: filterWord, text: v[i:j], start: i})
+		i = j
+	}
+	return append(tokens, filterToken{kind: filterEOF, start: len(v)}), nil
+}
+
+func filterOpAt(v string, i int) string {
+	for _, op := range filterOps {
+		if strings.HasPrefix(v[i:], op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// filterParser compiles the tokens of a filter into dbx expressions, the
+// values bound as parameters.
+type filterParser struct {
+	tokens     []filterToken
+	pos        int
+	filterable map[string]FilterType
+	terms      int
+	depth      int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.tokens[p.pos]
+	if t.kind != filterEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword reports whether the next token is the keyword, in any case.
+func (p *filterParser) keyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == filterWord && strings.EqualFold(t.text, keyword)
+}
+
+// parseOr parses terms joined by OR, which binds looser than AND.
+func (p *filterParser) parseOr() (dbx.Expression, error) {
+	exps := []dbx.Expression{}
+	for {
+		exp, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exps = append(exps, exp)
+		if !p.keyword("OR") {
+			break
+		}
+		p.next()
+	}
+	if len(exps) == 1 {
+		return exps[0], nil
+	}
+	return dbx.Or(exps...), nil
+}
+
+// parseAnd parses terms joined by AND or by commas.
+func (p *filterParser) parseAnd() (dbx.Expression, error) {
+	exps := []dbx.Expression{}
+	for {
+		exp, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		exps = append(exps, exp)
+		if p.peek().kind != filterComma && !p.keyword("AND") {
+			break
+		}
+		p.next()
+	}
+	if len(exps) == 1 {
+		return exps[0], nil
+	}
+	return dbx.And(exps...), nil
+}
+
+// parseTerm parses a comparison or an expression in parentheses.
+func (p *filterParser) parseTerm() (dbx.Expression, error) {
+	t := p.next()
+	if t.kind == filterOpen {
+		if p.depth++; p.depth > MaxFilterDepth {
+			return nil, fmt.Errorf("invalid filter: more than %d nested parentheses", MaxFilterDepth)
+		}
+		exp, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != filterClose {
+			return nil, fmt.Errorf("invalid filter: expected ) at %d", closing.start)
+		}
+		p.depth--
+		return exp, nil
+	}
+	if t.kind != filterWord {
+		return nil, fmt.Errorf("invalid filter: expected a field at %d", t.start)
+	}
+	if p.terms++; p.terms > MaxFilterTerms {
+		return nil, fmt.Errorf("invalid filter: more than %d terms", MaxFilterTerms)
+	}
+
+	field := t.text
+	filterType, ok := p.filterable[field]
+	if !ok {
+		return nil, fmt.Errorf("invalid filter field %q", field)
+	}
+	op := p.next()
+	if op.kind != filterOp {
+		return nil, fmt.Errorf("invalid filter: expected an operator after %s", field)
+	}
+	// a missing value is the empty string, as in name=
+	value := ""
+	if v := p.peek(); v.kind == filterWord || v.kind == filterString {
+		value = p.next().text
+	}
+	return p.compare(field, filterType, op.text, value)
+}
+
+func (p *filterParser) compare(field string, filterType FilterType, op string, value string) (dbx.Expression, error) {
+	var typed any = value
+	switch filterType {
+	case FilterBool:
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("invalid filter operator %s for %s", op, field)
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter value %q for %s", value, field)
+		}
+		typed = b
+	case FilterNumber:
+		if op == "~" || op == "!~" {
+			return nil, fmt.Errorf("invalid filter operator %s for %s", op, field)
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter value %q for %s", value, field)
+		}
+		typed = n
+	}
+
+	switch op {
+	case "=":
+		return dbx.HashExp{field: typed}, nil
+	case "!=":
+		return dbx.Not(dbx.HashExp{field: typed}), nil
+	case "~":
+		return dbx.Like(field, value), nil
+	case "!~":
+		return dbx.NotLike(field, value), nil
+	}
+	param := fmt.Sprintf("filter%d", p.terms)
+	return dbx.NewExp(fmt.Sprintf("[[%s]] %s {:%s}", field, op, param), dbx.Params{param: typed}), nil
+}
+
+// ParseFilter parses a filter expression into a parameterized condition:
+// comparisons of a field with a value, joined with AND, OR and parentheses.
+// The operators are =, !=, >, >=, <, <=, ~ (contains) and !~. The values
+// are bare words or quoted strings, and a comma is the same as AND, so that
+// the lists of field=value terms still work. Every field must be listed in
+// filterable.
+func ParseFilter(v string, filterable map[string]FilterType) (dbx.Expression, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	tokens, err := lexFilter(v)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens, filterable: filterable}
+	exp, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != filterEOF {
+		return nil, fmt.Errorf("invalid filter: unexpected %q at %d", t.text, t.start)
+	}
+	return exp, nil
+}
+
+// FilterDescription documents the ?filter= parameter on the fields.
+func FilterDescription(filterable map[string]FilterType) string {
+	fields := make([]string, 0, len(filterable))
+	for field := range filterable {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return "Filter expression on " + strings.Join(fields, ", ") +
+		`, e.g. (name~"ann" OR verified=true) AND created>"2024-01-01". The operators are =, !=, >, >=, <, <=, ~ (contains) and !~, and a comma is the same as AND.`
+}
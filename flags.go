@@ -0,0 +1,159 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Flag is a feature flag of the flags collection. It is evaluated for a
+// requester in order: its user override, the override of one of its roles,
+// then Enabled and Rollout.
+type Flag struct {
+	Id          string `db:"id" json:"id"`
+	Name        string `db:"name" json:"name"`
+	Description string `db:"description" json:"description"`
+	Enabled     bool   `db:"enabled" json:"enabled"`
+	// Rollout is the percentage of the users the enabled flag is on for,
+	// always the same ones. The anonymous requesters only get the flags
+	// rolled out to everyone.
+	Rollout       int                 `db:"rollout" json:"rollout"`
+	UserOverrides types.JSONMap[bool] `db:"user_overrides" json:"userOverrides"`
+	RoleOverrides types.JSONMap[bool] `db:"role_overrides" json:"roleOverrides"`
+}
+
+var Flags = NewRepository[Flag]("flags")
+
+// FeatureFlags is the FlagSet IsEnabled reads, set up by main.
+var FeatureFlags *FlagSet
+
+// FlagSet caches the flags collection, reloaded on the first evaluation
+// following a change to it.
+type FlagSet struct {
+	app core.App
+
+	mu     sync.Mutex
+	flags  map[string]Flag
+	loaded bool
+}
+
+func NewFlagSet(app core.App) *FlagSet {
+	return &FlagSet{app: app}
+}
+
+// Bind invalidates the cache whenever the flags change.
+func (s *FlagSet) Bind(app core.App) {
+	invalidate := func(e *core.RecordEvent) error {
+		s.Invalidate()
+		return e.Next()
+	}
+	app.OnRecordAfterCreateSuccess(Flags.Table).BindFunc(invalidate)
+	app.OnRecordAfterUpdateSuccess(Flags.Table).BindFunc(invalidate)
+	app.OnRecordAfterDeleteSuccess(Flags.Table).BindFunc(invalidate)
+}
+
+func (s *FlagSet) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded = false
+	s.flags = nil
+}
+
+// all returns the flags by name. A failed read leaves every flag off until
+// the next change.
+func (s *FlagSet) all() map[string]Flag {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loaded {
+		return s.flags
+	}
+	flags, err := Flags.FindAll(s.app, ListOptions{})
+	if err != nil {
+		s.app.Logger().Error("Failed to load the feature flags", "error", err)
+	}
+	s.flags = make(map[string]Flag, len(flags))
+	for _, flag := range flags {
+		s.flags[flag.Name] = flag
+	}
+	s.loaded = true
+	return s.flags
+}
+
+// Evaluate reports whether the flag is on for the user with roles, "" for
+// the anonymous requesters. The unknown flags are off.
+func (s *FlagSet) Evaluate(name string, userId string, roles []string) bool {
+	flag, ok := s.all()[name]
+	if !ok {
+		return false
+	}
+	return flag.Evaluate(userId, roles)
+}
+
+// EvaluateAll evaluates every flag for the user with roles.
+func (s *FlagSet) EvaluateAll(userId string, roles []string) map[string]bool {
+	flags := s.all()
+	result := make(map[string]bool, len(flags))
+	for name, flag := range flags {
+		result[name] = flag.Evaluate(userId, roles)
+	}
+	return result
+}
+
+func (f Flag) Evaluate(userId string, roles []string) bool {
+	if on, ok := f.UserOverrides[userId]; ok && userId != "" {
+		return on
+	}
+	for _, role := range roles {
+		if on, ok := f.RoleOverrides[role]; ok {
+			return on
+		}
+	}
+	if !f.Enabled {
+		return false
+	}
+	if f.Rollout >= 100 {
+		return true
+	}
+	if userId == "" || f.Rollout <= 0 {
+		return false
+	}
+	return rolloutBucket(f.Name, userId) < f.Rollout
+}
+
+// rolloutBucket places the user in one of 100 buckets, differently for
+// every flag so that the same users don't get all the rollouts first.
+func rolloutBucket(flag string, userId string) int {
+	h := fnv.New32a()
+	h.Write([]byte(flag + ":" + userId))
+	return int(h.Sum32() % 100)
+}
+
+// flagRequester returns the user id and the roles the flags of the request
+// are evaluated for.
+func flagRequester(e *core.RequestEvent) (string, []string) {
+	if e.Auth == nil || e.Auth.Collection().Name != Users.Table {
+		return "", nil
+	}
+	return e.Auth.Id, e.Auth.GetStringSlice("roles")
+}
+
+// IsEnabled reports whether the flag is on for the requester, to gate the
+// new behaviors of the handlers.
+func IsEnabled(e *core.RequestEvent, name string) bool {
+	if FeatureFlags == nil {
+		return false
+	}
+	userId, roles := flagRequester(e)
+	return FeatureFlags.Evaluate(name, userId, roles)
+}
+
+// HandleListFlags responds with every flag evaluated for the requester.
+func HandleListFlags() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		userId, roles := flagRequester(e)
+		e.Response.Header().Set("Cache-Control", "private, no-store")
+		return WriteOK(e, "", FeatureFlags.EvaluateAll(userId, roles))
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// GeoLocation is where an IP address is, as found in the GeoIP database.
+type GeoLocation struct {
+	// Country is the ISO 3166-1 alpha-2 code, e.g. FR.
+	Country string `json:"country"`
+	Region  string `json:"region,omitempty"`
+}
+
+type geoIPRange struct {
+	start, end netip.Addr
+	location   GeoLocation
+}
+
+// GeoIPDatabase resolves the IP addresses to their country and region, from
+// the ranges held in memory, without calling any service.
+type GeoIPDatabase struct {
+	// ranges are sorted by start and don't overlap
+	ranges []geoIPRange
+}
+
+// GeoIP resolves the IP addresses of the signups. It is nil unless
+// GEOIP_DATABASE is set, in which case the signups aren't enriched.
+var GeoIP *GeoIPDatabase
+
+// LoadGeoIPDatabase reads the CSV file at path, gzipped when it ends with
+// .gz, whose lines are start,end,country[,region], start and end being the
+// first and the last IP addresses of a range, or their integer values like
+// in the IP2Location LITE files. A first line that isn't a range is
+// taken for a header and skipped.
+func LoadGeoIPDatabase(path string) (*GeoIPDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading GeoIP database: %w", err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading GeoIP database: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return ParseGeoIPDatabase(r)
+}
+
+// ParseGeoIPDatabase reads the CSV ranges of LoadGeoIPDatabase from r.
+func ParseGeoIPDatabase(r io.Reader) (*GeoIPDatabase, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	db := &GeoIPDatabase{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading GeoIP database: %w", err)
+		}
+		rng, err := parseGeoIPRange(record)
+		if err != nil && line == 1 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid GeoIP range on line %d: %w", line, err)
+		}
+		// the unknown locations of some databases are -
+		if rng.location.Country != "" && rng.location.Country != "-" {
+			db.ranges = append(db.ranges, rng)
+		}
+	}
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].start.Less(db.ranges[j].start) })
+	for i := 1; i < len(db.ranges); i++ {
+		if !db.ranges[i-1].end.Less(db.ranges[i].start) {
+			return nil, fmt.Errorf("GeoIP ranges %s and %s overlap", db.ranges[i-1].start, db.ranges[i].start)
+		}
+	}
+	return db, nil
+}
+
+func parseGeoIPRange(record []string) (geoIPRange, error) {
+	if len(record) < 3 {
+		return geoIPRange{}, errors.New("expected start,end,country[,region]")
+	}
+	start, err := parseGeoIPAddr(record[0])
+	if err != nil {
+		return geoIPRange{}, err
+	}
+	end, err := parseGeoIPAddr(record[1])
+	if err != nil {
+		return geoIPRange{}, err
+	}
+	if start.Is4() != end.Is4() || end.Less(start) {
+		return geoIPRange{}, fmt.Errorf("invalid range %s-%s", start, end)
+	}
+	rng := geoIPRange{start: start, end: end, location: GeoLocation{Country: strings.ToUpper(strings.TrimSpace(record[2]))}}
+	if len(record) > 3 {
+		rng.location.Region = strings.TrimSpace(record[3])
+	}
+	return rng, nil
+}
+
+func parseGeoIPAddr(value string) (netip.Addr, error) {
+	value = strings.TrimSpace(value)
+	if n, ok := new(big.Int).SetString(value, 10); ok {
+		switch {
+		case n.Sign() < 0 || n.BitLen() > 128:
+			return netip.Addr{}, fmt.Errorf("invalid IP address %s", value)
+		case n.BitLen() <= 32:
+			ip := [4]byte{}
+			n.FillBytes(ip[:])
+			return netip.AddrFrom4(ip), nil
+		}
+		// the IPv6 databases store the IPv4 ranges as IPv4-mapped addresses
+		ip := [16]byte{}
+		n.FillBytes(ip[:])
+		return netip.AddrFrom16(ip).Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// Len returns the number of ranges of the database.
+func (db *GeoIPDatabase) Len() int {
+	return len(db.ranges)
+}
+
+// Lookup returns the location of ip, false for the invalid and the unknown
+// addresses, e.g. the private ones.
+func (db *GeoIPDatabase) Lookup(ip string) (GeoLocation, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return GeoLocation{}, false
+	}
+	addr = addr.Unmap().WithZone("")
+	// the first range starting after addr, preceded by the one holding it
+	i := sort.Search(len(db.ranges), func(i int) bool { return addr.Less(db.ranges[i].start) })
+	if i == 0 || db.ranges[i-1].end.Less(addr) {
+		return GeoLocation{}, false
+	}
+	return db.ranges[i-1].location, true
+}
+
+// EnrichSignup stores the location of the IP address the request came from
+// on the new user, when GeoIP knows it. It never fails the signup, logging
+// the failures instead.
+func EnrichSignup(app core.App, e *core.RequestEvent, userId string) {
+	if GeoIP == nil {
+		return
+	}
+	location, ok := GeoIP.Lookup(e.RealIP())
+	if !ok {
+		return
+	}
+	err := RetryWrite(app, func() error {
+		_, err := Users.Update(app, userId, Changeset{
+			"signup_country": location.Country,
+			"signup_region":  location.Region,
+		})
+		return err
+	})
+	if err != nil {
+		app.Logger().Warn("Failed to store the signup location", "userId", userId, "error", err)
+	}
+}
+
+// CountryCount is the number of users who signed up from a country.
+type CountryCount struct {
+	Country string `json:"country" db:"country"`
+	Count   int    `json:"count" db:"count"`
+}
+
+// CountSignupsByCountry counts the users that aren't deleted by the country
+// they signed up from, most first, leaving out those whose country is
+// unknown.
+func CountSignupsByCountry(app core.App) ([]CountryCount, error) {
+	counts := []CountryCount{}
+	err := app.DB().
+		Select("[[signup_country]] AS country", "COUNT(*) AS count").
+		From(Users.Table).
+		Where(Users.scope(app)).
+		AndWhere(dbx.NewExp("[[signup_country]] != ''")).
+		GroupBy("country").
+		OrderBy("count DESC", "country").
+		All(&counts)
+	return counts, err
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file implements the subset of GraphQL that the /graphql endpoint
+// needs: query and mutation operations with variables, aliases, arguments
+// and nested selections. Fragments, directives and introspection aren't
+// supported.
+
+var ErrGraphQLSyntax = errors.New("syntax error")
+
+type gqlVariable string
+
+type gqlEnum string
+
+type gqlField struct {
+	Alias      string
+	Name       string
+	Args       map[string]any
+	Selections []gqlField
+}
+
+func (f gqlField) Key() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+type gqlVariableDef struct {
+	Name     string
+	Required bool
+	Default  any
+}
+
+type gqlOperation struct {
+	Type       string
+	Name       string
+	Variables  []gqlVariableDef
+	Selections []gqlField
+}
+
+type gqlParser struct {
+	src string
+	pos int
+	// tok is the current token, kind is one of "name", "int", "float",
+	// "string", "punct" or "" at the end of the document.
+	tok  string
+	kind string
+}
+
+// ParseGraphQL parses a document into its operations.
+func ParseGraphQL(src string) (ops []gqlOperation, err error) {
+	p := &gqlParser{src: src}
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxErr, ok := r.(gqlSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			ops, err = nil, syntaxErr
+		}
+	}()
+
+	p.next()
+	for p.kind != "" {
+		ops = append(ops, p.operation())
+	}
+	if len(ops) == 0 {
+		p.fail("document has no operations")
+	}
+	return ops, nil
+}
+
+type gqlSyntaxError struct {
+	msg string
+	pos int
+}
+
+func (e gqlSyntaxError) Error() string {
+	return fmt.Sprintf("%s at offset %d: %s", ErrGraphQLSyntax, e.pos, e.msg)
+}
+
+func (e gqlSyntaxError) Unwrap() error {
+	return ErrGraphQLSyntax
+}
+
+func (p *gqlParser) fail(format string, args ...any) {
+	panic(gqlSyntaxError{msg: fmt.Sprintf(format, args...), pos: p.pos})
+}
+
+func (p *gqlParser) next() {
+	// skip the ignored tokens: whitespace, commas and comments
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if strings.HasPrefix(p.src[p.pos:], "\uFEFF") {
+			p.pos += len("\uFEFF")
+		} else {
+			break
+		}
+	}
+	if p.pos >= len(p.src) {
+		p.tok, p.kind = "", ""
+		return
+	}
+
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+		for p.pos < len(p.src) && isGraphQLNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok, p.kind = p.src[start:p.pos], "name"
+	case c == '-' || c >= '0' && c <= '9':
+		p.pos++
+		kind := "int"
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			if c == '.' || c == 'e' || c == 'E' || (c == '+' || c == '-') && kind == "float" {
+				kind = "float"
+			} else if c < '0' || c > '9' {
+				break
+			}
+			p.pos++
+		}
+		p.tok, p.kind = p.src[start:p.pos], kind
+	case c == '"':
+		p.tok, p.kind = p.string(), "string"
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok, p.kind = "...", "punct"
+	case strings.ContainsRune("!$():=@[]{}|", rune(c)):
+		p.pos++
+		p.tok, p.kind = string(c), "punct"
+	default:
+		p.fail("unexpected character %q", c)
+	}
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+func (p *gqlParser) string() string {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		p.fail("block strings are not supported")
+	}
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+			p.fail("unterminated string")
+		}
+		c := p.src[p.pos]
+		if c == '"' {
+			p.pos++
+			return b.String()
+		}
+		if c != '\\' {
+			r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			b.WriteRune(r)
+			p.pos += size
+			continue
+		}
+		if p.pos+1 >= len(p.src) {
+			p.fail("unterminated string")
+		}
+		switch esc := p.src[p.pos+1]; esc {
+		case '"', '\\', '/':
+			b.WriteByte(esc)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if p.pos+6 > len(p.src) {
+				p.fail("invalid unicode escape")
+			}
+			code, err := strconv.ParseUint(p.src[p.pos+2:p.pos+6], 16, 32)
+			if err != nil {
+				p.fail("invalid unicode escape")
+			}
+			b.WriteRune(rune(code))
+			p.pos += 4
+		default:
+			p.fail("invalid escape \\%c", esc)
+		}
+		p.pos += 2
+	}
+}
+
+func (p *gqlParser) is(tok string) bool {
+	return p.kind != "string" && p.tok == tok
+}
+
+func (p *gqlParser) expect(tok string) {
+	if !p.is(tok) {
+		p.fail("expected %q, got %q", tok, p.tok)
+	}
+	p.next()
+}
+
+func (p *gqlParser) name() string {
+	if p.kind != "name" {
+		p.fail("expected a name, got %q", p.tok)
+	}
+	name := p.tok
+	p.next()
+	return name
+}
+
+func (p *gqlParser) operation() gqlOperation {
+	op := gqlOperation{Type: "query"}
+	if p.is("{") {
+		// the query shorthand
+		op.Selections = p.selectionSet()
+		return op
+	}
+
+	switch p.name() {
+	case "query":
+	case "mutation":
+		op.Type = "mutation"
+	case "subscription":
+		p.fail("subscriptions are not supported, use GET /users/events")
+	case "fragment":
+		p.fail("fragments are not supported")
+	default:
+		p.fail("expected an operation")
+	}
+	if p.kind == "name" {
+		op.Name = p.name()
+	}
+	if p.is("(") {
+		p.next()
+		for !p.is(")") {
+			op.Variables = append(op.Variables, p.variableDef())
+		}
+		p.next()
+	}
+	if p.is("@") {
+		p.fail("directives are not supported")
+	}
+	op.Selections = p.selectionSet()
+	return op
+}
+
+func (p *gqlParser) variableDef() gqlVariableDef {
+	p.expect("$")
+	def := gqlVariableDef{Name: p.name()}
+	p.expect(":")
+	def.Required = p.typeRef()
+	if p.is("=") {
+		p.next()
+		def.Default = p.value(true)
+	}
+	return def
+}
+
+// typeRef skips a type reference, reporting whether it is non null.
+func (p *gqlParser) typeRef() bool {
+	if p.is("[") {
+		p.next()
+		p.typeRef()
+		p.expect("]")
+	} else {
+		p.name()
+	}
+	if p.is("!") {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) selectionSet() []gqlField {
+	p.expect("{")
+	fields := []gqlField{}
+	for !p.is("}") {
+		if p.is("...") {
+			p.fail("fragments are not supported")
+		}
+		fields = append(fields, p.field())
+	}
+	p.next()
+	if len(fields) == 0 {
+		p.fail("empty selection set")
+	}
+	return fields
+}
+
+func (p *gqlParser) field() gqlField {
+	f := gqlField{Name: p.name()}
+	if p.is(":") {
+		p.next()
+		f.Alias, f.Name = f.Name, p.name()
+	}
+	if p.is("(") {
+		p.next()
+		f.Args = map[string]any{}
+		for !p.is(")") {
+			name := p.name()
+			p.expect(":")
+			f.Args[name] = p.value(false)
+		}
+		p.next()
+	}
+	if p.is("@") {
+		p.fail("directives are not supported")
+	}
+	if p.is("{") {
+		f.Selections = p.selectionSet()
+	}
+	return f
+}
+
+// value parses a value literal, which can't be a variable if isConst.
+func (p *gqlParser) value(isConst bool) any {
+	tok, kind := p.tok, p.kind
+	switch {
+	case kind == "punct" && tok == "$":
+		if isConst {
+			p.fail("unexpected variable")
+		}
+		p.next()
+		return gqlVariable(p.name())
+	case kind == "int":
+		p.next()
+		n, err := strconv.ParseInt(tok, 10, 64)
+		if err != nil {
+			p.fail("invalid int %s", tok)
+		}
+		return n
+	case kind == "float":
+		p.next()
+		n, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			p.fail("invalid float %s", tok)
+		}
+		return n
+	case kind == "string":
+		p.next()
+		return tok
+	case kind == "name":
+		p.next()
+		switch tok {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return gqlEnum(tok)
+	case kind == "punct" && tok == "[":
+		p.next()
+		list := []any{}
+		for !p.is("]") {
+			list = append(list, p.value(isConst))
+		}
+		p.next()
+		return list
+	case kind == "punct" && tok == "{":
+		p.next()
+		obj := map[string]any{}
+		for !p.is("}") {
+			name := p.name()
+			p.expect(":")
+			obj[name] = p.value(isConst)
+		}
+		p.next()
+		return obj
+	}
+	p.fail("expected a value, got %q", tok)
+	return nil
+}
+
+// gqlResolveArgs replaces the variables in the argument values with their
+// values in vars.
+func gqlResolveArgs(value any, vars map[string]any) any {
+	switch v := value.(type) {
+	case gqlVariable:
+		return vars[string(v)]
+	case gqlEnum:
+		return string(v)
+	case []any:
+		resolved := make([]any, len(v))
+		for i, item := range v {
+			resolved[i] = gqlResolveArgs(item, vars)
+		}
+		return resolved
+	case map[string]any:
+		resolved := make(map[string]any, len(v))
+		for k, item := range v {
+			resolved[k] = gqlResolveArgs(item, vars)
+		}
+		return resolved
+	}
+	return value
+}
+
+// GraphQLError is an entry of the errors of a GraphQL response.
+type GraphQLError struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// gqlObject is a JSON object that keeps the order of the selections, as
+// the GraphQL responses must.
+type gqlObject struct {
+	keys   []string
+	values map[string]any
+}
+
+func (o *gqlObject) Set(key string, value any) {
+	if o.values == nil {
+		o.values = map[string]any{}
+	}
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		rawKey, _ := json.Marshal(key)
+		buf.Write(rawKey)
+		buf.WriteByte(':')
+		rawValue, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(rawValue)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlComplete shapes a resolved value after the selections: structs (and
+// pointers to them) are reduced to the selected fields, looked up by their
+// json name, and lists are completed item by item. typeNames names the Go
+// types for __typename.
+func gqlComplete(value any, field gqlField, typeNames map[reflect.Type]string) (any, error) {
+	v := reflect.ValueOf(value)
+	for v.IsValid() && (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil, nil
+	}
+
+	switch {
+	case v.Kind() == reflect.Struct:
+		typeName, ok := typeNames[v.Type()]
+		if !ok {
+			typeName = v.Type().Name()
+		}
+		if len(field.Selections) == 0 {
+			return nil, fmt.Errorf("field %q of type %s must have a selection of subfields", field.Name, typeName)
+		}
+		obj := &gqlObject{}
+		for _, sel := range field.Selections {
+			if sel.Name == "__typename" {
+				obj.Set(sel.Key(), typeName)
+				continue
+			}
+			fv, ok := gqlStructField(v, sel.Name)
+			if !ok {
+				return nil, fmt.Errorf("cannot query field %q on type %s", sel.Name, typeName)
+			}
+			completed, err := gqlComplete(fv.Interface(), sel, typeNames)
+			if err != nil {
+				return nil, err
+			}
+			obj.Set(sel.Key(), completed)
+		}
+		return obj, nil
+	case (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() != reflect.String:
+		items := make([]any, v.Len())
+		for i := range items {
+			item, err := gqlComplete(v.Index(i).Interface(), field, typeNames)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+
+	if len(field.Selections) > 0 {
+		return nil, fmt.Errorf("field %q is a scalar and can't have a selection", field.Name)
+	}
+	return value, nil
+}
+
+func gqlStructField(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		jsonName, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if jsonName == name && t.Field(i).IsExported() {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
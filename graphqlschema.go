@@ -0,0 +1,436 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// GraphQLSchema documents the schema served at /graphql, since the endpoint
+// doesn't support introspection.
+const GraphQLSchema = `type Query {
+  user(id: ID!): User
+  "filter and sort take the same syntax as GET /users."
+  users(filter: String, sort: String, page: Int, perPage: Int): UserPage!
+}
+
+type Mutation {
+  "Superusers only."
+  createUser(input: UserCreationInput!): User!
+  "Superusers or the user itself. Email changes by the user are confirmed by email first, as with PATCH /users/{userId}."
+  updateUser(id: ID!, input: UserUpdateInput!): User!
+  "Superusers only. Soft deletes the user."
+  deleteUser(id: ID!): Boolean!
+}
+
+type User {
+  id: ID!
+  email: String!
+  emailVisibility: Boolean!
+  verified: Boolean!
+  name: String!
+  avatar: String!
+  lastSeen: String!
+  roles: [String!]!
+  loginCount: Int!
+  credits: Int!
+  completeness: Int!
+  created: String!
+  updated: String!
+}
+
+type UserPage {
+  items: [User!]!
+  page: Int!
+  perPage: Int!
+  totalItems: Int!
+  totalPages: Int!
+}
+
+input UserCreationInput {
+  email: String!
+  emailVisibility: Boolean
+  name: String
+  password: String
+  passwordConfirm: String
+}
+
+input UserUpdateInput {
+  email: String
+  emailVisibility: Boolean
+  name: String
+}
+`
+
+var graphQLTypeNames = map[reflect.Type]string{
+	reflect.TypeOf(models.User{}):                  "User",
+	reflect.TypeOf(models.ListPage[models.User]{}): "UserPage",
+}
+
+var graphQLRootTypeNames = map[string]string{"query": "Query", "mutation": "Mutation"}
+
+var (
+	ErrGraphQLForbidden      = errors.New("not allowed")
+	ErrGraphQLMutationMethod = errors.New("mutations must be sent with POST")
+)
+
+type GraphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+	Extensions    map[string]any `json:"extensions"`
+}
+
+// GraphQLResponse follows the GraphQL over HTTP format rather than APIResp,
+// which the GraphQL clients wouldn't understand.
+type GraphQLResponse struct {
+	Data   *gqlObject     `json:"data,omitempty"`
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+type gqlContext struct {
+	app           core.App
+	cfg           *Config
+	e             *core.RequestEvent
+	updateLimiter *RateLimiter
+}
+
+type gqlResolver func(ctx *gqlContext, args map[string]any) (any, error)
+
+var graphQLQueries = map[string]gqlResolver{
+	"user":  gqlUser,
+	"users": gqlUsers,
+}
+
+var graphQLMutations = map[string]gqlResolver{
+	"createUser": gqlCreateUser,
+	"updateUser": gqlUpdateUser,
+	"deleteUser": gqlDeleteUser,
+}
+
+func gqlArgString(args map[string]any, name string, required bool) (string, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		if required {
+			return "", fmt.Errorf("argument %q is required", name)
+		}
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("argument %q must be a string", name)
+	}
+	return s, nil
+}
+
+// gqlArgInput decodes the input object argument into dst, with the checks
+// of DecodeStrict.
+func gqlArgInput(args map[string]any, name string, dst any) error {
+	v, ok := args[name].(map[string]any)
+	if !ok {
+		return fmt.Errorf("argument %q must be an input object", name)
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return DecodeStrict(raw, dst)
+}
+
+// canManageUsers mirrors RequireSuperuser, which lets the API keys through.
+func (ctx *gqlContext) canManageUsers() bool {
+	if ctx.e.Auth != nil {
+		return ctx.e.HasSuperuserAuth()
+	}
+	return ctx.e.Get(apiKeyRequestKey) != nil
+}
+
+func gqlUser(ctx *gqlContext, args map[string]any) (any, error) {
+	id, err := gqlArgString(args, "id", true)
+	if err != nil {
+		return nil, err
+	}
+	user, err := GetUserById(ctx.app, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return RedactUser(ctx.e, *user), nil
+}
+
+func gqlUsers(ctx *gqlContext, args map[string]any) (any, error) {
+	query := url.Values{}
+	for _, name := range []string{"sort", "page", "perPage"} {
+		switch v := args[name].(type) {
+		case nil:
+		case string:
+			query.Set(name, v)
+		case int64:
+			query.Set(name, strconv.FormatInt(v, 10))
+		case float64:
+			query.Set(name, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			return nil, fmt.Errorf("invalid argument %q", name)
+		}
+	}
+	opts, err := ParseListOptions(query, UserSortFields, ctx.cfg)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := gqlArgString(args, "filter", false)
+	if err != nil {
+		return nil, err
+	}
+	opts.Filter, err = ParseFilter(filter, UserFilterFields)
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := CountUsers(ctx.app, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	users, err := GetUsers(ctx.app, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i, user := range users {
+		users[i] = RedactUser(ctx.e, user)
+	}
+	return NewListPage(users, opts, total), nil
+}
+
+func gqlCreateUser(ctx *gqlContext, args map[string]any) (any, error) {
+	if !ctx.canManageUsers() {
+		return nil, ErrGraphQLForbidden
+	}
+	cr := models.UserCreationRequest{}
+	if err := gqlArgInput(args, "input", &cr); err != nil {
+		return nil, err
+	}
+	var user *models.User
+	err := WithTx(ctx.app, func(txApp core.App) error {
+		var err error
+		if user, err = CreateUser(txApp, cr); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserCreated, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := QueueVerificationEmail(ctx.app, user.Id); err != nil {
+		ctx.app.Logger().Warn("Failed to queue verification email", "userId", user.Id, "error", err)
+	}
+	return user, nil
+}
+
+func gqlUpdateUser(ctx *gqlContext, args map[string]any) (any, error) {
+	id, err := gqlArgString(args, "id", true)
+	if err != nil {
+		return nil, err
+	}
+	superuser := ctx.canManageUsers()
+	if !superuser && (ctx.e.Auth == nil || ctx.e.Auth.Id != id) {
+		return nil, ErrGraphQLForbidden
+	}
+	ur := models.UserUpdateRequest{}
+	if err := gqlArgInput(args, "input", &ur); err != nil {
+		return nil, err
+	}
+	if err := CheckWritableFields(GraphQLUpdateUserRoute, superuser, ur); err != nil {
+		return nil, err
+	}
+	if err := ValidateUserUpdateRequest(ur); err != nil {
+		return nil, err
+	}
+	if err := CheckUserUpdate(ctx.app, id, ur); err != nil {
+		return nil, err
+	}
+	if ok, _ := ctx.updateLimiter.Allow(id, time.Now()); !ok {
+		return nil, errors.New("too many updates for this user, try again later")
+	}
+
+	user, err := GetUserById(ctx.app, id)
+	if err != nil {
+		return nil, err
+	}
+	pendingEmail := ""
+	if ur.Email != nil && !superuser && *ur.Email != user.Email {
+		pendingEmail = *ur.Email
+		ur.Email = nil
+	}
+	if len(NewChangeset(ur)) > 0 {
+		err = WithTx(ctx.app, func(txApp core.App) error {
+			var err error
+			if user, _, err = UpdateUserById(txApp, id, ur); err != nil {
+				return err
+			}
+			return QueueUserEvent(txApp, EventUserUpdated, user)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pendingEmail != "" {
+		if err := RequestEmailChange(ctx.app, ctx.cfg, id, pendingEmail); err != nil {
+			return nil, err
+		}
+	}
+	return RedactUser(ctx.e, *user), nil
+}
+
+func gqlDeleteUser(ctx *gqlContext, args map[string]any) (any, error) {
+	if !ctx.canManageUsers() {
+		return nil, ErrGraphQLForbidden
+	}
+	id, err := gqlArgString(args, "id", true)
+	if err != nil {
+		return nil, err
+	}
+	err = WithTx(ctx.app, func(txApp core.App) error {
+		user, err := GetUserById(txApp, id)
+		if err != nil {
+			return err
+		}
+		if err := DeleteUserById(txApp, id); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserDeleted, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// gqlErrorMessage turns the storage errors into the messages the REST
+// routes would respond with.
+func gqlErrorMessage(err error) string {
+	if errors.Is(err, sql.ErrNoRows) {
+		return "user not found"
+	}
+	if code, message := ClassifyError(err); code != CodeInternalError {
+		return message
+	}
+	return err.Error()
+}
+
+// ExecuteGraphQL runs the operation of req. The root fields are resolved in
+// order, each failing on its own with a null value and an error.
+func ExecuteGraphQL(ctx *gqlContext, req GraphQLRequest) (*GraphQLResponse, error) {
+	ops, err := ParseGraphQL(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	var op *gqlOperation
+	for i := range ops {
+		if req.OperationName == "" && len(ops) == 1 || ops[i].Name == req.OperationName {
+			op = &ops[i]
+			break
+		}
+	}
+	if op == nil {
+		if req.OperationName == "" {
+			return nil, errors.New("operationName is required for documents with several operations")
+		}
+		return nil, fmt.Errorf("unknown operation %q", req.OperationName)
+	}
+
+	resolvers := graphQLQueries
+	if op.Type == "mutation" {
+		if ctx.e.Request.Method != http.MethodPost {
+			return nil, ErrGraphQLMutationMethod
+		}
+		resolvers = graphQLMutations
+	}
+
+	vars := map[string]any{}
+	for _, def := range op.Variables {
+		v, ok := req.Variables[def.Name]
+		if !ok {
+			v = def.Default
+		}
+		if v == nil && def.Required {
+			return nil, fmt.Errorf("variable $%s is required", def.Name)
+		}
+		vars[def.Name] = v
+	}
+
+	resp := &GraphQLResponse{Data: &gqlObject{}}
+	for _, field := range op.Selections {
+		if field.Name == "__typename" {
+			resp.Data.Set(field.Key(), graphQLRootTypeNames[op.Type])
+			continue
+		}
+		resolver, ok := resolvers[field.Name]
+		if !ok {
+			return nil, fmt.Errorf("cannot query field %q on type %s", field.Name, graphQLRootTypeNames[op.Type])
+		}
+		args, _ := gqlResolveArgs(field.Args, vars).(map[string]any)
+
+		value, err := resolver(ctx, args)
+		if err == nil {
+			value, err = gqlComplete(value, field, graphQLTypeNames)
+		}
+		if err != nil {
+			resp.Data.Set(field.Key(), nil)
+			resp.Errors = append(resp.Errors, GraphQLError{Message: gqlErrorMessage(err), Path: []any{field.Key()}})
+			continue
+		}
+		resp.Data.Set(field.Key(), value)
+	}
+	return resp, nil
+}
+
+func HandleGraphQL(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	updateLimiter := NewRateLimiter(cfg.UserUpdatesPerHour, time.Hour)
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		req := GraphQLRequest{}
+		if e.Request.Method == http.MethodGet {
+			query := e.Request.URL.Query()
+			req.Query = query.Get("query")
+			req.OperationName = query.Get("operationName")
+			if v := query.Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					return e.JSON(http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: "variables must be a JSON object"}}})
+				}
+			}
+		} else if err := BindStrict(e, &req); err != nil {
+			return e.JSON(http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}})
+		}
+		if req.Query == "" {
+			return e.JSON(http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: "query is required"}}})
+		}
+
+		ctx := &gqlContext{app: app, cfg: cfg, e: e, updateLimiter: updateLimiter}
+		resp, err := ExecuteGraphQL(ctx, req)
+		if errors.Is(err, ErrGraphQLMutationMethod) {
+			e.Response.Header().Set("Allow", http.MethodPost)
+			return e.JSON(http.StatusMethodNotAllowed, GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}})
+		}
+		if err != nil {
+			return e.JSON(http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}})
+		}
+		return e.JSON(http.StatusOK, resp)
+	}
+}
+
+func HandleGraphQLSchema() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		return e.String(http.StatusOK, GraphQLSchema)
+	}
+}
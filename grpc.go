@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	usersv1 "github.com/EricFrancis12/pocketbase-demo/proto/users/v1"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/core"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcAPIKeyMetadata is the metadata the gRPC calls send their API key in,
+// APIKeyHeader as gRPC lower cases the keys.
+var grpcAPIKeyMetadata = strings.ToLower(APIKeyHeader)
+
+// grpcUserMethods are the methods of the routes the RPCs stand for, which
+// the scope of the API keys is checked against.
+var grpcUserMethods = map[string]string{
+	usersv1.UserService_ListUsers_FullMethodName:  http.MethodGet,
+	usersv1.UserService_GetUser_FullMethodName:    http.MethodGet,
+	usersv1.UserService_CreateUser_FullMethodName: http.MethodPost,
+	usersv1.UserService_UpdateUser_FullMethodName: http.MethodPatch,
+	usersv1.UserService_DeleteUser_FullMethodName: http.MethodDelete,
+}
+
+// GRPCServer serves the UserService of proto/users/v1, for the internal
+// services preferring gRPC over REST, along with grpc.health.v1. It runs
+// next to PocketBase on the same storage as the /users routes.
+type GRPCServer struct {
+	usersv1.UnimplementedUserServiceServer
+
+	app     core.App
+	cfg     *Config
+	service UserService
+	server  *grpc.Server
+	health  *health.Server
+	lis     net.Listener
+}
+
+// NewGRPCServer returns the server of service, over TLS when the config
+// has a certificate.
+func NewGRPCServer(app core.App, cfg *Config, service UserService) (*GRPCServer, error) {
+	s := &GRPCServer{app: app, cfg: cfg, service: service, health: health.NewServer()}
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(s.authenticate)}
+	if cfg.GRPCTLSCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(cfg.GRPCTLSCert, cfg.GRPCTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	s.server = grpc.NewServer(opts...)
+	usersv1.RegisterUserServiceServer(s.server, s)
+	healthpb.RegisterHealthServer(s.server, s.health)
+	return s, nil
+}
+
+// Listen binds addr, before the HTTP server is started, so that a taken
+// address fails the start of the app instead of only being logged.
+func (s *GRPCServer) Listen(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for gRPC on %s: %w", addr, err)
+	}
+	s.lis = lis
+	return nil
+}
+
+// Close releases the address bound by Listen, when the app fails to start
+// before Serve.
+func (s *GRPCServer) Close() error {
+	return s.lis.Close()
+}
+
+// Serve serves on the address bound by Listen in the background, until the
+// app terminates. The in flight calls are waited for by the graceful
+// shutdown, as the requests of the custom routes are.
+func (s *GRPCServer) Serve() {
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	s.health.SetServingStatus(usersv1.UserService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	go func() {
+		if err := s.server.Serve(s.lis); err != nil {
+			s.app.Logger().Error("gRPC server failed", "addr", s.lis.Addr().String(), "error", err)
+		}
+	}()
+	s.app.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+		s.health.Shutdown()
+		// Drain already waited for the calls, GracefulStop would wait for
+		// the health watches too, which only end with their clients
+		s.server.Stop()
+		return e.Next()
+	})
+	s.app.Logger().Info("gRPC server started", "addr", s.lis.Addr().String(), "tls", s.cfg.GRPCTLSCert != "")
+}
+
+// authenticate checks the API key of the calls, whose scope must allow the
+// method of the route the RPC stands for. The keys requiring signed
+// requests are refused, as the calls can't be signed. The health checks
+// need no key.
+func (s *GRPCServer) authenticate(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if strings.HasPrefix(info.FullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get(grpcAPIKeyMetadata)
+	if len(keys) == 0 || keys[0] == "" {
+		return nil, status.Error(codes.Unauthenticated, "authentication required")
+	}
+	apiKey, err := FindAPIKey(s.app, keys[0])
+	if errors.Is(err, ErrInvalidAPIKey) {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "error checking api key: "+err.Error())
+	}
+	now := time.Now()
+	if err := SignedRequests.Verify(ctx, apiKey, "", info.FullMethod, http.Header{}, nil, now); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	method, ok := grpcUserMethods[info.FullMethod]
+	if !ok {
+		method = http.MethodPost
+	}
+	if !apiKey.Allows(method) {
+		return nil, status.Error(codes.PermissionDenied, "api key is read only")
+	}
+	touchAPIKey(s.app, apiKey, now)
+
+	if !Drain.begin() {
+		return nil, status.Error(codes.Unavailable, "server is shutting down")
+	}
+	defer Drain.end()
+	return handler(ctx, req)
+}
+
+func (s *GRPCServer) ListUsers(ctx context.Context, req *usersv1.ListUsersRequest) (*usersv1.ListUsersResponse, error) {
+	query := url.Values{"sort": {req.Sort}}
+	if req.Page != 0 {
+		query.Set("page", strconv.Itoa(int(req.Page)))
+	}
+	if req.PerPage != 0 {
+		query.Set("perPage", strconv.Itoa(int(req.PerPage)))
+	}
+	opts, err := ParseListOptions(query, UserSortFields, s.cfg)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if opts.Filter, err = ParseFilter(req.Filter, UserFilterFields); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	total, err := s.service.Count(opts.Filter)
+	if err != nil {
+		return nil, grpcError(err, "error counting users")
+	}
+	users, err := s.service.List(opts)
+	if err != nil {
+		return nil, grpcError(err, "error getting users")
+	}
+	page := NewListPage(users, opts, total)
+	res := &usersv1.ListUsersResponse{
+		Items:      make([]*usersv1.User, len(page.Items)),
+		Page:       int32(page.Page),
+		PerPage:    int32(page.PerPage),
+		TotalItems: int32(page.TotalItems),
+		TotalPages: int32(page.TotalPages),
+	}
+	for i := range page.Items {
+		res.Items[i] = grpcUser(&page.Items[i])
+	}
+	return res, nil
+}
+
+func (s *GRPCServer) GetUser(ctx context.Context, req *usersv1.GetUserRequest) (*usersv1.User, error) {
+	user, err := s.service.Get(req.Id)
+	if err != nil {
+		return nil, grpcError(err, "error getting user")
+	}
+	return grpcUser(user), nil
+}
+
+// CreateUser creates the user as POST /users does, queuing its
+// verification email.
+func (s *GRPCServer) CreateUser(ctx context.Context, req *usersv1.CreateUserRequest) (*usersv1.User, error) {
+	user, err := s.service.Create(models.UserCreationRequest{
+		Email:           req.Email,
+		EmailVisibility: req.EmailVisibility,
+		Name:            req.Name,
+		Password:        req.Password,
+		PasswordConfirm: req.PasswordConfirm,
+	})
+	if err != nil {
+		return nil, grpcError(err, "error creating new user")
+	}
+	// the user can ask for another link, so this never fails the call
+	if err := QueueVerificationEmail(s.app, user.Id); err != nil {
+		s.app.Logger().Warn("Failed to queue verification email", "userId", user.Id, "error", err)
+	}
+	return grpcUser(user), nil
+}
+
+// UpdateUser applies the update as PATCH /users/{userId} does for a client
+// that isn't a superuser: within the writable fields of the route, and a
+// new email only being stored once confirmed through the link mailed to
+// it.
+func (s *GRPCServer) UpdateUser(ctx context.Context, req *usersv1.UpdateUserRequest) (*usersv1.User, error) {
+	ur := models.UserUpdateRequest{
+		Email:           req.Email,
+		EmailVisibility: req.EmailVisibility,
+		Name:            req.Name,
+		ExpectedUpdated: req.ExpectedUpdated,
+	}
+	if err := CheckWritableFields("PATCH /users/{userId}", false, ur); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid user: "+err.Error())
+	}
+	if err := ValidateUserUpdateRequest(ur); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid user: "+err.Error())
+	}
+	if err := s.service.CheckUpdate(req.Id, ur); err != nil {
+		return nil, grpcError(err, "error checking update")
+	}
+
+	user, err := s.service.Get(req.Id)
+	if err != nil {
+		return nil, grpcError(err, "error getting user")
+	}
+	if err := CheckUserVersion(user, ur); err != nil {
+		return nil, grpcError(err, "error checking update")
+	}
+	pendingEmail := ""
+	if ur.Email != nil && *ur.Email != user.Email {
+		pendingEmail = *ur.Email
+		ur.Email = nil
+	}
+	if pendingEmail == "" || len(NewChangeset(ur)) > 0 {
+		if user, _, err = s.service.Update(req.Id, ur); err != nil {
+			return nil, grpcError(err, "error updating user")
+		}
+	}
+	if pendingEmail != "" {
+		if err := RequestEmailChange(s.app, s.cfg, req.Id, pendingEmail); err != nil {
+			return nil, grpcError(err, "error requesting email change")
+		}
+	}
+	return grpcUser(user), nil
+}
+
+func (s *GRPCServer) DeleteUser(ctx context.Context, req *usersv1.DeleteUserRequest) (*usersv1.DeleteUserResponse, error) {
+	var err error
+	if req.Hard {
+		err = s.service.HardDelete(req.Id, nil)
+	} else {
+		err = s.service.Delete(req.Id, nil)
+	}
+	if err != nil {
+		return nil, grpcError(err, "error deleting user")
+	}
+	return &usersv1.DeleteUserResponse{}, nil
+}
+
+// grpcStatusCodes are the gRPC codes of the statuses of the error codes,
+// see ClassifyError.
+var grpcStatusCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.AlreadyExists,
+	http.StatusPreconditionFailed:    codes.FailedPrecondition,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusUnprocessableEntity:   codes.InvalidArgument,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+	http.StatusGatewayTimeout:        codes.DeadlineExceeded,
+}
+
+// grpcError is WriteError for the RPCs, the gRPC code standing for the
+// status of the error code err maps to. action prefixes the message of
+// the internal errors.
+func grpcError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, "user not found")
+	case errors.Is(err, ErrPasswordMismatch):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrUserModifiedSince):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrUserUpdateConflict):
+		return status.Error(codes.Aborted, err.Error())
+	}
+	code, message := ClassifyError(err)
+	if code == CodeInternalError {
+		return status.Error(codes.Internal, action+": "+err.Error())
+	}
+	// the details of the invalid fields, WriteError sends them as data
+	var validationErrs validation.Errors
+	if errors.As(err, &validationErrs) {
+		message += ": " + validationErrs.Error()
+	}
+	grpcCode, ok := grpcStatusCodes[ErrorStatus(code)]
+	if !ok {
+		grpcCode = codes.Unknown
+	}
+	return status.Error(grpcCode, message)
+}
+
+func grpcUser(user *models.User) *usersv1.User {
+	return &usersv1.User{
+		Id:              user.Id,
+		Email:           user.Email,
+		EmailVisibility: user.EmailVisibility,
+		Verified:        user.Verified,
+		Name:            user.Name,
+		Avatar:          user.Avatar,
+		LastSeen:        user.LastSeen,
+		Roles:           user.Roles,
+		Created:         user.Created,
+		Updated:         user.Updated,
+		LoginCount:      user.LoginCount,
+		Credits:         user.Credits,
+		Completeness:    user.Completeness,
+	}
+}
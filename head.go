@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// ServeHead answers the HEAD requests to the custom routes, served by their
+// GET handlers, with the status and headers of the GET response, its
+// Content-Length included, and no body.
+func ServeHead() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Request.Method != http.MethodHead || IsPocketBasePath(e.Request.URL.Path) {
+			return e.Next()
+		}
+
+		hw := &headResponse{ResponseWriter: e.Response}
+		e.Response = hw
+		err := e.Next()
+		e.Response = hw.ResponseWriter
+		hw.finish()
+		return err
+	}
+}
+
+// headResponse counts the body instead of sending it, holding back the
+// headers until the handler is done so that they can carry its length.
+type headResponse struct {
+	http.ResponseWriter
+	status int
+	length int
+}
+
+func (w *headResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *headResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.length += len(b)
+	return len(b), nil
+}
+
+// FlushError does nothing, the headers wait for the length of the body.
+func (w *headResponse) FlushError() error {
+	return nil
+}
+
+func (w *headResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends the headers, unless the handler wrote nothing, e.g. it
+// failed and left the response to the error handler.
+func (w *headResponse) finish() {
+	if w.status == 0 {
+		return
+	}
+	header := w.Header()
+	if header.Get("Content-Length") == "" && w.status != http.StatusNoContent && w.status != http.StatusNotModified {
+		header.Set("Content-Length", strconv.Itoa(w.length))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+const (
+	CheckOk    = "ok"
+	CheckError = "error"
+)
+
+type CheckResult struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+type Readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// ReadinessChecks are run by GET /readyz, keyed by dependency name.
+var ReadinessChecks = map[string]func(ctx context.Context, app core.App) error{
+	"database":   CheckDatabase,
+	"migrations": CheckMigrations,
+	"storage":    CheckStorage,
+}
+
+func CheckDatabase(ctx context.Context, app core.App) error {
+	_, err := app.DB().NewQuery("SELECT 1").WithContext(ctx).Execute()
+	return err
+}
+
+// CheckMigrations fails while any registered migration isn't applied yet.
+func CheckMigrations(ctx context.Context, app core.App) error {
+	applied := []string{}
+	err := app.DB().
+		Select("file").
+		From(core.DefaultMigrationsTable).
+		WithContext(ctx).
+		Column(&applied)
+	if err != nil {
+		return err
+	}
+
+	pending := []string{}
+	for _, list := range []core.MigrationsList{core.SystemMigrations, core.AppMigrations} {
+		for _, m := range list.Items() {
+			if !slices.Contains(applied, m.File) {
+				pending = append(pending, m.File)
+			}
+		}
+	}
+	if len(pending) > 0 {
+		return &PendingMigrationsError{Files: pending}
+	}
+	return nil
+}
+
+type PendingMigrationsError struct {
+	Files []string
+}
+
+func (e *PendingMigrationsError) Error() string {
+	if len(e.Files) == 1 {
+		return "pending migration " + e.Files[0]
+	}
+	return "pending migrations " + e.Files[0] + " and " + strconv.Itoa(len(e.Files)-1) + " more"
+}
+
+// CheckStorage writes and removes a small file through the app filesystem,
+// which is either the local storage or S3.
+func CheckStorage(ctx context.Context, app core.App) error {
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+	fsys.SetContext(ctx)
+
+	key := "_readyz/" + core.GenerateDefaultRandomId()
+	if err := fsys.Upload([]byte("ok"), key); err != nil {
+		return err
+	}
+	return fsys.Delete(key)
+}
+
+// CheckReadiness runs every readiness check concurrently.
+func CheckReadiness(ctx context.Context, app core.App) Readiness {
+	type named struct {
+		name   string
+		result CheckResult
+	}
+	results := make(chan named, len(ReadinessChecks))
+	for name, check := range ReadinessChecks {
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx, app)
+			result := CheckResult{Status: CheckOk, Latency: time.Since(start).String()}
+			if err != nil {
+				result.Status = CheckError
+				result.Error = err.Error()
+			}
+			results <- named{name: name, result: result}
+		}()
+	}
+
+	readiness := Readiness{Ready: true, Checks: map[string]CheckResult{}}
+	for range ReadinessChecks {
+		r := <-results
+		readiness.Checks[r.name] = r.result
+		if r.result.Status != CheckOk {
+			readiness.Ready = false
+		}
+	}
+	return readiness
+}
+
+// HandleHealthz only reports that the process is up and serving.
+func HandleHealthz() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		e.Response.Header().Set("Cache-Control", "no-store")
+		return WriteOK(e, "", map[string]string{"status": CheckOk})
+	}
+}
+
+func HandleReadyz(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		e.Response.Header().Set("Cache-Control", "no-store")
+		readiness := CheckReadiness(e.Request.Context(), app)
+		if !readiness.Ready {
+			return WriteResp(e, http.StatusServiceUnavailable, "not ready", readiness)
+		}
+		return WriteOK(e, "", readiness)
+	}
+}
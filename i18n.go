@@ -0,0 +1,215 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const languageKey = "language"
+
+//go:embed locales/*.json
+var embeddedLocales embed.FS
+
+// Catalog holds the translations of a language: the response messages keyed
+// by their English text, and the validation messages keyed by their code,
+// e.g. validation_required. Both keep the {{.param}} placeholders of the
+// ozzo-validation templates.
+type Catalog struct {
+	Messages   map[string]string `json:"messages"`
+	Validation map[string]string `json:"validation"`
+}
+
+// Catalogs are the loaded catalogs by language tag, set once at startup by
+// LoadCatalogs.
+var Catalogs = map[string]*Catalog{}
+
+// DefaultLanguage answers the requests that accept none of the Catalogs.
+var DefaultLanguage = "en"
+
+// LoadCatalogs reads every <language>.json of dir, the embedded locales when
+// dir is empty.
+func LoadCatalogs(dir string) (map[string]*Catalog, error) {
+	var fsys fs.FS
+	if dir == "" {
+		sub, err := fs.Sub(embeddedLocales, "locales")
+		if err != nil {
+			return nil, err
+		}
+		fsys = sub
+	} else {
+		fsys = os.DirFS(dir)
+	}
+
+	names, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	catalogs := map[string]*Catalog{}
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		catalog := &Catalog{}
+		if err := json.Unmarshal(data, catalog); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		catalogs[strings.ToLower(strings.TrimSuffix(name, path.Ext(name)))] = catalog
+	}
+	if len(catalogs) == 0 {
+		return nil, errors.New("no catalogs found")
+	}
+	return catalogs, nil
+}
+
+// Languages returns the tags of the loaded catalogs, sorted.
+func Languages() []string {
+	languages := make([]string, 0, len(Catalogs))
+	for language := range Catalogs {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// NegotiateLanguage returns the language of the Catalogs the Accept-Language
+// header prefers, matching a regional tag like es-MX to its base language,
+// and DefaultLanguage when it accepts none of them.
+func NegotiateLanguage(header string) string {
+	best, bestQ := DefaultLanguage, 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if tag == "*" {
+			tag = DefaultLanguage
+		}
+		if _, ok := Catalogs[tag]; !ok {
+			tag, _, _ = strings.Cut(tag, "-")
+			if _, ok := Catalogs[tag]; !ok {
+				continue
+			}
+		}
+		// ties go to the first listed language
+		if q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// Localize picks the language of the request from its Accept-Language
+// header, used by WriteResp to translate the messages.
+func Localize() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		language := NegotiateLanguage(e.Request.Header.Get("Accept-Language"))
+		e.Set(languageKey, language)
+		e.Response.Header().Set("Content-Language", language)
+		e.Response.Header().Add("Vary", "Accept-Language")
+		return e.Next()
+	}
+}
+
+// RequestLanguage returns the language picked by Localize, DefaultLanguage
+// for the requests it didn't run for.
+func RequestLanguage(e *core.RequestEvent) string {
+	if language, ok := e.Get(languageKey).(string); ok {
+		return language
+	}
+	return DefaultLanguage
+}
+
+// Translate returns message in language. The messages missing from its
+// catalog are looked up by their part before the first ": ", which is how
+// the details of an error are appended to them, and are kept in English
+// otherwise.
+func Translate(language string, message string) string {
+	catalog, ok := Catalogs[language]
+	if !ok || message == "" {
+		return message
+	}
+	if translated, ok := catalog.Messages[message]; ok {
+		return translated
+	}
+	if prefix, detail, ok := strings.Cut(message, ": "); ok {
+		if translated, ok := catalog.Messages[prefix]; ok {
+			return translated + ": " + detail
+		}
+	}
+	return message
+}
+
+// TranslateValidation returns a copy of errs whose messages are in
+// language, looked up by their code. The errors without a code or a
+// translation keep their message.
+func TranslateValidation(language string, errs validation.Errors) validation.Errors {
+	catalog, ok := Catalogs[language]
+	if !ok {
+		return errs
+	}
+	translated := make(validation.Errors, len(errs))
+	for field, err := range errs {
+		var nested validation.Errors
+		var coded validation.Error
+		switch {
+		case errors.As(err, &nested):
+			translated[field] = TranslateValidation(language, nested)
+		case errors.As(err, &coded):
+			if message, ok := catalog.Validation[coded.Code()]; ok {
+				translated[field] = coded.SetMessage(message)
+			} else {
+				translated[field] = err
+			}
+		default:
+			translated[field] = err
+		}
+	}
+	return translated
+}
+
+// TranslateFieldErrors returns a copy of errs whose messages are in
+// language, looked up by their code like the validation messages.
+func TranslateFieldErrors(language string, errs []FieldError) []FieldError {
+	catalog, ok := Catalogs[language]
+	if !ok {
+		return errs
+	}
+	translated := slices.Clone(errs)
+	for i, err := range translated {
+		if message, ok := catalog.Validation[err.Code]; ok {
+			translated[i].Message = message
+		}
+	}
+	return translated
+}
+
+// translateResp localizes the message and the validation errors of a
+// response to the language of the request.
+func translateResp(e *core.RequestEvent, message string, data any) (string, any) {
+	language := RequestLanguage(e)
+	switch v := data.(type) {
+	case validation.Errors:
+		data = TranslateValidation(language, v)
+	case []FieldError:
+		data = TranslateFieldErrors(language, v)
+	}
+	return Translate(language, message), data
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotentReplayedHeader  = "Idempotent-Replayed"
+	idempotencyMaxKeyLength   = 255
+	idempotencyKeysTable      = "_idempotency_keys"
+	idempotencyCleanupJobName = "idempotencyKeysCleanup"
+)
+
+type idempotencyEntry struct {
+	RequestHash string `db:"request_hash"`
+	Status      int    `db:"status"`
+	ContentType string `db:"content_type"`
+	Response    []byte `db:"response"`
+}
+
+// idempotencyRecorder keeps a copy of the response to replay it later.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets the router reach its own writer, e.g. for e.Status().
+func (r *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// idempotencyScope keeps the keys of different routes and clients apart.
+func idempotencyScope(e *core.RequestEvent) string {
+	principal := "ip:" + e.RealIP()
+	if e.Auth != nil {
+		principal = "auth:" + e.Auth.Collection().Id + ":" + e.Auth.Id
+	} else if apiKey, _ := e.Get(apiKeyRequestKey).(*APIKey); apiKey != nil {
+		principal = "apikey:" + apiKey.Id
+	}
+	return e.Request.Method + " " + e.Request.URL.Path + " " + principal
+}
+
+// Idempotent makes a route safe to retry with an Idempotency-Key header.
+// The first response to a key is stored for ttl and replayed for every
+// retry with the same key and body. Failures with a 5xx status aren't
+// stored, so that they can be retried. Requests without the header are
+// handled as usual.
+func Idempotent(app core.App, ttl time.Duration) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		key := e.Request.Header.Get(IdempotencyKeyHeader)
+		// a dry run mustn't claim the key of the write it previews
+		if key == "" || IsDryRun(e) {
+			return e.Next()
+		}
+		if len(key) > idempotencyMaxKeyLength {
+			return WriteBadRequest(e, "bad request: Idempotency-Key is too long", nil)
+		}
+
+		body, err := io.ReadAll(e.Request.Body)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		e.Request.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(sum[:])
+
+		scope := idempotencyScope(e)
+		claimed, err := claimIdempotencyKey(app, scope, key, requestHash, time.Now().Add(-ttl))
+		if err != nil {
+			return WriteInternalServerError(e, "error checking idempotency key: "+err.Error(), nil)
+		}
+		if !claimed {
+			return replayIdempotentResponse(app, e, scope, key, requestHash)
+		}
+
+		recorder := &idempotencyRecorder{ResponseWriter: e.Response}
+		e.Response = recorder
+		err = e.Next()
+		e.Response = recorder.ResponseWriter
+
+		if err != nil || recorder.status == 0 || recorder.status >= http.StatusInternalServerError {
+			if err := releaseIdempotencyKey(app, scope, key); err != nil {
+				app.Logger().Warn("Failed to release idempotency key", "key", key, "error", err)
+			}
+			return err
+		}
+		if err := storeIdempotentResponse(app, scope, key, recorder); err != nil {
+			app.Logger().Warn("Failed to store idempotent response", "key", key, "error", err)
+		}
+		return nil
+	}
+}
+
+// claimIdempotencyKey inserts the key as in progress, dropping it first if
+// it expired. It returns false if the key is already taken.
+func claimIdempotencyKey(app core.App, scope string, key string, requestHash string, expired time.Time) (bool, error) {
+	cutoff, err := types.ParseDateTime(expired)
+	if err != nil {
+		return false, err
+	}
+	claimed := false
+	err = WithTx(app, func(txApp core.App) error {
+		_, err := txApp.NonconcurrentDB().Delete(idempotencyKeysTable, dbx.And(
+			dbx.HashExp{"scope": scope, "key": key},
+			dbx.NewExp("created < {:cutoff}", dbx.Params{"cutoff": cutoff.String()}),
+		)).Execute()
+		if err != nil {
+			return err
+		}
+		res, err := txApp.NonconcurrentDB().NewQuery(
+			"INSERT OR IGNORE INTO " + idempotencyKeysTable + " (scope, key, request_hash, created) VALUES ({:scope}, {:key}, {:hash}, {:created})",
+		).Bind(dbx.Params{
+			"scope":   scope,
+			"key":     key,
+			"hash":    requestHash,
+			"created": types.NowDateTime().String(),
+		}).Execute()
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		claimed = affected == 1
+		return err
+	})
+	return claimed, err
+}
+
+func replayIdempotentResponse(app core.App, e *core.RequestEvent, scope string, key string, requestHash string) error {
+	entry := idempotencyEntry{}
+	err := app.DB().
+		Select("request_hash", "status", "content_type", "response").
+		From(idempotencyKeysTable).
+		Where(dbx.HashExp{"scope": scope, "key": key}).
+		One(&entry)
+	if errors.Is(err, sql.ErrNoRows) {
+		// released by a failed request in the meantime
+		return WriteConflict(e, "the request with this Idempotency-Key failed, retry it", nil)
+	}
+	if err != nil {
+		return WriteInternalServerError(e, "error checking idempotency key: "+err.Error(), nil)
+	}
+
+	if entry.RequestHash != requestHash {
+		return WriteUnprocessableEntity(e, "Idempotency-Key was already used with a different request", nil)
+	}
+	if entry.Status == 0 {
+		return WriteConflict(e, "a request with this Idempotency-Key is still in progress", nil)
+	}
+
+	e.Response.Header().Set(IdempotentReplayedHeader, "true")
+	if entry.ContentType != "" {
+		e.Response.Header().Set("Content-Type", entry.ContentType)
+	}
+	e.Response.WriteHeader(entry.Status)
+	_, err = e.Response.Write(entry.Response)
+	return err
+}
+
+func storeIdempotentResponse(app core.App, scope string, key string, recorder *idempotencyRecorder) error {
+	return RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().Update(idempotencyKeysTable, dbx.Params{
+			"status":       recorder.status,
+			"content_type": recorder.Header().Get("Content-Type"),
+			"response":     recorder.body.Bytes(),
+		}, dbx.HashExp{"scope": scope, "key": key}).Execute()
+		return err
+	})
+}
+
+func releaseIdempotencyKey(app core.App, scope string, key string) error {
+	return RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().Delete(idempotencyKeysTable, dbx.HashExp{"scope": scope, "key": key}).Execute()
+		return err
+	})
+}
+
+// DeleteExpiredIdempotencyKeys removes the keys older than ttl.
+func DeleteExpiredIdempotencyKeys(app core.App, ttl time.Duration) error {
+	cutoff, err := types.ParseDateTime(time.Now().Add(-ttl))
+	if err != nil {
+		return err
+	}
+	return RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().Delete(idempotencyKeysTable, dbx.NewExp(
+			"created < {:cutoff}", dbx.Params{"cutoff": cutoff.String()},
+		)).Execute()
+		return err
+	})
+}
+
+// ScheduleIdempotencyKeysCleanup deletes the expired keys every hour.
+func ScheduleIdempotencyKeysCleanup(app core.App, ttl time.Duration) {
+	app.Cron().MustAdd(idempotencyCleanupJobName, "0 * * * *", func() {
+		if err := DeleteExpiredIdempotencyKeys(app, ttl); err != nil {
+			app.Logger().Warn("Failed to delete expired idempotency keys", "error", err)
+		}
+	})
+}
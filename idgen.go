@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// IdGenerator returns a new row id. The ids are made of lowercase letters
+// and digits, as PocketBase expects from the records it validates, though
+// only the random ones have its default length of 15: the collections
+// given another strategy need a longer id field, see the migrations.
+type IdGenerator func() string
+
+// IdStrategies are the accepted strategies of ID_STRATEGIES. Apart from
+// random, the PocketBase default, the ids start with their creation time so
+// that they sort by it, to the millisecond.
+var IdStrategies = []string{"random", "uuidv7", "ulid", "snowflake"}
+
+// SnowflakeEpoch is the start of the snowflake timestamps, which last 69
+// years from it.
+var SnowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	idGeneratorsMu sync.RWMutex
+	idGenerators   = map[string]IdGenerator{}
+)
+
+// NewIdGenerator returns the generator of strategy, one of IdStrategies.
+// node tells the snowflake ids of the instances apart.
+func NewIdGenerator(strategy string, node int) (IdGenerator, error) {
+	switch strategy {
+	case "random":
+		return core.GenerateDefaultRandomId, nil
+	case "uuidv7":
+		return NewUUIDv7, nil
+	case "ulid":
+		return NewULID, nil
+	case "snowflake":
+		return NewSnowflakeGenerator(node)
+	}
+	return nil, fmt.Errorf("unknown id strategy %q, expected one of %s", strategy, strings.Join(IdStrategies, ", "))
+}
+
+// ParseIdStrategy parses a table=strategy entry of ID_STRATEGIES.
+func ParseIdStrategy(s string) (table string, strategy string, err error) {
+	table, strategy, ok := strings.Cut(s, "=")
+	table, strategy = strings.TrimSpace(table), strings.TrimSpace(strategy)
+	if !ok || table == "" {
+		return "", "", fmt.Errorf("invalid id strategy %q, expected table=strategy", s)
+	}
+	if !slices.Contains(IdStrategies, strategy) {
+		return "", "", fmt.Errorf("unknown id strategy %q of %s, expected one of %s", strategy, table, strings.Join(IdStrategies, ", "))
+	}
+	return table, strategy, nil
+}
+
+// SetIdStrategies sets the generators of the tables from the table=strategy
+// entries of ID_STRATEGIES. The other tables keep the random ids.
+func SetIdStrategies(entries []string, node int) error {
+	generators := map[string]IdGenerator{}
+	for _, entry := range entries {
+		table, strategy, err := ParseIdStrategy(entry)
+		if err != nil {
+			return err
+		}
+		generators[table], err = NewIdGenerator(strategy, node)
+		if err != nil {
+			return err
+		}
+	}
+	idGeneratorsMu.Lock()
+	defer idGeneratorsMu.Unlock()
+	idGenerators = generators
+	return nil
+}
+
+// NewId returns a new id for a row of table, from its generator.
+func NewId(table string) string {
+	idGeneratorsMu.RLock()
+	generate, ok := idGenerators[table]
+	idGeneratorsMu.RUnlock()
+	if !ok {
+		return core.GenerateDefaultRandomId()
+	}
+	return generate()
+}
+
+// NewUUIDv7 returns a version 7 UUID, its 48 first bits being the Unix
+// time in milliseconds, as 32 hex digits without the dashes.
+func NewUUIDv7() string {
+	var b [16]byte
+	_, _ = rand.Read(b[6:])
+	putMillis(b[:6], time.Now())
+	b[6] = 0x70 | b[6]&0x0f
+	b[8] = 0x80 | b[8]&0x3f
+	return hex.EncodeToString(b[:])
+}
+
+// crockford is the base32 alphabet of the ULIDs, lowercased.
+const crockford = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// NewULID returns a ULID, 48 bits of Unix time in milliseconds followed by
+// 80 random bits, in lowercase.
+func NewULID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[6:])
+	putMillis(b[:6], time.Now())
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	// 26 characters of 5 bits hold the 128 bits, the first one only 3
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+func putMillis(b []byte, t time.Time) {
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
+
+// NewSnowflakeGenerator returns a generator of snowflake ids: 41 bits of
+// milliseconds since SnowflakeEpoch, 10 of node and a 12 bits sequence
+// within the millisecond, as 19 zero padded digits so that they sort as
+// strings. A node running out of sequence waits for the next millisecond.
+func NewSnowflakeGenerator(node int) (IdGenerator, error) {
+	if node < 0 || node > 1023 {
+		return nil, fmt.Errorf("snowflake node %d out of range, expected 0 to 1023", node)
+	}
+	var (
+		mu       sync.Mutex
+		last     int64
+		sequence int64
+	)
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		ms := time.Since(SnowflakeEpoch).Milliseconds()
+		if ms < last {
+			// the clock went back, keep counting from the last millisecond
+			ms = last
+		}
+		if ms == last {
+			sequence = (sequence + 1) & 0xfff
+			if sequence == 0 {
+				for ms <= last {
+					time.Sleep(time.Millisecond / 10)
+					ms = time.Since(SnowflakeEpoch).Milliseconds()
+				}
+			}
+		} else {
+			sequence = 0
+		}
+		last = ms
+		id := ms<<22 | int64(node)<<12 | sequence
+		s := strconv.FormatInt(id, 10)
+		return strings.Repeat("0", 19-len(s)) + s
+	}, nil
+}
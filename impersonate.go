@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// ImpersonatedByHeader is set on the responses to the impersonated
+// requests, to the id of the superuser behind them.
+const ImpersonatedByHeader = "X-Impersonated-By"
+
+// impersonatorClaim holds the superuser id in the impersonation tokens.
+const impersonatorClaim = "impersonator"
+
+const impersonatorRequestKey = "impersonator"
+
+var ErrImpersonationRefresh = errors.New("impersonation tokens can't be refreshed")
+
+type ImpersonationResponse struct {
+	Token        string       `json:"token"`
+	User         *models.User `json:"user"`
+	Impersonator string       `json:"impersonator"`
+	ExpiresAt    string       `json:"expiresAt"`
+}
+
+// NewImpersonationToken issues a PocketBase auth token for the users
+// record, which PocketBase accepts like any other but won't refresh, with
+// the id of the superuser impersonating the user.
+func NewImpersonationToken(record *core.Record, superuserId string, ttl time.Duration) (string, error) {
+	claims := map[string]any{
+		core.TokenClaimType:         core.TokenTypeAuth,
+		core.TokenClaimId:           record.Id,
+		core.TokenClaimCollectionId: record.Collection().Id,
+		core.TokenClaimRefreshable:  false,
+		impersonatorClaim:           superuserId,
+	}
+	return security.NewJWT(claims, record.TokenKey()+record.Collection().AuthToken.Secret, ttl)
+}
+
+// TrackImpersonation marks the requests made with an impersonation token,
+// see Impersonator, so that their audit logs name the superuser.
+func TrackImpersonation() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil || e.Auth.Collection().Name != Users.Table {
+			return e.Next()
+		}
+		// PocketBase has already checked the signature of the token
+		token := strings.TrimPrefix(e.Request.Header.Get("Authorization"), "Bearer ")
+		claims, err := security.ParseUnverifiedJWT(token)
+		if err != nil {
+			return e.Next()
+		}
+		if superuserId, _ := claims[impersonatorClaim].(string); superuserId != "" {
+			e.Set(impersonatorRequestKey, superuserId)
+			e.Response.Header().Set(ImpersonatedByHeader, superuserId)
+		}
+		return e.Next()
+	}
+}
+
+// Impersonator returns the id of the superuser impersonating the requester,
+// "" for the regular requests.
+func Impersonator(e *core.RequestEvent) string {
+	superuserId, _ := e.Get(impersonatorRequestKey).(string)
+	return superuserId
+}
+
+// HandleImpersonate issues a short lived token acting as the user, for the
+// support staff to reproduce their issues. AuditMutations records the
+// impersonation, and every request made with the token.
+func HandleImpersonate(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		user, err := GetUserById(app, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+		record, err := app.FindRecordById(Users.Table, userId)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+
+		expires := time.Now().Add(cfg.ImpersonationTTL)
+		token, err := NewImpersonationToken(record, e.Auth.Id, cfg.ImpersonationTTL)
+		if err != nil {
+			return WriteInternalServerError(e, "error issuing token: "+err.Error(), nil)
+		}
+		app.Logger().Info("Superuser impersonating user", "superuserId", e.Auth.Id, "userId", userId, "requestId", RequestId(e))
+		return WriteOK(e, "", &ImpersonationResponse{
+			Token:        token,
+			User:         user,
+			Impersonator: e.Auth.Id,
+			ExpiresAt:    expires.UTC().Format(time.RFC3339),
+		})
+	}
+}
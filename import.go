@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var ErrImportUnsupportedFormat = errors.New("unsupported import format, expected text/csv or application/json")
+
+// ImportCSVColumns are the columns accepted in the header row of a CSV import.
+var ImportCSVColumns = []string{"email", "emailVisibility", "name", "password"}
+
+type ImportRowResult struct {
+	Row   int    `json:"row"`
+	Email string `json:"email,omitempty"`
+	Id    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type ImportReport struct {
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+// ImportRowError is returned by an ImportReader for a row that can't be
+// parsed, the rows after it can still be read.
+type ImportRowError struct {
+	Err error
+}
+
+func (e *ImportRowError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ImportRowError) Unwrap() error {
+	return e.Err
+}
+
+// ImportReader reads the rows of an import one at a time, returning io.EOF
+// after the last one.
+type ImportReader interface {
+	Next() (models.UserCreationRequest, error)
+}
+
+type csvImportReader struct {
+	r       *csv.Reader
+	columns []string
+}
+
+func NewCSVImportReader(r io.Reader) (ImportReader, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading csv header: %w", err)
+	}
+	for _, col := range header {
+		if !slices.Contains(ImportCSVColumns, col) {
+			return nil, fmt.Errorf("unknown csv column %q", col)
+		}
+	}
+	if !slices.Contains(header, "email") {
+		return nil, errors.New("csv header must include an email column")
+	}
+	// rows are allowed to have a different number of fields than the
+	// header, which is reported per row below
+	cr.FieldsPerRecord = -1
+	return &csvImportReader{r: cr, columns: header}, nil
+}
+
+func (r *csvImportReader) Next() (models.UserCreationRequest, error) {
+	cr := models.UserCreationRequest{}
+	record, err := r.r.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return cr, &ImportRowError{Err: err}
+		}
+		return cr, err
+	}
+	if len(record) != len(r.columns) {
+		return cr, &ImportRowError{Err: fmt.Errorf("expected %d fields, got %d", len(r.columns), len(record))}
+	}
+	for i, col := range r.columns {
+		value := record[i]
+		switch col {
+		case "email":
+			cr.Email = value
+		case "name":
+			cr.Name = value
+		case "password":
+			cr.Password = value
+			cr.PasswordConfirm = value
+		case "emailVisibility":
+			if value == "" {
+				continue
+			}
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return cr, &ImportRowError{Err: fmt.Errorf("invalid emailVisibility %q", value)}
+			}
+			cr.EmailVisibility = b
+		}
+	}
+	return cr, nil
+}
+
+type jsonImportReader struct {
+	dec *json.Decoder
+}
+
+// NewJSONImportReader reads a JSON array of UserCreationRequest objects
+// without loading the whole array in memory.
+func NewJSONImportReader(r io.Reader) (ImportReader, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("error reading json: %w", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("expected a JSON array of users")
+	}
+	return &jsonImportReader{dec: dec}, nil
+}
+
+func (r *jsonImportReader) Next() (models.UserCreationRequest, error) {
+	cr := models.UserCreationRequest{}
+	if !r.dec.More() {
+		if _, err := r.dec.Token(); err != nil {
+			return cr, err
+		}
+		return cr, io.EOF
+	}
+
+	raw := json.RawMessage{}
+	if err := r.dec.Decode(&raw); err != nil {
+		return cr, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cr); err != nil {
+		return cr, &ImportRowError{Err: err}
+	}
+	if cr.PasswordConfirm == "" {
+		cr.PasswordConfirm = cr.Password
+	}
+	return cr, nil
+}
+
+func NewImportReader(contentType string, r io.Reader) (ImportReader, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return NewCSVImportReader(r)
+	case "application/json":
+		return NewJSONImportReader(r)
+	}
+	return nil, ErrImportUnsupportedFormat
+}
+
+type importRow struct {
+	result ImportRowResult
+	cr     models.UserCreationRequest
+}
+
+// ImportUsers validates every row read from r and inserts the valid ones in
+// transactions of batchSize rows. A row that fails doesn't fail its batch,
+// it is only reported as failed.
+func ImportUsers(app core.App, r ImportReader, batchSize int) (*ImportReport, error) {
+	report := &ImportReport{Rows: []ImportRowResult{}}
+	seen := map[string]int{}
+	batch := []importRow{}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		results := make([]ImportRowResult, len(batch))
+		err := WithTx(app, func(txApp core.App) error {
+			for i, row := range batch {
+				results[i] = row.result
+				user, err := InsertUser(txApp, row.cr)
+				if err != nil {
+					if IsBusyError(err) || errors.Is(err, ErrDatabaseBusy) {
+						return err
+					}
+					results[i].Error = err.Error()
+					continue
+				}
+				results[i].Id = user.Id
+				if err := QueueUserEvent(txApp, EventUserCreated, user); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			if result.Error != "" {
+				report.Failed++
+			} else {
+				report.Created++
+			}
+			report.Rows = append(report.Rows, result)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	fail := func(result ImportRowResult, err error) {
+		result.Error = err.Error()
+		report.Failed++
+		report.Rows = append(report.Rows, result)
+	}
+
+	for rowNum := 1; ; rowNum++ {
+		cr, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		result := ImportRowResult{Row: rowNum, Email: cr.Email}
+		var rowErr *ImportRowError
+		if errors.As(err, &rowErr) {
+			fail(result, rowErr)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ValidateUserCreationRequest(cr); err != nil {
+			fail(result, err)
+			continue
+		}
+		email := strings.ToLower(cr.Email)
+		if first, ok := seen[email]; ok {
+			fail(result, fmt.Errorf("duplicate of row %d", first))
+			continue
+		}
+		seen[email] = rowNum
+		if err := CheckEmailAvailable(app, "", cr.Email); err != nil {
+			if !errors.Is(err, ErrEmailTaken) {
+				return nil, err
+			}
+			fail(result, err)
+			continue
+		}
+
+		batch = append(batch, importRow{result: result, cr: cr})
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	// failed rows are reported right away and the valid ones once their
+	// batch is written, put them back in input order
+	sort.Slice(report.Rows, func(i, j int) bool {
+		return report.Rows[i].Row < report.Rows[j].Row
+	})
+	return report, nil
+}
+
+func HandleImportUsers(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		r, err := NewImportReader(e.Request.Header.Get("Content-Type"), e.Request.Body)
+		if errors.Is(err, ErrImportUnsupportedFormat) {
+			return WriteUnsupportedMediaType(e, err.Error(), nil)
+		}
+		if limit, ok := IsBodyTooLarge(err); ok {
+			return writeBodyTooLarge(e, limit)
+		}
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+
+		report, err := ImportUsers(app, r, cfg.ImportBatchSize)
+		if limit, ok := IsBodyTooLarge(err); ok {
+			return writeBodyTooLarge(e, limit)
+		}
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error importing users")
+		}
+		return WriteOK(e, "", report)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// InboundEventsCollection stores the events received on POST
+// /hooks/{provider}, see HandleInboundHook.
+const InboundEventsCollection = "inbound_events"
+
+// The statuses of the inbound events. The failed ones are run again when
+// the provider redelivers them, the others are skipped.
+const (
+	InboundProcessed = "processed"
+	InboundIgnored   = "ignored"
+	InboundFailed    = "failed"
+)
+
+var (
+	ErrHookSignature = errors.New("invalid signature")
+	ErrHookTimestamp = errors.New("signature timestamp outside the tolerance")
+)
+
+// HookVerifier checks the signature of a delivery, made with secret, over
+// its raw body. tolerance bounds the age of the signed timestamps.
+type HookVerifier func(header http.Header, body []byte, secret []byte, now time.Time, tolerance time.Duration) error
+
+// InboundEvent is a delivery of a provider whose signature was verified.
+type InboundEvent struct {
+	Provider string
+	Id       string
+	Type     string
+	// Payload is the decoded body, Raw the body as received.
+	Payload map[string]any
+	Raw     []byte
+}
+
+// Field returns the value at the dotted path of the payload, e.g.
+// data.object.id.
+func (e *InboundEvent) Field(path string) (any, bool) {
+	return payloadField(e.Payload, path)
+}
+
+// InboundHandler ingests the events of a type.
+type InboundHandler struct {
+	// Required maps the dotted paths of the payload the handler reads to
+	// their JSON type: string, number, bool, object or array. The events
+	// missing one are rejected before Handle runs.
+	Required map[string]string
+	// Handle runs in a transaction, which also marks the event processed,
+	// so that an event is ingested once even when redelivered. Returning
+	// an error fails the delivery, for the provider to retry it.
+	Handle func(app core.App, event *InboundEvent) error
+}
+
+// HookProvider describes how a third party signs its deliveries and where
+// they carry the id and the type of their event: in the payload, at the
+// dotted IdField and TypeField paths, or in the IdHeader and TypeHeader.
+type HookProvider struct {
+	Verify     HookVerifier
+	IdField    string
+	TypeField  string
+	IdHeader   string
+	TypeHeader string
+
+	handlers map[string]InboundHandler
+}
+
+// HookProviders are the providers POST /hooks/{provider} accepts, once
+// HOOK_SECRETS has a secret for them.
+var HookProviders = map[string]*HookProvider{
+	"stripe": {
+		Verify:    TimestampedSignature("Stripe-Signature"),
+		IdField:   "id",
+		TypeField: "type",
+	},
+	"github": {
+		Verify:     BodySignature("X-Hub-Signature-256", "sha256="),
+		IdHeader:   "X-GitHub-Delivery",
+		TypeHeader: "X-GitHub-Event",
+	},
+}
+
+// RegisterInboundHandler sets the handler of the events of eventType sent
+// by provider, e.g. in an init:
+//
+//	RegisterInboundHandler("stripe", "customer.created", InboundHandler{
+//		Required: map[string]string{"data.object.email": "string"},
+//		Handle:   func(app core.App, event *InboundEvent) error { ... },
+//	})
+//
+// The events without a handler are acknowledged and recorded as ignored.
+func RegisterInboundHandler(provider string, eventType string, handler InboundHandler) {
+	p, ok := HookProviders[provider]
+	if !ok {
+		panic("unknown hook provider " + provider)
+	}
+	if p.handlers == nil {
+		p.handlers = map[string]InboundHandler{}
+	}
+	p.handlers[eventType] = handler
+}
+
+// TimestampedSignature verifies the Stripe-style signatures, sent in the
+// header as t=<unix time>,v1=<hex(hmac_sha256(secret, t + "." + body))>,
+// with a v1 for each secret being rotated. The timestamp keeps the old
+// deliveries from being replayed.
+func TimestampedSignature(header string) HookVerifier {
+	return func(h http.Header, body []byte, secret []byte, now time.Time, tolerance time.Duration) error {
+		timestamp := ""
+		signatures := []string{}
+		for _, part := range strings.Split(h.Get(header), ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch key {
+			case "t":
+				timestamp = value
+			case "v1":
+				signatures = append(signatures, value)
+			}
+		}
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || len(signatures) == 0 {
+			return ErrHookSignature
+		}
+		if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+			return ErrHookTimestamp
+		}
+		expected := []byte(SignWebhookPayload(secret, timestamp, body))
+		for _, signature := range signatures {
+			if hmac.Equal(expected, []byte(signature)) {
+				return nil
+			}
+		}
+		return ErrHookSignature
+	}
+}
+
+// BodySignature verifies the signatures sent in the header as
+// prefix + hex(hmac_sha256(secret, body)), e.g. sha256=... by GitHub.
+func BodySignature(header string, prefix string) HookVerifier {
+	return func(h http.Header, body []byte, secret []byte, now time.Time, tolerance time.Duration) error {
+		signature, ok := strings.CutPrefix(h.Get(header), prefix)
+		if !ok {
+			return ErrHookSignature
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(signature)) {
+			return ErrHookSignature
+		}
+		return nil
+	}
+}
+
+// ParseHookSecrets reads the provider:secret entries of HOOK_SECRETS. A
+// provider can have several secrets while one is being rotated.
+func ParseHookSecrets(entries []string) (map[string][][]byte, error) {
+	secrets := map[string][][]byte{}
+	for _, entry := range entries {
+		provider, secret, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		// the entry is left out of the errors, it may be a secret
+		if !ok || secret == "" {
+			return nil, errors.New("invalid entry, expected provider:secret")
+		}
+		if _, ok := HookProviders[provider]; !ok {
+			return nil, fmt.Errorf("unknown hook provider %q", provider)
+		}
+		secrets[provider] = append(secrets[provider], []byte(secret))
+	}
+	return secrets, nil
+}
+
+func payloadField(payload map[string]any, path string) (any, bool) {
+	var current any = payload
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case json.Number, float64:
+		return "number"
+	case bool:
+		return "bool"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	}
+	return "null"
+}
+
+// CheckPayload validates the fields of the event the handler requires.
+func (h InboundHandler) CheckPayload(event *InboundEvent) error {
+	errs := validation.Errors{}
+	for path, want := range h.Required {
+		value, ok := event.Field(path)
+		if !ok {
+			errs[path] = validation.ErrRequired
+		} else if got := jsonType(value); got != want {
+			errs[path] = fmt.Errorf("must be a %s, not a %s", want, got)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// parseInboundEvent decodes the body of a verified delivery and finds the
+// id and the type of its event.
+func (p *HookProvider) parseInboundEvent(provider string, header http.Header, body []byte) (*InboundEvent, error) {
+	payload := map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, validation.Errors{"body": errors.New("must be a JSON object")}
+	}
+	event := &InboundEvent{Provider: provider, Payload: payload, Raw: body}
+
+	errs := validation.Errors{}
+	for _, f := range []struct {
+		dst          *string
+		field        string
+		header, name string
+	}{{&event.Id, p.IdField, p.IdHeader, "id"}, {&event.Type, p.TypeField, p.TypeHeader, "type"}} {
+		if f.header != "" {
+			*f.dst = header.Get(f.header)
+		} else if v, ok := event.Field(f.field); ok {
+			*f.dst, _ = v.(string)
+		}
+		if *f.dst == "" {
+			errs[f.name] = validation.ErrRequired
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return event, nil
+}
+
+// findInboundEvent returns the record of a previous delivery of the event,
+// or nil.
+func findInboundEvent(app core.App, event *InboundEvent) (*core.Record, error) {
+	record, err := app.FindFirstRecordByFilter(InboundEventsCollection,
+		"provider = {:provider} && event_id = {:id}",
+		dbx.Params{"provider": event.Provider, "id": event.Id})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return record, err
+}
+
+// IngestInboundEvent runs the handler of the event, if any, unless a
+// previous delivery of the event was processed or ignored, and records the
+// outcome. It reports whether the event was a duplicate.
+func IngestInboundEvent(app core.App, provider *HookProvider, event *InboundEvent) (bool, error) {
+	record, err := findInboundEvent(app, event)
+	if err != nil {
+		return false, err
+	}
+	if record != nil && record.GetString("status") != InboundFailed {
+		return true, nil
+	}
+	if record == nil {
+		collection, err := app.FindCachedCollectionByNameOrId(InboundEventsCollection)
+		if err != nil {
+			return false, err
+		}
+		record = core.NewRecord(collection)
+		record.Set("provider", event.Provider)
+		record.Set("event_id", event.Id)
+	}
+	record.Set("type", event.Type)
+	record.Set("payload", string(event.Raw))
+	record.Set("attempts", record.GetInt("attempts")+1)
+	record.Set("error", "")
+
+	handler, ok := provider.handlers[event.Type]
+	if !ok {
+		record.Set("status", InboundIgnored)
+		return false, RetryWrite(app, func() error { return app.Save(record) })
+	}
+	err = WithTx(app, func(txApp core.App) error {
+		if err := handler.Handle(txApp, event); err != nil {
+			return err
+		}
+		record.Set("status", InboundProcessed)
+		return txApp.Save(record)
+	})
+	if err == nil {
+		return false, nil
+	}
+
+	// the transaction rolled the record back, write the failure on its own
+	record.Set("status", InboundFailed)
+	record.Set("error", PII.String(err.Error()))
+	if saveErr := RetryWrite(app, func() error { return app.Save(record) }); saveErr != nil {
+		app.Logger().Warn("Failed to record the inbound event failure", "provider", event.Provider, "eventId", event.Id, "error", saveErr)
+	}
+	return false, err
+}
+
+// HandleInboundHook receives the events of the third parties on POST
+// /hooks/{provider}. The deliveries must be signed with one of the
+// HOOK_SECRETS of the provider, within HOOK_TOLERANCE for the timestamped
+// signatures, and carry the fields their handler requires. They are
+// answered with a 2xx once ingested, ignored or already processed, and
+// with a 5xx when the handler fails, for the provider to retry.
+func HandleInboundHook(app core.App, cfg *Config) func(e *core.RequestEvent) error {
+	secrets, _ := ParseHookSecrets(cfg.HookSecrets)
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		name := e.Request.PathValue("provider")
+		provider, ok := HookProviders[name]
+		if !ok || len(secrets[name]) == 0 {
+			return WriteNotFound(e, "unknown hook provider "+name, nil)
+		}
+
+		body, err := io.ReadAll(e.Request.Body)
+		if limit, ok := IsBodyTooLarge(err); ok {
+			return writeBodyTooLarge(e, limit)
+		}
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+
+		now := time.Now()
+		verifyErr := ErrHookSignature
+		for _, secret := range secrets[name] {
+			if verifyErr = provider.Verify(e.Request.Header, body, secret, now, cfg.HookTolerance); verifyErr == nil {
+				break
+			}
+		}
+		if verifyErr != nil {
+			return WriteErrorCode(e, CodeInvalidSignature, verifyErr.Error(), nil)
+		}
+
+		event, err := provider.parseInboundEvent(name, e.Request.Header, body)
+		if err != nil {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid event", err)
+		}
+		if handler, ok := provider.handlers[event.Type]; ok {
+			if err := handler.CheckPayload(event); err != nil {
+				return WriteErrorCode(e, CodeValidationFailed, "invalid "+event.Type+" event", err)
+			}
+		}
+
+		duplicate, err := IngestInboundEvent(app, provider, event)
+		if err != nil {
+			return WriteError(e, err, "error ingesting event "+event.Id)
+		}
+		if duplicate {
+			return WriteOK(e, "event already processed", nil)
+		}
+		return WriteOK(e, "", nil)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/dbutils"
+)
+
+// IndexedListing describes the columns a list route sorts and filters a
+// table by, which CheckQueryIndexes expects an index for.
+type IndexedListing struct {
+	Table string
+	// Scope are the columns the repository of the table always matches by
+	// equality, e.g. the tenant, which an index can start with.
+	Scope  []string
+	Fields []string
+}
+
+// NewIndexedListing returns the listing of the repository, sorted by the
+// sort fields and filtered by the filter ones. The boolean filters are left
+// out, an index not narrowing them down much.
+func NewIndexedListing[T any](repo *Repository[T], sortFields []string, filterFields map[string]FilterType) IndexedListing {
+	listing := IndexedListing{Table: repo.Table}
+	for _, column := range []string{repo.TenantColumn, repo.SoftDeleteColumn} {
+		if column != "" {
+			listing.Scope = append(listing.Scope, column)
+		}
+	}
+	listing.Fields = slices.Clone(sortFields)
+	for field, filterType := range filterFields {
+		if filterType != FilterBool && !slices.Contains(listing.Fields, field) {
+			listing.Fields = append(listing.Fields, field)
+		}
+	}
+	sort.Strings(listing.Fields)
+	return listing
+}
+
+// IndexedListings are the listings of the list routes, see
+// CheckQueryIndexes.
+func IndexedListings() []IndexedListing {
+	return []IndexedListing{
+		NewIndexedListing(Users, UserSortFields, UserFilterFields),
+		NewIndexedListing(Posts, PostSortFields, PostFilterFields),
+		NewIndexedListing(AuditLogs, AuditSortFields, AuditFilterFields),
+		NewIndexedListing(Jobs, JobSortFields, JobFilterFields),
+		NewIndexedListing(ModerationItems, ModerationSortFields, ModerationFilterFields),
+		NewIndexedListing(RetentionRuns, RetentionRunSortFields, RetentionRunFilterFields),
+	}
+}
+
+// UnindexedFields returns the fields of the listing no index of indexes, the
+// CREATE INDEX statements of its table, can look up: none starts with the
+// field, once past the scope columns it may start with. The id is always
+// indexed as the primary key.
+func UnindexedFields(listing IndexedListing, indexes []string) []string {
+	leading := map[string]bool{"id": true}
+	for _, sql := range indexes {
+		for _, column := range dbutils.ParseIndex(sql).Columns {
+			leading[column.Name] = true
+			if !slices.Contains(listing.Scope, column.Name) {
+				break
+			}
+		}
+	}
+	unindexed := []string{}
+	for _, field := range listing.Fields {
+		if !leading[field] {
+			unindexed = append(unindexed, field)
+		}
+	}
+	return unindexed
+}
+
+// CheckQueryIndexes warns of the fields the list routes sort or filter by
+// without an index, which make their queries scan the whole table. The
+// indexes are created by the migrations; the warnings point at the ones
+// missing.
+func CheckQueryIndexes(app core.App) {
+	for _, listing := range IndexedListings() {
+		indexes, err := app.TableIndexes(listing.Table)
+		if err != nil {
+			app.Logger().Warn("Failed to read the indexes", "table", listing.Table, "error", err)
+			continue
+		}
+		sqls := make([]string, 0, len(indexes))
+		for _, sql := range indexes {
+			sqls = append(sqls, sql)
+		}
+		if fields := UnindexedFields(listing, sqls); len(fields) > 0 {
+			app.Logger().Warn("List fields without an index, add one in a migration if they are queried often",
+				"table", listing.Table, "fields", strings.Join(fields, ", "))
+		}
+	}
+}
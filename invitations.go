@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+var (
+	ErrInviteOnly         = errors.New("signing up requires an invitation")
+	ErrInvitationInvalid  = errors.New("invalid invitation token")
+	ErrInvitationExpired  = errors.New("invitation expired")
+	ErrInvitationRevoked  = errors.New("invitation was revoked")
+	ErrInvitationAccepted = errors.New("invitation was already accepted")
+)
+
+// Invitation lets its invitee sign up, once, while INVITE_ONLY closes
+// POST /auth/register.
+type Invitation struct {
+	Id       string `db:"id" json:"id"`
+	Email    string `db:"email" json:"email"`
+	Name     string `db:"name" json:"name"`
+	Role     string `db:"role" json:"role"`
+	TenantId string `db:"tenant_id" json:"-"`
+	Expires  string `db:"expires" json:"expires"`
+	Accepted string `db:"accepted" json:"accepted"`
+	User     string `db:"user" json:"user"`
+	Revoked  string `db:"revoked" json:"revoked"`
+	Created  string `db:"created" json:"created"`
+	Updated  string `db:"updated" json:"updated"`
+}
+
+// InvitationView is the prefilled data of GET /invitations/{token}.
+type InvitationView struct {
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+	Expires string `json:"expires"`
+}
+
+type InvitationRequest struct {
+	Email string `json:"email" binding:"required"`
+	Name  string `json:"name" binding:"max=255"`
+	Role  string `json:"role"`
+}
+
+type AcceptInvitationRequest struct {
+	Name            string `json:"name" binding:"max=255"`
+	EmailVisibility bool   `json:"emailVisibility"`
+	Password        string `json:"password" binding:"required"`
+	PasswordConfirm string `json:"passwordConfirm" binding:"required"`
+}
+
+var Invitations = &Repository[Invitation]{Table: "invitations", TenantColumn: "tenant_id"}
+
+// SignInvitationToken returns a token for the invitation and its email.
+func SignInvitationToken(secret []byte, invitationId string, email string, expires time.Time) string {
+	return signUserToken(secret, "invitation", invitationId, email, expires)
+}
+
+// VerifyInvitationToken checks the token signature and expiry and returns
+// the invitation id and email it was issued for.
+func VerifyInvitationToken(secret []byte, token string, now time.Time) (string, string, error) {
+	invitationId, email, err := verifyUserToken(secret, "invitation", token, now)
+	if errors.Is(err, errTokenExpired) {
+		return "", "", ErrInvitationExpired
+	}
+	if err != nil {
+		return "", "", ErrInvitationInvalid
+	}
+	return invitationId, email, nil
+}
+
+// CreateInvitation stores an invitation for the email, unless a user has
+// it, and mails the link to it. The invitation isn't kept if the email
+// can't be sent.
+func CreateInvitation(app core.App, cfg *Config, ir InvitationRequest, now time.Time) (*Invitation, error) {
+	if _, err := mail.ParseAddress(ir.Email); err != nil {
+		return nil, validation.Errors{"email": validation.NewError("validation_invalid_email", "must be a valid email address")}
+	}
+	if ir.Role != "" && !slices.Contains(Roles, ir.Role) {
+		return nil, ErrInvalidRole
+	}
+	collection, err := app.FindCachedCollectionByNameOrId(Invitations.Table)
+	if err != nil {
+		return nil, err
+	}
+	expires, err := types.ParseDateTime(now.Add(cfg.InvitationTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	var invitation *Invitation
+	err = WithTx(app, func(txApp core.App) error {
+		if err := CheckEmailAvailable(txApp, "", ir.Email); err != nil {
+			return err
+		}
+		record := core.NewRecord(collection)
+		record.Set("email", ir.Email)
+		record.Set("name", ir.Name)
+		record.Set("role", ir.Role)
+		record.Set("expires", expires)
+		if tenantId, ok := Invitations.tenant(txApp); ok {
+			record.Set(Invitations.TenantColumn, tenantId)
+		}
+		if err := txApp.Save(record); err != nil {
+			return err
+		}
+		var err error
+		invitation, err = Invitations.Find(txApp, record.Id)
+		if err != nil {
+			return err
+		}
+		return SendInvitationEmail(txApp, cfg, invitation, expires.Time())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// SendInvitationEmail mails the invitee a link to the sign up page of the
+// app, which reads the invitation with GET /invitations/{token}.
+func SendInvitationEmail(app core.App, cfg *Config, invitation *Invitation, expires time.Time) error {
+	token := SignInvitationToken([]byte(cfg.InvitationSecret), invitation.Id, invitation.Email, expires)
+	meta := app.Settings().Meta
+
+	body, err := Views.RenderString(app, "emails/invitation.html", map[string]any{
+		"Name": invitation.Name,
+		"TTL":  cfg.InvitationTTL.String(),
+		"URL":  strings.TrimRight(meta.AppURL, "/") + "/invite?token=" + url.QueryEscape(token),
+	})
+	if err != nil {
+		return err
+	}
+	return SendMail(app, &mailer.Message{
+		From:    mail.Address{Name: meta.SenderName, Address: meta.SenderAddress},
+		To:      []mail.Address{{Address: invitation.Email}},
+		Subject: "You were invited to sign up",
+		HTML:    body,
+	})
+}
+
+// FindInvitation returns the pending invitation the token was issued for.
+func FindInvitation(app core.App, cfg *Config, token string, now time.Time) (*Invitation, error) {
+	invitationId, email, err := VerifyInvitationToken([]byte(cfg.InvitationSecret), token, now)
+	if err != nil {
+		return nil, err
+	}
+	invitation, err := Invitations.Find(app, invitationId)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvitationInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if invitation.Email != email {
+		return nil, ErrInvitationInvalid
+	}
+	if invitation.Revoked != "" {
+		return nil, ErrInvitationRevoked
+	}
+	if invitation.Accepted != "" {
+		return nil, ErrInvitationAccepted
+	}
+	return invitation, nil
+}
+
+// AcceptInvitation creates the invited user, verified since the token
+// reached its email, and consumes the invitation and queues the event of
+// the user in the same transaction.
+func AcceptInvitation(app core.App, cfg *Config, token string, ar AcceptInvitationRequest, now time.Time) (*models.User, error) {
+	accepted, err := types.ParseDateTime(now)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *models.User
+	err = WithTx(app, func(txApp core.App) error {
+		invitation, err := FindInvitation(txApp, cfg, token, now)
+		if err != nil {
+			return err
+		}
+		// only one of two concurrent acceptances consumes the invitation
+		affected, err := Invitations.exec(txApp, func(db dbx.Builder) *dbx.Query {
+			return db.Update(Invitations.Table, dbx.Params{"accepted": accepted.String()}, dbx.HashExp{"id": invitation.Id, "accepted": "", "revoked": ""})
+		})
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrInvitationAccepted
+		}
+
+		name := ar.Name
+		if name == "" {
+			name = invitation.Name
+		}
+		created, err := CreateUser(txApp, models.UserCreationRequest{
+			Email:           invitation.Email,
+			EmailVisibility: ar.EmailVisibility,
+			Name:            name,
+			Password:        ar.Password,
+			PasswordConfirm: ar.PasswordConfirm,
+		})
+		if err != nil {
+			return err
+		}
+		cs := Changeset{"verified": true}
+		if invitation.Role != "" {
+			cs["roles"] = models.Roles{invitation.Role}
+		}
+		if _, err := Users.Update(txApp, created.Id, cs); err != nil {
+			return err
+		}
+		if _, err := Invitations.Update(txApp, invitation.Id, Changeset{"user": created.Id}); err != nil {
+			return err
+		}
+		if user, err = GetUserById(txApp, created.Id); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserCreated, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// RevokeInvitation marks the pending invitation as revoked at now, after
+// which its token is rejected.
+func RevokeInvitation(app core.App, id string, now time.Time) (*Invitation, error) {
+	revoked, err := types.ParseDateTime(now)
+	if err != nil {
+		return nil, err
+	}
+	affected, err := Invitations.exec(app, func(db dbx.Builder) *dbx.Query {
+		where := dbx.HashExp{"id": id, "accepted": "", "revoked": ""}
+		if tenantId, ok := Invitations.tenant(app); ok {
+			where[Invitations.TenantColumn] = tenantId
+		}
+		return db.Update(Invitations.Table, dbx.Params{"revoked": revoked.String()}, where)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invitation, err := Invitations.Find(app, id)
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 && invitation.Accepted != "" {
+		return nil, ErrInvitationAccepted
+	}
+	if affected == 0 {
+		return nil, ErrInvitationRevoked
+	}
+	return invitation, nil
+}
+
+func ListInvitations(app core.App) ([]Invitation, error) {
+	return Invitations.FindAll(app, ListOptions{Sort: []SortField{{Field: "created", Desc: true}}})
+}
+
+func writeInvitationError(e *core.RequestEvent, err error, action string) error {
+	switch {
+	case errors.Is(err, ErrInvitationInvalid), errors.Is(err, ErrPasswordMismatch):
+		return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+	case errors.Is(err, ErrInvalidRole):
+		return WriteBadRequest(e, "bad request: "+err.Error(), map[string]string{"role": err.Error()})
+	case errors.Is(err, ErrInvitationExpired), errors.Is(err, ErrInvitationRevoked), errors.Is(err, ErrInvitationAccepted):
+		return WriteGone(e, err.Error(), nil)
+	case errors.Is(err, ErrEmailTaken):
+		return WriteErrorCode(e, CodeEmailTaken, err.Error(), map[string]string{"email": err.Error()})
+	}
+	return WriteError(e, err, action)
+}
+
+func HandleCreateInvitation(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		ir := InvitationRequest{}
+		if err := BindStrict(e, &ir); err != nil {
+			return WriteBindError(e, err)
+		}
+		ir.Email = strings.TrimSpace(ir.Email)
+
+		invitation, err := CreateInvitation(WithTrace(app, e), cfg, ir, time.Now())
+		if err != nil {
+			return writeInvitationError(e, err, "error creating invitation")
+		}
+		return WriteResp(e, http.StatusCreated, "an invitation was sent to "+invitation.Email, invitation)
+	}
+}
+
+func HandleListInvitations(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		invitations, err := ListInvitations(WithTrace(app, e))
+		if err != nil {
+			return WriteError(e, err, "error getting invitations")
+		}
+		return WriteOK(e, "", invitations)
+	}
+}
+
+func HandleRevokeInvitation(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		invitation, err := RevokeInvitation(WithTrace(app, e), e.Request.PathValue("invitationId"), time.Now())
+		if errors.Is(err, ErrNotFound) {
+			return WriteNotFound(e, "invitation not found", nil)
+		}
+		if errors.Is(err, ErrInvitationRevoked) || errors.Is(err, ErrInvitationAccepted) {
+			return WriteConflict(e, err.Error(), nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error revoking invitation")
+		}
+		return WriteOK(e, "", invitation)
+	}
+}
+
+func HandleGetInvitation(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		invitation, err := FindInvitation(WithTrace(app, e), cfg, e.Request.PathValue("token"), time.Now())
+		if err != nil {
+			return writeInvitationError(e, err, "error getting invitation")
+		}
+		e.Response.Header().Set("Cache-Control", "no-store")
+		return WriteOK(e, "", InvitationView{Email: invitation.Email, Name: invitation.Name, Expires: invitation.Expires})
+	}
+}
+
+// HandleAcceptInvitation signs the invitee up and responds like
+// HandleRegister.
+func HandleAcceptInvitation(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		ar := AcceptInvitationRequest{}
+		if err := BindStrict(e, &ar); err != nil {
+			return WriteBindError(e, err)
+		}
+		if err := Passwords.Check(app, e.Request.Context(), ar.Password); err != nil {
+			return WriteError(e, err, "invalid password")
+		}
+
+		user, err := AcceptInvitation(app, cfg, e.Request.PathValue("token"), ar, time.Now())
+		var validationErrs validation.Errors
+		if errors.As(err, &validationErrs) {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid user", validationErrs)
+		}
+		if err != nil {
+			return writeInvitationError(e, err, "error accepting invitation")
+		}
+		SetAuditedUser(e, user.Id)
+
+		record, err := app.FindRecordById(Users.Table, user.Id)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+		resp, err := NewAuthResponse(app, e, record)
+		if err != nil {
+			return WriteError(e, err, "error issuing token")
+		}
+		return WriteOK(e, "", resp)
+	}
+}
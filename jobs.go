@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+const (
+	JobWebhookDelivery    = "webhook.delivery"
+	JobVerificationEmail  = "email.verification"
+	JobPasswordResetEmail = "email.password_reset"
+	JobAvatarThumbs       = "avatar.thumbs"
+	JobTakeout            = "users.takeout"
+	JobNotificationDigest = "notifications.digest"
+	JobProfileChangeEmail = "email.profile_change"
+)
+
+var ErrJobStatus = errors.New("job can't be changed in its current status")
+
+var JobSortFields = []string{"created", "run_at", "updated"}
+
+var JobFilterFields = map[string]FilterType{
+	"type":   FilterString,
+	"status": FilterString,
+}
+
+type Job struct {
+	Id          string        `db:"id" json:"id"`
+	Type        string        `db:"type" json:"type"`
+	Payload     types.JSONRaw `db:"payload" json:"payload"`
+	Status      string        `db:"status" json:"status"`
+	Attempts    int           `db:"attempts" json:"attempts"`
+	MaxAttempts int           `db:"max_attempts" json:"maxAttempts"`
+	RunAt       string        `db:"run_at" json:"runAt"`
+	LastError   string        `db:"last_error" json:"lastError"`
+	Created     string        `db:"created" json:"created"`
+	Updated     string        `db:"updated" json:"updated"`
+}
+
+// Jobs is the repository of the jobs collection table. The jobs are
+// created as records by EnqueueJob and updated through it.
+var Jobs = NewRepository[Job]("jobs")
+
+// JobHandler runs the jobs of a type. A job whose Run fails is retried
+// after BaseDelay, doubled on every following attempt, until it made
+// MaxAttempts attempts.
+type JobHandler struct {
+	Run         func(ctx context.Context, app core.App, job *Job) error
+	MaxAttempts int
+	BaseDelay   time.Duration
+}
+
+var (
+	jobHandlersMu sync.RWMutex
+	jobHandlers   = map[string]JobHandler{}
+)
+
+func RegisterJobHandler(jobType string, h JobHandler) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+	jobHandlers[jobType] = h
+}
+
+func findJobHandler(jobType string) (JobHandler, bool) {
+	jobHandlersMu.RLock()
+	defer jobHandlersMu.RUnlock()
+	h, ok := jobHandlers[jobType]
+	return h, ok
+}
+
+// EnqueueJob persists a job of jobType running at runAt, with payload
+// encoded as JSON. Called with a transaction, the job is only queued if it
+// commits.
+func EnqueueJob(app core.App, jobType string, payload any, runAt time.Time) (*Job, error) {
+	collection, err := app.FindCachedCollectionByNameOrId("jobs")
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	at, err := types.ParseDateTime(runAt)
+	if err != nil {
+		return nil, err
+	}
+	maxAttempts := 1
+	if h, ok := findJobHandler(jobType); ok {
+		maxAttempts = max(h.MaxAttempts, 1)
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("type", jobType)
+	record.Set("payload", types.JSONRaw(raw))
+	record.Set("status", JobPending)
+	record.Set("max_attempts", maxAttempts)
+	record.Set("run_at", at)
+	if err := RetryWrite(app, func() error { return app.Save(record) }); err != nil {
+		return nil, err
+	}
+	Queue.notify()
+	return &Job{
+		Id:          record.Id,
+		Type:        jobType,
+		Payload:     types.JSONRaw(raw),
+		Status:      JobPending,
+		MaxAttempts: maxAttempts,
+		RunAt:       at.String(),
+		Created:     record.GetString("created"),
+		Updated:     record.GetString("updated"),
+	}, nil
+}
+
+// Queue runs the persisted jobs. It is nil until main starts it, the jobs
+// enqueued meanwhile run once it is.
+var Queue *JobQueue
+
+// JobQueue runs the due jobs with a pool of workers, which poll the jobs
+// table and are woken up early by EnqueueJob.
+type JobQueue struct {
+	app     core.App
+	workers int
+	poll    time.Duration
+	wake    chan struct{}
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopping chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewJobQueue(app core.App, workers int, poll time.Duration) *JobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobQueue{
+		app:      app,
+		workers:  max(workers, 1),
+		poll:     poll,
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		stopping: make(chan struct{}),
+	}
+}
+
+// Start puts back the jobs a previous run left running and starts the
+// workers.
+func (q *JobQueue) Start() error {
+	_, err := q.app.NonconcurrentDB().Update(Jobs.Table, dbx.Params{
+		"status":  JobPending,
+		"updated": types.NowDateTime().String(),
+	}, dbx.HashExp{"status": JobRunning}).Execute()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return nil
+}
+
+// Shutdown runs the jobs already due and waits for the running ones to
+// finish, canceling them once ctx is done. The jobs scheduled later, and
+// the canceled ones, stay pending until the next Start.
+func (q *JobQueue) Shutdown(ctx context.Context) {
+	if q == nil {
+		return
+	}
+	q.stopOnce.Do(func() { close(q.stopping) })
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+	}
+	q.cancel()
+}
+
+func (q *JobQueue) notify() {
+	if q == nil {
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *JobQueue) work() {
+	defer q.wg.Done()
+	for q.ctx.Err() == nil {
+		if q.runNext() {
+			continue
+		}
+		select {
+		case <-q.stopping:
+			// no job is due anymore
+			return
+		case <-q.ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(q.poll):
+		}
+	}
+}
+
+// runNext runs the next due job, if any, and reports whether it did.
+func (q *JobQueue) runNext() bool {
+	job, err := claimJob(q.app, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		q.app.Logger().Error("Failed to claim job", "error", err)
+		return false
+	}
+
+	h, ok := findJobHandler(job.Type)
+	if ok {
+		err = h.Run(q.ctx, q.app, job)
+	} else {
+		err = fmt.Errorf("no handler for job type %q", job.Type)
+	}
+	if err != nil && q.ctx.Err() == nil {
+		q.app.Logger().Warn("Job failed", "job", job.Id, "type", job.Type, "attempt", job.Attempts, "error", err)
+	}
+	if err := finishJob(q.app, job, h, err, q.ctx.Err() != nil); err != nil {
+		q.app.Logger().Error("Failed to update job", "job", job.Id, "error", err)
+	}
+	return true
+}
+
+// claimJob marks the job due the earliest as running and returns it, or
+// sql.ErrNoRows if no job is due.
+func claimJob(app core.App, now time.Time) (*Job, error) {
+	at, err := types.ParseDateTime(now)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	err = RetryWrite(app, func() error {
+		return app.NonconcurrentDB().NewQuery(
+			"UPDATE {{jobs}} SET [[status]] = {:running}, [[attempts]] = [[attempts]] + 1, [[updated]] = {:now} " +
+				"WHERE [[id]] = (SELECT [[id]] FROM {{jobs}} WHERE [[status]] = {:pending} AND [[run_at]] <= {:now} ORDER BY [[run_at]] LIMIT 1) " +
+				"RETURNING *",
+		).Bind(dbx.Params{"running": JobRunning, "pending": JobPending, "now": at.String()}).One(job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// finishJob records the outcome of an attempt. An attempt interrupted by
+// the shutdown isn't counted.
+func finishJob(app core.App, job *Job, h JobHandler, runErr error, interrupted bool) error {
+	now := time.Now()
+	cs := Changeset{"updated": types.NowDateTime().String()}
+	switch {
+	case runErr == nil:
+		cs["status"] = JobSucceeded
+		cs["last_error"] = ""
+	case interrupted:
+		cs["status"] = JobPending
+		cs["attempts"] = job.Attempts - 1
+	case job.Attempts >= job.MaxAttempts:
+		cs["status"] = JobFailed
+		cs["last_error"] = runErr.Error()
+	default:
+		runAt, err := types.ParseDateTime(now.Add(h.BaseDelay << (job.Attempts - 1)))
+		if err != nil {
+			return err
+		}
+		cs["status"] = JobPending
+		cs["run_at"] = runAt.String()
+		cs["last_error"] = runErr.Error()
+	}
+	_, err := Jobs.Update(app, job.Id, cs)
+	return err
+}
+
+// DecodeJobPayload decodes the payload of job into dst.
+func DecodeJobPayload(job *Job, dst any) error {
+	if err := json.Unmarshal(job.Payload, dst); err != nil {
+		return fmt.Errorf("invalid %s job payload: %w", job.Type, err)
+	}
+	return nil
+}
+
+// setJobStatus moves the job to status if it is in one of from, returning
+// ErrJobStatus otherwise and sql.ErrNoRows if there is no such job.
+func setJobStatus(app core.App, name string, jobId string, from []string, cs Changeset) (*Job, error) {
+	span := StartStorageSpan(app, name, "UPDATE")
+	var job *Job
+	err := WithTx(app, func(txApp core.App) error {
+		current, err := Jobs.Find(txApp, jobId)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(from, current.Status) {
+			return ErrJobStatus
+		}
+		cs["updated"] = types.NowDateTime().String()
+		if _, err := Jobs.Update(txApp, jobId, cs); err != nil {
+			return err
+		}
+		job, err = Jobs.Find(txApp, jobId)
+		return err
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// RetryJob runs a failed or canceled job again as soon as possible, with a
+// fresh set of attempts.
+func RetryJob(app core.App, jobId string) (*Job, error) {
+	runAt := types.NowDateTime().String()
+	job, err := setJobStatus(app, "RetryJob", jobId, []string{JobFailed, JobCanceled}, Changeset{
+		"status":   JobPending,
+		"attempts": 0,
+		"run_at":   runAt,
+	})
+	if err == nil {
+		Queue.notify()
+	}
+	return job, err
+}
+
+// CancelJob keeps a pending job from running. Running jobs can't be
+// canceled.
+func CancelJob(app core.App, jobId string) (*Job, error) {
+	return setJobStatus(app, "CancelJob", jobId, []string{JobPending}, Changeset{
+		"status": JobCanceled,
+	})
+}
+
+func HandleListJobs(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		filter, err := ParseFilter(e.Request.URL.Query().Get("filter"), JobFilterFields)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		opts, err := ParseListOptions(e.Request.URL.Query(), JobSortFields, cfg)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if len(opts.Sort) == 0 {
+			opts.Sort = []SortField{{Field: "created", Desc: true}}
+		}
+		opts.Filter = filter
+
+		span := StartStorageSpan(app, "ListJobs", "SELECT")
+		total, err := Jobs.Count(app, opts.Filter)
+		if err != nil {
+			span.End(err)
+			return WriteInternalServerError(e, "error counting jobs: "+err.Error(), nil)
+		}
+		jobs, err := Jobs.FindAll(app, opts)
+		span.SetAttr("db.response.returned_rows", len(jobs))
+		span.End(err)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting jobs: "+err.Error(), nil)
+		}
+		return WriteOK(e, "", NewListPage(jobs, opts, total))
+	}
+}
+
+func writeJobResult(e *core.RequestEvent, job *Job, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return WriteNotFound(e, "job not found", nil)
+	}
+	if errors.Is(err, ErrJobStatus) {
+		return WriteConflict(e, err.Error(), nil)
+	}
+	if err != nil {
+		return WriteError(e, err, "error updating job")
+	}
+	return WriteOK(e, "", job)
+}
+
+func HandleRetryJob(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		job, err := RetryJob(app, e.Request.PathValue("jobId"))
+		return writeJobResult(e, job, err)
+	}
+}
+
+func HandleCancelJob(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		job, err := CancelJob(app, e.Request.PathValue("jobId"))
+		return writeJobResult(e, job, err)
+	}
+}
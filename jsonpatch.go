@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+)
+
+const (
+	ContentTypeJSONPatch  = "application/json-patch+json"
+	ContentTypeMergePatch = "application/merge-patch+json"
+)
+
+var ErrEmailRemoved = errors.New("email cannot be removed")
+
+// JSONPatchOp is a single RFC 6902 operation. Only the add, replace, remove
+// and test ops are supported, and only on the top level user fields.
+type JSONPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type JSONPatchError struct {
+	Index   int    `json:"index"`
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e *JSONPatchError) Error() string {
+	return fmt.Sprintf("op %d (%s %s): %s", e.Index, e.Op, e.Path, e.Message)
+}
+
+// MergePatchError is a member of an RFC 7396 merge patch that can't be
+// applied to the user.
+type MergePatchError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *MergePatchError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+func IsJSONPatchRequest(r *http.Request) bool {
+	return hasMediaType(r, ContentTypeJSONPatch)
+}
+
+func IsMergePatchRequest(r *http.Request) bool {
+	return hasMediaType(r, ContentTypeMergePatch)
+}
+
+func hasMediaType(r *http.Request, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == contentType
+}
+
+// ApplyJSONPatch applies ops to user and returns an update request
+// containing only the fields touched by the patch. Removing a field, or
+// setting it to null, clears it. When the patch tests the user, the update
+// request expects its updated time, for the update to fail with a conflict
+// rather than apply to a user that changed since it was tested.
+func ApplyJSONPatch(user models.User, ops []JSONPatchOp) (models.UserUpdateRequest, error) {
+	ur := models.UserUpdateRequest{}
+	read := user
+	tested := false
+
+	for i, op := range ops {
+		patchErr := func(message string) error {
+			return &JSONPatchError{Index: i, Op: op.Op, Path: op.Path, Message: message}
+		}
+
+		field, ok := strings.CutPrefix(op.Path, "/")
+		if !ok || userPatchField(&user, field) == nil {
+			return models.UserUpdateRequest{}, patchErr("unsupported path")
+		}
+
+		switch op.Op {
+		case "add", "replace":
+			if op.Value == nil {
+				return models.UserUpdateRequest{}, patchErr("missing value")
+			}
+			if err := setUserPatchField(&user, field, op.Value); err != nil {
+				return models.UserUpdateRequest{}, patchErr(err.Error())
+			}
+		case "remove":
+			if err := clearUserPatchField(&user, field); err != nil {
+				return models.UserUpdateRequest{}, patchErr(err.Error())
+			}
+		case "test":
+			if op.Value == nil {
+				return models.UserUpdateRequest{}, patchErr("missing value")
+			}
+			ok, err := testUserPatchField(user, field, op.Value)
+			if err != nil {
+				return models.UserUpdateRequest{}, patchErr(err.Error())
+			}
+			if !ok {
+				return models.UserUpdateRequest{}, patchErr("test failed")
+			}
+			tested = true
+			continue
+		default:
+			return models.UserUpdateRequest{}, patchErr("unsupported op")
+		}
+		if field == "email" && user.Email == "" {
+			return models.UserUpdateRequest{}, patchErr("email cannot be empty")
+		}
+		setUserUpdateField(&ur, field, &user)
+	}
+
+	if tested {
+		ur.ExpectedUpdated = &read.Updated
+	}
+	return ur, nil
+}
+
+// ApplyMergePatch applies an RFC 7396 merge patch to user and returns an
+// update request containing only the fields in the patch, a null clearing
+// its field. The members are applied in order of their names, for the
+// first invalid one to be the same whatever order they were sent in.
+func ApplyMergePatch(user models.User, patch map[string]json.RawMessage) (models.UserUpdateRequest, error) {
+	ur := models.UserUpdateRequest{}
+	fields := make([]string, 0, len(patch))
+	for field := range patch {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		patchErr := func(message string) error {
+			return &MergePatchError{Field: field, Message: message}
+		}
+		if userPatchField(&user, field) == nil {
+			return models.UserUpdateRequest{}, patchErr("unsupported field")
+		}
+		if err := setUserPatchField(&user, field, patch[field]); err != nil {
+			return models.UserUpdateRequest{}, patchErr(err.Error())
+		}
+		if field == "email" && user.Email == "" {
+			return models.UserUpdateRequest{}, patchErr("email cannot be empty")
+		}
+		setUserUpdateField(&ur, field, &user)
+	}
+	return ur, nil
+}
+
+// userPatchField returns a pointer to the field of user a patch can write,
+// by its JSON name, or nil if it can't be patched.
+func userPatchField(user *models.User, field string) any {
+	switch field {
+	case "email":
+		return &user.Email
+	case "emailVisibility":
+		return &user.EmailVisibility
+	case "name":
+		return &user.Name
+	case "phone":
+		return &user.Phone
+	case "nationalId":
+		return &user.NationalId
+	}
+	return nil
+}
+
+// setUserPatchField sets the field of user to value, a JSON null clearing
+// it.
+func setUserPatchField(user *models.User, field string, value json.RawMessage) error {
+	if string(value) == "null" {
+		return clearUserPatchField(user, field)
+	}
+	ptr := userPatchField(user, field)
+	if ptr == nil {
+		return fmt.Errorf("unsupported path")
+	}
+	return json.Unmarshal(value, ptr)
+}
+
+// clearUserPatchField sets the field of user to its zero value, the empty
+// string being what the users collection stores for an unset text field.
+// The email is required, and can only be replaced.
+func clearUserPatchField(user *models.User, field string) error {
+	if field == "email" {
+		return ErrEmailRemoved
+	}
+	ptr := userPatchField(user, field)
+	if ptr == nil {
+		return fmt.Errorf("unsupported path")
+	}
+	reflect.ValueOf(ptr).Elem().SetZero()
+	return nil
+}
+
+func setUserUpdateField(ur *models.UserUpdateRequest, field string, user *models.User) {
+	switch field {
+	case "email":
+		ur.Email = &user.Email
+	case "emailVisibility":
+		ur.EmailVisibility = &user.EmailVisibility
+	case "name":
+		ur.Name = &user.Name
+	case "phone":
+		ur.Phone = &user.Phone
+	case "nationalId":
+		ur.NationalId = &user.NationalId
+	}
+}
+
+func testUserPatchField(user models.User, field string, value json.RawMessage) (bool, error) {
+	expected := user
+	if err := setUserPatchField(&expected, field, value); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(expected, user), nil
+}
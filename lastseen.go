@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// LastSeenTracker remembers when the lastSeen column of each user was last
+// written so that it is updated at most once per interval.
+type LastSeenTracker struct {
+	mu         sync.Mutex
+	written    map[string]time.Time
+	interval   time.Duration
+	maxEntries int
+}
+
+func NewLastSeenTracker(interval time.Duration, maxEntries int) *LastSeenTracker {
+	return &LastSeenTracker{
+		written:    map[string]time.Time{},
+		interval:   interval,
+		maxEntries: maxEntries,
+	}
+}
+
+// ShouldWrite reports whether the lastSeen of userId is due for a write and,
+// if so, marks it as written at now.
+func (t *LastSeenTracker) ShouldWrite(userId string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if last, ok := t.written[userId]; ok && now.Sub(last) < t.interval {
+		return false
+	}
+
+	if len(t.written) >= t.maxEntries {
+		for id, last := range t.written {
+			if now.Sub(last) >= t.interval {
+				delete(t.written, id)
+			}
+		}
+		// every entry is still fresh, start over rather than growing unbounded
+		if len(t.written) >= t.maxEntries {
+			clear(t.written)
+		}
+	}
+
+	t.written[userId] = now
+	return true
+}
+
+func UpdateLastSeen(app core.App, userId string, seen time.Time) error {
+	lastSeen, err := types.ParseDateTime(seen)
+	if err != nil {
+		return err
+	}
+	_, err = Users.Untouched().Update(app, userId, Changeset{"lastSeen": lastSeen.String()})
+	return err
+}
+
+// TrackLastSeen records the lastSeen of authenticated users. Failing to
+// write it is only logged and never fails the request.
+func TrackLastSeen(app core.App, tracker *LastSeenTracker) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil || e.Auth.Collection().Name != "users" {
+			return e.Next()
+		}
+
+		userId := e.Auth.Id
+		now := time.Now()
+		if tracker.ShouldWrite(userId, now) {
+			Drain.Go(func() {
+				if err := UpdateLastSeen(app, userId, now); err != nil {
+					app.Logger().Warn("Failed to update lastSeen", "userId", userId, "error", err)
+				}
+			})
+		}
+
+		return e.Next()
+	}
+}
+
+func GetActiveUsers(app core.App, since time.Time) ([]models.User, error) {
+	cutoff, err := types.ParseDateTime(since)
+	if err != nil {
+		return []models.User{}, err
+	}
+	span := StartStorageSpan(app, "GetActiveUsers", "SELECT")
+	users, err := Users.FindAll(app, ListOptions{
+		Filter: dbx.NewExp("[[lastSeen]] >= {:cutoff}", dbx.Params{"cutoff": cutoff.String()}),
+		Sort:   []SortField{{Field: "lastSeen", Desc: true}},
+	})
+	span.SetAttr("db.response.returned_rows", len(users))
+	span.End(err)
+	return users, err
+}
+
+func HandleGetActiveUsers(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		since := 24 * time.Hour
+		if v := e.Request.URL.Query().Get("since"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return WriteBadRequest(e, "bad request: invalid since "+v, nil)
+			}
+			since = d
+		}
+		users, err := GetActiveUsers(app, time.Now().Add(-since))
+		if err != nil {
+			return WriteInternalServerError(e, "error getting active users: "+err.Error(), nil)
+		}
+		return WriteOK(e, "", RedactUsers(e, users))
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const legacySyncJobName = "legacy_user_sync"
+
+// The conflict rules of LEGACY_SYNC_CONFLICT, deciding what happens to the
+// users that exist on both sides.
+const (
+	// LegacyConflictLegacy overwrites the users with their legacy rows.
+	LegacyConflictLegacy = "legacy"
+	// LegacyConflictLocal keeps the users as they are, only linking them
+	// to their legacy rows.
+	LegacyConflictLocal = "local"
+	// LegacyConflictNewest overwrites the users updated before their
+	// legacy rows.
+	LegacyConflictNewest = "newest"
+)
+
+// The fields of the users a column of the legacy rows can be mapped to.
+const (
+	LegacyFieldExternalId = "externalId"
+	LegacyFieldEmail      = "email"
+	LegacyFieldName       = "name"
+	LegacyFieldVerified   = "verified"
+	LegacyFieldActive     = "active"
+	LegacyFieldUpdated    = "updated"
+)
+
+var LegacyFields = []string{
+	LegacyFieldExternalId,
+	LegacyFieldEmail,
+	LegacyFieldName,
+	LegacyFieldVerified,
+	LegacyFieldActive,
+	LegacyFieldUpdated,
+}
+
+// legacySyncMaxErrors caps the row errors kept in the status of a run.
+const legacySyncMaxErrors = 20
+
+var legacyIdentifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// ParseLegacyFieldMapping reads the field=column pairs of
+// LEGACY_SYNC_FIELDS into a map of the fields to their legacy columns.
+// externalId and email must be mapped.
+func ParseLegacyFieldMapping(pairs []string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, pair := range pairs {
+		field, column, ok := strings.Cut(pair, "=")
+		field, column = strings.TrimSpace(field), strings.TrimSpace(column)
+		if !ok || field == "" || column == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected field=column", pair)
+		}
+		if !slices.Contains(LegacyFields, field) {
+			return nil, fmt.Errorf("unknown field %q, expected one of %s", field, strings.Join(LegacyFields, ", "))
+		}
+		if !legacyIdentifierRegex.MatchString(column) {
+			return nil, fmt.Errorf("invalid column %q", column)
+		}
+		if _, ok := mapping[field]; ok {
+			return nil, fmt.Errorf("field %q is mapped twice", field)
+		}
+		mapping[field] = column
+	}
+	for _, field := range []string{LegacyFieldExternalId, LegacyFieldEmail} {
+		if _, ok := mapping[field]; !ok {
+			return nil, fmt.Errorf("field %q must be mapped", field)
+		}
+	}
+	return mapping, nil
+}
+
+// LegacyUser is a row of the legacy database, read through the field
+// mapping. The nil fields aren't mapped.
+type LegacyUser struct {
+	ExternalId string
+	Email      string
+	Name       *string
+	Verified   *bool
+	Active     *bool
+	Updated    string
+}
+
+// legacySyncedUser holds the columns of the users the sync compares with
+// the legacy rows.
+type legacySyncedUser struct {
+	Id         string `db:"id"`
+	Email      string `db:"email"`
+	Name       string `db:"name"`
+	Verified   bool   `db:"verified"`
+	Locked     bool   `db:"locked"`
+	ExternalId string `db:"external_id"`
+	Updated    string `db:"updated"`
+}
+
+var legacySyncedUsers = &Repository[legacySyncedUser]{
+	Table:            Users.Table,
+	SoftDeleteColumn: Users.SoftDeleteColumn,
+	TenantColumn:     Users.TenantColumn,
+}
+
+// LegacySyncRowError reports a legacy row that couldn't be synced.
+type LegacySyncRowError struct {
+	ExternalId string `json:"externalId"`
+	Error      string `json:"error"`
+}
+
+// LegacySyncStats counts what a run did to the legacy rows it read.
+type LegacySyncStats struct {
+	Read      int `json:"read"`
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Linked    int `json:"linked"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+}
+
+func (s *LegacySyncStats) add(o LegacySyncStats) {
+	s.Read += o.Read
+	s.Created += o.Created
+	s.Updated += o.Updated
+	s.Linked += o.Linked
+	s.Unchanged += o.Unchanged
+	s.Failed += o.Failed
+}
+
+// LegacySyncStatus describes the sync for GET /admin/sync/status. The runs
+// and the totals only cover the runs since the process started.
+type LegacySyncStatus struct {
+	Enabled      bool                 `json:"enabled"`
+	Driver       string               `json:"driver,omitempty"`
+	Table        string               `json:"table,omitempty"`
+	Schedule     string               `json:"schedule,omitempty"`
+	Conflict     string               `json:"conflict,omitempty"`
+	Running      bool                 `json:"running"`
+	Cursor       string               `json:"cursor,omitempty"`
+	Runs         int                  `json:"runs"`
+	LastRun      string               `json:"lastRun,omitempty"`
+	LastDuration string               `json:"lastDuration,omitempty"`
+	LastError    string               `json:"lastError,omitempty"`
+	Last         LegacySyncStats      `json:"last"`
+	LastErrors   []LegacySyncRowError `json:"lastErrors,omitempty"`
+	Totals       LegacySyncStats      `json:"totals"`
+}
+
+// LegacySync is the sync of the users from LEGACY_SYNC_DSN, nil unless it
+// is set.
+var LegacySync *LegacySyncer
+
+// LegacySyncer pulls the rows of a table of a legacy Postgres or MySQL
+// database on a schedule and upserts them into the users, matching them by
+// their external_id and then by their email.
+//
+// With an updated column mapped, each run only reads the rows updated
+// since the last row of the previous run. The cursor isn't persisted, the
+// first run after a restart reads the whole table again, which the
+// conflict rules make harmless.
+type LegacySyncer struct {
+	app       core.App
+	db        *dbx.DB
+	table     string
+	mapping   map[string]string
+	conflict  string
+	batchSize int
+
+	mu     sync.Mutex
+	status LegacySyncStatus
+	// the updated value and the external id of the last row read
+	cursorUpdated string
+	cursorId      string
+}
+
+// NewLegacySyncer opens the legacy database of cfg, with the database/sql
+// driver of LEGACY_SYNC_DRIVER, see legacysync_mysql.go and
+// legacysync_postgres.go.
+func NewLegacySyncer(app core.App, cfg *Config) (*LegacySyncer, error) {
+	mapping, err := ParseLegacyFieldMapping(cfg.LegacySyncFields)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(sql.Drivers(), cfg.LegacySyncDriver) {
+		return nil, fmt.Errorf("the %s driver isn't compiled in, build with the legacysync_postgres or legacysync_mysql tag", cfg.LegacySyncDriver)
+	}
+	db, err := dbx.Open(cfg.LegacySyncDriver, cfg.LegacySyncDSN)
+	if err != nil {
+		return nil, fmt.Errorf("error opening the legacy database: %w", err)
+	}
+	db.DB().SetMaxOpenConns(1)
+	return &LegacySyncer{
+		app:       app,
+		db:        db,
+		table:     cfg.LegacySyncTable,
+		mapping:   mapping,
+		conflict:  cfg.LegacySyncConflict,
+		batchSize: cfg.LegacySyncBatchSize,
+		status: LegacySyncStatus{
+			Enabled:  true,
+			Driver:   cfg.LegacySyncDriver,
+			Table:    cfg.LegacySyncTable,
+			Schedule: cfg.LegacySyncSchedule,
+			Conflict: cfg.LegacySyncConflict,
+		},
+	}, nil
+}
+
+// Schedule runs the sync on the schedule of LEGACY_SYNC_SCHEDULE, and
+// closes the legacy database on terminate.
+func (s *LegacySyncer) Schedule(schedule string) {
+	s.app.Cron().MustAdd(legacySyncJobName, schedule, func() {
+		if _, err := s.Run(time.Now()); err != nil && !errors.Is(err, ErrLegacySyncRunning) {
+			s.app.Logger().Error("Legacy user sync failed", "error", err)
+		}
+	})
+	s.app.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+		s.app.Cron().Remove(legacySyncJobName)
+		if err := s.db.Close(); err != nil {
+			e.App.Logger().Warn("Failed to close the legacy database", "error", err)
+		}
+		return e.Next()
+	})
+}
+
+var ErrLegacySyncRunning = errors.New("the legacy user sync is already running")
+
+// Run reads the legacy rows in batches and syncs them, unless the previous
+// run is still going. A row that fails is only counted and reported, a
+// failure of the legacy database stops the run, the next one resuming
+// from the last batch synced.
+func (s *LegacySyncer) Run(now time.Time) (LegacySyncStats, error) {
+	s.mu.Lock()
+	if s.status.Running {
+		s.mu.Unlock()
+		return LegacySyncStats{}, ErrLegacySyncRunning
+	}
+	s.status.Running = true
+	cursorUpdated, cursorId := s.cursorUpdated, s.cursorId
+	s.mu.Unlock()
+
+	stats := LegacySyncStats{}
+	rowErrs := []LegacySyncRowError{}
+	var err error
+	for {
+		var users []LegacyUser
+		users, err = s.readBatch(cursorUpdated, cursorId)
+		if err != nil {
+			break
+		}
+		for _, user := range users {
+			stats.Read++
+			outcome, err := s.syncUser(user)
+			if err != nil {
+				stats.Failed++
+				if len(rowErrs) < legacySyncMaxErrors {
+					rowErrs = append(rowErrs, LegacySyncRowError{ExternalId: user.ExternalId, Error: err.Error()})
+				}
+				continue
+			}
+			outcome(&stats)
+		}
+		if len(users) > 0 {
+			last := users[len(users)-1]
+			cursorUpdated, cursorId = last.Updated, last.ExternalId
+		}
+		if len(users) < s.batchSize {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Running = false
+	s.status.Runs++
+	s.status.LastRun = now.UTC().Format(time.RFC3339)
+	s.status.LastDuration = time.Since(now).String()
+	s.status.LastError = ""
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+	s.status.Last = stats
+	s.status.LastErrors = rowErrs
+	s.status.Totals.add(stats)
+	// without an updated column, every run reads the whole table
+	if _, ok := s.mapping[LegacyFieldUpdated]; ok {
+		s.cursorUpdated, s.cursorId = cursorUpdated, cursorId
+		s.status.Cursor = cursorUpdated
+	}
+	return stats, err
+}
+
+func (s *LegacySyncer) Status() LegacySyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.LastErrors = slices.Clone(s.status.LastErrors)
+	return status
+}
+
+// readBatch reads the batchSize legacy rows following the cursor, in the
+// order of their updated and external id columns.
+func (s *LegacySyncer) readBatch(cursorUpdated string, cursorId string) ([]LegacyUser, error) {
+	columns := make([]string, 0, len(s.mapping))
+	for _, field := range LegacyFields {
+		if column, ok := s.mapping[field]; ok {
+			columns = append(columns, column+" AS "+field)
+		}
+	}
+	idColumn := s.mapping[LegacyFieldExternalId]
+	q := s.db.Select(columns...).From(s.table).Limit(int64(s.batchSize))
+	if updatedColumn, ok := s.mapping[LegacyFieldUpdated]; ok {
+		q.OrderBy(updatedColumn, idColumn)
+		if cursorUpdated != "" {
+			q.Where(dbx.NewExp(
+				fmt.Sprintf("([[%[1]s]] > {:updated} OR ([[%[1]s]] = {:updated} AND [[%[2]s]] > {:id}))", updatedColumn, idColumn),
+				dbx.Params{"updated": cursorUpdated, "id": cursorId},
+			))
+		} else if cursorId != "" {
+			q.Where(dbx.NewExp(fmt.Sprintf("[[%s]] > {:id}", idColumn), dbx.Params{"id": cursorId}))
+		}
+	} else {
+		q.OrderBy(idColumn)
+		if cursorId != "" {
+			q.Where(dbx.NewExp(fmt.Sprintf("[[%s]] > {:id}", idColumn), dbx.Params{"id": cursorId}))
+		}
+	}
+
+	rows := []dbx.NullStringMap{}
+	if err := q.All(&rows); err != nil {
+		return nil, fmt.Errorf("error reading the legacy users: %w", err)
+	}
+	users := make([]LegacyUser, 0, len(rows))
+	for _, row := range rows {
+		user := LegacyUser{
+			ExternalId: row[LegacyFieldExternalId].String,
+			Email:      strings.TrimSpace(row[LegacyFieldEmail].String),
+			Updated:    row[LegacyFieldUpdated].String,
+		}
+		if name, ok := row[LegacyFieldName]; ok {
+			user.Name = &name.String
+		}
+		if value, ok := row[LegacyFieldVerified]; ok {
+			verified, _ := strconv.ParseBool(value.String)
+			user.Verified = &verified
+		}
+		if value, ok := row[LegacyFieldActive]; ok {
+			active, _ := strconv.ParseBool(value.String)
+			user.Active = &active
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// syncUser upserts the user of the legacy row, returning how to count it.
+func (s *LegacySyncer) syncUser(lu LegacyUser) (func(*LegacySyncStats), error) {
+	if lu.ExternalId == "" {
+		return nil, errors.New("empty external id")
+	}
+
+	var count func(*LegacySyncStats)
+	err := WithTx(s.app, func(txApp core.App) error {
+		count = func(stats *LegacySyncStats) { stats.Unchanged++ }
+		local, err := legacySyncedUsers.FindOne(txApp, dbx.HashExp{scimExternalIdColumn: lu.ExternalId})
+		if errors.Is(err, ErrNotFound) {
+			local, err = legacySyncedUsers.FindOne(txApp, dbx.NewExp("LOWER([[email]]) = LOWER({:email})", dbx.Params{"email": lu.Email}))
+			if err == nil && local.ExternalId != "" {
+				return fmt.Errorf("email %s is linked to the external id %s", PII.String(lu.Email), local.ExternalId)
+			}
+		}
+		if errors.Is(err, ErrNotFound) {
+			user, err := s.createUser(txApp, lu)
+			if err != nil {
+				return err
+			}
+			count = func(stats *LegacySyncStats) { stats.Created++ }
+			return QueueUserEvent(txApp, EventUserCreated, user)
+		}
+		if err != nil {
+			return err
+		}
+
+		linked := local.ExternalId == ""
+		if linked {
+			if _, err := Users.Untouched().Update(txApp, local.Id, Changeset{scimExternalIdColumn: lu.ExternalId}); err != nil {
+				return err
+			}
+			count = func(stats *LegacySyncStats) { stats.Linked++ }
+		}
+		if !s.overwrites(*local, lu) {
+			return nil
+		}
+		updated, err := s.updateUser(txApp, *local, lu)
+		if err != nil || !updated {
+			return err
+		}
+		user, err := GetUserById(txApp, local.Id)
+		if err != nil {
+			return err
+		}
+		if !linked {
+			count = func(stats *LegacySyncStats) { stats.Updated++ }
+		}
+		return QueueUserEvent(txApp, EventUserUpdated, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return count, nil
+}
+
+// overwrites tells if the conflict rule lets the legacy row overwrite the
+// user.
+func (s *LegacySyncer) overwrites(local legacySyncedUser, lu LegacyUser) bool {
+	switch s.conflict {
+	case LegacyConflictLegacy:
+		return true
+	case LegacyConflictNewest:
+		localUpdated, err := types.ParseDateTime(local.Updated)
+		if err != nil {
+			return true
+		}
+		legacyUpdated, err := types.ParseDateTime(lu.Updated)
+		if err != nil || legacyUpdated.IsZero() {
+			return false
+		}
+		return legacyUpdated.Time().After(localUpdated.Time())
+	}
+	return false
+}
+
+// createUser creates the user of the legacy row, verified unless the
+// verified column says otherwise, as the legacy database vouched for the
+// email.
+func (s *LegacySyncer) createUser(txApp core.App, lu LegacyUser) (*models.User, error) {
+	cr := models.UserCreationRequest{Email: lu.Email}
+	if lu.Name != nil {
+		cr.Name = *lu.Name
+	}
+	user, err := CreateUser(txApp, cr)
+	if err != nil {
+		return nil, err
+	}
+	cs := Changeset{"verified": lu.Verified == nil || *lu.Verified, scimExternalIdColumn: lu.ExternalId}
+	if lu.Active != nil {
+		cs[LockedField] = !*lu.Active
+	}
+	if _, err := Users.Untouched().Update(txApp, user.Id, cs); err != nil {
+		return nil, err
+	}
+	return GetUserById(txApp, user.Id)
+}
+
+// updateUser writes the mapped fields of the legacy row that differ from
+// the user, reporting whether there were any.
+func (s *LegacySyncer) updateUser(txApp core.App, local legacySyncedUser, lu LegacyUser) (bool, error) {
+	ur := models.UserUpdateRequest{}
+	if !strings.EqualFold(local.Email, lu.Email) {
+		ur.Email = &lu.Email
+	}
+	if lu.Name != nil && *lu.Name != local.Name {
+		ur.Name = lu.Name
+	}
+	cs := Changeset{}
+	if lu.Verified != nil && *lu.Verified != local.Verified {
+		cs["verified"] = *lu.Verified
+	}
+	if lu.Active != nil && *lu.Active == local.Locked {
+		cs[LockedField] = !*lu.Active
+	}
+	if ur.Email == nil && ur.Name == nil && len(cs) == 0 {
+		return false, nil
+	}
+
+	if ur.Email != nil || ur.Name != nil {
+		if err := ValidateUserUpdateRequest(ur); err != nil {
+			return false, err
+		}
+		if err := CheckUserUpdate(txApp, local.Id, ur); err != nil {
+			return false, err
+		}
+		if _, _, err := UpdateUserById(txApp, local.Id, ur); err != nil {
+			return false, err
+		}
+	}
+	if len(cs) > 0 {
+		if _, err := Users.Update(txApp, local.Id, cs); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func HandleGetLegacySyncStatus() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if LegacySync == nil {
+			return WriteOK(e, "", LegacySyncStatus{})
+		}
+		return WriteOK(e, "", LegacySync.Status())
+	}
+}
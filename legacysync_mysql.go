@@ -0,0 +1,6 @@
+//go:build legacysync_mysql
+
+package main
+
+// registers the mysql driver of LEGACY_SYNC_DRIVER=mysql
+import _ "github.com/go-sql-driver/mysql"
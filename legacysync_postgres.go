@@ -0,0 +1,6 @@
+//go:build legacysync_postgres
+
+package main
+
+// registers the pgx driver of LEGACY_SYNC_DRIVER=pgx
+import _ "github.com/jackc/pgx/v5/stdlib"
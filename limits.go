@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// UploadRoutes take files rather than JSON documents, which they stream, so
+// they are allowed MaxUploadSize bytes and their bodies aren't checked
+// against the JSON limits.
+var UploadRoutes = []string{
+	"POST /users/import",
+	"POST /users/{userId}/avatar",
+	"POST /admin/users-restore",
+	"POST /admin/deploy-static",
+}
+
+// bodyMethods are the methods of the requests with a body.
+var bodyMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch}
+
+var (
+	ErrJSONTooDeep      = errors.New("JSON body is nested too deeply")
+	ErrJSONArrayTooLong = errors.New("JSON body has an array that is too long")
+)
+
+// LimitBody rejects the bodies of the custom routes larger than
+// MaxBodySize with 413, and the JSON bodies nested deeper than MaxJSONDepth
+// or with arrays longer than MaxJSONArrayLength with 400, before the
+// handlers read them into memory.
+func LimitBody(cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if !slices.Contains(bodyMethods, e.Request.Method) || IsPocketBasePath(e.Request.URL.Path) {
+			return e.Next()
+		}
+		upload := slices.Contains(UploadRoutes, e.Request.Pattern)
+		limit := int64(cfg.MaxBodySize)
+		if upload {
+			limit = int64(cfg.MaxUploadSize)
+		}
+		if e.Request.ContentLength > limit {
+			return writeBodyTooLarge(e, limit)
+		}
+		e.Request.Body = http.MaxBytesReader(e.Response, e.Request.Body, limit)
+
+		mediaType, _, _ := mime.ParseMediaType(e.Request.Header.Get("Content-Type"))
+		if upload || mediaType != "application/json" {
+			return e.Next()
+		}
+		body, err := io.ReadAll(e.Request.Body)
+		if limit, ok := IsBodyTooLarge(err); ok {
+			return writeBodyTooLarge(e, limit)
+		}
+		if err != nil {
+			return WriteBadRequest(e, "bad request: error reading request body: "+err.Error(), nil)
+		}
+		if err := CheckJSONLimits(body, cfg.MaxJSONDepth, cfg.MaxJSONArrayLength); err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		e.Request.Body = io.NopCloser(bytes.NewReader(body))
+		return e.Next()
+	}
+}
+
+// CheckJSONLimits reports whether the JSON document in body is nested at
+// most maxDepth levels deep, with arrays of at most maxArrayLength items.
+// Syntax errors are left to the decoding of the body.
+func CheckJSONLimits(body []byte, maxDepth int, maxArrayLength int) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	// the item counts of the open arrays, -1 for the objects
+	var open []int
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		if n := len(open); n > 0 && open[n-1] >= 0 {
+			if !isJSONEnd(token) {
+				open[n-1]++
+				if open[n-1] > maxArrayLength {
+					return fmt.Errorf("%w, at most %d items are allowed", ErrJSONArrayTooLong, maxArrayLength)
+				}
+			}
+		}
+		switch token {
+		case json.Delim('['):
+			open = append(open, 0)
+		case json.Delim('{'):
+			open = append(open, -1)
+		case json.Delim(']'), json.Delim('}'):
+			open = open[:len(open)-1]
+		}
+		if len(open) > maxDepth {
+			return fmt.Errorf("%w, at most %d levels are allowed", ErrJSONTooDeep, maxDepth)
+		}
+	}
+}
+
+func isJSONEnd(token json.Token) bool {
+	return token == json.Delim(']') || token == json.Delim('}')
+}
+
+// IsBodyTooLarge reports whether err comes from reading a body past the
+// limit set by LimitBody, for the handlers that stream their body.
+func IsBodyTooLarge(err error) (int64, bool) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return maxBytesErr.Limit, true
+	}
+	return 0, false
+}
+
+func writeBodyTooLarge(e *core.RequestEvent, limit int64) error {
+	return WriteErrorCode(e, CodeBodyTooLarge, fmt.Sprintf("request body must be at most %d bytes", limit), nil)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+)
+
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+type ListOptions struct {
+	Page    int
+	PerPage int
+	Sort    []SortField
+	Filter  dbx.Expression
+}
+
+// FilterType tells ParseFilter how to convert the value of a filter field.
+type FilterType int
+
+const (
+	FilterString FilterType = iota
+	FilterBool
+	FilterNumber
+)
+
+func NewListPage[T any](items []T, opts ListOptions, totalItems int) *models.ListPage[T] {
+	return &models.ListPage[T]{
+		Items:      items,
+		Page:       opts.Page,
+		PerPage:    opts.PerPage,
+		TotalItems: totalItems,
+		TotalPages: (totalItems + opts.PerPage - 1) / opts.PerPage,
+	}
+}
+
+// ParseListOptions reads ?page=, ?perPage= and ?sort= from the query string.
+// Sort is a comma separated list of fields, each optionally prefixed with "-"
+// for descending order, and every field must be listed in sortable.
+func ParseListOptions(query url.Values, sortable []string, cfg *Config) (ListOptions, error) {
+	opts := ListOptions{Page: 1, PerPage: cfg.DefaultPerPage}
+
+	if v := query.Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return opts, fmt.Errorf("invalid page %q", v)
+		}
+		opts.Page = page
+	}
+
+	if v := query.Get("perPage"); v != "" {
+		perPage, err := strconv.Atoi(v)
+		if err != nil || perPage < 1 {
+			return opts, fmt.Errorf("invalid perPage %q", v)
+		}
+		opts.PerPage = min(perPage, cfg.MaxPerPage)
+	}
+
+	if v := query.Get("sort"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			sf := SortField{Field: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")}
+			if !slices.Contains(sortable, sf.Field) {
+				return opts, fmt.Errorf("invalid sort field %q", sf.Field)
+			}
+			opts.Sort = append(opts.Sort, sf)
+		}
+	}
+
+	return opts, nil
+}
+
+// Apply adds the ORDER BY, LIMIT and OFFSET clauses to q. The sort columns
+// are qualified with table to avoid ambiguity in joined queries.
+func (o ListOptions) Apply(q *dbx.SelectQuery, table string) *dbx.SelectQuery {
+	return o.ApplySort(q, table).
+		Limit(int64(o.PerPage)).
+		Offset(int64((o.Page - 1) * o.PerPage))
+}
+
+// ApplySort adds only the ORDER BY clause to q, for queries that aren't paged.
+func (o ListOptions) ApplySort(q *dbx.SelectQuery, table string) *dbx.SelectQuery {
+	for _, sf := range o.Sort {
+		col := fmt.Sprintf("[[%s.%s]]", table, sf.Field)
+		if sf.Desc {
+			col += " DESC"
+		} else {
+			col += " ASC"
+		}
+		q = q.AndOrderBy(col)
+	}
+	return q
+}
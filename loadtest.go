@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/client"
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/spf13/cobra"
+)
+
+// loadTestSuperuser is the superuser the load test drives the routes as.
+const loadTestSuperuser = "loadtest@example.com"
+
+// LoadTestScenario sends one request to a custom route with c, ids being
+// the ids of the seeded users.
+type LoadTestScenario func(ctx context.Context, c *client.Client, rng *rand.Rand, ids []string) error
+
+// LoadTestScenarios are the requests the load test can mix, by name.
+var LoadTestScenarios = map[string]LoadTestScenario{
+	"list": func(ctx context.Context, c *client.Client, rng *rand.Rand, ids []string) error {
+		perPage := 30
+		_, err := c.ListUsers(ctx, &client.ListUsersOptions{Page: 1 + rng.IntN(max(1, len(ids)/perPage)), PerPage: perPage})
+		return err
+	},
+	"get": func(ctx context.Context, c *client.Client, rng *rand.Rand, ids []string) error {
+		_, err := c.GetUser(ctx, ids[rng.IntN(len(ids))])
+		return err
+	},
+	"create": func(ctx context.Context, c *client.Client, rng *rand.Rand, ids []string) error {
+		_, err := c.CreateUser(ctx, models.UserCreationRequest{
+			Email: "loadtest." + security.RandomString(12) + "@example.com",
+			Name:  "Load Test",
+		})
+		return err
+	},
+	"update": func(ctx context.Context, c *client.Client, rng *rand.Rand, ids []string) error {
+		name := "Load Test " + security.RandomString(6)
+		return c.UpdateUser(ctx, ids[rng.IntN(len(ids))], models.UserUpdateRequest{Name: &name})
+	},
+}
+
+type LoadTestOptions struct {
+	Concurrency int
+	Duration    time.Duration
+	// Requests stops the run after that many requests, before Duration
+	// elapses. 0 means no limit.
+	Requests  int
+	Users     int
+	Scenarios []string
+	// Keep leaves the data directory of the app in place for inspection.
+	Keep bool
+}
+
+// LoadTestStats are the latencies of the requests of a scenario, or of all
+// of them for the "total" row.
+type LoadTestStats struct {
+	Scenario   string
+	Requests   int
+	Errors     int
+	Throughput float64
+	Mean       time.Duration
+	P50        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+}
+
+type loadTestSample struct {
+	scenario string
+	latency  time.Duration
+	failed   bool
+}
+
+// RunLoadTest starts the app from its own binary on a temporary data
+// directory, seeds opts.Users users and drives the scenarios with
+// opts.Concurrency workers, returning the stats by scenario.
+func RunLoadTest(ctx context.Context, opts LoadTestOptions, out io.Writer) ([]LoadTestStats, error) {
+	if opts.Concurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+	if opts.Users < 1 {
+		return nil, errors.New("users must be at least 1")
+	}
+	for _, name := range opts.Scenarios {
+		if _, ok := LoadTestScenarios[name]; !ok {
+			return nil, fmt.Errorf("unknown scenario %q", name)
+		}
+	}
+	if len(opts.Scenarios) == 0 {
+		return nil, errors.New("no scenario to run")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "pocketbase-loadtest-*")
+	if err != nil {
+		return nil, err
+	}
+	if opts.Keep {
+		fmt.Fprintf(out, "data directory: %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	password := security.RandomString(24)
+	setup := [][]string{
+		{"migrate", "up"},
+		{"seed", "--count", fmt.Sprint(opts.Users), "--batch-size", "500"},
+		{"superuser", "upsert", loadTestSuperuser, password},
+	}
+	for _, args := range setup {
+		fmt.Fprintf(out, "running %s\n", strings.Join(args[:2], " "))
+		cmd := loadTestCommand(ctx, exe, dir, args...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%s: %w\n%s", strings.Join(args[:2], " "), err, output)
+		}
+	}
+
+	addr, err := freeLocalAddr()
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := os.Create(filepath.Join(dir, "serve.log"))
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+	serve := loadTestCommand(context.Background(), exe, dir, "serve", "--http", addr)
+	serve.Stdout, serve.Stderr = logFile, logFile
+	if err := serve.Start(); err != nil {
+		return nil, err
+	}
+	defer stopLoadTestServer(serve)
+
+	baseURL := "http://" + addr
+	if err := waitHealthy(ctx, baseURL, 30*time.Second); err != nil {
+		return nil, fmt.Errorf("%w, see %s", err, logFile.Name())
+	}
+	token, err := superuserToken(ctx, baseURL, loadTestSuperuser, password)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{
+		Timeout:   client.DefaultTimeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: opts.Concurrency},
+	}
+	c := client.New(baseURL, client.WithToken(token), client.WithHTTPClient(httpClient))
+	page, err := c.ListUsers(ctx, &client.ListUsersOptions{PerPage: min(opts.Users, 500)})
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, user := range page.Items {
+		ids = append(ids, user.Id)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no seeded user")
+	}
+
+	fmt.Fprintf(out, "driving %s with %d workers for %s\n", strings.Join(opts.Scenarios, ", "), opts.Concurrency, opts.Duration)
+	samples, elapsed := driveLoadTest(ctx, c, opts, ids)
+	return LoadTestReport(samples, elapsed, opts.Scenarios), nil
+}
+
+// driveLoadTest runs the workers until opts.Duration elapses or
+// opts.Requests are sent, each picking the scenarios at random.
+func driveLoadTest(ctx context.Context, c *client.Client, opts LoadTestOptions, ids []string) ([]loadTestSample, time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	var sent atomic.Int64
+	results := make([][]loadTestSample, opts.Concurrency)
+	wg := sync.WaitGroup{}
+	start := time.Now()
+	for w := range opts.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(w), uint64(start.UnixNano())))
+			for ctx.Err() == nil {
+				if opts.Requests > 0 && sent.Add(1) > int64(opts.Requests) {
+					return
+				}
+				name := opts.Scenarios[rng.IntN(len(opts.Scenarios))]
+				began := time.Now()
+				err := LoadTestScenarios[name](ctx, c, rng, ids)
+				if ctx.Err() != nil {
+					// cut short by the end of the run
+					return
+				}
+				results[w] = append(results[w], loadTestSample{scenario: name, latency: time.Since(began), failed: err != nil})
+			}
+		}()
+	}
+	wg.Wait()
+	return slices.Concat(results...), time.Since(start)
+}
+
+// LoadTestReport returns the stats of the samples by scenario, in the order
+// of scenarios, followed by the total.
+func LoadTestReport(samples []loadTestSample, elapsed time.Duration, scenarios []string) []LoadTestStats {
+	byScenario := map[string][]loadTestSample{}
+	for _, s := range samples {
+		byScenario[s.scenario] = append(byScenario[s.scenario], s)
+	}
+	stats := []LoadTestStats{}
+	seen := map[string]bool{}
+	for _, name := range scenarios {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		stats = append(stats, loadTestStats(name, byScenario[name], elapsed))
+	}
+	return append(stats, loadTestStats("total", samples, elapsed))
+}
+
+func loadTestStats(scenario string, samples []loadTestSample, elapsed time.Duration) LoadTestStats {
+	stats := LoadTestStats{Scenario: scenario, Requests: len(samples)}
+	if len(samples) == 0 {
+		return stats
+	}
+	latencies := make([]time.Duration, len(samples))
+	var total time.Duration
+	for i, s := range samples {
+		latencies[i] = s.latency
+		total += s.latency
+		if s.failed {
+			stats.Errors++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	stats.Throughput = float64(len(samples)) / elapsed.Seconds()
+	stats.Mean = total / time.Duration(len(samples))
+	stats.P50 = percentile(latencies, 50)
+	stats.P95 = percentile(latencies, 95)
+	stats.P99 = percentile(latencies, 99)
+	stats.Max = latencies[len(latencies)-1]
+	return stats
+}
+
+// percentile returns the nearest rank percentile p of the sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+func PrintLoadTestStats(w io.Writer, stats []LoadTestStats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "scenario\trequests\terrors\treq/s\tmean\tp50\tp95\tp99\tmax\t")
+	for _, s := range stats {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t%s\t\n", s.Scenario, s.Requests, s.Errors, s.Throughput,
+			roundLatency(s.Mean), roundLatency(s.P50), roundLatency(s.P95), roundLatency(s.P99), roundLatency(s.Max))
+	}
+	return tw.Flush()
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+// loadTestCommand runs a command of the app binary on the data directory.
+// The rate limits are turned off, the load coming from a single client.
+func loadTestCommand(ctx context.Context, exe string, dir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, exe, append([]string{"--dir", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"RATE_LIMIT_IP_PER_MINUTE=0",
+		"RATE_LIMIT_AUTH_PER_MINUTE=0",
+	)
+	return cmd
+}
+
+func stopLoadTestServer(cmd *exec.Cmd) {
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+	}
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		<-done
+	}
+}
+
+// freeLocalAddr returns a loopback address with a free port.
+func freeLocalAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+func waitHealthy(ctx context.Context, baseURL string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/api/health", nil)
+		if err != nil {
+			return err
+		}
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return errors.New("the app didn't start in time")
+}
+
+// superuserToken authenticates with the PocketBase superuser login, the
+// custom /login being for the users.
+func superuserToken(ctx context.Context, baseURL string, email string, password string) (string, error) {
+	body, err := json.Marshal(map[string]string{"identity": email, "password": password})
+	if err != nil {
+		return "", err
+	}
+	url := baseURL + "/api/collections/" + core.CollectionNameSuperusers + "/auth-with-password"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("superuser login failed with %s", resp.Status)
+	}
+	auth := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", err
+	}
+	return auth.Token, nil
+}
+
+// NewLoadTestCommand adds the "loadtest" command, which benchmarks the
+// custom routes against a throwaway copy of the app.
+func NewLoadTestCommand() *cobra.Command {
+	opts := LoadTestOptions{}
+	command := &cobra.Command{
+		Use:          "loadtest",
+		Short:        "Benchmarks the custom routes on a temporary database, reporting their latencies",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			stats, err := RunLoadTest(command.Context(), opts, os.Stdout)
+			if err != nil {
+				return err
+			}
+			return PrintLoadTestStats(os.Stdout, stats)
+		},
+	}
+	names := []string{}
+	for name := range LoadTestScenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	command.Flags().IntVar(&opts.Concurrency, "concurrency", 10, "number of concurrent workers")
+	command.Flags().DurationVar(&opts.Duration, "duration", 30*time.Second, "how long to drive the load")
+	command.Flags().IntVar(&opts.Requests, "requests", 0, "stop after that many requests, 0 for no limit")
+	command.Flags().IntVar(&opts.Users, "users", 1000, "number of users seeded before the run")
+	command.Flags().StringSliceVar(&opts.Scenarios, "scenarios", names, "scenarios to mix, out of "+strings.Join(names, ", "))
+	command.Flags().BoolVar(&opts.Keep, "keep", false, "keep the data directory and the server log of the run")
+	return command
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/mails"
+)
+
+// LockedField is the users column set on the accounts locked by an admin.
+const LockedField = "locked"
+
+var ErrUserLocked = errors.New("the account is locked")
+
+// UserLockStatus is the response of the lock and unlock routes.
+type UserLockStatus struct {
+	UserId string `json:"userId"`
+	Locked bool   `json:"locked"`
+}
+
+type PasswordResetJob struct {
+	UserId string `json:"userId"`
+}
+
+// IsLocked reports whether the auth record is a locked user.
+func IsLocked(record *core.Record) bool {
+	return record.Collection().Name == Users.Table && record.GetBool(LockedField)
+}
+
+// SetUserLocked locks or unlocks the user, returning ErrNotFound if there is
+// no such user. Locking isn't a change of the user, its updated time stays.
+func SetUserLocked(app core.App, userId string, locked bool) error {
+	span := StartStorageSpan(app, "SetUserLocked", "UPDATE")
+	affected, err := Users.Untouched().Update(app, userId, Changeset{LockedField: locked})
+	span.SetAttr("db.response.affected_rows", affected)
+	span.End(err)
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RejectLockedUsers refuses the requests authenticated as a locked user,
+// whose tokens stay valid otherwise and work again once unlocked.
+func RejectLockedUsers() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth != nil && IsLocked(e.Auth) {
+			return WriteErrorCode(e, CodeUserLocked, ErrUserLocked.Error(), nil)
+		}
+		return e.Next()
+	}
+}
+
+// QueuePasswordResetEmail queues a job sending the user PocketBase's
+// password reset email.
+func QueuePasswordResetEmail(app core.App, userId string) error {
+	_, err := EnqueueJob(app, JobPasswordResetEmail, PasswordResetJob{UserId: userId}, time.Now())
+	return err
+}
+
+// RunPasswordResetEmailJob runs the JobPasswordResetEmail jobs, which skip
+// the users deleted since.
+func RunPasswordResetEmailJob(ctx context.Context, app core.App, job *Job) error {
+	p := PasswordResetJob{}
+	if err := DecodeJobPayload(job, &p); err != nil {
+		return err
+	}
+	record, err := app.FindRecordById(Users.Table, p.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if record.GetString(Users.SoftDeleteColumn) != "" {
+		return nil
+	}
+	return mails.SendRecordPasswordReset(app, record)
+}
+
+// HandleResetUserPassword sends the user the password reset email, for the
+// support staff. The current password keeps working until it is reset.
+func HandleResetUserPassword(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		if _, err := GetUserById(app, userId); err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+		if err := QueuePasswordResetEmail(app, userId); err != nil {
+			return WriteError(e, err, "error queuing password reset email")
+		}
+		SetAuditedUser(e, userId)
+		return WriteOK(e, "password reset email queued", nil)
+	}
+}
+
+// HandleLockUser locks (locked true) or unlocks the user. The locked users
+// can't log in nor use the tokens they hold.
+func HandleLockUser(app *pocketbase.PocketBase, locked bool) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		if err := SetUserLocked(app, userId, locked); err != nil {
+			return writeUserError(e, err, "error locking user")
+		}
+		SetAuditedUser(e, userId)
+		_, actorId := RequestActor(e)
+		app.Logger().Info("User lock changed", "userId", userId, "locked", locked, "actorId", actorId)
+		return WriteOK(e, "", UserLockStatus{UserId: userId, Locked: locked})
+	}
+}
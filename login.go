@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// ErrInvalidCredentials is returned for unknown emails as well as wrong
+// passwords, so that logins can't be used to find out which emails exist.
+var ErrInvalidCredentials = errors.New("invalid email or password")
+
+// NewAuthResponse issues a PocketBase auth token for the users record, the
+// same token the built-in auth endpoints return, starting a new session on
+// the device of the request. The locked users get ErrUserLocked instead.
+func NewAuthResponse(app core.App, e *core.RequestEvent, record *core.Record) (*models.AuthResponse, error) {
+	return newAuthResponse(app, e, record, "")
+}
+
+// RefreshAuthResponse is NewAuthResponse for the requester, keeping the
+// session of the token of the request when it has one.
+func RefreshAuthResponse(app core.App, e *core.RequestEvent) (*models.AuthResponse, error) {
+	return newAuthResponse(app, e, e.Auth, RequestSessionId(e))
+}
+
+func newAuthResponse(app core.App, e *core.RequestEvent, record *core.Record, sessionId string) (*models.AuthResponse, error) {
+	if IsLocked(record) {
+		return nil, ErrUserLocked
+	}
+	user, err := GetUserById(app, record.Id)
+	if err != nil {
+		return nil, err
+	}
+	if sessionId == "" {
+		sessionId, err = StartSession(app, e, record.Id)
+	} else {
+		err = TouchSession(app, sessionId, time.Now())
+	}
+	if err != nil {
+		return nil, err
+	}
+	token, err := NewSessionToken(record, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	return &models.AuthResponse{Token: token, User: user}, nil
+}
+
+// Login checks the credentials of a user, returning ErrInvalidCredentials
+// for unknown, deleted or passwordless users too.
+func Login(app core.App, email string, password string) (*core.Record, error) {
+	record, err := app.FindAuthRecordByEmail(Users.Table, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.GetString(Users.SoftDeleteColumn) != "" || !InRecordTenant(app, record) || !record.ValidatePassword(password) {
+		return nil, ErrInvalidCredentials
+	}
+	return record, nil
+}
+
+func HandleRegister(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		if cfg.InviteOnly {
+			return WriteForbidden(e, ErrInviteOnly.Error(), nil)
+		}
+		cr := models.UserCreationRequest{}
+		if err := BindStrict(e, &cr); err != nil {
+			return WriteBindError(e, err)
+		}
+		if cr.Password == "" {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid user", validation.Errors{"password": validation.ErrRequired})
+		}
+		if err := Passwords.Check(app, e.Request.Context(), cr.Password); err != nil {
+			return WriteError(e, err, "invalid password")
+		}
+		verdict := ScreenRequest(app, e, map[string]string{"name": cr.Name})
+		if len(verdict.Rejected) > 0 {
+			return WriteErrorCode(e, CodeContentRejected, "invalid user", verdict.Rejected)
+		}
+		var user *models.User
+		err := WithTx(app, func(txApp core.App) error {
+			var err error
+			if user, err = CreateUser(txApp, cr); err != nil {
+				return err
+			}
+			return QueueUserEvent(txApp, EventUserCreated, user)
+		})
+		if errors.Is(err, ErrPasswordMismatch) {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if errors.Is(err, ErrEmailTaken) {
+			return WriteErrorCode(e, CodeEmailTaken, err.Error(), map[string]string{"email": err.Error()})
+		}
+		var validationErrs validation.Errors
+		if errors.As(err, &validationErrs) {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid user", validationErrs)
+		}
+		if err != nil {
+			return WriteError(e, err, "error registering user")
+		}
+		SetAuditedUser(e, user.Id)
+		flagForReview(app, Users.Table, user.Id, verdict)
+		EnrichSignup(app, e, user.Id)
+		if err := QueueVerificationEmail(app, user.Id); err != nil {
+			app.Logger().Warn("Failed to queue verification email", "userId", user.Id, "error", err)
+		}
+
+		record, err := app.FindRecordById(Users.Table, user.Id)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+		resp, err := NewAuthResponse(app, e, record)
+		if err != nil {
+			return WriteError(e, err, "error issuing token")
+		}
+		return WriteOK(e, "", resp)
+	}
+}
+
+// HandleLogin responds like writeAuthResponse, with a 2FA challenge for the
+// users who enabled it.
+func HandleLogin(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		lr := models.LoginRequest{}
+		if err := BindStrict(e, &lr); err != nil {
+			return WriteBindError(e, err)
+		}
+		keys := []string{AuthIPKey(e.RealIP()), AuthAccountKey(lr.Email)}
+		if retryAfter, err := Throttle.Check(e, keys...); err != nil {
+			return writeAuthThrottleError(e, retryAfter, err)
+		}
+		record, err := Login(app, lr.Email, lr.Password)
+		if errors.Is(err, ErrInvalidCredentials) {
+			Throttle.Fail(keys...)
+			return WriteErrorCode(e, CodeInvalidCredentials, err.Error(), nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error logging in: "+err.Error(), nil)
+		}
+		SetAuditedUser(e, record.Id)
+		return writeAuthResponse(app, cfg, e, record)
+	}
+}
+
+// HandleRefreshToken issues a fresh token for the users token of the
+// request. API keys, superuser and impersonation tokens can't be refreshed
+// here.
+func HandleRefreshToken(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		if e.Auth == nil || e.Auth.Collection().Name != Users.Table {
+			return WriteUnauthorized(e, "users token required", nil)
+		}
+		if e.Auth.GetString(Users.SoftDeleteColumn) != "" {
+			return WriteUnauthorized(e, "user is deleted", nil)
+		}
+		if Impersonator(e) != "" {
+			return WriteForbidden(e, ErrImpersonationRefresh.Error(), nil)
+		}
+		resp, err := RefreshAuthResponse(app, e)
+		if errors.Is(err, sql.ErrNoRows) {
+			return WriteUnauthorized(e, "user is deleted", nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error issuing token")
+		}
+		return WriteOK(e, "", resp)
+	}
+}
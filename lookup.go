@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func GetUsersByIds(app core.App, ids []string) ([]models.User, error) {
+	users := []models.User{}
+	values := make([]any, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+	span := StartStorageSpan(app, "GetUsersByIds", "SELECT")
+	err := Users.Query(app).
+		AndWhere(dbx.In("id", values...)).
+		All(&users)
+	span.SetAttr("db.response.returned_rows", len(users))
+	span.End(err)
+	if err != nil {
+		return []models.User{}, err
+	}
+	return users, Users.decryptAll(users)
+}
+
+// dedupeIds drops empty and repeated ids while keeping their order.
+func dedupeIds(ids []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+	return unique
+}
+
+// writeLookup responds with the requested users keyed by id, with a null
+// value for every id that doesn't exist.
+func writeLookup(app core.App, cfg *Config, e *core.RequestEvent, ids []string, fields []string) error {
+	ids = dedupeIds(ids)
+	if len(ids) > cfg.MaxLookupIds {
+		return WriteBadRequest(e, fmt.Sprintf("bad request: at most %d ids can be looked up at once", cfg.MaxLookupIds), nil)
+	}
+
+	result := make(map[string]any, len(ids))
+	for _, id := range ids {
+		result[id] = nil
+	}
+	if len(ids) > 0 {
+		users, err := GetUsersByIds(app, ids)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting users: "+err.Error(), nil)
+		}
+		for _, user := range users {
+			result[user.Id] = ProjectUser(e, user, fields)
+		}
+	}
+	return WriteOK(e, "", result)
+}
+
+func HandleLookupUsers(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		ids := []string{}
+		if err := e.BindBody(&ids); err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		return writeLookup(app, cfg, e, ids, nil)
+	}
+}
@@ -1,243 +1,987 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/pocketbase/dbx"
+	"github.com/EricFrancis12/pocketbase-demo/events"
+	_ "github.com/EricFrancis12/pocketbase-demo/migrations"
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/EricFrancis12/pocketbase-demo/resilience"
 	"github.com/pocketbase/pocketbase"
-	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/plugins/migratecmd"
 )
 
-type User struct {
-	Id              string `db:"id" json:"id"`
-	Email           string `db:"email" json:"email"`
-	EmailVisibility bool   `db:"emailVisibility" json:"emailVisibility"`
-	Verified        bool   `db:"verified" json:"verified"`
-	Name            string `db:"name" json:"name"`
-	Avatar          string `db:"avatar" json:"avatar"`
-	Created         string `db:"created" json:"created"`
-	Updated         string `db:"updated" json:"updated"`
+type Storage struct {
 }
 
-type UserCreationRequest struct {
-	Email           string `db:"email" json:"email"`
-	EmailVisibility bool   `db:"emailVisibility" json:"emailVisibility"`
-	Name            string `db:"name" json:"name"`
+const RetryAfterSeconds = 1
+
+type RawError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
 }
 
-type UserUpdateRequest struct {
-	Email           *string `db:"email" json:"email"`
-	EmailVisibility *bool   `db:"emailVisibility" json:"emailVisibility"`
-	Name            *string `db:"name" json:"name"`
+type RawErrorResp struct {
+	Error RawError `json:"error"`
 }
 
-type Storage struct {
+func NewRawErrorResp(code string, message string, details any) *RawErrorResp {
+	return &RawErrorResp{
+		Error: RawError{
+			Code:    code,
+			Message: message,
+			Details: details,
+		},
+	}
 }
 
-type APIResp struct {
-	Success bool   `json:"success,omitempty"`
-	Message string `json:"message,omitempty"`
-	Data    any    `json:"data,omitempty"`
+// RawResponseProfile is the profile of the Accept media types asking for
+// raw responses, e.g. application/json; profile="raw".
+const RawResponseProfile = "raw"
+
+// WantsRawResponse reports whether the request opted out of the APIResp
+// envelope via ?envelope=false, the X-Raw-Response header or the
+// RawResponseProfile. ?envelope=true opts back in whatever the headers say.
+func WantsRawResponse(e *core.RequestEvent) bool {
+	if v := e.Request.URL.Query().Get("envelope"); v != "" {
+		if envelope, err := strconv.ParseBool(v); err == nil {
+			return !envelope
+		}
+	}
+	if raw, err := strconv.ParseBool(e.Request.Header.Get("X-Raw-Response")); err == nil {
+		return raw
+	}
+	for _, part := range strings.Split(e.Request.Header.Get("Accept"), ",") {
+		if _, params, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && params["profile"] == RawResponseProfile {
+			return true
+		}
+	}
+	return false
 }
 
-func NewAPIResp(success bool, message string, data any) *APIResp {
-	return &APIResp{
-		Success: success,
-		Message: message,
-		Data:    data,
+// WriteResp writes the APIResp envelope, or just the payload when the client
+// asked for a raw response (see WantsRawResponse), in the format picked by
+// the Accept header (see NegotiateContentType). The message and the
+// validation errors are translated to the language of the request (see
+// Localize). The failures carry the
+// default code of their status, see WriteErrorCode for the specific ones.
+func WriteResp(e *core.RequestEvent, status int, message string, data any) error {
+	return writeResp(e, status, DefaultErrorCode(status), message, data)
+}
+
+func writeResp(e *core.RequestEvent, status int, code string, message string, data any) error {
+	message, data = translateResp(e, message, data)
+	success := status < http.StatusBadRequest
+	if !success {
+		message = PII.String(message)
+	}
+	e.Response.Header().Add("Vary", "X-Raw-Response")
+	if !WantsRawResponse(e) {
+		resp := models.NewAPIResp(success, message, data)
+		if !success {
+			resp.Code = code
+			resp.RequestId = RequestId(e)
+		}
+		return writeEncoded(e, status, resp)
+	}
+	if !success {
+		resp := NewRawErrorResp(code, message, data)
+		resp.Error.RequestId = RequestId(e)
+		return writeEncoded(e, status, resp)
 	}
+	if data == nil {
+		return e.NoContent(http.StatusNoContent)
+	}
+	return writeEncoded(e, status, data)
 }
 
 func WriteOK(e *core.RequestEvent, message string, data any) error {
-	return e.JSON(http.StatusOK, NewAPIResp(true, message, data))
+	return WriteResp(e, http.StatusOK, message, data)
 }
 
 func WriteBadRequest(e *core.RequestEvent, message string, data any) error {
-	return e.JSON(http.StatusBadRequest, NewAPIResp(false, message, data))
+	return WriteResp(e, http.StatusBadRequest, message, data)
 }
 
-func WriteInternalServerError(e *core.RequestEvent, message string, data any) error {
-	return e.JSON(http.StatusInternalServerError, NewAPIResp(false, message, data))
+func WriteUnauthorized(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusUnauthorized, message, data)
 }
 
-func GetUsers(app *pocketbase.PocketBase) ([]User, error) {
-	users := []User{}
-	err := app.DB().
-		NewQuery("SELECT * FROM users").
-		All(&users)
-	if err != nil {
-		return []User{}, err
-	}
-	return users, nil
+func WriteForbidden(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusForbidden, message, data)
 }
 
-func GetUserById(app *pocketbase.PocketBase, userId string) (*User, error) {
-	user := User{}
-	err := app.DB().
-		NewQuery("SELECT * FROM users WHERE id={:userId}").
-		Bind(dbx.Params{
-			"userId": userId,
-		}).
-		One(&user)
-	if err != nil {
-		return nil, err
-	}
-	return &user, nil
+func WriteNotFound(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusNotFound, message, data)
 }
 
-func GetUserByEmail(app *pocketbase.PocketBase, email string) (*User, error) {
-	user := User{}
-	err := app.DB().
-		NewQuery("SELECT * FROM users WHERE email={:email}").
-		Bind(dbx.Params{
-			"email": email,
-		}).
-		One(&user)
-	if err != nil {
-		return nil, err
+func WriteMethodNotAllowed(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusMethodNotAllowed, message, data)
+}
+
+func WriteConflict(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusConflict, message, data)
+}
+
+func WritePreconditionFailed(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusPreconditionFailed, message, data)
+}
+
+func WriteGone(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusGone, message, data)
+}
+
+func WriteRequestEntityTooLarge(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusRequestEntityTooLarge, message, data)
+}
+
+func WriteUnsupportedMediaType(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusUnsupportedMediaType, message, data)
+}
+
+func WriteUnprocessableEntity(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusUnprocessableEntity, message, data)
+}
+
+func WriteTooManyRequests(e *core.RequestEvent, message string, data any) error {
+	return WriteResp(e, http.StatusTooManyRequests, message, data)
+}
+
+// WriteInternalServerError responds with 500, or with 504 when the failure
+// comes from the request running out of time, see Timeout.
+func WriteInternalServerError(e *core.RequestEvent, message string, data any) error {
+	if deadlineExceeded(e) {
+		return writeDeadlineExceeded(e)
 	}
-	return &user, nil
+	return WriteResp(e, http.StatusInternalServerError, message, data)
 }
 
-func InsertUser(app *pocketbase.PocketBase, cr UserCreationRequest) (*User, error) {
-	_, err := app.DB().
-		NewQuery("INSERT INTO users (email, emailVisibility, name) VALUES ({:email}, {:emailVisibility}, {:name})").
-		Bind(dbx.Params{
-			"email":           cr.Email,
-			"emailVisibility": cr.EmailVisibility,
-			"name":            cr.Name,
-		}).
-		Execute()
+func WriteServiceUnavailable(e *core.RequestEvent, message string, data any) error {
+	e.Response.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds))
+	return WriteResp(e, http.StatusServiceUnavailable, message, data)
+}
+
+func main() {
+	started := time.Now()
+	app := pocketbase.New()
+
+	migratecmd.MustRegister(app, app.RootCmd, migratecmd.Config{
+		// enable auto creation of migration files when making collection changes in the Dashboard
+		// (the isGoRun check is to enable it only during development)
+		Automigrate: strings.HasPrefix(os.Args[0], os.TempDir()),
+	})
+
+	app.RootCmd.AddCommand(NewSeedCommand(app), NewWipeUsersCommand(app), NewAPIKeyCommand(app), NewUsersCommand(app), NewSchemaCommand(app), NewGenClientCommand(), NewLoadTestCommand())
+
+	cfg, err := LoadConfig(app.RootCmd)
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
+	}
+	if err := Setup(app, cfg, started); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := app.Start(); err != nil {
+		log.Fatal(err)
 	}
-	return GetUserByEmail(app, cr.Email)
 }
 
-func UpdateUserById(app *pocketbase.PocketBase, userId string, ur UserUpdateRequest) (*User, error) {
-	values := []string{}
-	params := dbx.Params{
-		"userId": userId,
+// Setup applies cfg and binds the hooks, the jobs and the custom routes to
+// app, for main and for the tests, which serve the routes of a test app.
+// started is when the process started, for the uptime of the alerts.
+func Setup(app *pocketbase.PocketBase, cfg *Config, started time.Time) error {
+	SetReadOnlyFields(cfg.ReadOnlyFields)
+	ReadOnlyForced = cfg.ReadOnlyMode
+	DemoSeedOptions.Count = cfg.DemoSeedUsers
+	if err := SetIdStrategies(cfg.IdStrategies, cfg.SnowflakeNode); err != nil {
+		return err
+	}
+	piiPatterns, err := CompilePIIPatterns(cfg.PIIPatterns)
+	if err != nil {
+		return fmt.Errorf("PII_PATTERNS: %w", err)
 	}
-	if ur.Email != nil {
-		values = append(values, "email={:email}")
-		params["email"] = *ur.Email
+	PII = NewSanitizer(piiPatterns)
+	if Views, err = LoadTemplates(cfg.TemplatesDir); err != nil {
+		return fmt.Errorf("loading the templates: %w", err)
 	}
-	if ur.EmailVisibility != nil {
-		values = append(values, "emailVisibility={:emailVisibility}")
-		params["emailVisibility"] = *ur.EmailVisibility
+	if Catalogs, err = LoadCatalogs(cfg.LocalesDir); err != nil {
+		return fmt.Errorf("loading the message catalogs: %w", err)
 	}
-	if ur.Name != nil {
-		values = append(values, "name={:name}")
-		params["name"] = *ur.Name
+	cfg.DefaultLanguage = strings.ToLower(cfg.DefaultLanguage)
+	if _, ok := Catalogs[cfg.DefaultLanguage]; !ok {
+		return fmt.Errorf("DEFAULT_LANGUAGE %q has no catalog, available: %s", cfg.DefaultLanguage, strings.Join(Languages(), ", "))
 	}
-	if len(values) == 0 {
-		return nil, fmt.Errorf("empty update request")
+	DefaultLanguage = cfg.DefaultLanguage
+	for _, s := range cfg.MergeOwnedTables {
+		owned, err := ParseOwnedTable(s)
+		if err != nil {
+			return fmt.Errorf("MERGE_OWNED_TABLES: %w", err)
+		}
+		RegisterOwnedTable(owned.Table, owned.Column)
 	}
-	query := fmt.Sprintf("UPDATE users SET %s WHERE id={:userId}", strings.Join(values, ", "))
-	_, err := app.DB().
-		NewQuery(query).
-		Bind(params).
-		Execute()
-	if err != nil {
-		return nil, err
+	if cfg.ShareLinkSecret == "" {
+		log.Println("SHARE_LINK_SECRET is not set, share links won't survive a restart")
+		cfg.ShareLinkSecret = NewShareLinkSecret()
+	}
+	if cfg.EmailChangeSecret == "" {
+		log.Println("EMAIL_CHANGE_SECRET is not set, pending email changes won't survive a restart")
+		cfg.EmailChangeSecret = NewShareLinkSecret()
+	}
+	if cfg.VerificationSecret == "" {
+		log.Println("VERIFICATION_SECRET is not set, verification links won't survive a restart")
+		cfg.VerificationSecret = NewShareLinkSecret()
+	}
+	if cfg.TeamInviteSecret == "" {
+		log.Println("TEAM_INVITE_SECRET is not set, team invitations won't survive a restart")
+		cfg.TeamInviteSecret = NewShareLinkSecret()
+	}
+	if cfg.InvitationSecret == "" {
+		log.Println("INVITATION_SECRET is not set, invitation links won't survive a restart")
+		cfg.InvitationSecret = NewShareLinkSecret()
+	}
+	if cfg.BulkDeleteSecret == "" {
+		cfg.BulkDeleteSecret = NewShareLinkSecret()
+	}
+	if cfg.TwoFactorSecret == "" {
+		log.Println("TWO_FACTOR_SECRET is not set, 2FA sessions won't survive a restart")
+		cfg.TwoFactorSecret = NewShareLinkSecret()
+	}
+	if cfg.OAuth2StateSecret == "" {
+		cfg.OAuth2StateSecret = NewShareLinkSecret()
+	}
+	if cfg.SignupFormSecret == "" {
+		cfg.SignupFormSecret = NewShareLinkSecret()
+	}
+	if len(cfg.FieldEncryptionKeys) > 0 {
+		if FieldEncryption, err = NewFieldCipher(cfg.FieldEncryptionKeys); err != nil {
+			return fmt.Errorf("FIELD_ENCRYPTION_KEYS: %w", err)
+		}
+	} else {
+		log.Println("FIELD_ENCRYPTION_KEYS is not set, the phone and nationalId of the users can't be written")
+	}
+	if cfg.DownloadURLSecret == "" {
+		log.Println("DOWNLOAD_URL_SECRET is not set, download links won't survive a restart")
+		cfg.DownloadURLSecret = NewShareLinkSecret()
+	}
+	BindStorageConfig(app, cfg)
+	WriteRetryOptions.MaxAttempts = cfg.WriteRetryAttempts
+	Downstream = resilience.NewRegistry(resilience.Options{
+		FailureThreshold: cfg.BreakerFailureThreshold,
+		OpenTimeout:      cfg.BreakerOpenTimeout,
+		MaxConcurrent:    cfg.BulkheadMaxConcurrent,
+	})
+	if cfg.OTLPEndpoint != "" {
+		Tracing = NewTracer(cfg.OTLPEndpoint, cfg.OTelServiceName)
+		app.OnBootstrap().BindFunc(func(e *core.BootstrapEvent) error {
+			if err := e.Next(); err != nil {
+				return err
+			}
+			TraceQueries(e.App)
+			return nil
+		})
+		app.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := Tracing.Shutdown(ctx); err != nil {
+				e.App.Logger().Warn("Failed to flush traces", "error", err)
+			}
+			return e.Next()
+		})
 	}
-	return GetUserById(app, userId)
-}
 
-func DeleteUserById(app *pocketbase.PocketBase, userId string) error {
-	_, err := app.DB().
-		NewQuery("DELETE FROM users WHERE id={:userId}").
-		Bind(dbx.Params{
-			"userId": userId,
-		}).
-		Execute()
-	return err
-}
+	app.OnRecordAuthRequest("users").BindFunc(func(e *core.RecordAuthRequestEvent) error {
+		if e.Record.GetString("deleted_at") != "" {
+			return e.ForbiddenError("The account has been deleted.", nil)
+		}
+		if IsLocked(e.Record) {
+			return e.ForbiddenError("The account is locked.", nil)
+		}
+		return e.Next()
+	})
+	// before the sessions, which the challenges don't start
+	BindTwoFactorHooks(app, cfg)
+	BindSessionHooks(app)
+	BindAuthThrottleHooks(app)
 
-func HandleGetUsers(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
-	return func(e *core.RequestEvent) error {
-		users, err := GetUsers(app)
-		if err != nil {
-			return WriteInternalServerError(e, "error getting users: "+err.Error(), nil)
+	app.OnRecordAfterDeleteSuccess("users").BindFunc(func(e *core.RecordEvent) error {
+		if err := RemoveGeneratedAvatar(e.App, e.Record.Id); err != nil {
+			e.App.Logger().Warn("Failed to remove generated avatar", "userId", e.Record.Id, "error", err)
 		}
-		return WriteOK(e, "", users)
-	}
-}
+		if err := RemoveAvatarDerivatives(e.App, e.Record.Id); err != nil {
+			e.App.Logger().Warn("Failed to remove avatar derivatives", "userId", e.Record.Id, "error", err)
+		}
+		return e.Next()
+	})
 
-func HandleGetUserById(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
-	return func(e *core.RequestEvent) error {
-		userId := e.Request.PathValue("userId")
-		user, err := GetUserById(app, userId)
+	BindWebhookHooks(app)
+	BindResponseCacheHooks(app)
+	BindTombstoneHooks(app)
+	BindLogSanitizer(app)
+	if len(cfg.AlertChannels) > 0 {
+		channels, err := ParseAlertChannels(cfg.AlertChannels)
 		if err != nil {
-			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+			return fmt.Errorf("ALERT_CHANNELS: %w", err)
 		}
-		return WriteOK(e, "", user)
+		routes, err := ParseAlertRoutes(cfg.AlertRoutes, channels)
+		if err != nil {
+			return fmt.Errorf("ALERT_ROUTES: %w", err)
+		}
+		Alerts = NewAlerter(app, channels, routes, cfg.AlertThrottle)
 	}
-}
-
-func HandleInsertUser(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
-	return func(e *core.RequestEvent) error {
-		cr := UserCreationRequest{}
-		if err := e.BindBody(&cr); err != nil {
-			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+	BindAlertHooks(app, started)
+	responsesCache, err := OpenCache(app, cfg, "responses:", cfg.ResponseCacheSize)
+	if err != nil {
+		return err
+	}
+	rateLimitCache, err := OpenCache(app, cfg, "ratelimit:", RateLimitMaxKeys)
+	if err != nil {
+		return err
+	}
+	settingsCache, err := OpenCache(app, cfg, "settings:", 16)
+	if err != nil {
+		return err
+	}
+	nonceCache, err := OpenCache(app, cfg, "nonces:", SignatureMaxNonces)
+	if err != nil {
+		return err
+	}
+	SignedRequests = NewRequestSigning(nonceCache, cfg.SignedRequestMaxSkew, cfg.RequireSignedRequests)
+	if cfg.CacheURL != "" {
+		ReadinessChecks["cache"] = func(ctx context.Context, app core.App) error {
+			return settingsCache.Ping(ctx)
 		}
-		user, err := InsertUser(app, cr)
+	}
+	if cfg.ResponseCacheTTL > 0 {
+		UserResponseCache = NewResponseCache(responsesCache, cfg.ResponseCacheTTL, app.Logger())
+	}
+	ScheduleIdempotencyKeysCleanup(app, cfg.IdempotencyKeyTTL)
+	ScheduleSessionsCleanup(app)
+	ScheduleAuthFailuresCleanup(app, cfg.AuthFailureWindow)
+	ScheduleProfileChangeNotifications(app)
+	ScheduleTombstonesCleanup(app, cfg.SyncTombstoneTTL)
+	ScheduleOutboxCleanup(app, cfg.OutboxRetention)
+	if cfg.EventBusURL != "" {
+		bus, err := events.NewPublisher(cfg.EventBusURL, events.WithName(cfg.OTelServiceName), events.WithTimeout(cfg.EventBusTimeout))
 		if err != nil {
-			return WriteInternalServerError(e, "error creating new user: "+err.Error(), nil)
+			return err
 		}
-		return WriteOK(e, "", user)
+		EventBus = bus
+		BindEventBus(app, EventBus, cfg.EventBusPrefix)
 	}
-}
-
-func HandleUpdateUserById(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
-	return func(e *core.RequestEvent) error {
-		userId := e.Request.PathValue("userId")
-		ur := UserUpdateRequest{}
-		if err := e.BindBody(&ur); err != nil {
-			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
-		}
-		_, err := UpdateUserById(app, userId, ur)
+	if cfg.ModerationRejectList != "" || cfg.ModerationFlagList != "" || cfg.ModerationAPIURL != "" {
+		moderator, err := NewModerator(cfg)
 		if err != nil {
-			return WriteInternalServerError(e, "error creating new user: "+err.Error(), nil)
+			return err
 		}
-		return WriteOK(e, "", nil)
+		Moderation = moderator
 	}
-}
-
-func HandleDeleteUserById(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
-	return func(e *core.RequestEvent) error {
-		userId := e.Request.PathValue("userId")
-		err := DeleteUserById(app, userId)
+	Passwords = NewPasswordPolicy(cfg)
+	if cfg.CaptchaVerifyURL != "" {
+		Captcha = NewSiteVerifyCaptcha(cfg.CaptchaVerifyURL, cfg.CaptchaSecret)
+	}
+	if cfg.GeoIPDatabase != "" {
+		db, err := LoadGeoIPDatabase(cfg.GeoIPDatabase)
 		if err != nil {
-			return WriteInternalServerError(e, "error deleting user: "+err.Error(), nil)
+			return err
 		}
-		return WriteOK(e, "", nil)
+		GeoIP = db
 	}
-}
+	scheduler := NewScheduler(app)
+	scheduler.Bind(app)
+	retention := NewRetentionEngine(app, cfg.RetentionMaxPerRun)
+	retention.Bind(app)
+	ScheduleRetentionReportsCleanup(app, cfg.RetentionReportTTL)
+	routeSettings := NewRouteSettingsLoader(app, settingsCache, rateLimitCache)
+	routeSettings.Bind(app)
+	emailBlocklist := NewEmailDomainBlocklist(app)
+	emailBlocklist.Bind(app)
+	sitemap := NewSitemap(app, cfg.SitemapChunkSize)
+	sitemap.Schedule(cfg.SitemapSchedule)
+	FeatureFlags = NewFlagSet(app)
+	FeatureFlags.Bind(app)
+	BindGracefulShutdown(app, cfg.ShutdownTimeout)
 
-func main() {
-	app := pocketbase.New()
+	var users UserService = NewUserService(app)
+	if cfg.UserEventSourcing {
+		users = NewEventSourcedUserService(app)
+	}
 
 	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
-		se.Router.GET("/users", HandleGetUsers(app))
-		se.Router.GET("/users/{userId}", HandleGetUserById(app))
-		se.Router.POST("/users", HandleInsertUser(app))
-		se.Router.PATCH("/users/{userId}", HandleUpdateUserById(app))
-		se.Router.DELETE("/users/{userId}", HandleDeleteUserById(app))
+		if err := EnforceSchema(app, cfg.SchemaDriftAction); err != nil {
+			return err
+		}
+
+		Webhooks = NewWebhookDispatcher(app, WebhookOptions{
+			MaxAttempts: cfg.WebhookMaxAttempts,
+			BaseDelay:   cfg.WebhookBaseDelay,
+			Timeout:     cfg.WebhookTimeout,
+		})
+		RegisterJobHandler(JobWebhookDelivery, Webhooks.JobHandler())
+		RegisterJobHandler(JobVerificationEmail, JobHandler{
+			Run:         RunVerificationEmailJob(cfg),
+			MaxAttempts: cfg.JobMaxAttempts,
+			BaseDelay:   cfg.JobBaseDelay,
+		})
+		RegisterJobHandler(JobPasswordResetEmail, JobHandler{
+			Run:         RunPasswordResetEmailJob,
+			MaxAttempts: cfg.JobMaxAttempts,
+			BaseDelay:   cfg.JobBaseDelay,
+		})
+		RegisterJobHandler(JobAvatarThumbs, JobHandler{
+			Run:         RunAvatarThumbsJob,
+			MaxAttempts: cfg.JobMaxAttempts,
+			BaseDelay:   cfg.JobBaseDelay,
+		})
+		RegisterJobHandler(JobTakeout, JobHandler{
+			Run:         RunTakeoutJob(cfg),
+			MaxAttempts: cfg.JobMaxAttempts,
+			BaseDelay:   cfg.JobBaseDelay,
+		})
+		RegisterJobHandler(JobNotificationDigest, JobHandler{
+			Run:         RunNotificationDigestJob,
+			MaxAttempts: cfg.JobMaxAttempts,
+			BaseDelay:   cfg.JobBaseDelay,
+		})
+		RegisterJobHandler(JobProfileChangeEmail, JobHandler{
+			Run:         RunProfileChangeEmailJob,
+			MaxAttempts: cfg.JobMaxAttempts,
+			BaseDelay:   cfg.JobBaseDelay,
+		})
+		Queue = NewJobQueue(app, cfg.JobWorkers, cfg.JobPollInterval)
+		if err := Queue.Start(); err != nil {
+			app.Logger().Error("Failed to start the job queue", "error", err)
+		}
+		Outbox = NewOutboxDispatcher(app, OutboxOptions{
+			PollInterval: cfg.OutboxPollInterval,
+			BatchSize:    cfg.OutboxBatchSize,
+			BaseDelay:    cfg.OutboxBaseDelay,
+			MaxDelay:     cfg.OutboxMaxDelay,
+		})
+		Outbox.Start()
+
+		ActivityLog = NewActivityRecorder(app, cfg.ActivityBatchSize, cfg.ActivityHistorySize)
+		ActivityLog.Start(cfg.ActivityFlushInterval)
+		Usage = NewUsageTracker(app)
+		Usage.Start(cfg.UsageFlushInterval)
+		if cfg.AuthLockoutThreshold > 0 {
+			Throttle = NewAuthThrottle(app, AuthThrottleOptions{
+				LockoutThreshold: cfg.AuthLockoutThreshold,
+				CaptchaThreshold: cfg.AuthCaptchaThreshold,
+				BaseLockout:      cfg.AuthLockoutBase,
+				MaxLockout:       cfg.AuthLockoutMax,
+				Window:           cfg.AuthFailureWindow,
+			})
+			if err := Throttle.Load(); err != nil {
+				return err
+			}
+		}
+
+		InstrumentDB(app, Metrics)
+		queryAnalyzer := NewQueryAnalyzer(app, cfg.SlowQueryThreshold, cfg.QueryStatsMaxStatements)
+		AnalyzeQueries(app, queryAnalyzer)
+		CheckQueryIndexes(app)
+		if cfg.ReadReplicaConns > 0 {
+			replica, err := OpenReadReplica(app, cfg.ReadReplicaConns)
+			if err != nil {
+				return err
+			}
+			ReadReplica = replica
+		}
+		if cfg.LegacySyncDSN != "" {
+			syncer, err := NewLegacySyncer(app, cfg)
+			if err != nil {
+				return err
+			}
+			LegacySync = syncer
+			LegacySync.Schedule(cfg.LegacySyncSchedule)
+		}
+
+		// shared by the requests and the websockets of the same users
+		lastSeen := NewLastSeenTracker(cfg.LastSeenInterval, cfg.LastSeenCacheSize)
+
+		se.Router.BindFunc(TrackInFlight(Drain))
+		se.Router.BindFunc(Localize())
+		se.Router.BindFunc(LogRequests(app))
+		se.Router.BindFunc(RecordMetrics(Metrics))
+		if Alerts != nil && cfg.AlertErrorRatePercent > 0 {
+			se.Router.BindFunc(AlertOnErrorRate(NewErrorRateMonitor(cfg.AlertErrorRatePercent, cfg.AlertErrorRateWindow, cfg.AlertErrorRateRequests)))
+		}
+		if cfg.CompressionMinSize >= 0 {
+			se.Router.BindFunc(Compress(cfg.CompressionMinSize))
+		}
+		se.Router.BindFunc(ServeHead())
+		if cfg.ContractMode != "" {
+			if app.IsDev() {
+				se.Router.BindFunc(NewContractRecorder(cfg.ContractMode, cfg.ContractDir).Middleware())
+			} else {
+				app.Logger().Warn("CONTRACT_MODE is ignored outside of --dev", "mode", cfg.ContractMode)
+			}
+		}
+
+		var ipLimiter, authLimiter *TokenBucket
+		if cfg.RateLimitIPPerMinute > 0 {
+			ipLimiter = NewTokenBucket(rateLimitCache, "ip", cfg.RateLimitIPPerMinute, cfg.RateLimitIPBurst)
+		}
+		if cfg.RateLimitAuthPerMinute > 0 {
+			authLimiter = NewTokenBucket(rateLimitCache, "auth", cfg.RateLimitAuthPerMinute, cfg.RateLimitAuthBurst)
+		}
+		se.Router.BindFunc(Timeout(cfg))
+		se.Router.BindFunc(ApplyRouteSettings(routeSettings))
+		se.Router.BindFunc(ReadOnly(routeSettings))
+		se.Router.BindFunc(Maintenance(routeSettings, cfg))
+		se.Router.BindFunc(RateLimit(ipLimiter, authLimiter, routeSettings))
+		se.Router.BindFunc(TrackUsage(cfg))
+		se.Router.BindFunc(LimitBody(cfg))
+		se.Router.BindFunc(ResolveTenant(app, cfg.TenantBaseDomain))
+		se.Router.BindFunc(RejectLockedUsers())
+		se.Router.BindFunc(CheckSessions(app, lastSeen))
+		se.Router.BindFunc(GatePremiumRoutes(app, cfg))
+		se.Router.BindFunc(TrackLastSeen(app, lastSeen))
+		se.Router.BindFunc(TrackActivity())
+		se.Router.BindFunc(TrackImpersonation())
+		se.Router.BindFunc(AuditMutations(app))
+
+		HandleResource(se.Router, "/healthz", func(r *Resource) {
+			r.GET(HandleHealthz())
+		})
+		HandleResource(se.Router, "/readyz", func(r *Resource) {
+			r.GET(HandleReadyz(app))
+		})
+		HandleResource(se.Router, "/flags", func(r *Resource) {
+			r.GET(HandleListFlags())
+		})
+
+		HandleResource(se.Router, "/metrics", func(r *Resource) {
+			r.GET(HandleMetrics(Metrics)).BindFunc(RequireMetricsToken(cfg.MetricsToken))
+		})
+
+		// not Resources, the profiles being no JSON API
+		se.Router.GET("/debug/pprof/{profile...}", HandlePprof(cfg)).BindFunc(RequireDebugToken(cfg))
+		se.Router.POST("/debug/pprof/{profile...}", HandlePprof(cfg)).BindFunc(RequireDebugToken(cfg))
+
+		RegisterCRUD(se.Router, "posts", PostsCRUDOptions(app, cfg))
+
+		HandleResource(se.Router, "/api/openapi.json", func(r *Resource) {
+			r.GET(HandleOpenAPISpec())
+		})
+		HandleResource(se.Router, "/api/docs", func(r *Resource) {
+			r.GET(HandleAPIDocs())
+		})
+		se.Router.GET("/admin-ui/{path...}", HandleAdminUI())
+
+		HandleResource(se.Router, "/auth/register", func(r *Resource) {
+			r.POST(HandleRegister(app, cfg)).BindFunc(GuardSignup(cfg, emailBlocklist))
+		})
+		HandleResource(se.Router, "/auth/register/form", func(r *Resource) {
+			r.GET(HandleSignupForm(cfg))
+		})
+		HandleResource(se.Router, "/auth/login", func(r *Resource) {
+			r.POST(HandleLogin(app, cfg))
+		})
+		HandleResource(se.Router, "/auth/refresh", func(r *Resource) {
+			r.POST(HandleRefreshToken(app))
+		})
+		HandleResource(se.Router, "/auth/2fa", func(r *Resource) {
+			r.POST(HandleVerifyTwoFactor(app, cfg))
+		})
+		HandleResource(se.Router, "/auth/oauth2/{provider}", func(r *Resource) {
+			r.GET(HandleOAuth2Redirect(app, cfg))
+		})
+		HandleResource(se.Router, "/auth/oauth2/{provider}/callback", func(r *Resource) {
+			r.GET(HandleOAuth2Callback(app, cfg))
+		})
+
+		HandleResource(se.Router, "/users", func(r *Resource) {
+			r.GET(HandleGetUsers(app, users, cfg)).BindFunc(RequireAuth(), CacheResponses(UserResponseCache))
+			r.POST(HandleInsertUser(app, users, cfg)).BindFunc(RequireSuperuser(), Idempotent(app, cfg.IdempotencyKeyTTL))
+			r.PUT(HandleUpsertUser(app)).BindFunc(RequireSuperuser())
+			r.DELETE(HandleBulkDeleteUsers(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/users/export", func(r *Resource) {
+			r.GET(HandleExportUsers(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/users/import", func(r *Resource) {
+			r.POST(HandleImportUsers(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/users/batch", func(r *Resource) {
+			r.POST(HandleBatchUsers(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/users/events", func(r *Resource) {
+			r.GET(HandleUserEvents()).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/ws", func(r *Resource) {
+			r.GET(HandlePresence(app, Presence, lastSeen)).BindFunc(AuthFromQueryToken(app))
+		})
+		HandleResource(se.Router, "/users/verify", func(r *Resource) {
+			r.GET(HandleVerifyUser(app, cfg))
+		})
+		HandleResource(se.Router, "/users/search", func(r *Resource) {
+			r.GET(HandleSearchUsers(app, cfg)).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/users/changes", func(r *Resource) {
+			r.GET(HandleGetUserChanges(app, cfg)).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/users/active", func(r *Resource) {
+			r.GET(HandleGetActiveUsers(app)).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/users/lookup", func(r *Resource) {
+			r.POST(HandleLookupUsers(app, cfg)).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/users/{userId}", func(r *Resource) {
+			r.GET(HandleGetUserById(app, users)).BindFunc(RequireAuth(), CacheResponses(UserResponseCache))
+			// the users edit their own profile, within the writable fields
+			// of the route, the other writes being the superusers' only
+			r.PATCH(HandleUpdateUserById(app, users, cfg)).BindFunc(RequireSuperuserOrOwner("userId"))
+			r.DELETE(HandleDeleteUserById(users)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/users/{userId}/history", func(r *Resource) {
+			r.GET(HandleGetUserHistory(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/users/{userId}/restore", func(r *Resource) {
+			r.POST(HandleRestoreUserById(users)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/users/{userId}/roles", func(r *Resource) {
+			r.POST(HandleAssignUserRole(app)).BindFunc(RequireRole(RoleAdmin))
+		})
+		HandleResource(se.Router, "/users/{userId}/roles/{role}", func(r *Resource) {
+			r.DELETE(HandleRevokeUserRole(app)).BindFunc(RequireRole(RoleAdmin))
+		})
+		HandleResource(se.Router, "/users/{userId}/avatar", func(r *Resource) {
+			// public, the profile pages shared outside of the app show it
+			r.GET(HandleGetUserAvatar(app, cfg))
+			r.POST(HandleUploadUserAvatar(app, cfg)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/posts", func(r *Resource) {
+			r.GET(HandleGetUserPosts(app, cfg)).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/users/{userId}/set-password", func(r *Resource) {
+			r.POST(HandleSetUserPassword(app)).BindFunc(RequireSuperuserOrOwner("userId"), Require2FA(app, cfg))
+		})
+		HandleResource(se.Router, "/users/{userId}/2fa", func(r *Resource) {
+			r.POST(HandleEnrollTOTP(app)).BindFunc(RequireSuperuserOrOwner("userId"))
+			r.DELETE(HandleDisableTOTP(app)).BindFunc(RequireSuperuserOrOwner("userId"), Require2FA(app, cfg))
+		})
+		HandleResource(se.Router, "/users/{userId}/2fa/confirm", func(r *Resource) {
+			r.POST(HandleConfirmTOTP(app)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/2fa/backup-codes", func(r *Resource) {
+			r.POST(HandleRegenerateBackupCodes(app)).BindFunc(RequireSuperuserOrOwner("userId"), Require2FA(app, cfg))
+		})
+		HandleResource(se.Router, "/users/{userId}/sessions", func(r *Resource) {
+			r.GET(HandleListSessions(app)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/sessions/{sessionId}", func(r *Resource) {
+			r.DELETE(HandleRevokeSession(app)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/preferences", func(r *Resource) {
+			r.GET(HandleGetPreferences(app)).BindFunc(RequireSuperuserOrOwner("userId"))
+			r.PUT(HandleSetPreferences(app)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/activity", func(r *Resource) {
+			r.GET(HandleGetUserActivity(app, cfg)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/notifications", func(r *Resource) {
+			r.GET(HandleListNotifications(app, cfg)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/notifications/read", func(r *Resource) {
+			r.POST(HandleMarkAllNotificationsRead(app)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/notifications/{notificationId}/read", func(r *Resource) {
+			r.POST(HandleMarkNotificationRead(app)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/usage", func(r *Resource) {
+			r.GET(HandleGetUserUsage(app, cfg)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/personal-data", func(r *Resource) {
+			r.DELETE(HandleErasePersonalData(app, cfg)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/takeout", func(r *Resource) {
+			r.GET(HandleRequestTakeout(app, cfg)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/request-verification", func(r *Resource) {
+			r.POST(HandleRequestVerification(app, cfg)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/{userId}/email-change", func(r *Resource) {
+			r.POST(HandleRequestEmailChange(app, cfg)).BindFunc(RequireSuperuserOrOwner("userId"))
+		})
+		HandleResource(se.Router, "/users/email-change/confirm", func(r *Resource) {
+			r.GET(HandleConfirmEmailChangeLink(app, cfg))
+		})
+		HandleResource(se.Router, "/users/{userId}/confirm-email-change", func(r *Resource) {
+			r.POST(HandleConfirmEmailChange(app, cfg))
+		})
+		HandleResource(se.Router, "/users/{userId}/increment", func(r *Resource) {
+			r.POST(HandleIncrementUserCounter(app)).BindFunc(RequireSuperuser())
+		})
+		// /share and /shared/{token} are the shorter forms of the share
+		// link routes, the tokens working with both
+		for _, path := range []string{"/users/{userId}/share-link", "/users/{userId}/share"} {
+			HandleResource(se.Router, path, func(r *Resource) {
+				r.POST(HandleCreateShareLink(app, cfg)).BindFunc(RequireSuperuserOrOwner("userId"))
+			})
+		}
+		HandleResource(se.Router, "/users/{targetId}/merge", func(r *Resource) {
+			r.POST(HandleMergeUsers(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/teams", func(r *Resource) {
+			r.POST(HandleCreateTeam(app)).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/teams/invitations/accept", func(r *Resource) {
+			r.POST(HandleAcceptTeamInvite(app, cfg)).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/teams/{teamId}/members", func(r *Resource) {
+			r.GET(HandleListTeamMembers(app)).BindFunc(RequireTeamRole(app, TeamRoleMember))
+		})
+		HandleResource(se.Router, "/teams/{teamId}/members/{userId}", func(r *Resource) {
+			r.PUT(HandleSetTeamRole(app)).BindFunc(RequireTeamRole(app, TeamRoleAdmin))
+		})
+		HandleResource(se.Router, "/teams/{teamId}/invitations", func(r *Resource) {
+			r.POST(HandleInviteToTeam(app, cfg)).BindFunc(RequireTeamRole(app, TeamRoleAdmin))
+		})
+		HandleResource(se.Router, "/invitations/{token}", func(r *Resource) {
+			r.GET(HandleGetInvitation(app, cfg))
+		})
+		HandleResource(se.Router, "/invitations/{token}/accept", func(r *Resource) {
+			r.POST(HandleAcceptInvitation(app, cfg))
+		})
+		HandleResource(se.Router, "/billing/checkout", func(r *Resource) {
+			r.POST(HandleCreateCheckoutSession(app, cfg)).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/billing/subscription", func(r *Resource) {
+			r.GET(HandleGetSubscription(app)).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/scim/v2/Users", func(r *Resource) {
+			r.GET(HandleListSCIMUsers(app, cfg)).BindFunc(RequireSCIMToken(cfg))
+			r.POST(HandleCreateSCIMUser(app)).BindFunc(RequireSCIMToken(cfg))
+		})
+		HandleResource(se.Router, "/scim/v2/Users/{userId}", func(r *Resource) {
+			r.GET(HandleGetSCIMUser(app)).BindFunc(RequireSCIMToken(cfg))
+			r.PATCH(HandlePatchSCIMUser(app)).BindFunc(RequireSCIMToken(cfg))
+			r.DELETE(HandleDeleteSCIMUser(users)).BindFunc(RequireSCIMToken(cfg))
+		})
+		HandleResource(se.Router, "/hooks/{provider}", func(r *Resource) {
+			r.POST(HandleInboundHook(app, cfg))
+		})
+		HandleResource(se.Router, "/downloads/{token}", func(r *Resource) {
+			r.GET(HandleDownload(app, cfg))
+		})
+		HandleResource(se.Router, "/p/{userId}", func(r *Resource) {
+			r.GET(HandleProfilePage(app))
+		})
+		HandleResource(se.Router, "/sitemap.xml", func(r *Resource) {
+			r.GET(HandleSitemap(sitemap))
+		})
+		HandleResource(se.Router, "/sitemaps/{file}", func(r *Resource) {
+			r.GET(HandleSitemapFile(sitemap))
+		})
+		HandleResource(se.Router, "/robots.txt", func(r *Resource) {
+			r.GET(HandleRobotsTxt(app, cfg))
+		})
+		for _, path := range []string{"/shared/users/{token}", "/shared/{token}"} {
+			HandleResource(se.Router, path, func(r *Resource) {
+				r.GET(HandleGetSharedUser(app, cfg))
+			})
+		}
+
+		graphQL := HandleGraphQL(app, cfg)
+		HandleResource(se.Router, "/graphql", func(r *Resource) {
+			r.GET(graphQL).BindFunc(RequireAuth())
+			r.POST(graphQL).BindFunc(RequireAuth())
+		})
+		HandleResource(se.Router, "/graphql/schema", func(r *Resource) {
+			r.GET(HandleGraphQLSchema())
+		})
+
+		HandleResource(se.Router, "/admin/users-backup", func(r *Resource) {
+			r.GET(HandleUsersBackup(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/users-restore", func(r *Resource) {
+			r.POST(HandleUsersRestore(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/backup", func(r *Resource) {
+			r.POST(HandleCreateBackup(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/backups", func(r *Resource) {
+			r.GET(HandleListBackups(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/restore/{name}", func(r *Resource) {
+			r.POST(HandleRestoreBackup(app)).BindFunc(RequireSuperuserToken())
+		})
+		staticDeployer := NewStaticDeployer(cfg)
+		HandleResource(se.Router, "/admin/deploy-static", func(r *Resource) {
+			r.GET(HandleListStaticVersions(staticDeployer)).BindFunc(RequireSuperuser())
+			r.POST(HandleDeployStatic(staticDeployer)).BindFunc(RequireSuperuser(), RequireDeployToken(cfg))
+		})
+		HandleResource(se.Router, "/admin/deploy-static/{version}/rollback", func(r *Resource) {
+			r.POST(HandleRollbackStatic(staticDeployer)).BindFunc(RequireSuperuser(), RequireDeployToken(cfg))
+		})
+		HandleResource(se.Router, "/admin/maintenance", func(r *Resource) {
+			r.GET(HandleGetMaintenance(routeSettings, cfg)).BindFunc(RequireSuperuser())
+			r.PUT(HandleSetMaintenance(app, routeSettings, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/read-only", func(r *Resource) {
+			r.GET(HandleGetReadOnly(routeSettings)).BindFunc(RequireSuperuser())
+			r.PUT(HandleSetReadOnly(app, routeSettings)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/invitations", func(r *Resource) {
+			r.GET(HandleListInvitations(app)).BindFunc(RequireSuperuser())
+			r.POST(HandleCreateInvitation(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/invitations/{invitationId}", func(r *Resource) {
+			r.DELETE(HandleRevokeInvitation(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/api-keys", func(r *Resource) {
+			r.GET(HandleListAPIKeys(app)).BindFunc(RequireSuperuserToken())
+			r.POST(HandleCreateAPIKey(app)).BindFunc(RequireSuperuserToken())
+		})
+		HandleResource(se.Router, "/admin/api-keys/{keyId}", func(r *Resource) {
+			r.DELETE(HandleRevokeAPIKey(app)).BindFunc(RequireSuperuserToken())
+		})
+		HandleResource(se.Router, "/admin/blocked-email-domains", func(r *Resource) {
+			r.POST(HandleBlockEmailDomains(app, emailBlocklist)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/users/duplicates", func(r *Resource) {
+			r.GET(HandleFindDuplicateUsers(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/users/{userId}/reset-password", func(r *Resource) {
+			r.POST(HandleResetUserPassword(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/users/{userId}/lock", func(r *Resource) {
+			r.POST(HandleLockUser(app, true)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/users/{userId}/unlock", func(r *Resource) {
+			r.POST(HandleLockUser(app, false)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/users/merge", func(r *Resource) {
+			r.POST(HandleAdminMergeUsers(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/impersonate/{userId}", func(r *Resource) {
+			r.POST(HandleImpersonate(app, cfg)).BindFunc(RequireSuperuserToken())
+		})
+		HandleResource(se.Router, "/admin/jobs", func(r *Resource) {
+			r.GET(HandleListJobs(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/jobs/{jobId}/retry", func(r *Resource) {
+			r.POST(HandleRetryJob(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/jobs/{jobId}/cancel", func(r *Resource) {
+			r.POST(HandleCancelJob(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/audit", func(r *Resource) {
+			r.GET(HandleListAuditLogs(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/usage", func(r *Resource) {
+			r.GET(HandleGetUsageTotals(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/stats", func(r *Resource) {
+			r.GET(HandleGetStats(app)).BindFunc(RequireSuperuser(), CacheResponses(StatsCache))
+		})
+		HandleResource(se.Router, "/admin/stats/daily", func(r *Resource) {
+			r.GET(HandleGetDailyStats(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/completeness", func(r *Resource) {
+			r.GET(HandleGetCompletenessStats(app)).BindFunc(RequireSuperuser(), CacheResponses(StatsCache))
+		})
+		HandleResource(se.Router, "/admin/schema", func(r *Resource) {
+			r.GET(HandleGetSchemaReport(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/alerts/test", func(r *Resource) {
+			r.POST(HandleTestAlert()).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/cron", func(r *Resource) {
+			r.GET(HandleGetCronStatus(scheduler)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/auth-lockouts", func(r *Resource) {
+			r.GET(HandleListAuthLockouts()).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/auth-lockouts/{key}", func(r *Resource) {
+			r.DELETE(HandleUnlockAuthLockout(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/moderation", func(r *Resource) {
+			r.GET(HandleListModerationItems(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/moderation/{itemId}/approve", func(r *Resource) {
+			r.POST(HandleReviewModerationItem(app, ModerationApproved)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/moderation/{itemId}/reject", func(r *Resource) {
+			r.POST(HandleReviewModerationItem(app, ModerationRejected)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/retention/rules", func(r *Resource) {
+			r.GET(HandleListRetentionRules(retention)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/retention/rules/{ruleId}/preview", func(r *Resource) {
+			r.POST(HandleRunRetentionRule(retention, true)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/retention/rules/{ruleId}/run", func(r *Resource) {
+			r.POST(HandleRunRetentionRule(retention, false)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/retention/runs", func(r *Resource) {
+			r.GET(HandleListRetentionRuns(app, cfg)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/health", func(r *Resource) {
+			r.GET(HandleAdminHealth(app)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/sync/status", func(r *Resource) {
+			r.GET(HandleGetLegacySyncStatus()).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/slow-queries", func(r *Resource) {
+			r.GET(HandleSlowQueries(queryAnalyzer, cfg)).BindFunc(RequireSuperuser())
+			r.DELETE(HandleResetSlowQueries(queryAnalyzer)).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/runtime", func(r *Resource) {
+			r.GET(HandleRuntime()).BindFunc(RequireSuperuser())
+		})
+		HandleResource(se.Router, "/admin/config", func(r *Resource) {
+			r.GET(HandleGetConfig(cfg)).BindFunc(RequireSuperuser())
+		})
+
+		undocumented, stale := CheckAPIOperations(APIOperations)
+		for _, route := range undocumented {
+			app.Logger().Warn("Route missing from APIOperations, the OpenAPI spec and the generated clients", "route", route)
+		}
+		for _, route := range stale {
+			app.Logger().Warn("APIOperations documents a route that isn't registered", "route", route)
+		}
+
+		HandleNotFound(se.Router)
 
 		// serves static files from the provided public dir (if exists)
-		se.Router.GET("/{path...}", apis.Static(os.DirFS("./pb_public"), false))
+		se.Router.GET("/{path...}", HandleStatic(cfg))
 
-		return se.Next()
-	})
+		// the internal services calling the user CRUD over gRPC
+		var grpcServer *GRPCServer
+		if cfg.GRPCAddr != "" {
+			var err error
+			if grpcServer, err = NewGRPCServer(app, cfg, users); err != nil {
+				return err
+			}
+			if err := grpcServer.Listen(cfg.GRPCAddr); err != nil {
+				return err
+			}
+		}
 
-	if err := app.Start(); err != nil {
-		log.Fatal(err)
-	}
+		if err := se.Next(); err != nil {
+			if grpcServer != nil {
+				grpcServer.Close()
+			}
+			return err
+		}
+		RouterMux, _ = se.Server.Handler.(*http.ServeMux)
+		if grpcServer != nil {
+			grpcServer.Serve()
+		}
+		return nil
+	})
+	return nil
 }
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// testEnv is the config of the test servers over the defaults, without the
+// rate limits the tests sending many requests would hit.
+var testEnv = map[string]string{
+	"RATE_LIMIT_IP_PER_MINUTE":   "0",
+	"RATE_LIMIT_AUTH_PER_MINUTE": "0",
+}
+
+const testUserPassword = "fixture-password-1"
+
+// testServer serves a test app set up as main does, custom routes included,
+// through httptest.
+type testServer struct {
+	*httptest.Server
+	App    *tests.TestApp
+	Config *Config
+	// SuperuserToken authenticates the requests as a superuser.
+	SuperuserToken string
+	// Users are the fixture users, see seedTestUsers.
+	Users []*models.User
+}
+
+// newTestServer starts a test app on an empty data dir, migrated, set up
+// with the config of env over testEnv and seeded with the fixture users.
+// The server and the app are shut down with the test.
+func newTestServer(t testing.TB, env map[string]string) *testServer {
+	t.Helper()
+	app := newTestApp(t)
+	cfg, err := LoadConfigFrom(func(key string) (string, bool) {
+		if v, ok := env[key]; ok {
+			return v, true
+		}
+		v, ok := testEnv[key]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Setup(&pocketbase.PocketBase{App: app}, cfg, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := apis.NewRouter(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	se := &core.ServeEvent{App: app, Router: router}
+	err = app.OnServe().Trigger(se, func(e *core.ServeEvent) error {
+		mux, err := e.Router.BuildMux()
+		if err != nil {
+			return err
+		}
+		e.Server = &http.Server{Handler: mux}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(se.Server.Handler)
+	t.Cleanup(srv.Close)
+
+	return &testServer{
+		Server:         srv,
+		App:            app,
+		Config:         cfg,
+		SuperuserToken: newTestSuperuserToken(t, app),
+		Users:          seedTestUsers(t, app, 3),
+	}
+}
+
+// newTestApp starts a test app on an empty data dir, migrated, which is
+// shut down with the test.
+func newTestApp(t testing.TB) *tests.TestApp {
+	t.Helper()
+	// the shutdown of the previous test app closed them
+	Drain = &Drainer{}
+	UserEvents = NewUserEventHub(userEventBufferSize)
+	Presence = NewPresenceHub(presenceBufferSize)
+
+	app, err := tests.NewTestApp(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.Cleanup)
+	return app
+}
+
+func newTestSuperuserToken(t testing.TB, app core.App) string {
+	t.Helper()
+	superusers, err := app.FindCollectionByNameOrId(core.CollectionNameSuperusers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	superuser := core.NewRecord(superusers)
+	superuser.SetEmail("superuser@example.com")
+	superuser.SetPassword(testUserPassword)
+	if err := app.Save(superuser); err != nil {
+		t.Fatal(err)
+	}
+	token, err := superuser.NewAuthToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// seedTestUsers creates n users, user<i>@example.com with testUserPassword.
+func seedTestUsers(t testing.TB, app core.App, n int) []*models.User {
+	t.Helper()
+	users := make([]*models.User, n)
+	for i := range users {
+		user, err := CreateUser(app, models.UserCreationRequest{
+			Email:           fmt.Sprintf("user%d@example.com", i),
+			Name:            fmt.Sprintf("User %d", i),
+			Password:        testUserPassword,
+			PasswordConfirm: testUserPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[i] = user
+	}
+	return users
+}
+
+// do sends a request with body encoded as JSON unless nil, authenticated
+// with token unless empty, and returns the response with its body read.
+func (s *testServer) do(t testing.TB, method string, path string, token string, body any) (*http.Response, []byte) {
+	t.Helper()
+	if body == nil {
+		return s.doRaw(t, method, path, token, "", nil)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.doRaw(t, method, path, token, "application/json", data)
+}
+
+// doRaw is do with a body sent as is, of contentType unless empty.
+func (s *testServer) doRaw(t testing.TB, method string, path string, token string, contentType string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, data
+}
+
+// apiRespFields are the members of the APIResp envelope.
+var apiRespFields = []string{"success", "message", "data", "code", "requestId"}
+
+// checkAPIResp checks that body is the APIResp envelope of a response with
+// status: only its members, success matching the status, and the failures
+// carrying a message, the code of their status and a request id.
+func checkAPIResp(t testing.TB, status int, body []byte) models.APIResp {
+	t.Helper()
+	members := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &members); err != nil {
+		t.Fatalf("expected an APIResp, got %v: %s", err, body)
+	}
+	for member := range members {
+		if !slices.Contains(apiRespFields, member) {
+			t.Errorf("unexpected member %q in %s", member, body)
+		}
+	}
+	if _, ok := members["success"]; !ok {
+		t.Errorf("missing success in %s", body)
+	}
+
+	resp := models.APIResp{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Success != (status < http.StatusBadRequest) {
+		t.Errorf("expected success %v with status %d, got %s", !resp.Success, status, body)
+	}
+	if resp.Success {
+		return resp
+	}
+	if resp.Message == "" {
+		t.Errorf("missing message in %s", body)
+	}
+	if resp.Code == "" || ErrorStatus(resp.Code) != status {
+		t.Errorf("expected a code of status %d, got %q", status, resp.Code)
+	}
+	if resp.RequestId == "" {
+		t.Errorf("missing requestId in %s", body)
+	}
+	return resp
+}
+
+// decodeData decodes the data of resp into v.
+func decodeData(t testing.TB, resp models.APIResp, v any) {
+	t.Helper()
+	data, err := json.Marshal(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("unexpected data %s: %v", data, err)
+	}
+}
+
+var pathParamRegex = regexp.MustCompile(`\{(\w+)\}`)
+
+// TestRoutesAPIResp calls every documented route answering with the APIResp
+// envelope as a superuser, with the first fixture user for the user ids and
+// an empty object for the bodies, and checks the shape of the responses.
+// The reads go first, and the deletes last.
+func TestRoutesAPIResp(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	ops := []APIOperation{}
+	seen := map[string]bool{}
+	for _, op := range APIOperations {
+		// RegisterCRUD documents its routes again on every setup
+		route := op.Method + " " + op.Path
+		if op.ResponseTypes != nil || seen[route] {
+			continue
+		}
+		seen[route] = true
+		ops = append(ops, op)
+	}
+	sort.SliceStable(ops, func(i, j int) bool {
+		return slices.Index(resourceMethods, ops[i].Method) < slices.Index(resourceMethods, ops[j].Method)
+	})
+
+	for _, op := range ops {
+		path := pathParamRegex.ReplaceAllStringFunc(op.Path, func(param string) string {
+			if param == "{userId}" || param == "{targetId}" {
+				return s.Users[0].Id
+			}
+			return "unknown"
+		})
+		var body any
+		if op.Method != http.MethodGet && op.Method != http.MethodDelete {
+			body = map[string]any{}
+		}
+		t.Run(op.Method+" "+op.Path, func(t *testing.T) {
+			res, data := s.do(t, op.Method, path, s.SuperuserToken, body)
+			checkAPIResp(t, res.StatusCode, data)
+		})
+	}
+}
+
+func TestUserRoutes(t *testing.T) {
+	s := newTestServer(t, nil)
+	user := s.Users[0]
+
+	scenarios := []struct {
+		name           string
+		method         string
+		path           string
+		token          string
+		body           any
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"list without auth", http.MethodGet, "/users", "", nil, http.StatusUnauthorized, "UNAUTHORIZED"},
+		{"list", http.MethodGet, "/users", s.SuperuserToken, nil, http.StatusOK, ""},
+		{"list invalid sort", http.MethodGet, "/users?sort=password", s.SuperuserToken, nil, http.StatusBadRequest, "BAD_REQUEST"},
+		{"get", http.MethodGet, "/users/" + user.Id, s.SuperuserToken, nil, http.StatusOK, ""},
+		{"get unknown", http.MethodGet, "/users/unknown", s.SuperuserToken, nil, http.StatusNotFound, CodeUserNotFound},
+		{"create", http.MethodPost, "/users", s.SuperuserToken, models.UserCreationRequest{Email: "new@example.com", Name: "New"}, http.StatusOK, ""},
+		{"create taken email", http.MethodPost, "/users", s.SuperuserToken, models.UserCreationRequest{Email: user.Email}, http.StatusConflict, CodeEmailTaken},
+		{"create invalid email", http.MethodPost, "/users", s.SuperuserToken, models.UserCreationRequest{Email: "invalid"}, http.StatusBadRequest, CodeValidationFailed},
+		{"update", http.MethodPatch, "/users/" + user.Id, s.SuperuserToken, map[string]any{"name": "Renamed"}, http.StatusOK, ""},
+		{"update unknown", http.MethodPatch, "/users/unknown", s.SuperuserToken, map[string]any{"name": "Renamed"}, http.StatusNotFound, CodeUserNotFound},
+		{"delete", http.MethodDelete, "/users/" + s.Users[1].Id, s.SuperuserToken, nil, http.StatusOK, ""},
+		{"get deleted", http.MethodGet, "/users/" + s.Users[1].Id, s.SuperuserToken, nil, http.StatusNotFound, CodeUserNotFound},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			res, body := s.do(t, scenario.method, scenario.path, scenario.token, scenario.body)
+			if res.StatusCode != scenario.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", scenario.expectedStatus, res.StatusCode, body)
+			}
+			resp := checkAPIResp(t, res.StatusCode, body)
+			if resp.Code != scenario.expectedCode {
+				t.Errorf("expected code %q, got %q", scenario.expectedCode, resp.Code)
+			}
+		})
+	}
+
+	res, body := s.do(t, http.MethodGet, "/users?sort=email", s.SuperuserToken, nil)
+	page := models.ListPage[models.User]{}
+	decodeData(t, checkAPIResp(t, res.StatusCode, body), &page)
+	emails := []string{}
+	for _, u := range page.Items {
+		emails = append(emails, u.Email)
+	}
+	expected := []string{"new@example.com", "user0@example.com", "user2@example.com"}
+	if !slices.Equal(emails, expected) {
+		t.Errorf("expected the users %v, got %v", expected, emails)
+	}
+	if page.TotalItems != len(expected) {
+		t.Errorf("expected totalItems %d, got %d", len(expected), page.TotalItems)
+	}
+
+	res, body = s.do(t, http.MethodGet, "/users/"+user.Id, s.SuperuserToken, nil)
+	got := models.User{}
+	decodeData(t, checkAPIResp(t, res.StatusCode, body), &got)
+	if got.Name != "Renamed" {
+		t.Errorf("expected the updated name, got %q", got.Name)
+	}
+}
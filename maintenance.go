@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// MaintenanceExemptPrefixes stay writable in maintenance, so that the
+// superusers can log in to turn it off.
+var MaintenanceExemptPrefixes = []string{"/api/collections/_superusers/"}
+
+var ErrMaintenanceForced = errors.New("maintenance mode is forced by MAINTENANCE_MODE or by a schema drift, see GET /admin/schema")
+
+type MaintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+	// Forced is set when MAINTENANCE_MODE or SchemaReadOnly enables it,
+	// which the API can't undo.
+	Forced bool `json:"forced"`
+}
+
+type MaintenanceRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// Global returns the setting of the empty prefix, which applies to every
+// route.
+func (l *RouteSettingsLoader) Global() (RouteSetting, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, setting := range l.load() {
+		if setting.Prefix == "" {
+			return setting, true
+		}
+	}
+	return RouteSetting{}, false
+}
+
+// InMaintenance reports whether the whole app is in maintenance.
+func InMaintenance(settings *RouteSettingsLoader, cfg *Config) MaintenanceStatus {
+	global, _ := settings.Global()
+	forced := cfg.MaintenanceMode || SchemaReadOnly
+	return MaintenanceStatus{Enabled: forced || global.Maintenance, Forced: forced}
+}
+
+// Maintenance rejects the writes with 503 while the app, or the route
+// setting of the request, is in maintenance. The reads keep working, as do
+// the writes of the superusers, e.g. the backups.
+func Maintenance(settings *RouteSettingsLoader, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if !slices.Contains(auditedMethods, e.Request.Method) || e.HasSuperuserAuth() || isMaintenanceExempt(e.Request.URL.Path) {
+			return e.Next()
+		}
+		setting, _ := RequestRouteSetting(e)
+		if setting.Maintenance || InMaintenance(settings, cfg).Enabled {
+			return WriteErrorCode(e, CodeMaintenance, "down for maintenance, try again later", nil)
+		}
+		return e.Next()
+	}
+}
+
+func isMaintenanceExempt(urlPath string) bool {
+	for _, prefix := range MaintenanceExemptPrefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMaintenance turns the maintenance of the whole app on or off, through
+// the route setting of the empty prefix.
+func SetMaintenance(app core.App, enabled bool) error {
+	return setGlobalRouteSetting(app, "maintenance", enabled)
+}
+
+// setGlobalRouteSetting sets a field of the route setting of the empty
+// prefix, creating it if needed.
+func setGlobalRouteSetting(app core.App, field string, value any) error {
+	record, err := app.FindFirstRecordByData(RouteSettings.Table, "prefix", "")
+	if errors.Is(err, sql.ErrNoRows) {
+		collection, err := app.FindCachedCollectionByNameOrId(RouteSettings.Table)
+		if err != nil {
+			return err
+		}
+		record = core.NewRecord(collection)
+	} else if err != nil {
+		return err
+	}
+	record.Set(field, value)
+	return RetryWrite(app, func() error { return app.Save(record) })
+}
+
+func HandleGetMaintenance(settings *RouteSettingsLoader, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		return WriteOK(e, "", InMaintenance(settings, cfg))
+	}
+}
+
+// HandleSetMaintenance turns the maintenance on or off. The route settings
+// hooks apply it to the next requests.
+func HandleSetMaintenance(app *pocketbase.PocketBase, settings *RouteSettingsLoader, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		mr := MaintenanceRequest{}
+		if err := BindStrict(e, &mr); err != nil {
+			return WriteBindError(e, err)
+		}
+		if !*mr.Enabled && InMaintenance(settings, cfg).Forced {
+			return WriteConflict(e, ErrMaintenanceForced.Error(), nil)
+		}
+		if err := SetMaintenance(WithTrace(app, e), *mr.Enabled); err != nil {
+			return WriteError(e, err, "error setting maintenance")
+		}
+		app.Logger().Warn("Maintenance mode changed", "enabled", *mr.Enabled, "requestId", RequestId(e))
+		return WriteOK(e, "", InMaintenance(settings, cfg))
+	}
+}
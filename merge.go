@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var (
+	ErrMergeIntoSelf        = errors.New("cannot merge a user into itself")
+	ErrMergeTargetNotFound  = errors.New("target user not found")
+	ErrMergeSourceNotFound  = errors.New("source user not found")
+	ErrMergeMissingSourceId = errors.New("missing sourceId")
+	ErrMergeInvalidPolicy   = errors.New("precedence must be primary, duplicate or newest")
+)
+
+// Precedence policies of MergeUsers, deciding whose profile fields the
+// merged user keeps.
+const (
+	// MergeKeepPrimary only fills the empty fields of the primary user.
+	MergeKeepPrimary = "primary"
+	// MergePreferDuplicate takes every non empty field of the duplicate.
+	MergePreferDuplicate = "duplicate"
+	// MergePreferNewest takes the non empty fields of the user updated
+	// last.
+	MergePreferNewest = "newest"
+)
+
+var mergePolicies = []string{MergeKeepPrimary, MergePreferDuplicate, MergePreferNewest}
+
+// OwnedTable is a table holding rows that belong to a user through Column.
+type OwnedTable struct {
+	Table  string
+	Column string
+}
+
+var ownedTables = []OwnedTable{}
+
+var ownedTablePattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\.([A-Za-z_][A-Za-z0-9_]*)$`)
+
+// RegisterOwnedTable registers a table whose rows should follow their owner
+// when user accounts are merged.
+func RegisterOwnedTable(table string, column string) {
+	ownedTables = append(ownedTables, OwnedTable{Table: table, Column: column})
+}
+
+// ParseOwnedTable parses a table.column entry of MERGE_OWNED_TABLES.
+func ParseOwnedTable(s string) (OwnedTable, error) {
+	m := ownedTablePattern.FindStringSubmatch(s)
+	if m == nil {
+		return OwnedTable{}, fmt.Errorf("invalid owned table %q, expected table.column", s)
+	}
+	return OwnedTable{Table: m[1], Column: m[2]}, nil
+}
+
+type MergeRequest struct {
+	SourceId   string `json:"sourceId" binding:"required"`
+	Precedence string `json:"precedence" default:"primary"`
+}
+
+// AdminMergeRequest is the body of POST /admin/users/merge.
+type AdminMergeRequest struct {
+	PrimaryId   string `json:"primaryId" binding:"required"`
+	DuplicateId string `json:"duplicateId" binding:"required"`
+	Precedence  string `json:"precedence" default:"primary"`
+}
+
+type MergeResult struct {
+	User      *models.User     `json:"user"`
+	MovedRows map[string]int64 `json:"movedRows"`
+}
+
+// MergeUsers moves everything owned by the source user to the target user,
+// combines their profiles following the precedence policy and soft deletes
+// the source, queueing the events of both, all in one transaction.
+func MergeUsers(app core.App, targetId string, sourceId string, precedence string) (*MergeResult, error) {
+	if sourceId == "" {
+		return nil, ErrMergeMissingSourceId
+	}
+	if targetId == sourceId {
+		return nil, ErrMergeIntoSelf
+	}
+	if !slices.Contains(mergePolicies, precedence) {
+		return nil, ErrMergeInvalidPolicy
+	}
+
+	result := &MergeResult{MovedRows: map[string]int64{}}
+	err := app.RunInTransaction(func(txApp core.App) error {
+		txApp = rebind(app, txApp)
+		target, err := GetUserById(txApp, targetId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMergeTargetNotFound
+		}
+		if err != nil {
+			return err
+		}
+		source, err := GetUserById(txApp, sourceId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMergeSourceNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, owned := range ownedTables {
+			if !txApp.HasTable(owned.Table) {
+				continue
+			}
+			res, err := txApp.DB().
+				Update(owned.Table, dbx.Params{owned.Column: target.Id}, dbx.HashExp{owned.Column: source.Id}).
+				Execute()
+			if err != nil {
+				return fmt.Errorf("moving %s rows: %w", owned.Table, err)
+			}
+			moved, _ := res.RowsAffected()
+			result.MovedRows[owned.Table] += moved
+		}
+
+		cs := MergeProfiles(*target, *source, precedence)
+		if len(cs) > 0 {
+			if _, err := Users.Update(txApp, target.Id, cs); err != nil {
+				return err
+			}
+		}
+
+		if err := DeleteUserById(txApp, source.Id); err != nil {
+			return err
+		}
+		if err := QueueUserEvent(txApp, EventUserDeleted, source); err != nil {
+			return err
+		}
+
+		if result.User, err = GetUserById(txApp, target.Id); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserUpdated, result.User)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// again after the commit, the responses cached meanwhile may be stale
+	UserResponseCache.Invalidate()
+
+	app.Logger().Info(
+		"Merged users",
+		"targetId", targetId,
+		"sourceId", sourceId,
+		"precedence", precedence,
+		"movedRows", result.MovedRows,
+	)
+
+	return result, nil
+}
+
+// MergeProfiles returns the changes to the profile of the target user
+// combining it with the source one. The roles are always combined.
+func MergeProfiles(target models.User, source models.User, precedence string) Changeset {
+	preferSource := precedence == MergePreferDuplicate ||
+		precedence == MergePreferNewest && source.Updated > target.Updated
+	cs := Changeset{}
+	pick := func(field string, targetValue string, sourceValue string) {
+		if sourceValue != "" && sourceValue != targetValue && (targetValue == "" || preferSource) {
+			cs[field] = sourceValue
+		}
+	}
+	pick("name", target.Name, source.Name)
+	pick("avatar", target.Avatar, source.Avatar)
+
+	roles := slices.Clone(target.Roles)
+	for _, role := range source.Roles {
+		if !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) > len(target.Roles) {
+		cs["roles"] = roles
+	}
+	return cs
+}
+
+func HandleMergeUsers(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		mr := MergeRequest{}
+		if err := BindStrict(e, &mr); err != nil {
+			return WriteBindError(e, err)
+		}
+		return writeMerge(WithTrace(app, e), e, e.Request.PathValue("targetId"), mr.SourceId, mr.Precedence)
+	}
+}
+
+// HandleAdminMergeUsers merges the duplicate user into the primary one.
+func HandleAdminMergeUsers(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		mr := AdminMergeRequest{}
+		if err := BindStrict(e, &mr); err != nil {
+			return WriteBindError(e, err)
+		}
+		SetAuditedUser(e, mr.PrimaryId)
+		return writeMerge(WithTrace(app, e), e, mr.PrimaryId, mr.DuplicateId, mr.Precedence)
+	}
+}
+
+func writeMerge(app core.App, e *core.RequestEvent, targetId string, sourceId string, precedence string) error {
+	result, err := MergeUsers(app, targetId, sourceId, precedence)
+	switch {
+	case errors.Is(err, ErrMergeMissingSourceId), errors.Is(err, ErrMergeIntoSelf), errors.Is(err, ErrMergeInvalidPolicy):
+		return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+	case errors.Is(err, ErrMergeTargetNotFound), errors.Is(err, ErrMergeSourceNotFound):
+		return WriteErrorCode(e, CodeUserNotFound, err.Error(), nil)
+	case err != nil:
+		return WriteError(e, err, "error merging users")
+	}
+	return WriteOK(e, "", result)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// MetricsBuckets are the upper bounds in seconds of the latency histograms,
+// the Prometheus client defaults.
+var MetricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics holds what GET /metrics exposes in the Prometheus text format.
+var Metrics = NewMetricsRegistry(MetricsBuckets)
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	for i, le := range buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+type statusKey struct {
+	routeKey
+	status int
+}
+
+type MetricsRegistry struct {
+	mu              sync.Mutex
+	buckets         []float64
+	requests        map[statusKey]uint64
+	errors          map[routeKey]uint64
+	requestDuration map[routeKey]*histogram
+	queryDuration   map[string]*histogram
+}
+
+func NewMetricsRegistry(buckets []float64) *MetricsRegistry {
+	return &MetricsRegistry{
+		buckets:         buckets,
+		requests:        map[statusKey]uint64{},
+		errors:          map[routeKey]uint64{},
+		requestDuration: map[routeKey]*histogram{},
+		queryDuration:   map[string]*histogram{},
+	}
+}
+
+func (m *MetricsRegistry) newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(m.buckets))}
+}
+
+// ObserveRequest records a response of the route, a router pattern such as
+// /users/{userId} so that the label doesn't grow with the ids.
+func (m *MetricsRegistry) ObserveRequest(method string, route string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := routeKey{method: method, route: route}
+	m.requests[statusKey{routeKey: key, status: status}]++
+	if status >= http.StatusInternalServerError {
+		m.errors[key]++
+	}
+	h, ok := m.requestDuration[key]
+	if !ok {
+		h = m.newHistogram()
+		m.requestDuration[key] = h
+	}
+	h.observe(m.buckets, d.Seconds())
+}
+
+// ObserveQuery records the duration of a SQL statement, labeled with its
+// first keyword.
+func (m *MetricsRegistry) ObserveQuery(query string, d time.Duration) {
+	operation := "OTHER"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		switch op := strings.ToUpper(fields[0]); op {
+		case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH", "BEGIN", "COMMIT", "ROLLBACK", "PRAGMA":
+			operation = op
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.queryDuration[operation]
+	if !ok {
+		h = m.newHistogram()
+		m.queryDuration[operation] = h
+	}
+	h.observe(m.buckets, d.Seconds())
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	b := strings.Builder{}
+	m.mu.Lock()
+
+	writeMetricHeader(&b, "http_requests_total", "counter", "Requests handled by the custom routes.")
+	requests := sortedKeys(m.requests, func(a, b statusKey) int {
+		if c := cmpRouteKeys(a.routeKey, b.routeKey); c != 0 {
+			return c
+		}
+		return a.status - b.status
+	})
+	for _, key := range requests {
+		fmt.Fprintf(&b, "http_requests_total{%s,status=\"%d\"} %d\n", routeLabels(key.routeKey), key.status, m.requests[key])
+	}
+
+	writeMetricHeader(&b, "http_request_errors_total", "counter", "Responses of the custom routes with a 5xx status.")
+	for _, key := range sortedKeys(m.errors, cmpRouteKeys) {
+		fmt.Fprintf(&b, "http_request_errors_total{%s} %d\n", routeLabels(key), m.errors[key])
+	}
+
+	writeMetricHeader(&b, "http_request_duration_seconds", "histogram", "Latency of the custom routes.")
+	for _, key := range sortedKeys(m.requestDuration, cmpRouteKeys) {
+		m.writeHistogram(&b, "http_request_duration_seconds", routeLabels(key), m.requestDuration[key])
+	}
+
+	writeMetricHeader(&b, "db_query_duration_seconds", "histogram", "Duration of the SQL statements run on the data database.")
+	for _, operation := range sortedKeys(m.queryDuration, strings.Compare) {
+		m.writeHistogram(&b, "db_query_duration_seconds", "operation="+quoteLabel(operation), m.queryDuration[operation])
+	}
+	m.mu.Unlock()
+
+	writeMetricHeader(&b, "http_requests_in_flight", "gauge", "Requests of the custom routes being handled.")
+	fmt.Fprintf(&b, "http_requests_in_flight %d\n", Drain.InFlight())
+	writeMetricHeader(&b, "go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	fmt.Fprintf(&b, "go_goroutines %d\n", runtime.NumGoroutine())
+	writeDownstreamMetrics(&b)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (m *MetricsRegistry) writeHistogram(b *strings.Builder, name string, labels string, h *histogram) {
+	for i, le := range m.buckets {
+		fmt.Fprintf(b, "%s_bucket{%s,le=%q} %d\n", name, labels, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(b, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func writeMetricHeader(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelReplacer.Replace(value) + `"`
+}
+
+func routeLabels(key routeKey) string {
+	return "method=" + quoteLabel(key.method) + ",route=" + quoteLabel(key.route)
+}
+
+func cmpRouteKeys(a, b routeKey) int {
+	if c := strings.Compare(a.route, b.route); c != 0 {
+		return c
+	}
+	return strings.Compare(a.method, b.method)
+}
+
+func sortedKeys[K comparable, V any](m map[K]V, cmp func(a, b K) int) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, cmp)
+	return keys
+}
+
+// RecordMetrics observes the requests of the custom routes. The route label
+// is the matched pattern, or "unmatched" for the requests no route handled.
+func RecordMetrics(m *MetricsRegistry) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if IsPocketBasePath(e.Request.URL.Path) {
+			return e.Next()
+		}
+
+		start := time.Now()
+		err := e.Next()
+
+		status := e.Status()
+		if err != nil && status == 0 {
+			status = http.StatusInternalServerError
+		}
+		route := e.Request.Pattern
+		if route == "" {
+			route = "unmatched"
+		} else if _, path, ok := strings.Cut(route, " "); ok {
+			// drop the method prefix of the router patterns
+			route = path
+		}
+		m.ObserveRequest(e.Request.Method, route, status, time.Since(start))
+		return err
+	}
+}
+
+// InstrumentDB records the duration of the statements run on the data
+// database, keeping the loggers PocketBase installs in dev mode.
+func InstrumentDB(app core.App, m *MetricsRegistry) {
+	for _, builder := range []dbx.Builder{app.DB(), app.NonconcurrentDB()} {
+		db, ok := builder.(*dbx.DB)
+		if !ok {
+			continue
+		}
+		queryLog, execLog := db.QueryLogFunc, db.ExecLogFunc
+		db.QueryLogFunc = func(ctx context.Context, t time.Duration, query string, rows *sql.Rows, err error) {
+			m.ObserveQuery(query, t)
+			if queryLog != nil {
+				queryLog(ctx, t, query, rows, err)
+			}
+		}
+		db.ExecLogFunc = func(ctx context.Context, t time.Duration, query string, result sql.Result, err error) {
+			m.ObserveQuery(query, t)
+			if execLog != nil {
+				execLog(ctx, t, query, result, err)
+			}
+		}
+	}
+}
+
+// RequireMetricsToken lets Prometheus scrape with the token as a bearer
+// token. Without a token only superusers and API keys get in.
+func RequireMetricsToken(token string) func(e *core.RequestEvent) error {
+	superuser := RequireSuperuser()
+	return func(e *core.RequestEvent) error {
+		if token == "" {
+			return superuser(e)
+		}
+		bearer, ok := strings.CutPrefix(e.Request.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			return WriteUnauthorized(e, "invalid metrics token", nil)
+		}
+		return e.Next()
+	}
+}
+
+func HandleMetrics(m *MetricsRegistry) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		e.Response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		e.Response.WriteHeader(http.StatusOK)
+		_, err := m.WriteTo(e.Response)
+		return err
+	}
+}
@@ -0,0 +1,45 @@
+// Package migrations creates and alters the collections and fields the
+// custom API depends on. The migrations are applied on serve, so a fresh
+// pb_data boots with the schema the handlers expect.
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			// the default users collection was removed, create it again
+			users = core.NewAuthCollection("users")
+		}
+
+		changed := users.IsNew()
+		if users.Fields.GetByName("name") == nil {
+			users.Fields.Add(&core.TextField{
+				Name: "name",
+				Max:  255,
+			})
+			changed = true
+		}
+		if users.Fields.GetByName("avatar") == nil {
+			users.Fields.Add(&core.FileField{
+				Name:      "avatar",
+				MaxSelect: 1,
+				MaxSize:   core.DefaultFileFieldMaxSize,
+				MimeTypes: []string{"image/jpeg", "image/png", "image/svg+xml", "image/gif", "image/webp"},
+			})
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		// the fields may predate this migration, so they are left in place
+		return nil
+	})
+}
@@ -0,0 +1,57 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// the collection may already exist if it was created through the admin UI
+		if _, err := app.FindCollectionByNameOrId("posts"); err == nil {
+			return nil
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("posts")
+		collection.Fields.Add(
+			&core.TextField{
+				Name:     "title",
+				Required: true,
+				Max:      255,
+			},
+			&core.EditorField{
+				Name: "body",
+			},
+			&core.RelationField{
+				Name:          "author",
+				CollectionId:  users.Id,
+				Required:      true,
+				CascadeDelete: true,
+				MaxSelect:     1,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		collection.AddIndex("idx_posts_author", false, "author", "")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("posts")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(collection)
+	})
+}
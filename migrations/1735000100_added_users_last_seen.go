@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("lastSeen") != nil {
+			return nil
+		}
+
+		users.Fields.Add(&core.DateField{
+			Name: "lastSeen",
+		})
+		users.AddIndex("idx_users_lastSeen", false, "lastSeen", "")
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.RemoveIndex("idx_users_lastSeen")
+		users.Fields.RemoveByName("lastSeen")
+
+		return app.Save(users)
+	})
+}
@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("pending_email") != nil {
+			return nil
+		}
+
+		users.Fields.Add(&core.EmailField{
+			Name:   "pending_email",
+			Hidden: true,
+		})
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("pending_email")
+
+		return app.Save(users)
+	})
+}
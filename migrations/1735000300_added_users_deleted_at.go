@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("deleted_at") != nil {
+			return nil
+		}
+
+		users.Fields.Add(&core.DateField{
+			Name: "deleted_at",
+		})
+		users.AddIndex("idx_users_deleted_at", false, "deleted_at", "")
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.RemoveIndex("idx_users_deleted_at")
+		users.Fields.RemoveByName("deleted_at")
+
+		return app.Save(users)
+	})
+}
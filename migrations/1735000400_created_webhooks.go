@@ -0,0 +1,109 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		webhooks, err := app.FindCollectionByNameOrId("webhooks")
+		if err != nil {
+			// the nil API rules leave both collections to superusers only
+			webhooks = core.NewBaseCollection("webhooks")
+			webhooks.Fields.Add(
+				&core.URLField{
+					Name:     "url",
+					Required: true,
+				},
+				&core.TextField{
+					Name:   "secret",
+					Hidden: true,
+				},
+				&core.SelectField{
+					Name:      "events",
+					Required:  true,
+					MaxSelect: 3,
+					Values:    []string{"user.created", "user.updated", "user.deleted"},
+				},
+				&core.BoolField{
+					Name: "active",
+				},
+				&core.AutodateField{
+					Name:     "created",
+					OnCreate: true,
+				},
+				&core.AutodateField{
+					Name:     "updated",
+					OnCreate: true,
+					OnUpdate: true,
+				},
+			)
+			if err := app.Save(webhooks); err != nil {
+				return err
+			}
+		}
+
+		if _, err := app.FindCollectionByNameOrId("webhook_deliveries"); err == nil {
+			return nil
+		}
+
+		deliveries := core.NewBaseCollection("webhook_deliveries")
+		deliveries.Fields.Add(
+			&core.RelationField{
+				Name:          "webhook",
+				CollectionId:  webhooks.Id,
+				Required:      true,
+				CascadeDelete: true,
+				MaxSelect:     1,
+			},
+			&core.TextField{
+				Name:     "event",
+				Required: true,
+			},
+			&core.JSONField{
+				Name: "payload",
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"pending", "succeeded", "failed"},
+			},
+			&core.NumberField{
+				Name:    "attempts",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "response_status",
+				OnlyInt: true,
+			},
+			&core.TextField{
+				Name: "error",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		deliveries.AddIndex("idx_webhook_deliveries_status", false, "status", "")
+
+		return app.Save(deliveries)
+	}, func(app core.App) error {
+		for _, name := range []string{"webhook_deliveries", "webhooks"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				continue
+			}
+			if err := app.Delete(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,47 @@
+package migrations
+
+import (
+	"slices"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// avatarThumbs must match AvatarThumbSizes of the main package.
+var avatarThumbs = []string{"64x64", "256x256"}
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		avatar, ok := users.Fields.GetByName("avatar").(*core.FileField)
+		if !ok {
+			return nil
+		}
+
+		for _, size := range avatarThumbs {
+			if !slices.Contains(avatar.Thumbs, size) {
+				avatar.Thumbs = append(avatar.Thumbs, size)
+			}
+		}
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		avatar, ok := users.Fields.GetByName("avatar").(*core.FileField)
+		if !ok {
+			return nil
+		}
+
+		avatar.Thumbs = slices.DeleteFunc(avatar.Thumbs, func(size string) bool {
+			return slices.Contains(avatarThumbs, size)
+		})
+
+		return app.Save(users)
+	})
+}
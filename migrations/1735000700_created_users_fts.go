@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// The users_fts rows share the rowid of their users row. They are kept in
+// sync with triggers rather than record hooks, since most user writes are
+// plain SQL that never goes through the hooks. email_public only holds the
+// emails with emailVisibility, the ones anyone can search for.
+var usersFTSUp = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS users_fts USING fts5(
+		name,
+		email,
+		email_public,
+		tokenize = "unicode61 remove_diacritics 2"
+	)`,
+	`INSERT INTO users_fts (rowid, name, email, email_public)
+		SELECT rowid, name, email, CASE WHEN emailVisibility THEN email ELSE '' END FROM users`,
+	`CREATE TRIGGER IF NOT EXISTS users_fts_insert AFTER INSERT ON users BEGIN
+		INSERT INTO users_fts (rowid, name, email, email_public)
+		VALUES (new.rowid, new.name, new.email, CASE WHEN new.emailVisibility THEN new.email ELSE '' END);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS users_fts_update AFTER UPDATE OF name, email, emailVisibility ON users BEGIN
+		DELETE FROM users_fts WHERE rowid = old.rowid;
+		INSERT INTO users_fts (rowid, name, email, email_public)
+		VALUES (new.rowid, new.name, new.email, CASE WHEN new.emailVisibility THEN new.email ELSE '' END);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS users_fts_delete AFTER DELETE ON users BEGIN
+		DELETE FROM users_fts WHERE rowid = old.rowid;
+	END`,
+}
+
+var usersFTSDown = []string{
+	`DROP TRIGGER IF EXISTS users_fts_insert`,
+	`DROP TRIGGER IF EXISTS users_fts_update`,
+	`DROP TRIGGER IF EXISTS users_fts_delete`,
+	`DROP TABLE IF EXISTS users_fts`,
+}
+
+func init() {
+	m.Register(func(app core.App) error {
+		for _, query := range usersFTSUp {
+			if _, err := app.DB().NewQuery(query).Execute(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		for _, query := range usersFTSDown {
+			if _, err := app.DB().NewQuery(query).Execute(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
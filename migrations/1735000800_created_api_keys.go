@@ -0,0 +1,63 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("api_keys"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the keys to superusers only
+		keys := core.NewBaseCollection("api_keys")
+		keys.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+				Max:      100,
+			},
+			&core.TextField{
+				Name:     "prefix",
+				Required: true,
+			},
+			&core.TextField{
+				Name:     "key_hash",
+				Required: true,
+				Hidden:   true,
+			},
+			&core.SelectField{
+				Name:      "scope",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"read", "write"},
+			},
+			&core.DateField{
+				Name: "last_used",
+			},
+			&core.DateField{
+				Name: "revoked",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		keys.AddIndex("idx_api_keys_key_hash", true, "key_hash", "")
+
+		return app.Save(keys)
+	}, func(app core.App) error {
+		keys, err := app.FindCollectionByNameOrId("api_keys")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(keys)
+	})
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// a plain table rather than a collection, like PocketBase's own
+		// underscored tables, since the rows are only read by the middleware
+		_, err := app.DB().NewQuery(`
+			CREATE TABLE IF NOT EXISTS _idempotency_keys (
+				scope        TEXT NOT NULL,
+				key          TEXT NOT NULL,
+				request_hash TEXT NOT NULL,
+				status       INTEGER NOT NULL DEFAULT 0,
+				content_type TEXT NOT NULL DEFAULT '',
+				response     BLOB,
+				created      TEXT NOT NULL,
+				PRIMARY KEY (scope, key)
+			);
+			CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON _idempotency_keys (created);
+		`).Execute()
+		return err
+	}, func(app core.App) error {
+		_, err := app.DB().NewQuery("DROP TABLE IF EXISTS _idempotency_keys").Execute()
+		return err
+	})
+}
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("roles") != nil {
+			return nil
+		}
+
+		users.Fields.Add(&core.SelectField{
+			Name:      "roles",
+			Values:    []string{"admin", "editor", "viewer"},
+			MaxSelect: 3,
+		})
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("roles")
+
+		return app.Save(users)
+	})
+}
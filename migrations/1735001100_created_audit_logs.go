@@ -0,0 +1,70 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("audit_logs"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the collection to superusers only
+		logs := core.NewBaseCollection("audit_logs")
+		logs.Fields.Add(
+			&core.SelectField{
+				Name:      "actor_type",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"superuser", "user", "apikey", "anonymous"},
+			},
+			&core.TextField{
+				Name: "actor_id",
+			},
+			&core.TextField{
+				Name:     "action",
+				Required: true,
+			},
+			&core.TextField{
+				Name:     "method",
+				Required: true,
+			},
+			&core.TextField{
+				Name: "path",
+			},
+			&core.TextField{
+				Name: "target_id",
+			},
+			&core.NumberField{
+				Name:    "status",
+				OnlyInt: true,
+			},
+			&core.JSONField{
+				Name: "changes",
+			},
+			&core.TextField{
+				Name: "ip",
+			},
+			&core.TextField{
+				Name: "request_id",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+		)
+		logs.AddIndex("idx_audit_logs_created", false, "created", "")
+		logs.AddIndex("idx_audit_logs_target_id", false, "target_id", "")
+		logs.AddIndex("idx_audit_logs_actor_id", false, "actor_id", "")
+
+		return app.Save(logs)
+	}, func(app core.App) error {
+		logs, err := app.FindCollectionByNameOrId("audit_logs")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(logs)
+	})
+}
@@ -0,0 +1,88 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("jobs"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the collection to superusers only
+		jobs := core.NewBaseCollection("jobs")
+		jobs.Fields.Add(
+			&core.TextField{
+				Name:     "type",
+				Required: true,
+			},
+			&core.JSONField{
+				Name: "payload",
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"pending", "running", "succeeded", "failed", "canceled"},
+			},
+			&core.NumberField{
+				Name:    "attempts",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "max_attempts",
+				OnlyInt: true,
+			},
+			&core.DateField{
+				Name:     "run_at",
+				Required: true,
+			},
+			&core.TextField{
+				Name: "last_error",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		jobs.AddIndex("idx_jobs_status_run_at", false, "status, run_at", "")
+		jobs.AddIndex("idx_jobs_type", false, "type", "")
+		if err := app.Save(jobs); err != nil {
+			return err
+		}
+
+		// the webhook deliveries were queued in memory until now, so the
+		// pending ones get a job to be resumed by
+		pending, err := app.FindAllRecords("webhook_deliveries", dbx.HashExp{"status": "pending"})
+		if err != nil {
+			return err
+		}
+		for _, delivery := range pending {
+			job := core.NewRecord(jobs)
+			job.Set("type", "webhook.delivery")
+			job.Set("payload", map[string]string{"deliveryId": delivery.Id})
+			job.Set("status", "pending")
+			job.Set("max_attempts", 5)
+			job.Set("run_at", types.NowDateTime())
+			if err := app.Save(job); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		jobs, err := app.FindCollectionByNameOrId("jobs")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(jobs)
+	})
+}
@@ -0,0 +1,109 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("cron_settings"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the collections to superusers only, who
+		// edit the settings from the admin UI
+		settings := core.NewBaseCollection("cron_settings")
+		settings.Fields.Add(
+			&core.TextField{
+				Name:     "task",
+				Required: true,
+			},
+			&core.TextField{
+				Name:     "schedule",
+				Required: true,
+			},
+			&core.BoolField{
+				Name: "enabled",
+			},
+			&core.NumberField{
+				Name:    "retention_days",
+				OnlyInt: true,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		settings.AddIndex("idx_cron_settings_task", true, "task", "")
+		if err := app.Save(settings); err != nil {
+			return err
+		}
+
+		defaults := []struct {
+			task          string
+			schedule      string
+			retentionDays int
+		}{
+			{"purge_deleted_users", "0 3 * * *", 30},
+			{"prune_audit_logs", "30 3 * * *", 90},
+			{"aggregate_user_stats", "5 0 * * *", 0},
+		}
+		for _, d := range defaults {
+			record := core.NewRecord(settings)
+			record.Set("task", d.task)
+			record.Set("schedule", d.schedule)
+			record.Set("enabled", true)
+			record.Set("retention_days", d.retentionDays)
+			if err := app.Save(record); err != nil {
+				return err
+			}
+		}
+
+		daily := core.NewBaseCollection("user_stats_daily")
+		daily.Fields.Add(
+			&core.TextField{
+				Name:     "date",
+				Required: true,
+			},
+			&core.NumberField{
+				Name:    "total",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "verified",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "active",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "signups",
+				OnlyInt: true,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+		)
+		daily.AddIndex("idx_user_stats_daily_date", true, "date", "")
+		return app.Save(daily)
+	}, func(app core.App) error {
+		for _, name := range []string{"user_stats_daily", "cron_settings"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				continue
+			}
+			if err := app.Delete(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,91 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("user_totp"); err == nil {
+			return nil
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// the nil API rules leave the collections to superusers only, the
+		// users go through the /users/{userId}/2fa routes
+		totp := core.NewBaseCollection("user_totp")
+		totp.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				Required:      true,
+				CascadeDelete: true,
+				MaxSelect:     1,
+			},
+			&core.TextField{
+				Name:     "secret",
+				Required: true,
+				Hidden:   true,
+			},
+			&core.BoolField{
+				Name: "enabled",
+			},
+			// the last accepted time step, so that a code can't be replayed
+			&core.NumberField{
+				Name:    "last_step",
+				OnlyInt: true,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		totp.AddIndex("idx_user_totp_user", true, "user", "")
+		if err := app.Save(totp); err != nil {
+			return err
+		}
+
+		codes := core.NewBaseCollection("user_backup_codes")
+		codes.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				Required:      true,
+				CascadeDelete: true,
+				MaxSelect:     1,
+			},
+			&core.TextField{
+				Name:     "code_hash",
+				Required: true,
+				Hidden:   true,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+		)
+		codes.AddIndex("idx_user_backup_codes_user_code_hash", true, "user, code_hash", "")
+		return app.Save(codes)
+	}, func(app core.App) error {
+		for _, name := range []string{"user_backup_codes", "user_totp"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				continue
+			}
+			if err := app.Delete(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
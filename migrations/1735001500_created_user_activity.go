@@ -0,0 +1,64 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("user_activity"); err == nil {
+			return nil
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// the nil API rules leave the collection to superusers only, the
+		// users read their own through GET /users/{userId}/activity
+		collection := core.NewBaseCollection("user_activity")
+		collection.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				Required:      true,
+				CascadeDelete: true,
+				MaxSelect:     1,
+			},
+			&core.TextField{
+				Name: "method",
+			},
+			&core.TextField{
+				Name: "path",
+			},
+			&core.NumberField{
+				Name:    "status",
+				OnlyInt: true,
+			},
+			&core.TextField{
+				Name: "ip",
+			},
+			&core.TextField{
+				Name: "user_agent",
+			},
+			&core.NumberField{
+				Name:    "duration_ms",
+				OnlyInt: true,
+			},
+			// set to the time of the request rather than of the batched insert
+			&core.DateField{
+				Name: "created",
+			},
+		)
+		collection.AddIndex("idx_user_activity_user_created", false, "user, created", "")
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("user_activity")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(collection)
+	})
+}
@@ -0,0 +1,29 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		settings, err := app.FindCollectionByNameOrId("cron_settings")
+		if err != nil {
+			return err
+		}
+		if _, err := app.FindFirstRecordByData(settings, "task", "purge_exports"); err == nil {
+			return nil
+		}
+
+		record := core.NewRecord(settings)
+		record.Set("task", "purge_exports")
+		record.Set("schedule", "15 4 * * *")
+		record.Set("enabled", true)
+		record.Set("retention_days", 7)
+		return app.Save(record)
+	}, func(app core.App) error {
+		_, err := app.DB().Delete("cron_settings", dbx.HashExp{"task": "purge_exports"}).Execute()
+		return err
+	})
+}
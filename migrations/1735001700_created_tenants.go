@@ -0,0 +1,72 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("tenant_id") != nil {
+			return nil
+		}
+
+		tenants := core.NewBaseCollection("tenants")
+		tenants.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+				Max:      255,
+			},
+			// resolved from the X-Tenant header or the subdomain
+			&core.TextField{
+				Name:     "slug",
+				Required: true,
+				Max:      63,
+				Pattern:  `^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		tenants.AddIndex("idx_tenants_slug", true, "slug", "")
+		if err := app.Save(tenants); err != nil {
+			return err
+		}
+
+		// the users without a tenant make up the default workspace
+		users.Fields.Add(&core.RelationField{
+			Name:         "tenant_id",
+			CollectionId: tenants.Id,
+			MaxSelect:    1,
+		})
+		users.AddIndex("idx_users_tenant_id", false, "tenant_id", "")
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		users.RemoveIndex("idx_users_tenant_id")
+		users.Fields.RemoveByName("tenant_id")
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		tenants, err := app.FindCollectionByNameOrId("tenants")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(tenants)
+	})
+}
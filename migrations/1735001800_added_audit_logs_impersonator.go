@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		logs, err := app.FindCollectionByNameOrId("audit_logs")
+		if err != nil {
+			return err
+		}
+		if logs.Fields.GetByName("impersonator_id") != nil {
+			return nil
+		}
+
+		// the superuser behind the requests made with an impersonation token
+		logs.Fields.Add(&core.TextField{
+			Name: "impersonator_id",
+		})
+		logs.AddIndex("idx_audit_logs_impersonator_id", false, "impersonator_id", "")
+		return app.Save(logs)
+	}, func(app core.App) error {
+		logs, err := app.FindCollectionByNameOrId("audit_logs")
+		if err != nil {
+			return err
+		}
+		logs.RemoveIndex("idx_audit_logs_impersonator_id")
+		logs.Fields.RemoveByName("impersonator_id")
+		return app.Save(logs)
+	})
+}
@@ -0,0 +1,60 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("erasure_receipts"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the collection to superusers only. The user
+		// is kept as a plain id, the receipts must outlive the user.
+		collection := core.NewBaseCollection("erasure_receipts")
+		collection.Fields.Add(
+			&core.TextField{
+				Name:     "user_id",
+				Required: true,
+			},
+			// SHA-256 of the erased email, to answer whether an address was
+			// erased without keeping it
+			&core.TextField{
+				Name: "email_hash",
+			},
+			&core.TextField{
+				Name: "actor_type",
+			},
+			&core.TextField{
+				Name: "actor_id",
+			},
+			&core.NumberField{
+				Name:    "audit_logs_purged",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "activities_purged",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "files_deleted",
+				OnlyInt: true,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+		)
+		collection.AddIndex("idx_erasure_receipts_user_id", false, "user_id", "")
+		collection.AddIndex("idx_erasure_receipts_email_hash", false, "email_hash", "")
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("erasure_receipts")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(collection)
+	})
+}
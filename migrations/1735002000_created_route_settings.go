@@ -0,0 +1,55 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("route_settings"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the collection to superusers only, who
+		// edit the settings from the admin UI
+		settings := core.NewBaseCollection("route_settings")
+		settings.Fields.Add(
+			// the empty prefix configures every custom route
+			&core.TextField{
+				Name: "prefix",
+			},
+			&core.NumberField{
+				Name:    "rate_limit_per_minute",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "rate_limit_burst",
+				OnlyInt: true,
+			},
+			&core.BoolField{
+				Name: "maintenance",
+			},
+			&core.JSONField{
+				Name: "flags",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		settings.AddIndex("idx_route_settings_prefix", true, "prefix", "")
+		return app.Save(settings)
+	}, func(app core.App) error {
+		settings, err := app.FindCollectionByNameOrId("route_settings")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(settings)
+	})
+}
@@ -0,0 +1,63 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("flags"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the collection to superusers only, who
+		// edit the flags from the admin UI. The clients read their values
+		// from GET /flags.
+		flags := core.NewBaseCollection("flags")
+		flags.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+			},
+			&core.TextField{
+				Name: "description",
+			},
+			&core.BoolField{
+				Name: "enabled",
+			},
+			&core.NumberField{
+				Name:    "rollout",
+				OnlyInt: true,
+				Min:     types.Pointer(0.0),
+				Max:     types.Pointer(100.0),
+			},
+			// user id => on/off
+			&core.JSONField{
+				Name: "user_overrides",
+			},
+			// role => on/off
+			&core.JSONField{
+				Name: "role_overrides",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		flags.AddIndex("idx_flags_name", true, "name", "")
+		return app.Save(flags)
+	}, func(app core.App) error {
+		flags, err := app.FindCollectionByNameOrId("flags")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(flags)
+	})
+}
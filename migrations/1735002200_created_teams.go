@@ -0,0 +1,98 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("teams"); err == nil {
+			return nil
+		}
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		tenants, err := app.FindCollectionByNameOrId("tenants")
+		if err != nil {
+			return err
+		}
+
+		// the nil API rules leave the collections to the /teams routes,
+		// which check the team roles
+		teams := core.NewBaseCollection("teams")
+		teams.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+				Max:      255,
+			},
+			&core.RelationField{
+				Name:         "tenant_id",
+				CollectionId: tenants.Id,
+				MaxSelect:    1,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		teams.AddIndex("idx_teams_tenant_id", false, "tenant_id", "")
+		if err := app.Save(teams); err != nil {
+			return err
+		}
+
+		memberships := core.NewBaseCollection("team_memberships")
+		memberships.Fields.Add(
+			&core.RelationField{
+				Name:          "team",
+				CollectionId:  teams.Id,
+				Required:      true,
+				CascadeDelete: true,
+				MaxSelect:     1,
+			},
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				Required:      true,
+				CascadeDelete: true,
+				MaxSelect:     1,
+			},
+			&core.SelectField{
+				Name:      "role",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"owner", "admin", "member"},
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		memberships.AddIndex("idx_team_memberships_team_user", true, "team, user", "")
+		memberships.AddIndex("idx_team_memberships_user", false, "user", "")
+		return app.Save(memberships)
+	}, func(app core.App) error {
+		for _, name := range []string{"team_memberships", "teams"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				continue
+			}
+			if err := app.Delete(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,81 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("invitations"); err == nil {
+			return nil
+		}
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		tenants, err := app.FindCollectionByNameOrId("tenants")
+		if err != nil {
+			return err
+		}
+
+		// the nil API rules leave the invitations to superusers only, the
+		// invitees reading theirs through GET /invitations/{token}
+		invitations := core.NewBaseCollection("invitations")
+		invitations.Fields.Add(
+			&core.EmailField{
+				Name:     "email",
+				Required: true,
+			},
+			// prefilled in the sign up form
+			&core.TextField{
+				Name: "name",
+				Max:  255,
+			},
+			// granted to the user on acceptance
+			&core.SelectField{
+				Name:      "role",
+				MaxSelect: 1,
+				Values:    []string{"admin", "editor", "viewer"},
+			},
+			&core.RelationField{
+				Name:         "tenant_id",
+				CollectionId: tenants.Id,
+				MaxSelect:    1,
+			},
+			&core.DateField{
+				Name:     "expires",
+				Required: true,
+			},
+			&core.DateField{
+				Name: "accepted",
+			},
+			// the user created on acceptance
+			&core.RelationField{
+				Name:         "user",
+				CollectionId: users.Id,
+				MaxSelect:    1,
+			},
+			&core.DateField{
+				Name: "revoked",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		invitations.AddIndex("idx_invitations_email", false, "email", "")
+		return app.Save(invitations)
+	}, func(app core.App) error {
+		invitations, err := app.FindCollectionByNameOrId("invitations")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(invitations)
+	})
+}
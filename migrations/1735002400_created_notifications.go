@@ -0,0 +1,83 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("notifications"); err == nil {
+			return nil
+		}
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// the nil API rules leave the collection to superusers only, the
+		// users read their own through GET /users/{userId}/notifications
+		notifications := core.NewBaseCollection("notifications")
+		notifications.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				Required:      true,
+				CascadeDelete: true,
+				MaxSelect:     1,
+			},
+			&core.TextField{
+				Name:     "type",
+				Required: true,
+				Max:      100,
+			},
+			&core.JSONField{
+				Name: "payload",
+			},
+			&core.DateField{
+				Name: "read",
+			},
+			// set once the notification was part of an email digest
+			&core.DateField{
+				Name: "digested",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		notifications.AddIndex("idx_notifications_user_created", false, "user, created", "")
+		notifications.AddIndex("idx_notifications_unread", false, "read, digested", "")
+		if err := app.Save(notifications); err != nil {
+			return err
+		}
+
+		settings, err := app.FindCollectionByNameOrId("cron_settings")
+		if err != nil {
+			return err
+		}
+		if _, err := app.FindFirstRecordByData(settings, "task", "notification_digest"); err == nil {
+			return nil
+		}
+		record := core.NewRecord(settings)
+		record.Set("task", "notification_digest")
+		record.Set("schedule", "0 8 * * *")
+		record.Set("enabled", true)
+		return app.Save(record)
+	}, func(app core.App) error {
+		if _, err := app.DB().Delete("cron_settings", dbx.HashExp{"task": "notification_digest"}).Execute(); err != nil {
+			return err
+		}
+		notifications, err := app.FindCollectionByNameOrId("notifications")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(notifications)
+	})
+}
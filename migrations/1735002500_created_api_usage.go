@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("api_usage"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the collection to superusers only, read
+		// through GET /admin/usage and GET /users/{userId}/usage
+		usage := core.NewBaseCollection("api_usage")
+		usage.Fields.Add(
+			&core.SelectField{
+				Name:      "kind",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"user", "api_key"},
+			},
+			// the id of the user or of the api key
+			&core.TextField{
+				Name:     "subject",
+				Required: true,
+			},
+			// UTC, formatted as 2006-01-02
+			&core.TextField{
+				Name:     "day",
+				Required: true,
+			},
+			&core.NumberField{
+				Name:    "requests",
+				OnlyInt: true,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		usage.AddIndex("idx_api_usage_kind_subject_day", true, "kind, subject, day", "")
+		usage.AddIndex("idx_api_usage_day", false, "day", "")
+		return app.Save(usage)
+	}, func(app core.App) error {
+		usage, err := app.FindCollectionByNameOrId("api_usage")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(usage)
+	})
+}
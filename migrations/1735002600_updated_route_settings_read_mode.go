@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		settings, err := app.FindCollectionByNameOrId("route_settings")
+		if err != nil {
+			return err
+		}
+		if settings.Fields.GetByName("read_mode") != nil {
+			return nil
+		}
+
+		// the database connection the GET requests of the routes read
+		// through, the concurrent pool when empty
+		settings.Fields.Add(&core.SelectField{
+			Name:      "read_mode",
+			MaxSelect: 1,
+			Values:    []string{"concurrent", "replica", "primary"},
+		})
+		return app.Save(settings)
+	}, func(app core.App) error {
+		settings, err := app.FindCollectionByNameOrId("route_settings")
+		if err != nil {
+			return nil
+		}
+		settings.Fields.RemoveByName("read_mode")
+		return app.Save(settings)
+	})
+}
@@ -0,0 +1,40 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("user_tombstones"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the collection to superusers only, read
+		// through GET /users/changes
+		tombstones := core.NewBaseCollection("user_tombstones")
+		tombstones.Fields.Add(
+			// not a relation, the user is gone
+			&core.TextField{
+				Name:     "user_id",
+				Required: true,
+			},
+			&core.TextField{
+				Name: "tenant_id",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+		)
+		tombstones.AddIndex("idx_user_tombstones_created", false, "created, user_id", "")
+		return app.Save(tombstones)
+	}, func(app core.App) error {
+		tombstones, err := app.FindCollectionByNameOrId("user_tombstones")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(tombstones)
+	})
+}
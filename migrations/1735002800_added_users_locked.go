@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("locked") != nil {
+			return nil
+		}
+
+		// set through POST /admin/users/{userId}/lock, the locked users
+		// get no tokens and their tokens are refused
+		users.Fields.Add(&core.BoolField{
+			Name: "locked",
+		})
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("locked")
+
+		return app.Save(users)
+	})
+}
@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("loginCount") != nil {
+			return nil
+		}
+
+		// changed through POST /users/{userId}/increment, whose statement
+		// keeps them within their bounds
+		zero := 0.0
+		users.Fields.Add(
+			&core.NumberField{
+				Name:    "loginCount",
+				OnlyInt: true,
+				Min:     &zero,
+			},
+			&core.NumberField{
+				Name:    "credits",
+				OnlyInt: true,
+				Min:     &zero,
+			},
+		)
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("loginCount")
+		users.Fields.RemoveByName("credits")
+
+		return app.Save(users)
+	})
+}
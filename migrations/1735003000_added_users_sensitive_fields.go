@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("phone") != nil {
+			return nil
+		}
+
+		// encrypted by the app, hidden from the records API which would
+		// return the ciphertexts. No max length, the ciphertexts are longer
+		// than the values.
+		users.Fields.Add(
+			&core.TextField{
+				Name:   "phone",
+				Hidden: true,
+			},
+			&core.TextField{
+				Name:   "nationalId",
+				Hidden: true,
+			},
+		)
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("phone")
+		users.Fields.RemoveByName("nationalId")
+
+		return app.Save(users)
+	})
+}
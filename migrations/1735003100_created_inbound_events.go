@@ -0,0 +1,68 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("inbound_events"); err == nil {
+			return nil
+		}
+
+		// the events received on POST /hooks/{provider}, kept so that the
+		// redeliveries of a processed event are skipped. The nil API rules
+		// leave them to superusers only.
+		events := core.NewBaseCollection("inbound_events")
+		zero := 0.0
+		events.Fields.Add(
+			&core.TextField{
+				Name:     "provider",
+				Required: true,
+			},
+			&core.TextField{
+				Name:     "event_id",
+				Required: true,
+			},
+			&core.TextField{
+				Name: "type",
+			},
+			&core.JSONField{
+				Name:    "payload",
+				MaxSize: 1 << 20,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"processed", "ignored", "failed"},
+			},
+			&core.TextField{
+				Name: "error",
+			},
+			&core.NumberField{
+				Name:    "attempts",
+				OnlyInt: true,
+				Min:     &zero,
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		events.AddIndex("idx_inbound_events_event", true, "provider, event_id", "")
+		return app.Save(events)
+	}, func(app core.App) error {
+		events, err := app.FindCollectionByNameOrId("inbound_events")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(events)
+	})
+}
@@ -0,0 +1,73 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("subscriptions"); err == nil {
+			return nil
+		}
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// the Stripe subscriptions of the users, written by the stripe
+		// events of POST /hooks/{provider}. The nil API rules leave them to
+		// superusers only, the users read their own through
+		// GET /billing/subscription.
+		subscriptions := core.NewBaseCollection("subscriptions")
+		subscriptions.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				Required:      true,
+				CascadeDelete: true,
+				MaxSelect:     1,
+			},
+			&core.TextField{
+				Name: "stripe_customer",
+			},
+			&core.TextField{
+				Name: "stripe_subscription",
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"incomplete", "incomplete_expired", "trialing", "active", "past_due", "canceled", "unpaid", "paused"},
+			},
+			&core.TextField{
+				Name: "price",
+			},
+			&core.DateField{
+				Name: "current_period_end",
+			},
+			&core.BoolField{
+				Name: "cancel_at_period_end",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		subscriptions.AddIndex("idx_subscriptions_user", true, "user", "")
+		subscriptions.AddIndex("idx_subscriptions_stripe_subscription", false, "stripe_subscription", "")
+		subscriptions.AddIndex("idx_subscriptions_stripe_customer", false, "stripe_customer", "")
+		return app.Save(subscriptions)
+	}, func(app core.App) error {
+		subscriptions, err := app.FindCollectionByNameOrId("subscriptions")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(subscriptions)
+	})
+}
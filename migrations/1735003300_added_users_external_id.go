@@ -0,0 +1,38 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("external_id") != nil {
+			return nil
+		}
+
+		// the id the identity provider knows the users provisioned through
+		// /scim/v2/Users by
+		users.Fields.Add(&core.TextField{
+			Name: "external_id",
+			Max:  255,
+		})
+		users.AddIndex("idx_users_external_id", false, "external_id", "")
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.RemoveIndex("idx_users_external_id")
+		users.Fields.RemoveByName("external_id")
+
+		return app.Save(users)
+	})
+}
@@ -0,0 +1,67 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("outbox"); err == nil {
+			return nil
+		}
+
+		// the user events written along with the user changes, published by
+		// the outbox dispatcher. The nil API rules leave them to superusers
+		// only.
+		outbox := core.NewBaseCollection("outbox")
+		zero := 0.0
+		outbox.Fields.Add(
+			&core.TextField{
+				Name:     "event",
+				Required: true,
+			},
+			&core.JSONField{
+				Name:    "payload",
+				MaxSize: 1 << 20,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"pending", "delivered"},
+			},
+			&core.JSONField{
+				Name: "delivered_to",
+			},
+			&core.NumberField{
+				Name:    "attempts",
+				OnlyInt: true,
+				Min:     &zero,
+			},
+			&core.DateField{
+				Name: "next_attempt_at",
+			},
+			&core.TextField{
+				Name: "last_error",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		outbox.AddIndex("idx_outbox_due", false, "status, next_attempt_at", "")
+		return app.Save(outbox)
+	}, func(app core.App) error {
+		outbox, err := app.FindCollectionByNameOrId("outbox")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(outbox)
+	})
+}
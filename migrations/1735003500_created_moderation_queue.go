@@ -0,0 +1,75 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("moderation_queue"); err == nil {
+			return nil
+		}
+
+		// the user-supplied values the moderation flagged, waiting for a
+		// superuser to approve or reject them. The nil API rules leave them
+		// to superusers only.
+		queue := core.NewBaseCollection("moderation_queue")
+		queue.Fields.Add(
+			&core.TextField{
+				Name:     "collection",
+				Required: true,
+			},
+			&core.TextField{
+				Name:     "record_id",
+				Required: true,
+			},
+			&core.TextField{
+				Name:     "field",
+				Required: true,
+			},
+			&core.TextField{
+				Name: "value",
+			},
+			&core.SelectField{
+				Name:      "source",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"words", "api"},
+			},
+			&core.JSONField{
+				Name: "reasons",
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"pending", "approved", "rejected"},
+			},
+			&core.TextField{
+				Name: "reviewed_by",
+			},
+			&core.DateField{
+				Name: "reviewed_at",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		queue.AddIndex("idx_moderation_queue_status", false, "status, created", "")
+		queue.AddIndex("idx_moderation_queue_record", false, "collection, record_id, field", "")
+		return app.Save(queue)
+	}, func(app core.App) error {
+		queue, err := app.FindCollectionByNameOrId("moderation_queue")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(queue)
+	})
+}
@@ -0,0 +1,130 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("retention_rules"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the collections to superusers only, who
+		// define the rules from the admin UI
+		rules := core.NewBaseCollection("retention_rules")
+		one := 1.0
+		rules.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+			},
+			&core.TextField{
+				Name:     "target",
+				Required: true,
+			},
+			&core.NumberField{
+				Name:     "max_age_days",
+				Required: true,
+				OnlyInt:  true,
+				Min:      &one,
+			},
+			&core.TextField{
+				Name: "filter",
+			},
+			&core.TextField{
+				Name:     "schedule",
+				Required: true,
+			},
+			&core.BoolField{
+				Name: "enabled",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		rules.AddIndex("idx_retention_rules_name", true, "name", "")
+		if err := app.Save(rules); err != nil {
+			return err
+		}
+
+		// the report of every run of a rule, dry runs included
+		runs := core.NewBaseCollection("retention_runs")
+		zero := 0.0
+		runs.Fields.Add(
+			&core.TextField{
+				Name:     "rule",
+				Required: true,
+			},
+			&core.TextField{
+				Name: "rule_name",
+			},
+			&core.TextField{
+				Name: "target",
+			},
+			&core.BoolField{
+				Name: "dry_run",
+			},
+			&core.SelectField{
+				Name:      "trigger",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"schedule", "manual"},
+			},
+			&core.DateField{
+				Name: "cutoff",
+			},
+			&core.NumberField{
+				Name:    "matched",
+				OnlyInt: true,
+				Min:     &zero,
+			},
+			&core.NumberField{
+				Name:    "deleted",
+				OnlyInt: true,
+				Min:     &zero,
+			},
+			&core.NumberField{
+				Name:    "failed",
+				OnlyInt: true,
+				Min:     &zero,
+			},
+			&core.JSONField{
+				Name: "sample_ids",
+			},
+			&core.TextField{
+				Name: "error",
+			},
+			&core.DateField{
+				Name: "started",
+			},
+			&core.DateField{
+				Name: "finished",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+		)
+		runs.AddIndex("idx_retention_runs_rule", false, "rule, created", "")
+		return app.Save(runs)
+	}, func(app core.App) error {
+		for _, name := range []string{"retention_runs", "retention_rules"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				continue
+			}
+			if err := app.Delete(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
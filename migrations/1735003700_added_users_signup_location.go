@@ -0,0 +1,45 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("signup_country") != nil {
+			return nil
+		}
+
+		// where the users signed up from, resolved from their IP address
+		// when GEOIP_DATABASE is set
+		users.Fields.Add(&core.TextField{
+			Name:   "signup_country",
+			Max:    2,
+			Hidden: true,
+		})
+		users.Fields.Add(&core.TextField{
+			Name:   "signup_region",
+			Max:    255,
+			Hidden: true,
+		})
+		users.AddIndex("idx_users_signup_country", false, "signup_country", "")
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.RemoveIndex("idx_users_signup_country")
+		users.Fields.RemoveByName("signup_country")
+		users.Fields.RemoveByName("signup_region")
+
+		return app.Save(users)
+	})
+}
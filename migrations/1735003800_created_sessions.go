@@ -0,0 +1,65 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("sessions"); err == nil {
+			return nil
+		}
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// a row per login, shared by the tokens refreshed from it and
+		// deleted when the session is revoked. The nil API rules leave them
+		// to the /users/{userId}/sessions routes.
+		sessions := core.NewBaseCollection("sessions")
+		sessions.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				MaxSelect:     1,
+				Required:      true,
+				CascadeDelete: true,
+			},
+			&core.TextField{
+				Name: "device",
+				Max:  255,
+			},
+			&core.TextField{
+				Name: "ip",
+				Max:  45,
+			},
+			&core.TextField{
+				Name: "user_agent",
+				Max:  1000,
+			},
+			&core.DateField{
+				Name: "last_active",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		sessions.AddIndex("idx_sessions_user", false, "user", "")
+		sessions.AddIndex("idx_sessions_last_active", false, "last_active", "")
+		return app.Save(sessions)
+	}, func(app core.App) error {
+		sessions, err := app.FindCollectionByNameOrId("sessions")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(sessions)
+	})
+}
@@ -0,0 +1,54 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("auth_failures"); err == nil {
+			return nil
+		}
+
+		// the failed logins counted per client IP and per account, loaded
+		// by the throttle on start. The nil API rules leave them to
+		// GET /admin/auth-lockouts.
+		failures := core.NewBaseCollection("auth_failures")
+		failures.Fields.Add(
+			// ip:<address> or account:<email>
+			&core.TextField{
+				Name:     "key",
+				Required: true,
+			},
+			&core.NumberField{
+				Name:    "failures",
+				OnlyInt: true,
+			},
+			&core.DateField{
+				Name: "last_failure",
+			},
+			&core.DateField{
+				Name: "locked_until",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		failures.AddIndex("idx_auth_failures_key", true, "key", "")
+		failures.AddIndex("idx_auth_failures_last_failure", false, "last_failure", "")
+		return app.Save(failures)
+	}, func(app core.App) error {
+		failures, err := app.FindCollectionByNameOrId("auth_failures")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(failures)
+	})
+}
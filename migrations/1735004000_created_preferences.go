@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("preferences"); err == nil {
+			return nil
+		}
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// a row per user with preferences, the missing keys taking their
+		// defaults. The nil API rules leave them to superusers only.
+		preferences := core.NewBaseCollection("preferences")
+		preferences.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				Required:      true,
+				CascadeDelete: true,
+				MaxSelect:     1,
+			},
+			// the preferences by key, e.g. {"notifications.profileChanges.email": false}
+			&core.JSONField{
+				Name: "values",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+		preferences.AddIndex("idx_preferences_user", true, "user", "")
+		return app.Save(preferences)
+	}, func(app core.App) error {
+		preferences, err := app.FindCollectionByNameOrId("preferences")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(preferences)
+	})
+}
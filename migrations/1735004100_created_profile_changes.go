@@ -0,0 +1,95 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// The profile_changes rows queue the changes of the email, the name and the
+// verified flag of the users for the profile change notifier, which deletes
+// them once handled. Like the users_fts ones, the triggers see the plain SQL
+// writes the record hooks miss.
+var profileChangesTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS users_profile_change_email AFTER UPDATE OF email ON users
+	WHEN old.email IS NOT new.email BEGIN
+		INSERT INTO profile_changes (id, user, field, old_value, new_value, created, updated)
+		VALUES ('r' || lower(hex(randomblob(7))), new.id, 'email', old.email, new.email,
+			strftime('%Y-%m-%d %H:%M:%fZ', 'now'), strftime('%Y-%m-%d %H:%M:%fZ', 'now'));
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS users_profile_change_name AFTER UPDATE OF name ON users
+	WHEN old.name IS NOT new.name BEGIN
+		INSERT INTO profile_changes (id, user, field, old_value, new_value, created, updated)
+		VALUES ('r' || lower(hex(randomblob(7))), new.id, 'name', old.name, new.name,
+			strftime('%Y-%m-%d %H:%M:%fZ', 'now'), strftime('%Y-%m-%d %H:%M:%fZ', 'now'));
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS users_profile_change_verified AFTER UPDATE OF verified ON users
+	WHEN old.verified IS NOT new.verified BEGIN
+		INSERT INTO profile_changes (id, user, field, old_value, new_value, created, updated)
+		VALUES ('r' || lower(hex(randomblob(7))), new.id, 'verified',
+			CASE WHEN old.verified THEN 'true' ELSE 'false' END, CASE WHEN new.verified THEN 'true' ELSE 'false' END,
+			strftime('%Y-%m-%d %H:%M:%fZ', 'now'), strftime('%Y-%m-%d %H:%M:%fZ', 'now'));
+	END`,
+}
+
+var profileChangesTriggersDown = []string{
+	`DROP TRIGGER IF EXISTS users_profile_change_email`,
+	`DROP TRIGGER IF EXISTS users_profile_change_name`,
+	`DROP TRIGGER IF EXISTS users_profile_change_verified`,
+}
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("profile_changes"); err != nil {
+			// the nil API rules leave the queue to superusers only
+			changes := core.NewBaseCollection("profile_changes")
+			changes.Fields.Add(
+				// not a relation, so that the changes outlive a hard delete
+				// and are dropped by the notifier
+				&core.TextField{
+					Name:     "user",
+					Required: true,
+				},
+				&core.TextField{
+					Name:     "field",
+					Required: true,
+				},
+				&core.TextField{
+					Name: "old_value",
+				},
+				&core.TextField{
+					Name: "new_value",
+				},
+				&core.AutodateField{
+					Name:     "created",
+					OnCreate: true,
+				},
+				&core.AutodateField{
+					Name:     "updated",
+					OnCreate: true,
+					OnUpdate: true,
+				},
+			)
+			changes.AddIndex("idx_profile_changes_created", false, "created", "")
+			if err := app.Save(changes); err != nil {
+				return err
+			}
+		}
+		for _, query := range profileChangesTriggers {
+			if _, err := app.DB().NewQuery(query).Execute(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		for _, query := range profileChangesTriggersDown {
+			if _, err := app.DB().NewQuery(query).Execute(); err != nil {
+				return err
+			}
+		}
+		changes, err := app.FindCollectionByNameOrId("profile_changes")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(changes)
+	})
+}
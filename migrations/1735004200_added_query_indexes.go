@@ -0,0 +1,86 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/dbutils"
+)
+
+// queryIndex is an index of the custom queries. It replaces the index
+// named by replaces, if any, which it starts with.
+type queryIndex struct {
+	collection string
+	name       string
+	unique     bool
+	columns    string
+	replaces   string
+	replaced   string
+}
+
+// The list routes filter on the tenant and the soft deletion of the users
+// before sorting by created, and page the other tables by created. The
+// startup check of the main package warns of the list fields still left
+// without one.
+var queryIndexes = []queryIndex{
+	{collection: "users", name: "idx_users_tenant_created", columns: "tenant_id, deleted_at, created, id", replaces: "idx_users_tenant_id", replaced: "tenant_id"},
+	{collection: "posts", name: "idx_posts_created_id", columns: "created, id"},
+	{collection: "jobs", name: "idx_jobs_created", columns: "created"},
+	{collection: "moderation_queue", name: "idx_moderation_queue_created", columns: "created"},
+	{collection: "retention_runs", name: "idx_retention_runs_created", columns: "created"},
+}
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		// the auth collections get one from PocketBase, but the lookups by
+		// email rely on it
+		if !dbutils.HasSingleColumnUniqueIndex("email", users.Indexes) {
+			users.AddIndex("idx_users_email", true, "email", "email != ''")
+			if err := app.Save(users); err != nil {
+				return err
+			}
+		}
+
+		for _, index := range queryIndexes {
+			collection, err := app.FindCollectionByNameOrId(index.collection)
+			if err != nil || collection.GetIndex(index.name) != "" {
+				continue
+			}
+			if index.replaces != "" {
+				collection.RemoveIndex(index.replaces)
+			}
+			collection.AddIndex(index.name, index.unique, index.columns, "")
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		for _, index := range queryIndexes {
+			collection, err := app.FindCollectionByNameOrId(index.collection)
+			if err != nil {
+				continue
+			}
+			collection.RemoveIndex(index.name)
+			if index.replaces != "" && collection.GetIndex(index.replaces) == "" {
+				collection.AddIndex(index.replaces, false, index.replaced, "")
+			}
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.GetIndex("idx_users_email") == "" {
+			return nil
+		}
+		users.RemoveIndex("idx_users_email")
+		return app.Save(users)
+	})
+}
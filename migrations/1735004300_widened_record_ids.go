@@ -0,0 +1,48 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// idMaxLength fits the longest of the time sortable ids the main package can
+// generate for a collection, the 32 hex digits of the UUIDs.
+const idMaxLength = 32
+
+func init() {
+	m.Register(func(app core.App) error {
+		collections, err := app.FindAllCollections()
+		if err != nil {
+			return err
+		}
+		for _, collection := range collections {
+			id, _ := collection.Fields.GetByName("id").(*core.TextField)
+			if collection.System || id == nil || id.Max >= idMaxLength {
+				continue
+			}
+			id.Max = idMaxLength
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		collections, err := app.FindAllCollections()
+		if err != nil {
+			return err
+		}
+		for _, collection := range collections {
+			id, _ := collection.Fields.GetByName("id").(*core.TextField)
+			if collection.System || id == nil || id.Max != idMaxLength {
+				continue
+			}
+			// the longer ids already generated are kept, PocketBase doesn't
+			// validate the ids of the existing records
+			id.Max = core.DefaultIdLength
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
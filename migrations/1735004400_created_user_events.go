@@ -0,0 +1,57 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("user_events"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the stream to superusers only
+		events := core.NewBaseCollection("user_events")
+		events.Fields.Add(
+			// not a relation, the stream is dropped by the hard delete of
+			// the user itself
+			&core.TextField{
+				Name:     "aggregate",
+				Required: true,
+			},
+			&core.NumberField{
+				Name:     "version",
+				Required: true,
+				OnlyInt:  true,
+			},
+			&core.TextField{
+				Name:     "type",
+				Required: true,
+			},
+			&core.JSONField{
+				Name: "data",
+			},
+			&core.TextField{
+				Name: "actor_type",
+			},
+			&core.TextField{
+				Name: "actor_id",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+		)
+		// two writers can't both append the same version
+		events.AddIndex("idx_user_events_aggregate_version", true, "aggregate, version", "")
+
+		return app.Save(events)
+	}, func(app core.App) error {
+		events, err := app.FindCollectionByNameOrId("user_events")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(events)
+	})
+}
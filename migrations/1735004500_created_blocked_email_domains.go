@@ -0,0 +1,74 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// disposableEmailDomains seed the blocklist with the most common providers
+// of throwaway addresses. The list is edited from the admin UI, or extended
+// with POST /admin/blocked-email-domains.
+var disposableEmailDomains = []string{
+	"10minutemail.com",
+	"dispostable.com",
+	"emailondeck.com",
+	"fakeinbox.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"guerrillamail.net",
+	"mailinator.com",
+	"maildrop.cc",
+	"mintemail.com",
+	"mohmal.com",
+	"sharklasers.com",
+	"temp-mail.org",
+	"tempmail.com",
+	"throwawaymail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+func init() {
+	m.Register(func(app core.App) error {
+		if _, err := app.FindCollectionByNameOrId("blocked_email_domains"); err == nil {
+			return nil
+		}
+
+		// the nil API rules leave the list to superusers only
+		domains := core.NewBaseCollection("blocked_email_domains")
+		domains.Fields.Add(
+			&core.TextField{
+				Name:     "domain",
+				Required: true,
+				Pattern:  `^[a-z0-9.-]+$`,
+			},
+			&core.TextField{
+				Name: "reason",
+			},
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+		)
+		domains.AddIndex("idx_blocked_email_domains_domain", true, "domain", "")
+		if err := app.Save(domains); err != nil {
+			return err
+		}
+
+		for _, domain := range disposableEmailDomains {
+			record := core.NewRecord(domains)
+			record.Set("domain", domain)
+			record.Set("reason", "disposable")
+			if err := app.Save(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		domains, err := app.FindCollectionByNameOrId("blocked_email_domains")
+		if err != nil {
+			return nil
+		}
+		return app.Delete(domains)
+	})
+}
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		keys, err := app.FindCollectionByNameOrId("api_keys")
+		if err != nil {
+			return err
+		}
+		if keys.Fields.GetByName("signing_secret") != nil {
+			return nil
+		}
+
+		// the secret the signed requests are signed with, which the server
+		// must read back unlike the key, and whether the key is refused
+		// without a signature. The keys created before have no secret and
+		// can't sign.
+		keys.Fields.Add(
+			&core.TextField{
+				Name:   "signing_secret",
+				Hidden: true,
+			},
+			&core.BoolField{
+				Name: "require_signature",
+			},
+		)
+
+		return app.Save(keys)
+	}, func(app core.App) error {
+		keys, err := app.FindCollectionByNameOrId("api_keys")
+		if err != nil {
+			return err
+		}
+
+		keys.Fields.RemoveByName("signing_secret")
+		keys.Fields.RemoveByName("require_signature")
+
+		return app.Save(keys)
+	})
+}
@@ -0,0 +1,91 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// completenessSQL scores the users row being updated, out of 100, with the
+// weights of CompletenessCriteria of the main package: the email verified,
+// the name set, the avatar uploaded and the preferences filled.
+const completenessSQL = `(CASE WHEN verified THEN 30 ELSE 0 END)
+	+ (CASE WHEN name != '' THEN 25 ELSE 0 END)
+	+ (CASE WHEN avatar != '' THEN 25 ELSE 0 END)
+	+ (CASE WHEN EXISTS (SELECT 1 FROM preferences p WHERE p.user = users.id
+		AND p."values" NOT IN ('', '{}', 'null')) THEN 20 ELSE 0 END)`
+
+// Like the users_fts ones, the triggers see the plain SQL writes the record
+// hooks miss. The update one has no WHEN, for a record saved with a stale
+// completeness, every column being written, to be scored again.
+var completenessTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS users_completeness_insert AFTER INSERT ON users BEGIN
+		UPDATE users SET completeness = ` + completenessSQL + ` WHERE id = new.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS users_completeness_update AFTER UPDATE OF verified, name, avatar ON users BEGIN
+		UPDATE users SET completeness = ` + completenessSQL + ` WHERE id = new.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS preferences_completeness_insert AFTER INSERT ON preferences BEGIN
+		UPDATE users SET completeness = ` + completenessSQL + ` WHERE id = new.user;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS preferences_completeness_update AFTER UPDATE OF "values", user ON preferences BEGIN
+		UPDATE users SET completeness = ` + completenessSQL + ` WHERE id IN (old.user, new.user);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS preferences_completeness_delete AFTER DELETE ON preferences BEGIN
+		UPDATE users SET completeness = ` + completenessSQL + ` WHERE id = old.user;
+	END`,
+}
+
+var completenessTriggersDown = []string{
+	`DROP TRIGGER IF EXISTS users_completeness_insert`,
+	`DROP TRIGGER IF EXISTS users_completeness_update`,
+	`DROP TRIGGER IF EXISTS preferences_completeness_insert`,
+	`DROP TRIGGER IF EXISTS preferences_completeness_update`,
+	`DROP TRIGGER IF EXISTS preferences_completeness_delete`,
+}
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+		if users.Fields.GetByName("completeness") == nil {
+			// only written by the triggers, listed by GET /admin/completeness
+			zero, hundred := 0.0, 100.0
+			users.Fields.Add(&core.NumberField{
+				Name:    "completeness",
+				OnlyInt: true,
+				Min:     &zero,
+				Max:     &hundred,
+			})
+			users.AddIndex("idx_users_completeness", false, "completeness", "")
+			if err := app.Save(users); err != nil {
+				return err
+			}
+		}
+
+		for _, query := range completenessTriggers {
+			if _, err := app.DB().NewQuery(query).Execute(); err != nil {
+				return err
+			}
+		}
+		// scores the existing users
+		_, err = app.DB().NewQuery("UPDATE users SET completeness = " + completenessSQL).Execute()
+		return err
+	}, func(app core.App) error {
+		for _, query := range completenessTriggersDown {
+			if _, err := app.DB().NewQuery(query).Execute(); err != nil {
+				return err
+			}
+		}
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.RemoveIndex("idx_users_completeness")
+		users.Fields.RemoveByName("completeness")
+
+		return app.Save(users)
+	})
+}
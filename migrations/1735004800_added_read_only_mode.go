@@ -0,0 +1,49 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		settings, err := app.FindCollectionByNameOrId("route_settings")
+		if err != nil {
+			return err
+		}
+		if settings.Fields.GetByName("read_only") == nil {
+			// rejects the writes to the routes with 403, for the public
+			// demo deployments
+			settings.Fields.Add(&core.BoolField{Name: "read_only"})
+			if err := app.Save(settings); err != nil {
+				return err
+			}
+		}
+
+		cronSettings, err := app.FindCollectionByNameOrId("cron_settings")
+		if err != nil {
+			return err
+		}
+		if _, err := app.FindFirstRecordByData(cronSettings, "task", "reset_demo_data"); err == nil {
+			return nil
+		}
+		// disabled, the demo deployments turn it on, and it refuses to run
+		// outside of the read-only mode anyway
+		record := core.NewRecord(cronSettings)
+		record.Set("task", "reset_demo_data")
+		record.Set("schedule", "0 4 * * *")
+		record.Set("enabled", false)
+		return app.Save(record)
+	}, func(app core.App) error {
+		if _, err := app.DB().Delete("cron_settings", dbx.HashExp{"task": "reset_demo_data"}).Execute(); err != nil {
+			return err
+		}
+		settings, err := app.FindCollectionByNameOrId("route_settings")
+		if err != nil {
+			return err
+		}
+		settings.Fields.RemoveByName("read_only")
+		return app.Save(settings)
+	})
+}
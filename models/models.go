@@ -0,0 +1,160 @@
+// Package models holds the request and response types shared by the API
+// handlers and the Go client.
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type User struct {
+	Id              string `db:"id" json:"id"`
+	Email           string `db:"email" json:"email"`
+	EmailVisibility bool   `db:"emailVisibility" json:"emailVisibility"`
+	Verified        bool   `db:"verified" json:"verified"`
+	Name            string `db:"name" json:"name"`
+	Avatar          string `db:"avatar" json:"avatar"`
+	LastSeen        string `db:"lastSeen" json:"lastSeen"`
+	Roles           Roles  `db:"roles" json:"roles"`
+	LoginCount      int64  `db:"loginCount" json:"loginCount"`
+	Credits         int64  `db:"credits" json:"credits"`
+	// Completeness scores the profile out of 100, see GET
+	// /admin/completeness.
+	Completeness int64 `db:"completeness" json:"completeness"`
+	// Phone and NationalId are encrypted at rest, and only returned to the
+	// user and the superusers.
+	Phone      string `db:"phone" json:"phone,omitempty" encrypted:"true"`
+	NationalId string `db:"nationalId" json:"nationalId,omitempty" encrypted:"true"`
+	TenantId   string `db:"tenant_id" json:"tenantId,omitempty"`
+	Created    string `db:"created" json:"created"`
+	Updated    string `db:"updated" json:"updated"`
+}
+
+// Roles are the roles of a user, stored as a JSON array in the roles
+// column.
+type Roles []string
+
+func (r *Roles) Scan(src any) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*r = Roles{}
+		return nil
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw = v
+	default:
+		return fmt.Errorf("unsupported roles value %T", src)
+	}
+	roles := Roles{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &roles); err != nil {
+			return err
+		}
+	}
+	*r = roles
+	return nil
+}
+
+func (r Roles) Value() (driver.Value, error) {
+	if r == nil {
+		r = Roles{}
+	}
+	raw, err := json.Marshal([]string(r))
+	return string(raw), err
+}
+
+// MarshalJSON encodes nil roles as an empty array.
+func (r Roles) MarshalJSON() ([]byte, error) {
+	if r == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]string(r))
+}
+
+type UserCreationRequest struct {
+	Email           string `db:"email" json:"email"`
+	EmailVisibility bool   `db:"emailVisibility" json:"emailVisibility"`
+	Name            string `db:"name" json:"name"`
+	Password        string `db:"-" json:"password,omitempty"`
+	PasswordConfirm string `db:"-" json:"passwordConfirm,omitempty"`
+}
+
+// UserUpsertRequest is the body of PUT /users, which creates the user with
+// the email or replaces its fields.
+type UserUpsertRequest struct {
+	Email           string `db:"email" json:"email"`
+	EmailVisibility bool   `db:"emailVisibility" json:"emailVisibility"`
+	Name            string `db:"name" json:"name"`
+}
+
+type UserUpdateRequest struct {
+	Email           *string `db:"email" json:"email,omitempty"`
+	EmailVisibility *bool   `db:"emailVisibility" json:"emailVisibility,omitempty"`
+	Name            *string `db:"name" json:"name,omitempty"`
+	Phone           *string `db:"phone" json:"phone,omitempty"`
+	NationalId      *string `db:"nationalId" json:"nationalId,omitempty"`
+	// ExpectedUpdated, when set, makes the update fail unless the user's
+	// updated time still matches it. It can also be sent as If-Match.
+	ExpectedUpdated *string `db:"-" json:"expectedUpdated,omitempty"`
+	// UnmodifiedSince, set from the If-Unmodified-Since header, makes the
+	// update fail unless the user wasn't updated after it.
+	UnmodifiedSince *time.Time `db:"-" json:"-"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// AuthResponse is returned by the /auth routes. Token is a PocketBase auth
+// token, sent back in the Authorization header.
+type AuthResponse struct {
+	Token string `json:"token,omitempty"`
+	User  *User  `json:"user,omitempty"`
+	// TwoFactorToken is returned instead of Token and User to the users with
+	// two-factor authentication enabled, to be sent to POST /auth/2fa along
+	// with a code.
+	TwoFactorToken string `json:"twoFactorToken,omitempty"`
+	// TwoFactorSession is sent as the X-2FA-Session header to the routes
+	// that require a verified second factor.
+	TwoFactorSession string `json:"twoFactorSession,omitempty"`
+}
+
+type APIResp struct {
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	Data    any    `json:"data,omitempty"`
+	// Code is the stable code of a failure, e.g. USER_NOT_FOUND.
+	Code string `json:"code,omitempty"`
+	// RequestId is set on failures, to correlate them with the server logs.
+	RequestId string `json:"requestId,omitempty"`
+}
+
+func NewAPIResp(success bool, message string, data any) *APIResp {
+	return &APIResp{
+		Success: success,
+		Message: message,
+		Data:    data,
+	}
+}
+
+// ListPage is the paginated payload returned in APIResp.Data by list endpoints.
+type ListPage[T any] struct {
+	Items      []T `json:"items"`
+	Page       int `json:"page"`
+	PerPage    int `json:"perPage"`
+	TotalItems int `json:"totalItems"`
+	TotalPages int `json:"totalPages"`
+}
+
+// CursorPage is the payload of list endpoints in cursor mode. NextCursor is
+// empty on the last page.
+type CursorPage[T any] struct {
+	Items      []T    `json:"items"`
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"nextCursor"`
+}
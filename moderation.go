@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// The actions of MODERATION_API_ACTION, taken on the values the external
+// moderation API flags.
+const (
+	ModerationReject = "reject"
+	ModerationFlag   = "flag"
+)
+
+// The statuses of the moderation_queue items.
+const (
+	ModerationPending  = "pending"
+	ModerationApproved = "approved"
+	ModerationRejected = "rejected"
+)
+
+// What flagged a moderation_queue item.
+const (
+	ModerationSourceWords = "words"
+	ModerationSourceAPI   = "api"
+)
+
+var ErrModerationStatus = errors.New("moderation item was already reviewed")
+
+// errContentRejected is reported for every rejected field, without the words
+// that matched, which would help getting around the lists.
+var errContentRejected = validation.NewError("validation_content_rejected", "contains disallowed content")
+
+var ModerationSortFields = []string{"created", "updated"}
+
+var ModerationFilterFields = map[string]FilterType{
+	"collection": FilterString,
+	"record_id":  FilterString,
+	"field":      FilterString,
+	"source":     FilterString,
+	"status":     FilterString,
+}
+
+// ModerationItem is a value flagged for review, in moderation_queue.
+type ModerationItem struct {
+	Id         string        `db:"id" json:"id"`
+	Collection string        `db:"collection" json:"collection"`
+	RecordId   string        `db:"record_id" json:"recordId"`
+	Field      string        `db:"field" json:"field"`
+	Value      string        `db:"value" json:"value"`
+	Source     string        `db:"source" json:"source"`
+	Reasons    types.JSONRaw `db:"reasons" json:"reasons"`
+	Status     string        `db:"status" json:"status"`
+	ReviewedBy string        `db:"reviewed_by" json:"reviewedBy"`
+	ReviewedAt string        `db:"reviewed_at" json:"reviewedAt"`
+	Created    string        `db:"created" json:"created"`
+	Updated    string        `db:"updated" json:"updated"`
+}
+
+// moderationEntry is the row QueueModerationFlags inserts.
+type moderationEntry struct {
+	Collection string        `db:"collection"`
+	RecordId   string        `db:"record_id"`
+	Field      string        `db:"field"`
+	Value      string        `db:"value"`
+	Source     string        `db:"source"`
+	Reasons    types.JSONRaw `db:"reasons"`
+	Status     string        `db:"status"`
+}
+
+var ModerationItems = &Repository[ModerationItem]{
+	Table:         "moderation_queue",
+	CreatedColumn: "created",
+	UpdatedColumn: "updated",
+}
+
+// ModerationFlag is a value to review, with the words or the categories of
+// the API that flagged it.
+type ModerationFlag struct {
+	Field   string
+	Value   string
+	Source  string
+	Reasons []string
+}
+
+// ModerationVerdict is the outcome of screening the fields of a write.
+// Rejected holds the fields refusing the write, Flags the ones written but
+// queued for review.
+type ModerationVerdict struct {
+	Rejected validation.Errors
+	Flags    []ModerationFlag
+}
+
+// Moderation screens the free-text fields of the users and the posts. It is
+// nil unless a word list or MODERATION_API_URL is configured.
+var Moderation *Moderator
+
+// Moderator screens the values against two word lists, the words rejecting
+// the writes and the ones flagging them for review, and optionally against
+// an OpenAI-compatible moderation API, which rejects or flags them as
+// MODERATION_API_ACTION says.
+//
+// The lists hold a word or a phrase per line and match whole words, case
+// insensitively, with the common digit and symbol substitutions undone, so
+// that "b4d" matches "bad" but "badge" doesn't.
+type Moderator struct {
+	reject    []string
+	flag      []string
+	apiURL    string
+	apiKey    string
+	apiAction string
+	client    *http.Client
+}
+
+func NewModerator(cfg *Config) (*Moderator, error) {
+	reject, err := LoadModerationWords(cfg.ModerationRejectList)
+	if err != nil {
+		return nil, err
+	}
+	flag, err := LoadModerationWords(cfg.ModerationFlagList)
+	if err != nil {
+		return nil, err
+	}
+	return &Moderator{
+		reject:    reject,
+		flag:      flag,
+		apiURL:    cfg.ModerationAPIURL,
+		apiKey:    cfg.ModerationAPIKey,
+		apiAction: cfg.ModerationAPIAction,
+		client:    Downstream.Client(DependencyModeration, cfg.ModerationTimeout),
+	}, nil
+}
+
+// LoadModerationWords reads the word list at path, skipping the blank lines
+// and the # comments. An empty path is an empty list.
+func LoadModerationWords(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading moderation word list: %w", err)
+	}
+	defer f.Close()
+
+	words := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if word := strings.TrimSpace(normalizeModerationText(line)); word != "" && !slices.Contains(words, word) {
+			words = append(words, word)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading moderation word list: %w", err)
+	}
+	return words, nil
+}
+
+var moderationSubstitutions = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s",
+)
+
+// normalizeModerationText lowercases s, undoes the substitutions and keeps
+// its words separated by single spaces, with a space on either end so that
+// the lists match whole words.
+func normalizeModerationText(s string) string {
+	s = moderationSubstitutions.Replace(strings.ToLower(s))
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return " " + strings.Join(words, " ") + " "
+}
+
+// matchModerationWords returns the words of the list text contains.
+func matchModerationWords(text string, words []string) []string {
+	matched := []string{}
+	for _, word := range words {
+		if strings.Contains(text, " "+word+" ") {
+			matched = append(matched, word)
+		}
+	}
+	return matched
+}
+
+// Screen screens the fields, by name. The verdict of the word lists is
+// returned along with the error of the moderation API, if it failed.
+func (m *Moderator) Screen(ctx context.Context, fields map[string]string) (ModerationVerdict, error) {
+	verdict := ModerationVerdict{}
+	if m == nil {
+		return verdict, nil
+	}
+	names := make([]string, 0, len(fields))
+	for name, value := range fields {
+		if strings.TrimSpace(value) != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	reject := func(name string) {
+		if verdict.Rejected == nil {
+			verdict.Rejected = validation.Errors{}
+		}
+		verdict.Rejected[name] = errContentRejected
+	}
+	unscreened := []string{}
+	for _, name := range names {
+		text := normalizeModerationText(fields[name])
+		if len(matchModerationWords(text, m.reject)) > 0 {
+			reject(name)
+			continue
+		}
+		if matched := matchModerationWords(text, m.flag); len(matched) > 0 {
+			verdict.Flags = append(verdict.Flags, ModerationFlag{Field: name, Value: fields[name], Source: ModerationSourceWords, Reasons: matched})
+			continue
+		}
+		unscreened = append(unscreened, name)
+	}
+	if m.apiURL == "" || len(unscreened) == 0 {
+		return verdict, nil
+	}
+
+	inputs := make([]string, len(unscreened))
+	for i, name := range unscreened {
+		inputs[i] = fields[name]
+	}
+	results, err := m.callAPI(ctx, inputs)
+	if err != nil {
+		return verdict, err
+	}
+	for i, name := range unscreened {
+		if !results[i].Flagged {
+			continue
+		}
+		if m.apiAction == ModerationReject {
+			reject(name)
+			continue
+		}
+		verdict.Flags = append(verdict.Flags, ModerationFlag{Field: name, Value: fields[name], Source: ModerationSourceAPI, Reasons: results[i].categories()})
+	}
+	return verdict, nil
+}
+
+type moderationAPIRequest struct {
+	Input []string `json:"input"`
+}
+
+type moderationAPIResponse struct {
+	Results []moderationAPIResult `json:"results"`
+}
+
+type moderationAPIResult struct {
+	Flagged    bool            `json:"flagged"`
+	Categories map[string]bool `json:"categories"`
+}
+
+// categories returns the names of the flagged categories, sorted.
+func (r moderationAPIResult) categories() []string {
+	categories := []string{}
+	for name, flagged := range r.Categories {
+		if flagged {
+			categories = append(categories, name)
+		}
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// callAPI POSTs the inputs to the moderation API, in the format of the
+// OpenAI /v1/moderations endpoint, returning a result per input.
+func (m *Moderator) callAPI(ctx context.Context, inputs []string) ([]moderationAPIResult, error) {
+	body, err := json.Marshal(moderationAPIRequest{Input: inputs})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.apiURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling moderation API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("moderation API responded with status %d", resp.StatusCode)
+	}
+	decoded := moderationAPIResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("invalid moderation API response: %w", err)
+	}
+	if len(decoded.Results) != len(inputs) {
+		return nil, fmt.Errorf("moderation API returned %d results for %d inputs", len(decoded.Results), len(inputs))
+	}
+	return decoded.Results, nil
+}
+
+// ScreenRequest screens the fields written by the request. The superusers'
+// writes aren't screened, and a failing moderation API only leaves the
+// values to the word lists, logged rather than failing the write.
+func ScreenRequest(app core.App, e *core.RequestEvent, fields map[string]string) ModerationVerdict {
+	if Moderation == nil || e.HasSuperuserAuth() {
+		return ModerationVerdict{}
+	}
+	verdict, err := Moderation.Screen(e.Request.Context(), fields)
+	if err != nil {
+		app.Logger().Warn("Moderation API failed, only the word lists were applied", "error", err)
+	}
+	return verdict
+}
+
+// QueueModerationFlags queues the flagged values of the record for review,
+// replacing the pending items of the same fields.
+func QueueModerationFlags(app core.App, collection string, recordId string, flags []ModerationFlag) error {
+	if len(flags) == 0 {
+		return nil
+	}
+	return WithTx(app, func(txApp core.App) error {
+		for _, flag := range flags {
+			_, err := txApp.NonconcurrentDB().Delete(ModerationItems.Table, dbx.HashExp{
+				"collection": collection,
+				"record_id":  recordId,
+				"field":      flag.Field,
+				"status":     ModerationPending,
+			}).Execute()
+			if err != nil {
+				return err
+			}
+			reasons, _ := json.Marshal(flag.Reasons)
+			err = ModerationItems.Insert(txApp, moderationEntry{
+				Collection: collection,
+				RecordId:   recordId,
+				Field:      flag.Field,
+				Value:      flag.Value,
+				Source:     flag.Source,
+				Reasons:    reasons,
+				Status:     ModerationPending,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// flagForReview queues the flags of the verdict, logging rather than
+// failing the write already made.
+func flagForReview(app core.App, collection string, recordId string, verdict ModerationVerdict) {
+	if err := QueueModerationFlags(app, collection, recordId, verdict.Flags); err != nil {
+		app.Logger().Warn("Failed to queue moderation flags", "collection", collection, "recordId", recordId, "error", err)
+	}
+}
+
+// ReviewModerationItem approves or rejects a pending item. Rejecting it
+// blanks the field of the record, unless it was changed since, in which case
+// the new value was screened on its own. The blanked record is saved without
+// validation, as the field may be required.
+func ReviewModerationItem(app core.App, itemId string, status string, reviewerId string) (*ModerationItem, error) {
+	span := StartStorageSpan(app, "ReviewModerationItem", "UPDATE")
+	var item *ModerationItem
+	err := WithTx(app, func(txApp core.App) error {
+		current, err := ModerationItems.Find(txApp, itemId)
+		if err != nil {
+			return err
+		}
+		if current.Status != ModerationPending {
+			return ErrModerationStatus
+		}
+		if status == ModerationRejected {
+			if err := blankModeratedField(txApp, *current); err != nil {
+				return err
+			}
+		}
+		_, err = ModerationItems.Update(txApp, itemId, Changeset{
+			"status":      status,
+			"reviewed_by": reviewerId,
+			"reviewed_at": types.NowDateTime().String(),
+		})
+		if err != nil {
+			return err
+		}
+		item, err = ModerationItems.Find(txApp, itemId)
+		return err
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func blankModeratedField(txApp core.App, item ModerationItem) error {
+	record, err := txApp.FindRecordById(item.Collection, item.RecordId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if record.GetString(item.Field) != item.Value {
+		return nil
+	}
+	if item.Collection == Users.Table {
+		if _, err := Users.Update(txApp, item.RecordId, Changeset{item.Field: ""}); err != nil {
+			return err
+		}
+		user, err := GetUserById(txApp, item.RecordId)
+		if err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserUpdated, user)
+	}
+	record.Set(item.Field, "")
+	return txApp.SaveNoValidate(record)
+}
+
+func HandleListModerationItems(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		filter, err := ParseFilter(e.Request.URL.Query().Get("filter"), ModerationFilterFields)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		opts, err := ParseListOptions(e.Request.URL.Query(), ModerationSortFields, cfg)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if len(opts.Sort) == 0 {
+			opts.Sort = []SortField{{Field: "created"}}
+		}
+		opts.Filter = filter
+
+		span := StartStorageSpan(app, "ListModerationItems", "SELECT")
+		total, err := ModerationItems.Count(app, opts.Filter)
+		if err != nil {
+			span.End(err)
+			return WriteInternalServerError(e, "error counting moderation items: "+err.Error(), nil)
+		}
+		items, err := ModerationItems.FindAll(app, opts)
+		span.SetAttr("db.response.returned_rows", len(items))
+		span.End(err)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting moderation items: "+err.Error(), nil)
+		}
+		return WriteOK(e, "", NewListPage(items, opts, total))
+	}
+}
+
+// HandleReviewModerationItem approves or rejects the item of the path,
+// recording the superuser who did.
+func HandleReviewModerationItem(app *pocketbase.PocketBase, status string) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		reviewerId := ""
+		if e.Auth != nil {
+			reviewerId = e.Auth.Id
+		}
+		item, err := ReviewModerationItem(app, e.Request.PathValue("itemId"), status, reviewerId)
+		if errors.Is(err, ErrNotFound) {
+			return WriteNotFound(e, "moderation item not found", nil)
+		}
+		if errors.Is(err, ErrModerationStatus) {
+			return WriteConflict(e, err.Error(), nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error reviewing moderation item")
+		}
+		return WriteOK(e, "", item)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeXML     = "application/xml"
+	ContentTypeMsgPack = "application/msgpack"
+)
+
+// ResponseEncoder writes v, a value that marshals to JSON, in its format.
+type ResponseEncoder func(w io.Writer, v any) error
+
+// ResponseEncoders are the formats WriteResp can answer with, by media type,
+// picked with the Accept header of the request.
+var ResponseEncoders = map[string]ResponseEncoder{
+	ContentTypeJSON:    EncodeJSON,
+	ContentTypeXML:     EncodeXML,
+	ContentTypeMsgPack: EncodeMsgPack,
+}
+
+// contentTypeAliases are the other names the formats are requested with.
+var contentTypeAliases = map[string]string{
+	"text/xml":                ContentTypeXML,
+	"application/x-msgpack":   ContentTypeMsgPack,
+	"application/vnd.msgpack": ContentTypeMsgPack,
+}
+
+// NegotiateContentType returns the registered media type the request
+// prefers, JSON when the Accept header is missing or matches none of them.
+func NegotiateContentType(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return ContentTypeJSON
+	}
+
+	best, bestQ := ContentTypeJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if alias, ok := contentTypeAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		if mediaType == "*/*" || mediaType == "application/*" {
+			mediaType = ContentTypeJSON
+		}
+		if _, ok := ResponseEncoders[mediaType]; !ok {
+			continue
+		}
+		// ties go to JSON, then to the first listed type
+		if q > bestQ || q == bestQ && mediaType == ContentTypeJSON {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
+
+// writeEncoded writes v in the format negotiated for the request.
+func writeEncoded(e *core.RequestEvent, status int, v any) error {
+	e.Response.Header().Add("Vary", "Accept")
+	contentType := NegotiateContentType(e.Request)
+	if contentType == ContentTypeJSON {
+		return e.JSON(status, v)
+	}
+
+	var buf bytes.Buffer
+	if err := ResponseEncoders[contentType](&buf, v); err != nil {
+		return err
+	}
+	e.Response.Header().Set("Content-Type", contentType)
+	e.Response.WriteHeader(status)
+	_, err := e.Response.Write(buf.Bytes())
+	return err
+}
+
+func EncodeJSON(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// jsonMember is a key of a decoded JSON object, which keeps the order of
+// its members so that the other formats list them like JSON does.
+type jsonMember struct {
+	Key   string
+	Value any
+}
+
+// toJSONValue marshals v to JSON and decodes it back into nil, bool,
+// json.Number, string, []any and []jsonMember values, so that the other
+// formats follow the json tags.
+func toJSONValue(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return decodeJSONValue(dec)
+}
+
+func decodeJSONValue(dec *json.Decoder) (any, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('['):
+		items := []any{}
+		for dec.More() {
+			item, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		_, err := dec.Token()
+		return items, err
+	case json.Delim('{'):
+		members := []jsonMember{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, jsonMember{Key: key.(string), Value: value})
+		}
+		_, err := dec.Token()
+		return members, err
+	}
+	return token, nil
+}
+
+var xmlNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// EncodeXML writes v under a <response> element. Object members become
+// elements named after their keys (or <entry key="..."> when the key isn't
+// a valid name), array items become <item> elements and nulls are marked
+// with a nil="true" attribute.
+func EncodeXML(w io.Writer, v any) error {
+	value, err := toJSONValue(v)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	if err := encodeXMLValue(enc, xml.StartElement{Name: xml.Name{Local: "response"}}, value); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func encodeXMLValue(enc *xml.Encoder, start xml.StartElement, value any) error {
+	if value == nil {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "nil"}, Value: "true"})
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case []jsonMember:
+		for _, member := range value {
+			child := xml.StartElement{Name: xml.Name{Local: member.Key}}
+			if !xmlNamePattern.MatchString(member.Key) || strings.HasPrefix(strings.ToLower(member.Key), "xml") {
+				child = xml.StartElement{
+					Name: xml.Name{Local: "entry"},
+					Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: member.Key}},
+				}
+			}
+			if err := encodeXMLValue(enc, child, member.Value); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, item := range value {
+			if err := encodeXMLValue(enc, xml.StartElement{Name: xml.Name{Local: "item"}}, item); err != nil {
+				return err
+			}
+		}
+	case string:
+		if err := enc.EncodeToken(xml.CharData(value)); err != nil {
+			return err
+		}
+	case json.Number:
+		if err := enc.EncodeToken(xml.CharData(value.String())); err != nil {
+			return err
+		}
+	case bool:
+		if err := enc.EncodeToken(xml.CharData(strconv.FormatBool(value))); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+var errMsgPackTooLarge = errors.New("msgpack: value too large")
+
+// EncodeMsgPack writes v in the MessagePack format. Integers use the
+// smallest encoding that holds them, other numbers are float64.
+func EncodeMsgPack(w io.Writer, v any) error {
+	value, err := toJSONValue(v)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := encodeMsgPackValue(&buf, value); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func encodeMsgPackValue(buf *bytes.Buffer, value any) error {
+	switch value := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if value {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(value.String(), 10, 64); err == nil {
+			writeMsgPackInt(buf, i)
+			return nil
+		}
+		if u, err := strconv.ParseUint(value.String(), 10, 64); err == nil {
+			buf.WriteByte(0xcf)
+			return binary.Write(buf, binary.BigEndian, u)
+		}
+		f, err := value.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		return binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		if err := writeMsgPackHeader(buf, len(value), 0xa0, 32, 0xd9, 0xda, 0xdb); err != nil {
+			return err
+		}
+		buf.WriteString(value)
+	case []any:
+		if err := writeMsgPackHeader(buf, len(value), 0x90, 16, 0, 0xdc, 0xdd); err != nil {
+			return err
+		}
+		for _, item := range value {
+			if err := encodeMsgPackValue(buf, item); err != nil {
+				return err
+			}
+		}
+	case []jsonMember:
+		if err := writeMsgPackHeader(buf, len(value), 0x80, 16, 0, 0xde, 0xdf); err != nil {
+			return err
+		}
+		for _, member := range value {
+			if err := encodeMsgPackValue(buf, member.Key); err != nil {
+				return err
+			}
+			if err := encodeMsgPackValue(buf, member.Value); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("msgpack: unsupported value")
+	}
+	return nil
+}
+
+// writeMsgPackHeader writes the type and length of a string, array or map:
+// the fix format below fixMax, else the 8 (strings only, when non zero), 16
+// or 32 bit length formats.
+func writeMsgPackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, f8 byte, f16 byte, f32 byte) error {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		buf.Write([]byte{f8, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(f16)
+		return binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(f32)
+		return binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		return errMsgPackTooLarge
+	}
+	return nil
+}
+
+func writeMsgPackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(i)})
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(i))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, uint64(i))
+	case i >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(int8(i))})
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// ResponseContentTypes lists the registered media types, for the docs.
+func ResponseContentTypes() []string {
+	types := make([]string, 0, len(ResponseEncoders))
+	for contentType := range ResponseEncoders {
+		types = append(types, contentType)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// NotFoundPrefixes are the paths answered by HandleAPINotFound when no
+// route matches, instead of the static files handler or the PocketBase
+// catch-all, which don't reply with the APIResp envelope.
+var NotFoundPrefixes = []string{"/users/", "/api/"}
+
+// RouterMux is the mux the routes were built into, set once the server
+// starts listening.
+var RouterMux *http.ServeMux
+
+// HandleNotFound registers HandleAPINotFound for every method under the
+// NotFoundPrefixes, and HandleAPIOptions for OPTIONS. The routes are less
+// specific than any other of their prefix, so they only match what nothing
+// else does.
+func HandleNotFound(group RouteGroup) {
+	for _, prefix := range NotFoundPrefixes {
+		for _, method := range resourceMethods {
+			group.Route(method, prefix+"{path...}", HandleAPINotFound())
+		}
+		group.Route(http.MethodOptions, prefix+"{path...}", HandleAPIOptions())
+	}
+}
+
+// isCatchAll reports whether the mux pattern is one of the routes matching
+// whatever path the others don't.
+func isCatchAll(pattern string) bool {
+	return pattern == "" || pattern == "/" || strings.HasSuffix(pattern, "{path...}")
+}
+
+// AllowedMethods returns the methods of the routes matching the path of r,
+// found by probing RouterMux with each of them.
+func AllowedMethods(r *http.Request) []string {
+	if RouterMux == nil {
+		return nil
+	}
+	var allowed []string
+	for _, method := range resourceMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		if _, pattern := RouterMux.Handler(probe); !isCatchAll(pattern) {
+			allowed = append(allowed, method)
+			if method == http.MethodGet {
+				allowed = append(allowed, http.MethodHead)
+			}
+		}
+	}
+	return allowed
+}
+
+// HandleAPINotFound answers 405 with the Allow header when the path has
+// routes for other methods, and 404 otherwise.
+func HandleAPINotFound() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if allowed := AllowedMethods(e.Request); len(allowed) > 0 {
+			e.Response.Header().Set("Allow", strings.Join(allowed, ", "))
+			return WriteMethodNotAllowed(e, "method not allowed", nil)
+		}
+		return WriteNotFound(e, "not found", nil)
+	}
+}
+
+// HandleAPIOptions answers OPTIONS with the Allow header for the paths
+// without a Resource, e.g. the PocketBase routes. The CORS preflights are
+// answered before by the CORS middleware.
+func HandleAPIOptions() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		allowed := AllowedMethods(e.Request)
+		if len(allowed) == 0 {
+			return WriteNotFound(e, "not found", nil)
+		}
+		e.Response.Header().Set("Allow", strings.Join(append(allowed, http.MethodOptions), ", "))
+		return e.NoContent(http.StatusNoContent)
+	}
+}
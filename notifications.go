@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/mail"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// NotificationDigestMax caps the notifications listed by a digest email,
+// the others being counted.
+const NotificationDigestMax = 50
+
+var notificationDigestTemplate = template.Must(template.New("notificationDigest").Parse(
+	`<p>Hi{{if .Name}} {{.Name}}{{end}},</p>
+<p>You have {{.Total}} unread notification{{if ne .Total 1}}s{{end}}:</p>
+<ul>
+{{range .Items}}<li>{{.Created}}: {{.Type}}{{if .Message}}, {{.Message}}{{end}}</li>
+{{end}}</ul>
+{{if .More}}<p>and {{.More}} more.</p>{{end}}`))
+
+type Notification struct {
+	Id       string        `db:"id" json:"id"`
+	User     string        `db:"user" json:"user"`
+	Type     string        `db:"type" json:"type"`
+	Payload  types.JSONRaw `db:"payload" json:"payload"`
+	Read     string        `db:"read" json:"read"`
+	Digested string        `db:"digested" json:"-"`
+	Created  string        `db:"created" json:"created"`
+}
+
+var Notifications = NewRepository[Notification]("notifications")
+
+// NotificationDigestJob is the payload of the JobNotificationDigest jobs,
+// which roll the unread notifications created before Before.
+type NotificationDigestJob struct {
+	UserId string `json:"userId"`
+	Before string `json:"before"`
+}
+
+// Notify adds a notification of the type to the inbox of the user. The
+// payload is stored as JSON, a "message" string of it being quoted by the
+// digest emails.
+func Notify(app core.App, userId string, notificationType string, payload any) (*Notification, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	collection, err := app.FindCachedCollectionByNameOrId(Notifications.Table)
+	if err != nil {
+		return nil, err
+	}
+	record := core.NewRecord(collection)
+	record.Set("user", userId)
+	record.Set("type", notificationType)
+	record.Set("payload", types.JSONRaw(raw))
+	if err := RetryWrite(app, func() error { return app.Save(record) }); err != nil {
+		return nil, err
+	}
+	return Notifications.Find(app, record.Id)
+}
+
+// MarkNotificationRead marks the notification of the user as read at now,
+// unless it already is.
+func MarkNotificationRead(app core.App, userId string, id string, now time.Time) (*Notification, error) {
+	read, err := types.ParseDateTime(now)
+	if err != nil {
+		return nil, err
+	}
+	_, err = Notifications.exec(app, func(db dbx.Builder) *dbx.Query {
+		return db.Update(Notifications.Table, dbx.Params{"read": read.String()}, dbx.HashExp{"id": id, "user": userId, "read": ""})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Notifications.FindOne(app, dbx.HashExp{"id": id, "user": userId})
+}
+
+// MarkAllNotificationsRead marks every unread notification of the user as
+// read at now and returns how many there were.
+func MarkAllNotificationsRead(app core.App, userId string, now time.Time) (int64, error) {
+	read, err := types.ParseDateTime(now)
+	if err != nil {
+		return 0, err
+	}
+	return Notifications.exec(app, func(db dbx.Builder) *dbx.Query {
+		return db.Update(Notifications.Table, dbx.Params{"read": read.String()}, dbx.HashExp{"user": userId, "read": ""})
+	})
+}
+
+// undigested selects the unread notifications no digest included yet.
+func undigested(before string) dbx.Expression {
+	return dbx.And(
+		dbx.HashExp{"read": "", "digested": ""},
+		dbx.NewExp("[[created]] < {:before}", dbx.Params{"before": before}),
+	)
+}
+
+// QueueNotificationDigests is the TaskNotificationDigest task, queueing a
+// digest email for every user with undigested notifications.
+func QueueNotificationDigests(app core.App, now time.Time, _ time.Duration) error {
+	before, err := types.ParseDateTime(now)
+	if err != nil {
+		return err
+	}
+	userIds := []string{}
+	err = app.DB().
+		Select("user").
+		Distinct(true).
+		From(Notifications.Table).
+		Where(undigested(before.String())).
+		Column(&userIds)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, userId := range userIds {
+		if _, err := EnqueueJob(app, JobNotificationDigest, NotificationDigestJob{UserId: userId, Before: before.String()}, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RunNotificationDigestJob mails the user its undigested notifications,
+// marked as digested once sent so that the next digests skip them.
+func RunNotificationDigestJob(ctx context.Context, app core.App, job *Job) error {
+	p := NotificationDigestJob{}
+	if err := DecodeJobPayload(job, &p); err != nil {
+		return err
+	}
+	user, err := Users.AcrossTenants().Find(app, p.UserId)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	where := dbx.And(dbx.HashExp{"user": p.UserId}, undigested(p.Before))
+	total, err := Notifications.Count(app, where)
+	if err != nil || total == 0 {
+		return err
+	}
+	notifications, err := Notifications.FindAll(app, ListOptions{
+		Filter:  where,
+		Sort:    []SortField{{Field: "created", Desc: true}},
+		Page:    1,
+		PerPage: NotificationDigestMax,
+	})
+	if err != nil {
+		return err
+	}
+
+	type digestItem struct {
+		Type, Message, Created string
+	}
+	items := make([]digestItem, len(notifications))
+	for i, notification := range notifications {
+		payload := struct {
+			Message string `json:"message"`
+		}{}
+		_ = json.Unmarshal(notification.Payload, &payload)
+		items[i] = digestItem{Type: notification.Type, Message: payload.Message, Created: notification.Created}
+	}
+	body := bytes.Buffer{}
+	err = notificationDigestTemplate.Execute(&body, map[string]any{
+		"Name":  user.Name,
+		"Total": total,
+		"Items": items,
+		"More":  total - len(items),
+	})
+	if err != nil {
+		return err
+	}
+	meta := app.Settings().Meta
+	err = SendMail(app, &mailer.Message{
+		From:    mail.Address{Name: meta.SenderName, Address: meta.SenderAddress},
+		To:      []mail.Address{{Address: user.Email}},
+		Subject: "Your unread notifications",
+		HTML:    body.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	digested, err := types.ParseDateTime(time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = Notifications.exec(app, func(db dbx.Builder) *dbx.Query {
+		return db.Update(Notifications.Table, dbx.Params{"digested": digested.String()}, where)
+	})
+	return err
+}
+
+func HandleListNotifications(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		opts, err := ParseListOptions(e.Request.URL.Query(), []string{"created"}, cfg)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if len(opts.Sort) == 0 {
+			opts.Sort = []SortField{{Field: "created", Desc: true}}
+		}
+		filter := dbx.HashExp{"user": userId}
+		if e.Request.URL.Query().Get("unread") == "true" {
+			filter["read"] = ""
+		}
+		opts.Filter = filter
+
+		if _, err := GetUserById(app, userId); err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+		total, err := Notifications.Count(app, opts.Filter)
+		if err != nil {
+			return WriteError(e, err, "error counting notifications")
+		}
+		notifications, err := Notifications.FindAll(app, opts)
+		if err != nil {
+			return WriteError(e, err, "error getting notifications")
+		}
+		return WriteOK(e, "", NewListPage(notifications, opts, total))
+	}
+}
+
+func HandleMarkNotificationRead(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		notification, err := MarkNotificationRead(WithTrace(app, e), e.Request.PathValue("userId"), e.Request.PathValue("notificationId"), time.Now())
+		if errors.Is(err, ErrNotFound) {
+			return WriteNotFound(e, "notification not found", nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error marking notification read")
+		}
+		return WriteOK(e, "", notification)
+	}
+}
+
+func HandleMarkAllNotificationsRead(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		affected, err := MarkAllNotificationsRead(WithTrace(app, e), e.Request.PathValue("userId"), time.Now())
+		if err != nil {
+			return WriteError(e, err, "error marking notifications read")
+		}
+		return WriteOK(e, "", map[string]int64{"marked": affected})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/auth"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// OAuth2StateTTL is how long the user has to go through the provider's
+// consent page.
+const OAuth2StateTTL = 10 * time.Minute
+
+// oauth2StateCookie holds the nonce of the state, so that the callback only
+// completes logins started by the same browser.
+const oauth2StateCookie = "oauth2_state"
+
+var (
+	ErrOAuth2ProviderNotFound = errors.New("oauth2 provider is not enabled")
+	ErrOAuth2StateInvalid     = errors.New("invalid or expired oauth2 state")
+	ErrOAuth2NoEmail          = errors.New("oauth2 provider didn't share an email")
+)
+
+// NewOAuth2Provider initializes the provider from the OAuth2 settings of the
+// users collection, the same ones the built-in auth endpoints use.
+func NewOAuth2Provider(app core.App, name string) (auth.Provider, error) {
+	collection, err := app.FindCachedCollectionByNameOrId(Users.Table)
+	if err != nil {
+		return nil, err
+	}
+	if !collection.OAuth2.Enabled {
+		return nil, ErrOAuth2ProviderNotFound
+	}
+	config, ok := collection.OAuth2.GetProviderConfig(name)
+	if !ok {
+		return nil, ErrOAuth2ProviderNotFound
+	}
+	provider, err := config.InitProvider()
+	if err != nil {
+		return nil, err
+	}
+	provider.SetRedirectURL(strings.TrimRight(app.Settings().Meta.AppURL, "/") + "/auth/oauth2/" + name + "/callback")
+	return provider, nil
+}
+
+// AuthWithOAuth2 returns the users record linked to the external identity,
+// linking it first to the user with the same email, or to a new verified
+// user when there is none and signUp is set, whose event is queued along
+// with it. created reports whether the user is new.
+func AuthWithOAuth2(app core.App, providerName string, authUser *auth.AuthUser, signUp bool) (record *core.Record, created bool, err error) {
+	collection, err := app.FindCachedCollectionByNameOrId(Users.Table)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = WithTx(app, func(txApp core.App) error {
+		record, created = nil, false
+		externalAuth, err := txApp.FindFirstExternalAuthByExpr(dbx.HashExp{
+			"collectionRef": collection.Id,
+			"provider":      providerName,
+			"providerId":    authUser.Id,
+		})
+		if err == nil {
+			record, err = txApp.FindRecordById(collection, externalAuth.RecordRef())
+			if err == nil && !InRecordTenant(txApp, record) {
+				return ErrTenantMismatch
+			}
+			return err
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if authUser.Email == "" {
+			return ErrOAuth2NoEmail
+		}
+		record, err = txApp.FindAuthRecordByEmail(collection, authUser.Email)
+		if errors.Is(err, sql.ErrNoRows) && !signUp {
+			return ErrInviteOnly
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			record = core.NewRecord(collection)
+			record.SetEmail(authUser.Email)
+			record.SetVerified(true)
+			record.Set("name", authUser.Name)
+			// the user can still set a password of their own later on
+			record.SetPassword(security.RandomString(30))
+			SetRecordTenant(txApp, record)
+			if err := txApp.Save(record); err != nil {
+				return err
+			}
+			user, err := GetUserById(txApp, record.Id)
+			if err != nil {
+				return err
+			}
+			if err := QueueUserEvent(txApp, EventUserCreated, user); err != nil {
+				return err
+			}
+			created = true
+		} else if err != nil {
+			return err
+		} else if !InRecordTenant(txApp, record) {
+			return ErrTenantMismatch
+		}
+
+		externalAuth = core.NewExternalAuth(txApp)
+		externalAuth.SetCollectionRef(collection.Id)
+		externalAuth.SetRecordRef(record.Id)
+		externalAuth.SetProvider(providerName)
+		externalAuth.SetProviderId(authUser.Id)
+		return txApp.Save(externalAuth)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return record, created, nil
+}
+
+// HandleOAuth2Redirect sends the browser to the consent page of the
+// provider, which then redirects back to HandleOAuth2Callback.
+func HandleOAuth2Redirect(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		name := e.Request.PathValue("provider")
+		provider, err := NewOAuth2Provider(app, name)
+		if errors.Is(err, ErrOAuth2ProviderNotFound) {
+			return WriteNotFound(e, err.Error(), nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error initializing oauth2 provider: "+err.Error(), nil)
+		}
+
+		nonce := security.RandomString(32)
+		state := signUserToken([]byte(cfg.OAuth2StateSecret), "oauth2-state", name, nonce, time.Now().Add(OAuth2StateTTL))
+		http.SetCookie(e.Response, &http.Cookie{
+			Name:     oauth2StateCookie,
+			Value:    nonce,
+			Path:     "/auth/oauth2/",
+			MaxAge:   int(OAuth2StateTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   e.Request.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return e.Redirect(http.StatusTemporaryRedirect, provider.BuildAuthURL(state))
+	}
+}
+
+// HandleOAuth2Callback completes the login started by HandleOAuth2Redirect
+// and responds with an auth token (or a 2FA challenge) like POST /auth/login.
+func HandleOAuth2Callback(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		name := e.Request.PathValue("provider")
+		query := e.Request.URL.Query()
+		if providerErr := query.Get("error"); providerErr != "" {
+			return WriteUnauthorized(e, "oauth2 login failed: "+providerErr, nil)
+		}
+
+		cookie, err := e.Request.Cookie(oauth2StateCookie)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+ErrOAuth2StateInvalid.Error(), nil)
+		}
+		http.SetCookie(e.Response, &http.Cookie{Name: oauth2StateCookie, Path: "/auth/oauth2/", MaxAge: -1})
+		stateProvider, nonce, err := verifyUserToken([]byte(cfg.OAuth2StateSecret), "oauth2-state", query.Get("state"), time.Now())
+		if err != nil || stateProvider != name || nonce != cookie.Value {
+			return WriteBadRequest(e, "bad request: "+ErrOAuth2StateInvalid.Error(), nil)
+		}
+
+		provider, err := NewOAuth2Provider(app, name)
+		if errors.Is(err, ErrOAuth2ProviderNotFound) {
+			return WriteNotFound(e, err.Error(), nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error initializing oauth2 provider: "+err.Error(), nil)
+		}
+		provider.SetContext(e.Request.Context())
+		token, err := provider.FetchToken(query.Get("code"))
+		if err != nil {
+			return WriteUnauthorized(e, "oauth2 login failed: "+err.Error(), nil)
+		}
+		authUser, err := provider.FetchAuthUser(token)
+		if err != nil {
+			return WriteUnauthorized(e, "oauth2 login failed: "+err.Error(), nil)
+		}
+
+		record, created, err := AuthWithOAuth2(app, name, authUser, !cfg.InviteOnly)
+		if errors.Is(err, ErrOAuth2NoEmail) {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if errors.Is(err, ErrTenantMismatch) || errors.Is(err, ErrInviteOnly) {
+			return WriteForbidden(e, err.Error(), nil)
+		}
+		var validationErrs validation.Errors
+		if errors.As(err, &validationErrs) {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid user", validationErrs)
+		}
+		if err != nil {
+			return WriteError(e, err, "error logging in")
+		}
+		if record.GetString(Users.SoftDeleteColumn) != "" {
+			return WriteUnauthorized(e, "user is deleted", nil)
+		}
+		SetAuditedUser(e, record.Id)
+		return writeAuthResponse(app, cfg, e, record)
+	}
+}
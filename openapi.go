@@ -0,0 +1,782 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const OpenAPIVersion = "3.1.0"
+
+const APIVersion = "1.0.0"
+
+// Route access levels, matching the auth middlewares the routes are bound to.
+const (
+	AccessPublic    = ""
+	AccessAuth      = "auth"
+	AccessOwner     = "owner"
+	AccessAdmin     = "admin"
+	AccessSuperuser = "superuser"
+)
+
+type APIParam struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+// APIOperation documents a custom route. Body and Response are zero values
+// of the request and response types, whose schemas are derived from their
+// json tags. A nil Response means the APIResp envelope carries no data.
+type APIOperation struct {
+	Method  string
+	Path    string
+	Tag     string
+	Summary string
+	Access  string
+	Query   []APIParam
+	Headers []APIParam
+	Body    any
+	// BodyTypes are the accepted request content types, application/json
+	// when empty.
+	BodyTypes []string
+	Response  any
+	// ResponseTypes are set for the routes that don't answer with the
+	// APIResp envelope, e.g. file downloads.
+	ResponseTypes []string
+}
+
+var listParams = []APIParam{
+	{Name: "page", Type: "integer", Description: "Page number, starting at 1."},
+	{Name: "perPage", Type: "integer", Description: "Page size, capped by MAX_PER_PAGE."},
+	{Name: "sort", Type: "string", Description: "Comma separated fields, prefixed with - for descending order."},
+}
+
+var twoFactorSessionParam = APIParam{Name: TwoFactorSessionHeader, Type: "string", Description: "twoFactorSession of POST /auth/2fa, required from the users with 2FA enabled."}
+
+var ifUnmodifiedSinceParam = APIParam{Name: "If-Unmodified-Since", Type: "string", Description: "HTTP date, e.g. the Last-Modified of GET /users/{userId}, the write fails with 412 if the user was updated after it. Ignored along with If-Match."}
+
+var deployTokenParam = APIParam{Name: DeployTokenHeader, Type: "string", Description: "STATIC_DEPLOY_TOKEN."}
+
+var deviceNameParam = APIParam{Name: DeviceNameHeader, Type: "string", Description: "Name of the device the session is listed with in GET /users/{userId}/sessions, guessed from the User-Agent when empty."}
+
+var fieldsParam = APIParam{Name: "fields", Type: "string", Description: "Comma separated user fields to return, every field when empty."}
+
+// APIOperations lists every custom route in the order they are documented.
+var APIOperations = []APIOperation{
+	{Method: http.MethodGet, Path: "/healthz", Tag: "health", Summary: "Report that the process is up", Response: map[string]string{}},
+	{Method: http.MethodGet, Path: "/readyz", Tag: "health", Summary: "Report the status of every dependency", Response: Readiness{}},
+	{Method: http.MethodGet, Path: "/flags", Tag: "flags", Summary: "Get the feature flags evaluated for the requester, anonymous or not",
+		Response: map[string]bool{}},
+	{Method: http.MethodGet, Path: "/api/openapi.json", Tag: "docs", Summary: "Get this OpenAPI spec",
+		ResponseTypes: []string{"application/json"}},
+	{Method: http.MethodGet, Path: "/api/docs", Tag: "docs", Summary: "Browse the OpenAPI spec with Swagger UI",
+		ResponseTypes: []string{"text/html"}},
+
+	{Method: http.MethodPost, Path: "/auth/register", Tag: "auth", Summary: "Sign up with a password and get an auth token, unless INVITE_ONLY is set",
+		Headers: []APIParam{deviceNameParam, {Name: CaptchaResponseHeader, Type: "string", Description: "CAPTCHA response, required with SIGNUP_CAPTCHA."}},
+		Body:    models.UserCreationRequest{}, Response: models.AuthResponse{}},
+	{Method: http.MethodGet, Path: "/auth/register/form", Tag: "auth", Summary: "Get the token the signup form sends in formToken, required with SIGNUP_MIN_SUBMIT_TIME, and its honeypot fields",
+		Response: SignupFormToken{}},
+	{Method: http.MethodPost, Path: "/auth/login", Tag: "auth", Summary: "Log in with a password and get an auth token",
+		Headers: []APIParam{deviceNameParam}, Body: models.LoginRequest{}, Response: models.AuthResponse{}},
+	{Method: http.MethodPost, Path: "/auth/refresh", Tag: "auth", Summary: "Exchange a users auth token for a fresh one", Access: AccessAuth,
+		Response: models.AuthResponse{}},
+	{Method: http.MethodPost, Path: "/auth/2fa", Tag: "auth", Summary: "Complete a login of a user with 2FA enabled with a TOTP or backup code",
+		Body: TwoFactorVerifyRequest{}, Response: models.AuthResponse{}},
+	{Method: http.MethodGet, Path: "/auth/oauth2/{provider}", Tag: "auth", Summary: "Redirect to the consent page of an OAuth2 provider enabled on the users collection",
+		ResponseTypes: []string{"text/html"}},
+	{Method: http.MethodGet, Path: "/auth/oauth2/{provider}/callback", Tag: "auth", Summary: "Complete an OAuth2 login, creating or linking the user",
+		Query: []APIParam{
+			{Name: "code", Type: "string", Description: "Authorization code sent by the provider."},
+			{Name: "state", Type: "string", Description: "State sent by the provider, checked against the oauth2_state cookie."},
+		},
+		Response: models.AuthResponse{}},
+
+	{Method: http.MethodGet, Path: "/users", Tag: "users", Summary: "List users", Access: AccessAuth,
+		Query: slices.Concat(listParams, []APIParam{
+			{Name: "filter", Type: "string", Description: FilterDescription(UserFilterFields)},
+			{Name: "ids", Type: "string", Description: "Comma separated ids to look up instead of listing."},
+			{Name: "cursor", Type: "string", Description: "Switches to cursor mode, starting after the nextCursor of a previous page."},
+			{Name: "limit", Type: "integer", Description: "Page size in cursor mode, capped by MAX_PER_PAGE."},
+			{Name: "stream", Type: "string", Description: "json or ndjson to stream every matching user, unpaged and without the envelope, as they are read. Accept: application/x-ndjson does too."},
+			fieldsParam,
+		}),
+		Response: models.ListPage[models.User]{}},
+	{Method: http.MethodPost, Path: "/users", Tag: "users", Summary: "Create a user", Access: AccessSuperuser,
+		Query:   []APIParam{{Name: "dryRun", Type: "boolean", Description: "Run the checks of the creation without writing it, and return the user as it would be under user. The Idempotency-Key is left unclaimed."}},
+		Headers: []APIParam{{Name: IdempotencyKeyHeader, Type: "string", Description: "Replays the first response for retries with the same key."}},
+		Body:    models.UserCreationRequest{}, Response: models.User{}},
+	{Method: http.MethodDelete, Path: "/users", Tag: "users", Summary: "Delete the users matching a filter, previewed first with ?dryRun=true", Access: AccessSuperuser,
+		Query: []APIParam{
+			{Name: "filter", Type: "string", Description: "Filter of the users to delete, with the syntax of GET /users. Required."},
+			{Name: "dryRun", Type: "boolean", Description: "Only list the users that would be deleted, along with the token confirming their deletion."},
+			{Name: "token", Type: "string", Description: "Token of the dry run, required to delete. The deletion fails with 409 if other users match the filter since."},
+			{Name: "hard", Type: "boolean", Description: "Permanently delete instead of soft deleting, to pass to the dry run too."},
+		},
+		Response: BulkDeleteResult{}},
+	{Method: http.MethodPut, Path: "/users", Tag: "users", Summary: "Create the user with the email, or replace its fields, 201 when created", Access: AccessSuperuser,
+		Body: models.UserUpsertRequest{}, Response: models.User{}},
+	{Method: http.MethodGet, Path: "/users/export", Tag: "users", Summary: "Export every user", Access: AccessSuperuser,
+		Query: []APIParam{
+			{Name: "format", Type: "string", Description: "csv, json or ndjson."},
+			{Name: "store", Type: "boolean", Description: "Store the export and respond with a download link instead."},
+		},
+		ResponseTypes: []string{"text/csv", "application/json", "application/x-ndjson"}},
+	{Method: http.MethodPost, Path: "/users/import", Tag: "users", Summary: "Import users from CSV or JSON", Access: AccessSuperuser,
+		Body: []models.UserCreationRequest{}, BodyTypes: []string{"application/json", "text/csv"}, Response: ImportReport{}},
+	{Method: http.MethodPost, Path: "/users/batch", Tag: "users", Summary: "Create, update and delete users in one request", Access: AccessSuperuser,
+		Body: BatchRequest{}, Response: BatchResponse{}},
+	{Method: http.MethodGet, Path: "/users/events", Tag: "users", Summary: "Stream the user events as Server-Sent Events", Access: AccessAuth,
+		ResponseTypes: []string{"text/event-stream"}},
+	{Method: http.MethodGet, Path: "/ws", Tag: "users", Summary: "Upgrade to a websocket broadcasting the presence, statuses and typing of the users", Access: AccessAuth,
+		Query:         []APIParam{{Name: "token", Type: "string", Description: "Auth token of the user, for the clients that can't send an Authorization header."}},
+		ResponseTypes: []string{"application/json"}},
+	{Method: http.MethodGet, Path: "/users/verify", Tag: "users", Summary: "Verify the email of a user with the emailed link",
+		Query: []APIParam{{Name: "token", Type: "string", Description: "Token from the verification email."}}},
+	{Method: http.MethodGet, Path: "/users/search", Tag: "users", Summary: "Search users by name and email", Access: AccessAuth,
+		Query: []APIParam{
+			{Name: "q", Type: "string", Description: "Words matched as prefixes, all of which must match."},
+			{Name: "limit", Type: "integer", Description: "Maximum number of results, capped by MAX_PER_PAGE."},
+		},
+		Response: []SearchResult{}},
+	{Method: http.MethodGet, Path: "/users/changes", Tag: "users", Summary: "List the users created, updated and deleted since a cursor", Access: AccessAuth,
+		Query: []APIParam{
+			{Name: "since", Type: "string", Description: "Cursor of the previous sync, or a timestamp. Without it every user is returned."},
+			{Name: "limit", Type: "integer", Description: "Maximum number of changes, capped by MAX_PER_PAGE."},
+			{Name: "fields", Type: "string", Description: "Comma separated fields of the users to return."},
+		},
+		Response: UserChanges{}},
+	{Method: http.MethodGet, Path: "/users/active", Tag: "users", Summary: "List the recently seen users", Access: AccessAuth,
+		Query:    []APIParam{{Name: "since", Type: "string", Description: "Duration, defaults to 24h."}},
+		Response: []models.User{}},
+	{Method: http.MethodPost, Path: "/users/lookup", Tag: "users", Summary: "Look up users by id", Access: AccessAuth,
+		Body: []string{}, Response: map[string]*models.User{}},
+	{Method: http.MethodGet, Path: "/users/{userId}", Tag: "users", Summary: "Get a user", Access: AccessAuth,
+		Query:    []APIParam{fieldsParam, {Name: "expand", Type: "string", Description: "Comma separated relations to embed under expand: teams (the user's own only), posts, and nested paths such as teams.members, at most 3 deep."}},
+		Response: models.User{}},
+	{Method: http.MethodPatch, Path: "/users/{userId}", Tag: "users", Summary: "Update a user", Access: AccessOwner,
+		Query: []APIParam{
+			{Name: "dryRun", Type: "boolean", Description: "Run the checks of the update without writing it, and return the user as it would be, with the changes, under user and changed."},
+			{Name: "skipConfirmation", Type: "boolean", Description: "Change the email without confirmation, superusers only."},
+		},
+		Headers: []APIParam{
+			{Name: "If-Match", Type: "string", Description: "Updated time of the user last read, the update fails with 409 if it changed since."},
+			ifUnmodifiedSinceParam,
+		},
+		Body: models.UserUpdateRequest{}, BodyTypes: []string{"application/json", ContentTypeJSONPatch, ContentTypeMergePatch},
+		Response: UserUpdateResult{}},
+	{Method: http.MethodDelete, Path: "/users/{userId}", Tag: "users", Summary: "Delete a user", Access: AccessSuperuser,
+		Query:   []APIParam{{Name: "hard", Type: "boolean", Description: "Permanently delete instead of soft deleting."}},
+		Headers: []APIParam{ifUnmodifiedSinceParam}},
+	{Method: http.MethodPost, Path: "/users/{userId}/restore", Tag: "users", Summary: "Restore a soft deleted user", Access: AccessSuperuser,
+		Response: models.User{}},
+	{Method: http.MethodGet, Path: "/users/{userId}/avatar", Tag: "users", Summary: "Get the avatar of a user",
+		Query:         []APIParam{{Name: "size", Type: "integer", Description: "Side in pixels, from 16 to 1024, of the square the avatar is cropped and scaled to."}},
+		ResponseTypes: []string{"image/*"}},
+	{Method: http.MethodPost, Path: "/users/{userId}/avatar", Tag: "users", Summary: "Upload the avatar of a user", Access: AccessOwner,
+		BodyTypes: []string{"multipart/form-data"}, Response: AvatarUpload{}},
+	{Method: http.MethodGet, Path: "/users/{userId}/posts", Tag: "posts", Summary: "List the posts of a user", Access: AccessAuth,
+		Query:    slices.Concat(listParams, []APIParam{{Name: "expand", Type: "string", Description: "author to include the author of every post."}}),
+		Response: models.ListPage[Post]{}},
+	{Method: http.MethodGet, Path: "/users/{userId}/history", Tag: "users", Summary: "List the event stream of a user, oldest first, written with USER_EVENT_SOURCING", Access: AccessSuperuser,
+		Query: []APIParam{
+			{Name: "from", Type: "integer", Description: "Version of the first event, 1 by default, nextVersion of the previous page."},
+			{Name: "limit", Type: "integer", Description: "Maximum number of events, capped by MAX_PER_PAGE."},
+		},
+		Response: UserHistory{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/roles", Tag: "users", Summary: "Assign a role to a user", Access: AccessAdmin,
+		Body: RoleRequest{}, Response: models.User{}},
+	{Method: http.MethodDelete, Path: "/users/{userId}/roles/{role}", Tag: "users", Summary: "Revoke a role from a user", Access: AccessAdmin,
+		Response: models.User{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/set-password", Tag: "users", Summary: "Set the password of a user created without one", Access: AccessOwner,
+		Headers: []APIParam{twoFactorSessionParam}, Body: SetPasswordRequest{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/2fa", Tag: "users", Summary: "Enroll a TOTP secret, enabled once confirmed", Access: AccessOwner,
+		Response: TOTPEnrollment{}},
+	{Method: http.MethodDelete, Path: "/users/{userId}/2fa", Tag: "users", Summary: "Disable 2FA and drop the backup codes", Access: AccessOwner,
+		Headers: []APIParam{twoFactorSessionParam}},
+	{Method: http.MethodPost, Path: "/users/{userId}/2fa/confirm", Tag: "users", Summary: "Enable the enrolled TOTP secret with a code of it, returning the backup codes", Access: AccessOwner,
+		Body: TwoFactorCodeRequest{}, Response: BackupCodes{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/2fa/backup-codes", Tag: "users", Summary: "Replace the backup codes", Access: AccessOwner,
+		Headers: []APIParam{twoFactorSessionParam}, Response: BackupCodes{}},
+	{Method: http.MethodGet, Path: "/users/{userId}/sessions", Tag: "users", Summary: "List the devices the user is logged in on, the most recently active first", Access: AccessOwner,
+		Response: []Session{}},
+	{Method: http.MethodDelete, Path: "/users/{userId}/sessions/{sessionId}", Tag: "users", Summary: "Log a device of the user out, refusing the tokens of its session", Access: AccessOwner,
+		Response: Session{}},
+	{Method: http.MethodGet, Path: "/users/{userId}/preferences", Tag: "users", Summary: "Get the preferences of the user, with the defaults of the unset ones and the schema of the known keys", Access: AccessOwner,
+		Response: PreferencesResponse{}},
+	{Method: http.MethodPut, Path: "/users/{userId}/preferences", Tag: "users", Summary: "Replace the preferences of the user, the keys left out or null taking their defaults", Access: AccessOwner,
+		Body: PreferencesRequest{}, Response: PreferencesResponse{}},
+	{Method: http.MethodGet, Path: "/users/{userId}/activity", Tag: "users", Summary: "List the recent requests of a user, newest first by default", Access: AccessOwner,
+		Query: listParams, Response: models.ListPage[Activity]{}},
+	{Method: http.MethodGet, Path: "/users/{userId}/notifications", Tag: "users", Summary: "List the notifications of a user, newest first by default", Access: AccessOwner,
+		Query:    append([]APIParam{{Name: "unread", Type: "boolean", Description: "Only list the unread notifications when true."}}, listParams...),
+		Response: models.ListPage[Notification]{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/notifications/read", Tag: "users", Summary: "Mark every notification of a user as read", Access: AccessOwner,
+		Response: map[string]int64{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/notifications/{notificationId}/read", Tag: "users", Summary: "Mark a notification as read", Access: AccessOwner,
+		Response: Notification{}},
+	{Method: http.MethodGet, Path: "/users/{userId}/usage", Tag: "users", Summary: "Get the requests of a user in a month, by day, and its quota", Access: AccessOwner,
+		Query:    []APIParam{{Name: "month", Type: "string", Description: "Month as YYYY-MM (UTC), the current one when empty."}},
+		Response: UsageReport{}},
+	{Method: http.MethodDelete, Path: "/users/{userId}/personal-data", Tag: "users", Summary: "Erase the personal data of a user, returning the erasure receipt", Access: AccessOwner,
+		Response: ErasureReceipt{}},
+	{Method: http.MethodGet, Path: "/users/{userId}/takeout", Tag: "users", Summary: "Queue a zip of the data of a user, whose download link is emailed to it", Access: AccessOwner,
+		Response: Job{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/request-verification", Tag: "users", Summary: "Send another verification email", Access: AccessOwner},
+	{Method: http.MethodPost, Path: "/users/{userId}/email-change", Tag: "users", Summary: "Email a confirmation link to a new email, and a notice to the current one", Access: AccessOwner,
+		Body: EmailChangeRequest{}},
+	{Method: http.MethodGet, Path: "/users/email-change/confirm", Tag: "users", Summary: "Apply an email change from its emailed link",
+		Query:    []APIParam{{Name: "token", Type: "string", Description: "Token from the confirmation link."}},
+		Response: models.User{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/confirm-email-change", Tag: "users", Summary: "Confirm a pending email change",
+		Body: ConfirmEmailChangeRequest{}, Response: models.User{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/increment", Tag: "users", Summary: "Atomically add a delta to a counter field of the user, 409 out of its bounds", Access: AccessSuperuser,
+		Body: IncrementRequest{}, Response: IncrementResult{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/share-link", Tag: "users", Summary: "Create a link to the public profile of a user", Access: AccessOwner,
+		Query:    []APIParam{{Name: "ttl", Type: "string", Description: "Lifetime of the link, capped by SHARE_LINK_MAX_TTL."}},
+		Response: ShareLink{}},
+	{Method: http.MethodPost, Path: "/users/{userId}/share", Tag: "users", Summary: "Create a link to the public profile of a user, same as /share-link", Access: AccessOwner,
+		Query:    []APIParam{{Name: "ttl", Type: "string", Description: "Lifetime of the link, capped by SHARE_LINK_MAX_TTL."}},
+		Response: ShareLink{}},
+	{Method: http.MethodPost, Path: "/users/{targetId}/merge", Tag: "users", Summary: "Merge a user into another one", Access: AccessSuperuser,
+		Body: MergeRequest{}, Response: MergeResult{}},
+	{Method: http.MethodPost, Path: "/teams", Tag: "teams", Summary: "Create a team owned by the requester", Access: AccessAuth,
+		Body: CreateTeamRequest{}, Response: Team{}},
+	{Method: http.MethodPost, Path: "/teams/invitations/accept", Tag: "teams", Summary: "Join a team with an invitation token sent to the email of the requester", Access: AccessAuth,
+		Body: AcceptTeamInviteRequest{}, Response: TeamMembership{}},
+	{Method: http.MethodGet, Path: "/teams/{teamId}/members", Tag: "teams", Summary: "List the members of a team, to its members", Access: AccessAuth,
+		Response: []TeamMember{}},
+	{Method: http.MethodPut, Path: "/teams/{teamId}/members/{userId}", Tag: "teams", Summary: "Change the role of a member, owners only granting and revoking the owner role", Access: AccessAuth,
+		Body: TeamRoleRequest{}, Response: TeamMembership{}},
+	{Method: http.MethodPost, Path: "/teams/{teamId}/invitations", Tag: "teams", Summary: "Email an invitation to join a team, to its admins", Access: AccessAuth,
+		Body: TeamInviteRequest{}, Response: TeamInvitation{}},
+	{Method: http.MethodGet, Path: "/invitations/{token}", Tag: "invitations", Summary: "Get the prefilled sign up data of an invitation",
+		Response: InvitationView{}},
+	{Method: http.MethodPost, Path: "/invitations/{token}/accept", Tag: "invitations", Summary: "Sign up with an invitation, consuming it, and get an auth token",
+		Body: AcceptInvitationRequest{}, Response: models.AuthResponse{}},
+	{Method: http.MethodPost, Path: "/billing/checkout", Tag: "billing", Summary: "Create the Stripe checkout session the requester subscribes through", Access: AccessAuth,
+		Body: CheckoutRequest{}, Response: CheckoutSession{}},
+	{Method: http.MethodGet, Path: "/billing/subscription", Tag: "billing", Summary: "Get the subscription of the requester", Access: AccessAuth,
+		Response: Subscription{}},
+	{Method: http.MethodGet, Path: "/scim/v2/Users", Tag: "scim", Summary: "List the users in the SCIM format, with SCIM_TOKEN as bearer token",
+		Query: []APIParam{
+			{Name: "filter", Type: "string", Description: "SCIM comparisons joined with and, e.g. userName eq \"jane@example.com\", of id, externalId, userName, emails.value, displayName, name.formatted, active, meta.created and meta.lastModified."},
+			{Name: "startIndex", Type: "integer", Description: "1-based index of the first user."},
+			{Name: "count", Type: "integer", Description: "Page size, capped by MAX_PER_PAGE."},
+		},
+		ResponseTypes: []string{SCIMContentType}},
+	{Method: http.MethodPost, Path: "/scim/v2/Users", Tag: "scim", Summary: "Provision a user, verified, with SCIM_TOKEN as bearer token",
+		Body: SCIMUser{}, BodyTypes: []string{SCIMContentType, "application/json"}, ResponseTypes: []string{SCIMContentType}},
+	{Method: http.MethodGet, Path: "/scim/v2/Users/{userId}", Tag: "scim", Summary: "Get a user in the SCIM format, with SCIM_TOKEN as bearer token",
+		ResponseTypes: []string{SCIMContentType}},
+	{Method: http.MethodPatch, Path: "/scim/v2/Users/{userId}", Tag: "scim", Summary: "Update or deactivate a user with SCIM patch operations, with SCIM_TOKEN as bearer token",
+		Body: SCIMPatchRequest{}, BodyTypes: []string{SCIMContentType, "application/json"}, ResponseTypes: []string{SCIMContentType}},
+	{Method: http.MethodDelete, Path: "/scim/v2/Users/{userId}", Tag: "scim", Summary: "Deprovision a user, soft deleting it, with SCIM_TOKEN as bearer token"},
+	{Method: http.MethodPost, Path: "/hooks/{provider}", Tag: "hooks", Summary: "Receive a signed webhook delivery of a third party, e.g. stripe or github",
+		Headers: []APIParam{
+			{Name: "Stripe-Signature", Type: "string", Description: "t=<unix time>,v1=<hex hmac-sha256 of t.body> signature of the stripe deliveries."},
+			{Name: "X-Hub-Signature-256", Type: "string", Description: "sha256=<hex hmac-sha256 of the body> signature of the github deliveries."},
+		},
+		BodyTypes: []string{"application/json"}},
+	{Method: http.MethodGet, Path: "/downloads/{token}", Tag: "users", Summary: "Download a stored file through a signed link",
+		ResponseTypes: []string{"application/octet-stream"}},
+	{Method: http.MethodGet, Path: "/p/{userId}", Tag: "users", Summary: "Render the public profile of a user as an HTML page",
+		ResponseTypes: []string{"text/html"}},
+	{Method: http.MethodGet, Path: "/sitemap.xml", Tag: "users", Summary: "Get the sitemap of the profile pages of the verified users, an index of /sitemaps/{file} past SITEMAP_CHUNK_SIZE of them",
+		ResponseTypes: []string{"application/xml"}},
+	{Method: http.MethodGet, Path: "/sitemaps/{file}", Tag: "users", Summary: "Get a file of a sitemap split in several, e.g. 1.xml",
+		ResponseTypes: []string{"application/xml"}},
+	{Method: http.MethodGet, Path: "/robots.txt", Tag: "docs", Summary: "Get the robots.txt, ROBOTS_TXT or generated from ROBOTS_DISALLOW",
+		ResponseTypes: []string{"text/plain"}},
+	{Method: http.MethodGet, Path: "/shared/users/{token}", Tag: "users", Summary: "Get a shared public profile",
+		Response: PublicUser{}},
+	{Method: http.MethodGet, Path: "/shared/{token}", Tag: "users", Summary: "Get a shared public profile, same as /shared/users/{token}",
+		Response: PublicUser{}},
+
+	{Method: http.MethodGet, Path: "/graphql", Tag: "graphql", Summary: "Run a GraphQL query over the users", Access: AccessAuth,
+		Query: []APIParam{
+			{Name: "query", Type: "string", Description: "GraphQL document, mutations must be sent with POST."},
+			{Name: "operationName", Type: "string", Description: "Operation to run when the document has several."},
+			{Name: "variables", Type: "string", Description: "JSON object of the operation variables."},
+		},
+		ResponseTypes: []string{"application/json"}},
+	{Method: http.MethodPost, Path: "/graphql", Tag: "graphql", Summary: "Run a GraphQL query or mutation over the users", Access: AccessAuth,
+		Body: GraphQLRequest{}, ResponseTypes: []string{"application/json"}},
+	{Method: http.MethodGet, Path: "/graphql/schema", Tag: "graphql", Summary: "Get the GraphQL schema in SDL",
+		ResponseTypes: []string{"text/plain"}},
+
+	{Method: http.MethodGet, Path: "/metrics", Tag: "admin", Summary: "Get the Prometheus metrics, with METRICS_TOKEN as bearer token when set", Access: AccessSuperuser,
+		ResponseTypes: []string{"text/plain"}},
+	{Method: http.MethodGet, Path: "/admin/users-backup", Tag: "admin", Summary: "Download a backup of the users", Access: AccessSuperuser,
+		ResponseTypes: []string{"application/json"}},
+	{Method: http.MethodPost, Path: "/admin/users-restore", Tag: "admin", Summary: "Restore a backup of the users", Access: AccessSuperuser,
+		Query: []APIParam{{Name: "mode", Type: "string", Description: "merge (default) or replace."}},
+		Body:  UsersBackup{}, Response: RestoreResult{}},
+	{Method: http.MethodPost, Path: "/admin/backup", Tag: "admin", Summary: "Back up the database and the local storage", Access: AccessSuperuser,
+		Query:    []APIParam{{Name: "name", Type: "string", Description: "Name of the backup, e.g. nightly.zip, generated from the time when empty."}},
+		Response: BackupInfo{}},
+	{Method: http.MethodGet, Path: "/admin/backups", Tag: "admin", Summary: "List the backups, newest first", Access: AccessSuperuser,
+		Response: []BackupInfo{}},
+	{Method: http.MethodPost, Path: "/admin/restore/{name}", Tag: "admin", Summary: "Restore a backup, restarting the app", Access: AccessSuperuser},
+	{Method: http.MethodGet, Path: "/admin/deploy-static", Tag: "admin", Summary: "List the deployed static bundles kept for rollbacks, newest first", Access: AccessSuperuser,
+		Response: []StaticVersion{}},
+	{Method: http.MethodPost, Path: "/admin/deploy-static", Tag: "admin", Summary: "Serve a zip of the static files instead of PUBLIC_DIR, keeping the last STATIC_DEPLOY_KEEP bundles", Access: AccessSuperuser,
+		Headers: []APIParam{deployTokenParam}, BodyTypes: []string{"application/zip"}, Response: StaticVersion{}},
+	{Method: http.MethodPost, Path: "/admin/deploy-static/{version}/rollback", Tag: "admin", Summary: "Serve a kept static bundle again", Access: AccessSuperuser,
+		Headers: []APIParam{deployTokenParam}, Response: StaticVersion{}},
+	{Method: http.MethodGet, Path: "/admin/maintenance", Tag: "admin", Summary: "Get whether the app is in maintenance", Access: AccessSuperuser,
+		Response: MaintenanceStatus{}},
+	{Method: http.MethodPut, Path: "/admin/maintenance", Tag: "admin", Summary: "Turn the maintenance on or off, rejecting the writes with 503 while on", Access: AccessSuperuser,
+		Body: MaintenanceRequest{}, Response: MaintenanceStatus{}},
+	{Method: http.MethodGet, Path: "/admin/read-only", Tag: "admin", Summary: "Get whether the app is read-only", Access: AccessSuperuser,
+		Response: ReadOnlyStatus{}},
+	{Method: http.MethodPut, Path: "/admin/read-only", Tag: "admin", Summary: "Turn the read-only demo mode on or off, rejecting the writes with 403 while on", Access: AccessSuperuser,
+		Body: ReadOnlyRequest{}, Response: ReadOnlyStatus{}},
+	{Method: http.MethodGet, Path: "/admin/invitations", Tag: "admin", Summary: "List the invitations, newest first", Access: AccessSuperuser,
+		Response: []Invitation{}},
+	{Method: http.MethodPost, Path: "/admin/invitations", Tag: "admin", Summary: "Email a link to sign up, expiring after INVITATION_TTL", Access: AccessSuperuser,
+		Body: InvitationRequest{}, Response: Invitation{}},
+	{Method: http.MethodDelete, Path: "/admin/invitations/{invitationId}", Tag: "admin", Summary: "Revoke a pending invitation", Access: AccessSuperuser,
+		Response: Invitation{}},
+	{Method: http.MethodGet, Path: "/admin/api-keys", Tag: "admin", Summary: "List the API keys", Access: AccessSuperuser,
+		Response: []APIKey{}},
+	{Method: http.MethodPost, Path: "/admin/api-keys", Tag: "admin", Summary: "Mint an API key and its signing secret, returned only once", Access: AccessSuperuser,
+		Body: CreateAPIKeyRequest{}, Response: CreatedAPIKey{}},
+	{Method: http.MethodDelete, Path: "/admin/api-keys/{keyId}", Tag: "admin", Summary: "Revoke an API key", Access: AccessSuperuser,
+		Response: APIKey{}},
+	{Method: http.MethodGet, Path: "/admin/jobs", Tag: "admin", Summary: "List the background jobs", Access: AccessSuperuser,
+		Query: slices.Concat(listParams, []APIParam{
+			{Name: "filter", Type: "string", Description: FilterDescription(JobFilterFields)},
+		}),
+		Response: models.ListPage[Job]{}},
+	{Method: http.MethodPost, Path: "/admin/blocked-email-domains", Tag: "admin", Summary: "Block the signups of email domains, e.g. from a list of disposable email providers, skipping those already blocked", Access: AccessSuperuser,
+		Body: BlockEmailDomainsRequest{}, Response: BlockEmailDomainsResult{}},
+	{Method: http.MethodGet, Path: "/admin/users/duplicates", Tag: "admin", Summary: "List the clusters of likely duplicate users, by normalized email and similar names", Access: AccessSuperuser,
+		Query: []APIParam{
+			{Name: "threshold", Type: "number", Description: "Trigram similarity, above 0 and up to 1, from which names and email local parts match. Defaults to 0.6."},
+			{Name: "limit", Type: "integer", Description: "Maximum number of clusters, the most similar first."},
+		},
+		Response: DuplicateReport{}},
+	{Method: http.MethodPost, Path: "/admin/users/{userId}/reset-password", Tag: "admin", Summary: "Send the user the password reset email", Access: AccessSuperuser},
+	{Method: http.MethodPost, Path: "/admin/users/{userId}/lock", Tag: "admin", Summary: "Lock the user out, refusing its tokens", Access: AccessSuperuser,
+		Response: UserLockStatus{}},
+	{Method: http.MethodPost, Path: "/admin/users/{userId}/unlock", Tag: "admin", Summary: "Unlock the user", Access: AccessSuperuser,
+		Response: UserLockStatus{}},
+	{Method: http.MethodPost, Path: "/admin/users/merge", Tag: "admin", Summary: "Merge a duplicate user into the primary one, soft deleting the duplicate", Access: AccessSuperuser,
+		Body: AdminMergeRequest{}, Response: MergeResult{}},
+	{Method: http.MethodPost, Path: "/admin/impersonate/{userId}", Tag: "admin", Summary: "Issue a short lived token acting as a user, marked as impersonated in the audit logs", Access: AccessSuperuser,
+		Response: ImpersonationResponse{}},
+	{Method: http.MethodPost, Path: "/admin/jobs/{jobId}/retry", Tag: "admin", Summary: "Run a failed or canceled job again", Access: AccessSuperuser,
+		Response: Job{}},
+	{Method: http.MethodPost, Path: "/admin/jobs/{jobId}/cancel", Tag: "admin", Summary: "Cancel a pending job", Access: AccessSuperuser,
+		Response: Job{}},
+	{Method: http.MethodGet, Path: "/admin/audit", Tag: "admin", Summary: "List the audit logs of the mutations", Access: AccessSuperuser,
+		Query: slices.Concat(listParams, []APIParam{
+			{Name: "filter", Type: "string", Description: FilterDescription(AuditFilterFields)},
+			{Name: "since", Type: "string", Description: "RFC 3339 time of the oldest logs."},
+			{Name: "until", Type: "string", Description: "RFC 3339 time the logs must be older than."},
+		}),
+		Response: models.ListPage[AuditLog]{}},
+	{Method: http.MethodGet, Path: "/admin/usage", Tag: "admin", Summary: "List the requests of every user and API key in a month, the heaviest first", Access: AccessSuperuser,
+		Query: []APIParam{
+			{Name: "month", Type: "string", Description: "Month as YYYY-MM (UTC), the current one when empty."},
+			{Name: "limit", Type: "integer", Description: "Number of subjects to list, capped by MAX_PER_PAGE."},
+		},
+		Response: []UsageTotal{}},
+	{Method: http.MethodGet, Path: "/admin/stats", Tag: "admin", Summary: "Get the user stats, cached for a minute", Access: AccessSuperuser,
+		Response: UserStats{}},
+	{Method: http.MethodGet, Path: "/admin/stats/daily", Tag: "admin", Summary: "List the daily user stats aggregated by the scheduler", Access: AccessSuperuser,
+		Query: listParams, Response: models.ListPage[DailyUserStats]{}},
+	{Method: http.MethodGet, Path: "/admin/completeness", Tag: "admin", Summary: "Get the distribution of the profile completeness of the users and how many meet each criterion", Access: AccessSuperuser,
+		Response: CompletenessStats{}},
+	{Method: http.MethodGet, Path: "/admin/schema", Tag: "admin", Summary: "Check the collections against what this build expects, listing the drifts", Access: AccessSuperuser,
+		Response: SchemaReport{}},
+	{Method: http.MethodPost, Path: "/admin/alerts/test", Tag: "admin", Summary: "Post a test alert to every channel of ALERT_CHANNELS, 404 without any", Access: AccessSuperuser,
+		Response: []AlertResult{}},
+	{Method: http.MethodGet, Path: "/admin/cron", Tag: "admin", Summary: "Get the status of the scheduled tasks", Access: AccessSuperuser,
+		Response: []CronStatus{}},
+	{Method: http.MethodGet, Path: "/admin/auth-lockouts", Tag: "admin", Summary: "List the client IPs and the accounts with failed logins, the locked out ones first", Access: AccessSuperuser,
+		Response: []AuthLockout{}},
+	{Method: http.MethodDelete, Path: "/admin/auth-lockouts/{key}", Tag: "admin", Summary: "Lift the lockout of a client IP or an account, e.g. account:alice@example.com", Access: AccessSuperuser},
+	{Method: http.MethodGet, Path: "/admin/moderation", Tag: "admin", Summary: "List the user-supplied values flagged by the moderation for review", Access: AccessSuperuser,
+		Query: slices.Concat(listParams, []APIParam{
+			{Name: "filter", Type: "string", Description: FilterDescription(ModerationFilterFields)},
+		}),
+		Response: models.ListPage[ModerationItem]{}},
+	{Method: http.MethodPost, Path: "/admin/moderation/{itemId}/approve", Tag: "admin", Summary: "Approve a flagged value, leaving it as is", Access: AccessSuperuser,
+		Response: ModerationItem{}},
+	{Method: http.MethodPost, Path: "/admin/moderation/{itemId}/reject", Tag: "admin", Summary: "Reject a flagged value, blanking the field unless it changed since", Access: AccessSuperuser,
+		Response: ModerationItem{}},
+	{Method: http.MethodGet, Path: "/admin/retention/rules", Tag: "admin", Summary: "List the retention rules of retention_rules, with their scheduling errors", Access: AccessSuperuser,
+		Response: []RetentionRuleStatus{}},
+	{Method: http.MethodPost, Path: "/admin/retention/rules/{ruleId}/preview", Tag: "admin", Summary: "Dry run a retention rule, counting and sampling the rows it would delete", Access: AccessSuperuser,
+		Response: RetentionRun{}},
+	{Method: http.MethodPost, Path: "/admin/retention/rules/{ruleId}/run", Tag: "admin", Summary: "Run a retention rule now", Access: AccessSuperuser,
+		Response: RetentionRun{}},
+	{Method: http.MethodGet, Path: "/admin/retention/runs", Tag: "admin", Summary: "List the reports of the retention runs, dry runs included", Access: AccessSuperuser,
+		Query: slices.Concat(listParams, []APIParam{
+			{Name: "filter", Type: "string", Description: FilterDescription(RetentionRunFilterFields)},
+		}),
+		Response: models.ListPage[RetentionRun]{}},
+	{Method: http.MethodGet, Path: "/admin/health", Tag: "admin", Summary: "Get the readiness checks and the circuit breakers of the downstream dependencies", Access: AccessSuperuser,
+		Response: AdminHealth{}},
+	{Method: http.MethodGet, Path: "/admin/sync/status", Tag: "admin", Summary: "Get the status and the stats of the runs of the legacy user sync", Access: AccessSuperuser,
+		Response: LegacySyncStatus{}},
+	{Method: http.MethodGet, Path: "/admin/slow-queries", Tag: "admin", Summary: "List the SQL statements slower than SLOW_QUERY_THRESHOLD, normalized, the costliest first", Access: AccessSuperuser,
+		Query: []APIParam{
+			{Name: "sort", Type: "string", Description: "total (default), max, mean, count or slow, largest first."},
+			{Name: "limit", Type: "integer", Description: "Maximum number of statements, capped by MAX_PER_PAGE."},
+			{Name: "all", Type: "boolean", Description: "Include the statements that were never slow when true."},
+		},
+		Response: SlowQueryReport{}},
+	{Method: http.MethodDelete, Path: "/admin/slow-queries", Tag: "admin", Summary: "Reset the statement stats, e.g. once an index was added", Access: AccessSuperuser},
+	{Method: http.MethodGet, Path: "/admin/runtime", Tag: "admin", Summary: "Get the goroutine count, the memory stats and the uptime of the process", Access: AccessSuperuser,
+		Response: RuntimeStats{}},
+	{Method: http.MethodGet, Path: "/admin/config", Tag: "admin", Summary: "Get the config with the secrets redacted", Access: AccessSuperuser,
+		Response: []ConfigEntry{}},
+}
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+var pathWordPattern = regexp.MustCompile(`[A-Za-z0-9]+`)
+
+// typeArgPath matches the package path of the type arguments in the name of
+// an instantiated generic type, e.g. ListPage[github.com/x/models.User].
+var typeArgPath = regexp.MustCompile(`[\w.-]+(/[\w.-]+)*\.`)
+
+// schemaBuilder derives JSON schemas from Go types, collecting the named
+// struct types as components referenced with $ref.
+type schemaBuilder struct {
+	components map[string]any
+}
+
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if i := strings.Index(name, "["); i >= 0 {
+		args := typeArgPath.ReplaceAllString(name[i+1:len(name)-1], "")
+		name = name[:i] + "_" + strings.NewReplacer(",", "_", "*", "", "[]", "Array").Replace(args)
+	}
+	return name
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}), reflect.TypeOf(types.JSONRaw{}):
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Interface:
+		return map[string]any{}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := b.components[name]; !ok {
+			// registered first so that recursive types terminate
+			b.components[name] = nil
+			b.components[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	b.addFields(t, properties, &required)
+
+	obj := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	return obj
+}
+
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || !field.IsExported() && !field.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			b.addFields(field.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema := b.schema(field.Type)
+		addBindingKeywords(schema, field)
+		properties[name] = schema
+		_, hasDefault := field.Tag.Lookup("default")
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer && !hasDefault {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// addBindingKeywords documents the default and binding tags applied by
+// BindStrict.
+func addBindingKeywords(schema map[string]any, field reflect.StructField) {
+	if _, ok := schema["$ref"]; ok {
+		return
+	}
+	if def, ok := field.Tag.Lookup("default"); ok {
+		var value any = def
+		if schema["type"] != "string" {
+			_ = json.Unmarshal([]byte(def), &value)
+		}
+		schema["default"] = value
+	}
+	for _, rule := range strings.Split(field.Tag.Get("binding"), ",") {
+		key, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil || key != "min" && key != "max" {
+			continue
+		}
+		schemaType, _ := schema["type"].(string)
+		keyword := map[string]string{"string": "Length", "array": "Items", "object": "Properties"}[schemaType]
+		switch {
+		case keyword != "":
+			schema[key+keyword] = int(limit)
+		case key == "min":
+			schema["minimum"] = limit
+		default:
+			schema["maximum"] = limit
+		}
+	}
+}
+
+// envelope wraps the data schema in the APIResp envelope.
+func envelope(data map[string]any) map[string]any {
+	properties := map[string]any{
+		"success":   map[string]any{"type": "boolean"},
+		"message":   map[string]any{"type": "string"},
+		"code":      map[string]any{"type": "string", "description": "Code of a failure, one of x-error-codes or the status text, e.g. NOT_FOUND."},
+		"requestId": map[string]any{"type": "string"},
+	}
+	if data != nil {
+		properties["data"] = data
+	}
+	return map[string]any{"type": "object", "properties": properties, "required": []string{"success"}}
+}
+
+// responseContent describes the envelope in every format of
+// ResponseEncoders.
+func responseContent(schema map[string]any) map[string]any {
+	content := map[string]any{}
+	for _, contentType := range ResponseContentTypes() {
+		content[contentType] = map[string]any{"schema": schema}
+	}
+	return content
+}
+
+func errorResponse(description string) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     responseContent(map[string]any{"$ref": "#/components/schemas/ErrorResponse"}),
+	}
+}
+
+func (b *schemaBuilder) operation(op APIOperation) map[string]any {
+	params := []any{}
+	for _, m := range pathParamPattern.FindAllStringSubmatch(op.Path, -1) {
+		params = append(params, map[string]any{
+			"name": m[1], "in": "path", "required": true,
+			"schema": map[string]any{"type": "string"},
+		})
+	}
+	for _, p := range op.Query {
+		params = append(params, map[string]any{
+			"name": p.Name, "in": "query", "description": p.Description,
+			"schema": map[string]any{"type": p.Type},
+		})
+	}
+	for _, p := range op.Headers {
+		params = append(params, map[string]any{
+			"name": p.Name, "in": "header", "description": p.Description,
+			"schema": map[string]any{"type": p.Type},
+		})
+	}
+
+	responses := map[string]any{}
+	if len(op.ResponseTypes) > 0 {
+		content := map[string]any{}
+		for _, t := range op.ResponseTypes {
+			content[t] = map[string]any{}
+		}
+		responses["200"] = map[string]any{"description": "OK", "content": content}
+	} else {
+		var data map[string]any
+		if op.Response != nil {
+			data = b.schema(reflect.TypeOf(op.Response))
+		}
+		responses["200"] = map[string]any{"description": "OK", "content": responseContent(envelope(data))}
+	}
+	if op.Access != AccessPublic {
+		responses["401"] = errorResponse("Authentication required")
+	}
+	if op.Access == AccessOwner || op.Access == AccessAdmin || op.Access == AccessSuperuser {
+		responses["403"] = errorResponse("Not allowed")
+	}
+	responses["default"] = errorResponse("Error")
+
+	o := map[string]any{
+		"summary":     op.Summary,
+		"operationId": operationId(op),
+		"tags":        []string{op.Tag},
+		"parameters":  params,
+		"responses":   responses,
+	}
+	if op.Access != AccessPublic {
+		o["security"] = []any{
+			map[string]any{"authToken": []string{}},
+			map[string]any{"apiKey": []string{}},
+		}
+	}
+	if op.Body != nil || len(op.BodyTypes) > 0 {
+		bodyTypes := op.BodyTypes
+		if len(bodyTypes) == 0 {
+			bodyTypes = []string{"application/json"}
+		}
+		content := map[string]any{}
+		for _, t := range bodyTypes {
+			schema := map[string]any{}
+			if op.Body != nil && strings.HasPrefix(t, "application/json") {
+				schema = b.schema(reflect.TypeOf(op.Body))
+			}
+			if t == "multipart/form-data" {
+				schema = map[string]any{"type": "object", "properties": map[string]any{
+					"avatar": map[string]any{"type": "string", "contentMediaType": "application/octet-stream"},
+				}}
+			}
+			content[t] = map[string]any{"schema": schema}
+		}
+		o["requestBody"] = map[string]any{"required": true, "content": content}
+	}
+	return o
+}
+
+// operationId turns e.g. POST /users/{userId}/set-password into
+// postUsersUserIdSetPassword.
+func operationId(op APIOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, word := range pathWordPattern.FindAllString(op.Path, -1) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return id
+}
+
+// NewOpenAPISpec describes ops as an OpenAPI 3.1 document.
+func NewOpenAPISpec(ops []APIOperation) map[string]any {
+	b := &schemaBuilder{components: map[string]any{}}
+	b.components["ErrorResponse"] = envelope(map[string]any{})
+
+	paths := map[string]map[string]any{}
+	for _, op := range ops {
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]any{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = b.operation(op)
+	}
+
+	return map[string]any{
+		"openapi": OpenAPIVersion,
+		"info": map[string]any{
+			"title":   "pocketbase-demo custom API",
+			"version": APIVersion,
+			"description": "The responses are wrapped in the envelope described by each operation. " +
+				"?envelope=false, the X-Raw-Response: true header or an Accept media type with profile=\"raw\" " +
+				"return the bare data instead, and the failures as {\"error\": {\"code\", \"message\", \"details\", \"requestId\"}}, " +
+				"the HTTP status alone telling them apart.",
+		},
+		"paths":         paths,
+		"x-error-codes": ListErrorCodes(),
+		"components": map[string]any{
+			"schemas": b.components,
+			"securitySchemes": map[string]any{
+				"authToken": map[string]any{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Authorization",
+					"description": "Auth token of a users or _superusers record.",
+				},
+				"apiKey": map[string]any{
+					"type": "apiKey",
+					"in":   "header",
+					"name": APIKeyHeader,
+					"description": "API key, see /admin/api-keys. Its requests can be signed, and must be with requireSignature or REQUIRE_SIGNED_REQUESTS: " +
+						SignatureTimestampHeader + " is the unix time, within SIGNED_REQUEST_MAX_SKEW of the server's, " +
+						SignatureNonceHeader + " 16 to 128 random letters, digits, - or _ never sent twice, and " +
+						SignatureHeader + " the hex hmac-sha256, keyed with the signingSecret of the key, of the method, path with the query, " +
+						"timestamp, nonce and hex sha-256 of the body, joined with \\n. The failures are answered with 401 " + CodeInvalidSignature + ".",
+				},
+			},
+		},
+	}
+}
+
+func HandleOpenAPISpec() func(e *core.RequestEvent) error {
+	spec, err := json.Marshal(NewOpenAPISpec(APIOperations))
+	return func(e *core.RequestEvent) error {
+		if err != nil {
+			return WriteInternalServerError(e, "error encoding openapi spec: "+err.Error(), nil)
+		}
+		return e.Blob(http.StatusOK, "application/json", spec)
+	}
+}
+
+const swaggerUIPage = `<!doctype html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<title>pocketbase-demo API</title>
+	<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+	<script>
+		window.ui = SwaggerUIBundle({ url: "/api/openapi.json", dom_id: "#swagger-ui" });
+	</script>
+</body>
+</html>
+`
+
+func HandleAPIDocs() func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		return e.HTML(http.StatusOK, swaggerUIPage)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+)
+
+const outboxCleanupJobName = "outbox_cleanup"
+
+// The sinks the outbox publishes the user events to.
+const (
+	OutboxSinkWebhooks = "webhooks"
+	OutboxSinkStream   = "stream"
+	OutboxSinkBus      = "bus"
+)
+
+// OutboxEvent is a user event waiting in the outbox, or delivered to every
+// sink.
+type OutboxEvent struct {
+	Id            string        `db:"id" json:"id"`
+	Event         string        `db:"event" json:"event"`
+	Payload       types.JSONRaw `db:"payload" json:"payload"`
+	Status        string        `db:"status" json:"status"`
+	DeliveredTo   types.JSONRaw `db:"delivered_to" json:"deliveredTo"`
+	Attempts      int           `db:"attempts" json:"attempts"`
+	NextAttemptAt string        `db:"next_attempt_at" json:"nextAttemptAt"`
+	LastError     string        `db:"last_error" json:"lastError"`
+	Created       string        `db:"created" json:"created"`
+	Updated       string        `db:"updated" json:"updated"`
+}
+
+// outboxEntry is the row QueueUserEvent inserts.
+type outboxEntry struct {
+	Event         string        `db:"event"`
+	Payload       types.JSONRaw `db:"payload"`
+	Status        string        `db:"status"`
+	DeliveredTo   types.JSONRaw `db:"delivered_to"`
+	NextAttemptAt string        `db:"next_attempt_at"`
+}
+
+var OutboxEvents = &Repository[OutboxEvent]{
+	Table:         "outbox",
+	CreatedColumn: "created",
+	UpdatedColumn: "updated",
+}
+
+// OutboxSink publishes a user event taken out of the outbox, id being the
+// id of its outbox row. An event is handed again to the sinks that failed
+// it, until they all succeed, so a sink may see an event more than once.
+type OutboxSink func(ctx context.Context, id string, event string, user models.User) error
+
+var (
+	outboxSinksMu sync.RWMutex
+	outboxSinks   = map[string]OutboxSink{}
+)
+
+func RegisterOutboxSink(name string, sink OutboxSink) {
+	outboxSinksMu.Lock()
+	defer outboxSinksMu.Unlock()
+	outboxSinks[name] = sink
+}
+
+// sortedOutboxSinks returns the names of the sinks in a stable order.
+func sortedOutboxSinks() ([]string, map[string]OutboxSink) {
+	outboxSinksMu.RLock()
+	defer outboxSinksMu.RUnlock()
+	names := make([]string, 0, len(outboxSinks))
+	sinks := make(map[string]OutboxSink, len(outboxSinks))
+	for name, sink := range outboxSinks {
+		names = append(names, name)
+		sinks[name] = sink
+	}
+	sort.Strings(names)
+	return names, sinks
+}
+
+func init() {
+	RegisterOutboxSink(OutboxSinkWebhooks, func(_ context.Context, _ string, event string, user models.User) error {
+		return Webhooks.Dispatch(event, user)
+	})
+	RegisterOutboxSink(OutboxSinkStream, func(_ context.Context, _ string, event string, user models.User) error {
+		UserEvents.Publish(event, user)
+		return nil
+	})
+}
+
+// asUser reads the models.User, or the pointer to one, of the user events.
+func asUser(user any) (models.User, bool) {
+	switch u := user.(type) {
+	case models.User:
+		return u, true
+	case *models.User:
+		if u != nil {
+			return *u, true
+		}
+	}
+	return models.User{}, false
+}
+
+// QueueUserEvent writes the user event to the outbox. Called with the
+// transaction of the change, the event is published if and only if the
+// change commits.
+func QueueUserEvent(app core.App, event string, user any) error {
+	u, ok := asUser(user)
+	if !ok {
+		return fmt.Errorf("unexpected user event data %T", user)
+	}
+	// the encrypted fields would be stored in clear, as UserFromRecord
+	// the events leave them out
+	u.Phone, u.NationalId = "", ""
+	payload, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	err = OutboxEvents.Insert(app, outboxEntry{
+		Event:         event,
+		Payload:       payload,
+		Status:        OutboxPending,
+		DeliveredTo:   types.JSONRaw("[]"),
+		NextAttemptAt: types.NowDateTime().String(),
+	})
+	if err != nil {
+		return err
+	}
+	Outbox.notify()
+	return nil
+}
+
+// PublishUserEvent hands the user event to every sink right away, bypassing
+// the outbox.
+func PublishUserEvent(ctx context.Context, event string, user any) error {
+	u, ok := asUser(user)
+	if !ok {
+		return fmt.Errorf("unexpected user event data %T", user)
+	}
+	id := core.GenerateDefaultRandomId()
+	names, sinks := sortedOutboxSinks()
+	errs := []error{}
+	for _, name := range names {
+		if err := sinks[name](ctx, id, event, u); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Outbox publishes the user events of the outbox. It is nil until main
+// starts it, the user events being published right away meanwhile.
+var Outbox *OutboxDispatcher
+
+type OutboxOptions struct {
+	PollInterval time.Duration
+	BatchSize    int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+}
+
+// OutboxDispatcher publishes the pending outbox events to every sink, in
+// the order they were written, and marks them delivered once every sink
+// took them. A failed event is retried after BaseDelay, doubled on every
+// following attempt up to MaxDelay, for as long as it takes.
+type OutboxDispatcher struct {
+	app  core.App
+	opts OutboxOptions
+	wake chan struct{}
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopping chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func NewOutboxDispatcher(app core.App, opts OutboxOptions) *OutboxDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &OutboxDispatcher{
+		app:      app,
+		opts:     opts,
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (d *OutboxDispatcher) Start() {
+	go d.run()
+}
+
+// Shutdown publishes the events already due and stops, giving up once ctx
+// is done. The events left pending are published on the next start.
+func (d *OutboxDispatcher) Shutdown(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	d.stopOnce.Do(func() { close(d.stopping) })
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		d.cancel()
+		<-d.done
+	}
+}
+
+func (d *OutboxDispatcher) notify() {
+	if d == nil {
+		return
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *OutboxDispatcher) run() {
+	defer close(d.done)
+	for d.ctx.Err() == nil {
+		n, err := d.dispatchDue(time.Now())
+		if err != nil {
+			d.app.Logger().Error("Failed to read the outbox", "error", err)
+		}
+		if n == d.opts.BatchSize {
+			continue
+		}
+		select {
+		case <-d.stopping:
+			// nothing is due anymore
+			return
+		case <-d.ctx.Done():
+			return
+		case <-d.wake:
+		case <-time.After(d.opts.PollInterval):
+		}
+	}
+}
+
+// dispatchDue publishes the at most BatchSize events due at now, returning
+// how many it read.
+func (d *OutboxDispatcher) dispatchDue(now time.Time) (int, error) {
+	at, err := types.ParseDateTime(now)
+	if err != nil {
+		return 0, err
+	}
+	events := []OutboxEvent{}
+	err = OutboxEvents.Query(d.app).
+		AndWhere(dbx.HashExp{"status": OutboxPending}).
+		AndWhere(dbx.NewExp("[[next_attempt_at]] <= {:now}", dbx.Params{"now": at.String()})).
+		OrderBy("created", "id").
+		Limit(int64(d.opts.BatchSize)).
+		All(&events)
+	if err != nil {
+		return 0, err
+	}
+	for _, event := range events {
+		if d.ctx.Err() != nil {
+			break
+		}
+		if err := d.deliver(event, now); err != nil {
+			d.app.Logger().Error("Failed to update outbox event", "id", event.Id, "error", err)
+		}
+	}
+	return len(events), nil
+}
+
+// deliver hands the event to the sinks that didn't take it yet and records
+// the outcome.
+func (d *OutboxDispatcher) deliver(event OutboxEvent, now time.Time) error {
+	user := models.User{}
+	if err := json.Unmarshal(event.Payload, &user); err != nil {
+		// can't ever be delivered, keep it out of the way
+		_, err := OutboxEvents.Update(d.app, event.Id, Changeset{"status": OutboxDelivered, "last_error": err.Error()})
+		return err
+	}
+	deliveredTo := []string{}
+	json.Unmarshal(event.DeliveredTo, &deliveredTo)
+
+	names, sinks := sortedOutboxSinks()
+	errs := []error{}
+	for _, name := range names {
+		if slices.Contains(deliveredTo, name) {
+			continue
+		}
+		if err := sinks[name](d.ctx, event.Id, event.Event, user); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		deliveredTo = append(deliveredTo, name)
+	}
+	raw, _ := json.Marshal(deliveredTo)
+	cs := Changeset{"delivered_to": types.JSONRaw(raw)}
+	switch err := errors.Join(errs...); {
+	case err != nil && d.ctx.Err() != nil:
+		// interrupted by the shutdown, not counted as an attempt
+	case err != nil:
+		next, parseErr := types.ParseDateTime(now.Add(min(d.opts.BaseDelay<<min(event.Attempts, 30), d.opts.MaxDelay)))
+		if parseErr != nil {
+			return parseErr
+		}
+		cs["attempts"] = event.Attempts + 1
+		cs["next_attempt_at"] = next.String()
+		cs["last_error"] = err.Error()
+		d.app.Logger().Warn("Outbox event delivery failed", "id", event.Id, "event", event.Event, "attempt", event.Attempts+1, "error", err)
+	default:
+		cs["attempts"] = event.Attempts + 1
+		cs["status"] = OutboxDelivered
+		cs["last_error"] = ""
+	}
+	_, err := OutboxEvents.Update(d.app, event.Id, cs)
+	return err
+}
+
+// DeleteDeliveredOutboxEvents removes the events delivered more than
+// retention ago.
+func DeleteDeliveredOutboxEvents(app core.App, retention time.Duration) error {
+	cutoff, err := types.ParseDateTime(time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	return RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().Delete(OutboxEvents.Table, dbx.And(
+			dbx.HashExp{"status": OutboxDelivered},
+			dbx.NewExp("[[updated]] < {:cutoff}", dbx.Params{"cutoff": cutoff.String()}),
+		)).Execute()
+		return err
+	})
+}
+
+func ScheduleOutboxCleanup(app core.App, retention time.Duration) {
+	app.Cron().MustAdd(outboxCleanupJobName, "30 * * * *", func() {
+		if err := DeleteDeliveredOutboxEvents(app, retention); err != nil {
+			app.Logger().Warn("Failed to delete delivered outbox events", "error", err)
+		}
+	})
+}
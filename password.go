@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var (
+	ErrPasswordMismatch   = errors.New("password and passwordConfirm don't match")
+	ErrPasswordAlreadySet = errors.New("password is already set")
+)
+
+type SetPasswordRequest struct {
+	Password        string `json:"password"`
+	PasswordConfirm string `json:"passwordConfirm"`
+}
+
+// InsertAuthUser creates the user through the record API so that the
+// password is hashed and a tokenKey is generated, allowing the user to log
+// in through the built-in auth endpoints.
+func InsertAuthUser(app core.App, cr models.UserCreationRequest) (*models.User, error) {
+	collection, err := app.FindCachedCollectionByNameOrId("users")
+	if err != nil {
+		return nil, err
+	}
+	record := core.NewRecord(collection)
+	record.Id = NewId(collection.Name)
+	record.SetEmail(cr.Email)
+	record.SetEmailVisibility(cr.EmailVisibility)
+	record.Set("name", cr.Name)
+	record.SetPassword(cr.Password)
+	SetRecordTenant(app, record)
+	var user *models.User
+	err = WithTx(app, func(txApp core.App) error {
+		if err := txApp.Save(record); err != nil {
+			return RecordEmailError(err)
+		}
+		var err error
+		user, err = GetUserById(txApp, record.Id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// HasPassword reports whether the user has credentials. Users created
+// through POST /users without a password are left with an empty password
+// hash until one is set with SetUserPassword.
+func HasPassword(app core.App, userId string) (bool, error) {
+	hash := ""
+	err := app.DB().
+		Select("password").
+		From("users").
+		Where(dbx.HashExp{"id": userId}).
+		Row(&hash)
+	if err != nil {
+		return false, err
+	}
+	return hash != "", nil
+}
+
+func SetUserPassword(app core.App, userId string, password string) error {
+	record, err := app.FindRecordById("users", userId)
+	if err != nil {
+		return err
+	}
+	record.SetPassword(password)
+	return RetryWrite(app, func() error {
+		return app.Save(record)
+	})
+}
+
+func HandleSetUserPassword(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		userId := e.Request.PathValue("userId")
+		pr := SetPasswordRequest{}
+		if err := BindStrict(e, &pr); err != nil {
+			return WriteBindError(e, err)
+		}
+		if pr.Password != pr.PasswordConfirm {
+			return WriteBadRequest(e, "bad request: "+ErrPasswordMismatch.Error(), nil)
+		}
+
+		hasPassword, err := HasPassword(app, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+		if hasPassword && !e.HasSuperuserAuth() {
+			return WriteForbidden(e, ErrPasswordAlreadySet.Error(), nil)
+		}
+		if err := Passwords.Check(app, e.Request.Context(), pr.Password); err != nil {
+			return WriteError(e, err, "invalid password")
+		}
+
+		err = SetUserPassword(app, userId, pr.Password)
+		var validationErrs validation.Errors
+		if errors.As(err, &validationErrs) {
+			return WriteBadRequest(e, "invalid password", validationErrs)
+		}
+		if err != nil {
+			return WriteError(e, err, "error setting password")
+		}
+		return WriteOK(e, "", nil)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+)
+
+// authWithPassword logs in through the built-in endpoint of the users
+// collection, returning the id of the authenticated user, or "" if the
+// login failed.
+func (s *testServer) authWithPassword(t testing.TB, email string, password string) string {
+	t.Helper()
+	res, body := s.do(t, http.MethodPost, "/api/collections/users/auth-with-password", "", map[string]string{
+		"identity": email,
+		"password": password,
+	})
+	if res.StatusCode != http.StatusOK {
+		return ""
+	}
+	auth := struct {
+		Token  string `json:"token"`
+		Record struct {
+			Id string `json:"id"`
+		} `json:"record"`
+	}{}
+	if err := json.Unmarshal(body, &auth); err != nil {
+		t.Fatal(err)
+	}
+	if auth.Token == "" {
+		t.Fatalf("expected a token, got %s", body)
+	}
+	return auth.Record.Id
+}
+
+func TestCreatedUserLogin(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	res, body := s.do(t, http.MethodPost, "/users", s.SuperuserToken, models.UserCreationRequest{
+		Email:           "new@example.com",
+		Password:        testUserPassword,
+		PasswordConfirm: testUserPassword,
+	})
+	user := models.User{}
+	decodeData(t, checkAPIResp(t, res.StatusCode, body), &user)
+	if id := s.authWithPassword(t, user.Email, testUserPassword); id != user.Id {
+		t.Errorf("expected to log in as %s, got %q", user.Id, id)
+	}
+	if id := s.authWithPassword(t, user.Email, "wrong-password-1"); id != "" {
+		t.Errorf("expected the wrong password to be refused, got %q", id)
+	}
+}
+
+func TestSetPasswordLogin(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	res, body := s.do(t, http.MethodPost, "/users", s.SuperuserToken, models.UserCreationRequest{Email: "new@example.com"})
+	user := models.User{}
+	decodeData(t, checkAPIResp(t, res.StatusCode, body), &user)
+	if id := s.authWithPassword(t, user.Email, testUserPassword); id != "" {
+		t.Errorf("expected a user without password not to log in, got %q", id)
+	}
+
+	res, body = s.do(t, http.MethodPost, "/users/"+user.Id+"/set-password", s.SuperuserToken, SetPasswordRequest{
+		Password:        testUserPassword,
+		PasswordConfirm: testUserPassword,
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.StatusCode, body)
+	}
+	checkAPIResp(t, res.StatusCode, body)
+	if id := s.authWithPassword(t, user.Email, testUserPassword); id != user.Id {
+		t.Errorf("expected to log in as %s, got %q", user.Id, id)
+	}
+}
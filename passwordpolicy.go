@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// The character classes PASSWORD_REQUIRED_CLASSES can require.
+const (
+	PasswordClassLower  = "lower"
+	PasswordClassUpper  = "upper"
+	PasswordClassDigit  = "digit"
+	PasswordClassSymbol = "symbol"
+)
+
+// The codes of the violations of the password policy, sent in the data of
+// the WEAK_PASSWORD responses.
+const (
+	PasswordTooShort      = "too_short"
+	PasswordTooLong       = "too_long"
+	PasswordMissingLower  = "missing_lower"
+	PasswordMissingUpper  = "missing_upper"
+	PasswordMissingDigit  = "missing_digit"
+	PasswordMissingSymbol = "missing_symbol"
+	PasswordBreached      = "breached"
+)
+
+type passwordClass struct {
+	code  string
+	name  string
+	match func(r rune) bool
+}
+
+var passwordClasses = map[string]passwordClass{
+	PasswordClassLower:  {PasswordMissingLower, "a lowercase letter", unicode.IsLower},
+	PasswordClassUpper:  {PasswordMissingUpper, "an uppercase letter", unicode.IsUpper},
+	PasswordClassDigit:  {PasswordMissingDigit, "a digit", unicode.IsDigit},
+	PasswordClassSymbol: {PasswordMissingSymbol, "a symbol", func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r) }},
+}
+
+// PasswordViolation is a rule of the password policy a password breaks.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError is returned for the passwords breaking the policy,
+// with every rule they break.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (err *PasswordPolicyError) Error() string {
+	messages := make([]string, len(err.Violations))
+	for i, v := range err.Violations {
+		messages[i] = v.Message
+	}
+	return "weak password: " + strings.Join(messages, ", ")
+}
+
+// PasswordPolicy is checked by the register and the set-password flows.
+type PasswordPolicy struct {
+	MinLength       int
+	RequiredClasses []string
+	// Breached is nil unless PASSWORD_BREACH_CACHE is set.
+	Breached *BreachedPasswords
+}
+
+// Passwords is the password policy, set by main from the PASSWORD_*
+// settings. A nil policy lets every password through.
+var Passwords *PasswordPolicy
+
+func NewPasswordPolicy(cfg *Config) *PasswordPolicy {
+	policy := &PasswordPolicy{MinLength: cfg.PasswordMinLength, RequiredClasses: cfg.PasswordRequiredClasses}
+	if cfg.PasswordBreachCache != "" {
+		policy.Breached = &BreachedPasswords{
+			dir:    cfg.PasswordBreachCache,
+			apiURL: cfg.PasswordBreachAPIURL,
+			ttl:    cfg.PasswordBreachCacheTTL,
+			client: Downstream.Client(DependencyPasswords, 5*time.Second),
+		}
+	}
+	return policy
+}
+
+// Check returns a *PasswordPolicyError when password breaks the policy.
+// The breached check fails open: when the range of the password can't be
+// read or fetched, the password is let through and the error is logged.
+func (p *PasswordPolicy) Check(app core.App, ctx context.Context, password string) error {
+	if p == nil {
+		return nil
+	}
+	violations := []PasswordViolation{}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{Code: PasswordTooShort, Message: fmt.Sprintf("must be at least %d characters", p.MinLength)})
+	}
+	// bcrypt ignores the bytes past the 72nd
+	if len(password) > UserPasswordMaxLength {
+		violations = append(violations, PasswordViolation{Code: PasswordTooLong, Message: fmt.Sprintf("must be at most %d bytes", UserPasswordMaxLength)})
+	}
+	for _, name := range p.RequiredClasses {
+		class := passwordClasses[name]
+		if !strings.ContainsFunc(password, class.match) {
+			violations = append(violations, PasswordViolation{Code: class.code, Message: "must contain " + class.name})
+		}
+	}
+	if p.Breached != nil && password != "" {
+		count, err := p.Breached.Count(ctx, password)
+		if err != nil {
+			app.Logger().Warn("Failed to check the password against the breached passwords", "error", err)
+		}
+		if count > 0 {
+			violations = append(violations, PasswordViolation{Code: PasswordBreached, Message: "appears in a known data breach, choose another one"})
+		}
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// BreachedPasswords looks the passwords up in a local copy of the Have I
+// Been Pwned ranges, by k-anonymity: only the first 5 hex characters of the
+// SHA-1 of a password name its range, a <PREFIX>.txt file of SUFFIX:COUNT
+// lines. With an API URL, the missing and the stale ranges are fetched and
+// written to the cache, otherwise the missing ones are taken as empty.
+type BreachedPasswords struct {
+	dir    string
+	apiURL string
+	ttl    time.Duration
+	client *http.Client
+}
+
+// Count returns how many times password appears in the breaches, 0 when it
+// doesn't.
+func (b *BreachedPasswords) Count(ctx context.Context, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	path := filepath.Join(b.dir, prefix+".txt")
+	info, err := os.Stat(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	stale := err != nil || (b.ttl > 0 && time.Since(info.ModTime()) > b.ttl)
+	if stale && b.apiURL != "" {
+		if err := b.fetchRange(ctx, prefix, path); err != nil {
+			// a stale range is better than none
+			if info == nil {
+				return 0, err
+			}
+		}
+	} else if info == nil {
+		return 0, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return findBreachedSuffix(f, suffix)
+}
+
+// findBreachedSuffix returns the count of suffix in a range, 0 for the
+// padding lines the API adds with a count of 0.
+func findBreachedSuffix(r io.Reader, suffix string) (int, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok || !strings.EqualFold(line, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil {
+			return 0, fmt.Errorf("invalid breached password count %q", count)
+		}
+		return n, nil
+	}
+	return 0, scanner.Err()
+}
+
+// fetchRange downloads the range of prefix from the API to path, through a
+// temporary file so that the concurrent checks never read half a range.
+func (b *BreachedPasswords) fetchRange(ctx context.Context, prefix string, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(b.apiURL, "/")+"/"+prefix, nil)
+	if err != nil {
+		return err
+	}
+	// pads the responses so that their size doesn't give the range away
+	req.Header.Set("Add-Padding", "true")
+	res, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching breached passwords range: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching breached passwords range: status %d", res.StatusCode)
+	}
+
+	if err := os.MkdirAll(b.dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(b.dir, prefix+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, io.LimitReader(res.Body, 10<<20)); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error fetching breached passwords range: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// piiEmail matches the emails, masked down to their first character and
+// domain so that the logs stay useful, e.g. j***@example.com.
+var piiEmail = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*@([A-Za-z0-9.-]+\.[A-Za-z]{2,})`)
+
+// piiTokens match the credentials replaced whole: the bearer tokens, the
+// PocketBase JWTs, the API keys and the signed tokens of the links, see
+// signUserToken.
+var piiTokens = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bbearer\s+[^\s"',]+`),
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+	regexp.MustCompile(`\b` + apiKeyTokenPrefix + `[0-9a-f]{16,}`),
+	regexp.MustCompile(`\b[A-Za-z0-9_-]{16,}\.[A-Za-z0-9_-]{43}\b`),
+}
+
+// Sanitizer masks the personal data and the credentials of the strings
+// written to the logs and of the failure messages sent to the clients.
+type Sanitizer struct {
+	patterns []*regexp.Regexp
+}
+
+// PII is the sanitizer of the logs and of the failure messages, with the
+// PII_PATTERNS set in main.
+var PII = NewSanitizer(nil)
+
+// NewSanitizer returns a sanitizer masking the emails and the tokens, and
+// the matches of patterns with [redacted].
+func NewSanitizer(patterns []*regexp.Regexp) *Sanitizer {
+	return &Sanitizer{patterns: patterns}
+}
+
+// CompilePIIPatterns compiles the regular expressions of PII_PATTERNS.
+func CompilePIIPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func (s *Sanitizer) String(v string) string {
+	for _, re := range piiTokens {
+		v = re.ReplaceAllString(v, "[token]")
+	}
+	for _, re := range s.patterns {
+		v = re.ReplaceAllString(v, "[redacted]")
+	}
+	return piiEmail.ReplaceAllString(v, "$1***@$2")
+}
+
+// Value sanitizes the strings of v, going through its maps and slices.
+func (s *Sanitizer) Value(v any) any {
+	switch v := v.(type) {
+	case string:
+		return s.String(v)
+	case error:
+		return s.String(v.Error())
+	case map[string]any:
+		sanitized := make(map[string]any, len(v))
+		for key, value := range v {
+			sanitized[key] = s.Value(value)
+		}
+		return sanitized
+	case types.JSONMap[any]:
+		return types.JSONMap[any](s.Value(map[string]any(v)).(map[string]any))
+	case []any:
+		sanitized := make([]any, len(v))
+		for i, value := range v {
+			sanitized[i] = s.Value(value)
+		}
+		return sanitized
+	case []string:
+		sanitized := make([]string, len(v))
+		for i, value := range v {
+			sanitized[i] = s.String(value)
+		}
+		return sanitized
+	}
+	return v
+}
+
+// BindLogSanitizer sanitizes the logs before PocketBase stores them, so
+// that every app.Logger() call is covered. The logs printed to the console
+// in development aren't.
+func BindLogSanitizer(app core.App) {
+	app.OnModelCreate(core.LogsTableName).BindFunc(func(e *core.ModelEvent) error {
+		if log, ok := e.Model.(*core.Log); ok {
+			log.Message = PII.String(log.Message)
+			log.Data = PII.Value(log.Data).(types.JSONMap[any])
+		}
+		return e.Next()
+	})
+}
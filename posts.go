@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var PostSortFields = []string{"id", "title", "created", "updated"}
+
+// PostFields are the fields of the /posts routes, PostWritableFields those a
+// request may set. The author is the requester unless set by a superuser.
+var (
+	PostFields         = []string{"title", "body", "author", "created", "updated"}
+	PostWritableFields = []string{"title", "body", "author"}
+	PostFilterFields   = map[string]FilterType{"author": FilterString}
+)
+
+type Post struct {
+	Id      string      `db:"id" json:"id"`
+	Title   string      `db:"title" json:"title"`
+	Body    string      `db:"body" json:"body"`
+	Author  string      `db:"author" json:"author"`
+	Created string      `db:"created" json:"created"`
+	Updated string      `db:"updated" json:"updated"`
+	Expand  *PostExpand `db:"-" json:"expand,omitempty"`
+}
+
+// PostInput is the body of POST and PATCH /posts, which set the fields
+// present.
+type PostInput struct {
+	Title  string `json:"title,omitempty"`
+	Body   string `json:"body,omitempty"`
+	Author string `json:"author,omitempty"`
+}
+
+type PostExpand struct {
+	Author *models.User `json:"author,omitempty"`
+}
+
+// postWithAuthor is the row shape of the posts/users join used to expand
+// the author without issuing a query per post.
+type postWithAuthor struct {
+	Post
+	AuthorEmail           string       `db:"author_email"`
+	AuthorEmailVisibility bool         `db:"author_emailVisibility"`
+	AuthorVerified        bool         `db:"author_verified"`
+	AuthorName            string       `db:"author_name"`
+	AuthorAvatar          string       `db:"author_avatar"`
+	AuthorLastSeen        string       `db:"author_lastSeen"`
+	AuthorRoles           models.Roles `db:"author_roles"`
+	AuthorLoginCount      int64        `db:"author_loginCount"`
+	AuthorCredits         int64        `db:"author_credits"`
+	AuthorCompleteness    int64        `db:"author_completeness"`
+	AuthorCreated         string       `db:"author_created"`
+	AuthorUpdated         string       `db:"author_updated"`
+}
+
+// Posts is the repository of the posts collection table.
+var Posts = NewRepository[Post]("posts")
+
+func CountPostsByAuthor(app core.App, userId string) (int, error) {
+	span := StartStorageSpan(app, "CountPostsByAuthor", "SELECT")
+	total, err := Posts.Count(app, dbx.HashExp{"author": userId})
+	span.End(err)
+	return total, err
+}
+
+func GetPostsByAuthor(app core.App, userId string, opts ListOptions) ([]Post, error) {
+	span := StartStorageSpan(app, "GetPostsByAuthor", "SELECT")
+	opts.Filter = dbx.HashExp{"posts.author": userId}
+	posts, err := Posts.FindAll(app, opts)
+	span.SetAttr("db.response.returned_rows", len(posts))
+	span.End(err)
+	return posts, err
+}
+
+func GetPostsByAuthorWithAuthor(app core.App, userId string, opts ListOptions) ([]Post, error) {
+	rows := []postWithAuthor{}
+	q := Posts.Query(app).
+		AndSelect(
+			"users.email AS author_email",
+			"users.emailVisibility AS author_emailVisibility",
+			"users.verified AS author_verified",
+			"users.name AS author_name",
+			"users.avatar AS author_avatar",
+			"users.lastSeen AS author_lastSeen",
+			"users.loginCount AS author_loginCount",
+			"users.credits AS author_credits",
+			"users.completeness AS author_completeness",
+			"users.roles AS author_roles",
+			"users.created AS author_created",
+			"users.updated AS author_updated",
+		).
+		InnerJoin("users", dbx.NewExp("users.id = posts.author")).
+		AndWhere(dbx.HashExp{"posts.author": userId})
+	span := StartStorageSpan(app, "GetPostsByAuthorWithAuthor", "SELECT")
+	err := opts.Apply(q, "posts").All(&rows)
+	span.SetAttr("db.response.returned_rows", len(rows))
+	span.End(err)
+	if err != nil {
+		return []Post{}, err
+	}
+
+	posts := make([]Post, len(rows))
+	for i, row := range rows {
+		post := row.Post
+		post.Expand = &PostExpand{
+			Author: &models.User{
+				Id:              row.Author,
+				Email:           row.AuthorEmail,
+				EmailVisibility: row.AuthorEmailVisibility,
+				Verified:        row.AuthorVerified,
+				Name:            row.AuthorName,
+				Avatar:          row.AuthorAvatar,
+				LastSeen:        row.AuthorLastSeen,
+				Roles:           row.AuthorRoles,
+				LoginCount:      row.AuthorLoginCount,
+				Credits:         row.AuthorCredits,
+				Completeness:    row.AuthorCompleteness,
+				Created:         row.AuthorCreated,
+				Updated:         row.AuthorUpdated,
+			},
+		}
+		posts[i] = post
+	}
+	return posts, nil
+}
+
+func HandleGetUserPosts(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		opts, err := ParseListOptions(e.Request.URL.Query(), PostSortFields, cfg)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+
+		expand := e.Request.URL.Query().Get("expand")
+		if expand != "" && expand != "author" {
+			return WriteBadRequest(e, "bad request: unsupported expand "+expand, nil)
+		}
+
+		if _, err := GetUserById(app, userId); errors.Is(err, sql.ErrNoRows) {
+			return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+		} else if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+
+		total, err := CountPostsByAuthor(app, userId)
+		if err != nil {
+			return WriteInternalServerError(e, "error counting posts: "+err.Error(), nil)
+		}
+
+		var posts []Post
+		if expand == "author" {
+			posts, err = GetPostsByAuthorWithAuthor(app, userId, opts)
+		} else {
+			posts, err = GetPostsByAuthor(app, userId, opts)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error getting posts: "+err.Error(), nil)
+		}
+		for _, post := range posts {
+			if post.Expand != nil && post.Expand.Author != nil {
+				*post.Expand.Author = RedactUser(e, *post.Expand.Author)
+			}
+		}
+
+		return WriteOK(e, "", NewListPage(posts, opts, total))
+	}
+}
+
+// PostsCRUDOptions configures the /posts routes registered by RegisterCRUD.
+func PostsCRUDOptions(app *pocketbase.PocketBase, cfg *Config) CRUDOptions {
+	return CRUDOptions{
+		App:             app,
+		Config:          cfg,
+		Fields:          PostFields,
+		WritableFields:  PostWritableFields,
+		SortFields:      PostSortFields,
+		FilterFields:    PostFilterFields,
+		OwnerField:      "author",
+		TenantScope:     PostsOfTenant,
+		Validate:        ValidatePost,
+		ModeratedFields: []string{"title", "body"},
+		Item:            Post{},
+		Input:           PostInput{},
+		List:            models.ListPage[Post]{},
+		Read:            []func(e *core.RequestEvent) error{RequireAuth()},
+	}
+}
+
+// PostsOfTenant is the TenantScope of the posts, which belong to the
+// tenant of their author.
+func PostsOfTenant(tenantId string) dbx.Expression {
+	return dbx.NewExp("[[posts.author]] IN (SELECT [[id]] FROM {{users}} WHERE [[tenant_id]] = {:tenant})", dbx.Params{"tenant": tenantId})
+}
+
+// ValidatePost rejects blank titles, which the collection's required check
+// lets through.
+func ValidatePost(e *core.RequestEvent, record *core.Record) error {
+	return validation.Errors{
+		"title": validation.Validate(strings.TrimSpace(record.GetString("title")), validation.Required),
+	}.Filter()
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// The known preferences, see PreferenceSchema.
+const (
+	PrefProfileChangesEmail = "notifications.profileChanges.email"
+	PrefProfileChangesInApp = "notifications.profileChanges.inApp"
+	PrefProfileListed       = "profile.listed"
+	PrefTheme               = "theme"
+	PrefTimezone            = "timezone"
+)
+
+// The types of the preferences, named like in JSON Schema.
+const (
+	PrefBoolean = "boolean"
+	PrefString  = "string"
+	PrefInteger = "integer"
+	PrefNumber  = "number"
+)
+
+// upsertPreferencesSQL replaces the preferences of a user.
+const upsertPreferencesSQL = "INSERT INTO {{preferences}} ([[id]], [[user]], [[values]], [[created]], [[updated]]) " +
+	"VALUES ({:id}, {:user}, {:values}, {:now}, {:now}) " +
+	"ON CONFLICT ([[user]]) DO UPDATE SET [[values]] = excluded.[[values]], [[updated]] = excluded.[[updated]]"
+
+var ErrUnknownPreference = errors.New("unknown preference")
+
+// PreferenceDef describes a known preference. Allowed, when set, lists its
+// only valid values, and Validate checks the others further.
+type PreferenceDef struct {
+	Type        string                `json:"type"`
+	Default     any                   `json:"default"`
+	Allowed     []any                 `json:"allowed,omitempty"`
+	Description string                `json:"description"`
+	Validate    func(value any) error `json:"-"`
+}
+
+// PreferenceSchema is the registry of the known preferences, by key. The
+// users can only set these.
+var PreferenceSchema = map[string]PreferenceDef{
+	PrefProfileChangesEmail: {Type: PrefBoolean, Default: true, Description: "Email the changes of the email, the name and the verification of the account."},
+	PrefProfileChangesInApp: {Type: PrefBoolean, Default: true, Description: "Notify the changes of the email, the name and the verification of the account in the app."},
+	PrefProfileListed:       {Type: PrefBoolean, Default: true, Description: "List the profile page in the sitemap, and let the search engines index it."},
+	PrefTheme:               {Type: PrefString, Default: "system", Allowed: []any{"system", "light", "dark"}, Description: "Color theme of the app."},
+	PrefTimezone: {Type: PrefString, Default: "UTC", Description: "IANA time zone the dates are shown in, e.g. Europe/Paris.", Validate: func(value any) error {
+		if _, err := time.LoadLocation(value.(string)); err != nil {
+			return errors.New("must be an IANA time zone")
+		}
+		return nil
+	}},
+}
+
+// UserPreferences holds the preferences of a user by key, the missing ones
+// taking their defaults.
+type UserPreferences struct {
+	Id     string        `db:"id" json:"-"`
+	User   string        `db:"user" json:"-"`
+	Values types.JSONRaw `db:"values" json:"values"`
+}
+
+var Preferences = NewRepository[UserPreferences]("preferences")
+
+// LoadPreferences returns the preferences the user set, none when the user
+// has no preferences row.
+func LoadPreferences(app core.App, userId string) (map[string]any, error) {
+	row, err := Preferences.FindOne(app, dbx.HashExp{"user": userId})
+	if errors.Is(err, ErrNotFound) {
+		return map[string]any{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]any{}
+	if len(row.Values) > 0 {
+		if err := json.Unmarshal(row.Values, &values); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// EffectivePreferences returns every known preference of values, with the
+// defaults of the ones the user didn't set.
+func EffectivePreferences(values map[string]any) map[string]any {
+	effective := make(map[string]any, len(PreferenceSchema))
+	for key, def := range PreferenceSchema {
+		effective[key] = def.Default
+		if value, ok := values[key]; ok && validatePreference(def, value) == nil {
+			effective[key] = value
+		}
+	}
+	return effective
+}
+
+// PrefValue returns the preference key of values as a T, its default when
+// unset or when the stored value is no longer valid.
+func PrefValue[T any](values map[string]any, key string) (T, error) {
+	var v T
+	def, ok := PreferenceSchema[key]
+	if !ok {
+		return v, fmt.Errorf("%w %q", ErrUnknownPreference, key)
+	}
+	value := def.Default
+	if stored, ok := values[key]; ok && validatePreference(def, stored) == nil {
+		value = stored
+	}
+	// round trips through JSON so that the numbers fit the integer types
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return v, err
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return v, fmt.Errorf("preference %q isn't a %T: %w", key, v, err)
+	}
+	return v, nil
+}
+
+// GetPref returns the preference key of the user as a T, e.g.
+// GetPref[bool](app, userId, PrefProfileChangesEmail).
+func GetPref[T any](app core.App, userId string, key string) (T, error) {
+	values, err := LoadPreferences(app, userId)
+	if err != nil {
+		var v T
+		return v, err
+	}
+	return PrefValue[T](values, key)
+}
+
+// validatePreference checks a value decoded from JSON against def.
+func validatePreference(def PreferenceDef, value any) error {
+	switch def.Type {
+	case PrefBoolean:
+		if _, ok := value.(bool); !ok {
+			return errors.New("must be a boolean")
+		}
+	case PrefString:
+		if _, ok := value.(string); !ok {
+			return errors.New("must be a string")
+		}
+	case PrefInteger:
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			return errors.New("must be an integer")
+		}
+	case PrefNumber:
+		if _, ok := value.(float64); !ok {
+			return errors.New("must be a number")
+		}
+	}
+	if len(def.Allowed) > 0 && !slices.Contains(def.Allowed, value) {
+		return fmt.Errorf("must be one of %v", def.Allowed)
+	}
+	if def.Validate != nil {
+		return def.Validate(value)
+	}
+	return nil
+}
+
+// ValidatePreferences checks the keys and the values of values against
+// PreferenceSchema, returning the errors by key.
+func ValidatePreferences(values map[string]any) error {
+	errs := validation.Errors{}
+	for key, value := range values {
+		def, ok := PreferenceSchema[key]
+		if !ok {
+			errs[key] = validation.NewError("validation_unknown_preference", "unknown preference")
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		if err := validatePreference(def, value); err != nil {
+			errs[key] = validation.NewError("validation_invalid_preference", err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// SetPreferences replaces the preferences of the user with values, the
+// null ones being reset to their defaults.
+func SetPreferences(app core.App, userId string, values map[string]any) error {
+	if err := ValidatePreferences(values); err != nil {
+		return err
+	}
+	stored := map[string]any{}
+	for key, value := range values {
+		if value != nil {
+			stored[key] = value
+		}
+	}
+	raw, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	now := types.NowDateTime().String()
+	err = RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().NewQuery(upsertPreferencesSQL).Bind(dbx.Params{
+			"id":     NewId(Preferences.Table),
+			"user":   userId,
+			"values": string(raw),
+			"now":    now,
+		}).Execute()
+		return err
+	})
+	if err == nil {
+		// the completeness of the user counts its preferences
+		UserResponseCache.Invalidate()
+	}
+	return err
+}
+
+// PreferencesRequest is the body of PUT /users/{userId}/preferences.
+type PreferencesRequest struct {
+	Values map[string]any `json:"values" binding:"required"`
+}
+
+// PreferencesResponse is the response of the preferences routes: every
+// known preference, along with the schema for the clients to build their
+// settings from.
+type PreferencesResponse struct {
+	Values map[string]any           `json:"values"`
+	Schema map[string]PreferenceDef `json:"schema"`
+}
+
+func newPreferencesResponse(values map[string]any) PreferencesResponse {
+	return PreferencesResponse{Values: EffectivePreferences(values), Schema: PreferenceSchema}
+}
+
+func HandleGetPreferences(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		if _, err := GetUserById(app, userId); err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+		values, err := LoadPreferences(app, userId)
+		if err != nil {
+			return WriteError(e, err, "error getting preferences")
+		}
+		e.Response.Header().Set("Cache-Control", "no-store")
+		return WriteOK(e, "", newPreferencesResponse(values))
+	}
+}
+
+// HandleSetPreferences replaces the preferences of the user, the keys left
+// out or set to null taking their defaults.
+func HandleSetPreferences(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		req := PreferencesRequest{}
+		if err := BindStrict(e, &req); err != nil {
+			return WriteBindError(e, err)
+		}
+		if _, err := GetUserById(app, userId); err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+		if err := SetPreferences(app, userId, req.Values); err != nil {
+			return WriteError(e, err, "error setting preferences")
+		}
+		SetAuditedUser(e, userId)
+		return WriteOK(e, "", newPreferencesResponse(req.Values))
+	}
+}
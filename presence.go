@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const (
+	presenceBufferSize     = 64
+	presenceMaxMessageSize = 4096
+	presencePingInterval   = 30 * time.Second
+	// presenceReadTimeout leaves the clients two pings to answer.
+	presenceReadTimeout   = 2*presencePingInterval + 10*time.Second
+	presenceChannelMax    = 100
+	presenceDefaultStatus = "online"
+)
+
+// PresenceStatuses are the statuses the users can set with a status
+// message.
+var PresenceStatuses = []string{"online", "away", "busy"}
+
+// Presence tracks the users connected to GET /ws.
+var Presence = NewPresenceHub(presenceBufferSize)
+
+// PresenceMessage is a message of the GET /ws protocol, JSON encoded in a
+// text frame. The clients send:
+//
+//	{"type":"typing","channel":"<id>","typing":true}
+//	{"type":"status","status":"away"}
+//
+// and receive, for the users of their tenant:
+//
+//	{"type":"presence","users":[...]}, the users online, once connected
+//	{"type":"online","userId":"...","status":"online"}
+//	{"type":"offline","userId":"...","lastSeen":"..."}
+//	{"type":"status","userId":"...","status":"away"}
+//	{"type":"typing","userId":"...","channel":"<id>","typing":true}
+//	{"type":"error","message":"..."}, for the invalid messages
+type PresenceMessage struct {
+	Type     string         `json:"type"`
+	UserId   string         `json:"userId,omitempty"`
+	Status   string         `json:"status,omitempty"`
+	Channel  string         `json:"channel,omitempty"`
+	Typing   *bool          `json:"typing,omitempty"`
+	LastSeen string         `json:"lastSeen,omitempty"`
+	Users    []PresenceUser `json:"users,omitempty"`
+	Message  string         `json:"message,omitempty"`
+}
+
+type PresenceUser struct {
+	UserId string `json:"userId"`
+	Status string `json:"status"`
+	Since  string `json:"since"`
+}
+
+// presenceClient is a connection of a user, several of which count as one
+// presence, e.g. the tabs of a browser.
+type presenceClient struct {
+	userId   string
+	tenantId string
+	send     chan []byte
+	// dropped is set once send is closed, for the slow clients and on Close
+	dropped bool
+}
+
+type presenceState struct {
+	connections int
+	status      string
+	since       time.Time
+}
+
+// PresenceHub keeps the connections of the users in memory and broadcasts
+// their presence, statuses and typing to the other connections of their
+// tenant. A user is online from their first connection until their last
+// one closes.
+type PresenceHub struct {
+	mu         sync.Mutex
+	clients    map[*presenceClient]struct{}
+	users      map[string]*presenceState
+	bufferSize int
+	closed     bool
+}
+
+func NewPresenceHub(bufferSize int) *PresenceHub {
+	return &PresenceHub{
+		clients:    map[*presenceClient]struct{}{},
+		users:      map[string]*presenceState{},
+		bufferSize: bufferSize,
+	}
+}
+
+// Join registers a connection of the user, announcing them online if it is
+// their first, and returns it with the users of the tenant online. ok is
+// false once the hub is closed.
+func (h *PresenceHub) Join(userId string, tenantId string) (*presenceClient, []PresenceUser, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil, false
+	}
+
+	client := &presenceClient{userId: userId, tenantId: tenantId, send: make(chan []byte, h.bufferSize)}
+	h.clients[client] = struct{}{}
+	state, ok := h.users[userId]
+	if !ok {
+		state = &presenceState{status: presenceDefaultStatus, since: time.Now()}
+		h.users[userId] = state
+		h.broadcast(client, PresenceMessage{Type: "online", UserId: userId, Status: state.status})
+	}
+	state.connections++
+	return client, h.online(tenantId), true
+}
+
+// Leave unregisters the connection, announcing the user offline at lastSeen
+// if it was their last. It reports whether it was.
+func (h *PresenceHub) Leave(client *presenceClient, lastSeen time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[client]; !ok {
+		return false
+	}
+	delete(h.clients, client)
+	if !client.dropped {
+		client.dropped = true
+		close(client.send)
+	}
+
+	state := h.users[client.userId]
+	if state.connections--; state.connections > 0 {
+		return false
+	}
+	delete(h.users, client.userId)
+	h.broadcast(client, PresenceMessage{Type: "offline", UserId: client.userId, LastSeen: lastSeen.UTC().Format(time.RFC3339)})
+	return true
+}
+
+// SetStatus sets the status of the user of the connection, for all their
+// connections.
+func (h *PresenceHub) SetStatus(client *presenceClient, status string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.users[client.userId]
+	if !ok || state.status == status {
+		return
+	}
+	state.status = status
+	h.broadcast(client, PresenceMessage{Type: "status", UserId: client.userId, Status: status})
+}
+
+// Typing tells the other connections of the tenant that the user of the
+// connection started or stopped typing in channel.
+func (h *PresenceHub) Typing(client *presenceClient, channel string, typing bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.broadcast(client, PresenceMessage{Type: "typing", UserId: client.userId, Channel: channel, Typing: &typing})
+}
+
+// broadcast sends the message to the connections of the tenant of from but
+// from itself. The clients too slow to keep up are dropped rather than
+// blocking the others.
+func (h *PresenceHub) broadcast(from *presenceClient, message PresenceMessage) {
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	for client := range h.clients {
+		if client == from || client.dropped || client.tenantId != from.tenantId {
+			continue
+		}
+		select {
+		case client.send <- raw:
+		default:
+			client.dropped = true
+			close(client.send)
+		}
+	}
+}
+
+// online returns the users of the tenant online, by id.
+func (h *PresenceHub) online(tenantId string) []PresenceUser {
+	tenantUsers := []string{}
+	for client := range h.clients {
+		if client.tenantId == tenantId && !slices.Contains(tenantUsers, client.userId) {
+			tenantUsers = append(tenantUsers, client.userId)
+		}
+	}
+	sort.Strings(tenantUsers)
+	users := make([]PresenceUser, 0, len(tenantUsers))
+	for _, userId := range tenantUsers {
+		state := h.users[userId]
+		users = append(users, PresenceUser{UserId: userId, Status: state.status, Since: state.since.UTC().Format(time.RFC3339)})
+	}
+	return users
+}
+
+// Close ends every connection, current and future, so that the shutdown
+// doesn't wait for them.
+func (h *PresenceHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for client := range h.clients {
+		if !client.dropped {
+			client.dropped = true
+			close(client.send)
+		}
+	}
+}
+
+// AuthFromQueryToken authenticates the requests without an Authorization
+// header with their ?token=, which the browsers can't set on websockets.
+// The locked users are rejected, as by RejectLockedUsers.
+func AuthFromQueryToken(app core.App) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		token := e.Request.URL.Query().Get("token")
+		if e.Auth != nil || token == "" {
+			return e.Next()
+		}
+		record, err := app.FindAuthRecordByToken(token, core.TokenTypeAuth)
+		if err != nil {
+			return WriteUnauthorized(e, "invalid token", nil)
+		}
+		if IsLocked(record) {
+			return WriteErrorCode(e, CodeUserLocked, ErrUserLocked.Error(), nil)
+		}
+		e.Auth = record
+		return e.Next()
+	}
+}
+
+// HandlePresence upgrades to a websocket speaking the PresenceMessage
+// protocol. The lastSeen of the user is written as they come and go, and
+// while they send messages at most once per interval of tracker.
+func HandlePresence(app core.App, hub *PresenceHub, tracker *LastSeenTracker) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil || e.Auth.Collection().Name != Users.Table {
+			return WriteUnauthorized(e, "users token required", nil)
+		}
+		userId := e.Auth.Id
+		tenantId, _ := RequestTenant(e)
+
+		ws, err := UpgradeWebSocket(e, presenceMaxMessageSize)
+		if errors.Is(err, ErrNotWebSocket) {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error opening websocket: "+err.Error(), nil)
+		}
+		defer ws.Close()
+		ws.ReadTimeout = presenceReadTimeout
+
+		client, users, ok := hub.Join(userId, tenantId)
+		if !ok {
+			ws.CloseWith(WSCloseGoingAway, "server shutting down")
+			return nil
+		}
+		touch := func(now time.Time, force bool) {
+			if !tracker.ShouldWrite(userId, now) && !force {
+				return
+			}
+			if err := UpdateLastSeen(app, userId, now); err != nil {
+				app.Logger().Warn("Failed to update lastSeen", "userId", userId, "error", err)
+			}
+		}
+		touch(time.Now(), true)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			writePresence(ws, client, PresenceMessage{Type: "presence", Users: users})
+		}()
+
+		for {
+			raw, err := ws.ReadMessage()
+			if err != nil {
+				break
+			}
+			touch(time.Now(), false)
+			message := PresenceMessage{}
+			if err := json.Unmarshal(raw, &message); err != nil {
+				sendPresenceError(hub, client, "invalid message: "+err.Error())
+				continue
+			}
+			switch message.Type {
+			case "typing":
+				if message.Channel == "" || len(message.Channel) > presenceChannelMax || message.Typing == nil {
+					sendPresenceError(hub, client, "typing requires a channel and typing")
+					continue
+				}
+				hub.Typing(client, message.Channel, *message.Typing)
+			case "status":
+				if !slices.Contains(PresenceStatuses, message.Status) {
+					sendPresenceError(hub, client, "status must be one of online, away, busy")
+					continue
+				}
+				hub.SetStatus(client, message.Status)
+			default:
+				sendPresenceError(hub, client, "unsupported message type "+message.Type)
+			}
+		}
+
+		now := time.Now()
+		offline := hub.Leave(client, now)
+		<-done
+		if offline {
+			touch(now, true)
+		}
+		return nil
+	}
+}
+
+// writePresence sends the first message then the broadcasts of the client,
+// pinging it meanwhile, until the hub drops it.
+func writePresence(ws *WebSocket, client *presenceClient, first PresenceMessage) {
+	raw, err := json.Marshal(first)
+	if err != nil || ws.WriteText(raw) != nil {
+		ws.CloseWith(WSCloseGoingAway, "")
+		return
+	}
+	ping := time.NewTicker(presencePingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case raw, ok := <-client.send:
+			if !ok {
+				ws.CloseWith(WSCloseGoingAway, "")
+				return
+			}
+			if err := ws.WriteText(raw); err != nil {
+				ws.CloseWith(WSCloseGoingAway, "")
+				return
+			}
+		case <-ping.C:
+			if err := ws.Ping(); err != nil {
+				ws.CloseWith(WSCloseGoingAway, "")
+				return
+			}
+		}
+	}
+}
+
+// sendPresenceError answers an invalid message of the client, through the
+// hub so that the writes stay with writePresence.
+func sendPresenceError(hub *PresenceHub, client *presenceClient, message string) {
+	raw, err := json.Marshal(PresenceMessage{Type: "error", Message: message})
+	if err != nil {
+		return
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if client.dropped {
+		return
+	}
+	select {
+	case client.send <- raw:
+	default:
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"net/mail"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+)
+
+// NotificationProfileChanged is the type of the in-app notifications of
+// the profile changes.
+const NotificationProfileChanged = "profile.changed"
+
+const (
+	profileChangesTable          = "profile_changes"
+	profileChangesNotifyJobName  = "profileChangesNotify"
+	profileChangesNotifyBatchMax = 100
+)
+
+var profileChangeEmailTemplate = template.Must(template.New("profileChangeEmail").Parse(
+	`<p>Hi{{if .Name}} {{.Name}}{{end}},</p>
+<p>{{.Message}}</p>
+<p>If you didn't make this change, reset your password and contact us right away.</p>`))
+
+// ProfileChange is a change of the email, the name or the verified flag of
+// a user, queued by the triggers of the users table whatever made it.
+type ProfileChange struct {
+	Id       string `db:"id" json:"id"`
+	User     string `db:"user" json:"user"`
+	Field    string `db:"field" json:"field"`
+	OldValue string `db:"old_value" json:"oldValue"`
+	NewValue string `db:"new_value" json:"newValue"`
+	Created  string `db:"created" json:"created"`
+}
+
+// ProfileChangeEmailJob is the payload of the JobProfileChangeEmail jobs.
+type ProfileChangeEmailJob struct {
+	UserId string `json:"userId"`
+	// To is the old address for the email changes, so that the owner of
+	// the account hears of them even if it was taken over.
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+// Message describes the change to the user.
+func (c ProfileChange) Message() string {
+	switch c.Field {
+	case "email":
+		return "The email of your account was changed from " + c.OldValue + " to " + c.NewValue + "."
+	case "name":
+		if c.NewValue == "" {
+			return "The name of your account was removed."
+		}
+		return "The name of your account was changed to " + c.NewValue + "."
+	case "verified":
+		if c.NewValue == "true" {
+			return "The email of your account was verified."
+		}
+		return "The email of your account is no longer verified."
+	}
+	return "Your " + c.Field + " was changed."
+}
+
+// NotifyProfileChanges handles the queued profile changes, oldest first:
+// the users get an in-app notification and an email for each, unless they
+// turned them off in their preferences. The changes of the deleted users
+// are dropped. A change is deleted along with the writes of its
+// notifications, so that concurrent runs don't notify it twice, and is
+// retried by the next run if they fail.
+func NotifyProfileChanges(app core.App) error {
+	changes := []ProfileChange{}
+	err := app.DB().
+		Select("*").
+		From(profileChangesTable).
+		OrderBy("created", "id").
+		Limit(profileChangesNotifyBatchMax).
+		All(&changes)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, change := range changes {
+		if err := notifyProfileChange(app, change); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func notifyProfileChange(app core.App, change ProfileChange) error {
+	return WithTx(app, func(txApp core.App) error {
+		res, err := txApp.NonconcurrentDB().Delete(profileChangesTable, dbx.HashExp{"id": change.Id}).Execute()
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+			return err
+		}
+		user, err := Users.AcrossTenants().Find(txApp, change.User)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		preferences, err := LoadPreferences(txApp, change.User)
+		if err != nil {
+			return err
+		}
+
+		inApp, err := PrefValue[bool](preferences, PrefProfileChangesInApp)
+		if err != nil {
+			return err
+		}
+		byEmail, err := PrefValue[bool](preferences, PrefProfileChangesEmail)
+		if err != nil {
+			return err
+		}
+
+		message := change.Message()
+		if inApp {
+			_, err := Notify(txApp, change.User, NotificationProfileChanged, map[string]string{
+				"field":   change.Field,
+				"message": message,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		to := user.Email
+		if change.Field == "email" {
+			to = change.OldValue
+		}
+		if to != "" && byEmail {
+			job := ProfileChangeEmailJob{UserId: change.User, To: to, Message: message}
+			if _, err := EnqueueJob(txApp, JobProfileChangeEmail, job, time.Now()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RunProfileChangeEmailJob mails a profile change to the user, unless it
+// was deleted since.
+func RunProfileChangeEmailJob(ctx context.Context, app core.App, job *Job) error {
+	p := ProfileChangeEmailJob{}
+	if err := DecodeJobPayload(job, &p); err != nil {
+		return err
+	}
+	user, err := Users.AcrossTenants().Find(app, p.UserId)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	body := bytes.Buffer{}
+	err = profileChangeEmailTemplate.Execute(&body, map[string]any{
+		"Name":    user.Name,
+		"Message": p.Message,
+	})
+	if err != nil {
+		return err
+	}
+	meta := app.Settings().Meta
+	return SendMail(app, &mailer.Message{
+		From:    mail.Address{Name: meta.SenderName, Address: meta.SenderAddress},
+		To:      []mail.Address{{Address: p.To}},
+		Subject: "Your account was changed",
+		HTML:    body.String(),
+	})
+}
+
+// ScheduleProfileChangeNotifications handles the queued profile changes
+// every minute.
+func ScheduleProfileChangeNotifications(app core.App) {
+	app.Cron().MustAdd(profileChangesNotifyJobName, "* * * * *", func() {
+		if err := NotifyProfileChanges(app); err != nil {
+			app.Logger().Warn("Failed to notify profile changes", "error", err)
+		}
+	})
+}
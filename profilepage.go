@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// HandleProfilePage renders the public profile of the user as an HTML page,
+// with the fields of PublicUser only, for links shared outside of the app.
+func HandleProfilePage(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		user, err := GetUserById(app, e.Request.PathValue("userId"))
+		if errors.Is(err, ErrNotFound) {
+			return WritePage(e, app, http.StatusNotFound, "notfound.html", map[string]any{"Message": "This profile doesn't exist."})
+		}
+		if err != nil {
+			return WriteError(e, err, "error getting user")
+		}
+
+		listed, err := GetPref[bool](app, user.Id, PrefProfileListed)
+		if err != nil {
+			return WriteError(e, err, "error getting user preferences")
+		}
+
+		profile := NewPublicUser(*user)
+		avatarURL := ""
+		if profile.Avatar != "" {
+			avatarURL = "/users/" + profile.Id + "/avatar"
+		}
+		since := profile.Created
+		if created, err := types.ParseDateTime(profile.Created); err == nil {
+			since = created.Time().Format("January 2006")
+		}
+		e.Response.Header().Set("Cache-Control", "public, max-age=300")
+		return WritePage(e, app, http.StatusOK, "profile.html", map[string]any{
+			"User":      profile,
+			"AvatarURL": avatarURL,
+			"Since":     since,
+			"NoIndex":   !listed || !profile.Verified,
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// userFieldIndex maps the json names of the models.User fields to their
+// struct field index, for ?fields= projections.
+var userFieldIndex = func() map[string]int {
+	index := map[string]int{}
+	t := reflect.TypeOf(models.User{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			index[name] = i
+		}
+	}
+	return index
+}()
+
+// ParseUserFields parses ?fields=, a comma separated list of user json
+// fields. It returns nil when the parameter is missing, meaning every field.
+func ParseUserFields(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	fields := []string{}
+	for _, field := range strings.Split(v, ",") {
+		field = strings.TrimSpace(field)
+		if _, ok := userFieldIndex[field]; !ok {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// ProjectUser redacts the user for the requester and, when fields is set,
+// keeps only those fields.
+func ProjectUser(e *core.RequestEvent, user models.User, fields []string) any {
+	user = RedactUser(e, user)
+	if fields == nil {
+		return user
+	}
+	v := reflect.ValueOf(user)
+	projected := make(map[string]any, len(fields))
+	for _, field := range fields {
+		projected[field] = v.Field(userFieldIndex[field]).Interface()
+	}
+	return projected
+}
+
+func ProjectUsers(e *core.RequestEvent, users []models.User, fields []string) []any {
+	projected := make([]any, len(users))
+	for i, user := range users {
+		projected[i] = ProjectUser(e, user, fields)
+	}
+	return projected
+}
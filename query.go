@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pocketbase/dbx"
+)
+
+// Queries caches the SQL of the repository statements and prepares them
+// once per database, so the hot paths skip both the query building and
+// SQLite's statement parsing.
+var Queries = NewQueryRegistry()
+
+type preparedQueryKey struct {
+	db  *dbx.DB
+	sql string
+}
+
+type QueryRegistry struct {
+	mu         sync.Mutex
+	statements map[string]string
+	prepared   map[preparedQueryKey]*dbx.Query
+}
+
+func NewQueryRegistry() *QueryRegistry {
+	return &QueryRegistry{
+		statements: map[string]string{},
+		prepared:   map[preparedQueryKey]*dbx.Query{},
+	}
+}
+
+// SQL returns the statement cached under key, calling build to create it
+// the first time. key must identify everything build depends on, e.g. the
+// table and the updated columns.
+func (r *QueryRegistry) SQL(key string, build func() string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sql, ok := r.statements[key]
+	if !ok {
+		sql = build()
+		r.statements[key] = sql
+	}
+	return sql
+}
+
+// Query returns a query for sql, ready to be bound and run on db. On a
+// database the statement is prepared on first use and shared afterwards,
+// within a transaction it is run unprepared as the statement would have to
+// be prepared on the transaction anyway.
+func (r *QueryRegistry) Query(db dbx.Builder, sql string) *dbx.Query {
+	conn, ok := db.(*dbx.DB)
+	if !ok {
+		return db.NewQuery(sql)
+	}
+
+	key := preparedQueryKey{db: conn, sql: sql}
+	r.mu.Lock()
+	q, ok := r.prepared[key]
+	if !ok {
+		q = conn.NewQuery(sql).Prepare()
+		if q.LastError != nil {
+			r.mu.Unlock()
+			// let the query report the error when run
+			return conn.NewQuery(sql)
+		}
+		r.prepared[key] = q
+	}
+	r.mu.Unlock()
+
+	// the copy shares the prepared statement, which is safe for concurrent
+	// use, but gets its own params and context
+	cp := *q
+	return &cp
+}
+
+// Close closes the prepared statements, before the databases are closed.
+func (r *QueryRegistry) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, q := range r.prepared {
+		q.Close()
+		delete(r.prepared, key)
+	}
+}
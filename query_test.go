@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// benchmarkFind runs the SELECT of Users.Find, with find running it on the
+// database. The -parallel variant runs it from GOMAXPROCS goroutines, as
+// the concurrent requests do.
+func benchmarkFind(b *testing.B, find func(db dbx.Builder, sql string, params dbx.Params) error) {
+	app := newTestApp(b)
+	// before the database is closed by the cleanup of the app
+	b.Cleanup(Queries.Close)
+	user := seedTestUsers(b, app, 1)[0]
+	sql := "SELECT {{" + Users.Table + "}}.* FROM {{" + Users.Table + "}} WHERE " + Users.byId(app, false)
+	params := Users.byIdParams(app, user.Id)
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := find(app.DB(), sql, params); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := find(app.DB(), sql, params); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkFindCached(b *testing.B) {
+	benchmarkFind(b, func(db dbx.Builder, sql string, params dbx.Params) error {
+		return Queries.Query(db, sql).Bind(params).One(&models.User{})
+	})
+}
+
+func BenchmarkFindNewQuery(b *testing.B) {
+	benchmarkFind(b, func(db dbx.Builder, sql string, params dbx.Params) error {
+		return db.NewQuery(sql).Bind(params).One(&models.User{})
+	})
+}
+
+// benchmarkUpdate renames a user, with update running the UPDATE of
+// Users.Update.
+func benchmarkUpdate(b *testing.B, update func(app core.App, id string, cs Changeset) error) {
+	app := newTestApp(b)
+	b.Cleanup(Queries.Close)
+	user := seedTestUsers(b, app, 1)[0]
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cs := Changeset{"name": "Renamed", "emailVisibility": i%2 == 0}
+		if err := update(app, user.Id, cs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUpdateCached(b *testing.B) {
+	benchmarkUpdate(b, func(app core.App, id string, cs Changeset) error {
+		_, err := Users.Update(app, id, cs)
+		return err
+	})
+}
+
+func BenchmarkUpdateNewQuery(b *testing.B) {
+	benchmarkUpdate(b, func(app core.App, id string, cs Changeset) error {
+		cs[Users.UpdatedColumn] = types.NowDateTime().String()
+		where := dbx.HashExp{"id": id, Users.SoftDeleteColumn: ""}
+		_, err := app.DB().Update(Users.Table, cs.Params(), where).Execute()
+		return err
+	})
+}
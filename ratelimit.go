@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/cache"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// RateLimitedPrefixes are the paths of the custom routes guarded by
+// RateLimit. The PocketBase API has its own rate limiter.
+var RateLimitedPrefixes = []string{"/users", "/shared/", "/auth/"}
+
+// RateLimitMaxKeys bounds the buckets kept by the in-process cache, past
+// which the least recently used ones are dropped, i.e. refilled.
+const RateLimitMaxKeys = 100000
+
+// RateLimiter allows at most limit hits per key within a sliding window.
+type RateLimiter struct {
+	mu     sync.Mutex
+	hits   map[string][]time.Time
+	limit  int
+	window time.Duration
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		hits:   map[string][]time.Time{},
+		limit:  limit,
+		window: window,
+	}
+}
+
+// Allow records a hit for key at now if it is within the limit. Otherwise
+// it returns false and how long until the next hit would be allowed.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hits := l.hits[key]
+	for len(hits) > 0 && now.Sub(hits[0]) >= l.window {
+		hits = hits[1:]
+	}
+	if len(hits) >= l.limit {
+		l.hits[key] = hits
+		return false, l.window - now.Sub(hits[0])
+	}
+
+	l.hits[key] = append(hits, now)
+	return true, 0
+}
+
+// TokenBucket allows bursts of up to burst hits per key, refilled at
+// perMinute tokens a minute. The buckets are kept in a cache.Cache, shared
+// by the instances when CACHE_URL is set.
+type TokenBucket struct {
+	cache cache.Cache
+	// name prefixes the keys, for the limiters sharing a cache
+	name  string
+	rate  float64
+	burst int
+}
+
+func NewTokenBucket(c cache.Cache, name string, perMinute int, burst int) *TokenBucket {
+	return &TokenBucket{
+		cache: c,
+		name:  name,
+		rate:  float64(perMinute) / 60,
+		burst: max(burst, 1),
+	}
+}
+
+func (l *TokenBucket) Burst() int {
+	return l.burst
+}
+
+// Allow takes a token for key at now if there is one. Otherwise it returns
+// false and how long until the next token is available.
+func (l *TokenBucket) Allow(ctx context.Context, key string, now time.Time) (bool, time.Duration, error) {
+	return l.cache.Take(ctx, l.name+":"+key, l.rate, l.burst, now)
+}
+
+// RateLimit limits the requests to RateLimitedPrefixes, keyed by the auth
+// record when authenticated and by the client IP otherwise. A nil limiter
+// disables the limit of its kind, and superusers are never limited. The
+// rate limit of the route setting of the request, if any, replaces both.
+func RateLimit(byIP *TokenBucket, byAuth *TokenBucket, settings *RouteSettingsLoader) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		setting, _ := RequestRouteSetting(e)
+		routeLimiter := settings.Limiter(setting)
+		if (routeLimiter == nil && !isRateLimitedPath(e.Request.URL.Path)) || e.HasSuperuserAuth() {
+			return e.Next()
+		}
+
+		limiter, key := byIP, "ip:"+e.RealIP()
+		if e.Auth != nil {
+			limiter, key = byAuth, "auth:"+e.Auth.Collection().Id+":"+e.Auth.Id
+		}
+		if routeLimiter != nil {
+			limiter = routeLimiter
+		}
+		if limiter == nil {
+			return e.Next()
+		}
+
+		ok, retryAfter, err := limiter.Allow(e.Request.Context(), key, time.Now())
+		if err != nil {
+			// an unreachable cache lets the requests through rather than
+			// failing them all
+			e.App.Logger().Warn("Failed to check the rate limit", "key", key, "error", err)
+			return e.Next()
+		}
+		e.Response.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.Burst()))
+		if !ok {
+			e.Response.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			return WriteTooManyRequests(e, "too many requests, try again later", nil)
+		}
+		return e.Next()
+	}
+}
+
+func isRateLimitedPath(urlPath string) bool {
+	for _, prefix := range RateLimitedPrefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
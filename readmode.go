@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// The read modes of the route settings, picking the connection the GET
+// requests of the routes read through.
+const (
+	// ReadModeConcurrent reads through the concurrent pool of PocketBase,
+	// the default.
+	ReadModeConcurrent = "concurrent"
+	// ReadModeReplica reads through ReadReplica, a pool of read-only
+	// connections the writes don't compete with, falling back to the
+	// concurrent pool when it isn't open.
+	ReadModeReplica = "replica"
+	// ReadModePrimary reads through the single connection of the writes,
+	// waiting for them, for the routes that must see the latest write.
+	ReadModePrimary = "primary"
+)
+
+// ReadReplica is the pool of read-only connections to the data database,
+// nil unless READ_REPLICA_CONNS is set.
+var ReadReplica *dbx.DB
+
+// OpenReadReplica opens a pool of at most conns read-only connections to
+// the data database of app. Its statements are logged, traced and measured
+// like the ones of the concurrent pool.
+func OpenReadReplica(app core.App, conns int) (*dbx.DB, error) {
+	dsn := filepath.Join(app.DataDir(), "data.db") + "?_pragma=busy_timeout(10000)&_pragma=query_only(1)&_pragma=cache_size(-16000)"
+	db, err := dbx.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.DB().SetMaxOpenConns(conns)
+	db.DB().SetMaxIdleConns(conns)
+	if concurrent, ok := app.DB().(*dbx.DB); ok {
+		db.QueryLogFunc, db.ExecLogFunc = concurrent.QueryLogFunc, concurrent.ExecLogFunc
+	}
+	return db, nil
+}
+
+// readApp reads through db instead of the concurrent pool. The writes
+// keep using the non-concurrent connection.
+type readApp struct {
+	core.App
+	db dbx.Builder
+}
+
+func (r *readApp) DB() dbx.Builder {
+	return r.db
+}
+
+// withReadMode binds app to the connection the read mode of the route
+// setting of the request picks, for the GET and HEAD requests only.
+func withReadMode(app core.App, e *core.RequestEvent) core.App {
+	if e.Request.Method != http.MethodGet && e.Request.Method != http.MethodHead {
+		return app
+	}
+	setting, _ := RequestRouteSetting(e)
+	switch setting.ReadMode {
+	case ReadModeReplica:
+		if ReadReplica != nil {
+			return &readApp{App: app, db: ReadReplica}
+		}
+	case ReadModePrimary:
+		return &readApp{App: app, db: app.NonconcurrentDB()}
+	}
+	return app
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// ReadOnlyForced is set from READ_ONLY_MODE at startup, outside of the
+// config for ResetDemoData, which only gets the app, to see it too.
+var ReadOnlyForced bool
+
+var ErrReadOnlyForced = errors.New("read-only mode is forced by READ_ONLY_MODE")
+
+type ReadOnlyStatus struct {
+	Enabled bool `json:"enabled"`
+	// Forced is set when READ_ONLY_MODE enables it, which the API can't
+	// undo.
+	Forced bool `json:"forced"`
+}
+
+type ReadOnlyRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// InReadOnly reports whether the whole app is read-only.
+func InReadOnly(settings *RouteSettingsLoader) ReadOnlyStatus {
+	global, _ := settings.Global()
+	return ReadOnlyStatus{Enabled: ReadOnlyForced || global.ReadOnly, Forced: ReadOnlyForced}
+}
+
+// IsReadOnly is InReadOnly read from the database rather than from the
+// settings of a loader.
+func IsReadOnly(app core.App) (bool, error) {
+	if ReadOnlyForced {
+		return true, nil
+	}
+	global, err := RouteSettings.FindOne(app, dbx.HashExp{"prefix": ""})
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return global.ReadOnly, nil
+}
+
+// ReadOnly rejects the writes with 403 while the app, or the route setting
+// of the request, is read-only, e.g. for a public demo. Unlike the
+// maintenance it isn't meant to be waited out. The superusers can still
+// write, to turn it off and for the reset of the demo data.
+func ReadOnly(settings *RouteSettingsLoader) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if !slices.Contains(auditedMethods, e.Request.Method) || e.HasSuperuserAuth() || isMaintenanceExempt(e.Request.URL.Path) {
+			return e.Next()
+		}
+		setting, _ := RequestRouteSetting(e)
+		if setting.ReadOnly || InReadOnly(settings).Enabled {
+			return WriteErrorCode(e, CodeReadOnly, "this deployment is read-only, the changes are disabled", nil)
+		}
+		return e.Next()
+	}
+}
+
+// SetReadOnly turns the read-only mode of the whole app on or off, through
+// the route setting of the empty prefix.
+func SetReadOnly(app core.App, enabled bool) error {
+	return setGlobalRouteSetting(app, "read_only", enabled)
+}
+
+func HandleGetReadOnly(settings *RouteSettingsLoader) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		return WriteOK(e, "", InReadOnly(settings))
+	}
+}
+
+// HandleSetReadOnly turns the read-only mode on or off. The route settings
+// hooks apply it to the next requests.
+func HandleSetReadOnly(app *pocketbase.PocketBase, settings *RouteSettingsLoader) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		rr := ReadOnlyRequest{}
+		if err := BindStrict(e, &rr); err != nil {
+			return WriteBindError(e, err)
+		}
+		if !*rr.Enabled && InReadOnly(settings).Forced {
+			return WriteConflict(e, ErrReadOnlyForced.Error(), nil)
+		}
+		if err := SetReadOnly(WithTrace(app, e), *rr.Enabled); err != nil {
+			return WriteError(e, err, "error setting read-only mode")
+		}
+		app.Logger().Warn("Read-only mode changed", "enabled", *rr.Enabled, "requestId", RequestId(e))
+		return WriteOK(e, "", InReadOnly(settings))
+	}
+}
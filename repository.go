@@ -0,0 +1,588 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+var ErrSoftDeleteDisabled = errors.New("repository has no soft delete column")
+
+// ErrNotFound is returned for the rows that don't exist, are soft deleted
+// or belong to another tenant. It matches sql.ErrNoRows too, which the
+// older callers check for.
+var ErrNotFound error = notFoundError{}
+
+type notFoundError struct{}
+
+func (notFoundError) Error() string {
+	return "not found"
+}
+
+func (notFoundError) Is(target error) bool {
+	return target == sql.ErrNoRows
+}
+
+// notFound translates sql.ErrNoRows to ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Repository reads and writes the rows of a table as values of T, a db
+// tagged struct. The writes retry while the database is busy, see RetryWrite.
+// The string fields of T tagged encrypted:"true" are encrypted at rest with
+// FieldEncryption, see Decrypt.
+type Repository[T any] struct {
+	Table string
+	// SoftDeleteColumn, when set, names a datetime column marking the row
+	// as deleted. Deleted rows are left out of every read and update.
+	SoftDeleteColumn string
+	// TenantColumn, when set, names the column holding the tenant of the
+	// row. The apps scoped with WithTenant only read and write the rows of
+	// their tenant.
+	TenantColumn string
+	// OnWrite, when set, is called after every successful write, e.g. to
+	// invalidate a cache of the table.
+	OnWrite func()
+	// UniqueErrors, when set, maps the columns with a unique index to the
+	// errors reported for their violations by the writes, e.g.
+	// ErrEmailTaken, rather than the driver error.
+	UniqueErrors map[string]error
+	// CreatedColumn and UpdatedColumn, when set, name the autodate columns
+	// the writes set to the current time, which PocketBase only does for
+	// the records it saves itself: Insert sets both, Update, SoftDelete and
+	// Restore the latter.
+	CreatedColumn string
+	UpdatedColumn string
+}
+
+func NewRepository[T any](table string) *Repository[T] {
+	return &Repository[T]{Table: table}
+}
+
+// WithDeleted returns a copy of the repository that also sees the soft
+// deleted rows.
+func (r *Repository[T]) WithDeleted() *Repository[T] {
+	cp := *r
+	cp.SoftDeleteColumn = ""
+	return &cp
+}
+
+// AcrossTenants returns a copy of the repository that sees the rows of
+// every tenant, e.g. to check the uniqueness of an email.
+func (r *Repository[T]) AcrossTenants() *Repository[T] {
+	cp := *r
+	cp.TenantColumn = ""
+	return &cp
+}
+
+// Untouched returns a copy of the repository whose updates leave
+// UpdatedColumn as is, for the columns whose writes aren't changes of the
+// row, e.g. the last time a user was seen.
+func (r *Repository[T]) Untouched() *Repository[T] {
+	cp := *r
+	cp.UpdatedColumn = ""
+	return &cp
+}
+
+func (r *Repository[T]) notDeleted() dbx.Expression {
+	if r.SoftDeleteColumn == "" {
+		return nil
+	}
+	return dbx.HashExp{r.Table + "." + r.SoftDeleteColumn: ""}
+}
+
+// tenant returns the tenant the statements of app are limited to.
+func (r *Repository[T]) tenant(app core.App) (string, bool) {
+	if r.TenantColumn == "" {
+		return "", false
+	}
+	return TenantOf(app)
+}
+
+// scope returns the conditions every read of app is limited to: the rows
+// that aren't deleted, of the tenant of app.
+func (r *Repository[T]) scope(app core.App) dbx.Expression {
+	tenantId, ok := r.tenant(app)
+	if !ok {
+		return r.notDeleted()
+	}
+	return dbx.And(r.notDeleted(), dbx.HashExp{r.Table + "." + r.TenantColumn: tenantId})
+}
+
+// Query starts a SELECT of every column of the table, for the queries the
+// other methods don't cover. Conditions must be added with AndWhere to keep
+// the soft deleted rows and the other tenants out.
+func (r *Repository[T]) Query(app core.App) *dbx.SelectQuery {
+	return app.DB().
+		Select(r.Table + ".*").
+		From(r.Table).
+		Where(r.scope(app))
+}
+
+// byId returns the WHERE clause of the statements on a single row, with the
+// id bound to {:id} and, for the apps scoped to a tenant, the tenant bound
+// to {:tenant}.
+func (r *Repository[T]) byId(app core.App, withDeleted bool) string {
+	where := "[[id]] = {:id}"
+	if r.SoftDeleteColumn != "" && !withDeleted {
+		where += " AND [[" + r.SoftDeleteColumn + "]] = ''"
+	}
+	if _, ok := r.tenant(app); ok {
+		where += " AND [[" + r.TenantColumn + "]] = {:tenant}"
+	}
+	return where
+}
+
+// byIdParams binds the parameters of byId.
+func (r *Repository[T]) byIdParams(app core.App, id string) dbx.Params {
+	params := dbx.Params{"id": id}
+	if tenantId, ok := r.tenant(app); ok {
+		params["tenant"] = tenantId
+	}
+	return params
+}
+
+// statementKey identifies the statements of the repository for Queries.
+func (r *Repository[T]) statementKey(app core.App, kind string, fields ...string) string {
+	tenantColumn := ""
+	if _, ok := r.tenant(app); ok {
+		tenantColumn = r.TenantColumn
+	}
+	return kind + ":" + r.Table + ":" + r.SoftDeleteColumn + ":" + tenantColumn + ":" + strings.Join(fields, ",")
+}
+
+func (r *Repository[T]) Find(app core.App, id string) (*T, error) {
+	sql := Queries.SQL(r.statementKey(app, "find"), func() string {
+		return "SELECT {{" + r.Table + "}}.* FROM {{" + r.Table + "}} WHERE " + r.byId(app, false)
+	})
+	row := new(T)
+	if err := Queries.Query(app.DB(), sql).Bind(r.byIdParams(app, id)).One(row); err != nil {
+		return nil, notFound(err)
+	}
+	return row, r.Decrypt(row)
+}
+
+func (r *Repository[T]) FindOne(app core.App, where dbx.Expression) (*T, error) {
+	row := new(T)
+	if err := andWhere(r.Query(app), where).One(row); err != nil {
+		return nil, notFound(err)
+	}
+	return row, r.Decrypt(row)
+}
+
+// FindAll returns the rows matching opts.Filter, sorted and paged by opts.
+// A zero opts.PerPage returns every matching row.
+func (r *Repository[T]) FindAll(app core.App, opts ListOptions) ([]T, error) {
+	rows := []T{}
+	q := andWhere(r.Query(app), opts.Filter)
+	if opts.PerPage > 0 {
+		q = opts.Apply(q, r.Table)
+	} else {
+		q = opts.ApplySort(q, r.Table)
+	}
+	if err := q.All(&rows); err != nil {
+		return []T{}, err
+	}
+	return rows, r.decryptAll(rows)
+}
+
+// FindAfter returns the rows matching opts.Filter that follow opts.After,
+// plus one extra row when there are more, see NewCursorPage.
+func (r *Repository[T]) FindAfter(app core.App, opts CursorOptions) ([]T, error) {
+	rows := []T{}
+	q := opts.Apply(andWhere(r.Query(app), opts.Filter), r.Table)
+	if err := q.All(&rows); err != nil {
+		return []T{}, err
+	}
+	return rows, r.decryptAll(rows)
+}
+
+func (r *Repository[T]) Count(app core.App, where dbx.Expression) (int, error) {
+	total := 0
+	q := app.DB().
+		Select("COUNT(*)").
+		From(r.Table).
+		Where(r.scope(app))
+	err := andWhere(q, where).Row(&total)
+	return total, err
+}
+
+// andWhere adds the condition to q unless it is nil: dbx builds "()", which
+// isn't valid SQL, for the AND of two nils, e.g. a nil filter on a table
+// without a scope.
+func andWhere(q *dbx.SelectQuery, where dbx.Expression) *dbx.SelectQuery {
+	if where == nil {
+		return q
+	}
+	return q.AndWhere(where)
+}
+
+// Insert writes a new row with the db tagged fields of values, which can be
+// any struct (or pointer to one) and not only T, e.g. a creation request.
+// The rows inserted by an app scoped to a tenant belong to that tenant, and
+// the ones without an id get one from the generator of the table, see NewId.
+func (r *Repository[T]) Insert(app core.App, values any) error {
+	params := NewInsertParams(values)
+	if err := r.encrypt(params); err != nil {
+		return err
+	}
+	if tenantId, ok := r.tenant(app); ok {
+		params[r.TenantColumn] = tenantId
+	}
+	if id, _ := params["id"].(string); id == "" {
+		params["id"] = NewId(r.Table)
+	}
+	now := types.NowDateTime().String()
+	for _, column := range []string{r.CreatedColumn, r.UpdatedColumn} {
+		if _, ok := params[column]; column != "" && !ok {
+			params[column] = now
+		}
+	}
+	err := RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().
+			Insert(r.Table, params).
+			Execute()
+		return err
+	})
+	if err == nil {
+		r.written()
+	}
+	return r.uniqueError(err)
+}
+
+// Update writes the changeset to the row with the given id and returns the
+// number of rows affected.
+func (r *Repository[T]) Update(app core.App, id string, cs Changeset) (int64, error) {
+	if _, ok := cs[r.UpdatedColumn]; r.UpdatedColumn != "" && !ok {
+		cs = maps.Clone(cs)
+		cs[r.UpdatedColumn] = types.NowDateTime().String()
+	}
+	fields := cs.Fields()
+	// the statement is built once per combination of updated fields
+	sql := Queries.SQL(r.statementKey(app, "update", fields...), func() string {
+		set := make([]string, len(fields))
+		for i, field := range fields {
+			set[i] = "[[" + field + "]] = {:p" + strconv.Itoa(i) + "}"
+		}
+		return "UPDATE {{" + r.Table + "}} SET " + strings.Join(set, ", ") + " WHERE " + r.byId(app, false)
+	})
+	params := r.byIdParams(app, id)
+	for i, field := range fields {
+		params["p"+strconv.Itoa(i)] = cs[field]
+	}
+	if err := r.encryptParams(fields, params); err != nil {
+		return 0, err
+	}
+	return r.exec(app, func(db dbx.Builder) *dbx.Query {
+		return Queries.Query(db, sql).Bind(params)
+	})
+}
+
+// Increment adds delta to the integer column of the row with the given id
+// in a single statement, as long as the result stays within [lower, upper], and
+// returns the result. It returns sql.ErrNoRows if the row doesn't exist or
+// the result would be out of bounds.
+func (r *Repository[T]) Increment(app core.App, id string, column string, delta int64, lower int64, upper int64) (int64, error) {
+	touch := r.UpdatedColumn != ""
+	sql := Queries.SQL(r.statementKey(app, "increment", column, strconv.FormatBool(touch)), func() string {
+		set := "[[" + column + "]] = [[" + column + "]] + {:delta}"
+		if touch {
+			set += ", [[" + r.UpdatedColumn + "]] = {:now}"
+		}
+		return "UPDATE {{" + r.Table + "}} SET " + set + " WHERE " + r.byId(app, false) +
+			" AND [[" + column + "]] + {:delta} BETWEEN {:min} AND {:max} RETURNING [[" + column + "]]"
+	})
+	params := r.byIdParams(app, id)
+	params["delta"] = delta
+	params["min"] = lower
+	params["max"] = upper
+	params["now"] = types.NowDateTime().String()
+
+	var value int64
+	err := RetryWrite(app, func() error {
+		return Queries.Query(app.NonconcurrentDB(), sql).Bind(params).Row(&value)
+	})
+	if err != nil {
+		return 0, err
+	}
+	r.written()
+	return value, nil
+}
+
+// Delete permanently removes the row with the given id, soft deleted or
+// not, and returns the number of rows affected.
+func (r *Repository[T]) Delete(app core.App, id string) (int64, error) {
+	sql := Queries.SQL(r.statementKey(app, "delete"), func() string {
+		return "DELETE FROM {{" + r.Table + "}} WHERE " + r.byId(app, true)
+	})
+	return r.exec(app, func(db dbx.Builder) *dbx.Query {
+		return Queries.Query(db, sql).Bind(r.byIdParams(app, id))
+	})
+}
+
+// SoftDelete marks the row with the given id as deleted at now. It affects
+// no rows if the row doesn't exist or is already deleted.
+func (r *Repository[T]) SoftDelete(app core.App, id string, now time.Time) (int64, error) {
+	if r.SoftDeleteColumn == "" {
+		return 0, ErrSoftDeleteDisabled
+	}
+	deletedAt, err := types.ParseDateTime(now)
+	if err != nil {
+		return 0, err
+	}
+	return r.Update(app, id, Changeset{r.SoftDeleteColumn: deletedAt.String()})
+}
+
+// Restore clears the soft delete mark of the row with the given id. It
+// affects no rows if the row doesn't exist or isn't deleted.
+func (r *Repository[T]) Restore(app core.App, id string) (int64, error) {
+	if r.SoftDeleteColumn == "" {
+		return 0, ErrSoftDeleteDisabled
+	}
+	return r.exec(app, func(db dbx.Builder) *dbx.Query {
+		where := dbx.HashExp{"id": id}
+		if tenantId, ok := r.tenant(app); ok {
+			where[r.TenantColumn] = tenantId
+		}
+		params := dbx.Params{r.SoftDeleteColumn: ""}
+		if r.UpdatedColumn != "" {
+			params[r.UpdatedColumn] = types.NowDateTime().String()
+		}
+		return db.Update(r.Table, params, dbx.And(
+			where,
+			dbx.Not(dbx.HashExp{r.SoftDeleteColumn: ""}),
+		))
+	})
+}
+
+func (r *Repository[T]) exec(app core.App, query func(db dbx.Builder) *dbx.Query) (int64, error) {
+	var affected int64
+	err := RetryWrite(app, func() error {
+		res, err := query(app.NonconcurrentDB()).Execute()
+		if err != nil {
+			return err
+		}
+		affected, err = res.RowsAffected()
+		return err
+	})
+	if err == nil && affected > 0 {
+		r.written()
+	}
+	return affected, r.uniqueError(err)
+}
+
+func (r *Repository[T]) written() {
+	if r.OnWrite != nil {
+		r.OnWrite()
+	}
+}
+
+// uniqueError returns the error of UniqueErrors for the unique constraint
+// violations of err, err itself otherwise.
+func (r *Repository[T]) uniqueError(err error) error {
+	if err == nil {
+		return nil
+	}
+	_, columns, ok := strings.Cut(err.Error(), "UNIQUE constraint failed: ")
+	if !ok {
+		return err
+	}
+	for column, uniqueErr := range r.UniqueErrors {
+		if strings.Contains(columns, r.Table+"."+column) {
+			return uniqueErr
+		}
+	}
+	return err
+}
+
+// encryptedColumns returns the columns of the fields of T tagged
+// encrypted:"true".
+func (r *Repository[T]) encryptedColumns() []string {
+	t := reflect.TypeFor[T]()
+	columns := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("encrypted") == "true" {
+			columns = append(columns, t.Field(i).Tag.Get("db"))
+		}
+	}
+	return columns
+}
+
+// encryptValue encrypts the value written to the encrypted column.
+func (r *Repository[T]) encryptValue(column string, value any) (any, error) {
+	s, ok := value.(string)
+	if !ok || s == "" {
+		return value, nil
+	}
+	if FieldEncryption == nil {
+		return nil, ErrFieldKeyRequired
+	}
+	return FieldEncryption.Encrypt(r.Table+"."+column, s)
+}
+
+// encrypt encrypts the encrypted columns of the params of an insert.
+func (r *Repository[T]) encrypt(params dbx.Params) error {
+	for _, column := range r.encryptedColumns() {
+		if value, ok := params[column]; ok {
+			encrypted, err := r.encryptValue(column, value)
+			if err != nil {
+				return err
+			}
+			params[column] = encrypted
+		}
+	}
+	return nil
+}
+
+// encryptParams encrypts the params of an update, {:p<i>} being the value
+// of fields[i].
+func (r *Repository[T]) encryptParams(fields []string, params dbx.Params) error {
+	encrypted := r.encryptedColumns()
+	for i, field := range fields {
+		if slices.Contains(encrypted, field) {
+			value, err := r.encryptValue(field, params["p"+strconv.Itoa(i)])
+			if err != nil {
+				return err
+			}
+			params["p"+strconv.Itoa(i)] = value
+		}
+	}
+	return nil
+}
+
+// Decrypt decrypts the encrypted fields of the rows, for those read with
+// Query rather than the finders, which decrypt them.
+func (r *Repository[T]) Decrypt(rows ...*T) error {
+	columns := r.encryptedColumns()
+	if len(columns) == 0 {
+		return nil
+	}
+	for _, row := range rows {
+		v := reflect.ValueOf(row).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.Tag.Get("encrypted") != "true" || !IsEncrypted(v.Field(i).String()) {
+				continue
+			}
+			if FieldEncryption == nil {
+				return ErrFieldKeyRequired
+			}
+			plain, err := FieldEncryption.Decrypt(r.Table+"."+field.Tag.Get("db"), v.Field(i).String())
+			if err != nil {
+				return err
+			}
+			v.Field(i).SetString(plain)
+		}
+	}
+	return nil
+}
+
+// Reencrypt rewrites the encrypted columns of the rows whose values aren't
+// encrypted with the primary key, e.g. once a new key was added or for the
+// values written before the column was encrypted. It goes through every
+// row, soft deleted or of any tenant, batchSize rows at a time, leaving
+// UpdatedColumn as is, and returns the number of rows rewritten.
+func (r *Repository[T]) Reencrypt(app core.App, batchSize int) (int, error) {
+	columns := r.encryptedColumns()
+	if len(columns) == 0 {
+		return 0, nil
+	}
+	if FieldEncryption == nil {
+		return 0, ErrFieldKeyRequired
+	}
+	rewritten, after := 0, ""
+	for {
+		rows := []dbx.NullStringMap{}
+		err := app.DB().
+			Select(append([]string{"id"}, columns...)...).
+			From(r.Table).
+			Where(dbx.NewExp("[[id]] > {:after}", dbx.Params{"after": after})).
+			OrderBy("id").
+			Limit(int64(batchSize)).
+			All(&rows)
+		if err != nil {
+			return rewritten, err
+		}
+		for _, row := range rows {
+			after = row["id"].String
+			params := dbx.Params{}
+			for _, column := range columns {
+				value := row[column].String
+				if !FieldEncryption.NeedsReencryption(value) {
+					continue
+				}
+				plain, err := FieldEncryption.Decrypt(r.Table+"."+column, value)
+				if err != nil {
+					return rewritten, fmt.Errorf("row %s: %w", after, err)
+				}
+				if params[column], err = FieldEncryption.Encrypt(r.Table+"."+column, plain); err != nil {
+					return rewritten, err
+				}
+			}
+			if len(params) == 0 {
+				continue
+			}
+			err := RetryWrite(app, func() error {
+				_, err := app.NonconcurrentDB().Update(r.Table, params, dbx.HashExp{"id": after}).Execute()
+				return err
+			})
+			if err != nil {
+				return rewritten, err
+			}
+			rewritten++
+		}
+		if len(rows) == 0 || len(rows) < batchSize {
+			break
+		}
+	}
+	if rewritten > 0 {
+		r.written()
+	}
+	return rewritten, nil
+}
+
+func (r *Repository[T]) decryptAll(rows []T) error {
+	for i := range rows {
+		if err := r.Decrypt(&rows[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewInsertParams collects the db tagged fields of v (a struct or a pointer
+// to one), dereferencing pointers and skipping the nil ones.
+func NewInsertParams(v any) dbx.Params {
+	params := dbx.Params{}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		col := t.Field(i).Tag.Get("db")
+		f := rv.Field(i)
+		if col == "" || col == "-" {
+			continue
+		}
+		if f.Kind() == reflect.Pointer {
+			if f.IsNil() {
+				continue
+			}
+			f = f.Elem()
+		}
+		params[col] = f.Interface()
+	}
+	return params
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+const requestIdKey = "requestId"
+
+// validRequestId matches the upstream request ids (e.g. from a load
+// balancer) that are safe to reuse and log.
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// unloggedPaths are the health probes, which would flood the logs.
+var unloggedPaths = []string{"/healthz", "/readyz"}
+
+// IsPocketBasePath reports whether urlPath belongs to PocketBase's own API
+// or admin UI rather than to the custom routes.
+func IsPocketBasePath(urlPath string) bool {
+	return strings.HasPrefix(urlPath, "/api/") || strings.HasPrefix(urlPath, "/_/")
+}
+
+// shouldLogRequest skips the paths PocketBase already logs and the probes.
+func shouldLogRequest(urlPath string) bool {
+	return !IsPocketBasePath(urlPath) && !slices.Contains(unloggedPaths, urlPath)
+}
+
+func NewRequestId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// RequestId returns the id assigned to the request by LogRequests, or an
+// empty string if it didn't run.
+func RequestId(e *core.RequestEvent) string {
+	id, _ := e.Get(requestIdKey).(string)
+	return id
+}
+
+// LogRequests assigns every request an id, reusing a valid X-Request-Id
+// from upstream, and echoes it in the response headers. The requests that
+// PocketBase doesn't log itself are logged with their status and latency.
+func LogRequests(app core.App) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		id := e.Request.Header.Get(RequestIdHeader)
+		if !validRequestId.MatchString(id) {
+			id = NewRequestId()
+		}
+		e.Set(requestIdKey, id)
+		e.Response.Header().Set(RequestIdHeader, id)
+
+		if !shouldLogRequest(e.Request.URL.Path) {
+			return e.Next()
+		}
+
+		start := time.Now()
+		err := e.Next()
+
+		status := e.Status()
+		if err != nil && status == 0 {
+			status = http.StatusInternalServerError
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if status >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+
+		attrs := []any{
+			"requestId", id,
+			"method", e.Request.Method,
+			"path", e.Request.URL.Path,
+			"status", status,
+			"latency", time.Since(start).String(),
+			"ip", e.RealIP(),
+		}
+		if e.Auth != nil {
+			attrs = append(attrs, "auth", e.Auth.Id)
+		}
+		if err != nil {
+			attrs = append(attrs, "error", err.Error())
+		}
+		app.Logger().Log(e.Request.Context(), level, e.Request.Method+" "+e.Request.URL.Path, attrs...)
+
+		return err
+	}
+}
@@ -0,0 +1,288 @@
+// Package resilience guards the calls to the downstream dependencies, e.g.
+// the webhook endpoints, the mail server and the external APIs, with a
+// circuit breaker, a bulkhead bounding the concurrent calls and a timeout,
+// so that a flaky dependency fails fast instead of holding up the handlers
+// and the workers waiting on it.
+package resilience
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The states of a circuit breaker.
+const (
+	// StateClosed lets the calls through, counting the consecutive failures.
+	StateClosed = "closed"
+	// StateOpen refuses the calls until OpenTimeout passed.
+	StateOpen = "open"
+	// StateHalfOpen lets a single probe call through, which closes the
+	// breaker if it succeeds and opens it again otherwise.
+	StateHalfOpen = "half-open"
+)
+
+var (
+	ErrOpen         = errors.New("circuit breaker is open")
+	ErrBulkheadFull = errors.New("too many concurrent calls")
+)
+
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 30 * time.Second
+	DefaultMaxConcurrent    = 16
+)
+
+type Options struct {
+	// FailureThreshold is the number of consecutive failures opening the
+	// breaker.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before letting a probe
+	// call through.
+	OpenTimeout time.Duration
+	// MaxConcurrent bounds the calls in flight, the others failing right
+	// away with ErrBulkheadFull.
+	MaxConcurrent int
+	// Timeout bounds the calls made through Do, none when 0.
+	Timeout time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = DefaultFailureThreshold
+	}
+	if o.OpenTimeout <= 0 {
+		o.OpenTimeout = DefaultOpenTimeout
+	}
+	if o.MaxConcurrent <= 0 {
+		o.MaxConcurrent = DefaultMaxConcurrent
+	}
+	return o
+}
+
+// Snapshot describes a guard for the metrics and the health reports.
+type Snapshot struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	InFlight int    `json:"inFlight"`
+	// OpenedAt is the RFC 3339 time the breaker last opened.
+	OpenedAt string `json:"openedAt,omitempty"`
+	// Rejected counts the calls refused by the open breaker and by the full
+	// bulkhead, since the process started.
+	RejectedOpen int64 `json:"rejectedOpen"`
+	RejectedFull int64 `json:"rejectedFull"`
+}
+
+// Guard is the circuit breaker and the bulkhead of a dependency. It is safe
+// for concurrent use.
+type Guard struct {
+	name string
+	opts Options
+	sem  chan struct{}
+
+	mu           sync.Mutex
+	state        string
+	failures     int
+	openedAt     time.Time
+	probing      bool
+	rejectedOpen int64
+	rejectedFull int64
+}
+
+func NewGuard(name string, opts Options) *Guard {
+	opts = opts.withDefaults()
+	return &Guard{
+		name:  name,
+		opts:  opts,
+		sem:   make(chan struct{}, opts.MaxConcurrent),
+		state: StateClosed,
+	}
+}
+
+func (g *Guard) Name() string {
+	return g.name
+}
+
+// enter takes a slot of the bulkhead and asks the breaker for the call,
+// returning the func reporting its outcome.
+func (g *Guard) enter() (func(failed bool), error) {
+	select {
+	case g.sem <- struct{}{}:
+	default:
+		g.mu.Lock()
+		g.rejectedFull++
+		g.mu.Unlock()
+		return nil, ErrBulkheadFull
+	}
+
+	g.mu.Lock()
+	probe := false
+	switch g.state {
+	case StateOpen:
+		if time.Since(g.openedAt) < g.opts.OpenTimeout {
+			g.rejectedOpen++
+			g.mu.Unlock()
+			<-g.sem
+			return nil, ErrOpen
+		}
+		g.state = StateHalfOpen
+		fallthrough
+	case StateHalfOpen:
+		if g.probing {
+			g.rejectedOpen++
+			g.mu.Unlock()
+			<-g.sem
+			return nil, ErrOpen
+		}
+		g.probing, probe = true, true
+	}
+	g.mu.Unlock()
+
+	return func(failed bool) {
+		defer func() { <-g.sem }()
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if probe {
+			g.probing = false
+		}
+		if !failed {
+			g.state, g.failures = StateClosed, 0
+			return
+		}
+		g.failures++
+		if probe || (g.state == StateClosed && g.failures >= g.opts.FailureThreshold) {
+			g.state, g.openedAt = StateOpen, time.Now()
+		}
+	}, nil
+}
+
+// Do calls fn, with the Timeout of the guard, unless the breaker is open or
+// the bulkhead full. The errors of fn count as failures, except the
+// cancellation of ctx by the caller. fn must return once its ctx is done.
+func (g *Guard) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	done, err := g.enter()
+	if err != nil {
+		return err
+	}
+	callCtx := ctx
+	if g.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, g.opts.Timeout)
+		defer cancel()
+	}
+	err = fn(callCtx)
+	done(err != nil && !(errors.Is(err, context.Canceled) && ctx.Err() != nil))
+	return err
+}
+
+// Transport guards the requests sent through next, http.DefaultTransport
+// when nil. The failed requests and the 5xx and 429 responses count as
+// failures. The slot of the bulkhead is released once the response headers
+// are read, the timeout being the one of the http.Client.
+func (g *Guard) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		return g.roundTrip(next, req)
+	})
+}
+
+func (g *Guard) roundTrip(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	done, err := g.enter()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		done(!(errors.Is(err, context.Canceled) && req.Context().Err() != nil))
+		return nil, err
+	}
+	done(resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests)
+	return resp, nil
+}
+
+func (g *Guard) Snapshot() Snapshot {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := Snapshot{
+		Name:         g.name,
+		State:        g.state,
+		Failures:     g.failures,
+		InFlight:     len(g.sem),
+		RejectedOpen: g.rejectedOpen,
+		RejectedFull: g.rejectedFull,
+	}
+	// an open breaker past its timeout lets the next call through
+	if s.State == StateOpen && time.Since(g.openedAt) >= g.opts.OpenTimeout {
+		s.State = StateHalfOpen
+	}
+	if !g.openedAt.IsZero() {
+		s.OpenedAt = g.openedAt.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+type roundTripper func(req *http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Registry holds the guards of the dependencies, by name, created with the
+// options of the registry on first use.
+type Registry struct {
+	opts Options
+
+	mu     sync.Mutex
+	guards map[string]*Guard
+}
+
+func NewRegistry(opts Options) *Registry {
+	return &Registry{opts: opts.withDefaults(), guards: map[string]*Guard{}}
+}
+
+// Guard returns the guard of the dependency name.
+func (r *Registry) Guard(name string) *Guard {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.guards[name]
+	if !ok {
+		g = NewGuard(name, r.opts)
+		r.guards[name] = g
+	}
+	return g
+}
+
+// Client returns an http.Client with timeout whose requests are guarded
+// per host, as name/host, so that a failing host of a dependency calling
+// many, e.g. the webhook endpoints, doesn't trip the others.
+func (r *Registry) Client(name string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: roundTripper(func(req *http.Request) (*http.Response, error) {
+			return r.Guard(name+"/"+req.URL.Host).roundTrip(http.DefaultTransport, req)
+		}),
+	}
+}
+
+// Snapshots describes every guard, sorted by name.
+func (r *Registry) Snapshots() []Snapshot {
+	r.mu.Lock()
+	guards := make([]*Guard, 0, len(r.guards))
+	for _, g := range r.guards {
+		guards = append(guards, g)
+	}
+	r.mu.Unlock()
+
+	snapshots := make([]Snapshot, len(guards))
+	for i, g := range guards {
+		snapshots[i] = g.Snapshot()
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return snapshots
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// The targets the retention rules can apply to.
+const (
+	RetentionUnverifiedUsers    = "unverified_users"
+	RetentionDeletedUsers       = "deleted_users"
+	RetentionAuditLogs          = "audit_logs"
+	RetentionFinishedJobs       = "finished_jobs"
+	RetentionReviewedModeration = "reviewed_moderation"
+)
+
+// What started a retention run.
+const (
+	RetentionTriggerSchedule = "schedule"
+	RetentionTriggerManual   = "manual"
+)
+
+// retentionJobPrefix keeps the ids of the retention rules apart from the
+// other cron jobs of the app.
+const retentionJobPrefix = "retention:"
+
+const retentionReportsCleanupJobName = "retention_reports_cleanup"
+
+// retentionSampleSize caps the ids kept in the report of a run.
+const retentionSampleSize = 20
+
+var ErrRetentionRunning = errors.New("the retention rule is already running")
+
+// RetentionTarget is what a retention rule deletes: the rows of Table
+// matching Scope whose AgeColumn is older than the max age of the rule.
+type RetentionTarget struct {
+	Table     string
+	AgeColumn string
+	// Scope limits the rows of the table, e.g. to the unverified users.
+	Scope dbx.Expression
+	// FilterFields are the fields the filter of a rule can narrow the rows
+	// down with.
+	FilterFields map[string]FilterType
+	// Delete deletes the rows with the ids, returning how many it did.
+	Delete func(app core.App, ids []string) (int, error)
+}
+
+var (
+	retentionTargetsMu sync.RWMutex
+	retentionTargets   = map[string]RetentionTarget{}
+)
+
+func RegisterRetentionTarget(name string, target RetentionTarget) {
+	retentionTargetsMu.Lock()
+	defer retentionTargetsMu.Unlock()
+	retentionTargets[name] = target
+}
+
+func getRetentionTarget(name string) (RetentionTarget, bool) {
+	retentionTargetsMu.RLock()
+	defer retentionTargetsMu.RUnlock()
+	target, ok := retentionTargets[name]
+	return target, ok
+}
+
+// RetentionTargetNames returns the names of the registered targets,
+// sorted.
+func RetentionTargetNames() []string {
+	retentionTargetsMu.RLock()
+	defer retentionTargetsMu.RUnlock()
+	names := make([]string, 0, len(retentionTargets))
+	for name := range retentionTargets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterRetentionTarget(RetentionUnverifiedUsers, RetentionTarget{
+		Table:        Users.Table,
+		AgeColumn:    "created",
+		Scope:        dbx.HashExp{"verified": false, "deleted_at": ""},
+		FilterFields: UserFilterFields,
+		Delete:       deleteRetainedUsers,
+	})
+	RegisterRetentionTarget(RetentionDeletedUsers, RetentionTarget{
+		Table:        Users.Table,
+		AgeColumn:    "deleted_at",
+		Scope:        dbx.Not(dbx.HashExp{"deleted_at": ""}),
+		FilterFields: UserFilterFields,
+		Delete:       deleteRetainedUsers,
+	})
+	RegisterRetentionTarget(RetentionAuditLogs, RetentionTarget{
+		Table:        AuditLogs.Table,
+		AgeColumn:    "created",
+		FilterFields: AuditFilterFields,
+		Delete:       deleteRetainedRows(AuditLogs.Table),
+	})
+	RegisterRetentionTarget(RetentionFinishedJobs, RetentionTarget{
+		Table:        Jobs.Table,
+		AgeColumn:    "updated",
+		Scope:        dbx.In("status", JobSucceeded, JobFailed, JobCanceled),
+		FilterFields: JobFilterFields,
+		Delete:       deleteRetainedRows(Jobs.Table),
+	})
+	RegisterRetentionTarget(RetentionReviewedModeration, RetentionTarget{
+		Table:        ModerationItems.Table,
+		AgeColumn:    "updated",
+		Scope:        dbx.In("status", ModerationApproved, ModerationRejected),
+		FilterFields: ModerationFilterFields,
+		Delete:       deleteRetainedRows(ModerationItems.Table),
+	})
+}
+
+// deleteRetainedUsers hard deletes the users one by one, with their user
+// events, so that a user failing doesn't keep the others.
+func deleteRetainedUsers(app core.App, ids []string) (int, error) {
+	users := NewUserService(app)
+	deleted := 0
+	errs := []error{}
+	for _, id := range ids {
+		if err := users.HardDelete(id, nil); err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		deleted++
+	}
+	return deleted, errors.Join(errs...)
+}
+
+func deleteRetainedRows(table string) func(app core.App, ids []string) (int, error) {
+	return func(app core.App, ids []string) (int, error) {
+		var affected int64
+		err := RetryWrite(app, func() error {
+			result, err := app.NonconcurrentDB().Delete(table, dbx.In("id", toAny(ids)...)).Execute()
+			if err != nil {
+				return err
+			}
+			affected, err = result.RowsAffected()
+			return err
+		})
+		return int(affected), err
+	}
+}
+
+type RetentionRule struct {
+	Id         string `db:"id" json:"id"`
+	Name       string `db:"name" json:"name"`
+	Target     string `db:"target" json:"target"`
+	MaxAgeDays int    `db:"max_age_days" json:"maxAgeDays"`
+	Filter     string `db:"filter" json:"filter"`
+	Schedule   string `db:"schedule" json:"schedule"`
+	Enabled    bool   `db:"enabled" json:"enabled"`
+	Created    string `db:"created" json:"created"`
+	Updated    string `db:"updated" json:"updated"`
+}
+
+var RetentionRules = NewRepository[RetentionRule]("retention_rules")
+
+// RetentionRun is the report of a run of a rule, in retention_runs.
+// Matched counts every row past the max age, Deleted and Failed the ones
+// of the at most RETENTION_MAX_PER_RUN the run went through.
+type RetentionRun struct {
+	Id        string        `db:"id" json:"id"`
+	Rule      string        `db:"rule" json:"rule"`
+	RuleName  string        `db:"rule_name" json:"ruleName"`
+	Target    string        `db:"target" json:"target"`
+	DryRun    bool          `db:"dry_run" json:"dryRun"`
+	Trigger   string        `db:"trigger" json:"trigger"`
+	Cutoff    string        `db:"cutoff" json:"cutoff"`
+	Matched   int           `db:"matched" json:"matched"`
+	Deleted   int           `db:"deleted" json:"deleted"`
+	Failed    int           `db:"failed" json:"failed"`
+	SampleIds types.JSONRaw `db:"sample_ids" json:"sampleIds"`
+	Error     string        `db:"error" json:"error"`
+	Started   string        `db:"started" json:"started"`
+	Finished  string        `db:"finished" json:"finished"`
+	Created   string        `db:"created" json:"created"`
+}
+
+// retentionRunEntry is the row of a run report.
+type retentionRunEntry struct {
+	Id        string        `db:"id"`
+	Rule      string        `db:"rule"`
+	RuleName  string        `db:"rule_name"`
+	Target    string        `db:"target"`
+	DryRun    bool          `db:"dry_run"`
+	Trigger   string        `db:"trigger"`
+	Cutoff    string        `db:"cutoff"`
+	Matched   int           `db:"matched"`
+	Deleted   int           `db:"deleted"`
+	Failed    int           `db:"failed"`
+	SampleIds types.JSONRaw `db:"sample_ids"`
+	Error     string        `db:"error"`
+	Started   string        `db:"started"`
+	Finished  string        `db:"finished"`
+}
+
+var RetentionRuns = &Repository[RetentionRun]{
+	Table:         "retention_runs",
+	CreatedColumn: "created",
+}
+
+var RetentionRunSortFields = []string{"created", "started"}
+
+var RetentionRunFilterFields = map[string]FilterType{
+	"rule":    FilterString,
+	"target":  FilterString,
+	"dry_run": FilterBool,
+	"trigger": FilterString,
+}
+
+// RetentionRuleStatus describes a rule for GET /admin/retention/rules.
+type RetentionRuleStatus struct {
+	RetentionRule
+	Running   bool   `json:"running"`
+	RuleError string `json:"ruleError,omitempty"`
+}
+
+// ValidateRetentionRule checks the target, the filter and, for the enabled
+// rules, the schedule of the rule.
+func ValidateRetentionRule(rule RetentionRule) error {
+	errs := validation.Errors{}
+	target, ok := getRetentionTarget(rule.Target)
+	if !ok {
+		errs["target"] = fmt.Errorf("unknown target, expected one of %v", RetentionTargetNames())
+	} else if _, err := ParseFilter(rule.Filter, target.FilterFields); err != nil {
+		errs["filter"] = err
+	}
+	if rule.MaxAgeDays < 1 {
+		errs["max_age_days"] = errors.New("must be at least 1")
+	}
+	if rule.Enabled {
+		if _, err := cron.NewSchedule(rule.Schedule); err != nil {
+			errs["schedule"] = err
+		}
+	}
+	return errs.Filter()
+}
+
+// RetentionEngine runs the retention_rules on their schedules, following
+// the changes made to the rules, and reports every run in retention_runs.
+type RetentionEngine struct {
+	app       core.App
+	maxPerRun int
+
+	mu         sync.Mutex
+	scheduled  []string
+	running    map[string]bool
+	ruleErrors map[string]string
+}
+
+func NewRetentionEngine(app core.App, maxPerRun int) *RetentionEngine {
+	return &RetentionEngine{
+		app:        app,
+		maxPerRun:  maxPerRun,
+		running:    map[string]bool{},
+		ruleErrors: map[string]string{},
+	}
+}
+
+// Bind validates the rules written through the records API and the admin
+// UI, and schedules them on serve and again whenever they change.
+func (r *RetentionEngine) Bind(app core.App) {
+	app.OnRecordValidate(RetentionRules.Table).BindFunc(func(e *core.RecordEvent) error {
+		err := ValidateRetentionRule(RetentionRule{
+			Target:     e.Record.GetString("target"),
+			MaxAgeDays: e.Record.GetInt("max_age_days"),
+			Filter:     e.Record.GetString("filter"),
+			Schedule:   e.Record.GetString("schedule"),
+			Enabled:    e.Record.GetBool("enabled"),
+		})
+		if err != nil {
+			return err
+		}
+		return e.Next()
+	})
+	app.OnServe().BindFunc(func(e *core.ServeEvent) error {
+		if err := r.Reload(); err != nil {
+			app.Logger().Error("Failed to schedule the retention rules", "error", err)
+		}
+		return e.Next()
+	})
+	reload := func(e *core.RecordEvent) error {
+		if err := r.Reload(); err != nil {
+			e.App.Logger().Error("Failed to reschedule the retention rules", "error", err)
+		}
+		return e.Next()
+	}
+	app.OnRecordAfterCreateSuccess(RetentionRules.Table).BindFunc(reload)
+	app.OnRecordAfterUpdateSuccess(RetentionRules.Table).BindFunc(reload)
+	app.OnRecordAfterDeleteSuccess(RetentionRules.Table).BindFunc(reload)
+}
+
+// Reload reads retention_rules and (re)schedules the enabled ones. An
+// invalid rule is only skipped, reported in its status.
+func (r *RetentionEngine) Reload() error {
+	rules, err := RetentionRules.FindAll(r.app, ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, jobId := range r.scheduled {
+		r.app.Cron().Remove(jobId)
+	}
+	r.scheduled = nil
+	r.ruleErrors = map[string]string{}
+	for _, rule := range rules {
+		if err := ValidateRetentionRule(rule); err != nil {
+			r.ruleErrors[rule.Id] = err.Error()
+			continue
+		}
+		if !rule.Enabled {
+			continue
+		}
+		ruleId := rule.Id
+		r.scheduled = append(r.scheduled, retentionJobPrefix+ruleId)
+		r.app.Cron().MustAdd(retentionJobPrefix+ruleId, rule.Schedule, func() {
+			_, err := r.Run(ruleId, false, RetentionTriggerSchedule, time.Now())
+			if err != nil && !errors.Is(err, ErrRetentionRunning) {
+				r.app.Logger().Error("Retention rule failed", "rule", ruleId, "error", err)
+			}
+		})
+	}
+	return nil
+}
+
+func (r *RetentionEngine) Statuses() ([]RetentionRuleStatus, error) {
+	rules, err := RetentionRules.FindAll(r.app, ListOptions{Sort: []SortField{{Field: "name"}}})
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]RetentionRuleStatus, len(rules))
+	for i, rule := range rules {
+		statuses[i] = RetentionRuleStatus{
+			RetentionRule: rule,
+			Running:       r.running[rule.Id],
+			RuleError:     r.ruleErrors[rule.Id],
+		}
+	}
+	return statuses, nil
+}
+
+// Run applies the rule at now, unless it is already running, and reports
+// the run. A dry run only counts the rows past the max age and samples
+// their ids. A run deletes at most RETENTION_MAX_PER_RUN rows, the oldest
+// first, leaving the others to the next runs.
+func (r *RetentionEngine) Run(ruleId string, dryRun bool, trigger string, now time.Time) (*RetentionRun, error) {
+	rule, err := RetentionRules.Find(r.app, ruleId)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateRetentionRule(*rule); err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		r.mu.Lock()
+		if r.running[ruleId] {
+			r.mu.Unlock()
+			return nil, ErrRetentionRunning
+		}
+		r.running[ruleId] = true
+		r.mu.Unlock()
+		defer func() {
+			r.mu.Lock()
+			delete(r.running, ruleId)
+			r.mu.Unlock()
+		}()
+	}
+
+	target, _ := getRetentionTarget(rule.Target)
+	filter, _ := ParseFilter(rule.Filter, target.FilterFields)
+	cutoff, err := types.ParseDateTime(now.AddDate(0, 0, -rule.MaxAgeDays))
+	if err != nil {
+		return nil, err
+	}
+	entry := retentionRunEntry{
+		Id:       NewId(RetentionRuns.Table),
+		Rule:     rule.Id,
+		RuleName: rule.Name,
+		Target:   rule.Target,
+		DryRun:   dryRun,
+		Trigger:  trigger,
+		Cutoff:   cutoff.String(),
+		Started:  types.NowDateTime().String(),
+	}
+	runErr := r.apply(&entry, target, filter, cutoff, dryRun)
+	if runErr != nil {
+		entry.Error = runErr.Error()
+	}
+	entry.Finished = types.NowDateTime().String()
+
+	var run *RetentionRun
+	err = RetentionRuns.Insert(r.app, entry)
+	if err == nil {
+		run, err = RetentionRuns.Find(r.app, entry.Id)
+	}
+	if err != nil {
+		return nil, errors.Join(runErr, fmt.Errorf("error writing the retention run report: %w", err))
+	}
+	if runErr != nil {
+		r.app.Logger().Warn("Retention run failed", "rule", rule.Name, "deleted", entry.Deleted, "failed", entry.Failed, "error", runErr)
+	}
+	return run, nil
+}
+
+// apply counts the rows of the rule past cutoff and, unless dryRun,
+// deletes them, filling in the report.
+func (r *RetentionEngine) apply(entry *retentionRunEntry, target RetentionTarget, filter dbx.Expression, cutoff types.DateTime, dryRun bool) error {
+	where := dbx.And(
+		target.Scope,
+		filter,
+		dbx.NewExp(fmt.Sprintf("[[%s]] < {:cutoff}", target.AgeColumn), dbx.Params{"cutoff": cutoff.String()}),
+	)
+	var matched int
+	if err := r.app.DB().Select("COUNT(*)").From(target.Table).Where(where).Row(&matched); err != nil {
+		return err
+	}
+	entry.Matched = matched
+
+	ids := []string{}
+	q := r.app.DB().Select("id").From(target.Table).Where(where).OrderBy(target.AgeColumn, "id")
+	if dryRun {
+		q.Limit(retentionSampleSize)
+	} else {
+		q.Limit(int64(r.maxPerRun))
+	}
+	if err := q.Column(&ids); err != nil {
+		return err
+	}
+	sample, _ := json.Marshal(ids[:min(len(ids), retentionSampleSize)])
+	entry.SampleIds = sample
+	if dryRun || len(ids) == 0 {
+		return nil
+	}
+
+	deleted, err := target.Delete(r.app, ids)
+	entry.Deleted = deleted
+	entry.Failed = len(ids) - deleted
+	return err
+}
+
+// DeleteRetentionReports removes the run reports older than retention.
+func DeleteRetentionReports(app core.App, retention time.Duration) error {
+	cutoff, err := types.ParseDateTime(time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	return RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().Delete(RetentionRuns.Table, dbx.NewExp(
+			"[[created]] < {:cutoff}", dbx.Params{"cutoff": cutoff.String()},
+		)).Execute()
+		return err
+	})
+}
+
+func ScheduleRetentionReportsCleanup(app core.App, retention time.Duration) {
+	app.Cron().MustAdd(retentionReportsCleanupJobName, "15 3 * * *", func() {
+		if err := DeleteRetentionReports(app, retention); err != nil {
+			app.Logger().Warn("Failed to delete retention run reports", "error", err)
+		}
+	})
+}
+
+func HandleListRetentionRules(engine *RetentionEngine) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		statuses, err := engine.Statuses()
+		if err != nil {
+			return WriteError(e, err, "error getting retention rules")
+		}
+		return WriteOK(e, "", statuses)
+	}
+}
+
+// HandleRunRetentionRule runs the rule of the path now, or only previews
+// it when dryRun, responding with the report of the run.
+func HandleRunRetentionRule(engine *RetentionEngine, dryRun bool) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		run, err := engine.Run(e.Request.PathValue("ruleId"), dryRun, RetentionTriggerManual, time.Now())
+		if errors.Is(err, ErrNotFound) {
+			return WriteNotFound(e, "retention rule not found", nil)
+		}
+		if errors.Is(err, ErrRetentionRunning) {
+			return WriteConflict(e, err.Error(), nil)
+		}
+		var validationErrs validation.Errors
+		if errors.As(err, &validationErrs) {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid retention rule", validationErrs)
+		}
+		if err != nil {
+			return WriteError(e, err, "error running retention rule")
+		}
+		return WriteOK(e, "", run)
+	}
+}
+
+func HandleListRetentionRuns(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		filter, err := ParseFilter(e.Request.URL.Query().Get("filter"), RetentionRunFilterFields)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		opts, err := ParseListOptions(e.Request.URL.Query(), RetentionRunSortFields, cfg)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if len(opts.Sort) == 0 {
+			opts.Sort = []SortField{{Field: "created", Desc: true}}
+		}
+		opts.Filter = filter
+
+		span := StartStorageSpan(app, "ListRetentionRuns", "SELECT")
+		total, err := RetentionRuns.Count(app, opts.Filter)
+		if err != nil {
+			span.End(err)
+			return WriteInternalServerError(e, "error counting retention runs: "+err.Error(), nil)
+		}
+		runs, err := RetentionRuns.FindAll(app, opts)
+		span.SetAttr("db.response.returned_rows", len(runs))
+		span.End(err)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting retention runs: "+err.Error(), nil)
+		}
+		return WriteOK(e, "", NewListPage(runs, opts, total))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+var ErrDatabaseBusy = errors.New("database is busy")
+
+type RetryOptions struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// WriteRetryOptions controls how the storage write functions retry when
+// SQLite reports that the database is busy or locked.
+var WriteRetryOptions = RetryOptions{
+	MaxAttempts: 5,
+	BaseDelay:   25 * time.Millisecond,
+	MaxDelay:    time.Second,
+}
+
+func IsBusyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") ||
+		strings.Contains(msg, "table is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY")
+}
+
+// RetryOnBusy calls fn until it succeeds, fails with a non busy error or runs
+// out of attempts, in which case the last error is wrapped in ErrDatabaseBusy.
+func RetryOnBusy(opts RetryOptions, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < max(opts.MaxAttempts, 1); attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryBackoff(opts, attempt))
+		}
+		err = fn()
+		if !IsBusyError(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrDatabaseBusy, err)
+}
+
+func retryBackoff(opts RetryOptions, attempt int) time.Duration {
+	delay := opts.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > opts.MaxDelay {
+		delay = opts.MaxDelay
+	}
+	half := delay / 2
+	return half + rand.N(half+1)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryOnBusy(t *testing.T) {
+	opts := RetryOptions{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	locked := errors.New("database is locked (5) (SQLITE_BUSY)")
+
+	calls := 0
+	err := RetryOnBusy(opts, func() error {
+		calls++
+		if calls < 3 {
+			return locked
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success on the third attempt, got %v after %d", err, calls)
+	}
+
+	calls = 0
+	err = RetryOnBusy(opts, func() error {
+		calls++
+		return locked
+	})
+	if !errors.Is(err, ErrDatabaseBusy) || calls != 3 {
+		t.Errorf("expected ErrDatabaseBusy after 3 attempts, got %v after %d", err, calls)
+	}
+
+	calls = 0
+	other := errors.New("constraint failed")
+	err = RetryOnBusy(opts, func() error {
+		calls++
+		return other
+	})
+	if err != other || calls != 1 {
+		t.Errorf("expected the error of the first attempt, got %v after %d", err, calls)
+	}
+}
+
+// TestConcurrentUserInserts hammers POST /users from many goroutines, none
+// of which may see the database locked.
+func TestConcurrentUserInserts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	s := newTestServer(t, nil)
+
+	const workers, perWorker = 20, 10
+	client := &http.Client{Timeout: time.Minute}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failures := []string{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				// not s.do, which can't fail the test outside of its goroutine
+				body := fmt.Sprintf(`{"email":"stress%d-%d@example.com"}`, w, i)
+				req, _ := http.NewRequest(http.MethodPost, s.URL+"/users", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", s.SuperuserToken)
+				failure := ""
+				if res, err := client.Do(req); err != nil {
+					failure = err.Error()
+				} else {
+					data, _ := io.ReadAll(res.Body)
+					res.Body.Close()
+					if res.StatusCode != http.StatusOK || strings.Contains(string(data), "locked") {
+						failure = fmt.Sprintf("%d %s", res.StatusCode, data)
+					}
+				}
+				if failure != "" {
+					mu.Lock()
+					failures = append(failures, failure)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, failure := range failures {
+		t.Error(failure)
+	}
+	total, err := CountUsers(s.App, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := len(s.Users) + workers*perWorker; total != expected {
+		t.Errorf("expected %d users, got %d", expected, total)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// Roles lists the roles from the most to the least privileged. A role
+// grants everything the roles after it grant, e.g. an admin passes
+// RequireRole(RoleEditor).
+var Roles = []string{RoleAdmin, RoleEditor, RoleViewer}
+
+var ErrInvalidRole = errors.New("invalid role, expected admin, editor or viewer")
+
+type RoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// HasRole reports whether roles include required or a more privileged role.
+func HasRole(roles []string, required string) bool {
+	rank := slices.Index(Roles, required)
+	if rank < 0 {
+		return false
+	}
+	for _, role := range roles {
+		if i := slices.Index(Roles, role); i >= 0 && i <= rank {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole rejects requests that aren't authenticated either as a
+// superuser, as a user with the role (see HasRole) or with an API key.
+func RequireRole(role string) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil {
+			return requireAPIKey(e)
+		}
+		if e.HasSuperuserAuth() {
+			return e.Next()
+		}
+		if e.Auth.Collection().Name != "users" || !HasRole(e.Auth.GetStringSlice("roles"), role) {
+			return WriteForbidden(e, role+" role required", nil)
+		}
+		return e.Next()
+	}
+}
+
+// updateUserRoles replaces the roles of the user with the result of fn and
+// queues the event of the change, returning sql.ErrNoRows if there is no
+// such user.
+func updateUserRoles(app core.App, name string, userId string, fn func(roles models.Roles) models.Roles) (*models.User, error) {
+	span := StartStorageSpan(app, name, "UPDATE")
+	var user *models.User
+	err := WithTx(app, func(txApp core.App) error {
+		current, err := GetUserById(txApp, userId)
+		if err != nil {
+			return err
+		}
+		affected, err := Users.Update(txApp, userId, Changeset{"roles": fn(current.Roles)})
+		if err != nil {
+			return err
+		}
+		span.SetAttr("db.response.affected_rows", affected)
+		if user, err = GetUserById(txApp, userId); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserUpdated, user)
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// AssignUserRole adds role to the roles of the user, if it isn't there yet.
+func AssignUserRole(app core.App, userId string, role string) (*models.User, error) {
+	if !slices.Contains(Roles, role) {
+		return nil, ErrInvalidRole
+	}
+	return updateUserRoles(app, "AssignUserRole", userId, func(roles models.Roles) models.Roles {
+		if slices.Contains(roles, role) {
+			return roles
+		}
+		return append(roles, role)
+	})
+}
+
+// RevokeUserRole removes role from the roles of the user, if it is there.
+func RevokeUserRole(app core.App, userId string, role string) (*models.User, error) {
+	if !slices.Contains(Roles, role) {
+		return nil, ErrInvalidRole
+	}
+	return updateUserRoles(app, "RevokeUserRole", userId, func(roles models.Roles) models.Roles {
+		return slices.DeleteFunc(roles, func(r string) bool { return r == role })
+	})
+}
+
+func writeRolesResult(e *core.RequestEvent, user *models.User, err error) error {
+	if errors.Is(err, ErrInvalidRole) {
+		return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+	}
+	if err != nil {
+		return WriteError(e, err, "error updating roles")
+	}
+	return WriteOK(e, "", user)
+}
+
+func HandleAssignUserRole(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		rr := RoleRequest{}
+		if err := BindStrict(e, &rr); err != nil {
+			return WriteBindError(e, err)
+		}
+		user, err := AssignUserRole(app, e.Request.PathValue("userId"), rr.Role)
+		return writeRolesResult(e, user, err)
+	}
+}
+
+func HandleRevokeUserRole(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		user, err := RevokeUserRole(app, e.Request.PathValue("userId"), e.Request.PathValue("role"))
+		return writeRolesResult(e, user, err)
+	}
+}
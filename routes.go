@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+var resourceMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// RouteGroup is implemented by both the ServeEvent router and its groups.
+type RouteGroup interface {
+	Route(method string, path string, action func(e *core.RequestEvent) error) *router.Route[*core.RequestEvent]
+}
+
+// Resource collects the routes registered for a single path.
+type Resource struct {
+	group   RouteGroup
+	path    string
+	methods []string
+}
+
+// HandleResource registers the routes added by fn for path and then answers
+// OPTIONS with the Allow header and every other method with 405, instead of
+// letting them fall through to the static files handler.
+func HandleResource(group RouteGroup, path string, fn func(r *Resource)) {
+	r := &Resource{group: group, path: path}
+	fn(r)
+
+	allow := r.Allow()
+	group.Route(http.MethodOptions, path, func(e *core.RequestEvent) error {
+		e.Response.Header().Set("Allow", allow)
+		return e.NoContent(http.StatusNoContent)
+	})
+	for _, method := range resourceMethods {
+		if slices.Contains(r.methods, method) {
+			continue
+		}
+		group.Route(method, path, func(e *core.RequestEvent) error {
+			e.Response.Header().Set("Allow", allow)
+			return WriteMethodNotAllowed(e, "method not allowed", nil)
+		})
+	}
+}
+
+// registeredRoutes are the routes registered through a Resource, as e.g.
+// "GET /users/{userId}", checked against the documented ones by
+// CheckAPIOperations.
+var registeredRoutes = map[string]bool{}
+
+// CheckAPIOperations compares the routes registered through a Resource with
+// ops, returning the routes ops doesn't document and the operations of ops
+// whose route isn't registered, both sorted. The generated clients and the
+// OpenAPI spec being derived from ops, either is a route they get wrong.
+func CheckAPIOperations(ops []APIOperation) (undocumented []string, stale []string) {
+	documented := map[string]bool{}
+	for _, op := range ops {
+		route := op.Method + " " + op.Path
+		documented[route] = true
+		if !registeredRoutes[route] {
+			stale = append(stale, route)
+		}
+	}
+	for route := range registeredRoutes {
+		if !documented[route] {
+			undocumented = append(undocumented, route)
+		}
+	}
+	sort.Strings(undocumented)
+	sort.Strings(stale)
+	return undocumented, stale
+}
+
+func (r *Resource) Route(method string, action func(e *core.RequestEvent) error) *router.Route[*core.RequestEvent] {
+	r.methods = append(r.methods, method)
+	registeredRoutes[method+" "+r.path] = true
+	route := r.group.Route(method, r.path, action)
+	if Tracing != nil {
+		route.BindFunc(TraceRoute(method + " " + r.path))
+	}
+	return route
+}
+
+func (r *Resource) GET(action func(e *core.RequestEvent) error) *router.Route[*core.RequestEvent] {
+	return r.Route(http.MethodGet, action)
+}
+
+func (r *Resource) POST(action func(e *core.RequestEvent) error) *router.Route[*core.RequestEvent] {
+	return r.Route(http.MethodPost, action)
+}
+
+func (r *Resource) PUT(action func(e *core.RequestEvent) error) *router.Route[*core.RequestEvent] {
+	return r.Route(http.MethodPut, action)
+}
+
+func (r *Resource) PATCH(action func(e *core.RequestEvent) error) *router.Route[*core.RequestEvent] {
+	return r.Route(http.MethodPatch, action)
+}
+
+func (r *Resource) DELETE(action func(e *core.RequestEvent) error) *router.Route[*core.RequestEvent] {
+	return r.Route(http.MethodDelete, action)
+}
+
+// Allow returns the Allow header value for the resource. GET routes also
+// serve HEAD requests.
+func (r *Resource) Allow() string {
+	allowed := slices.Clone(r.methods)
+	if slices.Contains(allowed, http.MethodGet) {
+		allowed = append(allowed, http.MethodHead)
+	}
+	allowed = append(allowed, http.MethodOptions)
+	return strings.Join(allowed, ", ")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/cache"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const routeSettingRequestKey = "routeSetting"
+
+// RouteSetting configures the custom routes under Prefix, all of them when
+// it is empty. The settings are edited from the admin UI and apply without
+// a restart.
+type RouteSetting struct {
+	Id     string `db:"id" json:"id"`
+	Prefix string `db:"prefix" json:"prefix"`
+	// RateLimitPerMinute and RateLimitBurst replace the limits of the
+	// config for the routes, per client, when RateLimitPerMinute is set.
+	RateLimitPerMinute int `db:"rate_limit_per_minute" json:"rateLimitPerMinute"`
+	RateLimitBurst     int `db:"rate_limit_burst" json:"rateLimitBurst"`
+	// Maintenance rejects the writes to the routes with 503, see
+	// Maintenance.
+	Maintenance bool `db:"maintenance" json:"maintenance"`
+	// ReadOnly rejects the writes to the routes with 403, see ReadOnly.
+	ReadOnly bool `db:"read_only" json:"readOnly"`
+	// ReadMode picks the connection the GET requests read through, see
+	// ReadModeReplica.
+	ReadMode string              `db:"read_mode" json:"readMode"`
+	Flags    types.JSONMap[bool] `db:"flags" json:"flags"`
+	Updated  string              `db:"updated" json:"updated"`
+}
+
+var RouteSettings = NewRepository[RouteSetting]("route_settings")
+
+// routeSettingsVersionKey holds the version of route_settings, bumped by
+// Invalidate for the other instances to reload it too.
+const routeSettingsVersionKey = "route_settings:version"
+
+// routeSettingsCheckEvery is how often the version is read.
+const routeSettingsCheckEvery = time.Second
+
+// RouteSettingsLoader caches route_settings, reloaded on the first request
+// following a change to the collection. With a cache shared by the
+// instances the changes made through another one are seen within
+// routeSettingsCheckEvery.
+type RouteSettingsLoader struct {
+	app    core.App
+	cache  cache.Cache
+	limits cache.Cache
+
+	mu       sync.Mutex
+	settings []RouteSetting
+	loaded   bool
+	version  int64
+	checked  time.Time
+	// limiters are the token buckets of the settings with a rate limit,
+	// by prefix, dropped on reload
+	limiters map[string]*TokenBucket
+}
+
+// NewRouteSettingsLoader returns a loader keeping its version in c, and
+// the buckets of the rate limits of the settings in limits.
+func NewRouteSettingsLoader(app core.App, c cache.Cache, limits cache.Cache) *RouteSettingsLoader {
+	return &RouteSettingsLoader{app: app, cache: c, limits: limits, limiters: map[string]*TokenBucket{}}
+}
+
+// Bind invalidates the cache whenever route_settings changes.
+func (l *RouteSettingsLoader) Bind(app core.App) {
+	invalidate := func(e *core.RecordEvent) error {
+		l.Invalidate()
+		return e.Next()
+	}
+	app.OnRecordAfterCreateSuccess(RouteSettings.Table).BindFunc(invalidate)
+	app.OnRecordAfterUpdateSuccess(RouteSettings.Table).BindFunc(invalidate)
+	app.OnRecordAfterDeleteSuccess(RouteSettings.Table).BindFunc(invalidate)
+}
+
+func (l *RouteSettingsLoader) Invalidate() {
+	if _, err := l.cache.Incr(context.Background(), routeSettingsVersionKey, 1, 0); err != nil {
+		l.app.Logger().Error("Failed to bump the version of the route settings", "error", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loaded = false
+	l.settings = nil
+	l.limiters = map[string]*TokenBucket{}
+}
+
+// load reads the settings unless cached at the current version, longest
+// prefix first. A failed read leaves the routes unconfigured until the
+// next change, and a failed read of the version keeps the cached ones.
+func (l *RouteSettingsLoader) load() []RouteSetting {
+	now := time.Now()
+	if l.loaded && now.Sub(l.checked) < routeSettingsCheckEvery {
+		return l.settings
+	}
+	l.checked = now
+	version, err := l.cache.Incr(context.Background(), routeSettingsVersionKey, 0, 0)
+	if err != nil {
+		l.app.Logger().Warn("Failed to read the version of the route settings", "error", err)
+	}
+	if l.loaded && (err != nil || version == l.version) {
+		return l.settings
+	}
+
+	settings, err := RouteSettings.FindAll(l.app, ListOptions{})
+	if err != nil {
+		l.app.Logger().Error("Failed to load the route settings", "error", err)
+	}
+	slices.SortFunc(settings, func(a, b RouteSetting) int { return len(b.Prefix) - len(a.Prefix) })
+	l.settings = settings
+	l.loaded = true
+	l.version = version
+	l.limiters = map[string]*TokenBucket{}
+	return settings
+}
+
+// Match returns the setting of the longest prefix of urlPath. The
+// PocketBase routes are never configured.
+func (l *RouteSettingsLoader) Match(urlPath string) (RouteSetting, bool) {
+	if IsPocketBasePath(urlPath) {
+		return RouteSetting{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, setting := range l.load() {
+		if strings.HasPrefix(urlPath, setting.Prefix) {
+			return setting, true
+		}
+	}
+	return RouteSetting{}, false
+}
+
+// Limiter returns the token bucket of the rate limit of setting, nil when
+// it has none.
+func (l *RouteSettingsLoader) Limiter(setting RouteSetting) *TokenBucket {
+	if setting.RateLimitPerMinute <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.limiters[setting.Prefix]
+	if !ok {
+		limiter = NewTokenBucket(l.limits, "route:"+setting.Prefix, setting.RateLimitPerMinute, setting.RateLimitBurst)
+		l.limiters[setting.Prefix] = limiter
+	}
+	return limiter
+}
+
+// ApplyRouteSettings makes the setting of the request available to the
+// middlewares and handlers after it, see RequestRouteSetting.
+func ApplyRouteSettings(settings *RouteSettingsLoader) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		setting, ok := settings.Match(e.Request.URL.Path)
+		if !ok {
+			return e.Next()
+		}
+		e.Set(routeSettingRequestKey, setting)
+		return e.Next()
+	}
+}
+
+// RequestRouteSetting returns the setting ApplyRouteSettings matched the
+// request with.
+func RequestRouteSetting(e *core.RequestEvent) (RouteSetting, bool) {
+	setting, ok := e.Get(routeSettingRequestKey).(RouteSetting)
+	return setting, ok
+}
+
+// RouteFlag reports whether the flag is on in the setting of the request.
+func RouteFlag(e *core.RequestEvent, name string) bool {
+	setting, _ := RequestRouteSetting(e)
+	return setting.Flags[name]
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	TaskPurgeDeletedUsers  = "purge_deleted_users"
+	TaskPruneAuditLogs     = "prune_audit_logs"
+	TaskAggregateUserStats = "aggregate_user_stats"
+	TaskPurgeExports       = "purge_exports"
+	TaskNotificationDigest = "notification_digest"
+	TaskResetDemoData      = "reset_demo_data"
+)
+
+// cronJobPrefix keeps the ids of the scheduled tasks apart from the other
+// cron jobs of the app.
+const cronJobPrefix = "task:"
+
+// CronTask is a task run on the schedule of its cron_settings record. The
+// retention is only used by the cleanup tasks.
+type CronTask struct {
+	Name string
+	Run  func(app core.App, now time.Time, retention time.Duration) error
+}
+
+// CronTasks are the tasks the Scheduler knows about. A task without a
+// cron_settings record never runs.
+var CronTasks = []CronTask{
+	{Name: TaskPurgeDeletedUsers, Run: PurgeDeletedUsers},
+	{Name: TaskPruneAuditLogs, Run: PruneAuditLogs},
+	{Name: TaskAggregateUserStats, Run: AggregateUserStats},
+	{Name: TaskPurgeExports, Run: PurgeExports},
+	{Name: TaskNotificationDigest, Run: QueueNotificationDigests},
+	{Name: TaskResetDemoData, Run: ResetDemoData},
+}
+
+type CronSetting struct {
+	Id            string `db:"id" json:"id"`
+	Task          string `db:"task" json:"task"`
+	Schedule      string `db:"schedule" json:"schedule"`
+	Enabled       bool   `db:"enabled" json:"enabled"`
+	RetentionDays int    `db:"retention_days" json:"retentionDays"`
+}
+
+var CronSettings = NewRepository[CronSetting]("cron_settings")
+
+// CronStatus describes a task for GET /admin/cron. The last run fields
+// only cover the runs since the process started.
+type CronStatus struct {
+	Task          string `json:"task"`
+	Schedule      string `json:"schedule"`
+	Enabled       bool   `json:"enabled"`
+	RetentionDays int    `json:"retentionDays"`
+	Running       bool   `json:"running"`
+	LastRun       string `json:"lastRun,omitempty"`
+	LastDuration  string `json:"lastDuration,omitempty"`
+	LastError     string `json:"lastError,omitempty"`
+	SettingsError string `json:"settingsError,omitempty"`
+}
+
+// Scheduler registers the CronTasks with the PocketBase cron, following the
+// changes made to cron_settings.
+type Scheduler struct {
+	app core.App
+
+	mu       sync.Mutex
+	statuses map[string]*CronStatus
+}
+
+func NewScheduler(app core.App) *Scheduler {
+	s := &Scheduler{app: app, statuses: map[string]*CronStatus{}}
+	for _, task := range CronTasks {
+		s.statuses[task.Name] = &CronStatus{Task: task.Name}
+	}
+	return s
+}
+
+// Bind schedules the tasks on serve and again whenever cron_settings
+// changes.
+func (s *Scheduler) Bind(app core.App) {
+	app.OnServe().BindFunc(func(e *core.ServeEvent) error {
+		if err := s.Reload(); err != nil {
+			app.Logger().Error("Failed to schedule the cron tasks", "error", err)
+		}
+		return e.Next()
+	})
+	reload := func(e *core.RecordEvent) error {
+		if err := s.Reload(); err != nil {
+			e.App.Logger().Error("Failed to reschedule the cron tasks", "error", err)
+		}
+		return e.Next()
+	}
+	app.OnRecordAfterCreateSuccess(CronSettings.Table).BindFunc(reload)
+	app.OnRecordAfterUpdateSuccess(CronSettings.Table).BindFunc(reload)
+	app.OnRecordAfterDeleteSuccess(CronSettings.Table).BindFunc(reload)
+}
+
+// Reload reads cron_settings and (re)schedules the tasks. An invalid
+// schedule only disables its task, reported in its status.
+func (s *Scheduler) Reload() error {
+	settings, err := CronSettings.FindAll(s.app, ListOptions{})
+	if err != nil {
+		return err
+	}
+	byTask := map[string]CronSetting{}
+	for _, setting := range settings {
+		byTask[setting.Task] = setting
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, task := range CronTasks {
+		jobId := cronJobPrefix + task.Name
+		s.app.Cron().Remove(jobId)
+
+		status := s.statuses[task.Name]
+		setting, ok := byTask[task.Name]
+		status.Schedule = setting.Schedule
+		status.Enabled = ok && setting.Enabled
+		status.RetentionDays = setting.RetentionDays
+		status.SettingsError = ""
+		if !status.Enabled {
+			continue
+		}
+		if _, err := cron.NewSchedule(setting.Schedule); err != nil {
+			status.Enabled = false
+			status.SettingsError = err.Error()
+			continue
+		}
+
+		task, retention := task, time.Duration(setting.RetentionDays)*24*time.Hour
+		s.app.Cron().MustAdd(jobId, setting.Schedule, func() {
+			s.run(task, retention)
+		})
+	}
+	return nil
+}
+
+// run runs the task, unless its previous run is still going.
+func (s *Scheduler) run(task CronTask, retention time.Duration) {
+	s.mu.Lock()
+	status := s.statuses[task.Name]
+	if status.Running {
+		s.mu.Unlock()
+		s.app.Logger().Warn("Skipped cron task still running", "task", task.Name)
+		return
+	}
+	status.Running = true
+	s.mu.Unlock()
+
+	start := time.Now()
+	err := task.Run(s.app, start, retention)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status.Running = false
+	status.LastRun = start.UTC().Format(time.RFC3339)
+	status.LastDuration = time.Since(start).String()
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+		s.app.Logger().Error("Cron task failed", "task", task.Name, "error", err)
+	}
+}
+
+func (s *Scheduler) Statuses() []CronStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]CronStatus, 0, len(s.statuses))
+	for _, status := range s.statuses {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Task < statuses[j].Task })
+	return statuses
+}
+
+// PurgeDeletedUsers permanently removes the users soft deleted more than
+// retention ago.
+func PurgeDeletedUsers(app core.App, now time.Time, retention time.Duration) error {
+	if retention <= 0 {
+		return errors.New("retention_days must be positive")
+	}
+	cutoff, err := types.ParseDateTime(now.Add(-retention))
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	err = app.DB().
+		Select("id").
+		From(Users.Table).
+		Where(dbx.Not(dbx.HashExp{"deleted_at": ""})).
+		AndWhere(dbx.NewExp("[[deleted_at]] < {:cutoff}", dbx.Params{"cutoff": cutoff.String()})).
+		Column(&ids)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, id := range ids {
+		if err := HardDeleteUserById(app, id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PruneAuditLogs removes the audit logs older than retention.
+func PruneAuditLogs(app core.App, now time.Time, retention time.Duration) error {
+	if retention <= 0 {
+		return errors.New("retention_days must be positive")
+	}
+	cutoff, err := types.ParseDateTime(now.Add(-retention))
+	if err != nil {
+		return err
+	}
+	return RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().Delete(AuditLogs.Table, dbx.NewExp(
+			"[[created]] < {:cutoff}", dbx.Params{"cutoff": cutoff.String()},
+		)).Execute()
+		return err
+	})
+}
+
+// AggregateUserStats stores the user stats of the UTC day before now in
+// user_stats_daily, replacing a previous aggregate of the day.
+func AggregateUserStats(app core.App, now time.Time, _ time.Duration) error {
+	now = now.UTC()
+	dayEnd := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	dayStart := dayEnd.AddDate(0, 0, -1)
+	start, err := types.ParseDateTime(dayStart)
+	if err != nil {
+		return err
+	}
+	end, err := types.ParseDateTime(dayEnd)
+	if err != nil {
+		return err
+	}
+
+	counts := struct {
+		Total    int `db:"total"`
+		Verified int `db:"verified"`
+		Active   int `db:"active"`
+		Signups  int `db:"signups"`
+	}{}
+	err = app.DB().
+		Select(
+			"COALESCE(SUM([[created]] < {:end}), 0) AS total",
+			"COALESCE(SUM([[created]] < {:end} AND [[verified]] = TRUE), 0) AS verified",
+			"COALESCE(SUM([[lastSeen]] >= {:start} AND [[lastSeen]] < {:end}), 0) AS active",
+			"COALESCE(SUM([[created]] >= {:start} AND [[created]] < {:end}), 0) AS signups",
+		).
+		From(Users.Table).
+		Where(Users.notDeleted()).
+		Bind(dbx.Params{"start": start.String(), "end": end.String()}).
+		One(&counts)
+	if err != nil {
+		return err
+	}
+
+	date := dayStart.Format(time.DateOnly)
+	record, err := app.FindFirstRecordByData("user_stats_daily", "date", date)
+	if err != nil {
+		collection, err := app.FindCachedCollectionByNameOrId("user_stats_daily")
+		if err != nil {
+			return err
+		}
+		record = core.NewRecord(collection)
+		record.Set("date", date)
+	}
+	record.Set("total", counts.Total)
+	record.Set("verified", counts.Verified)
+	record.Set("active", counts.Active)
+	record.Set("signups", counts.Signups)
+	return RetryWrite(app, func() error { return app.Save(record) })
+}
+
+func HandleGetCronStatus(s *Scheduler) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		return WriteOK(e, "", s.Statuses())
+	}
+}
+
+// DailyUserStats is a row of user_stats_daily, see AggregateUserStats.
+type DailyUserStats struct {
+	Date     string `db:"date" json:"date"`
+	Total    int    `db:"total" json:"total"`
+	Verified int    `db:"verified" json:"verified"`
+	Active   int    `db:"active" json:"active"`
+	Signups  int    `db:"signups" json:"signups"`
+}
+
+var DailyStats = NewRepository[DailyUserStats]("user_stats_daily")
+
+func HandleGetDailyStats(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		opts, err := ParseListOptions(e.Request.URL.Query(), []string{"date"}, cfg)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if len(opts.Sort) == 0 {
+			opts.Sort = []SortField{{Field: "date", Desc: true}}
+		}
+
+		span := StartStorageSpan(app, "ListDailyStats", "SELECT")
+		total, err := DailyStats.Count(app, nil)
+		if err != nil {
+			span.End(err)
+			return WriteInternalServerError(e, "error counting daily stats: "+err.Error(), nil)
+		}
+		days, err := DailyStats.FindAll(app, opts)
+		span.SetAttr("db.response.returned_rows", len(days))
+		span.End(err)
+		if err != nil {
+			return WriteInternalServerError(e, "error getting daily stats: "+err.Error(), nil)
+		}
+		return WriteOK(e, "", NewListPage(days, opts, total))
+	}
+}
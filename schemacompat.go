@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/dbutils"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+)
+
+// What the app does when the live schema drifted from SchemaContracts, see
+// SCHEMA_DRIFT_ACTION.
+const (
+	SchemaDriftRefuse   = "refuse"
+	SchemaDriftReadOnly = "readonly"
+	SchemaDriftWarn     = "warn"
+)
+
+var SchemaDriftActions = []string{SchemaDriftRefuse, SchemaDriftReadOnly, SchemaDriftWarn}
+
+var ErrSchemaDrift = errors.New("the collections don't match what this build expects")
+
+// SchemaReadOnly is set when the schema drifted at startup with
+// SCHEMA_DRIFT_ACTION=readonly, which forces the maintenance mode.
+var SchemaReadOnly bool
+
+// The field types the Go types of the row structs can be read from and
+// written to.
+var (
+	stringFieldTypes = []string{core.FieldTypeText, core.FieldTypeEmail, core.FieldTypeURL, core.FieldTypeEditor,
+		core.FieldTypeDate, core.FieldTypeAutodate, core.FieldTypeSelect, core.FieldTypeRelation, core.FieldTypeFile, core.FieldTypePassword}
+	boolFieldTypes   = []string{core.FieldTypeBool}
+	numberFieldTypes = []string{core.FieldTypeNumber}
+	// the slices, maps and JSON values, e.g. the roles of a multiple select
+	multiFieldTypes = []string{core.FieldTypeJSON, core.FieldTypeSelect, core.FieldTypeRelation, core.FieldTypeFile}
+)
+
+// SchemaContract is what the compiled code expects of a collection: its
+// columns, with the field types each can be, and the column sets it relies
+// on a unique index of, e.g. for an ON CONFLICT or a UniqueErrors.
+type SchemaContract struct {
+	Table         string
+	Columns       map[string][]string
+	UniqueIndexes [][]string
+}
+
+// NewSchemaContract returns the contract of the table of the repository:
+// the db columns of its row type and the unique indexes of UniqueErrors,
+// plus uniqueIndexes.
+func NewSchemaContract[T any](repo *Repository[T], uniqueIndexes ...[]string) SchemaContract {
+	contract := SchemaContract{Table: repo.Table, Columns: map[string][]string{}, UniqueIndexes: uniqueIndexes}
+	addSchemaColumns(contract.Columns, reflect.TypeFor[T]())
+	for _, column := range []string{repo.SoftDeleteColumn, repo.TenantColumn} {
+		if _, ok := contract.Columns[column]; column != "" && !ok {
+			contract.Columns[column] = stringFieldTypes
+		}
+	}
+	for column := range repo.UniqueErrors {
+		contract.UniqueIndexes = append(contract.UniqueIndexes, []string{column})
+	}
+	return contract
+}
+
+// addSchemaColumns adds the columns of the db tags of the struct t, and of
+// its embedded structs.
+func addSchemaColumns(columns map[string][]string, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		column := field.Tag.Get("db")
+		if field.Anonymous && column == "" && field.Type.Kind() == reflect.Struct {
+			addSchemaColumns(columns, field.Type)
+			continue
+		}
+		if column == "" || column == "-" {
+			continue
+		}
+		columns[column] = schemaFieldTypes(field.Type)
+	}
+}
+
+func schemaFieldTypes(t reflect.Type) []string {
+	switch t.Kind() {
+	case reflect.String:
+		return stringFieldTypes
+	case reflect.Bool:
+		return boolFieldTypes
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return numberFieldTypes
+	}
+	return multiFieldTypes
+}
+
+// SchemaContracts are the collections the compiled code reads and writes.
+// The tables only written with SQL list their columns themselves.
+func SchemaContracts() []SchemaContract {
+	return []SchemaContract{
+		NewSchemaContract(Users),
+		NewSchemaContract(legacySyncedUsers),
+		NewSchemaContract(scimUsers),
+		NewSchemaContract(UserEventStream, []string{"aggregate", "version"}),
+		NewSchemaContract(UserTombstones),
+		NewSchemaContract(Preferences, []string{"user"}),
+		NewSchemaContract(Sessions),
+		NewSchemaContract(Activities),
+		NewSchemaContract(Notifications),
+		NewSchemaContract(Invitations),
+		NewSchemaContract(Tenants, []string{"slug"}),
+		NewSchemaContract(Teams),
+		NewSchemaContract(TeamMemberships, []string{"team", "user"}),
+		NewSchemaContract(APIKeys, []string{"key_hash"}),
+		NewSchemaContract(Subscriptions, []string{"user"}),
+		NewSchemaContract(Posts),
+		NewSchemaContract(ModerationItems),
+		NewSchemaContract(AuditLogs),
+		NewSchemaContract(ErasureReceipts),
+		NewSchemaContract(Jobs),
+		NewSchemaContract(OutboxEvents),
+		NewSchemaContract(Flags, []string{"name"}),
+		NewSchemaContract(RouteSettings, []string{"prefix"}),
+		NewSchemaContract(CronSettings, []string{"task"}),
+		NewSchemaContract(DailyStats, []string{"date"}),
+		NewSchemaContract(RetentionRules, []string{"name"}),
+		NewSchemaContract(RetentionRuns),
+		NewSchemaContract(BlockedEmailDomains, []string{"domain"}),
+		{
+			Table: "api_usage",
+			Columns: map[string][]string{
+				"kind": stringFieldTypes, "subject": stringFieldTypes, "day": stringFieldTypes,
+				"requests": numberFieldTypes, "created": stringFieldTypes, "updated": stringFieldTypes,
+			},
+			UniqueIndexes: [][]string{{"kind", "subject", "day"}},
+		},
+		{
+			Table: authFailuresTable,
+			Columns: map[string][]string{
+				"key": stringFieldTypes, "failures": numberFieldTypes, "last_failure": stringFieldTypes,
+				"locked_until": stringFieldTypes, "created": stringFieldTypes, "updated": stringFieldTypes,
+			},
+			UniqueIndexes: [][]string{{"key"}},
+		},
+	}
+}
+
+// SchemaDrift is a difference between a live collection and its contract.
+type SchemaDrift struct {
+	Collection string `json:"collection"`
+	Field      string `json:"field,omitempty"`
+	Problem    string `json:"problem"`
+}
+
+func (d SchemaDrift) String() string {
+	if d.Field != "" {
+		return d.Collection + "." + d.Field + ": " + d.Problem
+	}
+	return d.Collection + ": " + d.Problem
+}
+
+// SchemaReport is the result of CheckSchema, for GET /admin/schema.
+type SchemaReport struct {
+	Compatible bool          `json:"compatible"`
+	Action     string        `json:"action"`
+	ReadOnly   bool          `json:"readOnly"`
+	Drifts     []SchemaDrift `json:"drifts"`
+	Checked    string        `json:"checked"`
+}
+
+// CheckSchema compares the live collections with the contracts: the
+// collections and fields missing, the fields of another type and the
+// unique indexes missing. The extra fields and indexes are fine, e.g. the
+// ones a newer build added.
+func CheckSchema(app core.App, contracts []SchemaContract) ([]SchemaDrift, error) {
+	drifts := []SchemaDrift{}
+	for _, contract := range contracts {
+		collection, err := app.FindCollectionByNameOrId(contract.Table)
+		if errors.Is(err, sql.ErrNoRows) {
+			drifts = append(drifts, SchemaDrift{Collection: contract.Table, Problem: "missing collection"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		columns := make([]string, 0, len(contract.Columns))
+		for column := range contract.Columns {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		for _, column := range columns {
+			field := collection.Fields.GetByName(column)
+			switch {
+			case field == nil:
+				drifts = append(drifts, SchemaDrift{Collection: contract.Table, Field: column, Problem: "missing field"})
+			case !slices.Contains(contract.Columns[column], field.Type()):
+				drifts = append(drifts, SchemaDrift{
+					Collection: contract.Table,
+					Field:      column,
+					Problem:    fmt.Sprintf("%s field, expected %s", field.Type(), strings.Join(contract.Columns[column], " or ")),
+				})
+			}
+		}
+
+		for _, unique := range contract.UniqueIndexes {
+			if !hasUniqueIndex(collection.Indexes, unique) {
+				drifts = append(drifts, SchemaDrift{
+					Collection: contract.Table,
+					Problem:    "missing unique index on (" + strings.Join(unique, ", ") + ")",
+				})
+			}
+		}
+	}
+	return drifts, nil
+}
+
+// hasUniqueIndex reports whether one of indexes is a unique index of the
+// columns, in any order.
+func hasUniqueIndex(indexes types.JSONArray[string], columns []string) bool {
+	for _, sql := range indexes {
+		index := dbutils.ParseIndex(sql)
+		if !index.Unique || len(index.Columns) != len(columns) {
+			continue
+		}
+		matched := true
+		for _, column := range index.Columns {
+			if !slices.Contains(columns, column.Name) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSchemaReport checks the schema against SchemaContracts.
+func NewSchemaReport(app core.App, action string) (SchemaReport, error) {
+	drifts, err := CheckSchema(app, SchemaContracts())
+	if err != nil {
+		return SchemaReport{}, err
+	}
+	return SchemaReport{
+		Compatible: len(drifts) == 0,
+		Action:     action,
+		ReadOnly:   SchemaReadOnly,
+		Drifts:     drifts,
+		Checked:    types.NowDateTime().String(),
+	}, nil
+}
+
+// EnforceSchema checks the schema on serve, before anything else runs. A
+// drift is logged, then per SCHEMA_DRIFT_ACTION refuses to serve, for a
+// rolling deploy to stop at the first instance, forces the maintenance
+// mode, or is only logged.
+func EnforceSchema(app core.App, action string) error {
+	report, err := NewSchemaReport(app, action)
+	if err != nil {
+		return fmt.Errorf("error checking the schema: %w", err)
+	}
+	if report.Compatible {
+		return nil
+	}
+	for _, drift := range report.Drifts {
+		app.Logger().Error("Schema drift", "collection", drift.Collection, "field", drift.Field, "problem", drift.Problem)
+	}
+	switch action {
+	case SchemaDriftRefuse:
+		return fmt.Errorf("%w, %d drifts: %s", ErrSchemaDrift, len(report.Drifts), report.Drifts[0])
+	case SchemaDriftReadOnly:
+		SchemaReadOnly = true
+		app.Logger().Warn("Serving read-only until the schema is fixed and the app restarted", "drifts", len(report.Drifts))
+	}
+	return nil
+}
+
+func HandleGetSchemaReport(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		report, err := NewSchemaReport(WithTrace(app, e), cfg.SchemaDriftAction)
+		if err != nil {
+			return WriteError(e, err, "error checking the schema")
+		}
+		return WriteOK(e, "", report)
+	}
+}
+
+// NewSchemaCommand adds the "schema check" command, which checks the
+// database against this build without serving, e.g. before switching a
+// blue/green deploy over.
+func NewSchemaCommand(app core.App) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "schema",
+		Short: "Checks the collections",
+	}
+	check := &cobra.Command{
+		Use:          "check",
+		Short:        "Checks that the collections match what this build expects, failing on a drift",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			drifts, err := CheckSchema(app, SchemaContracts())
+			if err != nil {
+				return err
+			}
+			for _, drift := range drifts {
+				fmt.Println(drift)
+			}
+			if len(drifts) > 0 {
+				return fmt.Errorf("%w, %d drifts", ErrSchemaDrift, len(drifts))
+			}
+			fmt.Println("the schema is compatible")
+			return nil
+		},
+	}
+	command.AddCommand(check)
+	return command
+}
@@ -0,0 +1,737 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// The SCIM 2.0 schemas of the resources and messages of /scim/v2 (RFC 7643
+// and 7644).
+const (
+	SCIMUserSchema       = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SCIMListSchema       = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SCIMPatchOpSchema    = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SCIMErrorSchema      = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SCIMContentType      = "application/scim+json"
+	scimExternalIdColumn = "external_id"
+)
+
+var ErrSCIMFilter = errors.New("invalid filter")
+
+// SCIMUser is the SCIM representation of a user: userName and the primary
+// email are its email, displayName or name its name, and active is false
+// for the locked users.
+type SCIMUser struct {
+	Schemas     []string    `json:"schemas"`
+	Id          string      `json:"id,omitempty"`
+	ExternalId  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        *SCIMName   `json:"name,omitempty"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []SCIMEmail `json:"emails,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Meta        *SCIMMeta   `json:"meta,omitempty"`
+}
+
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type SCIMMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Location     string `json:"location,omitempty"`
+}
+
+// SCIMListResponse is a page of GET /scim/v2/Users.
+type SCIMListResponse struct {
+	Schemas      []string   `json:"schemas"`
+	TotalResults int        `json:"totalResults"`
+	StartIndex   int        `json:"startIndex"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []SCIMUser `json:"Resources"`
+}
+
+// SCIMPatchRequest is the body of PATCH /scim/v2/Users/{userId}.
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	SCIMType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// scimUserRow holds the columns of the users the SCIM representation is
+// made of.
+type scimUserRow struct {
+	Id         string `db:"id"`
+	Email      string `db:"email"`
+	Name       string `db:"name"`
+	Locked     bool   `db:"locked"`
+	ExternalId string `db:"external_id"`
+	Created    string `db:"created"`
+	Updated    string `db:"updated"`
+}
+
+// scimUsers reads the users table as Users does, the deprovisioned users
+// being soft deleted.
+var scimUsers = &Repository[scimUserRow]{
+	Table:            Users.Table,
+	SoftDeleteColumn: Users.SoftDeleteColumn,
+	TenantColumn:     Users.TenantColumn,
+}
+
+// scimAttribute is a filterable attribute of the SCIM users.
+type scimAttribute struct {
+	column string
+	// caseExact attributes are compared as is, the others ignoring case
+	caseExact bool
+	// active is the negation of the locked column
+	active bool
+}
+
+// scimAttributes maps the lowercased filterable attributes to the columns
+// of the users.
+var scimAttributes = map[string]scimAttribute{
+	"id":                {column: "id", caseExact: true},
+	"externalid":        {column: scimExternalIdColumn, caseExact: true},
+	"username":          {column: "email"},
+	"emails":            {column: "email"},
+	"emails.value":      {column: "email"},
+	"displayname":       {column: "name"},
+	"name.formatted":    {column: "name"},
+	"active":            {column: LockedField, active: true},
+	"meta.created":      {column: "created", caseExact: true},
+	"meta.lastmodified": {column: "updated", caseExact: true},
+}
+
+// scimFilterTokens splits a filter into its words and quoted strings, the
+// latter kept with their quotes.
+func scimFilterTokens(filter string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ':
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrSCIMFilter)
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			end := strings.IndexByte(filter[i:], ' ')
+			if end < 0 {
+				end = len(filter) - i
+			}
+			tokens = append(tokens, filter[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+// ParseSCIMFilter translates the filters of GET /scim/v2/Users, a subset of
+// the SCIM filters: comparisons (eq, ne, co, sw, ew, gt, ge, lt, le and pr)
+// of the attributes of scimAttributes, joined with and, e.g.
+//
+//	userName eq "jane@example.com" and active eq true
+func ParseSCIMFilter(filter string) (dbx.Expression, error) {
+	tokens, err := scimFilterTokens(filter)
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+	exprs := []dbx.Expression{}
+	for clause := 0; len(tokens) > 0; clause++ {
+		if clause > 0 {
+			if !strings.EqualFold(tokens[0], "and") {
+				return nil, fmt.Errorf("%w: expected and, got %q", ErrSCIMFilter, tokens[0])
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("%w: expected attribute and operator", ErrSCIMFilter)
+		}
+		attr, ok := scimAttributes[strings.ToLower(tokens[0])]
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported attribute %q", ErrSCIMFilter, tokens[0])
+		}
+		op := strings.ToLower(tokens[1])
+		if op == "pr" {
+			tokens = tokens[2:]
+			if !attr.active {
+				exprs = append(exprs, dbx.Not(dbx.HashExp{attr.column: ""}))
+			}
+			continue
+		}
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("%w: %s has no value", ErrSCIMFilter, tokens[0])
+		}
+		expr, err := scimComparison(attr, op, tokens[2], clause)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		tokens = tokens[3:]
+	}
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	return dbx.And(exprs...), nil
+}
+
+// scimComparison builds the comparison of the attribute with the raw
+// value, a JSON string or boolean, binding it to a parameter named after i.
+func scimComparison(attr scimAttribute, op string, raw string, i int) (dbx.Expression, error) {
+	if attr.active {
+		active, err := strconv.ParseBool(raw)
+		if err != nil || (op != "eq" && op != "ne") {
+			return nil, fmt.Errorf("%w: active only supports eq and ne with true or false", ErrSCIMFilter)
+		}
+		return dbx.HashExp{attr.column: active != (op == "eq")}, nil
+	}
+
+	value := ""
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return nil, fmt.Errorf("%w: %s is not a string", ErrSCIMFilter, raw)
+	}
+	column, param := "[["+attr.column+"]]", "scim"+strconv.Itoa(i)
+	placeholder := "{:" + param + "}"
+	if !attr.caseExact {
+		column, placeholder = "LOWER("+column+")", "LOWER("+placeholder+")"
+	}
+	params := dbx.Params{param: value}
+	switch op {
+	case "eq":
+		return dbx.NewExp(column+" = "+placeholder, params), nil
+	case "ne":
+		return dbx.NewExp(column+" != "+placeholder, params), nil
+	case "gt":
+		return dbx.NewExp(column+" > "+placeholder, params), nil
+	case "ge":
+		return dbx.NewExp(column+" >= "+placeholder, params), nil
+	case "lt":
+		return dbx.NewExp(column+" < "+placeholder, params), nil
+	case "le":
+		return dbx.NewExp(column+" <= "+placeholder, params), nil
+	case "co", "sw", "ew":
+		// LIKE ignores the case of the ASCII letters already
+		return dbx.Like(attr.column, value).Match(op != "sw", op != "ew"), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported operator %q", ErrSCIMFilter, op)
+}
+
+// NewSCIMUser converts a users row to its SCIM representation.
+func NewSCIMUser(appURL string, row scimUserRow) SCIMUser {
+	active := !row.Locked
+	user := SCIMUser{
+		Schemas:     []string{SCIMUserSchema},
+		Id:          row.Id,
+		ExternalId:  row.ExternalId,
+		UserName:    row.Email,
+		DisplayName: row.Name,
+		Emails:      []SCIMEmail{{Value: row.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &SCIMMeta{
+			ResourceType: "User",
+			Created:      row.Created,
+			LastModified: row.Updated,
+			Location:     strings.TrimRight(appURL, "/") + "/scim/v2/Users/" + row.Id,
+		},
+	}
+	if row.Name != "" {
+		user.Name = &SCIMName{Formatted: row.Name}
+	}
+	return user
+}
+
+// email returns the userName of the user when it is an email, its primary
+// email otherwise.
+func (u SCIMUser) email() string {
+	if strings.Contains(u.UserName, "@") {
+		return u.UserName
+	}
+	for _, email := range u.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return u.UserName
+}
+
+// fullName returns displayName, or else the formatted name or the given
+// and family names.
+func (u SCIMUser) fullName() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	if u.Name == nil {
+		return ""
+	}
+	if u.Name.Formatted != "" {
+		return u.Name.Formatted
+	}
+	return strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName)
+}
+
+// FindSCIMUser returns the SCIM representation of the user.
+func FindSCIMUser(app core.App, userId string) (SCIMUser, error) {
+	row, err := scimUsers.Find(app, userId)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	return NewSCIMUser(app.Settings().Meta.AppURL, *row), nil
+}
+
+// ListSCIMUsers returns the page of the users matching filter starting at
+// the 1-based startIndex, and the number of matching users.
+func ListSCIMUsers(app core.App, filter dbx.Expression, startIndex int, count int) ([]SCIMUser, int, error) {
+	total, err := scimUsers.Count(app, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows := []scimUserRow{}
+	if count > 0 {
+		err = andWhere(scimUsers.Query(app), filter).
+			OrderBy("created ASC", "id ASC").
+			Offset(int64(startIndex - 1)).
+			Limit(int64(count)).
+			All(&rows)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	users := make([]SCIMUser, len(rows))
+	for i, row := range rows {
+		users[i] = NewSCIMUser(app.Settings().Meta.AppURL, row)
+	}
+	return users, total, nil
+}
+
+// CreateSCIMUser provisions the user, verified since its email comes from
+// the identity provider.
+func CreateSCIMUser(app core.App, u SCIMUser) (*models.User, error) {
+	var user *models.User
+	err := WithTx(app, func(txApp core.App) error {
+		var err error
+		user, err = CreateUser(txApp, models.UserCreationRequest{Email: u.email(), Name: u.fullName()})
+		if err != nil {
+			return err
+		}
+		cs := Changeset{"verified": true, scimExternalIdColumn: u.ExternalId}
+		if u.Active != nil {
+			cs[LockedField] = !*u.Active
+		}
+		if _, err := Users.Untouched().Update(txApp, user.Id, cs); err != nil {
+			return err
+		}
+		if user, err = GetUserById(txApp, user.Id); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserCreated, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// SCIMUserPatch holds the changes of the operations of a PATCH, nil for
+// the attributes left as they are.
+type SCIMUserPatch struct {
+	Email      *string
+	Name       *string
+	Active     *bool
+	ExternalId *string
+	givenName  *string
+	familyName *string
+}
+
+// ApplySCIMPatch collects the changes of the add and replace operations,
+// with or without a path, and of the remove operations of externalId and
+// the name. current is the user before the PATCH, whose name is completed
+// by the changes of its given or family name.
+func ApplySCIMPatch(current SCIMUser, ops []SCIMPatchOperation) (SCIMUserPatch, error) {
+	p := SCIMUserPatch{}
+	errs := validation.Errors{}
+	for i, op := range ops {
+		key := "Operations." + strconv.Itoa(i)
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+			if op.Path == "" {
+				values := map[string]json.RawMessage{}
+				if err := json.Unmarshal(op.Value, &values); err != nil {
+					errs[key] = errors.New("value must be an object without a path")
+					continue
+				}
+				for path, value := range values {
+					if err := p.set(path, value); err != nil {
+						errs[key+"."+path] = err
+					}
+				}
+			} else if err := p.set(op.Path, op.Value); err != nil {
+				errs[key] = err
+			}
+		case "remove":
+			empty := ""
+			switch strings.ToLower(op.Path) {
+			case "externalid":
+				p.ExternalId = &empty
+			case "displayname", "name", "name.formatted":
+				p.Name = &empty
+			default:
+				errs[key] = fmt.Errorf("can't remove %q", op.Path)
+			}
+		default:
+			errs[key] = fmt.Errorf("unsupported op %q", op.Op)
+		}
+	}
+	if len(errs) > 0 {
+		return SCIMUserPatch{}, errs
+	}
+
+	if p.Name == nil && (p.givenName != nil || p.familyName != nil) {
+		given, family, _ := strings.Cut(current.DisplayName, " ")
+		if p.givenName != nil {
+			given = *p.givenName
+		}
+		if p.familyName != nil {
+			family = *p.familyName
+		}
+		name := strings.TrimSpace(given + " " + family)
+		p.Name = &name
+	}
+	return p, nil
+}
+
+// set applies the value of an attribute path, e.g. active or
+// emails[type eq "work"].value.
+func (p *SCIMUserPatch) set(path string, raw json.RawMessage) error {
+	attr := strings.ToLower(path)
+	if strings.HasPrefix(attr, "emails[") && strings.HasSuffix(attr, "].value") {
+		attr = "emails.value"
+	}
+	switch attr {
+	case "active":
+		// some providers send the booleans as strings, e.g. "False"
+		active, err := scimBool(raw)
+		if err != nil {
+			return err
+		}
+		p.Active = &active
+		return nil
+	case "name":
+		name := SCIMName{}
+		if err := json.Unmarshal(raw, &name); err != nil {
+			return errors.New("must be an object")
+		}
+		full := SCIMUser{Name: &name}.fullName()
+		p.Name = &full
+		return nil
+	case "emails":
+		emails := []SCIMEmail{}
+		if err := json.Unmarshal(raw, &emails); err != nil || len(emails) == 0 {
+			return errors.New("must be a non empty array")
+		}
+		email := SCIMUser{Emails: emails}.email()
+		p.Email = &email
+		return nil
+	}
+
+	value := ""
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return errors.New("must be a string")
+	}
+	switch attr {
+	case "username", "emails.value":
+		p.Email = &value
+	case "displayname", "name.formatted":
+		p.Name = &value
+	case "name.givenname":
+		p.givenName = &value
+	case "name.familyname":
+		p.familyName = &value
+	case "externalid":
+		p.ExternalId = &value
+	default:
+		return fmt.Errorf("unsupported path %q", path)
+	}
+	return nil
+}
+
+func scimBool(raw json.RawMessage) (bool, error) {
+	b := false
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, nil
+	}
+	s := ""
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if b, err := strconv.ParseBool(strings.ToLower(s)); err == nil {
+			return b, nil
+		}
+	}
+	return false, errors.New("must be a boolean")
+}
+
+// UpdateSCIMUser applies the patch to the user, the email without the
+// confirmation the other routes require since the identity provider owns
+// it. Locking and unlocking the user through active isn't a change of it,
+// see SetUserLocked.
+func UpdateSCIMUser(app core.App, userId string, p SCIMUserPatch) (map[string]FieldChange, error) {
+	var changed map[string]FieldChange
+	err := WithTx(app, func(txApp core.App) error {
+		if _, err := GetUserById(txApp, userId); err != nil {
+			return err
+		}
+		ur := models.UserUpdateRequest{Email: p.Email, Name: p.Name}
+		if ur.Email != nil || ur.Name != nil {
+			if err := ValidateUserUpdateRequest(ur); err != nil {
+				return err
+			}
+			if err := CheckUserUpdate(txApp, userId, ur); err != nil {
+				return err
+			}
+			var err error
+			if _, changed, err = UpdateUserById(txApp, userId, ur); err != nil {
+				return err
+			}
+		}
+		cs := Changeset{}
+		if p.Active != nil {
+			cs[LockedField] = !*p.Active
+		}
+		if p.ExternalId != nil {
+			cs[scimExternalIdColumn] = *p.ExternalId
+		}
+		if len(cs) > 0 {
+			if _, err := Users.Untouched().Update(txApp, userId, cs); err != nil {
+				return err
+			}
+		}
+		user, err := GetUserById(txApp, userId)
+		if err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserUpdated, user)
+	})
+	return changed, err
+}
+
+// RequireSCIMToken rejects the requests to /scim/v2 without SCIM_TOKEN as
+// bearer token, the routes not existing while it is unset.
+func RequireSCIMToken(cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if cfg.SCIMToken == "" {
+			return writeSCIMError(e, http.StatusNotFound, "", "SCIM provisioning is disabled")
+		}
+		token, ok := strings.CutPrefix(e.Request.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.SCIMToken)) != 1 {
+			e.Response.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			return writeSCIMError(e, http.StatusUnauthorized, "", "invalid or missing bearer token")
+		}
+		return e.Next()
+	}
+}
+
+func writeSCIM(e *core.RequestEvent, status int, v any) error {
+	e.Response.Header().Set("Content-Type", SCIMContentType)
+	e.Response.WriteHeader(status)
+	return json.NewEncoder(e.Response).Encode(v)
+}
+
+func writeSCIMError(e *core.RequestEvent, status int, scimType string, detail string) error {
+	return writeSCIM(e, status, SCIMError{
+		Schemas:  []string{SCIMErrorSchema},
+		Status:   strconv.Itoa(status),
+		SCIMType: scimType,
+		Detail:   PII.String(detail),
+	})
+}
+
+// writeSCIMStorageError answers the errors of the storage functions in the
+// SCIM error format.
+func writeSCIMStorageError(e *core.RequestEvent, err error, action string) error {
+	var validationErrs validation.Errors
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return writeSCIMError(e, http.StatusNotFound, "", "user not found")
+	case errors.Is(err, ErrEmailTaken):
+		return writeSCIMError(e, http.StatusConflict, "uniqueness", err.Error())
+	case errors.As(err, &validationErrs):
+		return writeSCIMError(e, http.StatusBadRequest, "invalidValue", validationErrs.Error())
+	}
+	// the other codes of the registry, e.g. a busy database, in the SCIM
+	// format
+	if code, message := ClassifyError(err); code != CodeInternalError {
+		status := ErrorStatus(code)
+		if status == http.StatusServiceUnavailable {
+			e.Response.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds))
+		}
+		return writeSCIMError(e, status, "", message)
+	}
+	e.App.Logger().Error("SCIM request failed", "action", action, "error", err)
+	return writeSCIMError(e, http.StatusInternalServerError, "", action)
+}
+
+// writeSCIMBodyError answers the bodies that couldn't be decoded. They are
+// sent as application/scim+json, which BindStrict doesn't read.
+func writeSCIMBodyError(e *core.RequestEvent, err error) error {
+	if limit, ok := IsBodyTooLarge(err); ok {
+		return writeBodyTooLarge(e, limit)
+	}
+	return writeSCIMError(e, http.StatusBadRequest, "invalidSyntax", "request body must be a JSON object")
+}
+
+// HandleListSCIMUsers answers GET /scim/v2/Users, with the filter,
+// startIndex and count parameters.
+func HandleListSCIMUsers(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		query := e.Request.URL.Query()
+		filter, err := ParseSCIMFilter(query.Get("filter"))
+		if err != nil {
+			return writeSCIMError(e, http.StatusBadRequest, "invalidFilter", err.Error())
+		}
+		startIndex, count := 1, cfg.DefaultPerPage
+		if s := query.Get("startIndex"); s != "" {
+			// the values below 1 are read as 1, per RFC 7644
+			if startIndex, err = strconv.Atoi(s); err != nil {
+				return writeSCIMError(e, http.StatusBadRequest, "invalidValue", "startIndex must be an integer")
+			}
+			startIndex = max(startIndex, 1)
+		}
+		if s := query.Get("count"); s != "" {
+			if count, err = strconv.Atoi(s); err != nil {
+				return writeSCIMError(e, http.StatusBadRequest, "invalidValue", "count must be an integer")
+			}
+			count = min(max(count, 0), cfg.MaxPerPage)
+		}
+
+		users, total, err := ListSCIMUsers(app, filter, startIndex, count)
+		if err != nil {
+			return writeSCIMStorageError(e, err, "error listing users")
+		}
+		return writeSCIM(e, http.StatusOK, SCIMListResponse{
+			Schemas:      []string{SCIMListSchema},
+			TotalResults: total,
+			StartIndex:   startIndex,
+			ItemsPerPage: len(users),
+			Resources:    users,
+		})
+	}
+}
+
+func HandleGetSCIMUser(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		user, err := FindSCIMUser(WithTrace(app, e), e.Request.PathValue("userId"))
+		if err != nil {
+			return writeSCIMStorageError(e, err, "error getting user")
+		}
+		return writeSCIM(e, http.StatusOK, user)
+	}
+}
+
+// HandleCreateSCIMUser answers POST /scim/v2/Users, provisioning a user.
+func HandleCreateSCIMUser(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		u := SCIMUser{}
+		if err := json.NewDecoder(e.Request.Body).Decode(&u); err != nil {
+			return writeSCIMBodyError(e, err)
+		}
+		user, err := CreateSCIMUser(app, u)
+		if err != nil {
+			return writeSCIMStorageError(e, err, "error creating user")
+		}
+		SetAuditedUser(e, user.Id)
+		created, err := FindSCIMUser(app, user.Id)
+		if err != nil {
+			return writeSCIMStorageError(e, err, "error getting user")
+		}
+		e.Response.Header().Set("Location", created.Meta.Location)
+		return writeSCIM(e, http.StatusCreated, created)
+	}
+}
+
+// HandlePatchSCIMUser answers PATCH /scim/v2/Users/{userId}, through which
+// the identity providers update and deactivate the users.
+func HandlePatchSCIMUser(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		req := SCIMPatchRequest{}
+		if err := json.NewDecoder(e.Request.Body).Decode(&req); err != nil {
+			return writeSCIMBodyError(e, err)
+		}
+		current, err := FindSCIMUser(app, userId)
+		if err != nil {
+			return writeSCIMStorageError(e, err, "error getting user")
+		}
+		patch, err := ApplySCIMPatch(current, req.Operations)
+		if err != nil {
+			return writeSCIMError(e, http.StatusBadRequest, "invalidValue", err.Error())
+		}
+
+		changed, err := UpdateSCIMUser(app, userId, patch)
+		if err != nil {
+			return writeSCIMStorageError(e, err, "error updating user")
+		}
+		SetAuditChanges(e, changed)
+		updated, err := FindSCIMUser(app, userId)
+		if err != nil {
+			return writeSCIMStorageError(e, err, "error getting user")
+		}
+		return writeSCIM(e, http.StatusOK, updated)
+	}
+}
+
+// HandleDeleteSCIMUser answers DELETE /scim/v2/Users/{userId}, soft
+// deleting the user.
+func HandleDeleteSCIMUser(users UserService) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		users := users.WithRequest(e)
+		if err := users.Delete(e.Request.PathValue("userId"), nil); err != nil {
+			return writeSCIMStorageError(e, err, "error deleting user")
+		}
+		return e.NoContent(http.StatusNoContent)
+	}
+}
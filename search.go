@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// The markers around the matched terms in the search highlights. The
+// highlighted values are not HTML escaped.
+const (
+	SearchHighlightOpen  = "<mark>"
+	SearchHighlightClose = "</mark>"
+)
+
+// SearchMaxTerms caps the number of terms of a search query.
+const SearchMaxTerms = 8
+
+var (
+	ErrSearchQueryEmpty   = errors.New("empty search query")
+	ErrSearchQueryTooLong = fmt.Errorf("search query has more than %d terms", SearchMaxTerms)
+)
+
+type SearchHighlights struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type SearchResult struct {
+	User       models.User      `json:"user"`
+	Score      float64          `json:"score"`
+	Highlights SearchHighlights `json:"highlights"`
+}
+
+type searchRow struct {
+	models.User
+	Rank           float64 `db:"rank"`
+	NameHighlight  string  `db:"name_highlight"`
+	EmailHighlight string  `db:"email_highlight"`
+}
+
+// NewSearchMatch turns the words of q into an FTS5 query matching all of
+// them as prefixes within columns. Every word is quoted, so that the FTS5
+// operators and punctuation in q are taken literally.
+func NewSearchMatch(q string, columns []string) (string, error) {
+	terms := strings.FieldsFunc(q, unicode.IsSpace)
+	if len(terms) == 0 {
+		return "", ErrSearchQueryEmpty
+	}
+	if len(terms) > SearchMaxTerms {
+		return "", ErrSearchQueryTooLong
+	}
+
+	phrases := make([]string, len(terms))
+	for i, term := range terms {
+		phrases[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+	return "{" + strings.Join(columns, " ") + "} : (" + strings.Join(phrases, " ") + ")", nil
+}
+
+// SearchUsers returns the users whose name or email match q, best match
+// first. Unless withHiddenEmails is set, only the emails with
+// emailVisibility are searched.
+func SearchUsers(app core.App, q string, limit int, withHiddenEmails bool) ([]SearchResult, error) {
+	emailColumn, emailIndex := "email_public", 2
+	if withHiddenEmails {
+		emailColumn, emailIndex = "email", 1
+	}
+	match, err := NewSearchMatch(q, []string{"name", emailColumn})
+	if err != nil {
+		return nil, err
+	}
+
+	span := StartStorageSpan(app, "SearchUsers", "SELECT")
+	rows := []searchRow{}
+	err = app.DB().
+		Select(
+			"users.*",
+			"bm25(users_fts, 10.0, 1.0, 1.0) AS rank",
+			"highlight(users_fts, 0, {:open}, {:close}) AS name_highlight",
+			"highlight(users_fts, "+strconv.Itoa(emailIndex)+", {:open}, {:close}) AS email_highlight",
+		).
+		From("users_fts").
+		InnerJoin("users", dbx.NewExp("users.rowid = users_fts.rowid")).
+		Where(dbx.NewExp("users_fts MATCH {:match}", dbx.Params{"match": match})).
+		AndWhere(Users.scope(app)).
+		OrderBy("rank ASC").
+		Limit(int64(limit)).
+		Bind(dbx.Params{"open": SearchHighlightOpen, "close": SearchHighlightClose}).
+		All(&rows)
+	span.SetAttr("db.response.returned_rows", len(rows))
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchResult, len(rows))
+	for i, row := range rows {
+		results[i] = SearchResult{
+			User: row.User,
+			// bm25 is negative, lower meaning more relevant
+			Score:      -row.Rank,
+			Highlights: SearchHighlights{Name: row.NameHighlight, Email: row.EmailHighlight},
+		}
+	}
+	return results, nil
+}
+
+func HandleSearchUsers(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		query := e.Request.URL.Query()
+
+		limit := cfg.DefaultPerPage
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return WriteBadRequest(e, "bad request: invalid limit "+v, nil)
+			}
+			limit = min(n, cfg.MaxPerPage)
+		}
+
+		results, err := SearchUsers(app, query.Get("q"), limit, e.HasSuperuserAuth())
+		if errors.Is(err, ErrSearchQueryEmpty) || errors.Is(err, ErrSearchQueryTooLong) {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error searching users: "+err.Error(), nil)
+		}
+
+		for i, result := range results {
+			results[i].User = RedactUser(e, result.User)
+			if results[i].User.Email == "" {
+				results[i].Highlights.Email = ""
+			}
+		}
+		return WriteOK(e, "", results)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/spf13/cobra"
+)
+
+var seedFirstNames = []string{
+	"Ada", "Alan", "Barbara", "Claude", "Dennis", "Edsger", "Frances", "Grace",
+	"Hedy", "Ivan", "Jean", "Ken", "Linus", "Margaret", "Niklaus", "Radia",
+}
+
+var seedLastNames = []string{
+	"Allen", "Backus", "Cerf", "Dijkstra", "Hamilton", "Hopper", "Kay", "Knuth",
+	"Lamarr", "Liskov", "Lovelace", "Perlman", "Ritchie", "Thompson", "Turing", "Wirth",
+}
+
+type SeedOptions struct {
+	Count         int
+	Seed          uint64
+	VerifiedRatio float64
+	Avatars       bool
+	BatchSize     int
+	// Tenant is the slug of the tenant of the users, none when empty.
+	Tenant string
+}
+
+// DemoSeedOptions are the users ResetDemoData replaces the users with, the
+// defaults of the seed command but for the count, DEMO_SEED_USERS.
+var DemoSeedOptions = SeedOptions{Count: 50, Seed: 1, VerifiedRatio: 0.5, BatchSize: 100}
+
+var ErrDemoResetRefused = errors.New("refusing to reset the demo data outside of the read-only mode")
+
+type SeedResult struct {
+	Created int
+	Skipped int
+}
+
+// SeedUser returns the i-th fake user generated from seed. The email embeds
+// i so that every user of a run is unique and reruns produce the same rows.
+func SeedUser(rng *rand.Rand, i int, verifiedRatio float64) (name string, email string, verified bool) {
+	first := seedFirstNames[rng.IntN(len(seedFirstNames))]
+	last := seedLastNames[rng.IntN(len(seedLastNames))]
+	name = first + " " + last
+	email = fmt.Sprintf("%s.%s.%d@example.com", strings.ToLower(first), strings.ToLower(last), i)
+	verified = rng.Float64() < verifiedRatio
+	return name, email, verified
+}
+
+type seedRow struct {
+	name     string
+	email    string
+	verified bool
+}
+
+// SeedUsers inserts opts.Count fake users in batched transactions, skipping
+// emails that already exist so that running it twice is harmless.
+func SeedUsers(app core.App, opts SeedOptions) (*SeedResult, error) {
+	if opts.BatchSize < 1 {
+		return nil, errors.New("batch size must be at least 1")
+	}
+
+	collection, err := app.FindCachedCollectionByNameOrId("users")
+	if err != nil {
+		return nil, err
+	}
+
+	tenantId := ""
+	if opts.Tenant != "" {
+		tenant, err := Tenants.FindOne(app, dbx.HashExp{"slug": opts.Tenant})
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("no tenant %q", opts.Tenant)
+		}
+		if err != nil {
+			return nil, err
+		}
+		tenantId = tenant.Id
+	}
+
+	rng := rand.New(rand.NewPCG(opts.Seed, opts.Seed))
+	result := &SeedResult{}
+
+	for start := 0; start < opts.Count; start += opts.BatchSize {
+		rows := []seedRow{}
+		for i := start; i < min(start+opts.BatchSize, opts.Count); i++ {
+			name, email, verified := SeedUser(rng, i, opts.VerifiedRatio)
+			rows = append(rows, seedRow{name: name, email: email, verified: verified})
+		}
+
+		created := 0
+		err := WithTx(app, func(txApp core.App) error {
+			created = 0
+			for _, row := range rows {
+				ok, err := seedOne(txApp, collection, row, tenantId, opts.Avatars)
+				if err != nil {
+					return err
+				}
+				if ok {
+					created++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+		result.Created += created
+		result.Skipped += len(rows) - created
+	}
+
+	return result, nil
+}
+
+// seedOne inserts row unless its email is taken and reports whether it did.
+func seedOne(txApp core.App, collection *core.Collection, row seedRow, tenant string, avatar bool) (bool, error) {
+	res, err := txApp.DB().
+		NewQuery("INSERT OR IGNORE INTO users (email, emailVisibility, verified, name, tenant_id) VALUES ({:email}, {:emailVisibility}, {:verified}, {:name}, {:tenant})").
+		Bind(dbx.Params{
+			"email":           row.email,
+			"emailVisibility": false,
+			"verified":        row.verified,
+			"name":            row.name,
+			"tenant":          tenant,
+		}).
+		Execute()
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	if !avatar {
+		return true, nil
+	}
+
+	user, err := GetUserByEmail(txApp, row.email)
+	if err != nil {
+		return false, err
+	}
+	data, err := RenderIdenticon(row.email)
+	if err != nil {
+		return false, err
+	}
+	fsys, err := txApp.NewFilesystem()
+	if err != nil {
+		return false, err
+	}
+	defer fsys.Close()
+
+	filename := "avatar_" + user.Id + ".png"
+	if err := fsys.Upload(data, collection.Id+"/"+user.Id+"/"+filename); err != nil {
+		return false, err
+	}
+	_, err = txApp.DB().
+		Update("users", dbx.Params{"avatar": filename}, dbx.HashExp{"id": user.Id}).
+		Execute()
+	return err == nil, err
+}
+
+// WipeUsers deletes every user, along with what cascades from them.
+func WipeUsers(app core.App) error {
+	collection, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		return err
+	}
+	return app.TruncateCollection(collection)
+}
+
+// ResetDemoData replaces the users with the ones of DemoSeedOptions, for a
+// public demo to start each day from the same data. The wipe and the seed
+// share a transaction, for the demo never to be seen without users, nor
+// left without any by a failed seed. It only runs in the read-only mode,
+// for the task enabled by mistake not to wipe a real deployment.
+func ResetDemoData(app core.App, _ time.Time, _ time.Duration) error {
+	readOnly, err := IsReadOnly(app)
+	if err != nil {
+		return err
+	}
+	if !readOnly {
+		return ErrDemoResetRefused
+	}
+	var result *SeedResult
+	err = WithTx(app, func(txApp core.App) error {
+		if err := WipeUsers(txApp); err != nil {
+			return err
+		}
+		result, err = SeedUsers(txApp, DemoSeedOptions)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	UserResponseCache.Invalidate()
+	app.Logger().Info("Reset the demo data", "created", result.Created)
+	return nil
+}
+
+func NewSeedCommand(app core.App) *cobra.Command {
+	opts := SeedOptions{}
+	command := &cobra.Command{
+		Use:          "seed",
+		Short:        "Inserts fake users for demos and local development",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			result, err := SeedUsers(app, opts)
+			if result != nil {
+				fmt.Printf("created %d users, skipped %d existing\n", result.Created, result.Skipped)
+			}
+			return err
+		},
+	}
+	command.Flags().IntVar(&opts.Count, "count", 50, "number of users to generate")
+	command.Flags().Uint64Var(&opts.Seed, "seed", 1, "seed of the generator, the same seed always yields the same users")
+	command.Flags().Float64Var(&opts.VerifiedRatio, "verified", 0.5, "ratio of users marked as verified (0-1)")
+	command.Flags().BoolVar(&opts.Avatars, "avatars", false, "upload a generated avatar for every new user")
+	command.Flags().IntVar(&opts.BatchSize, "batch-size", 100, "number of users inserted per transaction")
+	command.Flags().StringVar(&opts.Tenant, "tenant", "", "slug of the tenant of the generated users")
+	return command
+}
+
+func NewWipeUsersCommand(app core.App) *cobra.Command {
+	yes := false
+	command := &cobra.Command{
+		Use:          "wipe-users",
+		Short:        "Deletes every user",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if !yes {
+				return errors.New("refusing to delete all users without --yes")
+			}
+			if err := WipeUsers(app); err != nil {
+				return err
+			}
+			fmt.Println("deleted all users")
+			return nil
+		},
+	}
+	command.Flags().BoolVar(&yes, "yes", false, "confirm the deletion")
+	return command
+}
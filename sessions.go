@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// sessionClaim holds the session id in the users tokens.
+const sessionClaim = "sid"
+
+const (
+	sessionRequestKey      = "session"
+	sessionsCleanupJobName = "sessionsCleanup"
+	deviceNameMaxLength    = 255
+)
+
+// DeviceNameHeader names the device of a login, e.g. "Alice's phone",
+// rather than the one guessed from its User-Agent.
+const DeviceNameHeader = "X-Device-Name"
+
+var ErrSessionRevoked = errors.New("the session was revoked")
+
+// Session is a login of a user, on a device. The tokens issued by the login
+// and the ones refreshed from them carry its id, and are refused once it is
+// revoked.
+type Session struct {
+	Id         string `db:"id" json:"id"`
+	User       string `db:"user" json:"-"`
+	Device     string `db:"device" json:"device"`
+	IP         string `db:"ip" json:"ip"`
+	UserAgent  string `db:"user_agent" json:"userAgent"`
+	LastActive string `db:"last_active" json:"lastActive"`
+	Created    string `db:"created" json:"created"`
+	// Current is set on the session of the request.
+	Current bool `db:"-" json:"current"`
+}
+
+type sessionEntry struct {
+	Id         string `db:"id"`
+	User       string `db:"user"`
+	Device     string `db:"device"`
+	IP         string `db:"ip"`
+	UserAgent  string `db:"user_agent"`
+	LastActive string `db:"last_active"`
+}
+
+var Sessions = &Repository[Session]{
+	Table:         "sessions",
+	CreatedColumn: "created",
+	UpdatedColumn: "updated",
+}
+
+// StartSession records a new session of the user, on the device the request
+// came from, and returns its id.
+func StartSession(app core.App, e *core.RequestEvent, userId string) (string, error) {
+	userAgent := e.Request.UserAgent()
+	if len(userAgent) > userAgentMaxLength {
+		userAgent = userAgent[:userAgentMaxLength]
+	}
+	device := strings.TrimSpace(e.Request.Header.Get(DeviceNameHeader))
+	if device == "" {
+		device = DescribeUserAgent(userAgent)
+	}
+	if len(device) > deviceNameMaxLength {
+		device = device[:deviceNameMaxLength]
+	}
+	entry := sessionEntry{
+		Id:         NewId(Sessions.Table),
+		User:       userId,
+		Device:     device,
+		IP:         e.RealIP(),
+		UserAgent:  userAgent,
+		LastActive: types.NowDateTime().String(),
+	}
+	if err := Sessions.Insert(app, entry); err != nil {
+		return "", err
+	}
+	return entry.Id, nil
+}
+
+// NewSessionToken issues a PocketBase auth token for the users record,
+// carrying the session id.
+func NewSessionToken(record *core.Record, sessionId string) (string, error) {
+	claims := map[string]any{
+		core.TokenClaimType:         core.TokenTypeAuth,
+		core.TokenClaimId:           record.Id,
+		core.TokenClaimCollectionId: record.Collection().Id,
+		core.TokenClaimRefreshable:  true,
+		sessionClaim:                sessionId,
+	}
+	return security.NewJWT(claims, record.TokenKey()+record.Collection().AuthToken.Secret, record.Collection().AuthToken.DurationTime())
+}
+
+// tokenSessionId returns the session id of the token of the request, ""
+// for the impersonation tokens and the ones issued before the sessions
+// were tracked.
+func tokenSessionId(e *core.RequestEvent) string {
+	// PocketBase has already checked the signature of the token
+	token := strings.TrimPrefix(e.Request.Header.Get("Authorization"), "Bearer ")
+	claims, err := security.ParseUnverifiedJWT(token)
+	if err != nil {
+		return ""
+	}
+	sessionId, _ := claims[sessionClaim].(string)
+	return sessionId
+}
+
+// RequestSessionId returns the session of the requester, checked by
+// CheckSessions, "" when the request isn't made with a session token.
+func RequestSessionId(e *core.RequestEvent) string {
+	sessionId, _ := e.Get(sessionRequestKey).(string)
+	return sessionId
+}
+
+// FindUserSession returns the session of the user, ErrNotFound when it
+// doesn't exist or was revoked.
+func FindUserSession(app core.App, userId string, sessionId string) (*Session, error) {
+	return Sessions.FindOne(app, dbx.HashExp{"id": sessionId, "user": userId})
+}
+
+// ListUserSessions returns the sessions of the user, the most recently
+// active first.
+func ListUserSessions(app core.App, userId string) ([]Session, error) {
+	sessions := []Session{}
+	err := Sessions.Query(app).
+		AndWhere(dbx.HashExp{"user": userId}).
+		OrderBy("last_active DESC", "created DESC").
+		All(&sessions)
+	return sessions, err
+}
+
+// RevokeSession deletes the session of the user, after which the tokens
+// carrying it are refused. It returns ErrNotFound when there is no such
+// session.
+func RevokeSession(app core.App, userId string, sessionId string) (*Session, error) {
+	session, err := FindUserSession(app, userId, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := Sessions.Delete(app, session.Id); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// TouchSession sets the last activity of the session to now. Like lastSeen,
+// it isn't a change of the session, its updated time stays.
+func TouchSession(app core.App, sessionId string, now time.Time) error {
+	lastActive, err := types.ParseDateTime(now)
+	if err != nil {
+		return err
+	}
+	_, err = Sessions.Untouched().Update(app, sessionId, Changeset{"last_active": lastActive.String()})
+	return err
+}
+
+// CheckSessions refuses the requests made with the token of a revoked
+// session, and records the last activity of the others, at most once per
+// interval of tracker. The tokens without a session are let through.
+func CheckSessions(app core.App, tracker *LastSeenTracker) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil || e.Auth.Collection().Name != Users.Table {
+			return e.Next()
+		}
+		sessionId := tokenSessionId(e)
+		if sessionId == "" {
+			return e.Next()
+		}
+		_, err := FindUserSession(app, e.Auth.Id, sessionId)
+		if errors.Is(err, ErrNotFound) {
+			return WriteErrorCode(e, CodeSessionRevoked, ErrSessionRevoked.Error(), nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error checking session")
+		}
+		e.Set(sessionRequestKey, sessionId)
+
+		now := time.Now()
+		if tracker.ShouldWrite(sessionId, now) {
+			Drain.Go(func() {
+				if err := TouchSession(app, sessionId, now); err != nil {
+					app.Logger().Warn("Failed to update session activity", "sessionId", sessionId, "error", err)
+				}
+			})
+		}
+		return e.Next()
+	}
+}
+
+// BindSessionHooks starts a session for the tokens issued by the built-in
+// auth endpoints of the users collection, e.g. auth-with-password and
+// auth-with-oauth2, their auth-refresh keeping the session of its token.
+func BindSessionHooks(app core.App) {
+	app.OnRecordAuthRequest(Users.Table).BindFunc(func(e *core.RecordAuthRequestEvent) error {
+		sessionId := ""
+		if e.Auth != nil && e.Auth.Id == e.Record.Id {
+			sessionId = tokenSessionId(e.RequestEvent)
+		}
+		if sessionId == "" {
+			var err error
+			sessionId, err = StartSession(e.App, e.RequestEvent, e.Record.Id)
+			if err != nil {
+				return err
+			}
+		} else if err := TouchSession(e.App, sessionId, time.Now()); err != nil {
+			return err
+		}
+		token, err := NewSessionToken(e.Record, sessionId)
+		if err != nil {
+			return err
+		}
+		e.Token = token
+		return e.Next()
+	})
+}
+
+// DeleteExpiredSessions removes the sessions inactive for longer than the
+// users tokens last, whose tokens have all expired.
+func DeleteExpiredSessions(app core.App) error {
+	collection, err := app.FindCachedCollectionByNameOrId(Users.Table)
+	if err != nil {
+		return err
+	}
+	cutoff, err := types.ParseDateTime(time.Now().Add(-collection.AuthToken.DurationTime()))
+	if err != nil {
+		return err
+	}
+	return RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().Delete(Sessions.Table, dbx.NewExp(
+			"last_active < {:cutoff}", dbx.Params{"cutoff": cutoff.String()},
+		)).Execute()
+		return err
+	})
+}
+
+// ScheduleSessionsCleanup deletes the expired sessions every hour.
+func ScheduleSessionsCleanup(app core.App) {
+	app.Cron().MustAdd(sessionsCleanupJobName, "30 * * * *", func() {
+		if err := DeleteExpiredSessions(app); err != nil {
+			app.Logger().Warn("Failed to delete expired sessions", "error", err)
+		}
+	})
+}
+
+// userAgentBrowsers and userAgentSystems are matched in order, the Chromium
+// based browsers mentioning Chrome and Safari too.
+var (
+	userAgentBrowsers = [][2]string{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	}
+	userAgentSystems = [][2]string{
+		{"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	}
+)
+
+// DescribeUserAgent names the device of a User-Agent for the users, e.g.
+// "Firefox on Windows", or returns the product of the non browser clients,
+// e.g. curl.
+func DescribeUserAgent(userAgent string) string {
+	browser, system := "", ""
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(userAgent, b[0]) {
+			browser = b[1]
+			break
+		}
+	}
+	for _, s := range userAgentSystems {
+		if strings.Contains(userAgent, s[0]) {
+			system = s[1]
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	product, _, _ := strings.Cut(userAgent, "/")
+	if product = strings.TrimSpace(product); product != "" {
+		return product
+	}
+	return "Unknown device"
+}
+
+// HandleListSessions lists the sessions of the user, marking the one of the
+// request as current.
+func HandleListSessions(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		sessions, err := ListUserSessions(WithTrace(app, e), e.Request.PathValue("userId"))
+		if err != nil {
+			return WriteError(e, err, "error getting sessions")
+		}
+		current := RequestSessionId(e)
+		for i := range sessions {
+			sessions[i].Current = sessions[i].Id == current
+		}
+		e.Response.Header().Set("Cache-Control", "no-store")
+		return WriteOK(e, "", sessions)
+	}
+}
+
+// HandleRevokeSession logs the device of the session out, the current one
+// included.
+func HandleRevokeSession(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		session, err := RevokeSession(app, userId, e.Request.PathValue("sessionId"))
+		if errors.Is(err, ErrNotFound) {
+			return WriteNotFound(e, "session not found", nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error revoking session")
+		}
+		SetAuditedUser(e, userId)
+		session.Current = session.Id == RequestSessionId(e)
+		return WriteOK(e, "", session)
+	}
+}
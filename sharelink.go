@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var (
+	ErrShareLinkInvalid = errors.New("invalid share link")
+	ErrShareLinkExpired = errors.New("share link expired")
+)
+
+// ShareLink is a link to GET /shared/{token}, absolute when the app URL is
+// set.
+type ShareLink struct {
+	URL     string `json:"url"`
+	Token   string `json:"token"`
+	Expires string `json:"expires"`
+}
+
+// PublicUser holds the fields of a user that can be shown to anyone.
+type PublicUser struct {
+	Id       string `json:"id"`
+	Email    string `json:"email,omitempty"`
+	Verified bool   `json:"verified"`
+	Name     string `json:"name"`
+	Avatar   string `json:"avatar"`
+	Created  string `json:"created"`
+}
+
+func NewPublicUser(user models.User) PublicUser {
+	pu := PublicUser{
+		Id:       user.Id,
+		Verified: user.Verified,
+		Name:     user.Name,
+		Avatar:   user.Avatar,
+		Created:  user.Created,
+	}
+	if user.EmailVisibility {
+		pu.Email = user.Email
+	}
+	return pu
+}
+
+// NewShareLinkSecret returns a random secret, used when none is configured.
+func NewShareLinkSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return base64.RawURLEncoding.EncodeToString(secret)
+}
+
+// SignShareToken returns a token of the form base64(userId:expiry).base64(hmac).
+func SignShareToken(secret []byte, userId string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(userId + ":" + strconv.FormatInt(expires.Unix(), 10)))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(shareTokenMAC(secret, payload))
+}
+
+// VerifyShareToken checks the token signature and expiry and returns the
+// user id it was issued for.
+func VerifyShareToken(secret []byte, token string, now time.Time) (string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrShareLinkInvalid
+	}
+	rawSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(rawSig, shareTokenMAC(secret, payload)) {
+		return "", ErrShareLinkInvalid
+	}
+	rawPayload, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrShareLinkInvalid
+	}
+	userId, exp, ok := strings.Cut(string(rawPayload), ":")
+	if !ok {
+		return "", ErrShareLinkInvalid
+	}
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return "", ErrShareLinkInvalid
+	}
+	if now.After(time.Unix(expUnix, 0)) {
+		return "", ErrShareLinkExpired
+	}
+	return userId, nil
+}
+
+func shareTokenMAC(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func HandleCreateShareLink(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		userId := e.Request.PathValue("userId")
+
+		ttl := cfg.ShareLinkDefaultTTL
+		if v := e.Request.URL.Query().Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return WriteBadRequest(e, "bad request: invalid ttl "+v, nil)
+			}
+			ttl = d
+		}
+		ttl = min(ttl, cfg.ShareLinkMaxTTL)
+
+		if _, err := GetUserById(app, userId); err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+
+		expires := time.Now().Add(ttl)
+		token := SignShareToken([]byte(cfg.ShareLinkSecret), userId, expires)
+		return WriteOK(e, "", ShareLink{
+			URL:     strings.TrimRight(app.Settings().Meta.AppURL, "/") + "/shared/" + token,
+			Token:   token,
+			Expires: expires.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+func HandleGetSharedUser(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		userId, err := VerifyShareToken([]byte(cfg.ShareLinkSecret), e.Request.PathValue("token"), time.Now())
+		if err != nil {
+			return WriteError(e, err, "error verifying share link")
+		}
+
+		user, err := GetUserById(app, userId)
+		if err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+		return WriteOK(e, "", NewPublicUser(*user))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+)
+
+// Drain tracks the in flight requests of the custom routes, and the
+// background tasks they start, for the graceful shutdown.
+var Drain = &Drainer{}
+
+type Drainer struct {
+	mu       sync.Mutex
+	draining bool
+	inFlight atomic.Int64
+	requests sync.WaitGroup
+	tasks    sync.WaitGroup
+}
+
+// begin registers a request, unless the shutdown already started.
+func (d *Drainer) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.inFlight.Add(1)
+	d.requests.Add(1)
+	return true
+}
+
+func (d *Drainer) end() {
+	d.inFlight.Add(-1)
+	d.requests.Done()
+}
+
+// Go runs fn in a goroutine the shutdown waits for. Once the shutdown
+// started fn runs right away instead, as the wait may already be over.
+func (d *Drainer) Go(fn func()) {
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		fn()
+		return
+	}
+	d.tasks.Add(1)
+	d.mu.Unlock()
+	go func() {
+		defer d.tasks.Done()
+		fn()
+	}()
+}
+
+func (d *Drainer) InFlight() int64 {
+	return d.inFlight.Load()
+}
+
+// Shutdown rejects the new requests and waits for the in flight ones, then
+// for the tasks they started, until ctx is done.
+func (d *Drainer) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.requests.Wait()
+		d.tasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TrackInFlight registers the requests of the custom routes with d, and
+// answers 503 to the new ones once the shutdown started, which also fails
+// /readyz so that load balancers stop sending traffic.
+func TrackInFlight(d *Drainer) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if IsPocketBasePath(e.Request.URL.Path) {
+			return e.Next()
+		}
+		if !d.begin() {
+			e.Response.Header().Set("Connection", "close")
+			return WriteServiceUnavailable(e, "server is shutting down", nil)
+		}
+		defer d.end()
+		return e.Next()
+	}
+}
+
+// BindGracefulShutdown drains the custom routes on SIGINT/SIGTERM before
+// PocketBase shuts the server down and closes the database: the event
+// streams and the websockets are ended, the in flight requests and their background writes
+// are waited for, the buffered user activity and api usage are written, the due outbox events are published and the due jobs, e.g. webhook deliveries, are run, all
+// within timeout, and the prepared statements and the read replica are closed. A second signal skips
+// the wait.
+func BindGracefulShutdown(app core.App, timeout time.Duration) {
+	app.OnTerminate().Bind(&hook.Handler[*core.TerminateEvent]{
+		Id: "gracefulShutdown",
+		// before pbGracefulShutdown, which only waits a second
+		Priority: -10000,
+		Func: func(e *core.TerminateEvent) error {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			sigch := make(chan os.Signal, 1)
+			signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sigch)
+			go func() {
+				select {
+				case <-sigch:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+
+			UserEvents.Close()
+			Presence.Close()
+			if err := Drain.Shutdown(ctx); err != nil {
+				e.App.Logger().Warn("Shutdown didn't wait for every request", "inFlight", Drain.InFlight(), "error", err)
+			}
+			if err := ActivityLog.Shutdown(); err != nil {
+				e.App.Logger().Warn("Failed to write user activity", "error", err)
+			}
+			if err := Usage.Shutdown(); err != nil {
+				e.App.Logger().Warn("Failed to write api usage", "error", err)
+			}
+			Outbox.Shutdown(ctx)
+			Queue.Shutdown(ctx)
+			Queries.Close()
+			if ReadReplica != nil {
+				ReadReplica.Close()
+			}
+			return e.Next()
+		},
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/cache"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// The headers of the signed requests of the API keys. The signature is
+// hex(hmac_sha256(signing secret, canonical request)), see
+// CanonicalRequest.
+const (
+	SignatureHeader          = "X-Signature"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+)
+
+const (
+	DefaultSignatureMaxSkew = 5 * time.Minute
+	// SignatureMaxNonces bounds the nonces kept by the in-process cache,
+	// past which the least recently used ones are dropped and could be
+	// replayed within the clock skew window.
+	SignatureMaxNonces = 100000
+
+	signatureNonceMinLength = 16
+	signatureNonceMaxLength = 128
+)
+
+var (
+	ErrSignatureRequired = errors.New("the api key requires signed requests")
+	ErrInvalidSignature  = errors.New("invalid request signature")
+	ErrSignatureSkew     = errors.New("the signature timestamp is outside of the allowed clock skew")
+	ErrInvalidNonce      = errors.New("invalid signature nonce, expected 16 to 128 letters, digits, - or _")
+	ErrReplayedNonce     = errors.New("the signature nonce was already used")
+)
+
+// SignedRequests verifies the signed requests of the API keys. It is
+// replaced on serve by one sharing its nonces through CACHE_URL.
+var SignedRequests = NewRequestSigning(cache.NewLRU(cache.Options{MaxEntries: SignatureMaxNonces}), DefaultSignatureMaxSkew, false)
+
+// RequestSigning checks the signature of the requests of the API keys and
+// rejects the replayed ones. A signature is only valid within maxSkew of
+// its timestamp, and its nonce is remembered for twice that, the longest
+// the same timestamp can be accepted for.
+type RequestSigning struct {
+	nonces  cache.Cache
+	maxSkew time.Duration
+	// required refuses the unsigned requests of every key, not only of
+	// the ones created with requireSignature.
+	required bool
+}
+
+func NewRequestSigning(nonces cache.Cache, maxSkew time.Duration, required bool) *RequestSigning {
+	return &RequestSigning{nonces: nonces, maxSkew: maxSkew, required: required}
+}
+
+// CanonicalRequest is what a request is signed as: its method, path with
+// the query as sent, timestamp, nonce and the hex SHA-256 of its body, each
+// on a line.
+func CanonicalRequest(method string, target string, timestamp string, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(strings.ToUpper(method) + "\n" + target + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:]))
+}
+
+func SignRequest(secret []byte, method string, target string, timestamp string, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(CanonicalRequest(method, target, timestamp, nonce, body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsSigned reports whether the request carries any of the signature
+// headers.
+func IsSigned(h http.Header) bool {
+	return h.Get(SignatureHeader) != "" || h.Get(SignatureTimestampHeader) != "" || h.Get(SignatureNonceHeader) != ""
+}
+
+// Verify checks the signature of the request of apiKey at now. The unsigned
+// requests pass unless the key or the config requires them signed. The
+// nonce is only recorded once the signature matched, for a forged request
+// not to burn the nonce of a genuine one.
+func (s *RequestSigning) Verify(ctx context.Context, apiKey *APIKey, method string, target string, h http.Header, body []byte, now time.Time) error {
+	if !IsSigned(h) {
+		if s.required || apiKey.RequireSignature {
+			return ErrSignatureRequired
+		}
+		return nil
+	}
+	// the keys created before the signing secrets can't sign
+	if apiKey.SigningSecret == "" {
+		return ErrInvalidSignature
+	}
+
+	timestamp := h.Get(SignatureTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > s.maxSkew || skew < -s.maxSkew {
+		return ErrSignatureSkew
+	}
+	nonce := h.Get(SignatureNonceHeader)
+	if !validNonce(nonce) {
+		return ErrInvalidNonce
+	}
+	expected := []byte(SignRequest([]byte(apiKey.SigningSecret), method, target, timestamp, nonce, body))
+	if !hmac.Equal(expected, []byte(strings.ToLower(h.Get(SignatureHeader)))) {
+		return ErrInvalidSignature
+	}
+
+	uses, err := s.nonces.Incr(ctx, apiKey.Id+":"+nonce, 1, 2*s.maxSkew)
+	if err != nil {
+		return err
+	}
+	if uses > 1 {
+		return ErrReplayedNonce
+	}
+	return nil
+}
+
+// VerifyRequest is Verify for the request of the event, whose body is read
+// and put back when it's signed.
+func (s *RequestSigning) VerifyRequest(e *core.RequestEvent, apiKey *APIKey, now time.Time) error {
+	var body []byte
+	if IsSigned(e.Request.Header) && e.Request.Body != nil {
+		var err error
+		if body, err = io.ReadAll(e.Request.Body); err != nil {
+			return err
+		}
+		e.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	// RequestURI is the target as sent, before any rewrite of the URL
+	return s.Verify(e.Request.Context(), apiKey, e.Request.Method, e.Request.RequestURI, e.Request.Header, body, now)
+}
+
+func validNonce(nonce string) bool {
+	if len(nonce) < signatureNonceMinLength || len(nonce) > signatureNonceMaxLength {
+		return false
+	}
+	for _, c := range nonce {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSignatureError reports whether err is a rejected signature rather than
+// a failure to check it.
+func IsSignatureError(err error) bool {
+	for _, target := range []error{ErrSignatureRequired, ErrInvalidSignature, ErrSignatureSkew, ErrInvalidNonce, ErrReplayedNonce} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// SignupFormTokenField is the body field of POST /auth/register carrying the
+// token of GET /auth/register/form, see SIGNUP_MIN_SUBMIT_TIME.
+const SignupFormTokenField = "formToken"
+
+const signupFormTokenPurpose = "signup-form"
+
+var emailDomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+
+var (
+	ErrSignupHoneypot     = errors.New("a honeypot field was filled")
+	ErrSignupFormToken    = errors.New("the form token is missing, invalid or expired, reload the form")
+	ErrSignupTooFast      = errors.New("the form was submitted too fast")
+	ErrDisposableEmail    = errors.New("disposable email addresses aren't accepted")
+	ErrSignupCaptcha      = errors.New("captcha required, send its response in the " + CaptchaResponseHeader + " header")
+	errSignupBodyNotValid = errors.New("body isn't a JSON object")
+)
+
+// SignupFormToken is the response of GET /auth/register/form.
+type SignupFormToken struct {
+	Token string `json:"token"`
+	// Field is the body field to send the token in.
+	Field string `json:"field"`
+	// HoneypotFields are the fields the form should include hidden from the
+	// humans, left empty.
+	HoneypotFields []string `json:"honeypotFields"`
+	Expires        string   `json:"expires"`
+}
+
+// NewSignupFormToken returns a token of the time the signup form was
+// rendered, signed with secret and valid for ttl.
+func NewSignupFormToken(secret []byte, now time.Time, ttl time.Duration) string {
+	return signUserToken(secret, signupFormTokenPurpose, "", strconv.FormatInt(now.UnixMilli(), 10), now.Add(ttl))
+}
+
+// CheckSignupFormToken returns ErrSignupFormToken unless the token is valid,
+// and ErrSignupTooFast if the form was submitted less than minSubmitTime
+// after it was rendered.
+func CheckSignupFormToken(secret []byte, token string, minSubmitTime time.Duration, now time.Time) error {
+	_, issued, err := verifyUserToken(secret, signupFormTokenPurpose, token, now)
+	if err != nil {
+		return ErrSignupFormToken
+	}
+	issuedMs, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return ErrSignupFormToken
+	}
+	if now.Sub(time.UnixMilli(issuedMs)) < minSubmitTime {
+		return ErrSignupTooFast
+	}
+	return nil
+}
+
+// BlockedEmailDomain is a domain whose addresses can't sign up, along with
+// its subdomains.
+type BlockedEmailDomain struct {
+	Id      string `db:"id" json:"id"`
+	Domain  string `db:"domain" json:"domain"`
+	Reason  string `db:"reason" json:"reason"`
+	Created string `db:"created" json:"created"`
+}
+
+type blockedEmailDomainEntry struct {
+	Domain string `db:"domain"`
+	Reason string `db:"reason"`
+}
+
+var BlockedEmailDomains = &Repository[BlockedEmailDomain]{
+	Table:         "blocked_email_domains",
+	CreatedColumn: "created",
+}
+
+// EmailDomainBlocklist caches blocked_email_domains, reloaded on the first
+// check following a change to the collection.
+type EmailDomainBlocklist struct {
+	app core.App
+
+	mu      sync.Mutex
+	domains map[string]bool
+}
+
+func NewEmailDomainBlocklist(app core.App) *EmailDomainBlocklist {
+	return &EmailDomainBlocklist{app: app}
+}
+
+// Bind invalidates the cache whenever blocked_email_domains changes.
+func (b *EmailDomainBlocklist) Bind(app core.App) {
+	invalidate := func(e *core.RecordEvent) error {
+		b.Invalidate()
+		return e.Next()
+	}
+	app.OnRecordAfterCreateSuccess(BlockedEmailDomains.Table).BindFunc(invalidate)
+	app.OnRecordAfterUpdateSuccess(BlockedEmailDomains.Table).BindFunc(invalidate)
+	app.OnRecordAfterDeleteSuccess(BlockedEmailDomains.Table).BindFunc(invalidate)
+}
+
+func (b *EmailDomainBlocklist) Invalidate() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.domains = nil
+}
+
+// Blocked reports whether the domain of the email, or one of its parent
+// domains, is blocked. A failed read of the list lets every email through
+// until the next change.
+func (b *EmailDomainBlocklist) Blocked(email string) bool {
+	_, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(email)), "@")
+	if !ok {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.domains == nil {
+		b.domains = map[string]bool{}
+		rows, err := BlockedEmailDomains.FindAll(b.app, ListOptions{})
+		if err != nil {
+			b.app.Logger().Error("Failed to load the blocked email domains", "error", err)
+		}
+		for _, row := range rows {
+			b.domains[strings.ToLower(row.Domain)] = true
+		}
+	}
+	for domain != "" {
+		if b.domains[domain] {
+			return true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return false
+}
+
+// signupFields reads the fields of the signup body, and strips all but
+// the email so that the handler binds the body strictly. The forms are left
+// as they are, their binding ignoring the unknown fields.
+func signupFields(e *core.RequestEvent, read []string) (map[string]string, error) {
+	fields := map[string]string{}
+	mediaType, _, _ := mime.ParseMediaType(e.Request.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		for _, field := range read {
+			fields[field] = e.Request.FormValue(field)
+		}
+		return fields, nil
+	}
+
+	body, err := io.ReadAll(e.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &values); err != nil {
+		// BindStrict reports it
+		e.Request.Body = io.NopCloser(bytes.NewReader(body))
+		return nil, errSignupBodyNotValid
+	}
+	for _, field := range read {
+		raw, ok := values[field]
+		if !ok {
+			continue
+		}
+		var value any
+		_ = json.Unmarshal(raw, &value)
+		switch v := value.(type) {
+		case nil:
+		case string:
+			fields[field] = v
+		default:
+			// any other value fills a honeypot
+			fields[field] = string(raw)
+		}
+		if field != "email" {
+			delete(values, field)
+		}
+	}
+	body, err = json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	e.Request.Body = io.NopCloser(bytes.NewReader(body))
+	e.Request.ContentLength = int64(len(body))
+	return fields, nil
+}
+
+// GuardSignup screens the public signups of POST /auth/register for bots:
+// the honeypot fields of SIGNUP_HONEYPOT_FIELDS must be left empty, the
+// form token of GET /auth/register/form must be at least
+// SIGNUP_MIN_SUBMIT_TIME old when set, a CAPTCHA response is verified with
+// SIGNUP_CAPTCHA, and the domains of blocklist can't sign up. The
+// rejections are logged with their reason, which the bots aren't told.
+func GuardSignup(cfg *Config, blocklist *EmailDomainBlocklist) func(e *core.RequestEvent) error {
+	read := slices.Concat([]string{SignupFormTokenField, "email"}, cfg.SignupHoneypotFields)
+	return func(e *core.RequestEvent) error {
+		fields, err := signupFields(e, read)
+		if errors.Is(err, errSignupBodyNotValid) {
+			return e.Next()
+		}
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+
+		reject := func(reason error) error {
+			e.App.Logger().Warn("Signup rejected", "reason", reason.Error(), "ip", e.RealIP(), "email", PII.String(fields["email"]))
+			return WriteErrorCode(e, CodeSignupRejected, "signup rejected", nil)
+		}
+		for _, field := range cfg.SignupHoneypotFields {
+			if strings.TrimSpace(fields[field]) != "" {
+				return reject(ErrSignupHoneypot)
+			}
+		}
+		if cfg.SignupMinSubmitTime > 0 {
+			err := CheckSignupFormToken([]byte(cfg.SignupFormSecret), fields[SignupFormTokenField], cfg.SignupMinSubmitTime, time.Now())
+			if errors.Is(err, ErrSignupFormToken) {
+				// the humans whose form expired can reload it
+				return WriteErrorCode(e, CodeSignupRejected, err.Error(), nil)
+			}
+			if err != nil {
+				return reject(err)
+			}
+		}
+		if cfg.SignupCaptcha && Captcha != nil {
+			response := e.Request.Header.Get(CaptchaResponseHeader)
+			if response == "" {
+				return WriteErrorCode(e, CodeCaptchaRequired, ErrSignupCaptcha.Error(), nil)
+			}
+			ok, err := Captcha.Verify(e.Request.Context(), response, e.RealIP())
+			if err != nil {
+				// the other checks still hold while the CAPTCHA service is down
+				e.App.Logger().Warn("Failed to verify captcha", "error", err)
+			} else if !ok {
+				return WriteErrorCode(e, CodeCaptchaRequired, ErrSignupCaptcha.Error(), nil)
+			}
+		}
+		if cfg.SignupBlockDisposable && blocklist.Blocked(fields["email"]) {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid user", validation.Errors{"email": ErrDisposableEmail})
+		}
+		return e.Next()
+	}
+}
+
+// HandleSignupForm returns the form token of the signup form, to fetch as
+// the form is rendered.
+func HandleSignupForm(cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		now := time.Now()
+		e.Response.Header().Set("Cache-Control", "no-store")
+		return WriteOK(e, "", SignupFormToken{
+			Token:          NewSignupFormToken([]byte(cfg.SignupFormSecret), now, cfg.SignupFormTokenTTL),
+			Field:          SignupFormTokenField,
+			HoneypotFields: cfg.SignupHoneypotFields,
+			Expires:        now.Add(cfg.SignupFormTokenTTL).UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+// BlockEmailDomainsRequest is the body of POST /admin/blocked-email-domains.
+type BlockEmailDomainsRequest struct {
+	Domains []string `json:"domains" binding:"required"`
+	Reason  string   `json:"reason"`
+}
+
+// BlockEmailDomainsResult counts the domains POST
+// /admin/blocked-email-domains added, the others being blocked already.
+type BlockEmailDomainsResult struct {
+	Added   int `json:"added"`
+	Skipped int `json:"skipped"`
+}
+
+// HandleBlockEmailDomains adds domains to the blocklist, e.g. from a public
+// list of disposable email providers. The domains already blocked are
+// skipped.
+func HandleBlockEmailDomains(app core.App, blocklist *EmailDomainBlocklist) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		req := BlockEmailDomainsRequest{}
+		if err := BindStrict(e, &req); err != nil {
+			return WriteBindError(e, err)
+		}
+		domains := []string{}
+		errs := validation.Errors{}
+		for i, domain := range req.Domains {
+			domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "@")
+			if !emailDomainPattern.MatchString(domain) {
+				errs[strconv.Itoa(i)] = errors.New("invalid domain")
+				continue
+			}
+			if !slices.Contains(domains, domain) {
+				domains = append(domains, domain)
+			}
+		}
+		if len(errs) > 0 {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid domains", validation.Errors{"domains": errs})
+		}
+
+		result := BlockEmailDomainsResult{}
+		err := WithTx(app, func(txApp core.App) error {
+			result = BlockEmailDomainsResult{}
+			for _, domain := range domains {
+				count, err := BlockedEmailDomains.Count(txApp, dbx.HashExp{"domain": domain})
+				if err != nil {
+					return err
+				}
+				if count > 0 {
+					result.Skipped++
+					continue
+				}
+				if err := BlockedEmailDomains.Insert(txApp, blockedEmailDomainEntry{Domain: domain, Reason: req.Reason}); err != nil {
+					return err
+				}
+				result.Added++
+			}
+			return nil
+		})
+		if err != nil {
+			return WriteError(e, err, "error blocking the domains")
+		}
+		// the plain SQL inserts don't trigger the record hooks of Bind
+		blocklist.Invalidate()
+		return WriteOK(e, "", result)
+	}
+}
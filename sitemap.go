@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// SitemapMaxURLs is the most URLs a sitemap file may list, per the sitemaps
+// protocol.
+const SitemapMaxURLs = 50000
+
+const (
+	sitemapNamespace      = "http://www.sitemaps.org/schemas/sitemap/0.9"
+	sitemapContentType    = "application/xml; charset=utf-8"
+	sitemapCacheControl   = "public, max-age=3600"
+	sitemapRefreshJobName = "sitemap_refresh"
+)
+
+// unlistedProfileSQL selects the preferences of a user who turned
+// PrefProfileListed off, the users without a preferences row being listed
+// by default.
+const unlistedProfileSQL = "SELECT 1 FROM {{preferences}} p WHERE p.[[user]] = {{users}}.[[id]] " +
+	"AND json_extract(p.[[values]], {:listedPath}) = 0"
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+// sitemapUser is the part of a user a sitemap needs.
+type sitemapUser struct {
+	Id      string `db:"id"`
+	Updated string `db:"updated"`
+}
+
+// Sitemap is the cached sitemap of the profile pages of the verified users
+// who didn't unlist theirs, for every tenant. Up to chunkSize users it's a
+// single file, past it GET /sitemap.xml is an index of the files of
+// /sitemaps/{file}, chunkSize users each.
+type Sitemap struct {
+	app       core.App
+	chunkSize int
+
+	// refreshMu keeps the cron and the first request from building it
+	// twice at once.
+	refreshMu sync.Mutex
+
+	mu        sync.RWMutex
+	generated time.Time
+	index     []byte
+	chunks    [][]byte
+}
+
+func NewSitemap(app core.App, chunkSize int) *Sitemap {
+	return &Sitemap{app: app, chunkSize: chunkSize}
+}
+
+// Schedule rebuilds the sitemap on the schedule of SITEMAP_SCHEDULE.
+func (s *Sitemap) Schedule(schedule string) {
+	s.app.Cron().MustAdd(sitemapRefreshJobName, schedule, func() {
+		if err := s.Refresh(); err != nil {
+			s.app.Logger().Error("Failed to refresh the sitemap", "error", err)
+		}
+	})
+}
+
+// Refresh rebuilds the sitemap, reading the users chunkSize at a time.
+func (s *Sitemap) Refresh() error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	base := strings.TrimRight(s.app.Settings().Meta.AppURL, "/")
+	chunks := [][]byte{}
+	index := sitemapIndex{Xmlns: sitemapNamespace}
+	after := ""
+	for {
+		users := []sitemapUser{}
+		err := Users.Query(s.app).
+			Select(Users.Table+".id", Users.Table+".updated").
+			AndWhere(dbx.HashExp{Users.Table + ".verified": true}).
+			AndWhere(dbx.NotExists(dbx.NewExp(unlistedProfileSQL, dbx.Params{"listedPath": `$."` + PrefProfileListed + `"`}))).
+			AndWhere(dbx.NewExp("{{users}}.[[id]] > {:after}", dbx.Params{"after": after})).
+			OrderBy(Users.Table + ".id").
+			Limit(int64(s.chunkSize)).
+			All(&users)
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 && len(chunks) > 0 {
+			break
+		}
+
+		set := sitemapURLSet{Xmlns: sitemapNamespace, URLs: make([]sitemapURL, len(users))}
+		lastMod := ""
+		for i, user := range users {
+			set.URLs[i] = sitemapURL{Loc: base + "/p/" + user.Id, LastMod: sitemapLastMod(user.Updated)}
+			lastMod = max(lastMod, set.URLs[i].LastMod)
+		}
+		chunk, err := marshalSitemap(set)
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+		index.Sitemaps = append(index.Sitemaps, sitemapURL{
+			Loc:     base + "/sitemaps/" + strconv.Itoa(len(chunks)) + ".xml",
+			LastMod: lastMod,
+		})
+		if len(users) < s.chunkSize {
+			break
+		}
+		after = users[len(users)-1].Id
+	}
+
+	var indexXML []byte
+	if len(chunks) > 1 {
+		var err error
+		if indexXML, err = marshalSitemap(index); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generated = time.Now()
+	s.index = indexXML
+	s.chunks = chunks
+	return nil
+}
+
+// files returns the index, nil for a single file, and the files of the
+// sitemap, building it first when it wasn't yet.
+func (s *Sitemap) files() ([]byte, [][]byte, error) {
+	s.mu.RLock()
+	generated := !s.generated.IsZero()
+	s.mu.RUnlock()
+	if !generated {
+		if err := s.Refresh(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index, s.chunks, nil
+}
+
+// sitemapLastMod formats a PocketBase date as the W3C datetime of the
+// sitemaps, "" when it can't be parsed.
+func sitemapLastMod(date string) string {
+	parsed, err := types.ParseDateTime(date)
+	if err != nil || parsed.IsZero() {
+		return ""
+	}
+	return parsed.Time().UTC().Format(time.RFC3339)
+}
+
+func marshalSitemap(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// HandleSitemap serves the sitemap, or its index when it's split in
+// several files.
+func HandleSitemap(sitemap *Sitemap) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		index, chunks, err := sitemap.files()
+		if err != nil {
+			return WriteError(e, err, "error generating the sitemap")
+		}
+		e.Response.Header().Set("Cache-Control", sitemapCacheControl)
+		if index != nil {
+			return e.Blob(http.StatusOK, sitemapContentType, index)
+		}
+		return e.Blob(http.StatusOK, sitemapContentType, chunks[0])
+	}
+}
+
+// HandleSitemapFile serves a file of a sitemap split in several, numbered
+// from 1 like in the index.
+func HandleSitemapFile(sitemap *Sitemap) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		index, chunks, err := sitemap.files()
+		if err != nil {
+			return WriteError(e, err, "error generating the sitemap")
+		}
+		name, ok := strings.CutSuffix(e.Request.PathValue("file"), ".xml")
+		n, err := strconv.Atoi(name)
+		if !ok || err != nil || n < 1 || n > len(chunks) || index == nil {
+			return WriteError(e, ErrNotFound, "sitemap not found")
+		}
+		e.Response.Header().Set("Cache-Control", sitemapCacheControl)
+		return e.Blob(http.StatusOK, sitemapContentType, chunks[n-1])
+	}
+}
+
+// HandleRobotsTxt serves ROBOTS_TXT, or when empty a robots.txt disallowing
+// the paths of ROBOTS_DISALLOW and pointing the crawlers to the sitemap.
+func HandleRobotsTxt(app core.App, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		e.Response.Header().Set("Cache-Control", sitemapCacheControl)
+		if cfg.RobotsTxt != "" {
+			return e.String(http.StatusOK, cfg.RobotsTxt)
+		}
+
+		var b strings.Builder
+		b.WriteString("User-agent: *\n")
+		if len(cfg.RobotsDisallow) == 0 {
+			b.WriteString("Disallow:\n")
+		}
+		for _, path := range cfg.RobotsDisallow {
+			b.WriteString("Disallow: " + path + "\n")
+		}
+		b.WriteString("\nSitemap: " + strings.TrimRight(app.Settings().Meta.AppURL, "/") + "/sitemap.xml\n")
+		return e.String(http.StatusOK, b.String())
+	}
+}
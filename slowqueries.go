@@ -0,0 +1,253 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// QuerySortFields are the accepted ?sort values of GET /admin/slow-queries.
+var QuerySortFields = []string{"total", "max", "mean", "count", "slow"}
+
+var (
+	sqlHexLiteral = regexp.MustCompile(`\b0x[0-9a-fA-F]+\b`)
+	sqlKeywordArg = regexp.MustCompile(`\b(?:true|false)\b|<nil>`)
+	sqlValueList  = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)+\s*\)`)
+	sqlSpaces     = regexp.MustCompile(`\s+`)
+)
+
+// NormalizeSQL masks the values dbx logs the statements with, as
+// SanitizeSQL does, and folds the lists of values and the whitespace, so
+// that the runs of a statement with different parameters add up.
+func NormalizeSQL(statement string) string {
+	statement = SanitizeSQL(statement)
+	statement = sqlHexLiteral.ReplaceAllString(statement, "?")
+	statement = sqlKeywordArg.ReplaceAllString(statement, "?")
+	statement = sqlValueList.ReplaceAllString(statement, "(?...)")
+	return strings.TrimSpace(sqlSpaces.ReplaceAllString(statement, " "))
+}
+
+// QueryStats are the runs of a normalized statement since the analyzer
+// started or was reset.
+type QueryStats struct {
+	Statement string  `json:"statement"`
+	Count     int64   `json:"count"`
+	Slow      int64   `json:"slow"`
+	Errors    int64   `json:"errors"`
+	TotalMs   float64 `json:"totalMs"`
+	MeanMs    float64 `json:"meanMs"`
+	MaxMs     float64 `json:"maxMs"`
+	LastRun   string  `json:"lastRun"`
+}
+
+// SlowQueryReport is the response of GET /admin/slow-queries.
+type SlowQueryReport struct {
+	Threshold string `json:"threshold"`
+	Since     string `json:"since"`
+	// Dropped counts the runs of the statements left out once
+	// QUERY_STATS_MAX_STATEMENTS were tracked.
+	Dropped    int64        `json:"dropped"`
+	Statements []QueryStats `json:"statements"`
+}
+
+type queryStat struct {
+	count, slow, errors int64
+	total, max          time.Duration
+	lastRun             time.Time
+}
+
+// QueryAnalyzer aggregates the runs of the SQL statements by normalized
+// statement, and logs the ones slower than its threshold with their
+// values masked.
+type QueryAnalyzer struct {
+	app           core.App
+	threshold     time.Duration
+	maxStatements int
+
+	mu      sync.Mutex
+	stats   map[string]*queryStat
+	dropped int64
+	since   time.Time
+}
+
+func NewQueryAnalyzer(app core.App, threshold time.Duration, maxStatements int) *QueryAnalyzer {
+	return &QueryAnalyzer{
+		app:           app,
+		threshold:     threshold,
+		maxStatements: maxStatements,
+		stats:         map[string]*queryStat{},
+		since:         time.Now(),
+	}
+}
+
+// Observe records a run of statement, as logged by dbx.
+func (a *QueryAnalyzer) Observe(statement string, took time.Duration, err error) {
+	normalized := NormalizeSQL(statement)
+	slow := a.threshold > 0 && took >= a.threshold
+
+	a.mu.Lock()
+	stat, ok := a.stats[normalized]
+	if !ok && len(a.stats) >= a.maxStatements {
+		a.dropped++
+		stat = nil
+	} else if !ok {
+		stat = &queryStat{}
+		a.stats[normalized] = stat
+	}
+	if stat != nil {
+		stat.count++
+		stat.total += took
+		stat.max = max(stat.max, took)
+		stat.lastRun = time.Now()
+		if slow {
+			stat.slow++
+		}
+		if err != nil {
+			stat.errors++
+		}
+	}
+	a.mu.Unlock()
+
+	if slow {
+		attrs := []any{"duration", took.String(), "statement", SanitizeSQL(statement)}
+		if err != nil {
+			attrs = append(attrs, "error", err.Error())
+		}
+		a.app.Logger().Warn("Slow query", attrs...)
+	}
+}
+
+// Report returns the stats of the statements sorted by sort, one of
+// QuerySortFields, the largest first. Unless all is set, only the
+// statements that were slow at least once are included.
+func (a *QueryAnalyzer) Report(sort string, limit int, all bool) SlowQueryReport {
+	a.mu.Lock()
+	statements := []QueryStats{}
+	for statement, stat := range a.stats {
+		if !all && stat.slow == 0 {
+			continue
+		}
+		statements = append(statements, QueryStats{
+			Statement: statement,
+			Count:     stat.count,
+			Slow:      stat.slow,
+			Errors:    stat.errors,
+			TotalMs:   durationMs(stat.total),
+			MeanMs:    durationMs(stat.total / time.Duration(stat.count)),
+			MaxMs:     durationMs(stat.max),
+			LastRun:   stat.lastRun.UTC().Format(time.RFC3339),
+		})
+	}
+	report := SlowQueryReport{
+		Threshold: a.threshold.String(),
+		Since:     a.since.UTC().Format(time.RFC3339),
+		Dropped:   a.dropped,
+	}
+	a.mu.Unlock()
+
+	key := func(s QueryStats) float64 {
+		switch sort {
+		case "max":
+			return s.MaxMs
+		case "mean":
+			return s.MeanMs
+		case "count":
+			return float64(s.Count)
+		case "slow":
+			return float64(s.Slow)
+		}
+		return s.TotalMs
+	}
+	slices.SortFunc(statements, func(x, y QueryStats) int {
+		if c := cmp.Compare(key(y), key(x)); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Statement, y.Statement)
+	})
+	if len(statements) > limit {
+		statements = statements[:limit]
+	}
+	report.Statements = statements
+	return report
+}
+
+// Reset forgets the stats, e.g. once an index was added.
+func (a *QueryAnalyzer) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stats = map[string]*queryStat{}
+	a.dropped = 0
+	a.since = time.Now()
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// AnalyzeQueries feeds the statements run on the data database to a,
+// keeping the other hooks.
+func AnalyzeQueries(app core.App, a *QueryAnalyzer) {
+	for _, builder := range []dbx.Builder{app.DB(), app.NonconcurrentDB()} {
+		db, ok := builder.(*dbx.DB)
+		if !ok {
+			continue
+		}
+		queryLog, execLog := db.QueryLogFunc, db.ExecLogFunc
+		db.QueryLogFunc = func(ctx context.Context, t time.Duration, statement string, rows *sql.Rows, err error) {
+			a.Observe(statement, t, err)
+			if queryLog != nil {
+				queryLog(ctx, t, statement, rows, err)
+			}
+		}
+		db.ExecLogFunc = func(ctx context.Context, t time.Duration, statement string, result sql.Result, err error) {
+			a.Observe(statement, t, err)
+			if execLog != nil {
+				execLog(ctx, t, statement, result, err)
+			}
+		}
+	}
+}
+
+// HandleSlowQueries lists the statements that ran slower than
+// SLOW_QUERY_THRESHOLD, by total time by default, to find the missing
+// indexes.
+func HandleSlowQueries(a *QueryAnalyzer, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		query := e.Request.URL.Query()
+		sort := query.Get("sort")
+		if sort == "" {
+			sort = "total"
+		}
+		if !slices.Contains(QuerySortFields, sort) {
+			return WriteBadRequest(e, "sort must be one of "+strings.Join(QuerySortFields, ", "), nil)
+		}
+		limit := cfg.DefaultPerPage
+		if raw := query.Get("limit"); raw != "" {
+			var err error
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit < 1 || limit > cfg.MaxPerPage {
+				return WriteBadRequest(e, fmt.Sprintf("limit must be an integer from 1 to %d", cfg.MaxPerPage), nil)
+			}
+		}
+		all, _ := strconv.ParseBool(query.Get("all"))
+		e.Response.Header().Set("Cache-Control", "no-store")
+		return WriteOK(e, "", a.Report(sort, limit, all))
+	}
+}
+
+func HandleResetSlowQueries(a *QueryAnalyzer) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		a.Reset()
+		return WriteOK(e, "", nil)
+	}
+}
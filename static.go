@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+const (
+	CacheControlImmutable = "public, max-age=31536000, immutable"
+	CacheControlNoCache   = "no-cache"
+)
+
+// APIPrefixes are never answered with the SPA index page, so that a typo'd
+// API path still 404s instead of returning HTML.
+var APIPrefixes = []string{"/api/", "/_/", "/users", "/shared/", "/admin/", "/downloads/"}
+
+func IsAPIPath(urlPath string) bool {
+	for _, prefix := range APIPrefixes {
+		if strings.HasPrefix(urlPath, prefix) || urlPath+"/" == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFingerprinted reports whether name looks like a build asset with a content
+// hash in it (e.g. app.3f9a1c2b.js or index-B4x9Kq1z.css).
+func IsFingerprinted(name string) bool {
+	base := strings.TrimSuffix(path.Base(name), path.Ext(name))
+	i := strings.LastIndexAny(base, ".-")
+	if i < 0 {
+		return false
+	}
+	hash := base[i+1:]
+	if len(hash) < 8 {
+		return false
+	}
+	hasDigit := false
+	for _, r := range hash {
+		switch {
+		case r >= '0' && r <= '9':
+			hasDigit = true
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		default:
+			return false
+		}
+	}
+	return hasDigit
+}
+
+func StaticCacheControl(name string) string {
+	if path.Base(name) == router.IndexPage || !IsFingerprinted(name) {
+		return CacheControlNoCache
+	}
+	return CacheControlImmutable
+}
+
+// precompressedEncodings are the Content-Encodings of the pre-compressed
+// files, by preference, and precompressedExts their extensions.
+var (
+	precompressedEncodings = []string{"br", "gzip"}
+	precompressedExts      = map[string]string{"br": ".br", "gzip": ".gz"}
+)
+
+// IsUnderSPABase reports whether urlPath is base or under it.
+func IsUnderSPABase(urlPath string, base string) bool {
+	base = strings.TrimSuffix(base, "/")
+	return base == "" || urlPath == base || strings.HasPrefix(urlPath, base+"/")
+}
+
+// servePrecompressed serves the name.br or name.gz file next to name, if
+// any, as the encoded name, as negotiated with Accept-Encoding. It reports
+// whether it did.
+func servePrecompressed(e *core.RequestEvent, fsys fs.FS, name string) (bool, error) {
+	available := []string{}
+	for _, encoding := range precompressedEncodings {
+		if fi, err := fs.Stat(fsys, name+precompressedExts[encoding]); err == nil && fi.Mode().IsRegular() {
+			available = append(available, encoding)
+		}
+	}
+	if len(available) == 0 {
+		return false, nil
+	}
+	header := e.Response.Header()
+	header.Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(e.Request.Header.Get("Accept-Encoding"), available)
+	if encoding == "" {
+		return false, nil
+	}
+
+	f, err := fsys.Open(name + precompressedExts[encoding])
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		return false, nil
+	}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("Content-Encoding", encoding)
+	http.ServeContent(e.Response, e.Request, name, fi.ModTime(), content)
+	return true, nil
+}
+
+// serveFile serves the file name, pre-compressed when cfg.StaticPrecompressed
+// is set and a variant the client accepts exists.
+func serveFile(e *core.RequestEvent, cfg *Config, fsys fs.FS, name string) (bool, error) {
+	if !cfg.StaticPrecompressed {
+		return false, nil
+	}
+	return servePrecompressed(e, fsys, name)
+}
+
+// HandleStatic serves cfg.PublicDir with cache headers. When cfg.SPAFallback
+// is set, unknown paths under cfg.SPABase without a file extension get its
+// index page so that client side routes can be deep linked. With
+// cfg.StaticPrecompressed, the .br and .gz files next to the served ones are
+// sent instead to the clients accepting them.
+func HandleStatic(cfg *Config) func(e *core.RequestEvent) error {
+	fsys := os.DirFS(cfg.PublicDir)
+	serve := apis.Static(fsys, false)
+	spaIndex := path.Join(strings.TrimPrefix(cfg.SPABase, "/"), router.IndexPage)
+
+	return func(e *core.RequestEvent) error {
+		name := strings.TrimPrefix(path.Clean("/"+e.Request.PathValue(apis.StaticWildcardParam)), "/")
+		if name == "" {
+			name = "."
+		}
+
+		fi, err := fs.Stat(fsys, name)
+		switch {
+		case err == nil && fi.IsDir():
+			e.Response.Header().Set("Cache-Control", CacheControlNoCache)
+		case err == nil:
+			e.Response.Header().Set("Cache-Control", StaticCacheControl(name))
+			if served, err := serveFile(e, cfg, fsys, name); served || err != nil {
+				return err
+			}
+		case cfg.SPAFallback && IsUnderSPABase(e.Request.URL.Path, cfg.SPABase) && !IsAPIPath(e.Request.URL.Path) && path.Ext(name) == "":
+			e.Response.Header().Set("Cache-Control", CacheControlNoCache)
+			if served, err := serveFile(e, cfg, fsys, spaIndex); served || err != nil {
+				return err
+			}
+			return e.FileFS(fsys, spaIndex)
+		}
+
+		return serve(e)
+	}
+}
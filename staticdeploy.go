@@ -0,0 +1,410 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// DeployTokenHeader carries STATIC_DEPLOY_TOKEN to POST /admin/deploy-static.
+const DeployTokenHeader = "X-Deploy-Token"
+
+// staticDeployMaxFiles caps the entries of a bundle.
+const staticDeployMaxFiles = 10000
+
+// staticVersionFormat names the versions after their deploy time, so that
+// they sort by age.
+const staticVersionFormat = "20060102T150405.000Z"
+
+var (
+	ErrStaticBundleInvalid  = errors.New("invalid static bundle")
+	ErrStaticVersionUnknown = errors.New("static version not found")
+)
+
+// StaticVersion is a deployed bundle kept under STATIC_VERSIONS_DIR.
+type StaticVersion struct {
+	Version string `json:"version"`
+	Created string `json:"created"`
+	Current bool   `json:"current"`
+	Files   int    `json:"files,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+}
+
+// StaticDeployer unpacks the static bundles into versions of
+// STATIC_VERSIONS_DIR and serves one at a time by pointing PUBLIC_DIR, a
+// symlink, at it. Replacing the symlink is atomic, so the requests see
+// either the old or the new bundle in full.
+type StaticDeployer struct {
+	publicDir   string
+	versionsDir string
+	keep        int
+	maxSize     int64
+
+	// mu serializes the deploys and the rollbacks
+	mu sync.Mutex
+}
+
+func NewStaticDeployer(cfg *Config) *StaticDeployer {
+	return &StaticDeployer{
+		publicDir:   filepath.Clean(cfg.PublicDir),
+		versionsDir: filepath.Clean(cfg.StaticVersionsDir),
+		keep:        cfg.StaticDeployKeep,
+		maxSize:     int64(cfg.StaticDeployMaxSize),
+	}
+}
+
+// Deploy unpacks the zip bundle and serves it, keeping the last versions
+// for rollbacks. The files can be at the root of the zip or in its single
+// top directory, e.g. dist/, and must include an index.html.
+func (d *StaticDeployer) Deploy(r io.ReaderAt, size int64) (*StaticVersion, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStaticBundleInvalid, err)
+	}
+	files, root, err := staticBundleFiles(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := os.MkdirAll(d.versionsDir, 0o755); err != nil {
+		return nil, err
+	}
+	version := &StaticVersion{Version: time.Now().UTC().Format(staticVersionFormat)}
+	dir := filepath.Join(d.versionsDir, version.Version)
+	if _, err := os.Lstat(dir); err == nil {
+		return nil, fmt.Errorf("static version %s already exists", version.Version)
+	}
+	// unpacked next to the versions, so that the partial ones are never
+	// listed nor served
+	tmp, err := os.MkdirTemp(d.versionsDir, ".tmp_*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	remaining := d.maxSize
+	for _, f := range files {
+		name := strings.TrimPrefix(f.Name, root)
+		n, err := unpackStaticFile(f, filepath.Join(tmp, filepath.FromSlash(name)), remaining)
+		if err != nil {
+			return nil, err
+		}
+		remaining -= n
+		version.Files++
+		version.Size += n
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return nil, err
+	}
+	if err := d.activate(version.Version); err != nil {
+		return nil, err
+	}
+	version.Current = true
+	version.Created = time.Now().UTC().Format(time.RFC3339)
+	return version, d.prune(version.Version)
+}
+
+// Rollback serves the kept version again.
+func (d *StaticDeployer) Rollback(version string) (*StaticVersion, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	versions, err := d.versions()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.Version != version {
+			continue
+		}
+		if err := d.activate(version); err != nil {
+			return nil, err
+		}
+		v.Current = true
+		return &v, nil
+	}
+	return nil, ErrStaticVersionUnknown
+}
+
+// Versions returns the kept versions, newest first.
+func (d *StaticDeployer) Versions() ([]StaticVersion, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.versions()
+}
+
+func (d *StaticDeployer) versions() ([]StaticVersion, error) {
+	entries, err := os.ReadDir(d.versionsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []StaticVersion{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := d.current()
+	versions := []StaticVersion{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, StaticVersion{
+			Version: entry.Name(),
+			Created: info.ModTime().UTC().Format(time.RFC3339),
+			Current: entry.Name() == current,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+	return versions, nil
+}
+
+// current returns the version PUBLIC_DIR points at, none when it isn't
+// a symlink into STATIC_VERSIONS_DIR.
+func (d *StaticDeployer) current() string {
+	target, err := os.Readlink(d.publicDir)
+	if err != nil {
+		return ""
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(d.publicDir), target)
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return ""
+	}
+	if filepath.Dir(target) != d.absVersionsDir() {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+func (d *StaticDeployer) absVersionsDir() string {
+	abs, err := filepath.Abs(d.versionsDir)
+	if err != nil {
+		return d.versionsDir
+	}
+	return abs
+}
+
+// activate points PUBLIC_DIR at the version. A PUBLIC_DIR that is still a
+// plain directory, i.e. before the first deploy, is moved into the
+// versions first, named after its last change, so that it can be rolled
+// back to.
+func (d *StaticDeployer) activate(version string) error {
+	info, err := os.Lstat(d.publicDir)
+	switch {
+	case err == nil && info.IsDir():
+		initial := info.ModTime().UTC().Format(staticVersionFormat)
+		if err := os.Rename(d.publicDir, filepath.Join(d.versionsDir, initial)); err != nil {
+			return err
+		}
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	target := filepath.Join(d.absVersionsDir(), version)
+	if parent, err := filepath.Abs(filepath.Dir(d.publicDir)); err == nil {
+		if rel, err := filepath.Rel(parent, target); err == nil {
+			target = rel
+		}
+	}
+	link := d.publicDir + ".tmp_" + security.RandomString(8)
+	if err := os.Symlink(target, link); err != nil {
+		return err
+	}
+	if err := os.Rename(link, d.publicDir); err != nil {
+		os.Remove(link)
+		return err
+	}
+	return nil
+}
+
+// prune deletes the versions beyond the last STATIC_DEPLOY_KEEP, never the
+// current one.
+func (d *StaticDeployer) prune(current string) error {
+	versions, err := d.versions()
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	kept := 0
+	for _, v := range versions {
+		if v.Version == current || kept < d.keep {
+			kept++
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(d.versionsDir, v.Version)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// staticBundleFiles returns the regular files of the bundle and the top
+// directory they share, if they are all in one, rejecting the paths that
+// would escape the version directory.
+func staticBundleFiles(zr *zip.Reader) ([]*zip.File, string, error) {
+	files := []*zip.File{}
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") && f.Mode().IsDir() {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			return nil, "", fmt.Errorf("%w: %s isn't a regular file", ErrStaticBundleInvalid, f.Name)
+		}
+		if strings.Contains(f.Name, `\`) || !fs.ValidPath(f.Name) {
+			return nil, "", fmt.Errorf("%w: invalid path %q", ErrStaticBundleInvalid, f.Name)
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, "", fmt.Errorf("%w: the zip is empty", ErrStaticBundleInvalid)
+	}
+	if len(files) > staticDeployMaxFiles {
+		return nil, "", fmt.Errorf("%w: more than %d files", ErrStaticBundleInvalid, staticDeployMaxFiles)
+	}
+
+	root := ""
+	if top, _, ok := strings.Cut(files[0].Name, "/"); ok {
+		root = top + "/"
+		for _, f := range files {
+			if !strings.HasPrefix(f.Name, root) {
+				root = ""
+				break
+			}
+		}
+	}
+	hasIndex := false
+	for _, f := range files {
+		if f.Name == root+router.IndexPage {
+			hasIndex = true
+		}
+	}
+	if !hasIndex {
+		return nil, "", fmt.Errorf("%w: missing %s", ErrStaticBundleInvalid, path.Join(root, router.IndexPage))
+	}
+	return files, root, nil
+}
+
+// unpackStaticFile writes the file to dst, failing past limit bytes
+// whatever its header claims.
+func unpackStaticFile(f *zip.File, dst string, limit int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return 0, err
+	}
+	src, err := f.Open()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %w", ErrStaticBundleInvalid, f.Name, err)
+	}
+	defer src.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, io.LimitReader(src, limit+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrFormat) {
+		return n, fmt.Errorf("%w: %s: %w", ErrStaticBundleInvalid, f.Name, err)
+	}
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, fmt.Errorf("%w: unpacks to more than STATIC_DEPLOY_MAX_SIZE", ErrStaticBundleInvalid)
+	}
+	return n, nil
+}
+
+// RequireDeployToken rejects the deploys without STATIC_DEPLOY_TOKEN in
+// the X-Deploy-Token header, the routes not existing while it is unset.
+func RequireDeployToken(cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if cfg.StaticDeployToken == "" {
+			return WriteNotFound(e, "static deploys are disabled", nil)
+		}
+		token := e.Request.Header.Get(DeployTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.StaticDeployToken)) != 1 {
+			return WriteUnauthorized(e, "invalid deploy token", nil)
+		}
+		return e.Next()
+	}
+}
+
+// HandleDeployStatic serves the zip of the request body, sent as
+// application/zip, instead of the current static files.
+func HandleDeployStatic(d *StaticDeployer) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		// zip reads from the end, so the body is spooled to disk first
+		tmp, err := os.CreateTemp("", "static-deploy-*.zip")
+		if err != nil {
+			return WriteInternalServerError(e, "error deploying static files", nil)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		size, err := io.Copy(tmp, e.Request.Body)
+		if limit, ok := IsBodyTooLarge(err); ok {
+			return writeBodyTooLarge(e, limit)
+		}
+		if err != nil {
+			return WriteBadRequest(e, "bad request: error reading request body: "+err.Error(), nil)
+		}
+		version, err := d.Deploy(tmp, size)
+		if errors.Is(err, ErrStaticBundleInvalid) {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if err != nil {
+			e.App.Logger().Error("Failed to deploy static files", "error", err)
+			return WriteInternalServerError(e, "error deploying static files", nil)
+		}
+		return WriteOK(e, "", version)
+	}
+}
+
+func HandleListStaticVersions(d *StaticDeployer) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		versions, err := d.Versions()
+		if err != nil {
+			return WriteInternalServerError(e, "error listing static versions", nil)
+		}
+		return WriteOK(e, "", versions)
+	}
+}
+
+// HandleRollbackStatic serves a kept version again.
+func HandleRollbackStatic(d *StaticDeployer) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		version, err := d.Rollback(e.Request.PathValue("version"))
+		if errors.Is(err, ErrStaticVersionUnknown) {
+			return WriteNotFound(e, "static version not found", nil)
+		}
+		if err != nil {
+			e.App.Logger().Error("Failed to roll back static files", "error", err)
+			return WriteInternalServerError(e, "error rolling back static files", nil)
+		}
+		return WriteOK(e, "", version)
+	}
+}
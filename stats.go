@@ -0,0 +1,118 @@
+package main
+
+import (
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/cache"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	StatsSignupDays = 30
+	StatsCacheTTL   = time.Minute
+)
+
+// StatsCache caches the GET /admin/stats responses, in process. Unlike the
+// user responses it isn't invalidated on writes, the stats are simply up to
+// a minute old.
+var StatsCache = NewResponseCache(cache.NewLRU(cache.Options{MaxEntries: 16}), StatsCacheTTL, nil)
+
+type DailyCount struct {
+	Date  string `json:"date" db:"date"`
+	Count int    `json:"count" db:"count"`
+}
+
+type UserStats struct {
+	Total    int `json:"total" db:"total"`
+	Verified int `json:"verified" db:"verified"`
+	// ActiveDay and ActiveWeek count the users seen in the last 24 hours
+	// and 7 days.
+	ActiveDay  int `json:"activeDay" db:"activeDay"`
+	ActiveWeek int `json:"activeWeek" db:"activeWeek"`
+	// SignupsPerDay has an entry for each of the last StatsSignupDays UTC
+	// days, oldest first, including the days without signups.
+	SignupsPerDay []DailyCount `json:"signupsPerDay" db:"-"`
+	// SignupsByCountry counts the users by the country they signed up
+	// from, see GEOIP_DATABASE, most first.
+	SignupsByCountry []CountryCount `json:"signupsByCountry" db:"-"`
+	Generated        string         `json:"generated" db:"-"`
+}
+
+// GetUserStats computes the stats of the users that aren't deleted at now.
+func GetUserStats(app core.App, now time.Time) (*UserStats, error) {
+	now = now.UTC()
+	dayAgo, err := types.ParseDateTime(now.Add(-24 * time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	weekAgo, err := types.ParseDateTime(now.Add(-7 * 24 * time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	firstDay := time.Date(now.Year(), now.Month(), now.Day()-(StatsSignupDays-1), 0, 0, 0, 0, time.UTC)
+	since, err := types.ParseDateTime(firstDay)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &UserStats{Generated: types.NowDateTime().String()}
+	span := StartStorageSpan(app, "GetUserStats", "SELECT")
+	err = app.DB().
+		Select(
+			"COUNT(*) AS total",
+			"COALESCE(SUM([[verified]] = TRUE), 0) AS verified",
+			"COALESCE(SUM([[lastSeen]] >= {:dayAgo}), 0) AS activeDay",
+			"COALESCE(SUM([[lastSeen]] >= {:weekAgo}), 0) AS activeWeek",
+		).
+		From(Users.Table).
+		Where(Users.scope(app)).
+		Bind(dbx.Params{"dayAgo": dayAgo.String(), "weekAgo": weekAgo.String()}).
+		One(stats)
+	if err != nil {
+		span.End(err)
+		return nil, err
+	}
+
+	// the datetimes are stored as "2006-01-02 15:04:05.000Z", so the
+	// first 10 characters are the UTC day
+	signups := []DailyCount{}
+	err = app.DB().
+		Select("substr([[created]], 1, 10) AS date", "COUNT(*) AS count").
+		From(Users.Table).
+		Where(Users.scope(app)).
+		AndWhere(dbx.NewExp("[[created]] >= {:since}", dbx.Params{"since": since.String()})).
+		GroupBy("date").
+		All(&signups)
+	if err == nil {
+		stats.SignupsByCountry, err = CountSignupsByCountry(app)
+	}
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(signups))
+	for _, signup := range signups {
+		counts[signup.Date] = signup.Count
+	}
+	stats.SignupsPerDay = make([]DailyCount, StatsSignupDays)
+	for i := range stats.SignupsPerDay {
+		date := firstDay.AddDate(0, 0, i).Format(time.DateOnly)
+		stats.SignupsPerDay[i] = DailyCount{Date: date, Count: counts[date]}
+	}
+	return stats, nil
+}
+
+func HandleGetStats(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		stats, err := GetUserStats(app, time.Now())
+		if err != nil {
+			return WriteInternalServerError(e, "error getting stats: "+err.Error(), nil)
+		}
+		return WriteOK(e, "", stats)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+const (
+	StorageBackendLocal = "local"
+	StorageBackendS3    = "s3"
+)
+
+// ExportsPrefix is where the stored exports are kept in the storage.
+const ExportsPrefix = "exports/"
+
+var ErrDownloadInvalid = errors.New("invalid or expired download link")
+
+// ApplyStorageConfig points the PocketBase file storage, which holds the
+// uploaded avatars and the stored exports, at the backend picked with
+// STORAGE_BACKEND. Without one, the S3 settings of the dashboard apply.
+func ApplyStorageConfig(app core.App, cfg *Config) {
+	s3 := &app.Settings().S3
+	switch cfg.StorageBackend {
+	case StorageBackendLocal:
+		s3.Enabled = false
+	case StorageBackendS3:
+		s3.Enabled = true
+		s3.Bucket = cfg.StorageS3Bucket
+		s3.Region = cfg.StorageS3Region
+		s3.Endpoint = cfg.StorageS3Endpoint
+		s3.AccessKey = cfg.StorageS3AccessKey
+		s3.Secret = cfg.StorageS3Secret
+		s3.ForcePathStyle = cfg.StorageS3ForcePathStyle
+	}
+}
+
+// BindStorageConfig applies the storage config every time the settings are
+// loaded, so that saving them from the dashboard doesn't undo it.
+func BindStorageConfig(app core.App, cfg *Config) {
+	app.OnSettingsReload().BindFunc(func(e *core.SettingsReloadEvent) error {
+		if err := e.Next(); err != nil {
+			return err
+		}
+		ApplyStorageConfig(e.App, cfg)
+		return nil
+	})
+}
+
+// Download is a signed link to a file of the storage.
+type Download struct {
+	Key       string `json:"key"`
+	URL       string `json:"url"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// NewDownload signs a link to the file key, served by HandleDownload until
+// it expires.
+func NewDownload(app core.App, cfg *Config, key string, now time.Time) Download {
+	return NewDownloadUntil(app, cfg, key, now.Add(cfg.DownloadURLTTL))
+}
+
+// NewDownloadUntil signs a link to the file key expiring at expires, for
+// the links that outlive DownloadURLTTL, e.g. the emailed ones.
+func NewDownloadUntil(app core.App, cfg *Config, key string, expires time.Time) Download {
+	token := signUserToken([]byte(cfg.DownloadURLSecret), "download", "", key, expires)
+	return Download{
+		Key:       key,
+		URL:       strings.TrimRight(app.Settings().Meta.AppURL, "/") + "/downloads/" + token,
+		ExpiresAt: expires.UTC().Format(time.RFC3339),
+	}
+}
+
+// StoreExport writes the export of the users matching opts to the storage
+// and returns its key. The export goes through a temporary file, so that it
+// doesn't have to fit in memory.
+func StoreExport(app core.App, format string, opts ListOptions, now time.Time) (string, error) {
+	tmp, err := os.CreateTemp("", "users-export-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	err = WriteUsersExport(app, tmp, format, opts)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return uploadExport(app, tmp.Name(), "users", format, now)
+}
+
+// uploadExport uploads the file at path under ExportsPrefix and returns its
+// key, named after name, the time and format.
+func uploadExport(app core.App, path string, name string, format string, now time.Time) (string, error) {
+	file, err := filesystem.NewFileFromPath(path)
+	if err != nil {
+		return "", err
+	}
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return "", err
+	}
+	defer fsys.Close()
+
+	// the random part keeps the keys of concurrent exports apart and
+	// unguessable
+	key := ExportsPrefix + name + "-" + now.UTC().Format("20060102T150405Z") + "-" +
+		security.RandomStringWithAlphabet(10, "abcdefghijklmnopqrstuvwxyz0123456789") + "." + format
+	if err := fsys.UploadFile(file, key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// PurgeExports deletes the stored exports older than retention.
+func PurgeExports(app core.App, now time.Time, retention time.Duration) error {
+	if retention <= 0 {
+		return errors.New("retention_days must be positive")
+	}
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+
+	objects, err := fsys.List(ExportsPrefix)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, object := range objects {
+		if object.ModTime.Before(now.Add(-retention)) {
+			if err := fsys.Delete(object.Key); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HandleDownload serves the storage file of a link made by NewDownload.
+func HandleDownload(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		_, key, err := verifyUserToken([]byte(cfg.DownloadURLSecret), "download", e.Request.PathValue("token"), time.Now())
+		if err != nil {
+			return WriteNotFound(e, ErrDownloadInvalid.Error(), nil)
+		}
+
+		fsys, err := app.NewFilesystem()
+		if err != nil {
+			return WriteInternalServerError(e, "error opening filesystem: "+err.Error(), nil)
+		}
+		defer fsys.Close()
+		fsys.SetContext(e.Request.Context())
+
+		if exists, err := fsys.Exists(key); err != nil {
+			return WriteInternalServerError(e, "error getting file: "+err.Error(), nil)
+		} else if !exists {
+			return WriteNotFound(e, "file not found", nil)
+		}
+		e.Response.Header().Set("Cache-Control", "private, no-store")
+		e.Response.Header().Set("Content-Disposition", `attachment; filename="`+path.Base(key)+`"`)
+		return fsys.Serve(e.Response, e.Request, key, path.Base(key))
+	}
+}
+
+// writeStoredExport stores the export and responds with a Download of it,
+// for GET /users/export?store=true.
+func writeStoredExport(app core.App, cfg *Config, e *core.RequestEvent, format string, opts ListOptions) error {
+	now := time.Now()
+	key, err := StoreExport(app, format, opts, now)
+	if err != nil {
+		return WriteInternalServerError(e, "error storing export: "+err.Error(), nil)
+	}
+	return WriteResp(e, http.StatusCreated, "", NewDownload(app, cfg, key, now))
+}
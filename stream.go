@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// StreamFlushRows is how many rows a streamed listing writes between two
+// flushes.
+const StreamFlushRows = 200
+
+// JSONStream writes values one at a time, as the elements of a JSON array
+// (ExportFormatJSON) or as the lines of NDJSON (ExportFormatNDJSON), so
+// that no more than one of them is held in memory.
+type JSONStream struct {
+	w      io.Writer
+	format string
+	count  int
+}
+
+func NewJSONStream(w io.Writer, format string) *JSONStream {
+	return &JSONStream{w: w, format: format}
+}
+
+// Write encodes v as the next value of the stream.
+func (s *JSONStream) Write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	switch {
+	case s.format == ExportFormatNDJSON:
+		data = append(data, '\n')
+	case s.count == 0:
+		data = append([]byte("["), data...)
+	default:
+		data = append([]byte(","), data...)
+	}
+	s.count++
+	_, err = s.w.Write(data)
+	return err
+}
+
+// Close ends the JSON array. The NDJSON streams need no closing.
+func (s *JSONStream) Close() error {
+	if s.format == ExportFormatNDJSON {
+		return nil
+	}
+	end := "]\n"
+	if s.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(s.w, end)
+	return err
+}
+
+// RequestedStream returns the format of the stream the request asks for
+// with ?stream=json or ?stream=ndjson, or with an Accept header preferring
+// application/x-ndjson.
+func RequestedStream(r *http.Request) (string, bool) {
+	switch r.URL.Query().Get("stream") {
+	case ExportFormatJSON, "true":
+		return ExportFormatJSON, true
+	case ExportFormatNDJSON:
+		return ExportFormatNDJSON, true
+	}
+	accept, _, _ := strings.Cut(r.Header.Get("Accept"), ",")
+	if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == exportContentTypes[ExportFormatNDJSON] {
+		return ExportFormatNDJSON, true
+	}
+	return "", false
+}
+
+// writeUserStream streams the users matching opts.Filter in opts.Sort
+// order, ignoring the paging, as they are read. The stream carries no
+// APIResp envelope, and a failure midway can only leave it truncated.
+func writeUserStream(app core.App, e *core.RequestEvent, format string, opts ListOptions, fields []string) error {
+	e.Response.Header().Set("Content-Type", exportContentTypes[format])
+	e.Response.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(e.Response)
+	stream := NewJSONStream(e.Response, format)
+	err := EachUser(app, opts, func(user models.User) error {
+		if err := stream.Write(ProjectUser(e, user, fields)); err != nil {
+			return err
+		}
+		if stream.count%StreamFlushRows == 0 {
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = stream.Close()
+	}
+	if err != nil {
+		app.Logger().Error("Failed to stream users", "format", format, "requestId", RequestId(e), "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const tombstonesCleanupJobName = "tombstones_cleanup"
+
+var ErrSyncCursorExpired = errors.New("the deletions since the cursor are no longer kept, sync again from scratch")
+
+// UserTombstone records a user deleted for good, so that GET /users/changes
+// can report it once the row is gone. The soft deleted users need none.
+type UserTombstone struct {
+	Id       string `db:"id" json:"id"`
+	UserId   string `db:"user_id" json:"userId"`
+	TenantId string `db:"tenant_id" json:"tenantId,omitempty"`
+	Created  string `db:"created" json:"created"`
+}
+
+var UserTombstones = &Repository[UserTombstone]{
+	Table:        "user_tombstones",
+	TenantColumn: "tenant_id",
+}
+
+// ChangeCursor is the position of a change in the (time, id) order of
+// GET /users/changes. An empty Id stands for the start of Time.
+type ChangeCursor struct {
+	Time string `json:"t"`
+	Id   string `json:"i"`
+}
+
+func (c ChangeCursor) IsZero() bool {
+	return c.Time == ""
+}
+
+func EncodeChangeCursor(c ChangeCursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// ParseChangeCursor reads ?since=, either the cursor of a previous sync or
+// a timestamp in RFC 3339 or in the format of the PocketBase dates.
+func ParseChangeCursor(since string) (ChangeCursor, error) {
+	c := ChangeCursor{}
+	if since == "" {
+		return c, nil
+	}
+	if raw, err := base64.RawURLEncoding.DecodeString(since); err == nil {
+		if err := json.Unmarshal(raw, &c); err == nil && c.Time != "" {
+			return c, nil
+		}
+	}
+	at, err := types.ParseDateTime(since)
+	if err != nil || at.IsZero() {
+		return ChangeCursor{}, ErrInvalidCursor
+	}
+	return ChangeCursor{Time: at.String()}, nil
+}
+
+// after is the keyset condition on the rows following c.
+func (c ChangeCursor) after(timeColumn string, idColumn string) dbx.Expression {
+	return dbx.NewExp(
+		fmt.Sprintf("([[%[1]s]] > {:time} OR ([[%[1]s]] = {:time} AND [[%[2]s]] > {:id}))", timeColumn, idColumn),
+		dbx.Params{"time": c.Time, "id": c.Id},
+	)
+}
+
+func (c ChangeCursor) before(time string, id string) bool {
+	return c.Time < time || c.Time == time && c.Id < id
+}
+
+type DeletedUser struct {
+	Id      string `json:"id"`
+	Deleted string `json:"deleted"`
+}
+
+// UserChanges is the response to GET /users/changes. Cursor is the ?since=
+// of the next sync, and HasMore tells to run it right away.
+type UserChanges struct {
+	Created []any         `json:"created"`
+	Updated []any         `json:"updated"`
+	Deleted []DeletedUser `json:"deleted"`
+	Cursor  string        `json:"cursor"`
+	HasMore bool          `json:"hasMore"`
+}
+
+// RecordUserTombstone records the deletion for good of the user.
+func RecordUserTombstone(app core.App, userId string, tenantId string) error {
+	return RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().Insert(UserTombstones.Table, dbx.Params{
+			"id":        NewId(UserTombstones.Table),
+			"user_id":   userId,
+			"tenant_id": tenantId,
+			"created":   types.NowDateTime().String(),
+		}).Execute()
+		return err
+	})
+}
+
+// BindTombstoneHooks records the tombstones of the users deleted as
+// records, e.g. from the dashboard. HardDeleteUserById records its own.
+func BindTombstoneHooks(app core.App) {
+	app.OnRecordAfterDeleteSuccess(Users.Table).BindFunc(func(e *core.RecordEvent) error {
+		if err := RecordUserTombstone(e.App, e.Record.Id, e.Record.GetString(Users.TenantColumn)); err != nil {
+			e.App.Logger().Warn("Failed to record user tombstone", "userId", e.Record.Id, "error", err)
+		}
+		return e.Next()
+	})
+}
+
+// DeleteExpiredTombstones removes the tombstones older than ttl, past which
+// the syncs from before them must start over.
+func DeleteExpiredTombstones(app core.App, ttl time.Duration) error {
+	cutoff, err := types.ParseDateTime(time.Now().Add(-ttl))
+	if err != nil {
+		return err
+	}
+	return RetryWrite(app, func() error {
+		_, err := app.NonconcurrentDB().Delete(UserTombstones.Table, dbx.NewExp(
+			"[[created]] < {:cutoff}", dbx.Params{"cutoff": cutoff.String()},
+		)).Execute()
+		return err
+	})
+}
+
+func ScheduleTombstonesCleanup(app core.App, ttl time.Duration) {
+	app.Cron().MustAdd(tombstonesCleanupJobName, "0 * * * *", func() {
+		if err := DeleteExpiredTombstones(app, ttl); err != nil {
+			app.Logger().Warn("Failed to delete expired user tombstones", "error", err)
+		}
+	})
+}
+
+// syncedUser is a user read along with its soft delete mark.
+type syncedUser struct {
+	models.User
+	DeletedAt string `db:"deleted_at"`
+}
+
+// userChange is a change of GET /users/changes, a user or a tombstone.
+type userChange struct {
+	time string
+	id   string
+	user *syncedUser
+}
+
+// FindUserChanges returns the at most limit changes to the users following
+// since, in the order they happened: the users created, updated or soft
+// deleted, by their updated time, and the tombstones of the users deleted
+// for good. From a zero cursor, the deleted users are left out. The last
+// return value tells if there are more changes.
+func FindUserChanges(app core.App, since ChangeCursor, limit int) ([]userChange, bool, error) {
+	users := []syncedUser{}
+	tombstones := []UserTombstone{}
+	if since.IsZero() {
+		err := Users.Query(app).
+			OrderBy(Users.Table+".updated", Users.Table+".id").
+			Limit(int64(limit) + 1).
+			All(&users)
+		if err != nil {
+			return nil, false, err
+		}
+	} else {
+		err := Users.WithDeleted().Query(app).
+			AndWhere(since.after(Users.Table+".updated", Users.Table+".id")).
+			OrderBy(Users.Table+".updated", Users.Table+".id").
+			Limit(int64(limit) + 1).
+			All(&users)
+		if err != nil {
+			return nil, false, err
+		}
+		err = UserTombstones.Query(app).
+			AndWhere(since.after(UserTombstones.Table+".created", UserTombstones.Table+".user_id")).
+			OrderBy(UserTombstones.Table+".created", UserTombstones.Table+".user_id").
+			Limit(int64(limit) + 1).
+			All(&tombstones)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	changes := make([]userChange, 0, len(users)+len(tombstones))
+	for i := range users {
+		if err := Users.Decrypt(&users[i].User); err != nil {
+			return nil, false, err
+		}
+		changes = append(changes, userChange{time: users[i].Updated, id: users[i].Id, user: &users[i]})
+	}
+	for _, tombstone := range tombstones {
+		changes = append(changes, userChange{time: tombstone.Created, id: tombstone.UserId})
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].time != changes[j].time {
+			return changes[i].time < changes[j].time
+		}
+		return changes[i].id < changes[j].id
+	})
+	if len(changes) > limit {
+		return changes[:limit], true, nil
+	}
+	return changes, false, nil
+}
+
+// HandleGetUserChanges returns the users created, updated and deleted since
+// ?since=, a timestamp or the cursor of the previous sync, so that clients
+// can keep a copy of the users without downloading them all again. Without
+// ?since= it returns every user, as the first sync. ?limit= caps the
+// changes returned at once.
+func HandleGetUserChanges(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		query := e.Request.URL.Query()
+		since, err := ParseChangeCursor(query.Get("since"))
+		if err != nil {
+			return WriteBadRequest(e, "bad request: since must be a cursor or a timestamp", nil)
+		}
+		fields, err := ParseUserFields(query.Get("fields"))
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		limit := cfg.DefaultPerPage
+		if raw := query.Get("limit"); raw != "" {
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit < 1 {
+				return WriteBadRequest(e, fmt.Sprintf("invalid limit %q", raw), nil)
+			}
+			limit = min(limit, cfg.MaxPerPage)
+		}
+
+		cutoff, err := types.ParseDateTime(time.Now().Add(-cfg.SyncTombstoneTTL))
+		if err != nil {
+			return WriteError(e, err, "error getting user changes")
+		}
+		if !since.IsZero() && since.Time < cutoff.String() {
+			return WriteGone(e, ErrSyncCursorExpired.Error(), nil)
+		}
+
+		changes, hasMore, err := FindUserChanges(app, since, limit)
+		if err != nil {
+			return WriteError(e, err, "error getting user changes")
+		}
+		result := UserChanges{Created: []any{}, Updated: []any{}, Deleted: []DeletedUser{}, HasMore: hasMore}
+		for _, change := range changes {
+			switch {
+			case change.user == nil:
+				result.Deleted = append(result.Deleted, DeletedUser{Id: change.id, Deleted: change.time})
+			case change.user.DeletedAt != "":
+				result.Deleted = append(result.Deleted, DeletedUser{Id: change.id, Deleted: change.user.DeletedAt})
+			case since.before(change.user.Created, change.user.Id):
+				result.Created = append(result.Created, ProjectUser(e, change.user.User, fields))
+			default:
+				result.Updated = append(result.Updated, ProjectUser(e, change.user.User, fields))
+			}
+		}
+		if len(changes) > 0 {
+			last := changes[len(changes)-1]
+			since = ChangeCursor{Time: last.time, Id: last.id}
+		}
+		if !since.IsZero() {
+			result.Cursor = EncodeChangeCursor(since)
+		}
+		return WriteOK(e, "", result)
+	}
+}
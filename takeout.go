@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+)
+
+var takeoutEmailTemplate = template.Must(template.New("takeout").Parse(
+	`<p>Hi{{if .Name}} {{.Name}}{{end}},</p>
+<p>The export of your data is ready. Download it from the link below, it expires in {{.TTL}}.</p>
+<p><a href="{{.URL}}">{{.URL}}</a></p>
+<p>If you didn't ask for it, contact us.</p>`))
+
+// TakeoutJob is the payload of the JobTakeout jobs.
+type TakeoutJob struct {
+	UserId string `json:"userId"`
+}
+
+// WriteTakeout writes to w a zip of the user, as user.json, the rows of the
+// tables owned by it, as <table>.json, and the files of all of them under
+// files/<collection>/<record id>/.
+func WriteTakeout(app core.App, w io.Writer, userId string, tables []OwnedTable) error {
+	user, err := Users.Find(app, userId)
+	if err != nil {
+		return err
+	}
+	record, err := app.FindRecordById(Users.Table, userId)
+	if err != nil {
+		return err
+	}
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+
+	zw := zip.NewWriter(w)
+	if err := writeZipJSON(zw, "user.json", user); err != nil {
+		return err
+	}
+	records := []*core.Record{record}
+	for _, t := range tables {
+		rows, err := app.FindAllRecords(t.Table, dbx.HashExp{t.Column: userId})
+		if err != nil {
+			return err
+		}
+		if err := writeZipJSON(zw, t.Table+".json", rows); err != nil {
+			return err
+		}
+		records = append(records, rows...)
+	}
+
+	for _, r := range records {
+		for _, field := range r.Collection().Fields {
+			if _, ok := field.(*core.FileField); !ok {
+				continue
+			}
+			for _, name := range r.GetStringSlice(field.GetName()) {
+				f, err := fsys.GetFile(r.BaseFilesPath() + "/" + name)
+				if err != nil {
+					return err
+				}
+				err = writeZipFile(zw, "files/"+r.Collection().Name+"/"+r.Id+"/"+name, f)
+				f.Close()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return zw.Close()
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeZipFile(zw, name, bytes.NewReader(raw))
+}
+
+func writeZipFile(zw *zip.Writer, name string, r io.Reader) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// StoreTakeout writes the takeout of the user to the storage, next to the
+// exports, and returns its key.
+func StoreTakeout(app core.App, userId string, tables []OwnedTable, now time.Time) (string, error) {
+	tmp, err := os.CreateTemp("", "takeout-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	err = WriteTakeout(app, tmp, userId, tables)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return uploadExport(app, tmp.Name(), "takeout-"+userId, "zip", now)
+}
+
+// SendTakeoutEmail mails the user the link to its takeout.
+func SendTakeoutEmail(app core.App, cfg *Config, user *models.User, download Download) error {
+	meta := app.Settings().Meta
+	body := bytes.Buffer{}
+	err := takeoutEmailTemplate.Execute(&body, map[string]any{
+		"Name": user.Name,
+		"TTL":  cfg.TakeoutURLTTL.String(),
+		"URL":  download.URL,
+	})
+	if err != nil {
+		return err
+	}
+	return SendMail(app, &mailer.Message{
+		From:    mail.Address{Name: meta.SenderName, Address: meta.SenderAddress},
+		To:      []mail.Address{{Address: user.Email}},
+		Subject: "Your data export is ready",
+		HTML:    body.String(),
+	})
+}
+
+// RunTakeoutJob returns the runner of the JobTakeout jobs, which store the
+// takeout of the user and email it a link to it. The users deleted since
+// are skipped.
+func RunTakeoutJob(cfg *Config) func(ctx context.Context, app core.App, job *Job) error {
+	return func(ctx context.Context, app core.App, job *Job) error {
+		p := TakeoutJob{}
+		if err := DecodeJobPayload(job, &p); err != nil {
+			return err
+		}
+		user, err := Users.Find(app, p.UserId)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		tables := make([]OwnedTable, 0, len(cfg.TakeoutCollections))
+		for _, s := range cfg.TakeoutCollections {
+			owned, err := ParseOwnedTable(s)
+			if err != nil {
+				return err
+			}
+			tables = append(tables, owned)
+		}
+		now := time.Now()
+		key, err := StoreTakeout(app, p.UserId, tables, now)
+		if err != nil {
+			return err
+		}
+		return SendTakeoutEmail(app, cfg, user, NewDownloadUntil(app, cfg, key, now.Add(cfg.TakeoutURLTTL)))
+	}
+}
+
+// HandleRequestTakeout queues the takeout of the user, which is emailed to
+// it once ready.
+func HandleRequestTakeout(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		if _, err := Users.Find(app, userId); err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+		job, err := EnqueueJob(app, JobTakeout, TakeoutJob{UserId: userId}, time.Now())
+		if err != nil {
+			return WriteInternalServerError(e, "error queueing takeout: "+err.Error(), nil)
+		}
+		return WriteResp(e, http.StatusAccepted, "takeout queued, a download link will be emailed", job)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	TeamRoleOwner  = "owner"
+	TeamRoleAdmin  = "admin"
+	TeamRoleMember = "member"
+)
+
+// TeamRoles lists the team roles from the most to the least privileged, see
+// HasTeamRole.
+var TeamRoles = []string{TeamRoleOwner, TeamRoleAdmin, TeamRoleMember}
+
+const (
+	teamRequestKey           = "team"
+	teamMembershipRequestKey = "teamMembership"
+)
+
+var (
+	ErrInvalidTeamRole   = errors.New("invalid team role, expected owner, admin or member")
+	ErrTeamOwnerRequired = errors.New("only the owners can grant or revoke the owner role")
+	ErrLastTeamOwner     = errors.New("the team must keep an owner")
+	ErrAlreadyTeamMember = errors.New("user is already a member of the team")
+	ErrTeamInviteInvalid = errors.New("invalid team invitation token")
+	ErrTeamInviteExpired = errors.New("team invitation token expired")
+	ErrTeamInviteEmail   = errors.New("team invitation was sent to another email")
+	ErrTeamUsersOnly     = errors.New("only users can be team members")
+)
+
+var teamInviteEmailTemplate = template.Must(template.New("teamInvite").Parse(
+	`<p>Hi,</p>
+<p>You were invited to join the team {{.Team}} as {{.Role}}. Open the link below, once logged in with this email, to accept. It expires in {{.TTL}}.</p>
+<p><a href="{{.URL}}">{{.URL}}</a></p>
+<p>If you didn't expect this invitation, you can ignore this email.</p>`))
+
+type Team struct {
+	Id       string `db:"id" json:"id"`
+	Name     string `db:"name" json:"name"`
+	TenantId string `db:"tenant_id" json:"-"`
+	Created  string `db:"created" json:"created"`
+	Updated  string `db:"updated" json:"updated"`
+}
+
+type TeamMembership struct {
+	Id      string `db:"id" json:"id"`
+	Team    string `db:"team" json:"team"`
+	User    string `db:"user" json:"user"`
+	Role    string `db:"role" json:"role"`
+	Created string `db:"created" json:"created"`
+	Updated string `db:"updated" json:"updated"`
+}
+
+// TeamMember is a membership with its user, as listed by
+// GET /teams/{teamId}/members.
+type TeamMember struct {
+	Role   string      `json:"role"`
+	Joined string      `json:"joined"`
+	User   models.User `json:"user"`
+}
+
+// TeamInvitation describes an emailed invitation, whose token isn't
+// returned so that only the owner of the email can accept it.
+type TeamInvitation struct {
+	Team    string `json:"team"`
+	Email   string `json:"email"`
+	Role    string `json:"role"`
+	Expires string `json:"expires"`
+}
+
+type CreateTeamRequest struct {
+	Name string `json:"name" binding:"required,max=255"`
+}
+
+type TeamInviteRequest struct {
+	Email string `json:"email" binding:"required"`
+	Role  string `json:"role" default:"member"`
+}
+
+type AcceptTeamInviteRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type TeamRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+var (
+	Teams           = &Repository[Team]{Table: "teams", TenantColumn: "tenant_id"}
+	TeamMemberships = NewRepository[TeamMembership]("team_memberships")
+)
+
+// HasTeamRole reports whether role is required or a more privileged role.
+func HasTeamRole(role string, required string) bool {
+	rank := slices.Index(TeamRoles, required)
+	i := slices.Index(TeamRoles, role)
+	return rank >= 0 && i >= 0 && i <= rank
+}
+
+// SignTeamInviteToken returns a token inviting email to the team with role.
+func SignTeamInviteToken(secret []byte, teamId string, role string, email string, expires time.Time) string {
+	return signUserToken(secret, "team-invite", teamId, role+":"+email, expires)
+}
+
+// VerifyTeamInviteToken checks the token signature and expiry and returns
+// the team id, role and email it was issued for.
+func VerifyTeamInviteToken(secret []byte, token string, now time.Time) (string, string, string, error) {
+	teamId, value, err := verifyUserToken(secret, "team-invite", token, now)
+	if errors.Is(err, errTokenExpired) {
+		return "", "", "", ErrTeamInviteExpired
+	}
+	if err != nil {
+		return "", "", "", ErrTeamInviteInvalid
+	}
+	role, email, ok := strings.Cut(value, ":")
+	if !ok {
+		return "", "", "", ErrTeamInviteInvalid
+	}
+	return teamId, role, email, nil
+}
+
+func FindTeamMembership(app core.App, teamId string, userId string) (*TeamMembership, error) {
+	return TeamMemberships.FindOne(app, dbx.HashExp{"team": teamId, "user": userId})
+}
+
+// saveTeamMembership adds the user to the team with role.
+func saveTeamMembership(app core.App, teamId string, userId string, role string) (*TeamMembership, error) {
+	collection, err := app.FindCachedCollectionByNameOrId(TeamMemberships.Table)
+	if err != nil {
+		return nil, err
+	}
+	record := core.NewRecord(collection)
+	record.Set("team", teamId)
+	record.Set("user", userId)
+	record.Set("role", role)
+	if err := app.Save(record); err != nil {
+		return nil, err
+	}
+	return TeamMemberships.Find(app, record.Id)
+}
+
+// CreateTeam creates a team in the tenant of app, owned by the user.
+func CreateTeam(app core.App, name string, ownerId string) (*Team, error) {
+	collection, err := app.FindCachedCollectionByNameOrId(Teams.Table)
+	if err != nil {
+		return nil, err
+	}
+	var team *Team
+	err = WithTx(app, func(txApp core.App) error {
+		record := core.NewRecord(collection)
+		record.Set("name", name)
+		if tenantId, ok := Teams.tenant(txApp); ok {
+			record.Set(Teams.TenantColumn, tenantId)
+		}
+		if err := txApp.Save(record); err != nil {
+			return err
+		}
+		if _, err := saveTeamMembership(txApp, record.Id, ownerId, TeamRoleOwner); err != nil {
+			return err
+		}
+		var err error
+		team, err = Teams.Find(txApp, record.Id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// ListTeamMembers returns the members of the team in the order they joined,
+// leaving out the deleted users.
+func ListTeamMembers(app core.App, teamId string) ([]TeamMember, error) {
+	memberships, err := TeamMemberships.FindAll(app, ListOptions{
+		Filter: dbx.HashExp{"team": teamId},
+		Sort:   []SortField{{Field: "created"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	userIds := make([]any, len(memberships))
+	for i, membership := range memberships {
+		userIds[i] = membership.User
+	}
+	users, err := Users.FindAll(app, ListOptions{Filter: dbx.In("users.id", userIds...)})
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[string]models.User, len(users))
+	for _, user := range users {
+		byId[user.Id] = user
+	}
+
+	members := make([]TeamMember, 0, len(memberships))
+	for _, membership := range memberships {
+		if user, ok := byId[membership.User]; ok {
+			members = append(members, TeamMember{Role: membership.Role, Joined: membership.Created, User: user})
+		}
+	}
+	return members, nil
+}
+
+// InviteToTeam mails email a token to join the team with role. Only the
+// owners (byOwner) may invite other owners.
+func InviteToTeam(app core.App, cfg *Config, team *Team, email string, role string, byOwner bool) (*TeamInvitation, error) {
+	if !slices.Contains(TeamRoles, role) {
+		return nil, ErrInvalidTeamRole
+	}
+	if role == TeamRoleOwner && !byOwner {
+		return nil, ErrTeamOwnerRequired
+	}
+	user, err := GetUserByEmail(app, email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if user != nil {
+		_, err := FindTeamMembership(app, team.Id, user.Id)
+		if err == nil {
+			return nil, ErrAlreadyTeamMember
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	expires := time.Now().Add(cfg.TeamInviteTTL)
+	token := SignTeamInviteToken([]byte(cfg.TeamInviteSecret), team.Id, role, email, expires)
+	meta := app.Settings().Meta
+	body := bytes.Buffer{}
+	err = teamInviteEmailTemplate.Execute(&body, map[string]any{
+		"Team": team.Name,
+		"Role": role,
+		"TTL":  cfg.TeamInviteTTL.String(),
+		"URL":  strings.TrimRight(meta.AppURL, "/") + "/teams/join?token=" + url.QueryEscape(token),
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = SendMail(app, &mailer.Message{
+		From:    mail.Address{Name: meta.SenderName, Address: meta.SenderAddress},
+		To:      []mail.Address{{Address: email}},
+		Subject: "You were invited to join " + team.Name,
+		HTML:    body.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt, err := types.ParseDateTime(expires)
+	if err != nil {
+		return nil, err
+	}
+	return &TeamInvitation{Team: team.Id, Email: email, Role: role, Expires: expiresAt.String()}, nil
+}
+
+// AcceptTeamInvite adds the user to the team of the token, as long as the
+// token was sent to its email.
+func AcceptTeamInvite(app core.App, cfg *Config, token string, user *models.User) (*TeamMembership, error) {
+	teamId, role, email, err := VerifyTeamInviteToken([]byte(cfg.TeamInviteSecret), token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(email, user.Email) {
+		return nil, ErrTeamInviteEmail
+	}
+
+	var membership *TeamMembership
+	err = WithTx(app, func(txApp core.App) error {
+		// the teams deleted since, or of another tenant, void the token
+		if _, err := Teams.Find(txApp, teamId); errors.Is(err, ErrNotFound) {
+			return ErrTeamInviteInvalid
+		} else if err != nil {
+			return err
+		}
+		_, err := FindTeamMembership(txApp, teamId, user.Id)
+		if err == nil {
+			return ErrAlreadyTeamMember
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		membership, err = saveTeamMembership(txApp, teamId, user.Id, role)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+// SetTeamRole changes the role of a member of the team. Only the owners
+// (byOwner) may grant or revoke the owner role, and the last owner keeps it.
+func SetTeamRole(app core.App, teamId string, userId string, role string, byOwner bool) (*TeamMembership, error) {
+	if !slices.Contains(TeamRoles, role) {
+		return nil, ErrInvalidTeamRole
+	}
+	var membership *TeamMembership
+	err := WithTx(app, func(txApp core.App) error {
+		current, err := FindTeamMembership(txApp, teamId, userId)
+		if err != nil {
+			return err
+		}
+		if (role == TeamRoleOwner || current.Role == TeamRoleOwner) && !byOwner {
+			return ErrTeamOwnerRequired
+		}
+		if current.Role == TeamRoleOwner && role != TeamRoleOwner {
+			owners, err := TeamMemberships.Count(txApp, dbx.HashExp{"team": teamId, "role": TeamRoleOwner})
+			if err != nil {
+				return err
+			}
+			if owners <= 1 {
+				return ErrLastTeamOwner
+			}
+		}
+		if _, err := TeamMemberships.Update(txApp, current.Id, Changeset{
+			"role":    role,
+			"updated": types.NowDateTime().String(),
+		}); err != nil {
+			return err
+		}
+		membership, err = TeamMemberships.Find(txApp, current.Id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+// RequireTeamRole rejects the requests to the team of the teamId path value
+// that aren't authenticated either as a superuser or as a member with the
+// role (see HasTeamRole). The API keys act for no user and are rejected.
+// The team and the membership of the requester are available to the
+// handlers, see RequestTeam.
+func RequireTeamRole(app core.App, role string) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil {
+			return WriteUnauthorized(e, "authentication required", nil)
+		}
+		app := WithTrace(app, e)
+		team, err := Teams.Find(app, e.Request.PathValue("teamId"))
+		if errors.Is(err, ErrNotFound) {
+			return WriteNotFound(e, "team not found", nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error getting team")
+		}
+		e.Set(teamRequestKey, team)
+		if e.HasSuperuserAuth() {
+			return e.Next()
+		}
+
+		membership, err := FindTeamMembership(app, team.Id, e.Auth.Id)
+		// the teams of others don't exist as far as their outsiders know
+		if errors.Is(err, ErrNotFound) {
+			return WriteNotFound(e, "team not found", nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error getting team membership")
+		}
+		if !HasTeamRole(membership.Role, role) {
+			return WriteForbidden(e, "team "+role+" role required", nil)
+		}
+		e.Set(teamMembershipRequestKey, membership)
+		return e.Next()
+	}
+}
+
+// RequestTeam returns the team RequireTeamRole loaded, and the membership
+// of the requester, nil for the superusers.
+func RequestTeam(e *core.RequestEvent) (*Team, *TeamMembership) {
+	team, _ := e.Get(teamRequestKey).(*Team)
+	membership, _ := e.Get(teamMembershipRequestKey).(*TeamMembership)
+	return team, membership
+}
+
+// isTeamOwner reports whether the requester may grant the owner role.
+func isTeamOwner(e *core.RequestEvent) bool {
+	_, membership := RequestTeam(e)
+	return e.HasSuperuserAuth() || (membership != nil && membership.Role == TeamRoleOwner)
+}
+
+func writeTeamError(e *core.RequestEvent, err error, action string) error {
+	switch {
+	case errors.Is(err, ErrInvalidTeamRole):
+		return WriteBadRequest(e, "bad request: "+err.Error(), map[string]string{"role": err.Error()})
+	case errors.Is(err, ErrTeamOwnerRequired):
+		return WriteForbidden(e, err.Error(), nil)
+	case errors.Is(err, ErrLastTeamOwner), errors.Is(err, ErrAlreadyTeamMember):
+		return WriteConflict(e, err.Error(), nil)
+	case errors.Is(err, ErrTeamInviteExpired):
+		return WriteGone(e, err.Error(), nil)
+	case errors.Is(err, ErrTeamInviteInvalid):
+		return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+	case errors.Is(err, ErrTeamInviteEmail):
+		return WriteForbidden(e, err.Error(), nil)
+	}
+	return WriteError(e, err, action)
+}
+
+// requestUser returns the users record the request is authenticated as.
+func requestUser(app core.App, e *core.RequestEvent) (*models.User, error) {
+	if e.Auth == nil || e.Auth.Collection().Name != Users.Table {
+		return nil, ErrTeamUsersOnly
+	}
+	return GetUserById(app, e.Auth.Id)
+}
+
+func HandleCreateTeam(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		cr := CreateTeamRequest{}
+		if err := BindStrict(e, &cr); err != nil {
+			return WriteBindError(e, err)
+		}
+		// the API keys pass RequireAuth without an auth record
+		if e.Auth == nil || e.Auth.Collection().Name != Users.Table {
+			return WriteForbidden(e, ErrTeamUsersOnly.Error(), nil)
+		}
+
+		team, err := CreateTeam(app, strings.TrimSpace(cr.Name), e.Auth.Id)
+		if err != nil {
+			return WriteError(e, err, "error creating team")
+		}
+		return WriteResp(e, http.StatusCreated, "", team)
+	}
+}
+
+func HandleListTeamMembers(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		team, _ := RequestTeam(e)
+		members, err := ListTeamMembers(WithTrace(app, e), team.Id)
+		if err != nil {
+			return WriteError(e, err, "error getting team members")
+		}
+		for i := range members {
+			members[i].User = RedactUser(e, members[i].User)
+		}
+		return WriteOK(e, "", members)
+	}
+}
+
+func HandleInviteToTeam(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		ir := TeamInviteRequest{}
+		if err := BindStrict(e, &ir); err != nil {
+			return WriteBindError(e, err)
+		}
+		if _, err := mail.ParseAddress(ir.Email); err != nil {
+			return WriteBadRequest(e, "bad request: invalid email", map[string]string{"email": "must be a valid email address"})
+		}
+
+		team, _ := RequestTeam(e)
+		invitation, err := InviteToTeam(WithTrace(app, e), cfg, team, strings.TrimSpace(ir.Email), ir.Role, isTeamOwner(e))
+		if err != nil {
+			return writeTeamError(e, err, "error inviting to team")
+		}
+		return WriteResp(e, http.StatusAccepted, "an invitation was sent to "+invitation.Email, invitation)
+	}
+}
+
+func HandleAcceptTeamInvite(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		ar := AcceptTeamInviteRequest{}
+		if err := BindStrict(e, &ar); err != nil {
+			return WriteBindError(e, err)
+		}
+		user, err := requestUser(app, e)
+		if errors.Is(err, ErrTeamUsersOnly) {
+			return WriteForbidden(e, err.Error(), nil)
+		}
+		if err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+
+		membership, err := AcceptTeamInvite(app, cfg, ar.Token, user)
+		if err != nil {
+			return writeTeamError(e, err, "error accepting team invitation")
+		}
+		return WriteOK(e, "", membership)
+	}
+}
+
+func HandleSetTeamRole(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		rr := TeamRoleRequest{}
+		if err := BindStrict(e, &rr); err != nil {
+			return WriteBindError(e, err)
+		}
+
+		team, _ := RequestTeam(e)
+		membership, err := SetTeamRole(WithTrace(app, e), team.Id, e.Request.PathValue("userId"), rr.Role, isTeamOwner(e))
+		if errors.Is(err, ErrNotFound) {
+			return WriteNotFound(e, "team member not found", nil)
+		}
+		if err != nil {
+			return writeTeamError(e, err, "error setting team role")
+		}
+		return WriteOK(e, "", membership)
+	}
+}
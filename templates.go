@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// Templates holds the HTML views, pages and emails, keyed by their path
+// under the templates directory, e.g. pages/profile.html. Every view is
+// parsed along with the layouts and partials, so that it can use the
+// layouts, e.g. {{template "page" .}}, and override their blocks.
+type Templates struct {
+	views map[string]*template.Template
+}
+
+// Views are the templates loaded at startup by LoadTemplates.
+var Views = &Templates{views: map[string]*template.Template{}}
+
+// LoadTemplates parses the layouts/*.html and partials/*.html of dir, then
+// every pages/*.html and emails/*.html with them. The embedded templates are
+// used when dir is empty.
+func LoadTemplates(dir string) (*Templates, error) {
+	var fsys fs.FS
+	if dir == "" {
+		sub, err := fs.Sub(embeddedTemplates, "templates")
+		if err != nil {
+			return nil, err
+		}
+		fsys = sub
+	} else {
+		fsys = os.DirFS(dir)
+	}
+
+	base := template.New("")
+	for _, pattern := range []string{"layouts/*.html", "partials/*.html"} {
+		names, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if err := parseTemplate(base.New(name), fsys, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t := &Templates{views: map[string]*template.Template{}}
+	for _, pattern := range []string{"pages/*.html", "emails/*.html"} {
+		names, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			view, err := base.Clone()
+			if err != nil {
+				return nil, err
+			}
+			if err := parseTemplate(view.New(name), fsys, name); err != nil {
+				return nil, err
+			}
+			t.views[name] = view
+		}
+	}
+	return t, nil
+}
+
+func parseTemplate(t *template.Template, fsys fs.FS, name string) error {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	if _, err := t.Parse(string(data)); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// Render executes the view with data, which gets the App and AppURL keys
+// of the app settings unless it sets them.
+func (t *Templates) Render(app core.App, w io.Writer, name string, data map[string]any) error {
+	view, ok := t.views[name]
+	if !ok {
+		return fmt.Errorf("no template %q", name)
+	}
+	meta := app.Settings().Meta
+	values := map[string]any{
+		"App":    meta.AppName,
+		"AppURL": strings.TrimRight(meta.AppURL, "/"),
+	}
+	for key, value := range data {
+		values[key] = value
+	}
+	return view.ExecuteTemplate(w, name, values)
+}
+
+// RenderString returns the rendered view, e.g. for the body of an email.
+func (t *Templates) RenderString(app core.App, name string, data map[string]any) (string, error) {
+	body := bytes.Buffer{}
+	if err := t.Render(app, &body, name, data); err != nil {
+		return "", err
+	}
+	return body.String(), nil
+}
+
+// WritePage responds with the rendered page, rendered before anything is
+// sent so that a failure still gets a proper error response.
+func WritePage(e *core.RequestEvent, app core.App, status int, name string, data map[string]any) error {
+	body, err := Views.RenderString(app, path.Join("pages", name), data)
+	if err != nil {
+		return WriteError(e, err, "error rendering page")
+	}
+	return e.HTML(status, body)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// TenantHeader picks the tenant of a request by slug, taking precedence
+// over the subdomain.
+const TenantHeader = "X-Tenant"
+
+const tenantRequestKey = "tenantId"
+
+var (
+	ErrTenantNotFound = errors.New("tenant not found")
+	ErrTenantMismatch = errors.New("user belongs to another tenant")
+)
+
+type Tenant struct {
+	Id      string `db:"id" json:"id"`
+	Name    string `db:"name" json:"name"`
+	Slug    string `db:"slug" json:"slug"`
+	Created string `db:"created" json:"created"`
+	Updated string `db:"updated" json:"updated"`
+}
+
+var Tenants = NewRepository[Tenant]("tenants")
+
+// tenantApp limits the repositories with a TenantColumn to a tenant, ""
+// being the default workspace of the users without one.
+type tenantApp struct {
+	core.App
+	tenantId string
+}
+
+func WithTenant(app core.App, tenantId string) core.App {
+	return &tenantApp{App: app, tenantId: tenantId}
+}
+
+// TenantOf returns the tenant app was scoped to with WithTenant. The apps
+// that weren't, e.g. of the cron tasks, see every tenant.
+func TenantOf(app core.App) (string, bool) {
+	for {
+		switch a := app.(type) {
+		case *tenantApp:
+			return a.tenantId, true
+		case *tracedApp:
+			app = a.App
+		case *readApp:
+			app = a.App
+		default:
+			return "", false
+		}
+	}
+}
+
+// SetRecordTenant makes the users record part of the tenant app is scoped
+// to, for the users saved as records rather than through Users.
+func SetRecordTenant(app core.App, record *core.Record) {
+	if tenantId, ok := Users.tenant(app); ok {
+		record.Set(Users.TenantColumn, tenantId)
+	}
+}
+
+// InRecordTenant reports whether the users record is part of the tenant
+// app is scoped to, if any.
+func InRecordTenant(app core.App, record *core.Record) bool {
+	tenantId, ok := Users.tenant(app)
+	return !ok || record.GetString(Users.TenantColumn) == tenantId
+}
+
+// TenantSlug returns the slug of the tenant a request is for, from the
+// X-Tenant header or else the subdomain of baseDomain it was sent to.
+func TenantSlug(r *http.Request, baseDomain string) string {
+	if slug := strings.TrimSpace(r.Header.Get(TenantHeader)); slug != "" {
+		return strings.ToLower(slug)
+	}
+	if baseDomain == "" {
+		return ""
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	sub, ok := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(baseDomain))
+	if !ok || sub == "" || strings.Contains(sub, ".") {
+		return ""
+	}
+	return sub
+}
+
+// ResolveTenant resolves the tenant of the requests to the custom routes,
+// see TenantSlug, which WithTrace then scopes the storage to. The requests
+// for no tenant go to the default workspace. Users can only act within
+// their own tenant.
+func ResolveTenant(app core.App, baseDomain string) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		// the PocketBase routes aren't tenant aware
+		if strings.HasPrefix(e.Request.URL.Path, "/api/") || strings.HasPrefix(e.Request.URL.Path, "/_/") {
+			return e.Next()
+		}
+
+		tenantId := ""
+		if slug := TenantSlug(e.Request, baseDomain); slug != "" {
+			tenant, err := Tenants.FindOne(app, dbx.HashExp{"slug": slug})
+			if errors.Is(err, sql.ErrNoRows) {
+				return WriteNotFound(e, ErrTenantNotFound.Error(), nil)
+			}
+			if err != nil {
+				return WriteInternalServerError(e, "error getting tenant: "+err.Error(), nil)
+			}
+			tenantId = tenant.Id
+		}
+		if e.Auth != nil && e.Auth.Collection().Name == Users.Table && e.Auth.GetString(Users.TenantColumn) != tenantId {
+			return WriteForbidden(e, ErrTenantMismatch.Error(), nil)
+		}
+		e.Set(tenantRequestKey, tenantId)
+		return e.Next()
+	}
+}
+
+// RequestTenant returns the tenant ResolveTenant resolved for the request,
+// ok is false for the requests it skipped.
+func RequestTenant(e *core.RequestEvent) (string, bool) {
+	tenantId, ok := e.Get(tenantRequestKey).(string)
+	return tenantId, ok
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// ParseRouteTimeout parses a "METHOD /pattern=duration" entry of
+// ROUTE_TIMEOUTS, 0 leaving the route without a deadline.
+func ParseRouteTimeout(s string) (string, time.Duration, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid route timeout %q, expected METHOD /pattern=duration", s)
+	}
+	pattern := strings.TrimSpace(s[:i])
+	timeout, err := time.ParseDuration(strings.TrimSpace(s[i+1:]))
+	if err != nil || timeout < 0 || !strings.Contains(pattern, " /") {
+		return "", 0, fmt.Errorf("invalid route timeout %q, expected METHOD /pattern=duration", s)
+	}
+	return pattern, timeout, nil
+}
+
+// Timeout gives the custom routes RequestTimeout, or the timeout of their
+// entry of RouteTimeouts, to complete. The deadline reaches the storage
+// functions through WithTrace, where it cancels the running statements,
+// and the routes that didn't respond by then get a 504.
+func Timeout(cfg *Config) func(e *core.RequestEvent) error {
+	timeouts := map[string]time.Duration{}
+	for _, s := range cfg.RouteTimeouts {
+		pattern, timeout, _ := ParseRouteTimeout(s)
+		timeouts[pattern] = timeout
+	}
+	return func(e *core.RequestEvent) error {
+		if IsPocketBasePath(e.Request.URL.Path) {
+			return e.Next()
+		}
+		timeout, ok := timeouts[e.Request.Pattern]
+		if !ok {
+			timeout = cfg.RequestTimeout
+		}
+		if timeout <= 0 {
+			return e.Next()
+		}
+
+		ctx, cancel := context.WithTimeout(e.Request.Context(), timeout)
+		defer cancel()
+		e.Request = e.Request.WithContext(ctx)
+
+		err := e.Next()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && !e.Written() {
+			return writeDeadlineExceeded(e)
+		}
+		return err
+	}
+}
+
+// deadlineExceeded reports whether the request ran out of time, which
+// makes its failures 504s.
+func deadlineExceeded(e *core.RequestEvent) bool {
+	return errors.Is(e.Request.Context().Err(), context.DeadlineExceeded)
+}
+
+func writeDeadlineExceeded(e *core.RequestEvent) error {
+	return WriteErrorCode(e, CodeDeadlineExceeded, "request timed out", nil)
+}
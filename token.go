@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errTokenInvalid = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+)
+
+// signUserToken returns a token of the form
+// base64(userId:expiry:value).base64(hmac). The purpose is part of the
+// signature, so that a token can't be used in place of another kind.
+func signUserToken(secret []byte, purpose string, userId string, value string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(userId + ":" + strconv.FormatInt(expires.Unix(), 10) + ":" + value))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(userTokenMAC(secret, purpose, payload))
+}
+
+// verifyUserToken checks the token signature and expiry and returns the
+// user id and value it was issued for.
+func verifyUserToken(secret []byte, purpose string, token string, now time.Time) (string, string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", errTokenInvalid
+	}
+	rawSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(rawSig, userTokenMAC(secret, purpose, payload)) {
+		return "", "", errTokenInvalid
+	}
+	rawPayload, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", errTokenInvalid
+	}
+	parts := strings.SplitN(string(rawPayload), ":", 3)
+	if len(parts) != 3 {
+		return "", "", errTokenInvalid
+	}
+	expUnix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", "", errTokenInvalid
+	}
+	if now.After(time.Unix(expUnix, 0)) {
+		return "", "", errTokenExpired
+	}
+	return parts[0], parts[2], nil
+}
+
+func userTokenMAC(secret []byte, purpose string, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose + ":" + payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Span kinds and status codes as defined by the OTLP protocol.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+
+	spanStatusOk    = 1
+	spanStatusError = 2
+)
+
+const (
+	tracerFlushInterval = 5 * time.Second
+	tracerBatchSize     = 512
+	tracerMaxPending    = 8192
+)
+
+// Tracing is the tracer used by the route and storage spans. It is nil
+// unless OTEL_EXPORTER_OTLP_ENDPOINT is set, in which case every span
+// function returns early without allocating.
+var Tracing *Tracer
+
+// Tracer batches finished spans and exports them to an OTLP/HTTP collector
+// using the JSON encoding.
+type Tracer struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+
+	mu      sync.Mutex
+	pending []*Span
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func NewTracer(endpoint string, serviceName string) *Tracer {
+	t := &Tracer{
+		endpoint:    strings.TrimRight(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      Downstream.Client(DependencyTracing, 10*time.Second),
+		flush:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.loop()
+	return t
+}
+
+func (t *Tracer) loop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(tracerFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flush:
+		case <-t.done:
+			return
+		}
+		t.export(context.Background())
+	}
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	// drop spans rather than growing unbounded when the collector is down
+	if len(t.pending) < tracerMaxPending {
+		t.pending = append(t.pending, s)
+	}
+	full := len(t.pending) >= tracerBatchSize
+	t.mu.Unlock()
+
+	if full {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) export(ctx context.Context) error {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(newOTLPTraces(t.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("otlp export failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Shutdown stops the background exporter and flushes the remaining spans.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	close(t.done)
+	t.wg.Wait()
+	return t.export(ctx)
+}
+
+type SpanContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	Sampled bool
+}
+
+// ParseTraceparent parses a W3C traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if n, err := hex.Decode(sc.TraceId[:], []byte(parts[1])); err != nil || n != 16 || sc.TraceId == [16]byte{} {
+		return sc, false
+	}
+	if n, err := hex.Decode(sc.SpanId[:], []byte(parts[2])); err != nil || n != 8 || sc.SpanId == [8]byte{} {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags&1 == 1
+	return sc, true
+}
+
+type spanContextKey struct{}
+
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+func SpanContextFrom(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+type spanAttr struct {
+	key   string
+	value any
+}
+
+// Span is a single timed operation. All its methods are no-ops on a nil
+// span, which is what StartSpan returns when tracing is disabled.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	kind     int
+	ctx      SpanContext
+	parentId [8]byte
+	start    time.Time
+	attrs    []spanAttr
+	err      string
+	status   int
+	end      time.Time
+}
+
+// StartSpan starts a span as a child of the span context in ctx, if any,
+// and returns a context carrying the new span.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if Tracing == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	s := &Span{tracer: Tracing, name: name, kind: kind, start: time.Now()}
+	if parent, ok := SpanContextFrom(ctx); ok {
+		s.ctx.TraceId = parent.TraceId
+		s.parentId = parent.SpanId
+	} else {
+		rand.Read(s.ctx.TraceId[:])
+	}
+	rand.Read(s.ctx.SpanId[:])
+	s.ctx.Sampled = true
+
+	return ContextWithSpanContext(ctx, s.ctx), s
+}
+
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, spanAttr{key: key, value: value})
+}
+
+// SetError marks the span as failed without ending it.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.status = spanStatusError
+	s.err = message
+}
+
+// End finishes the span, marking it as failed when err is not nil.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.SetError(err.Error())
+	} else if s.status == 0 {
+		s.status = spanStatusOk
+	}
+	s.end = time.Now()
+	s.tracer.enqueue(s)
+}
+
+// TraceRoute wraps a route in a server span named after its pattern,
+// joining the upstream trace when the request has a traceparent header.
+func TraceRoute(pattern string) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		ctx := e.Request.Context()
+		if sc, ok := ParseTraceparent(e.Request.Header.Get("traceparent")); ok {
+			ctx = ContextWithSpanContext(ctx, sc)
+		}
+		ctx, span := StartSpan(ctx, pattern, SpanKindServer)
+		e.Request = e.Request.WithContext(ctx)
+
+		span.SetAttr("http.request.method", e.Request.Method)
+		span.SetAttr("http.route", pattern)
+		if e.Auth != nil {
+			span.SetAttr("enduser.id", e.Auth.Id)
+		}
+
+		err := e.Next()
+
+		status := e.Status()
+		span.SetAttr("http.response.status_code", status)
+		if err == nil && status >= http.StatusInternalServerError {
+			span.SetError(http.StatusText(status))
+		}
+		span.End(err)
+		return err
+	}
+}
+
+// tracedApp carries the request context, with its span and deadline, down
+// to the storage functions, which only receive a core.App.
+type tracedApp struct {
+	core.App
+	ctx context.Context
+}
+
+// DB binds the queries to the request, so that they are traced (see
+// TraceQueries) and canceled with it, e.g. past its Timeout. The statements
+// of the transactions aren't.
+func (t *tracedApp) DB() dbx.Builder {
+	if db, ok := t.App.DB().(*dbx.DB); ok {
+		return db.WithContext(t.ctx)
+	}
+	return t.App.DB()
+}
+
+func (t *tracedApp) NonconcurrentDB() dbx.Builder {
+	if db, ok := t.App.NonconcurrentDB().(*dbx.DB); ok {
+		return db.WithContext(t.ctx)
+	}
+	return t.App.NonconcurrentDB()
+}
+
+// WithTrace returns app bound to the tenant and the context of the
+// request, with its span and deadline, reading through the connection of
+// the read mode of its route.
+func WithTrace(app core.App, e *core.RequestEvent) core.App {
+	if tenantId, ok := RequestTenant(e); ok {
+		app = WithTenant(app, tenantId)
+	}
+	app = withReadMode(app, e)
+	return &tracedApp{App: app, ctx: e.Request.Context()}
+}
+
+// StartStorageSpan starts a span for the storage function name, as a child
+// of the request span when app was bound with WithTrace.
+func StartStorageSpan(app core.App, name string, operation string) *Span {
+	if Tracing == nil {
+		return nil
+	}
+	var ctx context.Context
+	if t, ok := app.(*tracedApp); ok {
+		ctx = t.ctx
+	}
+	_, span := StartSpan(ctx, name, SpanKindInternal)
+	span.SetAttr("db.system", "sqlite")
+	span.SetAttr("db.operation.name", operation)
+	return span
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func newOTLPKeyValue(key string, value any) otlpKeyValue {
+	switch v := value.(type) {
+	case int:
+		return otlpKeyValue{Key: key, Value: map[string]any{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpKeyValue{Key: key, Value: map[string]any{"intValue": strconv.FormatInt(v, 10)}}
+	case bool:
+		return otlpKeyValue{Key: key, Value: map[string]any{"boolValue": v}}
+	case float64:
+		return otlpKeyValue{Key: key, Value: map[string]any{"doubleValue": v}}
+	default:
+		return otlpKeyValue{Key: key, Value: map[string]any{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+func newOTLPTraces(serviceName string, spans []*Span) otlpTraces {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceId:           hex.EncodeToString(s.ctx.TraceId[:]),
+			SpanId:            hex.EncodeToString(s.ctx.SpanId[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: s.status, Message: s.err},
+		}
+		if s.parentId != [8]byte{} {
+			span.ParentSpanId = hex.EncodeToString(s.parentId[:])
+		}
+		for _, attr := range s.attrs {
+			span.Attributes = append(span.Attributes, newOTLPKeyValue(attr.key, attr.value))
+		}
+		out = append(out, span)
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{newOTLPKeyValue("service.name", serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/EricFrancis12/pocketbase-demo"},
+			Spans: out,
+		}},
+	}}}
+}
+
+var (
+	sqlStringLiteral = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlNumber        = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+)
+
+// SanitizeSQL masks the literals of statement, which dbx logs with the
+// values of its parameters, so that the spans carry no personal data.
+func SanitizeSQL(statement string) string {
+	statement = sqlStringLiteral.ReplaceAllString(statement, "?")
+	return sqlNumber.ReplaceAllString(statement, "?")
+}
+
+// TraceQueries adds a client span for every SQL statement run through a
+// WithTrace app, as a child of the request span. The statements run
+// outside of a request aren't traced.
+func TraceQueries(app core.App) {
+	for _, builder := range []dbx.Builder{app.DB(), app.NonconcurrentDB()} {
+		db, ok := builder.(*dbx.DB)
+		if !ok {
+			continue
+		}
+		queryLog, execLog := db.QueryLogFunc, db.ExecLogFunc
+		db.QueryLogFunc = func(ctx context.Context, t time.Duration, statement string, rows *sql.Rows, err error) {
+			traceStatement(ctx, t, statement, err)
+			if queryLog != nil {
+				queryLog(ctx, t, statement, rows, err)
+			}
+		}
+		db.ExecLogFunc = func(ctx context.Context, t time.Duration, statement string, result sql.Result, err error) {
+			traceStatement(ctx, t, statement, err)
+			if execLog != nil {
+				execLog(ctx, t, statement, result, err)
+			}
+		}
+	}
+}
+
+func traceStatement(ctx context.Context, took time.Duration, statement string, err error) {
+	if ctx == nil {
+		return
+	}
+	if _, ok := SpanContextFrom(ctx); !ok {
+		return
+	}
+	operation, _, _ := strings.Cut(strings.TrimSpace(statement), " ")
+	operation = strings.ToUpper(operation)
+	_, span := StartSpan(ctx, operation, SpanKindClient)
+	if span == nil {
+		return
+	}
+	span.start = time.Now().Add(-took)
+	span.SetAttr("db.system", "sqlite")
+	span.SetAttr("db.operation.name", operation)
+	span.SetAttr("db.query.text", SanitizeSQL(statement))
+	span.End(err)
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// TOTP parameters of RFC 6238, the defaults of the authenticator apps.
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30
+	// TOTPSkew is the number of steps accepted on each side of the current
+	// one, to allow for clock drift.
+	TOTPSkew = 1
+)
+
+const (
+	BackupCodeCount = 10
+	// TwoFactorChallengeTTL is how long a login waits for its second factor.
+	TwoFactorChallengeTTL = 5 * time.Minute
+	// TwoFactorSessionHeader carries the twoFactorSession of the
+	// AuthResponse to the routes behind Require2FA.
+	TwoFactorSessionHeader = "X-2FA-Session"
+)
+
+const backupCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var (
+	ErrTwoFactorEnabled          = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled       = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotEnrolled      = errors.New("two-factor authentication is not enrolled, POST /users/{userId}/2fa first")
+	ErrTwoFactorCodeInvalid      = errors.New("invalid two-factor code")
+	ErrTwoFactorChallengeInvalid = errors.New("invalid or expired two-factor challenge")
+)
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// provisioning URI, to be shown as a QR code.
+	URI string `json:"uri"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type TwoFactorVerifyRequest struct {
+	// Token is the twoFactorToken returned by the login.
+	Token string `json:"token" binding:"required"`
+	Code  string `json:"code" binding:"required"`
+}
+
+// BackupCodes are only ever returned when generated, only their hashes are
+// stored.
+type BackupCodes struct {
+	Codes []string `json:"codes"`
+}
+
+func NewTOTPSecret() string {
+	key := make([]byte, 20)
+	rand.Read(key)
+	return totpEncoding.EncodeToString(key)
+}
+
+// TOTPCode returns the code of the secret for the given time step.
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for range TOTPDigits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod), nil
+}
+
+// MatchTOTP returns the time step code is valid for at now, ignoring the
+// steps up to lastStep that were already used.
+func MatchTOTP(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	current := now.Unix() / TOTPPeriod
+	for step := current - TOTPSkew; step <= current+TOTPSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func TOTPProvisioningURI(issuer string, account string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("digits", strconv.Itoa(TOTPDigits))
+	query.Set("period", strconv.Itoa(TOTPPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode()
+}
+
+func hashBackupCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func findTOTP(app core.App, userId string) (*core.Record, error) {
+	return app.FindFirstRecordByData("user_totp", "user", userId)
+}
+
+// TwoFactorEnabled reports whether the user confirmed a TOTP enrollment.
+func TwoFactorEnabled(app core.App, userId string) (bool, error) {
+	record, err := findTOTP(app, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return record.GetBool("enabled"), nil
+}
+
+// EnrollTOTP stores a new secret for the user, which is only enabled once
+// a code of it is confirmed with ConfirmTOTP.
+func EnrollTOTP(app core.App, userId string) (string, error) {
+	secret := NewTOTPSecret()
+	err := WithTx(app, func(txApp core.App) error {
+		record, err := findTOTP(txApp, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			collection, err := txApp.FindCachedCollectionByNameOrId("user_totp")
+			if err != nil {
+				return err
+			}
+			record = core.NewRecord(collection)
+			record.Set("user", userId)
+		} else if err != nil {
+			return err
+		} else if record.GetBool("enabled") {
+			return ErrTwoFactorEnabled
+		}
+		record.Set("secret", secret)
+		record.Set("last_step", 0)
+		return txApp.Save(record)
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// ConfirmTOTP enables the enrolled secret if code matches it and returns a
+// fresh set of backup codes.
+func ConfirmTOTP(app core.App, userId string, code string) ([]string, error) {
+	var codes []string
+	err := WithTx(app, func(txApp core.App) error {
+		record, err := findTOTP(txApp, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTwoFactorNotEnrolled
+		}
+		if err != nil {
+			return err
+		}
+		if record.GetBool("enabled") {
+			return ErrTwoFactorEnabled
+		}
+		step, ok := MatchTOTP(record.GetString("secret"), code, time.Now(), 0)
+		if !ok {
+			return ErrTwoFactorCodeInvalid
+		}
+		record.Set("enabled", true)
+		record.Set("last_step", step)
+		if err := txApp.Save(record); err != nil {
+			return err
+		}
+		codes, err = replaceBackupCodes(txApp, userId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifyTwoFactorCode accepts either a TOTP code or an unused backup code,
+// which is then spent.
+func VerifyTwoFactorCode(app core.App, userId string, code string) error {
+	return WithTx(app, func(txApp core.App) error {
+		record, err := findTOTP(txApp, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTwoFactorNotEnabled
+		}
+		if err != nil {
+			return err
+		}
+		if !record.GetBool("enabled") {
+			return ErrTwoFactorNotEnabled
+		}
+
+		if step, ok := MatchTOTP(record.GetString("secret"), code, time.Now(), int64(record.GetInt("last_step"))); ok {
+			record.Set("last_step", step)
+			return txApp.Save(record)
+		}
+
+		backupCode, err := txApp.FindFirstRecordByFilter(
+			"user_backup_codes",
+			"user = {:user} && code_hash = {:hash}",
+			dbx.Params{"user": userId, "hash": hashBackupCode(code)},
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTwoFactorCodeInvalid
+		}
+		if err != nil {
+			return err
+		}
+		return txApp.Delete(backupCode)
+	})
+}
+
+// DisableTOTP removes the secret and the backup codes of the user.
+func DisableTOTP(app core.App, userId string) error {
+	return WithTx(app, func(txApp core.App) error {
+		record, err := findTOTP(txApp, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTwoFactorNotEnabled
+		}
+		if err != nil {
+			return err
+		}
+		if err := txApp.Delete(record); err != nil {
+			return err
+		}
+		_, err = txApp.DB().Delete("user_backup_codes", dbx.HashExp{"user": userId}).Execute()
+		return err
+	})
+}
+
+// RegenerateBackupCodes replaces the backup codes of a user with 2FA
+// enabled.
+func RegenerateBackupCodes(app core.App, userId string) ([]string, error) {
+	var codes []string
+	err := WithTx(app, func(txApp core.App) error {
+		enabled, err := TwoFactorEnabled(txApp, userId)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			return ErrTwoFactorNotEnabled
+		}
+		codes, err = replaceBackupCodes(txApp, userId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func replaceBackupCodes(txApp core.App, userId string) ([]string, error) {
+	if _, err := txApp.DB().Delete("user_backup_codes", dbx.HashExp{"user": userId}).Execute(); err != nil {
+		return nil, err
+	}
+	collection, err := txApp.FindCachedCollectionByNameOrId("user_backup_codes")
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, BackupCodeCount)
+	for i := range codes {
+		raw := security.RandomStringWithAlphabet(10, backupCodeAlphabet)
+		codes[i] = raw[:5] + "-" + raw[5:]
+		record := core.NewRecord(collection)
+		record.Set("user", userId)
+		record.Set("code_hash", hashBackupCode(codes[i]))
+		if err := txApp.Save(record); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// The challenge and session tokens are bound to the tokenKey of the user,
+// so that they stop working along with the auth tokens, e.g. on a password
+// change.
+
+func SignTwoFactorChallenge(secret []byte, record *core.Record, expires time.Time) string {
+	return signUserToken(secret, "2fa-challenge", record.Id, record.TokenKey(), expires)
+}
+
+func SignTwoFactorSession(secret []byte, record *core.Record, expires time.Time) string {
+	return signUserToken(secret, "2fa-session", record.Id, record.TokenKey(), expires)
+}
+
+// VerifyTwoFactorSession reports whether token is a valid 2FA session of
+// the auth record.
+func VerifyTwoFactorSession(secret []byte, record *core.Record, token string, now time.Time) bool {
+	userId, tokenKey, err := verifyUserToken(secret, "2fa-session", token, now)
+	return err == nil && userId == record.Id && tokenKey == record.TokenKey()
+}
+
+// Require2FA rejects the requests of users with 2FA enabled that don't
+// carry a valid TwoFactorSessionHeader. It must be bound after the auth
+// middleware of the route. Superusers, API keys and users without 2FA go
+// through.
+func Require2FA(app core.App, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if e.Auth == nil || e.HasSuperuserAuth() {
+			return e.Next()
+		}
+		enabled, err := TwoFactorEnabled(app, e.Auth.Id)
+		if err != nil {
+			return WriteInternalServerError(e, "error checking two-factor authentication: "+err.Error(), nil)
+		}
+		if enabled && !VerifyTwoFactorSession([]byte(cfg.TwoFactorSecret), e.Auth, e.Request.Header.Get(TwoFactorSessionHeader), time.Now()) {
+			return WriteErrorCode(e, CodeTwoFactorRequired, "two-factor verification required", nil)
+		}
+		return e.Next()
+	}
+}
+
+// writeAuthResponse completes a login: users with 2FA enabled get a
+// challenge to pass to POST /auth/2fa instead of the auth token.
+func writeAuthResponse(app core.App, cfg *Config, e *core.RequestEvent, record *core.Record) error {
+	if IsLocked(record) {
+		return WriteErrorCode(e, CodeUserLocked, ErrUserLocked.Error(), nil)
+	}
+	enabled, err := TwoFactorEnabled(app, record.Id)
+	if err != nil {
+		return WriteInternalServerError(e, "error checking two-factor authentication: "+err.Error(), nil)
+	}
+	if enabled {
+		token := SignTwoFactorChallenge([]byte(cfg.TwoFactorSecret), record, time.Now().Add(TwoFactorChallengeTTL))
+		return WriteOK(e, "two-factor code required", &models.AuthResponse{TwoFactorToken: token})
+	}
+
+	// the accounts with 2FA enabled are only cleared once it is verified
+	Throttle.Succeed(AuthAccountKey(record.Email()))
+	CountLogin(app, record.Id)
+	resp, err := NewAuthResponse(app, e, record)
+	if err != nil {
+		return WriteError(e, err, "error issuing token")
+	}
+	return WriteOK(e, "", resp)
+}
+
+// BindTwoFactorHooks answers the built-in auth-with-password, OAuth2 and
+// OTP endpoints of the users collection as writeAuthResponse does: the
+// users with 2FA enabled get a challenge instead of the auth token.
+// auth-refresh goes through, its token having passed the second factor.
+func BindTwoFactorHooks(app core.App, cfg *Config) {
+	app.OnRecordAuthRequest(Users.Table).BindFunc(func(e *core.RecordAuthRequestEvent) error {
+		if e.AuthMethod == "" {
+			return e.Next()
+		}
+		enabled, err := TwoFactorEnabled(e.App, e.Record.Id)
+		if err != nil {
+			return WriteInternalServerError(e.RequestEvent, "error checking two-factor authentication: "+err.Error(), nil)
+		}
+		if !enabled {
+			return e.Next()
+		}
+		token := SignTwoFactorChallenge([]byte(cfg.TwoFactorSecret), e.Record, time.Now().Add(TwoFactorChallengeTTL))
+		return WriteOK(e.RequestEvent, "two-factor code required", &models.AuthResponse{TwoFactorToken: token})
+	})
+}
+
+func writeTwoFactorError(e *core.RequestEvent, err error) error {
+	return WriteError(e, err, "error updating two-factor authentication")
+}
+
+func HandleEnrollTOTP(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		user, err := GetUserById(app, e.Request.PathValue("userId"))
+		if errors.Is(err, sql.ErrNoRows) {
+			return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+		secret, err := EnrollTOTP(app, user.Id)
+		if err != nil {
+			return writeTwoFactorError(e, err)
+		}
+		return WriteOK(e, "", TOTPEnrollment{
+			Secret: secret,
+			URI:    TOTPProvisioningURI(app.Settings().Meta.AppName, user.Email, secret),
+		})
+	}
+}
+
+func HandleConfirmTOTP(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	limiter := NewRateLimiter(5, TwoFactorChallengeTTL)
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		userId := e.Request.PathValue("userId")
+		req := TwoFactorCodeRequest{}
+		if err := BindStrict(e, &req); err != nil {
+			return WriteBindError(e, err)
+		}
+		if ok, _ := limiter.Allow(userId, time.Now()); !ok {
+			return WriteTooManyRequests(e, "too many two-factor attempts, try again later", nil)
+		}
+		codes, err := ConfirmTOTP(app, userId, req.Code)
+		if err != nil {
+			return writeTwoFactorError(e, err)
+		}
+		return WriteOK(e, "", BackupCodes{Codes: codes})
+	}
+}
+
+func HandleDisableTOTP(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		if err := DisableTOTP(app, e.Request.PathValue("userId")); err != nil {
+			return writeTwoFactorError(e, err)
+		}
+		return WriteOK(e, "", nil)
+	}
+}
+
+func HandleRegenerateBackupCodes(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		codes, err := RegenerateBackupCodes(app, e.Request.PathValue("userId"))
+		if err != nil {
+			return writeTwoFactorError(e, err)
+		}
+		return WriteOK(e, "", BackupCodes{Codes: codes})
+	}
+}
+
+// HandleVerifyTwoFactor completes a login of a user with 2FA enabled,
+// responding with the auth token and a 2FA session.
+func HandleVerifyTwoFactor(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	limiter := NewRateLimiter(5, TwoFactorChallengeTTL)
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		req := TwoFactorVerifyRequest{}
+		if err := BindStrict(e, &req); err != nil {
+			return WriteBindError(e, err)
+		}
+		userId, tokenKey, err := verifyUserToken([]byte(cfg.TwoFactorSecret), "2fa-challenge", req.Token, time.Now())
+		if err != nil {
+			return WriteError(e, ErrTwoFactorChallengeInvalid, "error verifying two-factor challenge")
+		}
+		record, err := app.FindRecordById(Users.Table, userId)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && record.TokenKey() != tokenKey) {
+			return WriteError(e, ErrTwoFactorChallengeInvalid, "error verifying two-factor challenge")
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+		if ok, _ := limiter.Allow(userId, time.Now()); !ok {
+			return WriteTooManyRequests(e, "too many two-factor attempts, try again later", nil)
+		}
+		keys := []string{AuthIPKey(e.RealIP()), AuthAccountKey(record.Email())}
+		if retryAfter, err := Throttle.Check(e, keys...); err != nil {
+			return writeAuthThrottleError(e, retryAfter, err)
+		}
+
+		if err := VerifyTwoFactorCode(app, userId, req.Code); err != nil {
+			if errors.Is(err, ErrTwoFactorCodeInvalid) {
+				Throttle.Fail(keys...)
+			}
+			return writeTwoFactorError(e, err)
+		}
+		SetAuditedUser(e, userId)
+		Throttle.Succeed(AuthAccountKey(record.Email()))
+
+		CountLogin(app, userId)
+		resp, err := NewAuthResponse(app, e, record)
+		if err != nil {
+			return WriteError(e, err, "error issuing token")
+		}
+		resp.TwoFactorSession = SignTwoFactorSession([]byte(cfg.TwoFactorSecret), record, time.Now().Add(cfg.TwoFactorSessionTTL))
+		return WriteOK(e, "", resp)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+)
+
+// enableTestTwoFactor enrolls and confirms a TOTP secret for the user,
+// returning its backup codes.
+func enableTestTwoFactor(t testing.TB, s *testServer, userId string) []string {
+	t.Helper()
+	secret, err := EnrollTOTP(s.App, userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := TOTPCode(secret, time.Now().Unix()/TOTPPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := ConfirmTOTP(s.App, userId, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codes
+}
+
+// TestAuthWithPasswordTwoFactor checks that the built-in auth-with-password
+// endpoint only gives the users with 2FA enabled a challenge, which POST
+// /auth/2fa then exchanges for the auth token.
+func TestAuthWithPasswordTwoFactor(t *testing.T) {
+	s := newTestServer(t, nil)
+	user := s.Users[0]
+	codes := enableTestTwoFactor(t, s, user.Id)
+
+	res, body := s.do(t, http.MethodPost, "/api/collections/users/auth-with-password", "", map[string]string{
+		"identity": user.Email,
+		"password": testUserPassword,
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.StatusCode, body)
+	}
+	if strings.Contains(string(body), `"token"`) {
+		t.Fatalf("expected no auth token, got %s", body)
+	}
+	challenge := models.AuthResponse{}
+	decodeData(t, checkAPIResp(t, res.StatusCode, body), &challenge)
+	if challenge.TwoFactorToken == "" || challenge.Token != "" {
+		t.Fatalf("expected a two-factor challenge, got %s", body)
+	}
+
+	res, body = s.do(t, http.MethodPost, "/auth/2fa", "", TwoFactorVerifyRequest{Token: challenge.TwoFactorToken, Code: codes[0]})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.StatusCode, body)
+	}
+	auth := models.AuthResponse{}
+	decodeData(t, checkAPIResp(t, res.StatusCode, body), &auth)
+	if auth.Token == "" || auth.TwoFactorSession == "" {
+		t.Errorf("expected the auth token and a 2FA session, got %s", body)
+	}
+
+	// the users without 2FA still get their token
+	if id := s.authWithPassword(t, s.Users[1].Email, testUserPassword); id != s.Users[1].Id {
+		t.Errorf("expected to log in as %s, got %q", s.Users[1].Id, id)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "github.com/pocketbase/pocketbase/core"
+
+// WithTx runs fn in a transaction that is retried as a whole while the
+// database is busy. The storage functions called with txApp take part in
+// the transaction, so that handlers can compose several of them atomically.
+// When app is already a transaction fn simply joins it.
+func WithTx(app core.App, fn func(txApp core.App) error) error {
+	if app.IsTransactional() {
+		return fn(app)
+	}
+	return RetryOnBusy(WriteRetryOptions, func() error {
+		return app.RunInTransaction(func(txApp core.App) error {
+			return fn(rebind(app, txApp))
+		})
+	})
+}
+
+// rebind gives txApp the tenant and the span app was bound to, which
+// RunInTransaction doesn't carry over.
+func rebind(app core.App, txApp core.App) core.App {
+	if tenantId, ok := TenantOf(app); ok {
+		txApp = WithTenant(txApp, tenantId)
+	}
+	if t, ok := app.(*tracedApp); ok {
+		txApp = &tracedApp{App: txApp, ctx: t.ctx}
+	}
+	return txApp
+}
+
+// RetryWrite retries fn while the database is busy, except inside a
+// transaction where a single statement can't be retried on its own and the
+// whole transaction is retried by WithTx instead.
+func RetryWrite(app core.App, fn func() error) error {
+	if app.IsTransactional() {
+		return fn()
+	}
+	return RetryOnBusy(WriteRetryOptions, fn)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// upsertUserSQL inserts the user or updates the one with the email in a
+// single statement, so that concurrent upserts can't both insert. The soft
+// deleted users and the ones of other tenants aren't updated, which returns
+// no row.
+const upsertUserSQL = "INSERT INTO {{users}} ([[email]], [[emailVisibility]], [[name]], [[tenant_id]], [[created]], [[updated]]) " +
+	"VALUES ({:email}, {:emailVisibility}, {:name}, {:tenant}, {:now}, {:now}) " +
+	"ON CONFLICT ([[email]]) WHERE [[email]] != '' DO UPDATE SET " +
+	"[[emailVisibility]] = excluded.[[emailVisibility]], [[name]] = excluded.[[name]], [[updated]] = excluded.[[updated]] " +
+	"WHERE [[deleted_at]] = '' AND [[tenant_id]] = excluded.[[tenant_id]] " +
+	"RETURNING [[id]], [[created]]"
+
+// UpsertUser creates the user with the email of ur or replaces the fields
+// of the existing one, reporting whether it was created. The email of a
+// deleted user, or of a user of another tenant, is ErrEmailTaken.
+func UpsertUser(app core.App, ur models.UserUpsertRequest, now time.Time) (*models.User, bool, error) {
+	err := ValidateUserCreationRequest(models.UserCreationRequest{Email: ur.Email, EmailVisibility: ur.EmailVisibility, Name: ur.Name})
+	if err != nil {
+		return nil, false, err
+	}
+	at, err := types.ParseDateTime(now)
+	if err != nil {
+		return nil, false, err
+	}
+	tenantId, _ := TenantOf(app)
+
+	span := StartStorageSpan(app, "UpsertUser", "INSERT")
+	row := struct {
+		Id      string `db:"id"`
+		Created string `db:"created"`
+	}{}
+	err = RetryWrite(app, func() error {
+		return app.NonconcurrentDB().NewQuery(upsertUserSQL).Bind(dbx.Params{
+			"email":           ur.Email,
+			"emailVisibility": ur.EmailVisibility,
+			"name":            ur.Name,
+			"tenant":          tenantId,
+			"now":             at.String(),
+		}).One(&row)
+	})
+	span.End(err)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, ErrEmailTaken
+	}
+	if err != nil {
+		return nil, false, Users.uniqueError(err)
+	}
+	Users.written()
+
+	user, err := GetUserById(app, row.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	return user, row.Created == at.String(), nil
+}
+
+// HandleUpsertUser creates or replaces the user with the email of the body,
+// responding with 201 or 200, safe to retry.
+func HandleUpsertUser(app *pocketbase.PocketBase) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		ur := models.UserUpsertRequest{}
+		if err := BindStrict(e, &ur); err != nil {
+			return WriteBindError(e, err)
+		}
+		verdict := ScreenRequest(app, e, map[string]string{"name": ur.Name})
+		if len(verdict.Rejected) > 0 {
+			return WriteErrorCode(e, CodeContentRejected, "invalid user", verdict.Rejected)
+		}
+		var user *models.User
+		var created bool
+		err := WithTx(app, func(txApp core.App) error {
+			var err error
+			if user, created, err = UpsertUser(txApp, ur, time.Now()); err != nil {
+				return err
+			}
+			event := EventUserUpdated
+			if created {
+				event = EventUserCreated
+			}
+			return QueueUserEvent(txApp, event, user)
+		})
+		if errors.Is(err, ErrEmailTaken) {
+			return WriteErrorCode(e, CodeEmailTaken, err.Error(), map[string]string{"email": err.Error()})
+		}
+		var validationErrs validation.Errors
+		if errors.As(err, &validationErrs) {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid user", validationErrs)
+		}
+		if err != nil {
+			return WriteError(e, err, "error upserting user")
+		}
+		SetAuditedUser(e, user.Id)
+		flagForReview(app, Users.Table, user.Id, verdict)
+		if !created {
+			return WriteOK(e, "", user)
+		}
+		if err := QueueVerificationEmail(app, user.Id); err != nil {
+			app.Logger().Warn("Failed to queue verification email", "userId", user.Id, "error", err)
+		}
+		return WriteResp(e, http.StatusCreated, "", user)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// The kinds of the subjects the usage is counted for.
+const (
+	UsageKindUser   = "user"
+	UsageKindAPIKey = "api_key"
+)
+
+const (
+	usageDayLayout   = "2006-01-02"
+	usageMonthLayout = "2006-01"
+)
+
+// upsertUsageSQL adds requests to the count of the day of the subject.
+const upsertUsageSQL = "INSERT INTO {{api_usage}} ([[id]], [[kind]], [[subject]], [[day]], [[requests]], [[created]], [[updated]]) " +
+	"VALUES ({:id}, {:kind}, {:subject}, {:day}, {:requests}, {:now}, {:now}) " +
+	"ON CONFLICT ([[kind]], [[subject]], [[day]]) DO UPDATE SET " +
+	"[[requests]] = [[requests]] + excluded.[[requests]], [[updated]] = excluded.[[updated]]"
+
+var ErrInvalidUsageMonth = errors.New("invalid month, expected YYYY-MM")
+
+type UsageDay struct {
+	Day      string `db:"day" json:"day"`
+	Requests int64  `db:"requests" json:"requests"`
+}
+
+// UsageReport is the usage of a subject over a month, by day.
+type UsageReport struct {
+	Kind     string `json:"kind"`
+	Subject  string `json:"subject"`
+	Month    string `json:"month"`
+	Requests int64  `json:"requests"`
+	// Quota is USAGE_MONTHLY_QUOTA, 0 when the usage is unlimited.
+	Quota int64      `json:"quota"`
+	Days  []UsageDay `json:"days"`
+}
+
+// UsageTotal is the usage of a subject over a month, in GET /admin/usage.
+type UsageTotal struct {
+	Kind     string `db:"kind" json:"kind"`
+	Subject  string `db:"subject" json:"subject"`
+	Requests int64  `db:"requests" json:"requests"`
+}
+
+type usageKey struct {
+	kind    string
+	subject string
+	// period is the day of the pending counts and the month of the totals
+	period string
+}
+
+// Usage counts the requests of the users and API keys, nil until the
+// server starts.
+var Usage *UsageTracker
+
+// UsageTracker buffers the request counts, written to api_usage every
+// interval, and caches the totals of the current month the quotas are
+// checked against. The totals only include the requests of this process
+// since they were loaded, so that the quotas are approximate when several
+// instances share the database.
+type UsageTracker struct {
+	app core.App
+
+	mu      sync.Mutex
+	pending map[usageKey]int64
+	months  map[usageKey]int64
+	flushMu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewUsageTracker(app core.App) *UsageTracker {
+	return &UsageTracker{
+		app:     app,
+		pending: map[usageKey]int64{},
+		months:  map[usageKey]int64{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start flushes the buffered counts every interval, until Shutdown.
+func (t *UsageTracker) Start(interval time.Duration) {
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := t.Flush(); err != nil {
+					t.app.Logger().Warn("Failed to write api usage", "error", err)
+				}
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+// MonthTotal returns the requests of the subject in the month of now,
+// loaded from api_usage on the first call of the month.
+func (t *UsageTracker) MonthTotal(kind string, subject string, now time.Time) (int64, error) {
+	key := usageKey{kind: kind, subject: subject, period: now.UTC().Format(usageMonthLayout)}
+	t.mu.Lock()
+	total, ok := t.months[key]
+	t.mu.Unlock()
+	if ok {
+		return total, nil
+	}
+
+	total, err := countMonthUsage(t.app, kind, subject, now)
+	if err != nil {
+		return 0, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if current, ok := t.months[key]; ok {
+		return current, nil
+	}
+	t.months[key] = total
+	return total, nil
+}
+
+// Add counts a request of the subject at now.
+func (t *UsageTracker) Add(kind string, subject string, now time.Time) {
+	if t == nil {
+		return
+	}
+	now = now.UTC()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[usageKey{kind: kind, subject: subject, period: now.Format(usageDayLayout)}]++
+	month := usageKey{kind: kind, subject: subject, period: now.Format(usageMonthLayout)}
+	if _, ok := t.months[month]; ok {
+		t.months[month]++
+	}
+}
+
+// Flush writes the buffered counts in a single transaction, keeping them
+// for the next flush if it fails, and forgets the totals of the past
+// months.
+func (t *UsageTracker) Flush() error {
+	if t == nil {
+		return nil
+	}
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = map[usageKey]int64{}
+	month := time.Now().UTC().Format(usageMonthLayout)
+	for key := range t.months {
+		if key.period != month {
+			delete(t.months, key)
+		}
+	}
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	now := types.NowDateTime().String()
+	span := StartStorageSpan(t.app, "FlushUsage", "INSERT")
+	span.SetAttr("db.operation.batch.size", len(batch))
+	err := RetryWrite(t.app, func() error {
+		return WithTx(t.app, func(txApp core.App) error {
+			for key, requests := range batch {
+				_, err := txApp.DB().NewQuery(upsertUsageSQL).Bind(dbx.Params{
+					"id":       NewId("api_usage"),
+					"kind":     key.kind,
+					"subject":  key.subject,
+					"day":      key.period,
+					"requests": requests,
+					"now":      now,
+				}).Execute()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	span.End(err)
+	if err != nil {
+		t.mu.Lock()
+		for key, requests := range batch {
+			t.pending[key] += requests
+		}
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// Shutdown stops the periodic flushes and writes what is left.
+func (t *UsageTracker) Shutdown() error {
+	if t == nil {
+		return nil
+	}
+	close(t.stop)
+	<-t.done
+	return t.Flush()
+}
+
+// monthRange returns the first day of month and of the next one.
+func monthRange(month time.Time) (string, string) {
+	start := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start.Format(usageDayLayout), start.AddDate(0, 1, 0).Format(usageDayLayout)
+}
+
+func inMonth(month time.Time) dbx.Expression {
+	from, to := monthRange(month)
+	return dbx.NewExp("[[day]] >= {:from} AND [[day]] < {:to}", dbx.Params{"from": from, "to": to})
+}
+
+func countMonthUsage(app core.App, kind string, subject string, month time.Time) (int64, error) {
+	var total int64
+	err := app.DB().
+		Select("COALESCE(SUM([[requests]]), 0)").
+		From("api_usage").
+		Where(dbx.HashExp{"kind": kind, "subject": subject}).
+		AndWhere(inMonth(month)).
+		Row(&total)
+	return total, err
+}
+
+// GetUsageReport returns the usage of the subject in month, by day.
+func GetUsageReport(app core.App, kind string, subject string, month time.Time) (*UsageReport, error) {
+	days := []UsageDay{}
+	err := app.DB().
+		Select("day", "requests").
+		From("api_usage").
+		Where(dbx.HashExp{"kind": kind, "subject": subject}).
+		AndWhere(inMonth(month)).
+		OrderBy("day").
+		All(&days)
+	if err != nil {
+		return nil, err
+	}
+	report := &UsageReport{Kind: kind, Subject: subject, Month: month.Format(usageMonthLayout), Days: days}
+	for _, day := range days {
+		report.Requests += day.Requests
+	}
+	return report, nil
+}
+
+// GetUsageTotals returns the usage of every subject in month, the heaviest
+// first.
+func GetUsageTotals(app core.App, month time.Time, limit int) ([]UsageTotal, error) {
+	totals := []UsageTotal{}
+	err := app.DB().
+		Select("kind", "subject", "SUM([[requests]]) AS requests").
+		From("api_usage").
+		Where(inMonth(month)).
+		GroupBy("kind", "subject").
+		OrderBy("requests DESC").
+		Limit(int64(limit)).
+		All(&totals)
+	return totals, err
+}
+
+// usageSubject returns who the request counts against: its user or API
+// key. The superusers and the anonymous requests aren't counted.
+func usageSubject(e *core.RequestEvent) (string, string, bool) {
+	if e.Auth != nil {
+		if e.Auth.Collection().Name != Users.Table {
+			return "", "", false
+		}
+		return UsageKindUser, e.Auth.Id, true
+	}
+	apiKey, err := RequestAPIKey(e)
+	if err != nil || apiKey == nil {
+		return "", "", false
+	}
+	return UsageKindAPIKey, apiKey.Id, true
+}
+
+// TrackUsage counts the requests to the custom routes with Usage and,
+// when USAGE_MONTHLY_QUOTA is set, rejects those of the subjects that used
+// it up with 429 until the next month.
+func TrackUsage(cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		if Usage == nil || IsPocketBasePath(e.Request.URL.Path) {
+			return e.Next()
+		}
+		kind, subject, ok := usageSubject(e)
+		if !ok {
+			return e.Next()
+		}
+
+		now := time.Now()
+		if cfg.UsageMonthlyQuota > 0 {
+			total, err := Usage.MonthTotal(kind, subject, now)
+			if err != nil {
+				e.App.Logger().Warn("Failed to check usage quota", "kind", kind, "subject", subject, "error", err)
+			}
+			quota := int64(cfg.UsageMonthlyQuota)
+			remaining := max(quota-total, 0)
+			e.Response.Header().Set("X-Quota-Limit", strconv.FormatInt(quota, 10))
+			if err == nil && remaining == 0 {
+				e.Response.Header().Set("X-Quota-Remaining", "0")
+				return WriteErrorCode(e, CodeQuotaExceeded, "monthly request quota exceeded", nil)
+			}
+			e.Response.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining-1, 10))
+		}
+		Usage.Add(kind, subject, now)
+		return e.Next()
+	}
+}
+
+// parseUsageMonth parses the ?month of the usage routes, the current month
+// when empty.
+func parseUsageMonth(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now().UTC(), nil
+	}
+	month, err := time.Parse(usageMonthLayout, s)
+	if err != nil {
+		return time.Time{}, ErrInvalidUsageMonth
+	}
+	return month, nil
+}
+
+func HandleGetUserUsage(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		month, err := parseUsageMonth(e.Request.URL.Query().Get("month"))
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		userId := e.Request.PathValue("userId")
+		if _, err := GetUserById(app, userId); err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+		if err := Usage.Flush(); err != nil {
+			app.Logger().Warn("Failed to write api usage", "error", err)
+		}
+
+		report, err := GetUsageReport(app, UsageKindUser, userId, month)
+		if err != nil {
+			return WriteError(e, err, "error getting usage")
+		}
+		report.Quota = int64(cfg.UsageMonthlyQuota)
+		return WriteOK(e, "", report)
+	}
+}
+
+func HandleGetUsageTotals(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		query := e.Request.URL.Query()
+		month, err := parseUsageMonth(query.Get("month"))
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		limit := cfg.MaxPerPage
+		if v := query.Get("limit"); v != "" {
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > cfg.MaxPerPage {
+				return WriteBadRequest(e, "bad request: limit must be between 1 and "+strconv.Itoa(cfg.MaxPerPage), nil)
+			}
+		}
+		if err := Usage.Flush(); err != nil {
+			app.Logger().Warn("Failed to write api usage", "error", err)
+		}
+
+		totals, err := GetUsageTotals(WithTrace(app, e), month, limit)
+		if err != nil {
+			return WriteError(e, err, "error getting usage")
+		}
+		return WriteOK(e, "", totals)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+)
+
+// SetUserVerified sets the verified flag of the user, returning ErrNotFound
+// if there is no such user.
+func SetUserVerified(app core.App, userId string, verified bool) (*models.User, error) {
+	span := StartStorageSpan(app, "SetUserVerified", "UPDATE")
+	var user *models.User
+	err := WithTx(app, func(txApp core.App) error {
+		affected, err := Users.Update(txApp, userId, Changeset{
+			"verified": verified,
+			"updated":  types.NowDateTime().String(),
+		})
+		if err != nil {
+			return err
+		}
+		span.SetAttr("db.response.affected_rows", affected)
+		if affected == 0 {
+			return ErrNotFound
+		}
+		user, err = GetUserById(txApp, userId)
+		return err
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// listedUser is a user with its soft delete mark, for "users list".
+type listedUser struct {
+	models.User
+	DeletedAt string `db:"deleted_at"`
+}
+
+func printUser(user listedUser) {
+	status := "unverified"
+	if user.Verified {
+		status = "verified"
+	}
+	if user.DeletedAt != "" {
+		status = "deleted " + user.DeletedAt
+	}
+	fmt.Printf("%s\t%s\t%s\t%s\t%s\n", user.Id, user.Email, user.Name, status, user.Created)
+}
+
+// NewUsersCommand adds the "users" command to manage the users from the CLI,
+// through the same storage functions as the API.
+func NewUsersCommand(app core.App) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "users",
+		Short: "Manages the users",
+	}
+
+	limit, deleted := 50, false
+	list := &cobra.Command{
+		Use:          "list",
+		Short:        "Lists the users, newest first",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			repo := Users
+			if deleted {
+				repo = Users.WithDeleted()
+			}
+			users := []listedUser{}
+			opts := ListOptions{Page: 1, PerPage: limit, Sort: []SortField{{Field: "created", Desc: true}}}
+			if err := opts.Apply(repo.Query(app), Users.Table).All(&users); err != nil {
+				return err
+			}
+			for _, user := range users {
+				printUser(user)
+			}
+			return nil
+		},
+	}
+	list.Flags().IntVar(&limit, "limit", 50, "maximum number of users to list")
+	list.Flags().BoolVar(&deleted, "deleted", false, "include the soft deleted users")
+
+	cr, verified, tenant := models.UserCreationRequest{}, false, ""
+	create := &cobra.Command{
+		Use:          "create",
+		Short:        "Creates a user",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			app := app
+			if tenant != "" {
+				found, err := Tenants.FindOne(app, dbx.HashExp{"slug": tenant})
+				if errors.Is(err, ErrNotFound) {
+					return fmt.Errorf("no tenant %q", tenant)
+				}
+				if err != nil {
+					return err
+				}
+				app = WithTenant(app, found.Id)
+			}
+			cr.PasswordConfirm = cr.Password
+			user, err := CreateUser(app, cr)
+			if err != nil {
+				return err
+			}
+			if verified {
+				if user, err = SetUserVerified(app, user.Id, true); err != nil {
+					return err
+				}
+			}
+			printUser(listedUser{User: *user})
+			return nil
+		},
+	}
+	create.Flags().StringVar(&cr.Email, "email", "", "email of the user")
+	create.Flags().StringVar(&cr.Name, "name", "", "name of the user")
+	create.Flags().StringVar(&cr.Password, "password", "", "password of the user, none when empty")
+	create.Flags().BoolVar(&verified, "verified", false, "mark the user as verified")
+	create.Flags().StringVar(&tenant, "tenant", "", "slug of the tenant of the user")
+	_ = create.MarkFlagRequired("email")
+
+	hard := false
+	remove := &cobra.Command{
+		Use:          "delete <id>",
+		Short:        "Soft deletes a user, or removes it with --hard",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if hard {
+				if err := HardDeleteUserById(app, args[0]); err != nil {
+					return err
+				}
+				fmt.Println("removed", args[0])
+				return nil
+			}
+			if err := DeleteUserById(app, args[0]); err != nil {
+				return err
+			}
+			fmt.Println("deleted", args[0])
+			return nil
+		},
+	}
+	remove.Flags().BoolVar(&hard, "hard", false, "remove the user for good")
+
+	setVerified := &cobra.Command{
+		Use:          "set-verified <id> [true|false]",
+		Short:        "Marks a user as verified, or unverified with false",
+		Args:         cobra.RangeArgs(1, 2),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			verified := true
+			if len(args) == 2 {
+				var err error
+				if verified, err = strconv.ParseBool(args[1]); err != nil {
+					return fmt.Errorf("invalid verified value %q", args[1])
+				}
+			}
+			user, err := SetUserVerified(app, args[0], verified)
+			if err != nil {
+				return err
+			}
+			printUser(listedUser{User: *user})
+			return nil
+		},
+	}
+
+	batchSize := 500
+	reencrypt := &cobra.Command{
+		Use:          "reencrypt",
+		Short:        "Re-encrypts the encrypted fields of the users with the first FIELD_ENCRYPTION_KEYS key",
+		Long:         "Re-encrypts the encrypted fields of the users with the first FIELD_ENCRYPTION_KEYS key, e.g. after adding a new key in front, and encrypts the values stored in plain. The old keys can be removed once it is done.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if batchSize < 1 {
+				return errors.New("--batch-size must be at least 1")
+			}
+			rewritten, err := Users.Reencrypt(app, batchSize)
+			fmt.Println("re-encrypted", rewritten, "users")
+			return err
+		},
+	}
+	reencrypt.Flags().IntVar(&batchSize, "batch-size", 500, "number of users read at a time")
+
+	command.AddCommand(list, create, remove, setVerified, reencrypt)
+	return command
+}
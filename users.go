@@ -0,0 +1,747 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var ErrUserNotDeleted = errors.New("user is not deleted")
+
+var UserSortFields = []string{"id", "email", "name", "verified", "lastSeen", "completeness", "created", "updated"}
+
+var UserFilterFields = map[string]FilterType{
+	"email":           FilterString,
+	"name":            FilterString,
+	"verified":        FilterBool,
+	"emailVisibility": FilterBool,
+	"loginCount":      FilterNumber,
+	"credits":         FilterNumber,
+	"completeness":    FilterNumber,
+	"created":         FilterString,
+	"updated":         FilterString,
+}
+
+// Users is the repository of the users collection table. Deleted users are
+// only marked with deleted_at until deleted with ?hard=true.
+var Users = &Repository[models.User]{
+	Table:            "users",
+	SoftDeleteColumn: "deleted_at",
+	TenantColumn:     "tenant_id",
+	OnWrite:          func() { UserResponseCache.Invalidate() },
+	UniqueErrors:     map[string]error{"email": ErrEmailTaken},
+	CreatedColumn:    "created",
+	UpdatedColumn:    "updated",
+}
+
+func CountUsers(app core.App, filter dbx.Expression) (int, error) {
+	span := StartStorageSpan(app, "CountUsers", "SELECT")
+	total, err := Users.Count(app, filter)
+	span.End(err)
+	return total, err
+}
+
+func GetUsers(app core.App, opts ListOptions) ([]models.User, error) {
+	span := StartStorageSpan(app, "GetUsers", "SELECT")
+	users, err := Users.FindAll(app, opts)
+	span.SetAttr("db.response.returned_rows", len(users))
+	span.End(err)
+	return users, err
+}
+
+func GetUsersAfter(app core.App, opts CursorOptions) ([]models.User, error) {
+	span := StartStorageSpan(app, "GetUsersAfter", "SELECT")
+	users, err := Users.FindAfter(app, opts)
+	span.SetAttr("db.response.returned_rows", len(users))
+	span.End(err)
+	return users, err
+}
+
+func GetUserById(app core.App, userId string) (*models.User, error) {
+	span := StartStorageSpan(app, "GetUserById", "SELECT")
+	user, err := Users.Find(app, userId)
+	span.End(err)
+	return user, err
+}
+
+func GetUserByEmail(app core.App, email string) (*models.User, error) {
+	span := StartStorageSpan(app, "GetUserByEmail", "SELECT")
+	user, err := Users.FindOne(app, dbx.HashExp{"email": email})
+	span.End(err)
+	return user, err
+}
+
+func InsertUser(app core.App, cr models.UserCreationRequest) (*models.User, error) {
+	if cr.Password != "" {
+		return InsertAuthUser(app, cr)
+	}
+	span := StartStorageSpan(app, "InsertUser", "INSERT")
+	var user *models.User
+	err := WithTx(app, func(txApp core.App) error {
+		if err := Users.Insert(txApp, cr); err != nil {
+			return err
+		}
+		var err error
+		user, err = GetUserByEmail(txApp, cr.Email)
+		return err
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CreateUser validates cr and inserts the user, unless the email is taken.
+// The email is checked in the same transaction as the insert so that two
+// requests can't both find it available.
+func CreateUser(app core.App, cr models.UserCreationRequest) (*models.User, error) {
+	if cr.Password != cr.PasswordConfirm {
+		return nil, ErrPasswordMismatch
+	}
+	if err := ValidateUserCreationRequest(cr); err != nil {
+		return nil, err
+	}
+	var user *models.User
+	err := WithTx(app, func(txApp core.App) error {
+		if err := CheckEmailAvailable(txApp, "", cr.Email); err != nil {
+			return err
+		}
+		var err error
+		user, err = InsertUser(txApp, cr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UpdateUserById applies ur to the user, returning ErrNotFound if there is
+// no such user. It returns the updated user along with the old and new
+// values of the fields that changed, read in the same transaction. If the
+// version checks of ur fail (see CheckUserVersion), it returns their error
+// along with the current user.
+func UpdateUserById(app core.App, userId string, ur models.UserUpdateRequest) (*models.User, map[string]FieldChange, error) {
+	cs := NewChangeset(ur)
+	if len(cs) == 0 {
+		return nil, nil, fmt.Errorf("empty update request")
+	}
+	if err := cs.Validate(UserWritableFields); err != nil {
+		return nil, nil, err
+	}
+	span := StartStorageSpan(app, "UpdateUserById", "UPDATE")
+	var user *models.User
+	var changed map[string]FieldChange
+	err := WithTx(app, func(txApp core.App) error {
+		before, err := GetUserById(txApp, userId)
+		if err != nil {
+			return err
+		}
+		if err := CheckUserVersion(before, ur); err != nil {
+			user = before
+			return err
+		}
+		affected, err := Users.Update(txApp, userId, cs)
+		if err != nil {
+			return err
+		}
+		span.SetAttr("db.response.affected_rows", affected)
+		if affected == 0 {
+			return ErrNotFound
+		}
+		user, err = GetUserById(txApp, userId)
+		if err != nil {
+			return err
+		}
+		changed = DiffFields(before, user)
+		return nil
+	})
+	span.End(err)
+	if IsUserVersionError(err) {
+		return user, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, changed, nil
+}
+
+// DeleteUserById soft deletes the user, returning ErrNotFound if there is no
+// such user or it is already deleted.
+func DeleteUserById(app core.App, userId string) error {
+	span := StartStorageSpan(app, "DeleteUserById", "UPDATE")
+	affected, err := Users.SoftDelete(app, userId, time.Now())
+	span.SetAttr("db.response.affected_rows", affected)
+	span.End(err)
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// HardDeleteUserById permanently removes the user, soft deleted or not,
+// returning ErrNotFound if there is no such user. It leaves a tombstone of
+// the user for GET /users/changes.
+func HardDeleteUserById(app core.App, userId string) error {
+	span := StartStorageSpan(app, "HardDeleteUserById", "DELETE")
+	err := WithTx(app, func(txApp core.App) error {
+		user, err := Users.WithDeleted().Find(txApp, userId)
+		if err != nil {
+			return err
+		}
+		affected, err := Users.Delete(txApp, userId)
+		span.SetAttr("db.response.affected_rows", affected)
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrNotFound
+		}
+		return RecordUserTombstone(txApp, userId, user.TenantId)
+	})
+	span.End(err)
+	if err != nil {
+		return err
+	}
+	return RemoveGeneratedAvatar(app, userId)
+}
+
+// RestoreUserById clears the soft delete mark of the user. It returns
+// ErrNotFound if there is no such user and ErrUserNotDeleted if the user
+// isn't deleted.
+func RestoreUserById(app core.App, userId string) (*models.User, error) {
+	span := StartStorageSpan(app, "RestoreUserById", "UPDATE")
+	var user *models.User
+	err := WithTx(app, func(txApp core.App) error {
+		affected, err := Users.Restore(txApp, userId)
+		if err != nil {
+			return err
+		}
+		span.SetAttr("db.response.affected_rows", affected)
+		if affected == 0 {
+			if _, err := Users.WithDeleted().Find(txApp, userId); err != nil {
+				return err
+			}
+			return ErrUserNotDeleted
+		}
+		user, err = GetUserById(txApp, userId)
+		return err
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UserService is the storage of the users behind the /users handlers, so
+// that they can run against another implementation than PocketBase's.
+type UserService interface {
+	// WithRequest returns the service bound to the request, so that its
+	// queries are traced as part of it.
+	WithRequest(e *core.RequestEvent) UserService
+	Count(filter dbx.Expression) (int, error)
+	List(opts ListOptions) ([]models.User, error)
+	ListAfter(opts CursorOptions) ([]models.User, error)
+	// Get returns ErrNotFound for unknown and deleted users, which
+	// GetWithDeleted returns too. So do the writes for unknown users.
+	Get(userId string) (*models.User, error)
+	GetWithDeleted(userId string) (*models.User, error)
+	Create(cr models.UserCreationRequest) (*models.User, error)
+	CheckUpdate(userId string, ur models.UserUpdateRequest) error
+	// Update returns the updated user along with the fields it changed.
+	Update(userId string, ur models.UserUpdateRequest) (*models.User, map[string]FieldChange, error)
+	// Delete and HardDelete return ErrUserModifiedSince if the user was
+	// updated after unmodifiedSince, when not nil.
+	Delete(userId string, unmodifiedSince *time.Time) error
+	HardDelete(userId string, unmodifiedSince *time.Time) error
+	Restore(userId string) (*models.User, error)
+}
+
+// PocketBaseUserService implements UserService with the storage functions
+// above. Its writes queue their user events in the outbox in the same
+// transaction.
+type PocketBaseUserService struct {
+	App core.App
+}
+
+func NewUserService(app core.App) *PocketBaseUserService {
+	return &PocketBaseUserService{App: app}
+}
+
+func (s *PocketBaseUserService) WithRequest(e *core.RequestEvent) UserService {
+	return &PocketBaseUserService{App: WithTrace(s.App, e)}
+}
+
+func (s *PocketBaseUserService) Count(filter dbx.Expression) (int, error) {
+	return CountUsers(s.App, filter)
+}
+
+func (s *PocketBaseUserService) List(opts ListOptions) ([]models.User, error) {
+	return GetUsers(s.App, opts)
+}
+
+func (s *PocketBaseUserService) ListAfter(opts CursorOptions) ([]models.User, error) {
+	return GetUsersAfter(s.App, opts)
+}
+
+func (s *PocketBaseUserService) Get(userId string) (*models.User, error) {
+	return GetUserById(s.App, userId)
+}
+
+func (s *PocketBaseUserService) GetWithDeleted(userId string) (*models.User, error) {
+	return Users.WithDeleted().Find(s.App, userId)
+}
+
+func (s *PocketBaseUserService) Create(cr models.UserCreationRequest) (*models.User, error) {
+	var user *models.User
+	err := WithTx(s.App, func(txApp core.App) error {
+		var err error
+		if user, err = CreateUser(txApp, cr); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserCreated, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *PocketBaseUserService) CheckUpdate(userId string, ur models.UserUpdateRequest) error {
+	return CheckUserUpdate(s.App, userId, ur)
+}
+
+func (s *PocketBaseUserService) Update(userId string, ur models.UserUpdateRequest) (*models.User, map[string]FieldChange, error) {
+	var user *models.User
+	var changed map[string]FieldChange
+	err := WithTx(s.App, func(txApp core.App) error {
+		var err error
+		if user, changed, err = UpdateUserById(txApp, userId, ur); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserUpdated, user)
+	})
+	if IsUserVersionError(err) {
+		return user, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, changed, nil
+}
+
+func (s *PocketBaseUserService) Delete(userId string, unmodifiedSince *time.Time) error {
+	return WithTx(s.App, func(txApp core.App) error {
+		user, err := GetUserById(txApp, userId)
+		if err != nil {
+			return err
+		}
+		if err := CheckUserUnmodifiedSince(user, unmodifiedSince); err != nil {
+			return err
+		}
+		if err := DeleteUserById(txApp, userId); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserDeleted, user)
+	})
+}
+
+func (s *PocketBaseUserService) HardDelete(userId string, unmodifiedSince *time.Time) error {
+	return WithTx(s.App, func(txApp core.App) error {
+		user, err := Users.WithDeleted().Find(txApp, userId)
+		if err != nil {
+			return err
+		}
+		if err := CheckUserUnmodifiedSince(user, unmodifiedSince); err != nil {
+			return err
+		}
+		if err := HardDeleteUserById(txApp, userId); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserDeleted, user)
+	})
+}
+
+func (s *PocketBaseUserService) Restore(userId string) (*models.User, error) {
+	var user *models.User
+	err := WithTx(s.App, func(txApp core.App) error {
+		var err error
+		if user, err = RestoreUserById(txApp, userId); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserUpdated, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// writeUserError is WriteError with USER_NOT_FOUND for ErrNotFound.
+func writeUserError(e *core.RequestEvent, err error, action string) error {
+	if errors.Is(err, ErrNotFound) {
+		return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+	}
+	return WriteError(e, err, action)
+}
+
+func HandleGetUsers(app *pocketbase.PocketBase, service UserService, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		service := service.WithRequest(e)
+		fields, err := ParseUserFields(e.Request.URL.Query().Get("fields"))
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if ids := e.Request.URL.Query().Get("ids"); ids != "" {
+			return writeLookup(app, cfg, e, strings.Split(ids, ","), fields)
+		}
+		filter, err := ParseFilter(e.Request.URL.Query().Get("filter"), UserFilterFields)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+
+		if format, ok := RequestedStream(e.Request); ok {
+			opts, err := ParseListOptions(e.Request.URL.Query(), UserSortFields, cfg)
+			if err != nil {
+				return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+			}
+			opts.Filter = filter
+			return writeUserStream(app, e, format, opts, fields)
+		}
+
+		if IsCursorRequest(e.Request.URL.Query()) {
+			opts, err := ParseCursorOptions(e.Request.URL.Query(), cfg)
+			if err != nil {
+				return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+			}
+			opts.Filter = filter
+			users, err := service.ListAfter(opts)
+			if err != nil {
+				return WriteError(e, err, "error getting users")
+			}
+			page := NewCursorPage(users, opts, UserCursor)
+			return WriteOK(e, "", &models.CursorPage[any]{
+				Items:      ProjectUsers(e, page.Items, fields),
+				Limit:      page.Limit,
+				NextCursor: page.NextCursor,
+			})
+		}
+
+		opts, err := ParseListOptions(e.Request.URL.Query(), UserSortFields, cfg)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		opts.Filter = filter
+
+		total, err := service.Count(opts.Filter)
+		if err != nil {
+			return WriteError(e, err, "error counting users")
+		}
+		users, err := service.List(opts)
+		if err != nil {
+			return WriteError(e, err, "error getting users")
+		}
+		return WriteOK(e, "", NewListPage(ProjectUsers(e, users, fields), opts, total))
+	}
+}
+
+// HandleGetUserById returns the user, with the relations of ?expand=
+// embedded under "expand", see UserRelations.
+func HandleGetUserById(app *pocketbase.PocketBase, service UserService) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		service := service.WithRequest(e)
+		userId := e.Request.PathValue("userId")
+		fields, err := ParseUserFields(e.Request.URL.Query().Get("fields"))
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		paths, private, err := ParseExpand(e.Request.URL.Query().Get("expand"), UserRelations)
+		if err != nil {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if private && !e.HasSuperuserAuth() && (e.Auth == nil || e.Auth.Id != userId) {
+			return WriteForbidden(e, "not allowed to expand the relations of this user", nil)
+		}
+		user, err := service.Get(userId)
+		if err != nil {
+			return writeUserError(e, err, "error getting user")
+		}
+		SetUserLastModified(e, user)
+		if paths == nil {
+			return WriteOK(e, "", ProjectUser(e, *user, fields))
+		}
+
+		expanded, err := Expand(WithTrace(app, e), UserRelations, []string{userId}, paths)
+		if err != nil {
+			return WriteError(e, err, "error expanding user")
+		}
+		result, err := WithExpand(ProjectUser(e, *user, fields), expanded[userId])
+		if err != nil {
+			return WriteError(e, err, "error expanding user")
+		}
+		return WriteOK(e, "", result)
+	}
+}
+
+func HandleInsertUser(app *pocketbase.PocketBase, service UserService, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		service := service.WithRequest(e)
+		cr := models.UserCreationRequest{}
+		if err := BindStrict(e, &cr); err != nil {
+			return WriteBindError(e, err)
+		}
+		verdict := ScreenRequest(app, e, map[string]string{"name": cr.Name})
+		if len(verdict.Rejected) > 0 {
+			return WriteErrorCode(e, CodeContentRejected, "invalid user", verdict.Rejected)
+		}
+		dryRun := IsDryRun(e)
+		var user *models.User
+		var err error
+		if dryRun {
+			user, err = PreviewUserCreation(app, cr)
+		} else {
+			user, err = service.Create(cr)
+		}
+		if errors.Is(err, ErrPasswordMismatch) {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if errors.Is(err, ErrEmailTaken) {
+			return WriteErrorCode(e, CodeEmailTaken, err.Error(), map[string]string{"email": err.Error()})
+		}
+		var validationErrs validation.Errors
+		if errors.As(err, &validationErrs) {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid user", validationErrs)
+		}
+		if err != nil {
+			return WriteError(e, err, "error creating new user")
+		}
+		if dryRun {
+			return WriteOK(e, "", NewDryRunResult(user, verdict))
+		}
+		SetAuditedUser(e, user.Id)
+		flagForReview(app, Users.Table, user.Id, verdict)
+		EnrichSignup(app, e, user.Id)
+		// the user can ask for another link, so this never fails the request
+		if err := QueueVerificationEmail(app, user.Id); err != nil {
+			app.Logger().Warn("Failed to queue verification email", "userId", user.Id, "error", err)
+		}
+		return WriteOK(e, "", user)
+	}
+}
+
+// UserUpdateResult is the response to a user update, with the old and new
+// values of the fields it changed.
+type UserUpdateResult struct {
+	User    *models.User           `json:"user"`
+	Changed map[string]FieldChange `json:"changed"`
+}
+
+// HandleUpdateUserById applies a partial update to a user. A new email is
+// only stored as pending until confirmed through the token mailed to it,
+// unless a superuser passes ?skipConfirmation=true. Clients can send the
+// updated time they last read as If-Match (or expectedUpdated) to get a 409
+// with the current user instead of overwriting a concurrent update, or the
+// Last-Modified time they last read as If-Unmodified-Since to get a 412.
+// Besides the JSON of the fields to set, it takes a JSON Patch or a JSON
+// Merge Patch, which can also clear the optional fields.
+func HandleUpdateUserById(app *pocketbase.PocketBase, service UserService, cfg *Config) func(e *core.RequestEvent) error {
+	limiter := NewRateLimiter(cfg.UserUpdatesPerHour, time.Hour)
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		service := service.WithRequest(e)
+		userId := e.Request.PathValue("userId")
+		ur := models.UserUpdateRequest{}
+		switch {
+		case IsJSONPatchRequest(e.Request):
+			ops := []JSONPatchOp{}
+			if err := json.NewDecoder(e.Request.Body).Decode(&ops); err != nil {
+				return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+			}
+			user, err := service.Get(userId)
+			if err != nil {
+				return writeUserError(e, err, "error getting user")
+			}
+			ur, err = ApplyJSONPatch(*user, ops)
+			if patchErr, ok := err.(*JSONPatchError); ok {
+				return WriteUnprocessableEntity(e, "invalid patch: "+patchErr.Error(), patchErr)
+			}
+		case IsMergePatchRequest(e.Request):
+			// a patch that isn't an object would replace the whole user
+			patch := map[string]json.RawMessage{}
+			if err := json.NewDecoder(e.Request.Body).Decode(&patch); err != nil {
+				return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+			}
+			user, err := service.Get(userId)
+			if err != nil {
+				return writeUserError(e, err, "error getting user")
+			}
+			ur, err = ApplyMergePatch(*user, patch)
+			if patchErr, ok := err.(*MergePatchError); ok {
+				return WriteUnprocessableEntity(e, "invalid patch: "+patchErr.Error(), patchErr)
+			}
+		default:
+			if err := BindStrict(e, &ur); err != nil {
+				return WriteBindError(e, err)
+			}
+		}
+		if expected := ParseIfMatch(e.Request.Header.Get("If-Match")); expected != nil {
+			ur.ExpectedUpdated = expected
+		}
+		ur.UnmodifiedSince = ParseIfUnmodifiedSince(e.Request.Header.Get("If-Unmodified-Since"), e.Request.Header.Get("If-Match"))
+		if err := CheckWritableFields(e.Request.Pattern, e.HasSuperuserAuth(), ur); err != nil {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid user", err)
+		}
+		if err := ValidateUserUpdateRequest(ur); err != nil {
+			return WriteErrorCode(e, CodeValidationFailed, "invalid user", err)
+		}
+		verdict := ModerationVerdict{}
+		if ur.Name != nil {
+			verdict = ScreenRequest(app, e, map[string]string{"name": *ur.Name})
+		}
+		if len(verdict.Rejected) > 0 {
+			return WriteErrorCode(e, CodeContentRejected, "invalid user", verdict.Rejected)
+		}
+		if err := service.CheckUpdate(userId, ur); errors.Is(err, ErrEmailTaken) {
+			return WriteErrorCode(e, CodeEmailTaken, err.Error(), map[string]string{"email": err.Error()})
+		} else if err != nil {
+			return writeUserError(e, err, "error checking update")
+		}
+		skipConfirmation, _ := strconv.ParseBool(e.Request.URL.Query().Get("skipConfirmation"))
+		if skipConfirmation && !e.HasSuperuserAuth() {
+			return WriteForbidden(e, "only superusers can skip the email confirmation", nil)
+		}
+		if IsDryRun(e) {
+			return writeUserUpdateDryRun(e, service, userId, ur, skipConfirmation, verdict)
+		}
+		if ok, retryAfter := limiter.Allow(userId, time.Now()); !ok {
+			e.Response.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			return WriteTooManyRequests(e, "too many updates for this user, try again later", nil)
+		}
+
+		pendingEmail := ""
+		if ur.Email != nil && !skipConfirmation {
+			user, err := service.Get(userId)
+			if err != nil {
+				return writeUserError(e, err, "error getting user")
+			}
+			if err := CheckUserVersion(user, ur); err != nil {
+				return writeUserVersionError(e, err, user)
+			}
+			if *ur.Email != user.Email {
+				pendingEmail = *ur.Email
+				ur.Email = nil
+			}
+		}
+
+		var result *UserUpdateResult
+		if pendingEmail == "" || len(NewChangeset(ur)) > 0 {
+			user, changed, err := service.Update(userId, ur)
+			if IsUserVersionError(err) {
+				return writeUserVersionError(e, err, user)
+			}
+			if err != nil {
+				return writeUserError(e, err, "error updating user")
+			}
+			SetAuditChanges(e, changed)
+			flagForReview(app, Users.Table, userId, verdict)
+			result = &UserUpdateResult{User: user, Changed: changed}
+		}
+		if pendingEmail != "" {
+			err := RequestEmailChange(app, cfg, userId, pendingEmail)
+			if err != nil {
+				return WriteError(e, err, "error requesting email change")
+			}
+			return WriteOK(e, "a confirmation link was sent to "+pendingEmail, result)
+		}
+		return WriteOK(e, "", result)
+	}
+}
+
+// writeUserUpdateDryRun responds to the dry run of an update with the
+// user as the update would leave it, once past its version checks. It
+// doesn't count towards the update rate limit.
+func writeUserUpdateDryRun(e *core.RequestEvent, service UserService, userId string, ur models.UserUpdateRequest, skipConfirmation bool, verdict ModerationVerdict) error {
+	user, err := service.Get(userId)
+	if err != nil {
+		return writeUserError(e, err, "error getting user")
+	}
+	if err := CheckUserVersion(user, ur); err != nil {
+		return writeUserVersionError(e, err, user)
+	}
+	pendingEmail := ""
+	if ur.Email != nil && !skipConfirmation && *ur.Email != user.Email {
+		pendingEmail = *ur.Email
+		ur.Email = nil
+	}
+	cs := NewChangeset(ur)
+	preview := *user
+	cs.Apply(&preview)
+	result := NewDryRunResult(&preview, verdict)
+	result.Changed = cs.Diff(*user)
+	result.PendingEmail = pendingEmail
+	return WriteOK(e, "", result)
+}
+
+// writeUserVersionError responds to a failed version check of an update
+// with the current user, 412 for If-Unmodified-Since and 409 otherwise.
+func writeUserVersionError(e *core.RequestEvent, err error, user *models.User) error {
+	if errors.Is(err, ErrUserModifiedSince) {
+		return WritePreconditionFailed(e, err.Error(), user)
+	}
+	return WriteConflict(e, err.Error(), user)
+}
+
+// HandleDeleteUserById soft deletes, or with ?hard=true deletes for good, a
+// user. An If-Unmodified-Since header makes it fail with 412 if the user was
+// updated since.
+func HandleDeleteUserById(service UserService) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		service := service.WithRequest(e)
+		userId := e.Request.PathValue("userId")
+		since := ParseIfUnmodifiedSince(e.Request.Header.Get("If-Unmodified-Since"), "")
+		var err error
+		if hard, _ := strconv.ParseBool(e.Request.URL.Query().Get("hard")); hard {
+			err = service.HardDelete(userId, since)
+		} else {
+			err = service.Delete(userId, since)
+		}
+		if errors.Is(err, ErrUserModifiedSince) {
+			return WritePreconditionFailed(e, err.Error(), nil)
+		}
+		if err != nil {
+			return writeUserError(e, err, "error deleting user")
+		}
+		return WriteOK(e, "", nil)
+	}
+}
+
+func HandleRestoreUserById(service UserService) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		service := service.WithRequest(e)
+		userId := e.Request.PathValue("userId")
+		user, err := service.Restore(userId)
+		if errors.Is(err, ErrUserNotDeleted) {
+			return WriteConflict(e, err.Error(), nil)
+		}
+		if err != nil {
+			return writeUserError(e, err, "error restoring user")
+		}
+		return WriteOK(e, "", user)
+	}
+}
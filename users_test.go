@@ -0,0 +1,473 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func TestPocketBaseUserServiceCreate(t *testing.T) {
+	app := newTestApp(t)
+	service := NewUserService(app)
+
+	user, err := service.Create(models.UserCreationRequest{Email: "new@example.com", Name: "New"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := service.Get(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, user) {
+		t.Errorf("expected %+v, got %+v", user, got)
+	}
+
+	_, err = service.Create(models.UserCreationRequest{Email: "new@example.com"})
+	if !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken, got %v", err)
+	}
+	_, err = service.Create(models.UserCreationRequest{Email: "other@example.com", Password: testUserPassword, PasswordConfirm: "other"})
+	if !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("expected ErrPasswordMismatch, got %v", err)
+	}
+
+	total, err := service.Count(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 {
+		t.Errorf("expected 1 user, got %d", total)
+	}
+	events, err := OutboxEvents.Count(app, dbx.HashExp{"event": EventUserCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events != 1 {
+		t.Errorf("expected 1 %s event, got %d", EventUserCreated, events)
+	}
+}
+
+func TestPocketBaseUserServiceList(t *testing.T) {
+	app := newTestApp(t)
+	service := NewUserService(app)
+	seedTestUsers(t, app, 3)
+
+	users, err := service.List(ListOptions{
+		Page:    1,
+		PerPage: 2,
+		Sort:    []SortField{{Field: "email", Desc: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emails := []string{}
+	for _, user := range users {
+		emails = append(emails, user.Email)
+	}
+	expected := []string{"user2@example.com", "user1@example.com"}
+	if !slices.Equal(emails, expected) {
+		t.Errorf("expected the users %v, got %v", expected, emails)
+	}
+
+	filter := dbx.HashExp{"name": "User 1"}
+	users, err = service.List(ListOptions{Filter: filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Email != "user1@example.com" {
+		t.Errorf("expected user1@example.com, got %+v", users)
+	}
+	total, err := service.Count(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 {
+		t.Errorf("expected 1 user, got %d", total)
+	}
+}
+
+func TestPocketBaseUserServiceUpdate(t *testing.T) {
+	app := newTestApp(t)
+	service := NewUserService(app)
+	user := seedTestUsers(t, app, 1)[0]
+
+	name := "Renamed"
+	updated, changed, err := service.Update(user.Id, models.UserUpdateRequest{Name: &name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != name {
+		t.Errorf("expected the name %q, got %q", name, updated.Name)
+	}
+	if change, ok := changed["name"]; !ok || change.Old != user.Name || change.New != name {
+		t.Errorf("expected the name change from %q, got %+v", user.Name, changed)
+	}
+
+	stale := user.Updated
+	current, _, err := service.Update(user.Id, models.UserUpdateRequest{Name: &name, ExpectedUpdated: &stale})
+	if !errors.Is(err, ErrUserUpdateConflict) {
+		t.Errorf("expected ErrUserUpdateConflict, got %v", err)
+	}
+	if current == nil || current.Name != name {
+		t.Errorf("expected the current user along with the conflict, got %+v", current)
+	}
+
+	if _, _, err := service.Update("unknown", models.UserUpdateRequest{Name: &name}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := service.CheckUpdate("unknown", models.UserUpdateRequest{Name: &name}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPocketBaseUserServiceDelete(t *testing.T) {
+	app := newTestApp(t)
+	service := NewUserService(app)
+	users := seedTestUsers(t, app, 2)
+	user := users[0]
+
+	past := time.Now().Add(-time.Hour)
+	if err := service.Delete(user.Id, &past); !errors.Is(err, ErrUserModifiedSince) {
+		t.Errorf("expected ErrUserModifiedSince, got %v", err)
+	}
+
+	if err := service.Delete(user.Id, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Get(user.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a deleted user, got %v", err)
+	}
+	if _, err := service.GetWithDeleted(user.Id); err != nil {
+		t.Errorf("expected the deleted user, got %v", err)
+	}
+	if err := service.Delete(user.Id, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a deleted user, got %v", err)
+	}
+
+	restored, err := service.Restore(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Id != user.Id {
+		t.Errorf("expected the user %s, got %s", user.Id, restored.Id)
+	}
+	if _, err := service.Restore(user.Id); !errors.Is(err, ErrUserNotDeleted) {
+		t.Errorf("expected ErrUserNotDeleted, got %v", err)
+	}
+	if _, err := service.Restore("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	if err := service.HardDelete(user.Id, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.GetWithDeleted(user.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a hard deleted user, got %v", err)
+	}
+	if err := service.HardDelete(user.Id, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	total, err := service.Count(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 {
+		t.Errorf("expected 1 user left, got %d", total)
+	}
+}
+
+// fakeUserService is a UserService in memory, for the handlers to be tested
+// without the storage.
+type fakeUserService struct {
+	users   map[string]*models.User
+	deleted map[string]bool
+	// hardDeleted are the ids passed to HardDelete.
+	hardDeleted []string
+}
+
+func newFakeUserService(users ...models.User) *fakeUserService {
+	s := &fakeUserService{users: map[string]*models.User{}, deleted: map[string]bool{}}
+	for _, user := range users {
+		s.users[user.Id] = &user
+	}
+	return s
+}
+
+func (s *fakeUserService) WithRequest(e *core.RequestEvent) UserService {
+	return s
+}
+
+func (s *fakeUserService) Count(filter dbx.Expression) (int, error) {
+	users, err := s.List(ListOptions{})
+	return len(users), err
+}
+
+// List returns the users that aren't deleted by id, ignoring the options.
+func (s *fakeUserService) List(opts ListOptions) ([]models.User, error) {
+	users := []models.User{}
+	for id, user := range s.users {
+		if !s.deleted[id] {
+			users = append(users, *user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, nil
+}
+
+func (s *fakeUserService) ListAfter(opts CursorOptions) ([]models.User, error) {
+	return s.List(ListOptions{})
+}
+
+func (s *fakeUserService) Get(userId string) (*models.User, error) {
+	if s.deleted[userId] {
+		return nil, ErrNotFound
+	}
+	return s.GetWithDeleted(userId)
+}
+
+func (s *fakeUserService) GetWithDeleted(userId string) (*models.User, error) {
+	user, ok := s.users[userId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u := *user
+	return &u, nil
+}
+
+func (s *fakeUserService) Create(cr models.UserCreationRequest) (*models.User, error) {
+	if cr.Password != cr.PasswordConfirm {
+		return nil, ErrPasswordMismatch
+	}
+	for _, user := range s.users {
+		if strings.EqualFold(user.Email, cr.Email) {
+			return nil, ErrEmailTaken
+		}
+	}
+	user := &models.User{Id: fmt.Sprintf("fake%d", len(s.users)), Email: cr.Email, Name: cr.Name}
+	s.users[user.Id] = user
+	return s.GetWithDeleted(user.Id)
+}
+
+func (s *fakeUserService) CheckUpdate(userId string, ur models.UserUpdateRequest) error {
+	_, err := s.Get(userId)
+	return err
+}
+
+func (s *fakeUserService) Update(userId string, ur models.UserUpdateRequest) (*models.User, map[string]FieldChange, error) {
+	user, err := s.Get(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := CheckUserVersion(user, ur); err != nil {
+		return user, nil, err
+	}
+	cs := NewChangeset(ur)
+	changed := cs.Diff(user)
+	cs.Apply(user)
+	s.users[userId] = user
+	return user, changed, nil
+}
+
+func (s *fakeUserService) Delete(userId string, unmodifiedSince *time.Time) error {
+	user, err := s.Get(userId)
+	if err != nil {
+		return err
+	}
+	if err := CheckUserUnmodifiedSince(user, unmodifiedSince); err != nil {
+		return err
+	}
+	s.deleted[userId] = true
+	return nil
+}
+
+func (s *fakeUserService) HardDelete(userId string, unmodifiedSince *time.Time) error {
+	user, err := s.GetWithDeleted(userId)
+	if err != nil {
+		return err
+	}
+	if err := CheckUserUnmodifiedSince(user, unmodifiedSince); err != nil {
+		return err
+	}
+	delete(s.users, userId)
+	delete(s.deleted, userId)
+	s.hardDeleted = append(s.hardDeleted, userId)
+	return nil
+}
+
+func (s *fakeUserService) Restore(userId string) (*models.User, error) {
+	if _, err := s.GetWithDeleted(userId); err != nil {
+		return nil, err
+	}
+	if !s.deleted[userId] {
+		return nil, ErrUserNotDeleted
+	}
+	delete(s.deleted, userId)
+	return s.Get(userId)
+}
+
+// serveUserHandlers serves the /users handlers with service, without the
+// guards of main, and with the request ids of the error responses and then
+// the middlewares.
+func serveUserHandlers(t testing.TB, service UserService, middlewares ...func(e *core.RequestEvent) error) http.Handler {
+	t.Helper()
+	app := newTestApp(t)
+	pb := &pocketbase.PocketBase{App: app}
+	cfg, err := LoadConfigFrom(func(key string) (string, bool) {
+		v, ok := testEnv[key]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := apis.NewRouter(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.BindFunc(LogRequests(app))
+	for _, middleware := range middlewares {
+		router.BindFunc(middleware)
+	}
+	router.GET("/users", HandleGetUsers(pb, service, cfg))
+	router.POST("/users", HandleInsertUser(pb, service, cfg))
+	router.GET("/users/{userId}", HandleGetUserById(pb, service))
+	router.DELETE("/users/{userId}", HandleDeleteUserById(service))
+	router.POST("/users/{userId}/restore", HandleRestoreUserById(service))
+	mux, err := router.BuildMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mux
+}
+
+func TestUserHandlers(t *testing.T) {
+	updated := "2024-01-02 03:04:05.000Z"
+	service := newFakeUserService(
+		models.User{Id: "a", Email: "a@example.com", Name: "A", Updated: updated},
+		models.User{Id: "b", Email: "b@example.com", Name: "B", Updated: updated},
+		models.User{Id: "c", Email: "c@example.com", Name: "C", Updated: updated},
+	)
+	service.deleted["c"] = true
+	handler := serveUserHandlers(t, service)
+
+	scenarios := []struct {
+		name           string
+		method         string
+		path           string
+		headers        map[string]string
+		body           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"get", http.MethodGet, "/users/a", nil, "", http.StatusOK, ""},
+		{"get unknown", http.MethodGet, "/users/unknown", nil, "", http.StatusNotFound, CodeUserNotFound},
+		{"get deleted", http.MethodGet, "/users/c", nil, "", http.StatusNotFound, CodeUserNotFound},
+		{"create taken email", http.MethodPost, "/users", nil, `{"email":"A@example.com"}`, http.StatusConflict, CodeEmailTaken},
+		{"create password mismatch", http.MethodPost, "/users", nil, `{"email":"new@example.com","password":"a","passwordConfirm":"b"}`, http.StatusBadRequest, "BAD_REQUEST"},
+		{"delete modified since", http.MethodDelete, "/users/a", map[string]string{"If-Unmodified-Since": "Mon, 01 Jan 2024 00:00:00 GMT"}, "", http.StatusPreconditionFailed, "PRECONDITION_FAILED"},
+		{"delete unknown", http.MethodDelete, "/users/unknown", nil, "", http.StatusNotFound, CodeUserNotFound},
+		{"delete", http.MethodDelete, "/users/a", nil, "", http.StatusOK, ""},
+		{"hard delete", http.MethodDelete, "/users/b?hard=true", nil, "", http.StatusOK, ""},
+		{"restore", http.MethodPost, "/users/c/restore", nil, "", http.StatusOK, ""},
+		{"restore not deleted", http.MethodPost, "/users/c/restore", nil, "", http.StatusConflict, "CONFLICT"},
+		{"restore unknown", http.MethodPost, "/users/unknown/restore", nil, "", http.StatusNotFound, CodeUserNotFound},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			req := httptest.NewRequest(scenario.method, scenario.path, strings.NewReader(scenario.body))
+			req.Header.Set("Accept", "application/json")
+			if scenario.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			for key, value := range scenario.headers {
+				req.Header.Set(key, value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != scenario.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", scenario.expectedStatus, rec.Code, rec.Body)
+			}
+			resp := checkAPIResp(t, rec.Code, rec.Body.Bytes())
+			if resp.Code != scenario.expectedCode {
+				t.Errorf("expected code %q, got %q", scenario.expectedCode, resp.Code)
+			}
+		})
+	}
+
+	if !slices.Equal(service.hardDeleted, []string{"b"}) {
+		t.Errorf("expected ?hard=true to hard delete b, got %v", service.hardDeleted)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	page := models.ListPage[models.User]{}
+	decodeData(t, checkAPIResp(t, rec.Code, rec.Body.Bytes()), &page)
+	ids := []string{}
+	for _, user := range page.Items {
+		ids = append(ids, user.Id)
+	}
+	if !slices.Equal(ids, []string{"c"}) || page.TotalItems != 1 {
+		t.Errorf("expected only the restored user, got %v of %d", ids, page.TotalItems)
+	}
+}
+
+// TestUserUpdateDryRun checks that a PATCH gives the result its dry run
+// previewed, but for the updated time the dry run leaves alone.
+func TestUserUpdateDryRun(t *testing.T) {
+	s := newTestServer(t, nil)
+	user := s.Users[0]
+	path := "/users/" + user.Id + "?skipConfirmation=true"
+	body := map[string]any{"email": "renamed@example.com", "name": "Renamed", "emailVisibility": true}
+
+	res, data := s.do(t, http.MethodPatch, path+"&dryRun=true", s.SuperuserToken, body)
+	preview := DryRunResult{}
+	decodeData(t, checkAPIResp(t, res.StatusCode, data), &preview)
+	if !preview.DryRun {
+		t.Errorf("expected a dry run, got %s", data)
+	}
+
+	res, data = s.do(t, http.MethodGet, "/users/"+user.Id, s.SuperuserToken, nil)
+	current := models.User{}
+	decodeData(t, checkAPIResp(t, res.StatusCode, data), &current)
+	if current.Updated != user.Updated || current.Name != user.Name {
+		t.Errorf("expected the dry run to leave the user alone, got %+v", current)
+	}
+	events, err := OutboxEvents.Count(s.App, dbx.HashExp{"event": EventUserUpdated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events != 0 {
+		t.Errorf("expected no %s event from the dry run, got %d", EventUserUpdated, events)
+	}
+
+	res, data = s.do(t, http.MethodPatch, path, s.SuperuserToken, body)
+	result := UserUpdateResult{}
+	decodeData(t, checkAPIResp(t, res.StatusCode, data), &result)
+	if result.User.Updated == user.Updated {
+		t.Errorf("expected the update to bump the updated time")
+	}
+	delete(result.Changed, "updated")
+	if !reflect.DeepEqual(result.Changed, preview.Changed) {
+		t.Errorf("expected the previewed changes %+v, got %+v", preview.Changed, result.Changed)
+	}
+	preview.User.Updated, result.User.Updated = "", ""
+	if !reflect.DeepEqual(result.User, preview.User) {
+		t.Errorf("expected the previewed user %+v, got %+v", preview.User, result.User)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
+)
+
+// Limits matching the default PocketBase users collection fields.
+const (
+	UserEmailMaxLength      = 255
+	UserNameMaxLength       = 255
+	UserPasswordMinLength   = 8
+	UserPasswordMaxLength   = 71
+	UserNationalIdMaxLength = 64
+)
+
+// ValidateUserCreationRequest checks the fields of cr before it is inserted
+// and returns validation.Errors keyed by json field name.
+func ValidateUserCreationRequest(cr models.UserCreationRequest) error {
+	errs := validation.Errors{
+		"email": validation.Validate(cr.Email, validation.Required, validation.Length(1, UserEmailMaxLength), is.EmailFormat),
+		"name":  validation.Validate(cr.Name, validation.Length(0, UserNameMaxLength)),
+	}
+	if cr.Password != "" {
+		errs["password"] = validation.Validate(cr.Password, validation.Length(UserPasswordMinLength, UserPasswordMaxLength))
+	}
+	return errs.Filter()
+}
+
+// ValidateUserUpdateRequest checks the fields set in ur, the nil ones are
+// left untouched by the update and so aren't validated.
+func ValidateUserUpdateRequest(ur models.UserUpdateRequest) error {
+	errs := validation.Errors{}
+	if ur.Email != nil {
+		errs["email"] = validation.Validate(*ur.Email, validation.Required, validation.Length(1, UserEmailMaxLength), is.EmailFormat)
+	}
+	if ur.Name != nil {
+		errs["name"] = validation.Validate(*ur.Name, validation.Length(0, UserNameMaxLength))
+	}
+	if ur.Phone != nil {
+		errs["phone"] = validation.Validate(*ur.Phone, is.E164)
+	}
+	if ur.NationalId != nil {
+		errs["nationalId"] = validation.Validate(*ur.NationalId, validation.Length(0, UserNationalIdMaxLength))
+	}
+	return errs.Filter()
+}
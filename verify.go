@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+var (
+	ErrVerificationInvalid = errors.New("invalid verification token")
+	ErrVerificationExpired = errors.New("verification token expired")
+	ErrAlreadyVerified     = errors.New("user is already verified")
+)
+
+// SignVerificationToken returns a token for the email of the user, so that
+// it stops working once the email changes.
+func SignVerificationToken(secret []byte, userId string, email string, expires time.Time) string {
+	return signUserToken(secret, "verification", userId, email, expires)
+}
+
+// VerifyVerificationToken checks the token signature and expiry and returns
+// the user id and email it was issued for.
+func VerifyVerificationToken(secret []byte, token string, now time.Time) (string, string, error) {
+	userId, email, err := verifyUserToken(secret, "verification", token, now)
+	if errors.Is(err, errTokenExpired) {
+		return "", "", ErrVerificationExpired
+	}
+	if err != nil {
+		return "", "", ErrVerificationInvalid
+	}
+	return userId, email, nil
+}
+
+// SendVerificationEmail mails the user a link to GET /users/verify.
+func SendVerificationEmail(app core.App, cfg *Config, user *models.User) error {
+	if user.Verified {
+		return ErrAlreadyVerified
+	}
+	token := SignVerificationToken([]byte(cfg.VerificationSecret), user.Id, user.Email, time.Now().Add(cfg.VerificationTTL))
+	meta := app.Settings().Meta
+
+	body, err := Views.RenderString(app, "emails/verification.html", map[string]any{
+		"Name": user.Name,
+		"TTL":  cfg.VerificationTTL.String(),
+		"URL":  strings.TrimRight(meta.AppURL, "/") + "/users/verify?token=" + url.QueryEscape(token),
+	})
+	if err != nil {
+		return err
+	}
+	return SendMail(app, &mailer.Message{
+		From:    mail.Address{Name: meta.SenderName, Address: meta.SenderAddress},
+		To:      []mail.Address{{Address: user.Email}},
+		Subject: "Verify your email address",
+		HTML:    body,
+	})
+}
+
+// VerificationEmailJob is the payload of the JobVerificationEmail jobs.
+type VerificationEmailJob struct {
+	UserId string `json:"userId"`
+}
+
+// QueueVerificationEmail queues a job sending the user a verification email.
+func QueueVerificationEmail(app core.App, userId string) error {
+	_, err := EnqueueJob(app, JobVerificationEmail, VerificationEmailJob{UserId: userId}, time.Now())
+	return err
+}
+
+// RunVerificationEmailJob returns the runner of the JobVerificationEmail
+// jobs, which skip the users deleted or verified since.
+func RunVerificationEmailJob(cfg *Config) func(ctx context.Context, app core.App, job *Job) error {
+	return func(ctx context.Context, app core.App, job *Job) error {
+		p := VerificationEmailJob{}
+		if err := DecodeJobPayload(job, &p); err != nil {
+			return err
+		}
+		user, err := GetUserById(app, p.UserId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = SendVerificationEmail(app, cfg, user)
+		if errors.Is(err, ErrAlreadyVerified) {
+			return nil
+		}
+		return err
+	}
+}
+
+// VerifyUser marks the user the token was issued for as verified, as long
+// as its email didn't change since, and queues the event of the change.
+func VerifyUser(app core.App, cfg *Config, token string) (*models.User, error) {
+	userId, email, err := VerifyVerificationToken([]byte(cfg.VerificationSecret), token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	span := StartStorageSpan(app, "VerifyUser", "UPDATE")
+	var user *models.User
+	err = WithTx(app, func(txApp core.App) error {
+		current, err := GetUserById(txApp, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrVerificationInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if current.Email != email {
+			return ErrVerificationInvalid
+		}
+		if current.Verified {
+			return ErrAlreadyVerified
+		}
+		affected, err := Users.Update(txApp, userId, Changeset{
+			"verified": true,
+			"updated":  types.NowDateTime().String(),
+		})
+		if err != nil {
+			return err
+		}
+		span.SetAttr("db.response.affected_rows", affected)
+		if user, err = GetUserById(txApp, userId); err != nil {
+			return err
+		}
+		return QueueUserEvent(txApp, EventUserUpdated, user)
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func HandleVerifyUser(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		token := e.Request.URL.Query().Get("token")
+		if token == "" {
+			return WriteBadRequest(e, "bad request: token is required", nil)
+		}
+
+		_, err := VerifyUser(app, cfg, token)
+		if errors.Is(err, ErrVerificationExpired) {
+			return WriteGone(e, err.Error(), nil)
+		}
+		if errors.Is(err, ErrVerificationInvalid) {
+			return WriteBadRequest(e, "bad request: "+err.Error(), nil)
+		}
+		if errors.Is(err, ErrAlreadyVerified) {
+			return WriteOK(e, "email already verified", nil)
+		}
+		if err != nil {
+			return WriteError(e, err, "error verifying user")
+		}
+		return WriteOK(e, "email verified", nil)
+	}
+}
+
+func HandleRequestVerification(app *pocketbase.PocketBase, cfg *Config) func(e *core.RequestEvent) error {
+	return func(e *core.RequestEvent) error {
+		app := WithTrace(app, e)
+		user, err := GetUserById(app, e.Request.PathValue("userId"))
+		if errors.Is(err, sql.ErrNoRows) {
+			return WriteErrorCode(e, CodeUserNotFound, "user not found", nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error getting user: "+err.Error(), nil)
+		}
+
+		err = SendVerificationEmail(app, cfg, user)
+		if errors.Is(err, ErrAlreadyVerified) {
+			return WriteConflict(e, err.Error(), nil)
+		}
+		if err != nil {
+			return WriteInternalServerError(e, "error sending verification email: "+err.Error(), nil)
+		}
+		return WriteOK(e, "a verification link was sent to "+user.Email, nil)
+	}
+}
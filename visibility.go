@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// CanSeeEmail reports whether the requester may see the user's email,
+// mirroring PocketBase's emailVisibility rule for auth collections. Every
+// handler returning users to non superusers must pass them through
+// RedactUser (or ProjectUser).
+func CanSeeEmail(e *core.RequestEvent, user models.User) bool {
+	if user.EmailVisibility || e.HasSuperuserAuth() {
+		return true
+	}
+	return e.Auth != nil && e.Auth.Id == user.Id
+}
+
+// RedactUser blanks the email of the user when the requester can't see it,
+// and the sensitive fields unless the requester is the user or a superuser.
+func RedactUser(e *core.RequestEvent, user models.User) models.User {
+	if !CanSeeEmail(e, user) {
+		user.Email = ""
+	}
+	if !e.HasSuperuserAuth() && (e.Auth == nil || e.Auth.Id != user.Id) {
+		user.Phone = ""
+		user.NationalId = ""
+	}
+	return user
+}
+
+// RedactUsers redacts every user of users, see RedactUser.
+func RedactUsers(e *core.RequestEvent, users []models.User) []models.User {
+	redacted := make([]models.User, len(users))
+	for i, user := range users {
+		redacted[i] = RedactUser(e, user)
+	}
+	return redacted
+}
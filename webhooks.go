@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EricFrancis12/pocketbase-demo/models"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhooks dispatches the user lifecycle events. It is nil until main
+// starts it, and dispatching to a nil dispatcher does nothing.
+var Webhooks *WebhookDispatcher
+
+// WebhookPayload is the JSON body POSTed to the webhook URLs.
+type WebhookPayload struct {
+	Id      string `json:"id"`
+	Event   string `json:"event"`
+	Created string `json:"created"`
+	Data    any    `json:"data"`
+}
+
+type WebhookOptions struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	Timeout     time.Duration
+}
+
+// WebhookDispatcher delivers the events to the URLs of the active webhooks
+// subscribed to them. Each delivery is logged in webhook_deliveries and
+// sent by a JobWebhookDelivery job, retried with exponential backoff until
+// it succeeds or runs out of attempts.
+type WebhookDispatcher struct {
+	app    core.App
+	opts   WebhookOptions
+	client *http.Client
+}
+
+// WebhookDeliveryJob is the payload of the JobWebhookDelivery jobs.
+type WebhookDeliveryJob struct {
+	DeliveryId string `json:"deliveryId"`
+}
+
+func NewWebhookDispatcher(app core.App, opts WebhookOptions) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		app:    app,
+		opts:   opts,
+		client: Downstream.Client(DependencyWebhooks, opts.Timeout),
+	}
+}
+
+// JobHandler returns the handler of the JobWebhookDelivery jobs, with the
+// attempts and backoff of the dispatcher.
+func (d *WebhookDispatcher) JobHandler() JobHandler {
+	return JobHandler{
+		Run:         d.runDeliveryJob,
+		MaxAttempts: d.opts.MaxAttempts,
+		BaseDelay:   d.opts.BaseDelay,
+	}
+}
+
+// Dispatch logs a pending delivery of event for every subscribed webhook
+// and queues them, returning the failures. Dispatching the event again
+// queues a delivery to every webhook again.
+func (d *WebhookDispatcher) Dispatch(event string, data any) error {
+	if d == nil {
+		return nil
+	}
+
+	hooks, err := d.app.FindRecordsByFilter("webhooks", "active = true && events ?= {:event}", "", 0, 0, dbx.Params{"event": event})
+	if err != nil {
+		return fmt.Errorf("error finding webhooks: %w", err)
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	deliveries, err := d.app.FindCachedCollectionByNameOrId("webhook_deliveries")
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, hook := range hooks {
+		delivery := core.NewRecord(deliveries)
+		delivery.Id = NewId(deliveries.Name)
+		payload, err := json.Marshal(WebhookPayload{
+			Id:      delivery.Id,
+			Event:   event,
+			Created: types.NowDateTime().String(),
+			Data:    data,
+		})
+		if err != nil {
+			return fmt.Errorf("error encoding webhook payload: %w", err)
+		}
+		delivery.Set("webhook", hook.Id)
+		delivery.Set("event", event)
+		delivery.Set("payload", types.JSONRaw(payload))
+		delivery.Set("status", DeliveryPending)
+		err = WithTx(d.app, func(txApp core.App) error {
+			if err := txApp.Save(delivery); err != nil {
+				return err
+			}
+			_, err := EnqueueJob(txApp, JobWebhookDelivery, WebhookDeliveryJob{DeliveryId: delivery.Id}, time.Now())
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error queuing delivery to webhook %s: %w", hook.Id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runDeliveryJob makes a single attempt at a delivery, marking it failed
+// once the job ran out of attempts.
+func (d *WebhookDispatcher) runDeliveryJob(ctx context.Context, app core.App, job *Job) error {
+	p := WebhookDeliveryJob{}
+	if err := DecodeJobPayload(job, &p); err != nil {
+		return err
+	}
+	delivery, err := app.FindRecordById("webhook_deliveries", p.DeliveryId)
+	if err != nil {
+		return err
+	}
+	if delivery.GetString("status") == DeliverySucceeded {
+		return nil
+	}
+	hook, err := app.FindRecordById("webhooks", delivery.GetString("webhook"))
+	if err != nil {
+		return err
+	}
+
+	payload, _ := delivery.Get("payload").(types.JSONRaw)
+	status, postErr := d.post(ctx, hook.GetString("url"), hook.GetString("secret"), delivery, payload)
+	if ctx.Err() != nil {
+		// interrupted by the shutdown, retried on the next start
+		return ctx.Err()
+	}
+	delivery.Set("attempts", delivery.GetInt("attempts")+1)
+	delivery.Set("response_status", status)
+	if postErr == nil {
+		delivery.Set("status", DeliverySucceeded)
+		delivery.Set("error", "")
+	} else {
+		delivery.Set("error", postErr.Error())
+		if job.Attempts >= job.MaxAttempts {
+			delivery.Set("status", DeliveryFailed)
+			Alerts.Notify(Alert{
+				Type:    AlertWebhookFailed,
+				Level:   AlertLevelWarning,
+				Title:   "Webhook delivery failed",
+				Message: postErr.Error(),
+				Key:     hook.Id,
+				Fields: []AlertField{
+					{Name: "Webhook", Value: hook.Id},
+					{Name: "Event", Value: delivery.GetString("event")},
+					{Name: "Attempts", Value: strconv.Itoa(delivery.GetInt("attempts"))},
+				},
+			})
+		} else {
+			delivery.Set("status", DeliveryPending)
+		}
+	}
+	if err := app.Save(delivery); err != nil {
+		return err
+	}
+	return postErr
+}
+
+// post sends a single attempt, signed with the webhook secret as
+// X-Webhook-Signature: sha256=hex(hmac(secret, timestamp + "." + body)).
+func (d *WebhookDispatcher) post(ctx context.Context, url string, secret string, delivery *core.Record, payload []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", delivery.Id)
+	req.Header.Set("X-Webhook-Event", delivery.GetString("event"))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+SignWebhookPayload([]byte(secret), timestamp, payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func SignWebhookPayload(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewWebhookSecret returns a random secret for webhooks created without one.
+func NewWebhookSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+// UserFromRecord converts a users record, e.g. one that was just deleted and
+// can't be read back anymore.
+// UserFromRecord converts a users record, leaving out the encrypted fields.
+func UserFromRecord(record *core.Record) models.User {
+	return models.User{
+		Id:              record.Id,
+		Email:           record.Email(),
+		EmailVisibility: record.EmailVisibility(),
+		Verified:        record.Verified(),
+		Name:            record.GetString("name"),
+		Avatar:          record.GetString("avatar"),
+		LastSeen:        record.GetString("lastSeen"),
+		Roles:           record.GetStringSlice("roles"),
+		LoginCount:      int64(record.GetInt("loginCount")),
+		Credits:         int64(record.GetInt("credits")),
+		Completeness:    int64(record.GetInt("completeness")),
+		TenantId:        record.GetString("tenant_id"),
+		Created:         record.GetString("created"),
+		Updated:         record.GetString("updated"),
+	}
+}
+
+// recordsAPIUsers are the users records being written through the records
+// API, whose events the Execute hooks of BindWebhookHooks queue.
+var recordsAPIUsers sync.Map
+
+// BindWebhookHooks queues the events of the users changed through the
+// PocketBase records API and the admin UI, in the transaction of the
+// change. The custom handlers queue their own, so the other writes of the
+// users records are left alone.
+func BindWebhookHooks(app core.App) {
+	app.OnRecordCreate("webhooks").BindFunc(func(e *core.RecordEvent) error {
+		if e.Record.GetString("secret") == "" {
+			e.Record.Set("secret", NewWebhookSecret())
+		}
+		return e.Next()
+	})
+
+	// the writes of the records API run in a transaction, which the
+	// Execute hooks get as e.App
+	inTx := func(e *core.RecordRequestEvent) error {
+		recordsAPIUsers.Store(e.Record, struct{}{})
+		defer recordsAPIUsers.Delete(e.Record)
+		return e.App.RunInTransaction(func(txApp core.App) error {
+			e.App = txApp
+			return e.Next()
+		})
+	}
+	app.OnRecordCreateRequest("users").BindFunc(inTx)
+	app.OnRecordUpdateRequest("users").BindFunc(inTx)
+	app.OnRecordDeleteRequest("users").BindFunc(inTx)
+
+	queue := func(event string) func(e *core.RecordEvent) error {
+		return func(e *core.RecordEvent) error {
+			if err := e.Next(); err != nil {
+				return err
+			}
+			if _, ok := recordsAPIUsers.Load(e.Record); !ok {
+				return nil
+			}
+			return QueueUserEvent(e.App, event, UserFromRecord(e.Record))
+		}
+	}
+	app.OnRecordCreateExecute("users").BindFunc(queue(EventUserCreated))
+	app.OnRecordUpdateExecute("users").BindFunc(queue(EventUserUpdated))
+	app.OnRecordDeleteExecute("users").BindFunc(queue(EventUserDeleted))
+}
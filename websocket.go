@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// webSocketGUID is hashed with the Sec-WebSocket-Key of the handshake into
+// the Sec-WebSocket-Accept of the response, see RFC 6455 section 1.3.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// The close codes sent to the clients, RFC 6455 section 7.4.1.
+const (
+	WSCloseNormal          = 1000
+	WSCloseGoingAway       = 1001
+	WSCloseProtocolError   = 1002
+	WSCloseUnsupportedData = 1003
+	WSClosePolicyViolation = 1008
+	WSCloseTooBig          = 1009
+)
+
+var (
+	ErrNotWebSocket     = errors.New("not a websocket handshake")
+	ErrWebSocketClosed  = errors.New("websocket closed")
+	ErrWebSocketTooBig  = errors.New("websocket message too big")
+	ErrWebSocketBinary  = errors.New("websocket binary messages are not supported")
+	ErrWebSocketFraming = errors.New("invalid websocket frame")
+)
+
+// WebSocket is a server side websocket connection, taken over from the
+// HTTP server by UpgradeWebSocket. It only exchanges text messages, which
+// is all the JSON protocols of the routes need. The reads must come from a
+// single goroutine, the writes can come from any.
+type WebSocket struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	// MaxMessageSize caps the messages read, fragments included.
+	MaxMessageSize int64
+	// ReadTimeout is the time the client has to send each frame, the pongs
+	// included, 0 for none.
+	ReadTimeout time.Duration
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+// UpgradeWebSocket checks the handshake of the request and switches its
+// connection to the websocket protocol. ErrNotWebSocket is returned before
+// anything is written, so that the route can still respond with an error.
+func UpgradeWebSocket(e *core.RequestEvent, maxMessageSize int64) (*WebSocket, error) {
+	r := e.Request
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != http.MethodGet:
+		return nil, fmt.Errorf("%w: method must be GET", ErrNotWebSocket)
+	case !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket"):
+		return nil, fmt.Errorf("%w: missing Upgrade: websocket", ErrNotWebSocket)
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		return nil, fmt.Errorf("%w: Sec-WebSocket-Version must be 13", ErrNotWebSocket)
+	case key == "":
+		return nil, fmt.Errorf("%w: missing Sec-WebSocket-Key", ErrNotWebSocket)
+	}
+
+	conn, rw, err := http.NewResponseController(e.Response).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// the server deadlines would cut the connection
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocket{conn: conn, rw: rw, MaxMessageSize: maxMessageSize}, nil
+}
+
+func headerHasToken(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text message, joining its fragments. The
+// pings are answered and the pongs skipped. A close from the client is
+// echoed and returned as ErrWebSocketClosed. The protocol errors close the
+// connection with the matching code before being returned.
+func (ws *WebSocket) ReadMessage() ([]byte, error) {
+	message := []byte{}
+	fragmented := false
+	for {
+		if ws.ReadTimeout > 0 {
+			if err := ws.conn.SetReadDeadline(time.Now().Add(ws.ReadTimeout)); err != nil {
+				return nil, err
+			}
+		}
+		fin, opcode, payload, err := ws.readFrame(int64(len(message)))
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := WSCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			ws.CloseWith(code, "")
+			return nil, ErrWebSocketClosed
+		case wsBinary:
+			ws.CloseWith(WSCloseUnsupportedData, "text messages only")
+			return nil, ErrWebSocketBinary
+		case wsText:
+			if fragmented {
+				return nil, ws.failFraming("unexpected text frame")
+			}
+		case wsContinuation:
+			if !fragmented {
+				return nil, ws.failFraming("unexpected continuation frame")
+			}
+		default:
+			return nil, ws.failFraming("unknown opcode")
+		}
+
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+		fragmented = true
+	}
+}
+
+// readFrame reads a frame, unmasking its payload. read is the size of the
+// fragments of the message read so far.
+func (ws *WebSocket) readFrame(read int64) (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.rw, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, ws.failFraming("reserved bits set")
+	}
+	// the clients must mask every frame, RFC 6455 section 5.1
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, ws.failFraming("unmasked frame")
+	}
+
+	size := int64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(ws.rw, ext); err != nil {
+			return false, 0, nil, err
+		}
+		size = int64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(ws.rw, ext); err != nil {
+			return false, 0, nil, err
+		}
+		size = int64(binary.BigEndian.Uint64(ext))
+	}
+	control := opcode&0x8 != 0
+	if control && (size > 125 || !fin) {
+		return false, 0, nil, ws.failFraming("invalid control frame")
+	}
+	if size < 0 || !control && ws.MaxMessageSize > 0 && read+size > ws.MaxMessageSize {
+		ws.CloseWith(WSCloseTooBig, "message too big")
+		return false, 0, nil, ErrWebSocketTooBig
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.rw, mask); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+func (ws *WebSocket) failFraming(reason string) error {
+	ws.CloseWith(WSCloseProtocolError, reason)
+	return fmt.Errorf("%w: %s", ErrWebSocketFraming, reason)
+}
+
+// writeFrame writes an unmasked, unfragmented frame, as the servers do.
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch size := len(payload); {
+	case size < 126:
+		header = append(header, byte(size))
+	case size <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(size))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(size))
+	}
+	if _, err := ws.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(payload); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+// WriteText sends a text message.
+func (ws *WebSocket) WriteText(data []byte) error {
+	return ws.writeFrame(wsText, data)
+}
+
+// Ping sends a ping, which the client answers with a pong that keeps the
+// connection within ReadTimeout.
+func (ws *WebSocket) Ping() error {
+	return ws.writeFrame(wsPing, nil)
+}
+
+// CloseWith sends a close frame with the code and reason, then closes the
+// connection. Only the first close does anything.
+func (ws *WebSocket) CloseWith(code int, reason string) {
+	ws.closeOnce.Do(func() {
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+		ws.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		ws.writeFrame(wsClose, append(payload, reason...))
+		ws.conn.Close()
+	})
+}
+
+// Close closes the connection normally.
+func (ws *WebSocket) Close() {
+	ws.CloseWith(WSCloseNormal, "")
+}